@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/client"
+	goFlags "github.com/jessevdk/go-flags"
+	"github.com/miekg/dns"
+)
+
+// BenchOptions are the arguments of the bench subcommand
+type BenchOptions struct {
+	// Servers to send the queries to, in the client.New syntax
+	Servers []string `short:"s" long:"server" description:"Server to send the queries to, e.g. 127.0.0.1:53, tcp://127.0.0.1:53, tls://127.0.0.1:853, https://127.0.0.1:443/dns-query, or quic://127.0.0.1:853. The queries are distributed between them evenly. Can be specified multiple times" default:"127.0.0.1:53"`
+
+	// Total queries per second
+	QPS int `long:"qps" description:"Total number of queries per second sent to all the servers" default:"100"`
+
+	// Duration of the test
+	Duration time.Duration `short:"d" long:"duration" description:"Duration of the test in a human-readable form" default:"10s"`
+
+	// Number of the concurrent requests per server
+	Concurrency int `short:"c" long:"concurrency" description:"Max number of concurrent requests to each server. The queries that can't be sent on time because of it are counted as skipped" default:"10"`
+
+	// Query names
+	Names []string `short:"n" long:"name" description:"Name to query. Can be specified multiple times" default:"example.org"`
+
+	// File with the query names
+	NamesFile string `long:"names-file" description:"Path to a file with the names to query, one per line. Used instead of --name"`
+
+	// Distribution of the query names
+	Distribution string `long:"distribution" description:"Distribution of the query names: uniform or zipf, where the first names are queried much more often like in the real traffic" default:"uniform"`
+
+	// Random subdomains to bypass the cache
+	RandomSubdomains bool `long:"random-subdomains" description:"Query a random subdomain of the name to bypass the cache" optional:"yes" optional-value:"true"`
+
+	// Query type
+	QType string `long:"qtype" description:"Type of the queries" default:"A"`
+
+	// Request timeout
+	Timeout time.Duration `long:"timeout" description:"Timeout of a request in a human-readable form" default:"2s"`
+
+	// Don't verify the server certificate
+	Insecure bool `long:"insecure" description:"Don't verify the certificates of the encrypted servers, e.g. the self-signed ones of the local listeners" optional:"yes" optional-value:"true"`
+
+	// Self-test thresholds
+	MaxErrorRate float64       `long:"max-error-rate" description:"Self-test mode: exit with code 1 if the share of the failed queries to any server, 0 to 1, is higher" default:"-1"`
+	MaxP99       time.Duration `long:"max-p99" description:"Self-test mode: exit with code 1 if the 99th percentile of the latency of any server is higher, in a human-readable form"`
+}
+
+// benchStats are the results of the queries to a server
+type benchStats struct {
+	c *client.Client
+
+	// sent and skipped are only changed by the sending goroutine
+	sent    int // queries sent
+	skipped int // queries not sent because all the workers were busy
+
+	lock      sync.Mutex
+	errors    int             // queries without a response
+	rcodes    map[int]int     // response codes
+	latencies []time.Duration // latencies of the responses
+}
+
+// add records the result of a query
+func (s *benchStats) add(res *dns.Msg, err error, latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err != nil {
+		s.errors++
+		return
+	}
+
+	s.rcodes[res.Rcode]++
+	s.latencies = append(s.latencies, latency)
+}
+
+// errorRate returns the share of the queries without a response or with
+// SERVFAIL
+func (s *benchStats) errorRate() float64 {
+	if s.sent == 0 {
+		return 0
+	}
+
+	return float64(s.errors+s.rcodes[dns.RcodeServerFailure]) / float64(s.sent)
+}
+
+// percentile returns the p-th percentile of the sorted latencies by the
+// nearest-rank method
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return sorted[i]
+}
+
+// report writes the results and returns an error if the self-test thresholds
+// are exceeded
+func (s *benchStats) report(w io.Writer, elapsed time.Duration, opts BenchOptions) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+
+	var rcodes []string
+	for rcode, n := range s.rcodes {
+		rcodes = append(rcodes, fmt.Sprintf("%s=%d", dns.RcodeToString[rcode], n))
+	}
+	sort.Strings(rcodes)
+
+	p99 := percentile(s.latencies, 99)
+	_, _ = fmt.Fprintf(w, "%s\n", s.c.Address())
+	_, _ = fmt.Fprintf(w, "  queries:   %d sent, %d skipped, %.1f per second\n",
+		s.sent, s.skipped, float64(s.sent)/elapsed.Seconds())
+	_, _ = fmt.Fprintf(w, "  responses: %d, %s\n", len(s.latencies), strings.Join(rcodes, " "))
+	_, _ = fmt.Fprintf(w, "  errors:    %d, error rate %.2f%% (including SERVFAIL)\n", s.errors, 100*s.errorRate())
+	_, _ = fmt.Fprintf(w, "  latency:   p50 %s, p90 %s, p99 %s, max %s\n",
+		percentile(s.latencies, 50), percentile(s.latencies, 90), p99, percentile(s.latencies, 100))
+
+	if opts.MaxErrorRate >= 0 && s.errorRate() > opts.MaxErrorRate {
+		return fmt.Errorf("%s: error rate %.4f is higher than %.4f", s.c.Address(), s.errorRate(), opts.MaxErrorRate)
+	}
+	if opts.MaxP99 > 0 && p99 > opts.MaxP99 {
+		return fmt.Errorf("%s: p99 latency %s is higher than %s", s.c.Address(), p99, opts.MaxP99)
+	}
+
+	return nil
+}
+
+// benchNames returns the names to query
+func benchNames(opts BenchOptions) ([]string, error) {
+	if opts.NamesFile == "" {
+		return opts.Names, nil
+	}
+
+	f, err := os.Open(opts.NamesFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name != "" && !strings.HasPrefix(name, "#") {
+			names = append(names, name)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no names in %s", opts.NamesFile)
+	}
+
+	return names, nil
+}
+
+// nameGenerator returns the function that returns the next name to query
+func nameGenerator(names []string, opts BenchOptions) (func() string, error) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	var next func() int
+	switch opts.Distribution {
+	case "uniform":
+		next = func() int { return r.Intn(len(names)) }
+	case "zipf":
+		if len(names) == 1 {
+			next = func() int { return 0 }
+			break
+		}
+		z := rand.NewZipf(r, 1.1, 1, uint64(len(names)-1))
+		next = func() int { return int(z.Uint64()) }
+	default:
+		return nil, fmt.Errorf("unknown distribution %q", opts.Distribution)
+	}
+
+	return func() string {
+		name := dns.Fqdn(names[next()])
+		if opts.RandomSubdomains {
+			name = strconv.FormatUint(r.Uint64(), 36) + "." + name
+		}
+
+		return name
+	}, nil
+}
+
+// runBench runs the bench subcommand with the arguments
+func runBench(args []string) error {
+	var opts BenchOptions
+	parser := goFlags.NewParser(&opts, goFlags.HelpFlag|goFlags.PassDoubleDash)
+	parser.Usage = "bench [OPTIONS]"
+	_, err := parser.ParseArgs(args)
+	if err != nil {
+		if flagsErr, ok := err.(*goFlags.Error); ok && flagsErr.Type == goFlags.ErrHelp {
+			fmt.Println(flagsErr.Message)
+			return nil
+		}
+		return err
+	}
+
+	if opts.QPS <= 0 || opts.Concurrency <= 0 || opts.Duration <= 0 {
+		return errors.New("--qps, --concurrency, and --duration must be positive")
+	}
+
+	qtype, ok := dns.StringToType[strings.ToUpper(opts.QType)]
+	if !ok {
+		return fmt.Errorf("unknown query type %q", opts.QType)
+	}
+
+	names, err := benchNames(opts)
+	if err != nil {
+		return fmt.Errorf("reading the names: %w", err)
+	}
+	nextName, err := nameGenerator(names, opts)
+	if err != nil {
+		return err
+	}
+
+	var stats []*benchStats
+	for _, addr := range opts.Servers {
+		c, cErr := client.New(addr, client.Options{Timeout: opts.Timeout, InsecureSkipVerify: opts.Insecure})
+		if cErr != nil {
+			return cErr
+		}
+		stats = append(stats, &benchStats{c: c, rcodes: map[int]int{}})
+	}
+
+	fmt.Printf("Sending %d queries per second to %d servers for %s\n", opts.QPS, len(stats), opts.Duration)
+	elapsed := bench(stats, opts, qtype, nextName)
+
+	var errs []string
+	for _, s := range stats {
+		if err = s.report(os.Stdout, elapsed, opts); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("self-test failed: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// bench sends the queries to the servers at the rate of opts.QPS for
+// opts.Duration and waits for the responses.  It returns the actual duration
+// of sending.  The load is open-loop: the queries aren't delayed by the slow
+// responses, they're skipped if all the workers of the server are busy.
+func bench(stats []*benchStats, opts BenchOptions, qtype uint16, nextName func() string) time.Duration {
+	var wg sync.WaitGroup
+	queues := make([]chan *dns.Msg, len(stats))
+	for i, s := range stats {
+		queues[i] = make(chan *dns.Msg)
+		for j := 0; j < opts.Concurrency; j++ {
+			wg.Add(1)
+			go func(s *benchStats, queue chan *dns.Msg) {
+				defer wg.Done()
+				for req := range queue {
+					start := time.Now()
+					res, err := s.c.Exchange(req)
+					s.add(res, err, time.Since(start))
+				}
+			}(s, queues[i])
+		}
+	}
+
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	start := time.Now()
+	var elapsed time.Duration
+	var n, total int
+	for now := range ticker.C {
+		elapsed = now.Sub(start)
+		if elapsed >= opts.Duration {
+			break
+		}
+
+		for total = int(elapsed.Seconds() * float64(opts.QPS)); n < total; n++ {
+			req := &dns.Msg{}
+			req.SetQuestion(nextName(), qtype)
+			req.RecursionDesired = true
+
+			i := n % len(stats)
+			select {
+			case queues[i] <- req:
+				stats[i].sent++
+			default:
+				stats[i].skipped++
+			}
+		}
+	}
+
+	for _, q := range queues {
+		close(q)
+	}
+	wg.Wait()
+
+	return elapsed
+}
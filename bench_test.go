@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	testCases := []struct {
+		name   string
+		sorted []time.Duration
+		p      float64
+		want   time.Duration
+	}{{
+		name:   "empty",
+		sorted: nil,
+		p:      50,
+		want:   0,
+	}, {
+		name:   "zero",
+		sorted: sorted,
+		p:      0,
+		want:   1,
+	}, {
+		name:   "median",
+		sorted: sorted,
+		p:      50,
+		want:   5,
+	}, {
+		name:   "nearest_rank",
+		sorted: sorted,
+		p:      91,
+		want:   10,
+	}, {
+		name:   "max",
+		sorted: sorted,
+		p:      100,
+		want:   10,
+	}, {
+		name:   "single",
+		sorted: []time.Duration{7},
+		p:      99,
+		want:   7,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, percentile(tc.sorted, tc.p))
+		})
+	}
+}
+
+func TestNameGenerator(t *testing.T) {
+	testCases := []struct {
+		name    string
+		names   []string
+		opts    BenchOptions
+		wantErr bool
+		want    []string
+	}{{
+		name:  "uniform",
+		names: []string{"example.org", "example.net."},
+		opts:  BenchOptions{Distribution: "uniform"},
+		want:  []string{"example.org.", "example.net."},
+	}, {
+		name:  "zipf",
+		names: []string{"example.org", "example.net", "example.com"},
+		opts:  BenchOptions{Distribution: "zipf"},
+		want:  []string{"example.org.", "example.net.", "example.com."},
+	}, {
+		name:  "zipf_single",
+		names: []string{"example.org"},
+		opts:  BenchOptions{Distribution: "zipf"},
+		want:  []string{"example.org."},
+	}, {
+		name:    "unknown",
+		names:   []string{"example.org"},
+		opts:    BenchOptions{Distribution: "normal"},
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			next, err := nameGenerator(tc.names, tc.opts)
+			if tc.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+
+			for i := 0; i < 100; i++ {
+				assert.Contains(t, tc.want, next())
+			}
+		})
+	}
+}
+
+func TestNameGeneratorRandomSubdomains(t *testing.T) {
+	next, err := nameGenerator([]string{"example.org"}, BenchOptions{
+		Distribution:     "uniform",
+		RandomSubdomains: true,
+	})
+	assert.Nil(t, err)
+
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		name := next()
+		assert.True(t, strings.HasSuffix(name, ".example.org."), name)
+		assert.Equal(t, 3, dns.CountLabel(name), name)
+		seen[name] = true
+	}
+	assert.Greater(t, len(seen), 1)
+}
+
+func TestBenchStatsErrorRate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		sent   int
+		errors int
+		rcodes map[int]int
+		want   float64
+	}{{
+		name: "nothing_sent",
+		want: 0,
+	}, {
+		name:   "no_errors",
+		sent:   10,
+		rcodes: map[int]int{dns.RcodeSuccess: 8, dns.RcodeNameError: 2},
+		want:   0,
+	}, {
+		name:   "errors",
+		sent:   10,
+		errors: 2,
+		rcodes: map[int]int{dns.RcodeSuccess: 8},
+		want:   0.2,
+	}, {
+		name:   "servfail",
+		sent:   10,
+		errors: 1,
+		rcodes: map[int]int{dns.RcodeSuccess: 6, dns.RcodeServerFailure: 3},
+		want:   0.4,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &benchStats{sent: tc.sent, errors: tc.errors, rcodes: tc.rcodes}
+			assert.InDelta(t, tc.want, s.errorRate(), 1e-9)
+		})
+	}
+}
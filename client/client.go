@@ -0,0 +1,184 @@
+// Package client is a small DNS client API for the tools that need to send
+// one-off requests over any transport supported by dnsproxy: plain DNS over
+// UDP and TCP, DNS-over-TLS, DNS-over-HTTPS, DNS-over-QUIC, and DNSCrypt.
+// Unlike the upstream package, it doesn't depend on the proxy's internals, so
+// its API is kept stable.
+package client
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// DefaultTimeout is the timeout of a request if Options.Timeout isn't set
+const DefaultTimeout = 10 * time.Second
+
+// Options are the settings of a Client
+type Options struct {
+	// Bootstrap are the plain DNS servers or the encrypted ones specified by
+	// their IP addresses the hostname of the server is resolved with.  If
+	// empty, the system resolver is used.
+	Bootstrap []string
+
+	// ServerIPs are the IP addresses of the server.  If set, its hostname
+	// isn't resolved at all.
+	ServerIPs []net.IP
+
+	// Timeout is the timeout of a request including the bootstrap.  If 0,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	// InsecureSkipVerify disables the verification of the server
+	// certificate of the encrypted transports
+	InsecureSkipVerify bool
+
+	// DNSSEC sets the DO bit in the requests made by Resolve and LookupIP
+	DNSSEC bool
+}
+
+// Client sends DNS requests to a single server.  It's safe for concurrent use
+// and keeps the connections to the server open between the requests, so it
+// should be reused.
+type Client struct {
+	u    upstream.Upstream
+	opts Options
+}
+
+// New creates a new Client for the server address, e.g.:
+//
+//	8.8.8.8:53                         plain DNS over UDP
+//	tcp://8.8.8.8:53                   plain DNS over TCP
+//	tls://dns.adguard.com              DNS-over-TLS
+//	https://dns.adguard.com/dns-query  DNS-over-HTTPS
+//	quic://dns.adguard.com             DNS-over-QUIC
+//	sdns://...                         DNS stamp, e.g. of a DNSCrypt server
+func New(address string, opts Options) (*Client, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	u, err := upstream.AddressToUpstream(address, upstream.Options{
+		Bootstrap:          opts.Bootstrap,
+		ServerIPAddrs:      opts.ServerIPs,
+		Timeout:            opts.Timeout,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating client for %s: %w", address, err)
+	}
+
+	return &Client{u: u, opts: opts}, nil
+}
+
+// Address returns the address of the server
+func (c *Client) Address() string {
+	return c.u.Address()
+}
+
+// Exchange sends the request to the server and returns its response
+func (c *Client) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	res, err := c.u.Exchange(req)
+	if err != nil {
+		return nil, fmt.Errorf("exchanging with %s: %w", c.u.Address(), err)
+	}
+
+	return res, nil
+}
+
+// Resolve sends the recursive request for the name and the type to the server
+// and returns its response.  The response with any response code is returned
+// without an error.
+func (c *Client) Resolve(name string, qtype uint16) (*dns.Msg, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.RecursionDesired = true
+	if c.opts.DNSSEC {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	return c.Exchange(req)
+}
+
+// RcodeError is returned by LookupIP when the server answers with a response
+// code other than NOERROR
+type RcodeError struct {
+	Name  string
+	Rcode int
+}
+
+// Error implements the error interface for *RcodeError
+func (e *RcodeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, dns.RcodeToString[e.Rcode])
+}
+
+// LookupIP resolves the IPv4 and the IPv6 addresses of the host in parallel.
+// It returns an error if either request fails, e.g. with *RcodeError.
+func (c *Client) LookupIP(host string) ([]net.IP, error) {
+	type result struct {
+		ips []net.IP
+		err error
+	}
+
+	ch := make(chan result, 2)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		go func(qtype uint16) {
+			ips, err := c.lookup(host, qtype)
+			ch <- result{ips: ips, err: err}
+		}(qtype)
+	}
+
+	var ips []net.IP
+	var err error
+	for i := 0; i < 2; i++ {
+		r := <-ch
+		if r.err != nil {
+			err = r.err
+		}
+		ips = append(ips, r.ips...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ips, nil
+}
+
+// lookup returns the addresses of the host of the type qtype, either A or
+// AAAA
+func (c *Client) lookup(host string, qtype uint16) ([]net.IP, error) {
+	res, err := c.Resolve(host, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Rcode != dns.RcodeSuccess {
+		return nil, &RcodeError{Name: host, Rcode: res.Rcode}
+	}
+
+	var ips []net.IP
+	for _, rr := range res.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+
+	return ips, nil
+}
+
+// Resolve sends a single recursive request for the name and the type to the
+// server at address.  Use New to send several ones.
+func Resolve(address, name string, qtype uint16, opts Options) (*dns.Msg, error) {
+	c, err := New(address, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Resolve(name, qtype)
+}
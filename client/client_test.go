@@ -0,0 +1,99 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestServer starts a plain DNS server that answers example.org with
+// 192.0.2.1 and 2001:db8::1 and the other names with NXDOMAIN.  The DO bits
+// of the requests are sent to do.
+func startTestServer(t *testing.T) (srv *dns.Server, addr string, do chan bool) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	do = make(chan bool, 4)
+	srv = &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			opt := req.IsEdns0()
+			do <- opt != nil && opt.Do()
+
+			res := &dns.Msg{}
+			res.SetReply(req)
+			q := req.Question[0]
+			hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+			switch {
+			case q.Name != "example.org.":
+				res.Rcode = dns.RcodeNameError
+			case q.Qtype == dns.TypeA:
+				res.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IP{192, 0, 2, 1}}}
+			case q.Qtype == dns.TypeAAAA:
+				res.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")}}
+			}
+			_ = w.WriteMsg(res)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+
+	return srv, conn.LocalAddr().String(), do
+}
+
+func TestClient(t *testing.T) {
+	srv, addr, do := startTestServer(t)
+	defer func() { _ = srv.Shutdown() }()
+
+	c, err := New(addr, Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	assert.Equal(t, addr, c.Address())
+
+	res, err := c.Resolve("example.org", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Len(t, res.Answer, 1)
+	assert.False(t, <-do)
+
+	// The negative responses aren't errors
+	res, err = c.Resolve("example.net", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+	<-do
+
+	ips, err := c.LookupIP("example.org")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []net.IP{net.IP{192, 0, 2, 1}, net.ParseIP("2001:db8::1")}, ips)
+	<-do
+	<-do
+
+	// But they're errors for LookupIP
+	_, err = c.LookupIP("example.net")
+	var rcodeErr *RcodeError
+	if assert.True(t, errors.As(err, &rcodeErr)) {
+		assert.Equal(t, dns.RcodeNameError, rcodeErr.Rcode)
+	}
+	<-do
+	<-do
+
+	res, err = Resolve(addr, "example.org", dns.TypeAAAA, Options{DNSSEC: true})
+	assert.Nil(t, err)
+	assert.Len(t, res.Answer, 1)
+	assert.True(t, <-do)
+}
+
+func TestClientInvalid(t *testing.T) {
+	_, err := New("bad://example.org", Options{})
+	assert.NotNil(t, err)
+
+	// Nothing is listening there
+	c, err := New("tcp://127.0.0.1:1", Options{Timeout: 100 * time.Millisecond})
+	assert.Nil(t, err)
+	_, err = c.Resolve("example.org", dns.TypeA)
+	assert.NotNil(t, err)
+}
@@ -1,18 +1,17 @@
 package fastip
 
 import (
+	"bytes"
 	"encoding/binary"
 	"net"
+	"sort"
 	"time"
 )
 
-const (
-	fastestAddrCacheTTLSec = 10 * 60 // cache TTL for IP addresses
-)
-
 type cacheEntry struct {
 	status      int //0:ok; 1:timed out
 	latencyMsec uint
+	expire      uint32 // expiration time, in seconds since the epoch
 }
 
 // packCacheEntry - packss cache entry + ttl to bytes
@@ -44,7 +43,7 @@ func unpackCacheEntry(data []byte) *cacheEntry {
 	if int64(expire) <= now {
 		return nil
 	}
-	ent := cacheEntry{}
+	ent := cacheEntry{expire: expire}
 	i := 4
 
 	ent.status = int(data[i])
@@ -77,7 +76,7 @@ func (f *FastestAddr) cacheAddFailure(addr net.IP) {
 	ent.status = 1
 	f.cacheLock.Lock()
 	if f.cacheFind(addr) == nil {
-		f.cacheAdd(&ent, addr, fastestAddrCacheTTLSec)
+		f.cacheAdd(&ent, addr, f.cacheTTL)
 	}
 	f.cacheLock.Unlock()
 }
@@ -91,7 +90,7 @@ func (f *FastestAddr) cacheAddSuccessful(addr net.IP, latency uint) {
 	f.cacheLock.Lock()
 	entCached := f.cacheFind(addr)
 	if entCached == nil || entCached.status != 0 || entCached.latencyMsec > latency {
-		f.cacheAdd(&ent, addr, fastestAddrCacheTTLSec)
+		f.cacheAdd(&ent, addr, f.cacheTTL)
 	}
 	f.cacheLock.Unlock()
 }
@@ -100,9 +99,61 @@ func (f *FastestAddr) cacheAddSuccessful(addr net.IP, latency uint) {
 func (f *FastestAddr) cacheAdd(ent *cacheEntry, addr net.IP, ttl uint32) {
 	ip := getCacheKey(addr)
 	val := packCacheEntry(ent, ttl)
+
+	f.keysLock.Lock()
+	f.keys[string(ip)] = struct{}{}
+	f.keysLock.Unlock()
+
 	f.cache.Set(ip, val)
 }
 
+// Result is the cached result of probing an IP address
+type Result struct {
+	IP          net.IP    `json:"ip"`
+	Success     bool      `json:"success"`
+	LatencyMsec uint      `json:"latency_msec"`
+	Expires     time.Time `json:"expires"`
+}
+
+// Results returns the cached probing results that haven't expired: the
+// successful ones from the fastest to the slowest, and then the failed ones
+func (f *FastestAddr) Results() []Result {
+	f.keysLock.Lock()
+	keys := make([]net.IP, 0, len(f.keys))
+	for k := range f.keys {
+		keys = append(keys, net.IP(k))
+	}
+	f.keysLock.Unlock()
+
+	var results []Result
+	for _, ip := range keys {
+		ent := f.cacheFind(ip)
+		if ent == nil {
+			continue
+		}
+
+		results = append(results, Result{
+			IP:          ip,
+			Success:     ent.status == 0,
+			LatencyMsec: ent.latencyMsec,
+			Expires:     time.Unix(int64(ent.expire), 0),
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		ri, rj := results[i], results[j]
+		if ri.Success != rj.Success {
+			return ri.Success
+		}
+		if ri.Success && ri.LatencyMsec != rj.LatencyMsec {
+			return ri.LatencyMsec < rj.LatencyMsec
+		}
+		return bytes.Compare(ri.IP, rj.IP) < 0
+	})
+
+	return results
+}
+
 // getCacheKey - gets cache key (compresses ipv4 to 4 bytes)
 func getCacheKey(addr net.IP) net.IP {
 	ip := addr.To4()
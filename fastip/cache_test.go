@@ -15,7 +15,7 @@ func TestCacheAdd(t *testing.T) {
 		latencyMsec: 111,
 	}
 	ip := net.ParseIP("1.1.1.1")
-	f.cacheAdd(&ent, ip, fastestAddrCacheTTLSec)
+	f.cacheAdd(&ent, ip, f.cacheTTL)
 
 	// check that it's there
 	assert.NotNil(t, f.cacheFind(ip))
@@ -95,5 +95,5 @@ func TestCache(t *testing.T) {
 		status:      0,
 		latencyMsec: 222,
 	}
-	f.cacheAdd(&ent, net.ParseIP("2.2.2.2"), fastestAddrCacheTTLSec)
+	f.cacheAdd(&ent, net.ParseIP("2.2.2.2"), f.cacheTTL)
 }
@@ -2,8 +2,10 @@ package fastip
 
 import (
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 
@@ -13,25 +15,67 @@ import (
 	"github.com/miekg/dns"
 )
 
+// DefaultCacheTTL is the time the probing results are cached for if
+// Config.CacheTTL isn't set
+const DefaultCacheTTL = 10 * time.Minute
+
+// Config is the configuration of FastestAddr
+type Config struct {
+	// Probers check every IP address in parallel, the first successful
+	// probe determines the address's latency.  If empty, DefaultProbers are
+	// used.
+	Probers []Prober
+
+	// CacheTTL is the time the probing results are cached for.  If 0,
+	// DefaultCacheTTL is used.
+	CacheTTL time.Duration
+}
+
 // FastestAddr - object data
 type FastestAddr struct {
 	cache     glcache.Cache // cache of the fastest IP addresses
 	cacheLock sync.Mutex    // for atomic find-and-store cache operation
-	allowTCP  bool          // connect via TCP
-	tcpPorts  []uint        // TCP ports we're using to check connection speed
+	cacheTTL  uint32        // TTL of the cached results, in seconds
+	probers   []Prober      // probers we're using to check connection speed
+
+	// keys is the index of the cache keys, since the cache can't be
+	// iterated, see Results
+	keys     map[string]struct{}
+	keysLock sync.Mutex
 }
 
-// NewFastestAddr initializes a new instance of the FastestAddr
+// NewFastestAddr initializes a new instance of the FastestAddr with the
+// default configuration
 func NewFastestAddr() *FastestAddr {
-	conf := glcache.Config{
-		MaxSize:   64 * 1024,
-		EnableLRU: true,
+	return NewFastestAddrWithConfig(Config{})
+}
+
+// NewFastestAddrWithConfig initializes a new instance of the FastestAddr
+func NewFastestAddrWithConfig(c Config) *FastestAddr {
+	f := &FastestAddr{
+		cacheTTL: uint32(DefaultCacheTTL / time.Second),
+		probers:  DefaultProbers,
+		keys:     map[string]struct{}{},
 	}
-	return &FastestAddr{
-		cache:    glcache.New(conf),
-		allowTCP: true,
-		tcpPorts: []uint{80, 443},
+	if c.CacheTTL >= time.Second {
+		f.cacheTTL = uint32(c.CacheTTL / time.Second)
 	}
+	if len(c.Probers) != 0 {
+		f.probers = c.Probers
+	}
+
+	f.cache = glcache.New(glcache.Config{
+		MaxSize:   64 * 1024,
+		EnableLRU: true,
+		OnDelete: func(k, _ []byte) {
+			f.keysLock.Lock()
+			defer f.keysLock.Unlock()
+
+			delete(f.keys, string(k))
+		},
+	})
+
+	return f
 }
 
 // ExchangeFastest queries all specified upstreams and returns a response with the fastest IP address.
@@ -45,16 +89,22 @@ func NewFastestAddr() *FastestAddr {
 //   . If all addresses have been found: choose the fastest
 //   . If several (but not all) addresses have been found: remember the fastest
 // . For each response, for each IP address (not found in cache):
-//   . connect via TCP
-// . Receive TCP connection status.  The first connected address - the fastest IP address.
+//   . probe it with each of the probers in parallel, e.g. connect via TCP
+// . Receive the probe results.  The first probed address - the fastest IP address.
 // . Choose the fastest address between this and the one previously found in cache
 // . Return DNS packet containing the chosen IP address (remove all other IP addresses from the packet)
+//
+// The upstreams are in the order of preference: if several of them return the
+// fastest IP address or none of the addresses responds, the response of the
+// first one is used.
 func (f *FastestAddr) ExchangeFastest(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
 	replies, err := upstream.ExchangeAll(upstreams, req)
 	if err != nil || len(replies) == 0 {
 		return nil, nil, err
 	}
 
+	sortReplies(replies, upstreams)
+
 	host := strings.ToLower(req.Question[0].Name)
 	ips := f.getIPAddresses(replies)
 	found, pingRes := f.pingAll(host, ips)
@@ -78,6 +128,7 @@ func (f *FastestAddr) prepareReply(pingRes *pingResult, replies []upstream.Excha
 	var m *dns.Msg
 	var u upstream.Upstream
 
+replies:
 	for _, r := range replies {
 		for _, rr := range r.Resp.Answer {
 			ip := proxyutil.GetIPFromDNSRecord(rr)
@@ -85,7 +136,7 @@ func (f *FastestAddr) prepareReply(pingRes *pingResult, replies []upstream.Excha
 				// Found it!
 				m = r.Resp
 				u = r.Upstream
-				break
+				break replies
 			}
 		}
 	}
@@ -122,6 +173,18 @@ func (f *FastestAddr) prepareReply(pingRes *pingResult, replies []upstream.Excha
 	return m, u, nil
 }
 
+// sortReplies sorts the replies in the order of their upstreams
+func sortReplies(replies []upstream.ExchangeAllResult, upstreams []upstream.Upstream) {
+	order := make(map[upstream.Upstream]int, len(upstreams))
+	for i, u := range upstreams {
+		order[u] = i
+	}
+
+	sort.SliceStable(replies, func(i, j int) bool {
+		return order[replies[i].Upstream] < order[replies[j].Upstream]
+	})
+}
+
 // getIPAddresses -- extracts all IP addresses from the list of upstream.ExchangeAllResult
 func (f *FastestAddr) getIPAddresses(results []upstream.ExchangeAllResult) []net.IP {
 	var ips []net.IP
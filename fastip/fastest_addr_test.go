@@ -18,7 +18,7 @@ func TestFastestAddrOneDeadIP(t *testing.T) {
 	defer listener.Close()
 
 	f := NewFastestAddr()
-	f.tcpPorts = []uint{uint(listener.Addr().(*net.TCPAddr).Port)}
+	f.probers = tcpProbers(uint(listener.Addr().(*net.TCPAddr).Port))
 	up1 := &testUpstream{}
 	up2 := &testUpstream{}
 
@@ -50,7 +50,7 @@ func TestFastestAddrOneFaster(t *testing.T) {
 	defer listener.Close()
 
 	f := NewFastestAddr()
-	f.tcpPorts = []uint{443, uint(listener.Addr().(*net.TCPAddr).Port)}
+	f.probers = tcpProbers(443, uint(listener.Addr().(*net.TCPAddr).Port))
 	up1 := &testUpstream{}
 	up2 := &testUpstream{}
 
@@ -78,7 +78,7 @@ func TestFastestAddrOneFaster(t *testing.T) {
 // . The algorithm returns "127.0.0.1"
 func TestFastestAddrAllDead(t *testing.T) {
 	f := NewFastestAddr()
-	f.tcpPorts = []uint{getFreePort()}
+	f.probers = tcpProbers(getFreePort())
 	up1 := &testUpstream{}
 
 	up1.addARec("test.org.", "127.0.0.1")
@@ -93,6 +93,25 @@ func TestFastestAddrAllDead(t *testing.T) {
 	assert.Equal(t, "127.0.0.1", ip)
 }
 
+// . Upstream servers return "127.0.0.2" and "127.0.0.3": both are dead
+// . The algorithm returns the response of the first upstream in the list
+func TestFastestAddrUpstreamOrder(t *testing.T) {
+	f := NewFastestAddr()
+	f.probers = tcpProbers(getFreePort())
+	up1 := &testUpstream{}
+	up1.addARec("test.org.", "127.0.0.2")
+	up2 := &testUpstream{}
+	up2.addARec("test.org.", "127.0.0.3")
+
+	for _, ups := range [][]upstream.Upstream{{up1, up2}, {up2, up1}} {
+		for i := 0; i < 10; i++ {
+			_, up, err := f.ExchangeFastest(createHostTestMessage("test.org"), ups)
+			assert.Nil(t, err)
+			assert.Equal(t, ups[0], up)
+		}
+	}
+}
+
 type testUpstream struct {
 	aRespArr []*dns.A
 }
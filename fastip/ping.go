@@ -2,7 +2,6 @@ package fastip
 
 import (
 	"net"
-	"strconv"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -13,16 +12,16 @@ import (
 // we ignore all scheduled ping checks and return what we have
 const pingWaitTimeout = 1 * time.Second
 
-// TCP connection timeout. Note that it's higher that pingWaitTimeout
-// If the connection really takes more than "pingWaitTimeout" to succeed,
+// Probe timeout. Note that it's higher that pingWaitTimeout
+// If the probe really takes more than "pingWaitTimeout" to succeed,
 // it will be ignored at first. However, we will record it to the cache
 // and consider the IP address next time it's checked.
-const pingTCPTimeout = 10 * time.Second
+const pingProbeTimeout = 10 * time.Second
 
 // pingResult - represents the ping result
 type pingResult struct {
 	ip      net.IP // ip address
-	tcpPort uint   // tcp port that was probed
+	prober  Prober // prober that was used
 	latency uint   // ip latency (milliseconds)
 	success bool   // if true -- the ping operation was successful
 }
@@ -37,7 +36,7 @@ func (f *FastestAddr) pingAll(host string, ips []net.IP) (bool, *pingResult) {
 	}
 
 	// channel that we will use to get the ping result
-	ch := make(chan *pingResult, len(ips)*len(f.tcpPorts))
+	ch := make(chan *pingResult, len(ips)*len(f.probers))
 
 	// fastest cached address
 	var fCached *pingResult
@@ -50,9 +49,9 @@ func (f *FastestAddr) pingAll(host string, ips []net.IP) (bool, *pingResult) {
 		cached := f.cacheFind(ip)
 		if cached == nil {
 			// start async ping checks
-			for _, port := range f.tcpPorts {
+			for _, prober := range f.probers {
 				// async ping the specified IP
-				go f.pingDoTCP(host, ip, port, ch)
+				go f.pingDo(host, ip, prober, ch)
 				scheduled++
 			}
 
@@ -113,25 +112,24 @@ func (f *FastestAddr) pingAll(host string, ips []net.IP) (bool, *pingResult) {
 	return fCached != nil, fCached
 }
 
-// pingDoTCP - connects to the specified IP:port and writes result to the channel
-func (f *FastestAddr) pingDoTCP(host string, ip net.IP, port uint, ch chan *pingResult) {
+// pingDo - probes the specified IP with the prober and writes result to the channel
+func (f *FastestAddr) pingDo(host string, ip net.IP, prober Prober, ch chan *pingResult) {
 	res := &pingResult{
 		ip:      ip,
-		tcpPort: port,
+		prober:  prober,
 		success: true,
 	}
 
-	log.Debug("pingDoTCP: %s: connecting to %s:%d", host, ip, port)
+	log.Debug("pingDo: %s: probing %s with %s", host, ip, prober)
 
 	start := time.Now()
-	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
-	conn, err := net.DialTimeout("tcp", addr, pingTCPTimeout)
+	err := prober.Probe(ip, pingProbeTimeout)
 
 	// regardless of the result, save elapsed ms
 	res.latency = uint(time.Since(start).Milliseconds())
 
 	if err != nil {
-		log.Debug("pingDoTCP: %s: failed to connect to %s:%d, elapsed %d ms: %v", host, ip, port, res.latency, err)
+		log.Debug("pingDo: %s: failed to probe %s with %s, elapsed %d ms: %v", host, ip, prober, res.latency, err)
 
 		res.success = false
 		f.cacheAddFailure(ip)
@@ -141,8 +139,7 @@ func (f *FastestAddr) pingDoTCP(host string, ip net.IP, port uint, ch chan *ping
 		return
 	}
 
-	log.Debug("pingDoTCP: %s: elapsed %d ms on %s:%d", host, res.latency, ip, port)
-	_ = conn.Close()
+	log.Debug("pingDo: %s: elapsed %d ms on %s with %s", host, res.latency, ip, prober)
 	f.cacheAddSuccessful(ip, res.latency)
 	ch <- res
 }
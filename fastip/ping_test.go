@@ -18,7 +18,7 @@ func TestPingSuccess(t *testing.T) {
 	defer listener.Close()
 
 	f := NewFastestAddr()
-	f.tcpPorts = []uint{port}
+	f.probers = tcpProbers(port)
 
 	found, res := f.pingAll("test", []net.IP{ip})
 	assert.True(t, found)
@@ -38,7 +38,7 @@ func TestPingFail(t *testing.T) {
 	port := uint(getFreePort())
 
 	f := NewFastestAddr()
-	f.tcpPorts = []uint{port}
+	f.probers = tcpProbers(port)
 
 	found, res := f.pingAll("test", []net.IP{ip})
 	assert.False(t, found)
@@ -66,7 +66,7 @@ func TestPingFastest(t *testing.T) {
 	defer listener.Close()
 
 	f := NewFastestAddr()
-	f.tcpPorts = []uint{port, 443}
+	f.probers = tcpProbers(port, 443)
 
 	// test ips
 	ips := []net.IP{ip}
@@ -0,0 +1,208 @@
+package fastip
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// Prober checks the connection to an IP address.  The latency of the address
+// is the time its Probe call takes.  The probers must be safe for concurrent
+// use.
+type Prober interface {
+	// Probe connects to ip and returns an error if it isn't reachable
+	// within timeout
+	Probe(ip net.IP, timeout time.Duration) error
+
+	// String returns the name of the prober, e.g. "tcp:443"
+	String() string
+}
+
+// DefaultProbers are the probers used if none are configured: TCP
+// connections to the ports 80 and 443
+var DefaultProbers = []Prober{&TCPProber{Port: 80}, &TCPProber{Port: 443}}
+
+// ParseProber parses the prober name: "icmp", "tcp:port", or "quic[:port]",
+// the default QUIC port is 443
+func ParseProber(s string) (Prober, error) {
+	name, portStr := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		name, portStr = s[:i], s[i+1:]
+	}
+
+	var port uint64
+	if portStr != "" {
+		var err error
+		port, err = strconv.ParseUint(portStr, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid prober %q: bad port", s)
+		}
+	}
+
+	switch name {
+	case "icmp":
+		if portStr != "" {
+			return nil, fmt.Errorf("invalid prober %q: icmp has no port", s)
+		}
+		return &ICMPProber{}, nil
+	case "tcp":
+		if portStr == "" {
+			return nil, fmt.Errorf("invalid prober %q: tcp requires a port", s)
+		}
+		return &TCPProber{Port: uint(port)}, nil
+	case "quic":
+		if portStr == "" {
+			port = 443
+		}
+		return &QUICProber{Port: uint(port)}, nil
+	default:
+		return nil, fmt.Errorf("invalid prober %q: unknown type %q", s, name)
+	}
+}
+
+// TCPProber establishes a TCP connection to the port.  Note that the
+// middleboxes transparently proxying the port, e.g. 443, answer for any
+// address, so the result may be wrong on such networks.
+type TCPProber struct {
+	Port uint
+}
+
+// Probe implements the Prober interface for *TCPProber
+func (p *TCPProber) Probe(ip net.IP, timeout time.Duration) error {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(p.Port)))
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// String implements the Prober interface for *TCPProber
+func (p *TCPProber) String() string {
+	return "tcp:" + strconv.Itoa(int(p.Port))
+}
+
+// QUICProber completes a QUIC handshake with the HTTP/3 server on the port.
+// The certificate isn't verified.
+type QUICProber struct {
+	Port uint
+}
+
+// Probe implements the Prober interface for *QUICProber
+func (p *QUICProber) Probe(ip net.IP, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(p.Port)))
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec // only the handshake time matters
+		NextProtos:         []string{"h3", "h3-29"},
+	}
+	session, err := quic.DialAddrContext(ctx, addr, tlsConfig, &quic.Config{HandshakeTimeout: timeout})
+	if err != nil {
+		return err
+	}
+
+	return session.CloseWithError(0, "")
+}
+
+// String implements the Prober interface for *QUICProber
+func (p *QUICProber) String() string {
+	return "quic:" + strconv.Itoa(int(p.Port))
+}
+
+// ICMP echo message types
+const (
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// ICMPProber sends an ICMP echo request and waits for the reply.  It requires
+// the privilege to open raw sockets, e.g. CAP_NET_RAW on Linux.
+type ICMPProber struct{}
+
+// Probe implements the Prober interface for *ICMPProber
+func (p *ICMPProber) Probe(ip net.IP, timeout time.Duration) error {
+	network, reqType, replyType := "ip4:icmp", byte(icmpv4EchoRequest), byte(icmpv4EchoReply)
+	if ip.To4() == nil {
+		network, reqType, replyType = "ip6:ipv6-icmp", icmpv6EchoRequest, icmpv6EchoReply
+	}
+
+	conn, err := net.ListenPacket(network, "")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	// The ID and the sequence number tell our reply from the other ones
+	// every raw socket receives
+	id, seq := uint16(rand.Uint32()), uint16(rand.Uint32())
+	_, err = conn.WriteTo(icmpEcho(reqType, id, seq), &net.IPAddr{IP: ip})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		if n >= 8 && buf[0] == replyType &&
+			binary.BigEndian.Uint16(buf[4:]) == id &&
+			binary.BigEndian.Uint16(buf[6:]) == seq &&
+			from.(*net.IPAddr).IP.Equal(ip) {
+			return nil
+		}
+	}
+}
+
+// String implements the Prober interface for *ICMPProber
+func (p *ICMPProber) String() string {
+	return "icmp"
+}
+
+// icmpEcho returns the ICMP echo request message.  The checksum of the
+// ICMPv6 one is calculated by the kernel.
+func icmpEcho(typ byte, id, seq uint16) []byte {
+	msg := make([]byte, 8)
+	msg[0] = typ
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+
+	if typ == icmpv4EchoRequest {
+		binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	}
+
+	return msg
+}
+
+// icmpChecksum returns the Internet checksum of the message (RFC 1071)
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(msg[i:]))
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
@@ -0,0 +1,112 @@
+package fastip
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tcpProbers returns the TCP probers of the ports
+func tcpProbers(ports ...uint) []Prober {
+	var probers []Prober
+	for _, port := range ports {
+		probers = append(probers, &TCPProber{Port: port})
+	}
+
+	return probers
+}
+
+// testProber answers the probes of the addresses after their delays and
+// fails the other ones
+type testProber struct {
+	delays map[string]time.Duration
+}
+
+// Probe implements the Prober interface for *testProber
+func (p *testProber) Probe(ip net.IP, _ time.Duration) error {
+	d, ok := p.delays[ip.String()]
+	if !ok {
+		return errors.New("unreachable")
+	}
+
+	time.Sleep(d)
+	return nil
+}
+
+// String implements the Prober interface for *testProber
+func (p *testProber) String() string {
+	return "test"
+}
+
+func TestParseProber(t *testing.T) {
+	for s, want := range map[string]Prober{
+		"icmp":      &ICMPProber{},
+		"tcp:443":   &TCPProber{Port: 443},
+		"quic":      &QUICProber{Port: 443},
+		"quic:8443": &QUICProber{Port: 8443},
+	} {
+		p, err := ParseProber(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, want, p, s)
+		assert.Equal(t, want.String(), p.String(), s)
+	}
+
+	for _, s := range []string{"", "tcp", "tcp:0", "tcp:65536", "icmp:1", "udp:53"} {
+		_, err := ParseProber(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestICMPEcho(t *testing.T) {
+	msg := icmpEcho(icmpv4EchoRequest, 0x1234, 0x0001)
+	assert.Equal(t, []byte{8, 0, 0xe5, 0xca, 0x12, 0x34, 0, 1}, msg)
+
+	// The checksum of the message with its checksum is 0
+	assert.Equal(t, uint16(0), icmpChecksum(msg))
+
+	// The kernel calculates the ICMPv6 one
+	msg = icmpEcho(icmpv6EchoRequest, 0x1234, 0x0001)
+	assert.Equal(t, []byte{128, 0, 0, 0, 0x12, 0x34, 0, 1}, msg)
+}
+
+func TestProbers(t *testing.T) {
+	fast, slow := net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}
+	dead := net.IP{192, 0, 2, 3}
+	f := NewFastestAddrWithConfig(Config{
+		Probers: []Prober{&testProber{delays: map[string]time.Duration{
+			fast.String(): 0,
+			slow.String(): 200 * time.Millisecond,
+		}}},
+		CacheTTL: time.Hour,
+	})
+
+	found, res := f.pingAll("test", []net.IP{slow, dead, fast})
+	assert.True(t, found)
+	assert.Equal(t, fast, res.ip)
+	assert.Equal(t, "test", res.prober.String())
+
+	// Wait for the other probes to be cached
+	time.Sleep(300 * time.Millisecond)
+
+	results := f.Results()
+	if assert.Len(t, results, 3) {
+		assert.Equal(t, fast.To4(), results[0].IP)
+		assert.True(t, results[0].Success)
+		assert.Equal(t, slow.To4(), results[1].IP)
+		assert.True(t, results[1].Success)
+		assert.Equal(t, dead.To4(), results[2].IP)
+		assert.False(t, results[2].Success)
+
+		ttl := time.Until(results[0].Expires)
+		assert.True(t, ttl > 59*time.Minute && ttl <= time.Hour, ttl)
+	}
+}
+
+func TestDefaultProbers(t *testing.T) {
+	f := NewFastestAddr()
+	assert.Equal(t, DefaultProbers, f.probers)
+	assert.Equal(t, uint32(DefaultCacheTTL/time.Second), f.cacheTTL)
+}
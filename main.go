@@ -2,14 +2,18 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/fastip"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
@@ -29,6 +33,9 @@ type Options struct {
 	// Path to a log file
 	LogOutput string `short:"o" long:"output" description:"Path to the log file. If not set, write to stdout." default:""`
 
+	// Path to the YAML configuration file
+	ConfigPath string `long:"config-path" description:"Path to the YAML configuration file, see proxy.FileConfig. If set, the other options except the logging ones are ignored"`
+
 	// Listen addrs
 	// --
 
@@ -50,6 +57,21 @@ type Options struct {
 	// DNSCrypt listen ports
 	DNSCryptListenPorts []int `short:"y" long:"dnscrypt-port" description:"Listening ports for DNSCrypt"`
 
+	// UNIX socket paths
+	UnixSockets []string `long:"unix" description:"Path of a UNIX stream socket to listen to for plain DNS, e.g. /run/dnsproxy/dns.sock. Can be specified multiple times"`
+
+	// UNIX datagram socket paths
+	UnixgramSockets []string `long:"unixgram" description:"Path of a UNIX datagram socket to listen to for plain DNS. Can be specified multiple times"`
+
+	// Mode of the UNIX socket files
+	UnixSocketMode string `long:"unix-mode" description:"Octal mode of the UNIX socket files, e.g. 0660. If not specified, it depends on the umask"`
+
+	// Admin API listen address
+	AdminAddr string `long:"admin-addr" description:"Listening address of the runtime control HTTP API, e.g. 127.0.0.1:8053. Never expose it to untrusted networks"`
+
+	// Directory of the packet capture files
+	CaptureDir string `long:"capture-dir" description:"Directory the runtime control API writes the packet capture files to. If not set, the capture is disabled"`
+
 	// Encryption config
 	// --
 
@@ -59,12 +81,51 @@ type Options struct {
 	// Path to the file with the private key
 	TLSKeyPath string `short:"k" long:"tls-key" description:"Path to a file with the private key"`
 
+	// How often the certificate and key files are checked for changes
+	TLSReloadInterval time.Duration `long:"tls-reload-interval" description:"How often the TLS certificate and key files are checked for changes, 1m by default. Negative disables the checks, the certificate is still reloaded on SIGHUP" default:"0"`
+
+	// Path to the file with the CAs for client certificates verification
+	TLSClientCAPath string `long:"tls-client-ca" description:"Path to a file with CA certificates. If set, DoT, DoH, and DoQ clients must present a certificate signed by one of them (mTLS)"`
+
+	// If true, staple the OCSP responses for the listeners' certificates
+	OCSPStapling bool `long:"ocsp-stapling" description:"Fetch the OCSP responses for the certificate and staple them in the DoT, DoH, and DoQ handshakes. The certificate file must include the issuer" optional:"yes" optional-value:"true"`
+
+	// Domain names the certificate is obtained for via ACME
+	ACMEHosts []string `long:"acme-host" description:"Domain name to obtain the certificate for via ACME, e.g. from Let's Encrypt, instead of the certificate files. Can be specified multiple times"`
+
+	// Listening address of the ACME HTTP-01 challenges server
+	ACMEHTTPAddr string `long:"acme-http-addr" description:"Listening address of the HTTP server answering the ACME challenges, the CA connects to it on port 80" default:":80"`
+
+	// Directory the ACME certificates and account key are kept in
+	ACMECacheDir string `long:"acme-cache-dir" description:"Directory the certificates obtained via ACME and the account key are kept in" default:"acme"`
+
+	// Contact email of the ACME account
+	ACMEEmail string `long:"acme-email" description:"Contact email of the ACME account, optional"`
+
+	// ACME directory URL
+	ACMEDirectoryURL string `long:"acme-directory-url" description:"URL of the ACME directory, Let's Encrypt by default"`
+
+	// Static tokens for DoH clients authentication
+	HTTPSAuthTokens []string `long:"https-token" description:"A token that DoH clients must pass either as a bearer token or as the last URL path element. Can be specified multiple times"`
+
+	// Subnets of the CDNs or reverse proxies in front of the DoH listeners
+	HTTPSTrustedProxies []string `long:"https-trusted-proxy" description:"IP address or subnet of a CDN or a reverse proxy in front of the DoH listener. The client's address is only taken from the HTTP headers of the requests from them, the headers are ignored if none is specified. Can be specified multiple times"`
+
+	// HTTP headers the DoH client's address is taken from
+	HTTPSClientIPHeaders []string `long:"https-client-ip-header" description:"HTTP header the DoH client's address is taken from, e.g. CF-Connecting-IP or Fastly-Client-IP. If not specified, the headers set by Cloudflare and Fastly, X-Real-IP, and X-Forwarded-For are used. Can be specified multiple times"`
+
 	// Path to the DNSCrypt configuration file
 	DNSCryptConfigPath string `short:"g" long:"dnscrypt-config" description:"Path to a file with DNSCrypt configuration. You can generate one using https://github.com/ameshkov/dnscrypt"`
 
 	// Upstream DNS servers settings
 	// --
 
+	// Preset is the name of the tuning preset to apply before explicit settings
+	Preset string `long:"preset" description:"Apply a tuning preset before the explicit settings: home-router, public-resolver, mobile-client, or kubernetes-node-cache"`
+
+	// Timeout for outbound DNS queries
+	Timeout time.Duration `long:"timeout" description:"Timeout for outbound DNS queries to remote upstream servers in a human-readable form (default: 10s)"`
+
 	// DNS upstreams
 	Upstreams []string `short:"u" long:"upstream" description:"An upstream to be used (can be specified multiple times)" required:"true"`
 
@@ -74,6 +135,51 @@ type Options struct {
 	// Fallback DNS resolver
 	Fallbacks []string `short:"f" long:"fallback" description:"Fallback resolvers to use when regular ones are unavailable, can be specified multiple times"`
 
+	// Time budget of the exchange with the fallbacks
+	FallbackTimeout time.Duration `long:"fallback-timeout" description:"Time budget of the whole exchange with the fallback resolvers, including the retries, in a human-readable form, e.g. 2s"`
+
+	// If true, the .local names are resolved with Multicast DNS
+	MDNS bool `long:"mdns" description:"If specified, the .local names and the link-local reverse zones are resolved with Multicast DNS queries on the LAN" optional:"yes" optional-value:"true"`
+
+	// CNAME chains handling mode
+	CNAMEMode string `long:"cname-mode" description:"How to handle CNAME chains in responses to A and AAAA queries: chase (resolve unterminated chains) or flatten (chase and return only the final records)"`
+
+	// If true, identical concurrent requests are coalesced
+	Dedup bool `long:"dedup" description:"If specified, identical concurrent requests are coalesced into a single upstream request" optional:"yes" optional-value:"true"`
+
+	// Interval between the upstreams health checks
+	HealthCheckInterval time.Duration `long:"health-check-interval" description:"Interval between the upstreams health checks in a human-readable form. Upstreams that fail them are excluded until they recover. Disabled by default"`
+
+	// If true, the priming queries are sent on start
+	Priming bool `long:"priming" description:"If specified, NS queries for the root zone and the domains with the specified upstreams are sent on startup, so that the connections are established and the responses are cached before the first request" optional:"yes" optional-value:"true"`
+
+	// Last resort DNS resolvers
+	LastResort []string `long:"last-resort" description:"Last resort resolvers to use only when the upstreams and the fallbacks have been failing for --last-resort-threshold, can be specified multiple times"`
+
+	// Time the upstreams must have been failing for to use the last resort resolvers
+	LastResortThreshold time.Duration `long:"last-resort-threshold" description:"Time the upstreams and the fallbacks must have been failing for before the last resort resolvers are used in a human-readable form (default: 1m)"`
+
+	// Number of additional attempts after a failed exchange with an upstream
+	Retries int `long:"retries" description:"Number of retries after a failed exchange with an upstream (default: 0)"`
+
+	// Delay before the first retry
+	RetryBackoff time.Duration `long:"retry-backoff" description:"Delay before the first retry in a human-readable form, it's doubled for every next one"`
+
+	// Per-upstream timeouts and retries
+	UpstreamPolicies []string `long:"upstream-policy" description:"Timeout and retries of a single upstream in the address=timeout[,retries[,backoff]] form, e.g. tls://dns.adguard.com=2s,1,100ms. Can be specified multiple times"`
+
+	// Per-upstream certificate checks
+	UpstreamTLSChecks []string `long:"upstream-tls-check" description:"Additional certificate checks of an encrypted upstream in the address=check[,check] form, where check is ocsp (require a valid stapled OCSP response), sct[:number] (require valid SCTs from 2 or number CT logs), or pin:base64 (require a certificate of the chain to have the public key with the SHA-256 hash, any of several pins), e.g. tls://dns.adguard.com=ocsp,sct. Can be specified multiple times"`
+
+	// CT logs for the SCT checks
+	CTLogList string `long:"ct-log-list" description:"Path to the JSON list of the certificate transparency logs in the format of https://www.gstatic.com/ct/log_list/v3/log_list.json, required by the sct checks"`
+
+	// Timeout of an exchange attempt in the parallel mode
+	ParallelTimeout time.Duration `long:"parallel-timeout" description:"Timeout of an exchange attempt with --all-servers and with the fallbacks in a human-readable form, usually shorter than --timeout. The shortest of it, --timeout, and the one of --upstream-policy applies"`
+
+	// Share of the requests probing the other upstreams in the load-balancing mode
+	UpstreamProbeRate float64 `long:"upstream-probe-rate" description:"Share of the requests sent to a random upstream other than the fastest one first, from 0 to 1, so that the latency of the others keeps being measured without querying all of them. A negative value disables probing" default:"0.02"`
+
 	// If true, parallel queries to all configured upstream servers
 	AllServers bool `long:"all-servers" description:"If specified, parallel queries to all configured upstream servers are enabled" optional:"yes" optional-value:"true"`
 
@@ -81,12 +187,21 @@ type Options struct {
 	//  detected by ICMP response time or TCP connection time
 	FastestAddress bool `long:"fastest-addr" description:"Respond to A or AAAA requests only with the fastest IP address" optional:"yes" optional-value:"true"`
 
+	// Probers of the IP addresses in the fastest-addr mode
+	FastestAddrProbes []string `long:"fastest-addr-probe" description:"How the IP addresses are probed in the fastest-addr mode: icmp (requires the privilege to open raw sockets), tcp:port, or quic[:port]. Can be specified multiple times, the probes run in parallel. Default: tcp:80 and tcp:443"`
+
+	// How long the fastest-addr probing results are cached
+	FastestAddrCacheTTL time.Duration `long:"fastest-addr-cache-ttl" description:"How long the results of probing the IP addresses in the fastest-addr mode are cached, in a human-readable form" default:"10m"`
+
 	// Cache settings
 	// --
 
 	// If true, DNS cache is enabled
 	Cache bool `long:"cache" description:"If specified, DNS cache is enabled" optional:"yes" optional-value:"true"`
 
+	// If true, DNS cache is disabled even if the preset enables it
+	NoCache bool `long:"no-cache" description:"If specified, DNS cache is disabled even if the preset enables it" optional:"yes" optional-value:"true"`
+
 	// Cache size value
 	CacheSizeBytes int `long:"cache-size" description:"Cache size (in bytes). Default: 64k"`
 
@@ -96,6 +211,43 @@ type Options struct {
 	// DNS cache maximum TTL value - overrides record value
 	CacheMaxTTL uint32 `long:"cache-max-ttl" description:"Maximum TTL value for DNS entries, in seconds."`
 
+	// TTL range of the responses to the clients
+	ClientMinTTL uint32 `long:"client-min-ttl" description:"Minimum TTL value of the responses to the clients, in seconds. Doesn't affect the cached responses"`
+	ClientMaxTTL uint32 `long:"client-max-ttl" description:"Maximum TTL value of the responses to the clients, in seconds. Doesn't affect the cached responses, so the clients re-query sooner without increasing the upstream load"`
+
+	// Rules replacing the public addresses with the internal ones
+	SplitHorizon []string `long:"split-horizon" description:"Replace the public IP address in the answers to the internal clients with the internal one, in the public=internal[@subnet[,subnet]] form, e.g. 203.0.113.5=192.168.1.10. The default clients are the private networks. Can be specified multiple times"`
+
+	// Path to the GeoIP database
+	GeoIPDB string `long:"geoip-db" description:"Path to the MaxMind DB file with the locations of the IP addresses, e.g. GeoLite2-City.mmdb"`
+
+	// GeoIP rules
+	GeoIP []string `long:"geoip" description:"Sort the A and AAAA answers for the domain and its subdomains by the distance from the client, in the domain=sort or domain=nearest:N form, where N is the number of the nearest addresses kept. Requires --geoip-db. Can be specified multiple times"`
+
+	// Authoritative server the UPDATE and NOTIFY messages are forwarded to
+	UpdateForward string `long:"update-forward" description:"Forward the DNS UPDATE and NOTIFY messages to the authoritative server, host:port, instead of handling them as queries"`
+
+	// TSIG key the forwarded UPDATE and NOTIFY messages are signed with
+	UpdateTSIG string `long:"update-tsig" description:"Sign the forwarded UPDATE and NOTIFY messages with the TSIG key in the [algorithm:]name:secret form, the default algorithm is hmac-sha256. Requires --allow or --deny"`
+
+	// TSIG keys of the queries to the plain DNS upstreams
+	UpstreamTSIG []string `long:"upstream-tsig" description:"Sign the queries for the zone and its subdomains to the plain DNS upstreams with the TSIG key, in the zone[@upstream]=[algorithm:]name:secret form. Can be specified multiple times"`
+
+	// Number of the most requested cache entries kept on flush
+	CacheKeepHot int `long:"cache-keep-hot" description:"Number of the most requested cache entries that are kept and re-resolved in the background when the cache is flushed or the upstreams are reloaded"`
+
+	// Number of the hits after which a cache entry is prefetched
+	CachePrefetch int `long:"cache-prefetch" description:"Number of the hits after which a cache entry is re-resolved in the background when 10% of its TTL is left, so that the popular names never expire"`
+
+	// How long the expired cache entries are served if the upstreams fail
+	CacheServeStale time.Duration `long:"cache-serve-stale" description:"How long the expired cache entries are kept and served with the Stale Answer extended DNS error if the upstreams fail, in a human-readable form, e.g. 1h"`
+
+	// Rotate the cached A and AAAA answers
+	CacheRoundRobin bool `long:"cache-round-robin" description:"Rotate the order of the A and AAAA records in the cached answers for every response, so that the clients spread over the addresses" optional:"yes" optional-value:"true"`
+
+	// Path to the file with the names to pre-warm the cache with
+	CachePrewarmPath string `long:"cache-prewarm" description:"Path to a file with the names, one per line, the A and AAAA records of which are resolved into the cache on startup"`
+
 	// Anti-DNS amplification measures
 	// --
 
@@ -105,6 +257,36 @@ type Options struct {
 	// If true, refuse ANY requests
 	RefuseAny bool `long:"refuse-any" description:"If specified, refuse ANY requests" optional:"yes" optional-value:"true"`
 
+	// If true, ANY requests aren't refused even if the preset refuses them
+	NoRefuseAny bool `long:"no-refuse-any" description:"If specified, ANY requests aren't refused even if the preset refuses them" optional:"yes" optional-value:"true"`
+
+	// Query type policy
+	QTypePolicy []string `long:"qtype-policy" description:"How the requests of a query type are handled in the TYPE=action form, where action is pass, refuse, notimp, drop, minimal (RFC 8482 answer for ANY, empty answer for the others), or tcp_only (truncated response over UDP), e.g. ANY=minimal. Can be specified multiple times"`
+
+	// If true, DNS cookies are enabled
+	Cookies bool `long:"cookies" description:"If specified, DNS cookies (RFC 7873) are sent to the clients and the plain DNS upstreams. The UDP requests with a valid cookie aren't truncated by the tcp_only query type policy" optional:"yes" optional-value:"true"`
+
+	// Secret the server cookies are generated with
+	CookieSecret string `long:"cookie-secret" description:"Secret of at least 16 characters the server cookies are generated with. The instances behind the same anycast address should share it. If not specified, a random one is generated"`
+
+	// If true, the UDP requests with a client cookie only are answered with BADCOOKIE
+	CookiesRequired bool `long:"cookies-required" description:"If specified, the UDP requests that carry a client cookie but no valid server cookie are answered with BADCOOKIE, so that the client retries with the new server cookie" optional:"yes" optional-value:"true"`
+
+	// Client subnets the requests are allowed from
+	ACLAllow []string `long:"allow" description:"Client IP address or subnet the requests are allowed from, e.g. 192.168.0.0/16. If specified, the other clients are refused. Can be specified multiple times"`
+
+	// Client subnets the requests are refused from
+	ACLDeny []string `long:"deny" description:"Client IP address or subnet the requests are refused from, takes precedence over --allow. Can be specified multiple times"`
+
+	// Max size of the requests
+	MaxMessageSize int `long:"max-message-size" description:"Max size of a request in bytes. The larger DNS requests are answered with FORMERR and the DoH ones with 413. 0 means no limit" default:"0"`
+
+	// Max sizes of the requests from the client subnets
+	ClientMaxMessageSizes []string `long:"client-max-message-size" description:"Max size of the requests from a client IP address or subnet in the subnet=size form, e.g. 192.168.0.0/16=4096. Overrides --max-message-size, 0 means no limit. Can be specified multiple times"`
+
+	// If true, raise the UDP size advertised to the clients retrying truncated responses over TCP
+	AutoTuneUDPSize bool `long:"auto-udp-size" description:"If specified, the UDP size advertised to the EDNS clients that keep retrying truncated responses over TCP is raised up to 1232 bytes" optional:"yes" optional-value:"true"`
+
 	// ECS settings
 	// --
 
@@ -114,6 +296,21 @@ type Options struct {
 	// Use Custom EDNS Client Address
 	EDNSAddr string `long:"edns-addr" description:"Send EDNS Client Address"`
 
+	// Per-domain EDNS Client Subnet overrides
+	EDNSOverrides []string `long:"edns-override" description:"EDNS Client Subnet override for a domain and its subdomains in the domain=subnet form, e.g. cdn.example.org=203.0.113.0/24. An empty subnet strips ECS, . matches all domains. Can be specified multiple times"`
+
+	// If true, don't send any data identifying the clients to the upstreams
+	Privacy bool `long:"privacy" description:"If specified, no data identifying the clients is sent to the upstreams: the IDs and the casing of the requests are replaced and their EDNS options are removed. Can't be used with --edns" optional:"yes" optional-value:"true"`
+
+	// Downstream dnsproxy instances the client info is accepted from
+	TrustedProxies []string `long:"trusted-proxy" description:"IP address or subnet of a downstream dnsproxy the original client's address and protocol are accepted from in the client info EDNS option. They're used for the ACL, the ratelimit, and ECS. Can be specified multiple times"`
+
+	// If true, the client's address is taken from the PROXY protocol header
+	ProxyProtocol bool `long:"proxy-protocol" description:"If specified, the TCP and TLS connections from the --trusted-proxy addresses must start with the PROXY protocol v1 or v2 header, e.g. from HAProxy with send-proxy-v2, and the client's address is taken from it" optional:"yes" optional-value:"true"`
+
+	// If true, the original client's address and protocol are sent to the upstreams
+	ForwardClientInfo bool `long:"forward-client-info" description:"If specified, the original client's address and protocol are sent in the client info EDNS option to the upstreams, which must be the trusted dnsproxy instances. Can't be used with --privacy" optional:"yes" optional-value:"true"`
+
 	// Other settings and options
 	// --
 
@@ -121,16 +318,89 @@ type Options struct {
 	IPv6Disabled bool `long:"ipv6-disabled" description:"If specified, all AAAA requests will be replied with NoError RCode and empty answer" optional:"yes" optional-value:"true"`
 
 	// Transform responses that contain at least one of the given IP addresses into NXDOMAIN
-	BogusNXDomain []string `long:"bogus-nxdomain" description:"Transform responses that contain at least one of the given IP addresses into NXDOMAIN. Can be specified multiple times."`
+	BogusNXDomain []string `long:"bogus-nxdomain" description:"Transform responses that contain at least one of the given IP addresses or subnets, e.g. 192.0.2.0/24, into NXDOMAIN. Can be specified multiple times."`
+
+	// Blocklists
+	Blocklists []string `long:"blocklist" description:"Path or http(s) URL of a hosts file, a domain list, or an AdBlock-style filter list with the domains to block. Can be specified multiple times"`
+
+	// How the blocked requests are answered
+	BlockingMode string `long:"blocking-mode" description:"How the blocked requests are answered: nxdomain, null_ip (0.0.0.0 or ::), or custom_ip (--blocking-ip)" default:"nxdomain"`
+
+	// IP address the blocked requests are answered with
+	BlockingIP string `long:"blocking-ip" description:"IPv4 or IPv6 address the blocked A or AAAA requests are answered with in the custom_ip mode"`
+
+	// If true, the blocklists are imposed by an external authority
+	BlocklistCensored bool `long:"blocklist-censored" description:"If specified, the blocked responses have the Censored extended DNS error instead of the Blocked one, for the lists imposed by an external authority" optional:"yes" optional-value:"true"`
+
+	// Interval between the blocklists reloads
+	BlocklistRefresh time.Duration `long:"blocklist-refresh" description:"Interval between the blocklists reloads in a human-readable form" default:"24h"`
+
+	// Local domain of the registered hosts
+	LocalDomain string `long:"local-domain" description:"Local domain of the hosts registered with --local-host or the runtime control API, e.g. lan. The requests for the unknown names within it are answered with NXDOMAIN"`
+
+	// Statically registered local hosts
+	LocalHosts []string `long:"local-host" description:"Local host answered without the upstreams in the name=ip[,ip] form, e.g. nas=192.168.1.10. Its PTR requests are answered as well. Can be specified multiple times"`
+
+	// Networks of the local reverse zones
+	LocalReverseNets []string `long:"local-reverse-net" description:"Network the PTR requests for the unregistered addresses within are answered with NXDOMAIN, e.g. 192.168.1.0/24. Can be specified multiple times"`
+
+	// Path of the rewrites file
+	RewritesFile string `long:"rewrites-file" description:"Path of the file with the rewrite rules in the \"pattern type value\" form, one per line, e.g. *.dev.example.com A 10.0.0.5"`
+
+	// Rewrite rules
+	Rewrites []string `long:"rewrite" description:"Rewrite rule in the \"pattern type value\" form. The pattern is a name, a *.wildcard, or a /regexp/, the type is A, AAAA, CNAME, or TXT. Can be specified multiple times"`
+
+	// Interval between the rewrites file reloads
+	RewritesRefresh time.Duration `long:"rewrites-refresh" description:"Interval between the rewrites file reloads in a human-readable form. If 0, it's only reloaded with the runtime control API" default:"0"`
 
 	// UDP buffer size value
 	UDPBufferSize int `long:"udp-buf-size" description:"Set the size of the UDP buffer in bytes. A value <= 0 will use the system default." default:"0"`
 
+	// Number of the UDP sockets per listen address
+	UDPSocketsPerAddr int `long:"udp-sockets-per-addr" description:"Number of the UDP sockets opened for each listen address with SO_REUSEPORT, so that the kernel distributes the requests between them. Linux only" default:"0"`
+
 	// The maximum number of go routines
 	MaxGoRoutines int `long:"max-go-routines" description:"Set the maximum number of go routines. A value <= 0 will not not set a maximum." default:"0"`
 
+	// Refuse the requests when all the go routines are busy
+	Backpressure bool `long:"backpressure" description:"Refuse the TCP, TLS, and HTTPS requests instead of queueing them when all of --max-go-routines are busy" optional:"yes" optional-value:"true"`
+
+	// The maximum number of go routines processing the UDP requests
+	UDPMaxGoRoutines int `long:"udp-max-go-routines" description:"Maximum number of go routines processing the UDP requests. If 0, they're limited by --max-go-routines" default:"0"`
+
+	// How the UDP requests are handled when all the go routines are busy
+	UDPBackpressure string `long:"udp-backpressure" description:"How the UDP requests are handled when all the go routines are busy: block (wait for one), drop, queue (wait in the queue of --udp-queue-size, dropped if it's full), or servfail" default:"block"`
+
+	// Size of the UDP requests queue
+	UDPQueueSize int `long:"udp-queue-size" description:"Max number of the UDP requests waiting for a go routine with --udp-backpressure=queue" default:"1000"`
+
 	// Print DNSProxy version (just for the help)
 	Version bool `long:"version" description:"Prints the program version"`
+
+	// explicit are the long names of the options specified on the command
+	// line, they override the preset even if they're zero
+	explicit map[string]bool
+}
+
+// isExplicit returns true if the option with the long name was specified on
+// the command line
+func (o Options) isExplicit(name string) bool {
+	return o.explicit[name]
+}
+
+// explicitOptions returns the long names of the options specified on the
+// command line
+func explicitOptions(parser *goFlags.Parser) map[string]bool {
+	explicit := map[string]bool{}
+	for _, g := range parser.Groups() {
+		for _, o := range g.Options() {
+			if o.IsSet() && !o.IsSetDefault() {
+				explicit[o.LongName] = true
+			}
+		}
+	}
+
+	return explicit
 }
 
 // VersionString will be set through ldflags, contains current version
@@ -147,6 +417,15 @@ func main() {
 		os.Exit(0)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		err := runBench(os.Args[2:])
+		if err != nil {
+			log.Error("%s", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	_, err := parser.Parse()
 	if err != nil {
 		if flagsErr, ok := err.(*goFlags.Error); ok && flagsErr.Type == goFlags.ErrHelp {
@@ -156,6 +435,8 @@ func main() {
 		}
 	}
 
+	options.explicit = explicitOptions(parser)
+
 	log.Println("Starting the DNS proxy")
 	run(options)
 }
@@ -174,7 +455,16 @@ func run(options Options) {
 	}
 
 	// Prepare the proxy server
-	config := createProxyConfig(options)
+	var config proxy.Config
+	if options.ConfigPath != "" {
+		c, err := proxy.LoadConfig(options.ConfigPath)
+		if err != nil {
+			log.Fatalf("cannot load the configuration: %s", err)
+		}
+		config = *c
+	} else {
+		config = createProxyConfig(options)
+	}
 	dnsProxy := proxy.Proxy{Config: config}
 
 	// Add extra handler if needed
@@ -190,8 +480,19 @@ func run(options Options) {
 	}
 
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChannel
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signalChannel {
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		if dnsProxy.TLSCertPath != "" {
+			err = dnsProxy.ReloadTLSCertificate()
+			if err != nil {
+				log.Error("cannot reload the TLS certificate: %s", err)
+			}
+		}
+	}
 
 	// Stopping the proxy
 	err = dnsProxy.Stop()
@@ -204,55 +505,298 @@ func run(options Options) {
 func createProxyConfig(options Options) proxy.Config {
 	// Create the config
 	config := proxy.Config{
-		Ratelimit:              options.Ratelimit,
-		CacheEnabled:           options.Cache,
-		CacheSizeBytes:         options.CacheSizeBytes,
-		CacheMinTTL:            options.CacheMinTTL,
 		CacheMaxTTL:            options.CacheMaxTTL,
-		RefuseAny:              options.RefuseAny,
+		CacheKeepHot:           options.CacheKeepHot,
+		CachePrefetch:          options.CachePrefetch,
+		CacheServeStale:        options.CacheServeStale,
+		CacheRoundRobin:        options.CacheRoundRobin,
+		ClientMinTTL:           options.ClientMinTTL,
+		ClientMaxTTL:           options.ClientMaxTTL,
 		EnableEDNSClientSubnet: options.EnableEDNSSubnet,
-		UDPBufferSize:          options.UDPBufferSize,
-		MaxGoroutines:          options.MaxGoRoutines,
+		PrivacyMode:            options.Privacy,
+		ForwardClientInfo:      options.ForwardClientInfo,
+		ProxyProtocol:          options.ProxyProtocol,
 	}
 
-	initUpstreams(&config, options)
+	timeout := initPreset(&config, options)
+	initUpstreams(&config, options, timeout)
 	initEDNS(&config, options)
 	initBogusNXDomain(&config, options)
+	initBlocklist(&config, options)
+	initLocalHosts(&config, options)
+	initRewrites(&config, options)
+	initSplitHorizon(&config, options)
+	initGeoIP(&config, options)
+	initUpdateForward(&config, options)
+	initUpstreamTSIG(&config, options)
 	initTLSConfig(&config, options)
-	initDNSCryptConfig(&config, options)
+	rc := initDNSCryptConfig(&config, options)
 	initListenAddrs(&config, options)
+	logDNSCryptStamps(&config, rc)
 
 	return config
 }
 
+// initPreset applies the preset (if any) and then the explicitly specified
+// tuning options on top of it.  It returns the upstream timeout to use.
+func initPreset(config *proxy.Config, options Options) time.Duration {
+	timeout := defaultTimeout
+	if options.Preset != "" {
+		ps, err := proxy.GetPreset(options.Preset)
+		if err != nil {
+			log.Fatalf("cannot apply the preset: %s", err)
+		}
+		log.Printf("Applying the %s preset", ps.Name)
+		ps.Apply(config)
+		timeout = ps.Timeout
+	}
+
+	if options.Cache {
+		config.CacheEnabled = true
+	} else if options.NoCache {
+		config.CacheEnabled = false
+	}
+	if options.isExplicit("cache-size") {
+		config.CacheSizeBytes = options.CacheSizeBytes
+	}
+	if options.isExplicit("cache-min-ttl") {
+		config.CacheMinTTL = options.CacheMinTTL
+	}
+	if options.CachePrewarmPath != "" {
+		config.CachePrewarm = loadCachePrewarm(options.CachePrewarmPath)
+	}
+	if options.isExplicit("ratelimit") {
+		config.Ratelimit = options.Ratelimit
+	}
+	if options.RefuseAny {
+		config.RefuseAny = true
+	} else if options.NoRefuseAny {
+		config.RefuseAny = false
+	}
+	if len(options.QTypePolicy) > 0 {
+		policy, err := proxy.ParseQTypePolicy(options.QTypePolicy)
+		if err != nil {
+			log.Fatalf("cannot parse the query type policy: %s", err)
+		}
+		config.QTypePolicy = policy
+	}
+	if options.AutoTuneUDPSize {
+		config.AutoTuneUDPSize = true
+	}
+	if options.Cookies {
+		config.Cookies = true
+		config.CookieSecret = []byte(options.CookieSecret)
+		config.CookiesRequired = options.CookiesRequired
+	}
+	if len(options.ACLAllow) != 0 || len(options.ACLDeny) != 0 {
+		acl, err := proxy.ParseACL(options.ACLAllow, options.ACLDeny)
+		if err != nil {
+			log.Fatalf("cannot parse the ACL: %s", err)
+		}
+		config.ACL = acl
+	}
+	config.MaxMessageSize = options.MaxMessageSize
+	for _, s := range options.ClientMaxMessageSizes {
+		l, err := proxy.ParseClientMessageSizeLimit(s)
+		if err != nil {
+			log.Fatalf("cannot parse the client max message size: %s", err)
+		}
+		config.ClientMessageSizeLimits = append(config.ClientMessageSizeLimits, l)
+	}
+	if options.isExplicit("udp-buf-size") {
+		config.UDPBufferSize = options.UDPBufferSize
+	}
+	if options.UDPSocketsPerAddr > 0 {
+		config.UDPSocketsPerAddr = options.UDPSocketsPerAddr
+	}
+	if options.isExplicit("max-go-routines") {
+		config.MaxGoroutines = options.MaxGoRoutines
+	}
+	config.Backpressure = options.Backpressure
+	if options.UDPMaxGoRoutines > 0 {
+		config.UDPMaxGoroutines = options.UDPMaxGoRoutines
+	}
+	udpBackpressure, err := proxy.ParseUDPBackpressure(options.UDPBackpressure)
+	if err != nil {
+		log.Fatalf("cannot parse the UDP backpressure policy: %s", err)
+	}
+	config.UDPBackpressure = udpBackpressure
+	config.UDPQueueSize = options.UDPQueueSize
+	if options.Timeout > 0 {
+		timeout = options.Timeout
+	}
+
+	return timeout
+}
+
+// mdnsUpstream is the upstream of the domains resolved with Multicast DNS,
+// see RFC 6762, section 3 and section 4
+const mdnsUpstream = "[/local/254.169.in-addr.arpa/8.e.f.ip6.arpa/9.e.f.ip6.arpa/a.e.f.ip6.arpa/b.e.f.ip6.arpa/]mdns://"
+
 // initUpstreams inits upstream-related config
-func initUpstreams(config *proxy.Config, options Options) {
+func initUpstreams(config *proxy.Config, options Options, timeout time.Duration) {
+	tlsChecks := initTLSChecks(options)
+
 	// Init upstreams
-	upstreamConfig, err := proxy.ParseUpstreamsConfig(options.Upstreams, options.BootstrapDNS, defaultTimeout)
+	upstreams := options.Upstreams
+	if options.MDNS {
+		upstreams = append(append([]string{}, upstreams...), mdnsUpstream)
+	}
+
+	upstreamOpts := upstream.Options{Bootstrap: options.BootstrapDNS, Timeout: timeout}
+	upstreamConfig, err := proxy.ParseUpstreamsConfigWithOptions(upstreams, upstreamOpts, tlsChecks)
 	if err != nil {
 		log.Fatalf("error while parsing upstreams configuration: %s", err)
 	}
 	config.UpstreamConfig = &upstreamConfig
+	config.HealthCheckInterval = options.HealthCheckInterval
+	config.Priming = options.Priming
+	config.RequestDeduplication = options.Dedup
+
+	initUpstreamPolicies(config, options, timeout)
 
 	if options.AllServers {
 		config.UpstreamMode = proxy.UModeParallel
 	} else if options.FastestAddress {
 		config.UpstreamMode = proxy.UModeFastestAddr
+		config.FastestAddr = initFastestAddr(options)
 	} else {
 		config.UpstreamMode = proxy.UModeLoadBalance
 	}
 
+	switch options.CNAMEMode {
+	case "":
+		config.CNAMEMode = proxy.CNAMEModeNone
+	case "chase":
+		config.CNAMEMode = proxy.CNAMEModeChase
+	case "flatten":
+		config.CNAMEMode = proxy.CNAMEModeFlatten
+	default:
+		log.Fatalf("unknown CNAME mode %s", options.CNAMEMode)
+	}
+
 	if options.Fallbacks != nil {
 		fallbacks := []upstream.Upstream{}
 		for i, f := range options.Fallbacks {
-			fallback, err := upstream.AddressToUpstream(f, upstream.Options{Timeout: defaultTimeout})
+			opts := upstream.Options{Timeout: timeout}
+			if tlsChecks != nil {
+				tlsChecks(f, &opts)
+			}
+			fallback, err := upstream.AddressToUpstream(f, opts)
 			if err != nil {
 				log.Fatalf("cannot parse the fallback %s (%s): %s", f, options.BootstrapDNS, err)
 			}
 			log.Printf("Fallback %d is %s", i, fallback.Address())
 			fallbacks = append(fallbacks, fallback)
 		}
-		config.Fallbacks = fallbacks
+		upstreamConfig.Fallbacks = fallbacks
+		upstreamConfig.FallbackTimeout = options.FallbackTimeout
+	}
+
+	if options.LastResort != nil {
+		lastResort := []upstream.Upstream{}
+		for i, l := range options.LastResort {
+			opts := upstream.Options{Timeout: timeout}
+			if tlsChecks != nil {
+				tlsChecks(l, &opts)
+			}
+			u, err := upstream.AddressToUpstream(l, opts)
+			if err != nil {
+				log.Fatalf("cannot parse the last resort upstream %s: %s", l, err)
+			}
+			log.Printf("Last resort upstream %d is %s", i, u.Address())
+			lastResort = append(lastResort, u)
+		}
+		config.LastResortUpstreams = lastResort
+		config.LastResortThreshold = options.LastResortThreshold
+	}
+}
+
+// initFastestAddr returns the configuration of the fastest-addr module
+func initFastestAddr(options Options) fastip.Config {
+	c := fastip.Config{CacheTTL: options.FastestAddrCacheTTL}
+	for _, s := range options.FastestAddrProbes {
+		prober, err := fastip.ParseProber(s)
+		if err != nil {
+			log.Fatalf("cannot parse the fastest-addr probe: %s", err)
+		}
+		c.Probers = append(c.Probers, prober)
+	}
+
+	return c
+}
+
+// initTLSChecks returns the function setting the certificate checks of the
+// upstreams, or nil if there are none
+func initTLSChecks(options Options) proxy.UpstreamOptionsFunc {
+	if len(options.UpstreamTLSChecks) == 0 {
+		return nil
+	}
+
+	var logs []*upstream.CTLog
+	if options.CTLogList != "" {
+		var err error
+		logs, err = upstream.LoadCTLogList(options.CTLogList)
+		if err != nil {
+			log.Fatalf("cannot load the CT logs: %s", err)
+		}
+	}
+
+	checks := map[string]upstream.TLSChecks{}
+	for _, s := range options.UpstreamTLSChecks {
+		addr, c, err := upstream.ParseTLSChecks(s)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		checks[normalizeUpstreamAddress(addr)] = c
+	}
+
+	return func(addr string, opts *upstream.Options) {
+		if c, ok := checks[normalizeUpstreamAddress(addr)]; ok {
+			opts.TLSChecks = c
+			opts.CTLogs = logs
+		}
+	}
+}
+
+// normalizeUpstreamAddress returns the address of the upstream as it's
+// returned by its Address method so that the different forms of the same
+// address match
+func normalizeUpstreamAddress(addr string) string {
+	u, err := upstream.AddressToUpstream(addr, upstream.Options{})
+	if err != nil {
+		return addr
+	}
+
+	return u.Address()
+}
+
+// initUpstreamPolicies inits the timeout and retry policies of the upstreams
+func initUpstreamPolicies(config *proxy.Config, options Options, timeout time.Duration) {
+	config.UpstreamPolicy = proxy.UpstreamPolicy{
+		Retries: options.Retries,
+		Backoff: options.RetryBackoff,
+	}
+	config.ParallelTimeout = options.ParallelTimeout
+	config.UpstreamProbeRate = options.UpstreamProbeRate
+
+	if len(options.UpstreamPolicies) == 0 {
+		return
+	}
+
+	config.UpstreamPolicies = map[string]proxy.UpstreamPolicy{}
+	for _, s := range options.UpstreamPolicies {
+		addr, policy, err := proxy.ParseUpstreamPolicy(s)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+
+		// The policies are matched by the normalized upstream address
+		u, err := upstream.AddressToUpstream(addr, upstream.Options{Bootstrap: options.BootstrapDNS, Timeout: timeout})
+		if err != nil {
+			log.Fatalf("cannot parse the upstream %s of the policy: %s", addr, err)
+		}
+		config.UpstreamPolicies[u.Address()] = policy
 	}
 }
 
@@ -269,6 +813,47 @@ func initEDNS(config *proxy.Config, options Options) {
 			log.Printf("--edns-addr=%s need --edns to work", options.EDNSAddr)
 		}
 	}
+
+	if len(options.EDNSOverrides) > 0 {
+		if !options.EnableEDNSSubnet {
+			log.Printf("--edns-override needs --edns to work")
+		}
+
+		for _, s := range options.EDNSOverrides {
+			o, err := parseECSOverride(s)
+			if err != nil {
+				log.Fatalf("cannot parse --edns-override=%s: %s", s, err)
+			}
+			config.ECSOverrides = append(config.ECSOverrides, o)
+		}
+	}
+
+	if len(options.TrustedProxies) > 0 {
+		nets, err := proxy.ParseSubnets(options.TrustedProxies)
+		if err != nil {
+			log.Fatalf("cannot parse the trusted proxies: %s", err)
+		}
+		config.TrustedProxies = nets
+	}
+}
+
+// parseECSOverride parses the ECS override in the domain=subnet form
+func parseECSOverride(s string) (proxy.ECSOverride, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return proxy.ECSOverride{}, fmt.Errorf("expected domain=subnet")
+	}
+
+	o := proxy.ECSOverride{Domain: parts[0]}
+	if parts[1] != "" {
+		_, subnet, err := net.ParseCIDR(parts[1])
+		if err != nil {
+			return proxy.ECSOverride{}, err
+		}
+		o.Subnet = subnet
+	}
+
+	return o, nil
 }
 
 // initBogusNXDomain - inits BogusNXDomain structure
@@ -276,6 +861,16 @@ func initBogusNXDomain(config *proxy.Config, options Options) {
 	if len(options.BogusNXDomain) > 0 {
 		bogusIP := []net.IP{}
 		for _, s := range options.BogusNXDomain {
+			if strings.Contains(s, "/") {
+				nets, err := proxy.ParseSubnets([]string{s})
+				if err != nil {
+					log.Error("Invalid subnet: %s", s)
+				} else {
+					config.BogusNXDomainNets = append(config.BogusNXDomainNets, nets...)
+				}
+				continue
+			}
+
 			ip := net.ParseIP(s)
 			if ip == nil {
 				log.Error("Invalid IP: %s", s)
@@ -287,6 +882,174 @@ func initBogusNXDomain(config *proxy.Config, options Options) {
 	}
 }
 
+// initBlocklist inits the blocklist
+func initBlocklist(config *proxy.Config, options Options) {
+	if len(options.Blocklists) == 0 {
+		return
+	}
+
+	mode, err := proxy.ParseBlockingMode(options.BlockingMode)
+	if err != nil {
+		log.Fatalf("cannot parse the blocking mode: %s", err)
+	}
+
+	var ip net.IP
+	if mode == proxy.BlockingModeCustomIP {
+		ip = net.ParseIP(options.BlockingIP)
+		if ip == nil {
+			log.Fatalf("the custom_ip blocking mode requires a valid --blocking-ip, got %q", options.BlockingIP)
+		}
+	}
+
+	config.Blocklist = &proxy.Blocklist{
+		Sources:         options.Blocklists,
+		Mode:            mode,
+		BlockingIP:      ip,
+		RefreshInterval: options.BlocklistRefresh,
+		Censored:        options.BlocklistCensored,
+	}
+}
+
+// loadCachePrewarm loads the names to pre-warm the cache with.  The empty
+// lines and the lines starting with "#" are skipped.
+func loadCachePrewarm(path string) []string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("cannot read the cache pre-warm list: %s", err)
+	}
+
+	var names []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line[0] != '#' {
+			names = append(names, line)
+		}
+	}
+
+	return names
+}
+
+// initGeoIP loads the GeoIP database and inits the GeoIP rules
+func initGeoIP(config *proxy.Config, options Options) {
+	if options.GeoIPDB != "" {
+		g, err := proxy.LoadGeoIP(options.GeoIPDB)
+		if err != nil {
+			log.Fatalf("cannot load the GeoIP database: %s", err)
+		}
+		config.GeoIP = g
+	}
+
+	for _, s := range options.GeoIP {
+		r, err := proxy.ParseGeoIPRule(s)
+		if err != nil {
+			log.Fatalf("cannot parse the GeoIP rule: %s", err)
+		}
+		config.GeoIPRules = append(config.GeoIPRules, r)
+	}
+}
+
+// initUpdateForward inits forwarding of the UPDATE and NOTIFY messages
+func initUpdateForward(config *proxy.Config, options Options) {
+	if options.UpdateForward == "" {
+		if options.UpdateTSIG != "" {
+			log.Fatalf("--update-tsig requires --update-forward")
+		}
+		return
+	}
+
+	config.UpdateForward = &proxy.UpdateForward{Server: options.UpdateForward}
+	if options.UpdateTSIG != "" {
+		k, err := proxy.ParseTSIGKey(options.UpdateTSIG)
+		if err != nil {
+			log.Fatalf("cannot parse the TSIG key: %s", err)
+		}
+		config.UpdateForward.TSIG = k
+	}
+}
+
+// initUpstreamTSIG inits the TSIG keys of the queries to the upstreams
+func initUpstreamTSIG(config *proxy.Config, options Options) {
+	for _, s := range options.UpstreamTSIG {
+		t, err := proxy.ParseUpstreamTSIG(s)
+		if err != nil {
+			log.Fatalf("cannot parse the upstream TSIG key: %s", err)
+		}
+		config.UpstreamTSIG = append(config.UpstreamTSIG, t)
+	}
+}
+
+// initSplitHorizon inits the split horizon rules
+func initSplitHorizon(config *proxy.Config, options Options) {
+	for _, s := range options.SplitHorizon {
+		r, err := proxy.ParseSplitHorizonRule(s)
+		if err != nil {
+			log.Fatalf("cannot parse the split horizon rule: %s", err)
+		}
+		config.SplitHorizon = append(config.SplitHorizon, r)
+	}
+}
+
+// initLocalHosts inits the local hosts
+func initLocalHosts(config *proxy.Config, options Options) {
+	if options.LocalDomain == "" && len(options.LocalHosts) == 0 && len(options.LocalReverseNets) == 0 {
+		return
+	}
+
+	h := &proxy.LocalHosts{Domain: strings.ToLower(strings.Trim(options.LocalDomain, "."))}
+	for _, s := range options.LocalReverseNets {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Fatalf("cannot parse the local reverse network %s: %s", s, err)
+		}
+		h.ReverseNets = append(h.ReverseNets, n)
+	}
+
+	for _, s := range options.LocalHosts {
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			log.Fatalf("invalid local host %q, expected name=ip[,ip]", s)
+		}
+
+		var ips []net.IP
+		for _, ipStr := range strings.Split(s[i+1:], ",") {
+			ip := net.ParseIP(ipStr)
+			if ip == nil {
+				log.Fatalf("invalid IP %q of the local host %s", ipStr, s[:i])
+			}
+			ips = append(ips, ip)
+		}
+
+		err := h.Set(s[:i], append(h.Lookup(s[:i]), ips...)...)
+		if err != nil {
+			log.Fatalf("cannot add the local host: %s", err)
+		}
+	}
+
+	config.LocalHosts = h
+}
+
+// initRewrites inits the rewrites
+func initRewrites(config *proxy.Config, options Options) {
+	if options.RewritesFile == "" && len(options.Rewrites) == 0 {
+		return
+	}
+
+	rw := &proxy.Rewrites{Path: options.RewritesFile, RefreshInterval: options.RewritesRefresh}
+	for _, s := range options.Rewrites {
+		r, err := proxy.ParseRewriteRule(s)
+		if err != nil {
+			log.Fatalf("cannot parse the rewrite: %s", err)
+		}
+
+		err = rw.Add(r)
+		if err != nil {
+			log.Fatalf("cannot add the rewrite: %s", err)
+		}
+	}
+
+	config.Rewrites = rw
+}
+
 // initTLSConfig - inits TLS config
 func initTLSConfig(config *proxy.Config, options Options) {
 	if options.TLSCertPath != "" && options.TLSKeyPath != "" {
@@ -295,13 +1058,73 @@ func initTLSConfig(config *proxy.Config, options Options) {
 			log.Fatalf("failed to load TLS config: %s", err)
 		}
 		config.TLSConfig = tlsConfig
+		config.TLSCertPath = options.TLSCertPath
+		config.TLSKeyPath = options.TLSKeyPath
+		config.TLSReloadInterval = options.TLSReloadInterval
+		config.OCSPStapling = options.OCSPStapling
+
+		if options.TLSClientCAPath != "" {
+			err = initTLSClientAuth(tlsConfig, options.TLSClientCAPath)
+			if err != nil {
+				log.Fatalf("failed to load client CAs: %s", err)
+			}
+		}
+	} else if len(options.ACMEHosts) != 0 {
+		addr, err := net.ResolveTCPAddr("tcp", options.ACMEHTTPAddr)
+		if err != nil {
+			log.Fatalf("cannot parse the ACME HTTP address %s: %s", options.ACMEHTTPAddr, err)
+		}
+
+		config.TLSConfig = &tls.Config{}
+		config.ACMEHosts = options.ACMEHosts
+		config.ACMEHTTPListenAddr = addr
+		config.ACMECacheDir = options.ACMECacheDir
+		config.ACMEEmail = options.ACMEEmail
+		config.ACMEDirectoryURL = options.ACMEDirectoryURL
+
+		if options.TLSClientCAPath != "" {
+			err = initTLSClientAuth(config.TLSConfig, options.TLSClientCAPath)
+			if err != nil {
+				log.Fatalf("failed to load client CAs: %s", err)
+			}
+		}
+	}
+
+	config.HTTPSAuthTokens = options.HTTPSAuthTokens
+	config.HTTPSClientIPHeaders = options.HTTPSClientIPHeaders
+	if len(options.HTTPSTrustedProxies) > 0 {
+		nets, err := proxy.ParseSubnets(options.HTTPSTrustedProxies)
+		if err != nil {
+			log.Fatalf("cannot parse the HTTPS trusted proxies: %s", err)
+		}
+		config.HTTPSTrustedProxies = nets
 	}
 }
 
-// initDNSCryptConfig - inits DNSCrypt config
-func initDNSCryptConfig(config *proxy.Config, options Options) {
+// initTLSClientAuth makes the TLS listeners require client certificates
+// signed by one of the CAs from the specified file
+func initTLSClientAuth(tlsConfig *tls.Config, caPath string) error {
+	caPEM, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in %s", caPath)
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return nil
+}
+
+// initDNSCryptConfig - inits DNSCrypt config and returns the resolver
+// configuration, nil if DNSCrypt is disabled
+func initDNSCryptConfig(config *proxy.Config, options Options) *dnscrypt.ResolverConfig {
 	if options.DNSCryptConfigPath == "" {
-		return
+		return nil
 	}
 
 	b, err := ioutil.ReadFile(options.DNSCryptConfigPath)
@@ -322,6 +1145,25 @@ func initDNSCryptConfig(config *proxy.Config, options Options) {
 
 	config.DNSCryptResolverCert = cert
 	config.DNSCryptProviderName = rc.ProviderName
+
+	return rc
+}
+
+// logDNSCryptStamps prints the DNS stamps of the DNSCrypt listeners so that
+// the clients can be configured with them
+func logDNSCryptStamps(config *proxy.Config, rc *dnscrypt.ResolverConfig) {
+	if rc == nil {
+		return
+	}
+
+	for _, addr := range config.DNSCryptUDPListenAddr {
+		stamp, err := rc.CreateStamp(addr.String())
+		if err != nil {
+			log.Error("cannot create DNS stamp for %s: %s", addr, err)
+			return
+		}
+		log.Info("DNSCrypt server stamp for %s: %s", addr, stamp.String())
+	}
 }
 
 // initListenAddrs - inits listen addrs
@@ -335,6 +1177,63 @@ func initListenAddrs(config *proxy.Config, options Options) {
 		listenIPs = append(listenIPs, ip)
 	}
 
+	// The sockets passed by systemd or by the previous instance replace the
+	// DNS listen addresses
+	n, err := proxy.InheritListeners(config)
+	if err != nil {
+		log.Fatalf("cannot inherit the listening sockets: %s", err)
+	}
+	if n > 0 {
+		log.Info("Inherited %d listening sockets", n)
+	} else {
+		initListenPorts(config, options, listenIPs)
+	}
+
+	initUnixListenAddrs(config, options)
+
+	if options.AdminAddr != "" {
+		addr, err := net.ResolveTCPAddr("tcp", options.AdminAddr)
+		if err != nil {
+			log.Fatalf("cannot parse the admin API address %s: %s", options.AdminAddr, err)
+		}
+		config.AdminListenAddr = addr
+	}
+	config.CaptureDir = options.CaptureDir
+
+	if config.DNSCryptResolverCert != nil && config.DNSCryptProviderName != "" {
+		for _, port := range options.DNSCryptListenPorts {
+			for _, ip := range listenIPs {
+				tcp := &net.TCPAddr{Port: port, IP: ip}
+				config.DNSCryptTCPListenAddr = append(config.DNSCryptTCPListenAddr, tcp)
+
+				udp := &net.UDPAddr{Port: port, IP: ip}
+				config.DNSCryptUDPListenAddr = append(config.DNSCryptUDPListenAddr, udp)
+			}
+		}
+	}
+}
+
+// initUnixListenAddrs inits the UNIX sockets listen addrs
+func initUnixListenAddrs(config *proxy.Config, options Options) {
+	for _, path := range options.UnixSockets {
+		config.UnixListenAddr = append(config.UnixListenAddr, &net.UnixAddr{Name: path, Net: "unix"})
+	}
+
+	for _, path := range options.UnixgramSockets {
+		config.UnixgramListenAddr = append(config.UnixgramListenAddr, &net.UnixAddr{Name: path, Net: "unixgram"})
+	}
+
+	if options.UnixSocketMode != "" {
+		mode, err := strconv.ParseUint(options.UnixSocketMode, 8, 32)
+		if err != nil || mode == 0 || mode > 0o777 {
+			log.Fatalf("invalid UNIX socket mode %q", options.UnixSocketMode)
+		}
+		config.UnixSocketMode = os.FileMode(mode)
+	}
+}
+
+// initListenPorts - inits plain DNS, TLS, HTTPS, and QUIC listen addrs
+func initListenPorts(config *proxy.Config, options Options, listenIPs []net.IP) {
 	if len(options.ListenPorts) != 0 && options.ListenPorts[0] != 0 {
 		for _, port := range options.ListenPorts {
 			for _, ip := range listenIPs {
@@ -370,18 +1269,6 @@ func initListenAddrs(config *proxy.Config, options Options) {
 			}
 		}
 	}
-
-	if config.DNSCryptResolverCert != nil && config.DNSCryptProviderName != "" {
-		for _, port := range options.DNSCryptListenPorts {
-			for _, ip := range listenIPs {
-				tcp := &net.TCPAddr{Port: port, IP: ip}
-				config.DNSCryptTCPListenAddr = append(config.DNSCryptTCPListenAddr, tcp)
-
-				udp := &net.UDPAddr{Port: port, IP: ip}
-				config.DNSCryptUDPListenAddr = append(config.DNSCryptUDPListenAddr, udp)
-			}
-		}
-	}
 }
 
 // IPv6 configuration
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	goFlags "github.com/jessevdk/go-flags"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitPreset(t *testing.T) {
+	testCases := []struct {
+		name      string
+		args      []string
+		ratelimit int
+		cache     bool
+		refuseAny bool
+	}{{
+		name:      "preset",
+		args:      []string{"--preset=public-resolver"},
+		ratelimit: 20,
+		cache:     true,
+		refuseAny: true,
+	}, {
+		name:      "override",
+		args:      []string{"--preset=public-resolver", "--ratelimit=50"},
+		ratelimit: 50,
+		cache:     true,
+		refuseAny: true,
+	}, {
+		name:      "disable",
+		args:      []string{"--preset=public-resolver", "--ratelimit=0", "--no-cache", "--no-refuse-any"},
+		ratelimit: 0,
+		cache:     false,
+		refuseAny: false,
+	}, {
+		name:      "no_preset",
+		args:      []string{"--ratelimit=0"},
+		ratelimit: 0,
+		cache:     false,
+		refuseAny: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var options Options
+			parser := goFlags.NewParser(&options, goFlags.Default)
+			_, err := parser.ParseArgs(append(tc.args, "--upstream=8.8.8.8"))
+			assert.Nil(t, err)
+			options.explicit = explicitOptions(parser)
+
+			config := proxy.Config{}
+			initPreset(&config, options)
+			assert.Equal(t, tc.ratelimit, config.Ratelimit)
+			assert.Equal(t, tc.cache, config.CacheEnabled)
+			assert.Equal(t, tc.refuseAny, config.RefuseAny)
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ACL is an access control list of the client subnets.  The requests from
+// the denied clients are answered with REFUSED.
+type ACL struct {
+	// Allow, if not empty, is the list of the only subnets the clients are
+	// allowed from
+	Allow []*net.IPNet
+	// Deny is the list of the subnets the clients are denied from.  It takes
+	// precedence over Allow.
+	Deny []*net.IPNet
+}
+
+// ParseACL creates an ACL from the lists of the allowed and the denied
+// subnets.  A single IP address is a subnet as well.
+func ParseACL(allow, deny []string) (*ACL, error) {
+	acl := &ACL{}
+
+	var err error
+	acl.Allow, err = ParseSubnets(allow)
+	if err != nil {
+		return nil, err
+	}
+	acl.Deny, err = ParseSubnets(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+// ParseSubnets parses the subnets in the CIDR notation or the IP addresses
+func ParseSubnets(subnets []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range subnets {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+
+			bits := net.IPv6len * 8
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = net.IPv4len * 8
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// IsAllowed returns true if the client IP is allowed.  acl may be nil, all
+// clients are allowed then.
+func (acl *ACL) IsAllowed(ip net.IP) bool {
+	if acl == nil {
+		return true
+	}
+
+	if subnetsContain(acl.Deny, ip) {
+		return false
+	}
+
+	return len(acl.Allow) == 0 || subnetsContain(acl.Allow, ip)
+}
+
+// subnetsContain returns true if any of the subnets contains ip
+func subnetsContain(subnets []*net.IPNet, ip net.IP) bool {
+	for _, n := range subnets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acl returns the ACL for the request
+func (p *Proxy) acl(d *DNSContext) *ACL {
+	if d.listener != nil && d.listener.ACL != nil {
+		return d.listener.ACL
+	}
+
+	return p.ACL
+}
+
+// isAllowedClient checks the client of the request against the ACL.  The
+// clients of the UNIX sockets are always allowed.
+func (p *Proxy) isAllowedClient(d *DNSContext) bool {
+	acl := p.acl(d)
+	if acl == nil || isUnixAddr(d.ClientAddr()) {
+		return true
+	}
+
+	ip, _ := addrIPPort(d.ClientAddr())
+	return ip != nil && acl.IsAllowed(ip)
+}
+
+// isAllowedEarly checks the client of the request answered before it gets to
+// handleDNSRequest against the ACL and, for UDP, the ratelimit, so that these
+// responses can't be used to bypass them
+func (p *Proxy) isAllowedEarly(d *DNSContext) bool {
+	if !p.isAllowedClient(d) {
+		return false
+	}
+
+	return d.ClientProto() != ProtoUDP || !p.isRatelimitedWith(d.ClientAddr(), p.ratelimit(d))
+}
+
+// genRefused returns the REFUSED response to the request
+func (p *Proxy) genRefused(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetRcode(request, dns.RcodeRefused)
+	resp.RecursionAvailable = true
+	return &resp
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACL(t *testing.T) {
+	acl, err := ParseACL([]string{"192.168.0.0/16", "2001:db8::/32", "10.0.0.1"}, []string{"192.168.1.13"})
+	assert.Nil(t, err)
+
+	testCases := map[string]bool{
+		"192.168.1.1":  true,
+		"192.168.1.13": false,
+		"10.0.0.1":     true,
+		"10.0.0.2":     false,
+		"2001:db8::1":  true,
+		"2001:db9::1":  false,
+	}
+	for ip, allowed := range testCases {
+		assert.Equal(t, allowed, acl.IsAllowed(net.ParseIP(ip)), ip)
+	}
+
+	// Only the denied clients are refused if there is no allow list
+	acl, err = ParseACL(nil, []string{"192.168.1.0/24"})
+	assert.Nil(t, err)
+	assert.True(t, acl.IsAllowed(net.ParseIP("10.0.0.1")))
+	assert.False(t, acl.IsAllowed(net.ParseIP("192.168.1.1")))
+
+	var nilACL *ACL
+	assert.True(t, nilACL.IsAllowed(net.ParseIP("10.0.0.1")))
+
+	_, err = ParseACL([]string{"192.168.1"}, nil)
+	assert.NotNil(t, err)
+	_, err = ParseACL(nil, []string{"192.168.1.0/33"})
+	assert.NotNil(t, err)
+}
+
+func TestACLProxy(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TCPListenAddr = nil
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	var err error
+	dnsProxy.ACL, err = ParseACL(nil, []string{listenIP})
+	assert.Nil(t, err)
+
+	// The listener group allows the client
+	lc := &ListenerConfig{
+		UDPListenAddr: []*net.UDPAddr{{IP: net.ParseIP(listenIP)}},
+		ACL:           &ACL{},
+	}
+	dnsProxy.Listeners = []*ListenerConfig{lc}
+
+	err = dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	addrs := dnsProxy.Addrs(ProtoUDP)
+	assert.Len(t, addrs, 2)
+
+	client := &dns.Client{Net: "udp"}
+	req := createTestMessage()
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	res, _, err := client.Exchange(req, addrs[0].String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeRefused, res.Rcode)
+	assertEDE(t, res, edeProhibited)
+
+	res, _, err = client.Exchange(createTestMessage(), addrs[1].String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+
+	stats := dnsProxy.Stats()
+	assert.Equal(t, uint64(1), stats.ACLRefused)
+	assert.Equal(t, uint64(1), stats.Responses[ResponseClassBlocked.String()])
+}
+
+func TestACLRatelimit(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Ratelimit = 1
+
+	var err error
+	dnsProxy.ACL, err = ParseACL(nil, []string{listenIP})
+	assert.Nil(t, err)
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	// The UDP refusals are ratelimited
+	client := &dns.Client{Net: "udp", Timeout: 500 * time.Millisecond}
+	res, _, err := client.Exchange(createTestMessage(), dnsProxy.Addr(ProtoUDP).String())
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeRefused, res.Rcode)
+	}
+	_, _, err = client.Exchange(createTestMessage(), dnsProxy.Addr(ProtoUDP).String())
+	assert.NotNil(t, err)
+
+	// The TCP ones aren't
+	client.Net = "tcp"
+	res, _, err = client.Exchange(createTestMessage(), dnsProxy.Addr(ProtoTCP).String())
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeRefused, res.Rcode)
+	}
+}
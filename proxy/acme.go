@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// validateACME checks the ACME settings of the config
+func (c *Config) validateACME() []error {
+	var errs []error
+	if c.ACMEHTTPListenAddr == nil {
+		errs = append(errs, errors.New("ACME requires the HTTP listen address for the challenges"))
+	}
+
+	if c.ACMECacheDir == "" {
+		errs = append(errs, errors.New("ACME requires the cache directory"))
+	}
+
+	if c.TLSConfig == nil {
+		errs = append(errs, errors.New("ACME requires TLS config"))
+	} else if c.TLSConfig.GetCertificate != nil || c.TLSConfig.GetConfigForClient != nil {
+		errs = append(errs, errors.New("ACME can't be used with GetCertificate or GetConfigForClient in TLS config"))
+	}
+
+	if c.TLSCertPath != "" {
+		errs = append(errs, errors.New("ACME can't be used with the TLS certificate files"))
+	}
+
+	if c.OCSPStapling {
+		errs = append(errs, errors.New("OCSP stapling can't be used with ACME"))
+	}
+
+	return errs
+}
+
+// startACME makes the TLS config obtain the certificates for Config.ACMEHosts
+// via ACME.  The certificates are requested on the first handshakes and
+// renewed in the background.
+func (p *Proxy) startACME() {
+	if len(p.ACMEHosts) == 0 {
+		return
+	}
+
+	p.acme = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(p.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(p.ACMEHosts...),
+		Email:      p.ACMEEmail,
+	}
+	if p.ACMEDirectoryURL != "" {
+		p.acme.Client = &acme.Client{DirectoryURL: p.ACMEDirectoryURL}
+	}
+
+	p.TLSConfig.GetCertificate = p.getACMECertificate
+}
+
+// stopACME restores the TLS config
+func (p *Proxy) stopACME() {
+	if p.acme == nil {
+		return
+	}
+
+	p.TLSConfig.GetCertificate = nil
+	p.acme = nil
+}
+
+// getACMECertificate returns the certificate obtained via ACME for the
+// server name of the handshake or for the first of Config.ACMEHosts if the
+// client doesn't send SNI.  It's used as tls.Config.GetCertificate.
+func (p *Proxy) getACMECertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" {
+		h := *hello
+		h.ServerName = p.ACMEHosts[0]
+		hello = &h
+	}
+
+	return p.acme.GetCertificate(hello)
+}
+
+// createACMEHTTPListener creates the listener answering the ACME HTTP-01
+// challenges
+func (p *Proxy) createACMEHTTPListener() error {
+	if p.acme == nil {
+		return nil
+	}
+
+	tcpListen, err := net.ListenTCP("tcp", p.ACMEHTTPListenAddr)
+	if err != nil {
+		return errorx.Decorate(err, "could not start ACME HTTP listener")
+	}
+	p.acmeHTTPListen = tcpListen
+	p.acmeHTTPServer = &http.Server{
+		Handler:           p.acme.HTTPHandler(http.NotFoundHandler()),
+		ReadHeaderTimeout: defaultTimeout,
+		WriteTimeout:      defaultTimeout,
+	}
+	log.Info("Listening to ACME HTTP challenges on http://%s", tcpListen.Addr())
+
+	return nil
+}
+
+// listenACMEHTTP starts the ACME HTTP-01 challenges server
+func (p *Proxy) listenACMEHTTP(srv *http.Server, l net.Listener) {
+	err := srv.Serve(l)
+	if err != http.ErrServerClosed {
+		log.Info("ACME HTTP server was closed unexpectedly: %s", err)
+	} else {
+		log.Info("ACME HTTP server was closed")
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestACMECert puts the self-signed certificate for host into the ACME
+// cache directory as if it was obtained before
+func writeTestACMECert(t *testing.T, dir, host string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, host), data, 0o600))
+
+	return der
+}
+
+func TestACME(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cert := writeTestACMECert(t, dir, "dns.example.org")
+
+	dnsProxy := createTestProxy(t, &tls.Config{})
+	dnsProxy.ACMEHosts = []string{"dns.example.org"}
+	dnsProxy.ACMECacheDir = dir
+	dnsProxy.ACMEHTTPListenAddr = &net.TCPAddr{IP: net.ParseIP(listenIP)}
+	// Nothing is requested from the CA while the cached certificate is valid
+	dnsProxy.ACMEDirectoryURL = "http://127.0.0.1:1/directory"
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	// The cached certificate is served, also to the clients without SNI
+	for _, serverName := range []string{"dns.example.org", ""} {
+		conn, err := tls.Dial("tcp", dnsProxy.Addr(ProtoTLS).String(), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		assert.Nil(t, err)
+		if err == nil {
+			assert.Equal(t, cert, conn.ConnectionState().PeerCertificates[0].Raw)
+			conn.Close()
+		}
+	}
+
+	// The unknown names are refused
+	_, err = tls.Dial("tcp", dnsProxy.Addr(ProtoTLS).String(), &tls.Config{
+		ServerName:         "other.example.org",
+		InsecureSkipVerify: true,
+	})
+	assert.NotNil(t, err)
+
+	// The challenges are answered on the HTTP listener
+	httpAddr := dnsProxy.acmeHTTPListen.Addr().String()
+	req, err := http.NewRequest(http.MethodGet, "http://"+httpAddr+"/.well-known/acme-challenge/token", nil)
+	assert.Nil(t, err)
+	req.Host = "other.example.org"
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	req.Host = "dns.example.org"
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestACMEValidate(t *testing.T) {
+	c := &Config{
+		TLSConfig:    &tls.Config{},
+		ACMEHosts:    []string{"dns.example.org"},
+		OCSPStapling: true,
+	}
+	assert.Len(t, c.validateACME(), 3)
+
+	c.ACMEHTTPListenAddr = &net.TCPAddr{}
+	c.ACMECacheDir = "acme"
+	c.OCSPStapling = false
+	assert.Empty(t, c.validateACME())
+}
@@ -0,0 +1,586 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/fastip"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+)
+
+// Admin API handlers paths
+const (
+	adminPathCacheFlush  = "/control/cache/flush"
+	adminPathUpstreams   = "/control/upstreams"
+	adminPathStats       = "/control/stats"
+	adminPathVerbose     = "/control/verbose"
+	adminPathHosts       = "/control/hosts"
+	adminPathFastestAddr = "/control/fastest-addr"
+	adminPathRewrites    = "/control/rewrites"
+
+	adminPathRewritesReload = "/control/rewrites/reload"
+
+	adminPathCaptureStart = "/control/capture/start"
+	adminPathCaptureStop  = "/control/capture/stop"
+)
+
+// upstreamsReloadReq is the request body of the upstreams reload handler
+type upstreamsReloadReq struct {
+	Upstreams []string `json:"upstreams"`
+	Bootstrap []string `json:"bootstrap"`
+	Timeout   string   `json:"timeout"`
+
+	// Fallbacks replace the fallbacks of the current configuration if set,
+	// otherwise they're kept
+	Fallbacks       []string `json:"fallbacks"`
+	FallbackTimeout string   `json:"fallback_timeout"`
+}
+
+// verboseReq is the request body of the verbose logging handler
+type verboseReq struct {
+	IP      string `json:"ip"`
+	Enabled bool   `json:"enabled"`
+}
+
+// hostsReq is the request body of the local hosts handler
+type hostsReq struct {
+	Host string   `json:"host"`
+	IPs  []string `json:"ips"`
+}
+
+// captureStartReq is the request body of the capture start handler
+type captureStartReq struct {
+	Name     string `json:"name"`
+	QName    string `json:"qname"`
+	Client   string `json:"client"`
+	Duration string `json:"duration"`
+	Packets  int    `json:"packets"`
+}
+
+func (p *Proxy) createAdminListener() error {
+	if p.AdminListenAddr == nil {
+		return nil
+	}
+
+	log.Info("Creating the admin API server")
+	tcpListen, err := net.ListenTCP("tcp", p.AdminListenAddr)
+	if err != nil {
+		return errorx.Decorate(err, "could not start admin API listener")
+	}
+	p.adminListen = tcpListen
+	p.adminServer = &http.Server{
+		Handler:           p.adminHandler(),
+		ReadHeaderTimeout: defaultTimeout,
+		WriteTimeout:      defaultTimeout,
+	}
+	log.Info("Listening to admin API on http://%s", tcpListen.Addr())
+
+	return nil
+}
+
+// listenAdmin starts the admin API HTTP server
+func (p *Proxy) listenAdmin(srv *http.Server, l net.Listener) {
+	err := srv.Serve(l)
+	if err != http.ErrServerClosed {
+		log.Info("admin API server was closed unexpectedly: %s", err)
+	} else {
+		log.Info("admin API server was closed")
+	}
+}
+
+// adminHandler returns the http.Handler that serves the admin API
+func (p *Proxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPathCacheFlush, p.handleAdminCacheFlush)
+	mux.HandleFunc(adminPathUpstreams, p.handleAdminUpstreams)
+	mux.HandleFunc(adminPathStats, p.handleAdminStats)
+	mux.HandleFunc(adminPathVerbose, p.handleAdminVerbose)
+	mux.HandleFunc(adminPathHosts, p.handleAdminHosts)
+	mux.HandleFunc(adminPathFastestAddr, p.handleAdminFastestAddr)
+	mux.HandleFunc(adminPathRewrites, p.handleAdminRewrites)
+	mux.HandleFunc(adminPathRewritesReload, p.handleAdminRewritesReload)
+	mux.HandleFunc(adminPathCaptureStart, p.handleAdminCaptureStart)
+	mux.HandleFunc(adminPathCaptureStop, p.handleAdminCaptureStop)
+
+	return mux
+}
+
+// decodeAdminJSON decodes the JSON request body into v and writes the error
+// response if it fails.  The requests with another content type are refused,
+// so that the web pages can't send them without the CORS preflight.
+func decodeAdminJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	err = json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot decode request: %s", err), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// handleAdminCacheFlush flushes the whole cache or, if the "name" query
+// parameter is specified, only the entries for that name
+func (p *Proxy) handleAdminCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		log.Info("admin: flushing the cache")
+		p.ClearCache()
+	} else {
+		log.Info("admin: flushing the cache for %s", name)
+		p.ClearCacheForName(name)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAdminUpstreams replaces the upstreams configuration with the one
+// from the request body
+func (p *Proxy) handleAdminUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := upstreamsReloadReq{}
+	if !decodeAdminJSON(w, r, &req) {
+		return
+	}
+
+	var err error
+	timeout := defaultTimeout
+	if req.Timeout != "" {
+		timeout, err = time.ParseDuration(req.Timeout)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid timeout: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	uc, err := ParseUpstreamsConfig(req.Upstreams, req.Bootstrap, timeout)
+	if err == nil && len(uc.Upstreams) == 0 {
+		err = fmt.Errorf("no default upstreams specified")
+	}
+	if err == nil {
+		err = p.reloadFallbacks(&uc, req, timeout)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Info("admin: reloading upstreams configuration")
+	p.SetUpstreamConfig(&uc)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAdminStats writes the runtime statistics as JSON
+func (p *Proxy) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(p.Stats())
+	if err != nil {
+		log.Debug("admin: cannot write stats: %s", err)
+	}
+}
+
+// handleAdminFastestAddr returns the cached results of probing the IP
+// addresses in the fastest-addr mode
+func (p *Proxy) handleAdminFastestAddr(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	results := p.FastestAddrResults()
+	if results == nil {
+		results = []fastip.Result{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(results)
+	if err != nil {
+		log.Debug("admin: cannot write fastest-addr results: %s", err)
+	}
+}
+
+// handleAdminVerbose toggles the verbose logging for a single client IP
+func (p *Proxy) handleAdminVerbose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := verboseReq{}
+	if !decodeAdminJSON(w, r, &req) {
+		return
+	}
+
+	ip := net.ParseIP(req.IP)
+	if ip == nil {
+		http.Error(w, fmt.Sprintf("invalid IP: %s", req.IP), http.StatusBadRequest)
+		return
+	}
+
+	log.Info("admin: setting verbose logging for %s to %t", ip, req.Enabled)
+	p.SetClientVerbose(ip, req.Enabled)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAdminHosts sets the addresses of a local host.  The host is removed
+// if the list of the addresses is empty.
+func (p *Proxy) handleAdminHosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if p.LocalHosts == nil {
+		http.Error(w, "local hosts are disabled", http.StatusBadRequest)
+		return
+	}
+
+	req := hostsReq{}
+	if !decodeAdminJSON(w, r, &req) {
+		return
+	}
+
+	ips := make([]net.IP, 0, len(req.IPs))
+	for _, s := range req.IPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			http.Error(w, fmt.Sprintf("invalid IP: %s", s), http.StatusBadRequest)
+			return
+		}
+		ips = append(ips, ip)
+	}
+
+	log.Info("admin: setting the addresses of %s to %v", req.Host, ips)
+	err := p.LocalHosts.Set(req.Host, ips...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAdminRewrites lists the rewrite rules on GET, adds the rule from the
+// request body on POST, and removes it on DELETE
+func (p *Proxy) handleAdminRewrites(w http.ResponseWriter, r *http.Request) {
+	if p.Rewrites == nil {
+		http.Error(w, "rewrites are disabled", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.Rewrites.Rules())
+		return
+	}
+
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	rule := RewriteRule{}
+	if !decodeAdminJSON(w, r, &rule) {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		log.Info("admin: removing the rewrite %s", rule)
+		if !p.Rewrites.Remove(rule) {
+			http.Error(w, "no such rewrite", http.StatusNotFound)
+			return
+		}
+	} else {
+		log.Info("admin: adding the rewrite %s", rule)
+		err := p.Rewrites.Add(rule)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAdminRewritesReload reloads the rewrites file
+func (p *Proxy) handleAdminRewritesReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if p.Rewrites == nil {
+		http.Error(w, "rewrites are disabled", http.StatusBadRequest)
+		return
+	}
+
+	log.Info("admin: reloading the rewrites file")
+	err := p.Rewrites.Reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAdminCaptureStart starts a packet capture session
+func (p *Proxy) handleAdminCaptureStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := captureStartReq{}
+	if !decodeAdminJSON(w, r, &req) {
+		return
+	}
+
+	conf := CaptureConfig{
+		Name:       req.Name,
+		QName:      req.QName,
+		MaxPackets: req.Packets,
+	}
+
+	if req.Client != "" {
+		conf.Client = net.ParseIP(req.Client)
+		if conf.Client == nil {
+			http.Error(w, fmt.Sprintf("invalid IP: %s", req.Client), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var err error
+	if req.Duration != "" {
+		conf.Duration, err = time.ParseDuration(req.Duration)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid duration: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Info("admin: starting packet capture: %s", conf)
+	err = p.StartCapture(conf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAdminCaptureStop stops the running packet capture session
+func (p *Proxy) handleAdminCaptureStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Info("admin: stopping packet capture")
+	err := p.StopCapture()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// ClearCache removes all the entries from the DNS cache except for the
+// Config.CacheKeepHot most requested ones
+func (p *Proxy) ClearCache() {
+	if p.cache != nil && p.cacheHot != nil {
+		p.clearCacheKeepHot()
+	} else if p.cache != nil {
+		p.cache.clearItems()
+	}
+	if p.cacheSubnet != nil {
+		(*cache)(p.cacheSubnet).clearItems()
+	}
+}
+
+// ClearCacheForName removes the entries for the specified name from the DNS
+// cache.  The subnet cache keys contain the client subnet, so if the ECS is
+// enabled, the subnet cache is cleared entirely.
+func (p *Proxy) ClearCacheForName(name string) {
+	if p.cache != nil {
+		p.cache.delName(name)
+	}
+	if p.cacheSubnet != nil {
+		(*cache)(p.cacheSubnet).clearItems()
+	}
+}
+
+// SetUpstreamConfig replaces the upstreams configuration of a running proxy.
+// The Config.CacheKeepHot most requested cache entries are re-resolved with
+// the new upstreams in the background.  The upstreams of the replaced
+// configuration that uc doesn't have are closed when the requests that
+// started with it are finished.
+func (p *Proxy) SetUpstreamConfig(uc *UpstreamConfig) {
+	p.Lock()
+	old, oldInUse := p.UpstreamConfig, p.upstreamsInUse
+	p.UpstreamConfig = uc
+	p.upstreamsInUse = &sync.WaitGroup{}
+	p.Unlock()
+
+	if old != nil && old != uc {
+		go func() {
+			if oldInUse != nil {
+				oldInUse.Wait()
+			}
+			closeReplacedUpstreams(old, uc)
+		}()
+	}
+
+	if p.cache != nil && p.cacheHot != nil {
+		p.refreshHot(p.cacheHot.top())
+	}
+}
+
+// acquireUpstreams marks the current upstreams configuration as used until
+// release is called, so that SetUpstreamConfig doesn't close its upstreams
+// meanwhile
+func (p *Proxy) acquireUpstreams() (release func()) {
+	p.RLock()
+	defer p.RUnlock()
+
+	wg := p.upstreamsInUse
+	if wg == nil {
+		return func() {}
+	}
+	wg.Add(1)
+
+	return wg.Done
+}
+
+// closeReplacedUpstreams closes the upstreams of old that cur doesn't have
+func closeReplacedUpstreams(old, cur *UpstreamConfig) {
+	var kept []io.Closer
+	for _, u := range cur.all() {
+		if c, ok := u.(io.Closer); ok {
+			kept = append(kept, c)
+		}
+	}
+
+	closed := 0
+	for _, u := range old.all() {
+		c, ok := u.(io.Closer)
+		if !ok || containsCloser(kept, c) {
+			continue
+		}
+
+		if err := c.Close(); err != nil {
+			log.Debug("closing the replaced upstream %s: %s", u.Address(), err)
+		}
+		kept = append(kept, c)
+		closed++
+	}
+
+	log.Debug("Closed %d replaced upstreams", closed)
+}
+
+// containsCloser returns true if closers contain c
+func containsCloser(closers []io.Closer, c io.Closer) bool {
+	for _, k := range closers {
+		if k == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reloadFallbacks sets the fallbacks of the new upstreams configuration from
+// the reload request or, if it has none, from the current configuration
+func (p *Proxy) reloadFallbacks(uc *UpstreamConfig, req upstreamsReloadReq, timeout time.Duration) (err error) {
+	if req.Fallbacks == nil {
+		if cur := p.getUpstreamConfig(); cur != nil {
+			uc.Fallbacks, uc.FallbackTimeout = cur.Fallbacks, cur.FallbackTimeout
+		}
+
+		return nil
+	}
+
+	opts := upstream.Options{Bootstrap: req.Bootstrap, Timeout: timeout}
+	for _, addr := range req.Fallbacks {
+		u, err := upstream.AddressToUpstream(addr, opts)
+		if err != nil {
+			return fmt.Errorf("invalid fallback %s: %w", addr, err)
+		}
+		uc.Fallbacks = append(uc.Fallbacks, u)
+	}
+
+	if req.FallbackTimeout != "" {
+		uc.FallbackTimeout, err = time.ParseDuration(req.FallbackTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid fallback timeout: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// getUpstreamConfig returns the current upstreams configuration
+func (p *Proxy) getUpstreamConfig() *UpstreamConfig {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.UpstreamConfig
+}
+
+// SetClientVerbose enables or disables logging of all the DNS messages
+// exchanged with the specified client regardless of the log level
+func (p *Proxy) SetClientVerbose(ip net.IP, enabled bool) {
+	p.verboseLock.Lock()
+	defer p.verboseLock.Unlock()
+
+	if enabled {
+		if p.verboseClients == nil {
+			p.verboseClients = map[string]bool{}
+		}
+		p.verboseClients[ip.String()] = true
+	} else {
+		delete(p.verboseClients, ip.String())
+	}
+}
+
+// isClientVerbose checks if the verbose logging is enabled for the client
+func (p *Proxy) isClientVerbose(addr net.Addr) bool {
+	p.verboseLock.RLock()
+	defer p.verboseLock.RUnlock()
+
+	if len(p.verboseClients) == 0 {
+		return false
+	}
+
+	return p.verboseClients[getIPString(addr)]
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/fastip"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newAdminJSONRequest returns the admin API request with the JSON body
+func newAdminJSONRequest(method, path, body string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+
+	return r
+}
+
+func TestAdminCacheFlush(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	h := dnsProxy.adminHandler()
+
+	newResp := func(host string) *dns.Msg {
+		m := createHostTestMessage(host)
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		resp.Answer = append(resp.Answer, newRR(host+". 600 IN A 1.2.3.4"))
+		return resp
+	}
+
+	dnsProxy.cache.Set(newResp("host1"))
+	dnsProxy.cache.Set(newResp("host2"))
+
+	// Flush a single name
+	r := httptest.NewRequest(http.MethodPost, adminPathCacheFlush+"?name=host1", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	_, ok := dnsProxy.cache.Get(createHostTestMessage("host1"))
+	assert.False(t, ok)
+	_, ok = dnsProxy.cache.Get(createHostTestMessage("host2"))
+	assert.True(t, ok)
+
+	// Flush everything
+	r = httptest.NewRequest(http.MethodPost, adminPathCacheFlush, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	_, ok = dnsProxy.cache.Get(createHostTestMessage("host2"))
+	assert.False(t, ok)
+
+	// Wrong method
+	r = httptest.NewRequest(http.MethodGet, adminPathCacheFlush, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestAdminUpstreams(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	h := dnsProxy.adminHandler()
+
+	body := `{"upstreams":["1.1.1.1","[/example.org/]1.0.0.1"],"timeout":"1s"}`
+	r := newAdminJSONRequest(http.MethodPost, adminPathUpstreams, body)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	uc := dnsProxy.getUpstreamConfig()
+	assert.Len(t, uc.Upstreams, 1)
+	assert.Equal(t, "1.1.1.1:53", uc.Upstreams[0].Address())
+	assert.Len(t, uc.DomainReservedUpstreams["example.org."], 1)
+
+	// Only reserved upstreams
+	body = `{"upstreams":["[/example.org/]1.0.0.1"]}`
+	r = newAdminJSONRequest(http.MethodPost, adminPathUpstreams, body)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, uc, dnsProxy.getUpstreamConfig())
+}
+
+func TestAdminStats(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	dnsProxy.stats.incRequests()
+	dnsProxy.stats.incRequests()
+	dnsProxy.stats.incResponse(&DNSContext{ResponseClass: ResponseClassCached})
+
+	r := httptest.NewRequest(http.MethodGet, adminPathStats, nil)
+	w := httptest.NewRecorder()
+	dnsProxy.adminHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	stats := Stats{}
+	err = json.Unmarshal(w.Body.Bytes(), &stats)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), stats.Requests)
+	assert.Equal(t, uint64(1), stats.Responses["cached"])
+	assert.False(t, stats.StartTime.IsZero())
+}
+
+func TestAdminFastestAddr(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	// Not in the fastest-addr mode
+	r := httptest.NewRequest(http.MethodGet, adminPathFastestAddr, nil)
+	w := httptest.NewRecorder()
+	dnsProxy.adminHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]\n", w.Body.String())
+
+	dnsProxy.UpstreamMode = UModeFastestAddr
+	dnsProxy.FastestAddr.Probers = []fastip.Prober{&fastip.TCPProber{Port: 1}}
+	err = dnsProxy.Init()
+	assert.Nil(t, err)
+	assert.Empty(t, dnsProxy.FastestAddrResults())
+
+	r = httptest.NewRequest(http.MethodPost, adminPathFastestAddr, nil)
+	w = httptest.NewRecorder()
+	dnsProxy.adminHandler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestAdminVerbose(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	h := dnsProxy.adminHandler()
+	addr := &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 53}
+
+	assert.False(t, dnsProxy.isClientVerbose(addr))
+
+	r := newAdminJSONRequest(http.MethodPost, adminPathVerbose, `{"ip":"1.2.3.4","enabled":true}`)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, dnsProxy.isClientVerbose(addr))
+
+	r = newAdminJSONRequest(http.MethodPost, adminPathVerbose, `{"ip":"1.2.3.4","enabled":false}`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, dnsProxy.isClientVerbose(addr))
+
+	r = newAdminJSONRequest(http.MethodPost, adminPathVerbose, `{"ip":"bad"}`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAdminHosts(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	h := dnsProxy.adminHandler()
+
+	r := newAdminJSONRequest(http.MethodPost, adminPathHosts, `{"host":"nas","ips":["192.168.1.10"]}`)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	dnsProxy.LocalHosts = &LocalHosts{}
+	r = newAdminJSONRequest(http.MethodPost, adminPathHosts, `{"host":"nas","ips":["192.168.1.10"]}`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []net.IP{{192, 168, 1, 10}}, dnsProxy.LocalHosts.Lookup("nas"))
+
+	r = newAdminJSONRequest(http.MethodPost, adminPathHosts, `{"host":"nas","ips":["bad"]}`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	r = newAdminJSONRequest(http.MethodPost, adminPathHosts, `{"host":"nas","ips":[]}`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, dnsProxy.LocalHosts.Lookup("nas"))
+}
+
+// closerTestUpstream records whether it's closed
+type closerTestUpstream struct {
+	testUpstream
+	closed int32
+}
+
+func (u *closerTestUpstream) Close() error {
+	atomic.StoreInt32(&u.closed, 1)
+
+	return nil
+}
+
+func (u *closerTestUpstream) isClosed() bool {
+	return atomic.LoadInt32(&u.closed) == 1
+}
+
+func TestSetUpstreamConfigClose(t *testing.T) {
+	replaced := &closerTestUpstream{}
+	shared := &closerTestUpstream{}
+	p := &Proxy{upstreamsInUse: &sync.WaitGroup{}}
+	p.UpstreamConfig = &UpstreamConfig{
+		Upstreams: []upstream.Upstream{replaced},
+		Fallbacks: []upstream.Upstream{shared},
+	}
+
+	// A request using the replaced upstreams is in progress
+	release := p.acquireUpstreams()
+	p.SetUpstreamConfig(&UpstreamConfig{
+		Upstreams: []upstream.Upstream{&testUpstream{}},
+		Fallbacks: []upstream.Upstream{shared},
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, replaced.isClosed())
+
+	// The requests started after the replacement don't delay the closing
+	defer p.acquireUpstreams()()
+	release()
+	assert.Eventually(t, replaced.isClosed, time.Second, 10*time.Millisecond)
+	assert.False(t, shared.isClosed())
+}
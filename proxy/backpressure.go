@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// busyRetryAfter is the Retry-After value in seconds of the DoH
+	// responses refused because the proxy is busy
+	busyRetryAfter = 1
+
+	// busyReadTimeout is the time a refused TCP connection has to send its
+	// request
+	busyReadTimeout = time.Second
+
+	// busyMaxRefusers is the max number of the TCP connections being
+	// refused at once, the next ones are closed at once
+	busyMaxRefusers = 16
+
+	// defaultUDPQueueSize is the default max number of the UDP requests
+	// waiting for a request goroutine with UDPBackpressureQueue
+	defaultUDPQueueSize = 1000
+)
+
+// UDPBackpressure is the way the UDP requests are handled when all the
+// request goroutines are busy
+type UDPBackpressure int
+
+// UDPBackpressure values
+const (
+	UDPBackpressureBlock    UDPBackpressure = iota // the read loop waits for a goroutine, the requests queue up in the socket buffer
+	UDPBackpressureDrop                            // dropped without a response
+	UDPBackpressureQueue                           // wait in the queue of Config.UDPQueueSize, dropped if it's full
+	UDPBackpressureServfail                        // answered with SERVFAIL
+)
+
+// udpBackpressureNames are the names of the UDPBackpressure values
+var udpBackpressureNames = map[string]UDPBackpressure{
+	"block":    UDPBackpressureBlock,
+	"drop":     UDPBackpressureDrop,
+	"queue":    UDPBackpressureQueue,
+	"servfail": UDPBackpressureServfail,
+}
+
+// String implements the fmt.Stringer interface for UDPBackpressure
+func (b UDPBackpressure) String() string {
+	for name, v := range udpBackpressureNames {
+		if v == b {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("UDPBackpressure(%d)", int(b))
+}
+
+// ParseUDPBackpressure parses the UDP backpressure policy, one of block,
+// drop, queue, and servfail
+func ParseUDPBackpressure(s string) (UDPBackpressure, error) {
+	b, ok := udpBackpressureNames[s]
+	if !ok {
+		return 0, fmt.Errorf("invalid UDP backpressure policy %q", s)
+	}
+
+	return b, nil
+}
+
+// genNotReady returns REFUSED with the "Not Ready" Extended DNS Error
+func genNotReady(req *dns.Msg) *dns.Msg {
+	res := &dns.Msg{}
+	res.SetRcode(req, dns.RcodeRefused)
+	res.RecursionAvailable = true
+	setEDE(res, req, edeNotReady, "server is busy")
+
+	return res
+}
+
+// refuseTCPConnection answers the first request of the TCP or TLS connection
+// accepted when all the request goroutines are busy with REFUSED and closes
+// the connection, so that the client fails over to another server instead of
+// waiting in the queue
+func (p *Proxy) refuseTCPConnection(conn net.Conn, proto string, lc *ListenerConfig) {
+	defer conn.Close()
+
+	p.stats.incBusyRefused()
+	log.Debug("Refusing %s connection %s: too many requests", proto, conn.RemoteAddr())
+
+	conn.SetDeadline(time.Now().Add(busyReadTimeout)) //nolint
+	packet, err := proxyutil.ReadPrefixed(conn)
+	if err != nil || p.isTooLarge(lc, conn.RemoteAddr(), len(packet)) {
+		return
+	}
+
+	req, err := proxyutil.UnpackMsg(packet)
+	if err != nil {
+		return
+	}
+
+	bytes, err := genNotReady(req).Pack()
+	if err != nil {
+		log.Tracef("packing refused response: %s", err)
+		return
+	}
+
+	err = proxyutil.WritePrefixed(bytes, conn)
+	if err != nil && !proxyutil.IsConnClosed(err) {
+		log.Tracef("writing refused response to %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+// acquireHTTP acquires a request goroutine for the DoH request if
+// Config.Backpressure is set.  If all of them are busy, it answers with 503
+// and returns false.  release must be called after the request is handled
+// if ok is true.
+func (p *Proxy) acquireHTTP(w http.ResponseWriter) (release func(), ok bool) {
+	if !p.Backpressure {
+		return func() {}, true
+	}
+
+	if !p.requestGoroutinesSema.tryAcquire() {
+		p.stats.incBusyRefused()
+		w.Header().Set("Retry-After", strconv.Itoa(busyRetryAfter))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	return p.requestGoroutinesSema.release, true
+}
+
+// udpQueueSize returns the max number of the UDP requests waiting for a
+// request goroutine
+func (p *Proxy) udpQueueSize() int {
+	if p.UDPQueueSize > 0 {
+		return p.UDPQueueSize
+	}
+
+	return defaultUDPQueueSize
+}
+
+// udpBusy handles the UDP request that came when all the request goroutines
+// are busy according to Config.UDPBackpressure.  It returns true if a
+// goroutine has been acquired for r, otherwise r is queued, dropped, or
+// answered and its buffer is taken care of.
+func (p *Proxy) udpBusy(r udpRequest, conn net.PacketConn, lc *ListenerConfig, w *udpWriter, queue chan udpRequest, requestGoroutinesSema semaphore) bool {
+	p.stats.incUDPSaturated()
+
+	switch p.UDPBackpressure {
+	case UDPBackpressureDrop:
+		log.Debug("Dropping UDP packet from %s: too many requests", r.remoteAddr)
+	case UDPBackpressureQueue:
+		select {
+		case queue <- r:
+			return false
+		default:
+			log.Debug("Dropping UDP packet from %s: the queue is full", r.remoteAddr)
+		}
+	case UDPBackpressureServfail:
+		if p.udpServfail(r, conn, lc, w) {
+			p.udpBufPool.Put(r.buf)
+			return false
+		}
+		log.Debug("Dropping UDP packet from %s: too many requests", r.remoteAddr)
+	default:
+		requestGoroutinesSema.acquire()
+		return true
+	}
+
+	p.stats.incUDPDropped()
+	p.udpBufPool.Put(r.buf)
+
+	return false
+}
+
+// udpQueueLoop passes the queued UDP requests to handle in new goroutines as
+// the request goroutines become available until queue is closed
+func udpQueueLoop(queue chan udpRequest, requestGoroutinesSema semaphore, handle func(r udpRequest)) {
+	for r := range queue {
+		requestGoroutinesSema.acquire()
+		go handle(r)
+	}
+}
+
+// udpServfail answers the UDP request with SERVFAIL.  It returns false if
+// the packet isn't a valid request or its client is denied by the ACL or
+// ratelimited, such packets must be dropped.
+func (p *Proxy) udpServfail(r udpRequest, conn net.PacketConn, lc *ListenerConfig, w *udpWriter) bool {
+	req, err := proxyutil.UnpackMsg(r.packet)
+	if err != nil || req.Response {
+		// Never answer the responses
+		return false
+	}
+
+	d := &DNSContext{
+		Proto:      ProtoUDP,
+		Req:        req,
+		Addr:       r.remoteAddr,
+		packetConn: conn,
+		localIP:    r.localIP,
+		udpWriter:  w,
+
+		listener: lc,
+	}
+	if !p.isAllowedEarly(d) {
+		return false
+	}
+	d.Res = p.genServerFailure(req)
+
+	err = p.respondUDP(d)
+	if err != nil && !proxyutil.IsConnClosed(err) {
+		log.Tracef("writing SERVFAIL response to %s: %s", r.remoteAddr, err)
+	}
+
+	return true
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackpressureConfig(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Backpressure = true
+	assert.NotNil(t, dnsProxy.validateConfig())
+
+	dnsProxy.MaxGoroutines = 1
+	assert.Nil(t, dnsProxy.validateConfig())
+}
+
+// assertNotReady checks that the response is REFUSED with the "Not Ready"
+// Extended DNS Error
+func assertNotReady(t *testing.T, res *dns.Msg) {
+	assert.Equal(t, dns.RcodeRefused, res.Rcode)
+	assertEDE(t, res, edeNotReady)
+}
+
+func TestBackpressureTCP(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.MaxGoroutines = 1
+	dnsProxy.Backpressure = true
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	addr := dnsProxy.Addr(ProtoTCP).String()
+	req := createTestMessage()
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	// The open connection takes the only goroutine
+	busy, err := dns.Dial("tcp", addr)
+	assert.Nil(t, err)
+	assert.Nil(t, busy.SetDeadline(time.Now().Add(time.Second)))
+	assert.Nil(t, busy.WriteMsg(req))
+	res, err := busy.ReadMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+
+	conn, err := dns.Dial("tcp", addr)
+	assert.Nil(t, err)
+	assert.Nil(t, conn.SetDeadline(time.Now().Add(time.Second)))
+	assert.Nil(t, conn.WriteMsg(req))
+	res, err = conn.ReadMsg()
+	assert.Nil(t, err)
+	assertNotReady(t, res)
+	assert.Nil(t, conn.Close())
+
+	// The goroutine is released when the connection is closed
+	assert.Nil(t, busy.Close())
+	assert.Eventually(t, func() bool {
+		res, _, err = (&dns.Client{Net: "tcp", Timeout: time.Second}).Exchange(req, addr)
+		return err == nil && res.Rcode == dns.RcodeSuccess
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, uint64(1), dnsProxy.Stats().BusyRefused)
+}
+
+func TestBackpressureHTTPS(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.MaxGoroutines = 1
+	dnsProxy.Backpressure = true
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+	assert.Nil(t, dnsProxy.Init())
+
+	newRequest := func() *http.Request {
+		packed, err := createTestMessage().Pack()
+		assert.Nil(t, err)
+
+		r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packed))
+		r.Header.Set("Content-Type", "application/dns-message")
+		r.RemoteAddr = (&net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 1234}).String()
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	dnsProxy.ServeHTTP(w, newRequest())
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	dnsProxy.requestGoroutinesSema.acquire()
+	w = httptest.NewRecorder()
+	dnsProxy.ServeHTTP(w, newRequest())
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	dnsProxy.requestGoroutinesSema.release()
+
+	w = httptest.NewRecorder()
+	dnsProxy.ServeHTTP(w, newRequest())
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, uint64(1), dnsProxy.Stats().BusyRefused)
+}
+
+func TestUDPBackpressureConfig(t *testing.T) {
+	for _, s := range []string{"block", "drop", "queue", "servfail"} {
+		b, err := ParseUDPBackpressure(s)
+		assert.Nil(t, err)
+		assert.Equal(t, s, b.String())
+	}
+	_, err := ParseUDPBackpressure("refuse")
+	assert.NotNil(t, err)
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UDPBackpressure = UDPBackpressureDrop
+	assert.NotNil(t, dnsProxy.validateConfig())
+
+	dnsProxy.UDPMaxGoroutines = 1
+	assert.Nil(t, dnsProxy.validateConfig())
+
+	dnsProxy.UDPQueueSize = -1
+	assert.NotNil(t, dnsProxy.validateConfig())
+}
+
+func TestUDPBackpressure(t *testing.T) {
+	testCases := []struct {
+		name      string
+		policy    UDPBackpressure
+		ratelimit int
+		response  bool // the packets are responses
+		rcode     int  // rcode of the answered requests, -1 if none is answered
+		dropped   uint64
+	}{
+		{name: "drop", policy: UDPBackpressureDrop, rcode: -1, dropped: 2},
+		{name: "servfail", policy: UDPBackpressureServfail, rcode: dns.RcodeServerFailure},
+		// The second request is ratelimited
+		{name: "servfail_ratelimit", policy: UDPBackpressureServfail, ratelimit: 1, rcode: dns.RcodeServerFailure, dropped: 1},
+		{name: "servfail_response", policy: UDPBackpressureServfail, response: true, rcode: -1, dropped: 2},
+		// The first request waits in the queue, the second one is dropped
+		{name: "queue", policy: UDPBackpressureQueue, rcode: dns.RcodeSuccess, dropped: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.UDPMaxGoroutines = 1
+			dnsProxy.UDPBackpressure = tc.policy
+			dnsProxy.UDPQueueSize = 1
+			dnsProxy.Ratelimit = tc.ratelimit
+			dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+				d.Res = genEmptyNoError(d.Req)
+				return nil
+			}
+
+			assert.Nil(t, dnsProxy.Start())
+			defer func() {
+				assert.Nil(t, dnsProxy.Stop())
+			}()
+
+			// The only UDP goroutine is busy
+			dnsProxy.udpGoroutinesSema.acquire()
+
+			conn, err := net.Dial("udp", dnsProxy.Addr(ProtoUDP).String())
+			assert.Nil(t, err)
+			defer conn.Close()
+			client := &dns.Conn{Conn: conn}
+			for i := 0; i < 2; i++ {
+				m := createTestMessage()
+				m.Response = tc.response
+				assert.Nil(t, client.WriteMsg(m))
+			}
+
+			if tc.policy == UDPBackpressureQueue {
+				assert.Eventually(t, func() bool {
+					return dnsProxy.Stats().UDPSaturated == 2
+				}, time.Second, 10*time.Millisecond)
+				dnsProxy.udpGoroutinesSema.release()
+			}
+
+			assert.Nil(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+			res, err := client.ReadMsg()
+			if tc.rcode < 0 {
+				assert.NotNil(t, err)
+			} else if assert.Nil(t, err) {
+				assert.Equal(t, tc.rcode, res.Rcode)
+			}
+
+			stats := dnsProxy.Stats()
+			assert.Equal(t, uint64(2), stats.UDPSaturated)
+			assert.Equal(t, tc.dropped, stats.UDPDropped)
+		})
+	}
+}
+
+func TestBackpressureTCPRefusers(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.MaxGoroutines = 1
+	dnsProxy.Backpressure = true
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	addr := dnsProxy.Addr(ProtoTCP).String()
+
+	// The open connection takes the only goroutine and the silent ones take
+	// all the refusers
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	for i := 0; i < busyMaxRefusers+1; i++ {
+		c, err := net.Dial("tcp", addr)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		conns = append(conns, c)
+	}
+	assert.Eventually(t, func() bool {
+		return len(dnsProxy.busyRefusersSema.(*chanSemaphore).c) == busyMaxRefusers
+	}, time.Second, 10*time.Millisecond)
+
+	// The next connection is closed at once
+	conn, err := net.Dial("tcp", addr)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+	assert.Nil(t, conn.SetDeadline(time.Now().Add(busyReadTimeout/2)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, uint64(busyMaxRefusers+1), dnsProxy.Stats().BusyRefused)
+}
@@ -0,0 +1,379 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+const (
+	// blockedTTL is the TTL of the responses to the blocked requests
+	blockedTTL = 10
+	// blocklistFetchTimeout is the timeout of downloading a blocklist
+	blocklistFetchTimeout = time.Minute
+)
+
+// BlockingMode is the way the blocked requests are answered
+type BlockingMode int
+
+// BlockingMode values
+const (
+	BlockingModeNXDomain BlockingMode = iota // NXDOMAIN
+	BlockingModeNullIP                       // 0.0.0.0 or :: for A and AAAA, empty NOERROR for the others
+	BlockingModeCustomIP                     // Blocklist.BlockingIP for its type, empty NOERROR for the others
+)
+
+// ParseBlockingMode parses the blocking mode name: nxdomain, null_ip, or
+// custom_ip
+func ParseBlockingMode(s string) (BlockingMode, error) {
+	switch s {
+	case "nxdomain":
+		return BlockingModeNXDomain, nil
+	case "null_ip":
+		return BlockingModeNullIP, nil
+	case "custom_ip":
+		return BlockingModeCustomIP, nil
+	default:
+		return 0, fmt.Errorf("invalid blocking mode %q", s)
+	}
+}
+
+// ruleKind is the set of the rules for a domain
+type ruleKind uint8
+
+const (
+	ruleBlock          ruleKind = 1 << iota // block the domain
+	ruleBlockSubdomain                      // block the domain and its subdomains
+	ruleAllow                               // unblock the domain
+	ruleAllowSubdomain                      // unblock the domain and its subdomains
+)
+
+// Blocklist blocks the domains from the hosts files, the domain lists, and
+// the AdBlock-style filter lists.  Only the domain rules of the filter lists
+// are supported, "||example.org^" blocks the domain and its subdomains and
+// "@@||example.org^" unblocks them.  The other rules are skipped.
+type Blocklist struct {
+	// Sources are the paths or the http(s) URLs of the lists
+	Sources []string
+	// Mode is the way the blocked requests are answered
+	Mode BlockingMode
+	// BlockingIP is the IP address the blocked A or AAAA requests are
+	// answered with in BlockingModeCustomIP
+	BlockingIP net.IP
+	// RefreshInterval is the interval between the reloads of the lists.  If
+	// 0, they are only loaded on start.
+	RefreshInterval time.Duration
+	// Censored, if true, means that the lists are imposed by an external
+	// authority, so the blocked responses have the Censored Extended DNS
+	// Error instead of the Blocked one
+	Censored bool
+
+	sources map[string]map[string]ruleKind // source -> its rules
+	rules   map[string]ruleKind            // rules of all the sources
+	lock    sync.RWMutex
+}
+
+// Refresh reloads the lists.  If a list fails to load, its previous rules
+// are kept and the error is returned after the other lists are loaded.
+func (b *Blocklist) Refresh() error {
+	var errs []error
+	loaded := map[string]map[string]ruleKind{}
+	for _, src := range b.Sources {
+		rules, err := loadBlocklist(src)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		loaded[src] = rules
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.sources == nil {
+		b.sources = map[string]map[string]ruleKind{}
+	}
+	for src, rules := range loaded {
+		b.sources[src] = rules
+	}
+
+	b.rules = map[string]ruleKind{}
+	for _, rules := range b.sources {
+		for domain, kind := range rules {
+			b.rules[domain] |= kind
+		}
+	}
+
+	if len(errs) != 0 {
+		return errorx.DecorateMany("failed to load blocklists", errs...)
+	}
+
+	return nil
+}
+
+// RulesCount returns the number of the domains with the rules
+func (b *Blocklist) RulesCount() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return len(b.rules)
+}
+
+// Match returns true if the host is blocked.  b may be nil, nothing is
+// blocked then.
+func (b *Blocklist) Match(host string) bool {
+	if b == nil {
+		return false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	blocked := false
+	for domain, exact := host, true; domain != ""; exact = false {
+		kind := b.rules[domain]
+		if exact && kind&ruleAllow != 0 || kind&ruleAllowSubdomain != 0 {
+			return false
+		}
+		if exact && kind&ruleBlock != 0 || kind&ruleBlockSubdomain != 0 {
+			blocked = true
+		}
+
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+
+	return blocked
+}
+
+// edeCode returns the Extended DNS Error info code of the blocked responses
+func (b *Blocklist) edeCode() uint16 {
+	if b.Censored {
+		return edeCensored
+	}
+
+	return edeBlocked
+}
+
+// response returns the response to the blocked request
+func (b *Blocklist) response(req *dns.Msg) *dns.Msg {
+	if b.Mode == BlockingModeNXDomain {
+		return GenEmptyMessage(req, dns.RcodeNameError, blockedTTL)
+	}
+
+	var ip net.IP
+	qtype := req.Question[0].Qtype
+	switch b.Mode {
+	case BlockingModeNullIP:
+		if qtype == dns.TypeA {
+			ip = net.IPv4zero
+		} else {
+			ip = net.IPv6zero
+		}
+	case BlockingModeCustomIP:
+		ip = b.BlockingIP
+	}
+
+	var rr dns.RR
+	hdr := dns.RR_Header{Name: req.Question[0].Name, Rrtype: qtype, Class: dns.ClassINET, Ttl: blockedTTL}
+	if ip4 := ip.To4(); qtype == dns.TypeA && ip4 != nil {
+		rr = &dns.A{Hdr: hdr, A: ip4}
+	} else if qtype == dns.TypeAAAA && ip != nil && ip.To4() == nil {
+		rr = &dns.AAAA{Hdr: hdr, AAAA: ip}
+	} else {
+		return GenEmptyMessage(req, dns.RcodeSuccess, blockedTTL)
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	resp.Answer = []dns.RR{rr}
+	return resp
+}
+
+// loadBlocklist loads the rules from the file or the URL
+func loadBlocklist(src string) (map[string]ruleKind, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		client := &http.Client{Timeout: blocklistFetchTimeout}
+		resp, err := client.Get(src)
+		if err != nil {
+			return nil, errorx.Decorate(err, "couldn't download %s", src)
+		}
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("couldn't download %s: status %d", src, resp.StatusCode)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, errorx.Decorate(err, "couldn't open %s", src)
+		}
+		r = f
+	}
+	defer r.Close()
+
+	rules := map[string]ruleKind{}
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		domains, kind := parseBlocklistLine(line)
+		for _, d := range domains {
+			rules[d] |= kind
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errorx.Decorate(err, "couldn't read %s", src)
+		}
+	}
+
+	return rules, nil
+}
+
+// hostsLocalNames are the names in the hosts files that are never blocked
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+}
+
+// parseBlocklistLine parses a line of a hosts file, a domain list, or a
+// filter list.  It returns no domains if the line has no supported rule.
+func parseBlocklistLine(line string) (domains []string, kind ruleKind) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return nil, 0
+	}
+
+	if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+		kind = ruleBlockSubdomain
+		if strings.HasPrefix(line, "@@") {
+			kind = ruleAllowSubdomain
+			line = line[2:]
+		}
+
+		// Only the rules without the modifiers and the paths are
+		// supported
+		if !strings.HasSuffix(line, "^") {
+			return nil, 0
+		}
+		domains = []string{line[2 : len(line)-1]}
+	} else {
+		// A separate "#" starts a comment, while "##" and the like
+		// within a word mark the cosmetic rules of the filter lists
+		// that are rejected by isBlockableDomain
+		fields := strings.Fields(line)
+		for i, f := range fields {
+			if f[0] == '#' {
+				fields = fields[:i]
+				break
+			}
+		}
+
+		switch {
+		case len(fields) == 1:
+			// A domain list
+			domains = fields
+		case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+			// A hosts file, the address itself is ignored
+			domains = fields[1:]
+		default:
+			return nil, 0
+		}
+		kind = ruleBlock
+	}
+
+	valid := domains[:0]
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if isBlockableDomain(d) {
+			valid = append(valid, d)
+		}
+	}
+
+	if len(valid) == 0 {
+		return nil, 0
+	}
+
+	return valid, kind
+}
+
+// isBlockableDomain returns true if the domain of a rule is valid and isn't
+// a local name
+func isBlockableDomain(domain string) bool {
+	if hostsLocalNames[domain] || net.ParseIP(domain) != nil || strings.ContainsAny(domain, "*/|^$#") {
+		return false
+	}
+
+	_, ok := dns.IsDomainName(domain)
+	return ok
+}
+
+// startBlocklist loads the blocklist and starts the refresh loop if needed
+func (p *Proxy) startBlocklist() {
+	b := p.Blocklist
+	if b == nil {
+		return
+	}
+
+	err := b.Refresh()
+	if err != nil {
+		log.Error("%s", err)
+	}
+	log.Info("Loaded %d blocking rules from %d lists", b.RulesCount(), len(b.Sources))
+
+	if b.RefreshInterval <= 0 {
+		return
+	}
+
+	p.blocklistStop = make(chan struct{})
+	go p.blocklistRefreshLoop(p.blocklistStop)
+}
+
+// stopBlocklist stops the blocklist refresh loop if it's running
+func (p *Proxy) stopBlocklist() {
+	if p.blocklistStop != nil {
+		close(p.blocklistStop)
+		p.blocklistStop = nil
+	}
+}
+
+// blocklistRefreshLoop reloads the blocklist until stop is closed
+func (p *Proxy) blocklistRefreshLoop(stop chan struct{}) {
+	t := time.NewTicker(p.Blocklist.RefreshInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			err := p.Blocklist.Refresh()
+			if err != nil {
+				log.Error("%s", err)
+			}
+			log.Debug("Reloaded %d blocking rules", p.Blocklist.RulesCount())
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBlocklistLine(t *testing.T) {
+	testCases := []struct {
+		line    string
+		domains []string
+		kind    ruleKind
+	}{
+		{"0.0.0.0 ads.example.org", []string{"ads.example.org"}, ruleBlock},
+		{"127.0.0.1 a.example.org B.example.org. # comment", []string{"a.example.org", "b.example.org"}, ruleBlock},
+		{"127.0.0.1 localhost localhost.localdomain", nil, 0},
+		{"::1 ip6-localhost", nil, 0},
+		{"tracker.example.org", []string{"tracker.example.org"}, ruleBlock},
+		{"||example.com^", []string{"example.com"}, ruleBlockSubdomain},
+		{"@@||good.example.com^", []string{"good.example.com"}, ruleAllowSubdomain},
+		{"||example.com^$third-party", nil, 0},
+		{"||example.com/ads", nil, 0},
+		{"||*.example.com^", nil, 0},
+		{"example.com##.banner", nil, 0},
+		{"0.0.0.0 ads.example.org\t# comment", []string{"ads.example.org"}, ruleBlock},
+		{"# comment", nil, 0},
+		{"! comment", nil, 0},
+		{"[Adblock Plus 2.0]", nil, 0},
+		{"", nil, 0},
+	}
+
+	for _, tc := range testCases {
+		domains, kind := parseBlocklistLine(tc.line)
+		assert.Equal(t, tc.domains, domains, tc.line)
+		assert.Equal(t, tc.kind, kind, tc.line)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("0.0.0.0 ads.example.org\n0.0.0.0 good.example.net\n"), 0o644))
+
+	filter := "! Title: test\n||example.net^\n@@||good.example.net^"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(filter))
+	}))
+	defer srv.Close()
+
+	b := &Blocklist{Sources: []string{path, srv.URL}}
+	assert.Nil(t, b.Refresh())
+	assert.Equal(t, 3, b.RulesCount())
+
+	testCases := map[string]bool{
+		"ads.example.org.":     true,
+		"ADS.example.org.":     true,
+		"sub.ads.example.org.": false,
+		"example.org.":         false,
+		"example.net.":         true,
+		"sub.example.net.":     true,
+		"good.example.net.":    false,
+		"sub.good.example.net": false,
+		"example.com.":         false,
+	}
+	for host, blocked := range testCases {
+		assert.Equal(t, blocked, b.Match(host), host)
+	}
+
+	// The rules of the failed lists are kept
+	assert.Nil(t, os.Remove(path))
+	filter = "||example.com^"
+	assert.NotNil(t, b.Refresh())
+	assert.True(t, b.Match("ads.example.org."))
+	assert.True(t, b.Match("example.com."))
+	assert.False(t, b.Match("example.net."))
+
+	var nilBlocklist *Blocklist
+	assert.False(t, nilBlocklist.Match("example.com."))
+}
+
+func TestBlocklistResponse(t *testing.T) {
+	newReq := func(qtype uint16) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion("ads.example.org.", qtype)
+		return req
+	}
+
+	b := &Blocklist{Mode: BlockingModeNXDomain}
+	resp := b.response(newReq(dns.TypeA))
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Len(t, resp.Ns, 1)
+
+	b.Mode = BlockingModeNullIP
+	resp = b.response(newReq(dns.TypeA))
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, net.IPv4zero.To4(), resp.Answer[0].(*dns.A).A)
+	resp = b.response(newReq(dns.TypeAAAA))
+	assert.Equal(t, net.IPv6zero, resp.Answer[0].(*dns.AAAA).AAAA)
+	resp = b.response(newReq(dns.TypeMX))
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+
+	b.Mode = BlockingModeCustomIP
+	b.BlockingIP = net.ParseIP("192.168.1.2")
+	resp = b.response(newReq(dns.TypeA))
+	assert.Equal(t, "192.168.1.2", resp.Answer[0].(*dns.A).A.String())
+	resp = b.response(newReq(dns.TypeAAAA))
+	assert.Empty(t, resp.Answer)
+
+	_, err := ParseBlockingMode("null_ip")
+	assert.Nil(t, err)
+	_, err = ParseBlockingMode("drop")
+	assert.NotNil(t, err)
+}
+
+func TestBlocklistProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "filter.txt")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("||blocked.example.org^\n"), 0o644))
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TCPListenAddr = nil
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+	dnsProxy.Blocklist = &Blocklist{Sources: []string{path}}
+
+	err = dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	client := &dns.Client{Net: "udp"}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	req := &dns.Msg{}
+	req.SetQuestion("ads.blocked.example.org.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	res, _, err := client.Exchange(req, addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+	assertEDE(t, res, edeBlocked)
+
+	res, _, err = client.Exchange(createTestMessage(), addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+
+	stats := dnsProxy.Stats()
+	assert.Equal(t, uint64(1), stats.Responses[ResponseClassBlocked.String()])
+}
@@ -1,15 +1,18 @@
 package proxy
 
 import (
+	"net"
+
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/miekg/dns"
 )
 
 // isBogusNXDomain - checks if the specified DNS message
 // contains AT LEAST ONE ip address from the Proxy.BogusNXDomain list
+// or the Proxy.BogusNXDomainNets subnets
 func (p *Proxy) isBogusNXDomain(reply *dns.Msg) bool {
 	if reply == nil ||
-		len(p.BogusNXDomain) == 0 ||
+		(len(p.BogusNXDomain) == 0 && len(p.BogusNXDomainNets) == 0) ||
 		len(reply.Answer) == 0 ||
 		(reply.Question[0].Qtype != dns.TypeA &&
 			reply.Question[0].Qtype != dns.TypeAAAA) {
@@ -18,7 +21,7 @@ func (p *Proxy) isBogusNXDomain(reply *dns.Msg) bool {
 
 	for _, rr := range reply.Answer {
 		ip := proxyutil.GetIPFromDNSRecord(rr)
-		if proxyutil.ContainsIP(p.BogusNXDomain, ip) {
+		if proxyutil.ContainsIP(p.BogusNXDomain, ip) || p.isBogusNXDomainNet(ip) {
 			return true
 		}
 	}
@@ -26,3 +29,19 @@ func (p *Proxy) isBogusNXDomain(reply *dns.Msg) bool {
 	// No IPs are bogus if we got here
 	return false
 }
+
+// isBogusNXDomainNet checks if ip is within one of the Proxy.BogusNXDomainNets
+// subnets
+func (p *Proxy) isBogusNXDomainNet(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range p.BogusNXDomainNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
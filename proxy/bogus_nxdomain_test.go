@@ -74,3 +74,26 @@ func TestBogusNXDomainTypeA(t *testing.T) {
 
 	_ = dnsProxy.Stop()
 }
+
+func TestBogusNXDomainNets(t *testing.T) {
+	nets, err := ParseSubnets([]string{"198.51.100.0/24", "2001:db8::/32"})
+	assert.Nil(t, err)
+	p := &Proxy{}
+	p.BogusNXDomainNets = nets
+
+	newReply := func(rr dns.RR) *dns.Msg {
+		req := createHostTestMessage("host")
+		req.Question[0].Qtype = rr.Header().Rrtype
+		reply := genEmptyNoError(req)
+		reply.Answer = []dns.RR{rr}
+		return reply
+	}
+
+	hdr := dns.RR_Header{Rrtype: dns.TypeA, Name: "host.", Ttl: 10}
+	assert.True(t, p.isBogusNXDomain(newReply(&dns.A{Hdr: hdr, A: net.IP{198, 51, 100, 7}})))
+	assert.False(t, p.isBogusNXDomain(newReply(&dns.A{Hdr: hdr, A: net.IP{198, 51, 101, 7}})))
+
+	hdr.Rrtype = dns.TypeAAAA
+	assert.True(t, p.isBogusNXDomain(newReply(&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})))
+	assert.False(t, p.isBogusNXDomain(newReply(&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db9::1")})))
+}
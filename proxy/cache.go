@@ -14,37 +14,86 @@ import (
 
 const (
 	defaultCacheSize = 64 * 1024 // in bytes
+
+	// staleAnswerTTL is the TTL of the stale responses, see RFC 8767
+	staleAnswerTTL = 30
 )
 
 type cache struct {
 	items        glcache.Cache // cache
 	cacheSize    int           // cache size (in bytes)
-	sync.RWMutex               // lock
+	shards       int           // number of the storage shards, see Config.CacheShards
+	sync.RWMutex               // lock of items and keys initialization
+
+	// keys is the index of the items keys, since the underlying storage
+	// can't be iterated, sharded like the storage.  It may be slightly out
+	// of sync with the storage under concurrent updates, so it's only used
+	// to range the items.
+	keys []keysShard
+
+	// staleTime is how long the expired responses are kept to be served if
+	// the upstreams fail, see Config.CacheServeStale
+	staleTime time.Duration
 }
 
 func (c *cache) Get(request *dns.Msg) (*dns.Msg, bool) {
+	res, _, ok := c.getWithTTL(request)
+	return res, ok
+}
+
+// getWithTTL is Get that also returns the TTL the response has been cached
+// with
+func (c *cache) getWithTTL(request *dns.Msg) (*dns.Msg, uint32, bool) {
 	if request == nil || len(request.Question) != 1 {
-		return nil, false
+		return nil, 0, false
 	}
 	// create key for request
 	key := key(request)
-	c.Lock()
-	if c.items == nil {
-		c.Unlock()
-		return nil, false
+	items := c.getItems()
+	if items == nil {
+		return nil, 0, false
 	}
-	c.Unlock()
-	data := c.items.Get(key)
+	data := items.Get(key)
 	if data == nil {
-		return nil, false
+		return nil, 0, false
 	}
 
-	res := unpackResponse(data, request)
+	res, ttl := unpackResponseWithTTL(data, request)
 	if res == nil {
-		c.items.Del(key)
-		return nil, false
+		if !c.isStale(data) {
+			items.Del(key)
+		}
+		return nil, 0, false
+	}
+	return res, ttl, true
+}
+
+// getStale returns the cached response to the request that has expired less
+// than staleTime ago or nil.  Its TTL is staleAnswerTTL.
+func (c *cache) getStale(request *dns.Msg) *dns.Msg {
+	if c.staleTime <= 0 || request == nil || len(request.Question) != 1 {
+		return nil
+	}
+
+	items := c.getItems()
+	if items == nil {
+		return nil
+	}
+
+	data := items.Get(key(request))
+	if data == nil || !c.isStale(data) {
+		return nil
 	}
-	return res, true
+
+	res, _ := unpackResponseAt(data, request, staleAnswerTTL)
+	return res
+}
+
+// isStale returns true if the cached data has expired less than staleTime
+// ago or hasn't expired yet
+func (c *cache) isStale(data []byte) bool {
+	expire := int64(binary.BigEndian.Uint32(data[:4]))
+	return c.staleTime > 0 && time.Now().Unix() < expire+int64(c.staleTime/time.Second)
 }
 
 func (c *cache) Set(m *dns.Msg) {
@@ -57,23 +106,174 @@ func (c *cache) Set(m *dns.Msg) {
 	}
 
 	key := key(m)
+	items := c.initItems()
+
+	data := packResponse(m)
+	c.addKey(key)
+	_ = items.Set(key, data)
+}
+
+// getItems returns the storage or nil if nothing has been cached yet
+func (c *cache) getItems() glcache.Cache {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.items
+}
+
+// initItems returns the storage, it's created on the first call
+func (c *cache) initItems() glcache.Cache {
+	if items := c.getItems(); items != nil {
+		return items
+	}
 
 	c.Lock()
-	// lazy initialization for cache
-	if c.items == nil {
-		conf := glcache.Config{
-			MaxSize:   defaultCacheSize,
-			EnableLRU: true,
+	defer c.Unlock()
+
+	if c.items != nil {
+		return c.items
+	}
+
+	conf := glcache.Config{
+		MaxSize:   defaultCacheSize,
+		EnableLRU: true,
+		OnDelete: func(k, _ []byte) {
+			c.delKey(k)
+		},
+	}
+	if c.cacheSize > 0 {
+		conf.MaxSize = uint(c.cacheSize)
+	}
+
+	n := cacheShardsNum(conf.MaxSize, c.shards)
+	c.keys = make([]keysShard, n)
+	for i := range c.keys {
+		c.keys[i].keys = map[string]struct{}{}
+	}
+	c.items = newShardedCache(conf, n)
+
+	return c.items
+}
+
+// keysShard returns the shard of the keys index the key belongs to.  The
+// storage must be initialized.
+func (c *cache) keysShard(k []byte) *keysShard {
+	return &c.keys[shardIndex(k, len(c.keys))]
+}
+
+// addKey adds the key to the index
+func (c *cache) addKey(k []byte) {
+	s := c.keysShard(k)
+	s.Lock()
+	defer s.Unlock()
+
+	s.keys[string(k)] = struct{}{}
+}
+
+// delKey removes the key from the index
+func (c *cache) delKey(k []byte) {
+	s := c.keysShard(k)
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.keys, string(k))
+}
+
+// keysLen returns the number of the keys in the index
+func (c *cache) keysLen() (n int) {
+	if c.getItems() == nil {
+		return 0
+	}
+
+	for i := range c.keys {
+		s := &c.keys[i]
+		s.Lock()
+		n += len(s.keys)
+		s.Unlock()
+	}
+
+	return n
+}
+
+// clearItems removes all the items from the cache
+func (c *cache) clearItems() {
+	items := c.getItems()
+	if items == nil {
+		return
+	}
+
+	items.Clear()
+	for i := range c.keys {
+		s := &c.keys[i]
+		s.Lock()
+		s.keys = map[string]struct{}{}
+		s.Unlock()
+	}
+}
+
+// rangeItems calls f for each item of the cache until f returns false.  The
+// items added during the call may be skipped.
+func (c *cache) rangeItems(f func(k, data []byte) bool) {
+	items := c.getItems()
+	if items == nil {
+		return
+	}
+
+	var keys []string
+	for i := range c.keys {
+		s := &c.keys[i]
+		s.Lock()
+		for k := range s.keys {
+			keys = append(keys, k)
 		}
-		if c.cacheSize > 0 {
-			conf.MaxSize = uint(c.cacheSize)
+		s.Unlock()
+	}
+
+	for _, k := range keys {
+		data := items.Get([]byte(k))
+		if data == nil {
+			c.delKey([]byte(k))
+			continue
 		}
-		c.items = glcache.New(conf)
+
+		if !f([]byte(k), data) {
+			return
+		}
+	}
+}
+
+// delName removes the cached responses for the specified name.  Since the
+// keys index may miss some items, it removes the entries for all known query
+// types with and without the DO bit.
+func (c *cache) delName(name string) {
+	items := c.getItems()
+	if items == nil {
+		return
 	}
-	c.Unlock()
 
-	data := packResponse(m)
-	_ = c.items.Set(key, data)
+	for qtype := range dns.TypeToString {
+		c.del(name, qtype)
+	}
+}
+
+// del removes the cached responses for the specified name and query type
+// with and without the DO bit
+func (c *cache) del(name string, qtype uint16) {
+	items := c.getItems()
+	if items == nil {
+		return
+	}
+
+	m := &dns.Msg{}
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	for _, do := range []bool{false, true} {
+		if do {
+			m.SetEdns0(dns.DefaultMsgSize, true)
+		}
+		k := key(m)
+		items.Del(k)
+		c.delKey(k)
+	}
 }
 
 // check if message is cacheable
@@ -208,6 +408,18 @@ func key(m *dns.Msg) []byte {
 	return b
 }
 
+// requestFromKey returns the request that has the specified key
+func requestFromKey(k []byte) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion(string(k[5:]), binary.BigEndian.Uint16(k[1:]))
+	m.Question[0].Qclass = binary.BigEndian.Uint16(k[3:])
+	if k[0] == 1 {
+		m.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	return m
+}
+
 /*
 expire [4]byte
 dns_message []byte
@@ -225,17 +437,30 @@ func packResponse(m *dns.Msg) []byte {
 
 // Return nil if response has expired
 func unpackResponse(data []byte, request *dns.Msg) *dns.Msg {
+	res, _ := unpackResponseWithTTL(data, request)
+	return res
+}
+
+// unpackResponseWithTTL is unpackResponse that also returns the TTL the
+// response has been cached with
+func unpackResponseWithTTL(data []byte, request *dns.Msg) (*dns.Msg, uint32) {
 	now := time.Now().Unix()
 	expire := binary.BigEndian.Uint32(data[:4])
 	if int64(expire) <= now {
-		return nil
+		return nil, 0
 	}
 	ttl := expire - uint32(now)
 
+	return unpackResponseAt(data, request, ttl)
+}
+
+// unpackResponseAt returns the cached response to the request with the TTL
+// of all its records set to ttl and the TTL it has been cached with
+func unpackResponseAt(data []byte, request *dns.Msg, ttl uint32) (*dns.Msg, uint32) {
 	m := dns.Msg{}
 	err := m.Unpack(data[4:])
 	if err != nil {
-		return nil
+		return nil, 0
 	}
 
 	// check if DO flag is set in the request
@@ -277,5 +502,5 @@ func unpackResponse(data []byte, request *dns.Msg) *dns.Msg {
 		extra.Header().Ttl = ttl
 		res.Extra = append(res.Extra, extra)
 	}
-	return &res
+	return &res, findLowestTTL(&m)
 }
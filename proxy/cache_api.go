@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"errors"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// CacheEntry is a response in the DNS cache
+type CacheEntry struct {
+	// Question is the question of the response
+	Question dns.Question
+	// DO is true if the response is for the requests with the DNSSEC OK bit
+	DO bool
+	// Response is the cached response.  Its TTLs are the time left until it
+	// expires.
+	Response *dns.Msg
+}
+
+// RangeCache calls f for each entry of the DNS cache until f returns false.
+// The entries of the subnet cache used with EDNS Client Subnet aren't ranged.
+func (p *Proxy) RangeCache(f func(e CacheEntry) bool) {
+	if p.cache == nil {
+		return
+	}
+
+	p.cache.rangeItems(func(k, data []byte) bool {
+		req := requestFromKey(k)
+		res := unpackResponse(data, req)
+		if res == nil {
+			// Expired
+			return true
+		}
+
+		return f(CacheEntry{
+			Question: req.Question[0],
+			DO:       k[0] == 1,
+			Response: res,
+		})
+	})
+}
+
+// DeleteCacheEntry removes the cached responses for the name and the query
+// type.  Use ClearCacheForName to remove the responses of all types.
+func (p *Proxy) DeleteCacheEntry(name string, qtype uint16) {
+	if p.cache != nil {
+		p.cache.del(name, qtype)
+	}
+}
+
+// SetCacheEntry puts the response into the DNS cache as if it was received
+// from an upstream, e.g. to override a poisoned record until it expires.  It
+// replaces the cached responses for the question with and without the DO
+// bit.  The response must have a single question and a non-zero TTL.
+func (p *Proxy) SetCacheEntry(resp *dns.Msg) error {
+	if p.cache == nil {
+		return errors.New("cache is disabled")
+	}
+
+	if !isCacheable(resp) {
+		return errors.New("the response isn't cacheable")
+	}
+
+	q := resp.Question[0]
+	p.cache.del(q.Name, q.Qtype)
+
+	resp = resp.Copy()
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+
+	for _, do := range []bool{false, true} {
+		if do {
+			resp.SetEdns0(dns.DefaultMsgSize, true)
+		}
+		p.cache.Set(resp)
+	}
+
+	return nil
+}
+
+// PrewarmCache resolves the A and AAAA records of the names with the
+// upstreams and caches the responses.  It returns an error if some of them
+// fail, the others are cached anyway.
+func (p *Proxy) PrewarmCache(names []string) error {
+	if p.cache == nil {
+		return errors.New("cache is disabled")
+	}
+
+	var reqs []*dns.Msg
+	for _, name := range names {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			req := &dns.Msg{}
+			req.SetQuestion(dns.Fqdn(name), qtype)
+			reqs = append(reqs, req)
+		}
+	}
+
+	release := p.acquireUpstreams()
+	errs := p.resolveIntoCache(reqs, p.getUpstreamConfig().getUpstreamsForDomain)
+	release()
+	if len(errs) != 0 {
+		return errorx.DecorateMany("couldn't pre-warm the cache", errs...)
+	}
+
+	return nil
+}
+
+// startCachePrewarm pre-warms the cache with Config.CachePrewarm in the
+// background
+func (p *Proxy) startCachePrewarm() {
+	if p.cache == nil || len(p.CachePrewarm) == 0 {
+		return
+	}
+
+	names := p.CachePrewarm
+	go func() {
+		err := p.PrewarmCache(names)
+		if err != nil {
+			log.Error("%s", err)
+		}
+		log.Info("Pre-warmed the cache with %d names", len(names))
+	}()
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheAPI(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	u := &switchableUpstream{}
+	u.ip.Store(net.IP{1, 2, 3, 4})
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	assert.Nil(t, dnsProxy.Init())
+
+	// Pre-warming
+	err := dnsProxy.PrewarmCache([]string{"a.example.org", "b.example.org."})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&u.reqs))
+
+	entries := map[dns.Question]CacheEntry{}
+	dnsProxy.RangeCache(func(e CacheEntry) bool {
+		entries[e.Question] = e
+		return true
+	})
+	assert.Len(t, entries, 4)
+	e, ok := entries[dns.Question{Name: "b.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}]
+	assert.True(t, ok)
+	assert.False(t, e.DO)
+	assert.Equal(t, "1.2.3.4", getIPFromResponse(e.Response).String())
+
+	n := 0
+	dnsProxy.RangeCache(func(e CacheEntry) bool {
+		n++
+		return false
+	})
+	assert.Equal(t, 1, n)
+
+	// Synthetic entries
+	resp := &dns.Msg{}
+	resp.SetQuestion("a.example.org.", dns.TypeA)
+	resp.Response = true
+	resp.Answer = []dns.RR{newRR("a.example.org. 300 IN A 9.9.9.9")}
+	resp.SetEdns0(4096, false)
+	assert.Nil(t, dnsProxy.SetCacheEntry(resp))
+
+	for _, do := range []bool{false, true} {
+		req := createHostTestMessage("a.example.org")
+		if do {
+			req.SetEdns0(4096, true)
+		}
+		d := &DNSContext{Req: req}
+		assert.True(t, dnsProxy.replyFromCache(d))
+		assert.Equal(t, "9.9.9.9", getIPFromResponse(d.Res).String())
+	}
+
+	resp.Answer = nil
+	assert.NotNil(t, dnsProxy.SetCacheEntry(resp))
+
+	// Deletion
+	dnsProxy.DeleteCacheEntry("A.example.org", dns.TypeA)
+	assert.False(t, dnsProxy.replyFromCache(&DNSContext{Req: createHostTestMessage("a.example.org")}))
+	assert.True(t, dnsProxy.replyFromCache(&DNSContext{Req: createHostTestMessage("b.example.org")}))
+
+	entries = map[dns.Question]CacheEntry{}
+	dnsProxy.RangeCache(func(e CacheEntry) bool {
+		entries[e.Question] = e
+		return true
+	})
+	assert.Len(t, entries, 3)
+	_, ok = entries[dns.Question{Name: "a.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}]
+	assert.False(t, ok)
+
+	dnsProxy.ClearCache()
+	n = 0
+	dnsProxy.RangeCache(func(e CacheEntry) bool {
+		n++
+		return true
+	})
+	assert.Equal(t, 0, n)
+
+	// The cache is disabled
+	dnsProxy = createTestProxy(t, nil)
+	assert.Nil(t, dnsProxy.Init())
+	assert.NotNil(t, dnsProxy.PrewarmCache([]string{"example.org"}))
+	assert.NotNil(t, dnsProxy.SetCacheEntry(resp))
+	dnsProxy.DeleteCacheEntry("example.org", dns.TypeA)
+	dnsProxy.RangeCache(func(e CacheEntry) bool {
+		t.Fatal("no entries are expected")
+		return false
+	})
+}
+
+func TestCacheKeysIndex(t *testing.T) {
+	c := &cache{cacheSize: 512}
+	for i := 0; i < 100; i++ {
+		host := fmt.Sprintf("%d.example.org", i)
+		resp := &dns.Msg{}
+		resp.SetQuestion(host+".", dns.TypeA)
+		resp.Answer = []dns.RR{newRR(host + ". 300 IN A 1.2.3.4")}
+		c.Set(resp)
+	}
+
+	// The evicted items are removed from the index
+	n := 0
+	c.rangeItems(func(k, data []byte) bool {
+		n++
+		return true
+	})
+	assert.Equal(t, c.keysLen(), n)
+	assert.True(t, n < 100)
+	assert.Equal(t, c.items.Stats().Count, n)
+}
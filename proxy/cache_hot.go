@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+const (
+	// hotTrackFactor is the number of the tracked requests per a kept one,
+	// so that the requests that have just become popular can overtake the
+	// old ones
+	hotTrackFactor = 8
+	// cacheResolveWorkers is the number of the requests resolved into the
+	// cache concurrently
+	cacheResolveWorkers = 4
+)
+
+// hotEntry is a tracked request and the number of times it's been asked
+type hotEntry struct {
+	req  *dns.Msg
+	hits uint64
+}
+
+// hotEntries tracks the most requested cache entries, so that they're kept
+// when the cache is cleared
+type hotEntries struct {
+	max        int                  // number of the kept entries
+	entries    map[string]*hotEntry // cache key -> entry
+	refreshing int32                // 1 if the entries are being re-resolved
+	lock       sync.Mutex
+}
+
+// newHotEntries returns a new tracker of the max most requested entries
+func newHotEntries(max int) *hotEntries {
+	return &hotEntries{
+		max:     max,
+		entries: map[string]*hotEntry{},
+	}
+}
+
+// hit counts the request.  h may be nil, nothing is counted then.
+func (h *hotEntries) hit(req *dns.Msg) {
+	if h == nil || len(req.Question) != 1 {
+		return
+	}
+
+	k := string(key(req))
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if e, ok := h.entries[k]; ok {
+		e.hits++
+		return
+	}
+
+	if len(h.entries) >= h.max*hotTrackFactor {
+		h.decay()
+		if len(h.entries) >= h.max*hotTrackFactor {
+			return
+		}
+	}
+
+	h.entries[k] = &hotEntry{req: cacheKeyRequest(req), hits: 1}
+}
+
+// cacheKeyRequest returns the request made of only the parts of req the cache
+// key is made of
+func cacheKeyRequest(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	m := &dns.Msg{}
+	m.SetQuestion(q.Name, q.Qtype)
+	m.Question[0].Qclass = q.Qclass
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		m.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	return m
+}
+
+// decay halves the hits of the entries and removes the ones that are no
+// longer asked.  h.lock is expected to be locked.
+func (h *hotEntries) decay() {
+	for k, e := range h.entries {
+		e.hits /= 2
+		if e.hits == 0 {
+			delete(h.entries, k)
+		}
+	}
+}
+
+// top returns the most requested requests
+func (h *hotEntries) top() []*dns.Msg {
+	h.lock.Lock()
+	entries := make([]*hotEntry, 0, len(h.entries))
+	for _, e := range h.entries {
+		entries = append(entries, e)
+	}
+	h.lock.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].hits > entries[j].hits
+	})
+	if len(entries) > h.max {
+		entries = entries[:h.max]
+	}
+
+	reqs := make([]*dns.Msg, len(entries))
+	for i, e := range entries {
+		reqs[i] = e.req
+	}
+
+	return reqs
+}
+
+// clearCacheKeepHot clears the cache except for the hottest entries and
+// re-resolves them in the background
+func (p *Proxy) clearCacheKeepHot() {
+	reqs := p.cacheHot.top()
+
+	var kept []*dns.Msg
+	for _, req := range reqs {
+		res, ok := p.cache.Get(req)
+		if ok {
+			kept = append(kept, res)
+		}
+	}
+
+	p.cache.clearItems()
+	for _, res := range kept {
+		p.cache.Set(res)
+	}
+
+	log.Debug("Kept %d hot entries on the cache clear", len(kept))
+	p.refreshHot(reqs)
+}
+
+// refreshHot re-resolves the hot requests in the background and puts the
+// responses into the cache.  Nothing is done if the previous refresh isn't
+// finished yet.
+func (p *Proxy) refreshHot(reqs []*dns.Msg) {
+	if len(reqs) == 0 || !atomic.CompareAndSwapInt32(&p.cacheHot.refreshing, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer p.acquireUpstreams()()
+
+		errs := p.resolveIntoCache(reqs, p.getUpstreamConfig().getUpstreamsForDomain)
+		atomic.StoreInt32(&p.cacheHot.refreshing, 0)
+		log.Debug("Re-resolved %d hot entries, %d failed", len(reqs), len(errs))
+	}()
+}
+
+// resolveIntoCache resolves the requests with the upstreams returned by
+// upstreamsFor bypassing the cache and caches the responses if the cache is
+// enabled.  It returns the errors of the failed requests.
+func (p *Proxy) resolveIntoCache(reqs []*dns.Msg, upstreamsFor func(name string) []upstream.Upstream) []error {
+	ch := make(chan *dns.Msg)
+	errCh := make(chan error, len(reqs))
+	wg := &sync.WaitGroup{}
+	for i := 0; i < cacheResolveWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range ch {
+				err := p.resolveRequestIntoCache(req, upstreamsFor(req.Question[0].Name))
+				if err != nil {
+					errCh <- err
+				}
+			}
+		}()
+	}
+
+	for _, req := range reqs {
+		ch <- req
+	}
+	close(ch)
+	wg.Wait()
+	close(errCh)
+
+	var errs []error
+	for err := range errCh {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// resolveRequestIntoCache resolves the request with the upstreams bypassing
+// the cache and caches the response if the cache is enabled
+func (p *Proxy) resolveRequestIntoCache(req *dns.Msg, upstreams []upstream.Upstream) error {
+	req = req.Copy()
+	req.Id = p.newMsgID()
+
+	name := req.Question[0].Name
+	reply, u, err := p.exchangeUpstreams(req, upstreams, nil)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't resolve %s", name)
+	} else if reply == nil {
+		return fmt.Errorf("couldn't resolve %s: no reply", name)
+	}
+
+	if p.Deterministic {
+		sortRRsets(reply)
+	}
+	p.setMinMaxTTL(reply)
+	if p.cache == nil {
+		return nil
+	}
+
+	reply, ok := p.applyCachePolicy(&DNSContext{Req: req, Upstream: u}, reply)
+	if ok {
+		p.cache.Set(reply)
+	}
+
+	return nil
+}
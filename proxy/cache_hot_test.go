@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// switchableUpstream answers the A requests with the address that can be
+// changed and counts the requests
+type switchableUpstream struct {
+	ip   atomic.Value // net.IP
+	reqs int32
+}
+
+func (u *switchableUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.reqs, 1)
+
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100},
+		A:   u.ip.Load().(net.IP),
+	}}
+	return resp, nil
+}
+
+func (u *switchableUpstream) Address() string {
+	return "switchable"
+}
+
+func TestHotEntries(t *testing.T) {
+	h := newHotEntries(2)
+	for i := 0; i < 3; i++ {
+		h.hit(createHostTestMessage("a.example.org"))
+	}
+	for i := 0; i < 2; i++ {
+		h.hit(createHostTestMessage("b.example.org"))
+	}
+	req := createHostTestMessage("b.example.org")
+	req.SetEdns0(4096, true)
+	h.hit(req)
+
+	top := h.top()
+	assert.Len(t, top, 2)
+	assert.Equal(t, "a.example.org.", top[0].Question[0].Name)
+	assert.Equal(t, "b.example.org.", top[1].Question[0].Name)
+	assert.Nil(t, top[1].IsEdns0())
+
+	// The requests asked once are removed when the tracker is full
+	for i := len(h.entries); i < 2*hotTrackFactor; i++ {
+		h.hit(createHostTestMessage(fmt.Sprintf("%d.example.org", i)))
+	}
+	assert.Len(t, h.entries, 2*hotTrackFactor)
+	h.hit(createHostTestMessage("new.example.org"))
+	assert.Len(t, h.entries, 3)
+	assert.Equal(t, uint64(1), h.entries[string(key(createHostTestMessage("a.example.org")))].hits)
+
+	var nilEntries *hotEntries
+	nilEntries.hit(req)
+}
+
+func TestCacheKeepHot(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheKeepHot = 1
+	u := &switchableUpstream{}
+	u.ip.Store(net.IP{1, 2, 3, 4})
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	assert.Nil(t, dnsProxy.Init())
+
+	resolve := func(host string) *DNSContext {
+		d := &DNSContext{Req: createHostTestMessage(host), Addr: &net.UDPAddr{IP: net.IP{192, 168, 1, 1}}}
+		assert.Nil(t, dnsProxy.Resolve(d))
+		return d
+	}
+	for i := 0; i < 3; i++ {
+		resolve("hot.example.org")
+	}
+	resolve("cold.example.org")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.reqs))
+
+	// The hot entry is kept and re-resolved in the background, the cold
+	// one is removed
+	u.ip.Store(net.IP{5, 6, 7, 8})
+	dnsProxy.ClearCache()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&dnsProxy.cacheHot.refreshing) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&u.reqs))
+
+	d := resolve("hot.example.org")
+	assert.Equal(t, ResponseClassCached, d.ResponseClass)
+	assert.Equal(t, "5.6.7.8", getIPFromResponse(d.Res).String())
+	d = resolve("cold.example.org")
+	assert.Equal(t, ResponseClassUpstream, d.ResponseClass)
+
+	// The hot entry is re-resolved with the new upstreams
+	newU := &switchableUpstream{}
+	newU.ip.Store(net.IP{9, 9, 9, 9})
+	dnsProxy.SetUpstreamConfig(&UpstreamConfig{Upstreams: []upstream.Upstream{newU}})
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&newU.reqs) == 1 && atomic.LoadInt32(&dnsProxy.cacheHot.refreshing) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	d = resolve("hot.example.org")
+	assert.Equal(t, ResponseClassCached, d.ResponseClass)
+	assert.Equal(t, "9.9.9.9", getIPFromResponse(d.Res).String())
+}
+
+func TestCacheKeepHotConcurrent(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheKeepHot = 10
+	u := &switchableUpstream{}
+	u.ip.Store(net.IP{1, 2, 3, 4})
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	assert.Nil(t, dnsProxy.Init())
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				d := &DNSContext{Req: createTestMessage(), Addr: &net.UDPAddr{IP: net.IP{192, 168, 1, 1}}}
+				_ = dnsProxy.Resolve(d)
+				if j%5 == 0 {
+					dnsProxy.ClearCache()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+const (
+	// prefetchPercent is the part of its TTL, in percent, left before a
+	// cache entry expires when it's prefetched
+	prefetchPercent = 10
+	// prefetchCleanupInterval is the interval between the removals of the
+	// expired tracked entries
+	prefetchCleanupInterval = time.Minute
+)
+
+// prefetchEntry is a tracked cache entry
+type prefetchEntry struct {
+	hits       int
+	inProgress bool // true if the entry is being prefetched
+	lock       sync.Mutex
+}
+
+// prefetcher tracks the hits of the cache entries and tells when the popular
+// ones should be re-resolved before they expire
+type prefetcher struct {
+	// entries are the tracked entries by the cache keys.  Every one of
+	// them expires along with its cached response, so that only the hits
+	// of the current response are counted.
+	entries   *gocache.Cache
+	threshold int           // min number of the hits of a prefetched entry
+	workers   chan struct{} // limits the number of the concurrent prefetches
+}
+
+// newPrefetcher returns a new prefetcher of the entries with at least
+// threshold hits
+func newPrefetcher(threshold int) *prefetcher {
+	return &prefetcher{
+		entries:   gocache.New(gocache.NoExpiration, prefetchCleanupInterval),
+		threshold: threshold,
+		workers:   make(chan struct{}, cacheResolveWorkers),
+	}
+}
+
+// entry returns the tracked entry for the cache key, it's added with the
+// expiration in left seconds if there is none
+func (pf *prefetcher) entry(k string, left uint32) *prefetchEntry {
+	if v, ok := pf.entries.Get(k); ok {
+		return v.(*prefetchEntry)
+	}
+
+	e := &prefetchEntry{}
+	if err := pf.entries.Add(k, e, time.Duration(left)*time.Second); err != nil {
+		// Added concurrently
+		if v, ok := pf.entries.Get(k); ok {
+			return v.(*prefetchEntry)
+		}
+	}
+
+	return e
+}
+
+// hit counts the hit of the cache entry for the request.  left is the time
+// the cached response has left, ttl is the one it's been cached with.  It
+// returns true if the entry must be prefetched now, and then done must be
+// called once it's prefetched.  pf may be nil, nothing is counted then.
+func (pf *prefetcher) hit(req *dns.Msg, left, ttl uint32) bool {
+	if pf == nil || len(req.Question) != 1 {
+		return false
+	}
+
+	e := pf.entry(string(key(req)), left)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.hits++
+	if e.hits < pf.threshold || e.inProgress || uint64(left)*100 > uint64(ttl)*prefetchPercent {
+		return false
+	}
+
+	e.inProgress = true
+	return true
+}
+
+// done stops tracking the prefetched entry for the request, so that the hits
+// of the new response are counted from scratch
+func (pf *prefetcher) done(req *dns.Msg) {
+	pf.entries.Delete(string(key(req)))
+}
+
+// prefetch re-resolves the request into the cache in the background unless
+// too many requests are being prefetched already
+func (p *Proxy) prefetch(req *dns.Msg) {
+	req = cacheKeyRequest(req)
+
+	select {
+	case p.prefetcher.workers <- struct{}{}:
+	default:
+		log.Debug("Too many prefetches, skipping %s", req.Question[0].Name)
+		p.prefetcher.done(req)
+		return
+	}
+
+	go func() {
+		defer func() { <-p.prefetcher.workers }()
+		defer p.prefetcher.done(req)
+
+		name := req.Question[0].Name
+		err := p.resolveRequestIntoCache(req, p.getUpstreamConfig().getUpstreamsForDomain(name))
+		if err != nil {
+			log.Debug("Prefetching: %s", err)
+			return
+		}
+
+		log.Debug("Prefetched %s %s", dns.Type(req.Question[0].Qtype), name)
+	}()
+}
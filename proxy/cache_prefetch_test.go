@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetcherHit(t *testing.T) {
+	pf := newPrefetcher(3)
+	req := createHostTestMessage("host.example.org")
+
+	// Not popular enough
+	assert.False(t, pf.hit(req, 5, 100))
+	assert.False(t, pf.hit(req, 5, 100))
+
+	// Too early
+	assert.False(t, pf.hit(req, 50, 100))
+
+	assert.True(t, pf.hit(req, 10, 100))
+	// Already in progress
+	assert.False(t, pf.hit(req, 9, 100))
+
+	// The hits are counted anew after the prefetch
+	pf.done(req)
+	assert.False(t, pf.hit(req, 5, 100))
+
+	var nilPf *prefetcher
+	assert.False(t, nilPf.hit(req, 5, 100))
+}
+
+func TestCachePrefetch(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CachePrefetch = 2
+	u := &switchableUpstream{}
+	u.ip.Store(net.IP{1, 2, 3, 4})
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	// Cache the response that's about to expire
+	req := createHostTestMessage("host.example.org")
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Answer = []dns.RR{newRR("host.example.org. 100 IN A 5.6.7.8")}
+	dnsProxy.cache.Set(res)
+	data := dnsProxy.cache.items.Get(key(req))
+	binary.BigEndian.PutUint32(data, uint32(time.Now().Unix())+5)
+	_ = dnsProxy.cache.items.Set(key(req), data)
+
+	for i := 0; i < 2; i++ {
+		d := &DNSContext{Req: createHostTestMessage("host.example.org")}
+		assert.True(t, dnsProxy.replyFromCache(d))
+		assert.True(t, d.Res.Answer[0].(*dns.A).A.Equal(net.IP{5, 6, 7, 8}))
+	}
+
+	// The second hit has made it re-resolved
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&u.reqs) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		d := &DNSContext{Req: createHostTestMessage("host.example.org")}
+		return dnsProxy.replyFromCache(d) && d.Res.Answer[0].(*dns.A).A.Equal(net.IP{1, 2, 3, 4})
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"sync"
+
+	glcache "github.com/AdguardTeam/golibs/cache"
+)
+
+const (
+	// defaultCacheShards is the number of the cache shards if
+	// Config.CacheShards isn't set
+	defaultCacheShards = 16
+
+	// minCacheShardSize is the min size of a cache shard in bytes, so that
+	// the large responses still fit in one
+	minCacheShardSize = defaultCacheSize
+)
+
+// cacheShardsNum returns the number of the shards of the cache of the size:
+// n, or defaultCacheShards if n isn't positive, reduced so that every shard
+// is at least minCacheShardSize
+func cacheShardsNum(size uint, n int) int {
+	if n <= 0 {
+		n = defaultCacheShards
+	}
+	for n > 1 && size/uint(n) < minCacheShardSize {
+		n--
+	}
+
+	return n
+}
+
+// shardIndex returns the index of the key's shard, the FNV-1a hash of the
+// key modulo n
+func shardIndex(key []byte, n int) int {
+	if n == 1 {
+		return 0
+	}
+
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+
+	return int(h % uint32(n))
+}
+
+// shardedCache is a glcache.Cache that spreads the items over the
+// independent LRU caches by the hash of the key, so that the concurrent
+// requests for the different names don't contend for the single lock of the
+// storage.  Each shard evicts its least recently used items on its own.
+type shardedCache struct {
+	shards []glcache.Cache
+}
+
+// newShardedCache returns the storage with n shards, each of which gets an
+// equal part of conf.MaxSize
+func newShardedCache(conf glcache.Config, n int) glcache.Cache {
+	if n <= 1 {
+		return glcache.New(conf)
+	}
+
+	conf.MaxSize /= uint(n)
+	s := &shardedCache{shards: make([]glcache.Cache, n)}
+	for i := range s.shards {
+		s.shards[i] = glcache.New(conf)
+	}
+
+	return s
+}
+
+// shard returns the shard of the key
+func (s *shardedCache) shard(key []byte) glcache.Cache {
+	return s.shards[shardIndex(key, len(s.shards))]
+}
+
+// Set implements the glcache.Cache interface for *shardedCache
+func (s *shardedCache) Set(key, val []byte) bool {
+	return s.shard(key).Set(key, val)
+}
+
+// Get implements the glcache.Cache interface for *shardedCache
+func (s *shardedCache) Get(key []byte) []byte {
+	return s.shard(key).Get(key)
+}
+
+// Del implements the glcache.Cache interface for *shardedCache
+func (s *shardedCache) Del(key []byte) {
+	s.shard(key).Del(key)
+}
+
+// Clear implements the glcache.Cache interface for *shardedCache
+func (s *shardedCache) Clear() {
+	for _, c := range s.shards {
+		c.Clear()
+	}
+}
+
+// Stats implements the glcache.Cache interface for *shardedCache.  The
+// counters are the sums of the shards' ones.
+func (s *shardedCache) Stats() (st glcache.Stats) {
+	for _, c := range s.shards {
+		cs := c.Stats()
+		st.Count += cs.Count
+		st.Size += cs.Size
+		st.Hit += cs.Hit
+		st.Miss += cs.Miss
+	}
+
+	return st
+}
+
+// keysShard is a shard of the cache keys index, it has the keys of the same
+// storage shard
+type keysShard struct {
+	keys map[string]struct{}
+	sync.Mutex
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	glcache "github.com/AdguardTeam/golibs/cache"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheShardsNum(t *testing.T) {
+	assert.Equal(t, 1, cacheShardsNum(defaultCacheSize, 0))
+	assert.Equal(t, 1, cacheShardsNum(512, 8))
+	assert.Equal(t, 4, cacheShardsNum(4*minCacheShardSize, 0))
+	assert.Equal(t, defaultCacheShards, cacheShardsNum(64*1024*1024, 0))
+	assert.Equal(t, 3, cacheShardsNum(64*1024*1024, 3))
+}
+
+func TestShardedCache(t *testing.T) {
+	c := newShardedCache(glcache.Config{MaxSize: 4 * 1024, EnableLRU: true}, 4)
+	s, ok := c.(*shardedCache)
+	if !assert.True(t, ok) {
+		t.FailNow()
+	}
+
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("key%d", i))
+		assert.False(t, c.Set(k, []byte("value")))
+		assert.Equal(t, []byte("value"), c.Get(k))
+	}
+
+	// The items are spread over all the shards
+	for _, shard := range s.shards {
+		assert.True(t, shard.Stats().Count > 0)
+	}
+	st := c.Stats()
+	assert.Equal(t, 100, st.Count)
+	assert.Equal(t, 100, st.Hit)
+
+	c.Del([]byte("key1"))
+	assert.Nil(t, c.Get([]byte("key1")))
+	assert.Equal(t, 99, c.Stats().Count)
+
+	c.Clear()
+	assert.Equal(t, 0, c.Stats().Count)
+	assert.Nil(t, c.Get([]byte("key2")))
+
+	// A single shard is the plain storage
+	_, ok = newShardedCache(glcache.Config{MaxSize: 4 * 1024}, 1).(*shardedCache)
+	assert.False(t, ok)
+}
+
+func TestCacheShardsConcurrent(t *testing.T) {
+	c := &cache{cacheSize: 16 * minCacheShardSize}
+
+	wg := &sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < 100; i++ {
+				host := fmt.Sprintf("%d-%d.example.org", g, i)
+				resp := &dns.Msg{}
+				resp.SetQuestion(host+".", dns.TypeA)
+				resp.Answer = []dns.RR{newRR(host + ". 300 IN A 1.2.3.4")}
+				c.Set(resp)
+
+				_, ok := c.Get(resp)
+				assert.True(t, ok)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	assert.Len(t, c.keys, defaultCacheShards)
+	assert.Equal(t, 800, c.keysLen())
+	assert.Equal(t, 800, c.items.Stats().Count)
+
+	c.clearItems()
+	assert.Equal(t, 0, c.keysLen())
+	assert.Equal(t, 0, c.items.Stats().Count)
+}
@@ -5,7 +5,6 @@ import (
 	"net"
 	"strings"
 
-	glcache "github.com/AdguardTeam/golibs/cache"
 	"github.com/miekg/dns"
 )
 
@@ -75,17 +74,15 @@ func (c *cacheSubnet) GetWithSubnet(request *dns.Msg, ip net.IP, mask uint8) (*d
 		return nil, false
 	}
 	// create key for request
-	c.Lock()
-	if c.items == nil {
-		c.Unlock()
+	items := (*cache)(c).getItems()
+	if items == nil {
 		return nil, false
 	}
-	c.Unlock()
 
 	var key, data []byte
 	for {
 		key = keyWithSubnet(request, ip, mask)
-		data = c.items.Get(key)
+		data = items.Get(key)
 		if data != nil {
 			break
 		}
@@ -97,7 +94,7 @@ func (c *cacheSubnet) GetWithSubnet(request *dns.Msg, ip net.IP, mask uint8) (*d
 
 	res := unpackResponse(data, request)
 	if res == nil {
-		c.items.Del(key)
+		items.Del(key)
 		return nil, false
 	}
 	return res, true
@@ -111,21 +108,8 @@ func (c *cacheSubnet) SetWithSubnet(m *dns.Msg, ip net.IP, mask uint8) {
 		return
 	}
 	key := keyWithSubnet(m, ip, mask)
-
-	c.Lock()
-	// lazy initialization for cache
-	if c.items == nil {
-		conf := glcache.Config{
-			MaxSize:   defaultCacheSize,
-			EnableLRU: true,
-		}
-		if c.cacheSize > 0 {
-			conf.MaxSize = uint(c.cacheSize)
-		}
-		c.items = glcache.New(conf)
-	}
-	c.Unlock()
+	items := (*cache)(c).initItems()
 
 	data := packResponse(m)
-	_ = c.items.Set(key, data)
+	_ = items.Set(key, data)
 }
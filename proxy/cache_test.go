@@ -539,3 +539,59 @@ func TestSubnet(t *testing.T) {
 	a = resp.Answer[0].(*dns.A)
 	assert.True(t, a.A.String() == "3.3.3.3")
 }
+
+func TestCachePolicy(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CachePolicy = func(d *DNSContext, res *dns.Msg) (bool, uint32) {
+		for _, code := range EDECodes(res) {
+			if code == edeStaleAnswer {
+				return false, 0
+			}
+		}
+
+		if d.Upstream.Address() == "switchable" {
+			return false, 0
+		}
+
+		return true, 5
+	}
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	// The responses of the untrusted upstream aren't cached
+	untrusted := &switchableUpstream{}
+	untrusted.ip.Store(net.IP{1, 2, 3, 4})
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{untrusted}
+	d := &DNSContext{Req: createHostTestMessage("untrusted.example.org"), Addr: &net.TCPAddr{}}
+	assert.Nil(t, dnsProxy.Resolve(d))
+	assert.Equal(t, uint32(100), d.Res.Answer[0].Header().Ttl)
+	_, ok := dnsProxy.cache.Get(d.Req)
+	assert.False(t, ok)
+
+	// The others are cached with the TTL of the policy, the client gets
+	// the original one
+	trusted := &testUpstream{aResp: &dns.A{
+		Hdr: dns.RR_Header{Name: "trusted.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100},
+		A:   net.IP{4, 3, 2, 1},
+	}}
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{trusted}
+	d = &DNSContext{Req: createHostTestMessage("trusted.example.org"), Addr: &net.TCPAddr{}}
+	assert.Nil(t, dnsProxy.Resolve(d))
+	assert.Equal(t, uint32(100), d.Res.Answer[0].Header().Ttl)
+	r, ok := dnsProxy.cache.Get(d.Req)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(5), r.Answer[0].Header().Ttl)
+
+	// The responses with the Extended DNS Error aren't cached
+	req := createHostTestMessage("stale.example.org")
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Answer = []dns.RR{newRR("stale.example.org. 100 IN A 1.2.3.4")}
+	setEDE(res, req, edeStaleAnswer, "")
+	_, ok = dnsProxy.applyCachePolicy(&DNSContext{Req: req, Upstream: trusted}, res)
+	assert.False(t, ok)
+}
@@ -0,0 +1,419 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// The DNS messages are written to the pcap file wrapped into synthetic IP
+// and UDP headers so that the usual tools decode them as DNS
+const (
+	pcapMagic        = 0xa1b2c3d4 // microsecond timestamps
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+	pcapSnapLen      = 65535
+	pcapLinkTypeRaw  = 101 // LINKTYPE_RAW, the packets start with an IP header
+
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+	udpHeaderSize  = 8
+
+	// captureDNSPort is the port of the DNS server side of every captured
+	// packet regardless of the actual protocol
+	captureDNSPort = 53
+	// captureProxyPort is the port of the proxy side of the captured
+	// upstream exchanges
+	captureProxyPort = 10053
+)
+
+// CaptureConfig is the configuration of a packet capture session
+type CaptureConfig struct {
+	// Name is the name of the pcap file in Config.CaptureDir, it's
+	// overwritten if exists
+	Name string
+
+	// QName, if set, limits the capture to the requests for this name
+	QName string
+	// Client, if set, limits the capture to the requests from this IP
+	Client net.IP
+
+	// Duration is the maximum duration of the session.  0 means no limit.
+	Duration time.Duration
+	// MaxPackets is the maximum number of the captured packets.  0 means no
+	// limit.  Either Duration or MaxPackets must be set.
+	MaxPackets int
+}
+
+// capture is an active packet capture session
+type capture struct {
+	conf CaptureConfig
+
+	f       *os.File
+	w       *bufio.Writer
+	packets int
+	timer   *time.Timer
+	lock    sync.Mutex // protects the file and the counter
+	closed  bool
+}
+
+// StartCapture starts a diagnostic session capturing the DNS messages
+// exchanged with the clients and the upstreams into a pcap file in
+// Config.CaptureDir.  Only the upstream that answered the request is
+// captured.  The session stops when either of its limits is reached or when
+// StopCapture is called.
+func (p *Proxy) StartCapture(conf CaptureConfig) error {
+	path, err := captureFilePath(p.CaptureDir, conf.Name)
+	if err != nil {
+		return err
+	}
+	if conf.Duration <= 0 && conf.MaxPackets <= 0 {
+		return errors.New("either capture duration or packets limit must be specified")
+	}
+	if conf.QName != "" {
+		conf.QName = dns.Fqdn(strings.ToLower(conf.QName))
+	}
+
+	p.captureLock.Lock()
+	defer p.captureLock.Unlock()
+
+	if p.capture != nil {
+		return errors.New("capture is already running")
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return errorx.Decorate(err, "cannot create capture file")
+	}
+
+	c := &capture{conf: conf, f: f, w: bufio.NewWriter(f)}
+	err = c.writeHeader()
+	if err != nil {
+		_ = f.Close()
+		return errorx.Decorate(err, "cannot write capture file header")
+	}
+
+	if conf.Duration > 0 {
+		c.timer = time.AfterFunc(conf.Duration, func() {
+			p.stopCapture(c)
+		})
+	}
+
+	log.Info("Started capturing DNS messages into %s", path)
+	p.capture = c
+
+	return nil
+}
+
+// captureFilePath returns the path of the capture file name in dir.  The
+// names with the path separators and ".." are rejected, so that the file
+// can't be written outside of dir.
+func captureFilePath(dir, name string) (string, error) {
+	if dir == "" {
+		return "", errors.New("capture directory is not configured")
+	}
+	if name == "" || name == "." || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return "", fmt.Errorf("invalid capture file name %q", name)
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+// StopCapture stops the running capture session if any
+func (p *Proxy) StopCapture() error {
+	p.captureLock.Lock()
+	c := p.capture
+	p.captureLock.Unlock()
+
+	if c == nil {
+		return nil
+	}
+
+	return p.stopCapture(c)
+}
+
+// stopCapture stops the capture session c if it's still running
+func (p *Proxy) stopCapture(c *capture) error {
+	p.captureLock.Lock()
+	if p.capture == c {
+		p.capture = nil
+	}
+	p.captureLock.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+
+	return c.close()
+}
+
+// activeCapture returns the running capture session or nil
+func (p *Proxy) activeCapture() *capture {
+	p.captureLock.Lock()
+	defer p.captureLock.Unlock()
+
+	return p.capture
+}
+
+// captureClientMessage captures the request from the client or the response
+// to it
+func (p *Proxy) captureClientMessage(d *DNSContext, m *dns.Msg, t time.Time) {
+	c := p.activeCapture()
+	if c == nil || !c.matches(d) {
+		return
+	}
+
+	clientIP, clientPort := addrIPPort(d.Addr)
+	var localIP net.IP
+	if d.localIP != nil {
+		localIP = d.localIP
+	} else if d.Conn != nil {
+		localIP, _ = addrIPPort(d.Conn.LocalAddr())
+	}
+
+	if m.Response {
+		p.capturePacket(c, m, t, localIP, captureDNSPort, clientIP, clientPort)
+	} else {
+		p.capturePacket(c, m, t, clientIP, clientPort, localIP, captureDNSPort)
+	}
+}
+
+// captureUpstreamExchange captures the request sent to the upstream that has
+// answered and its response
+func (p *Proxy) captureUpstreamExchange(d *DNSContext, addr string, start time.Time, reply *dns.Msg) {
+	c := p.activeCapture()
+	if c == nil || !c.matches(d) {
+		return
+	}
+
+	upstreamIP := upstreamAddrIP(addr)
+	p.capturePacket(c, d.Req, start, nil, captureProxyPort, upstreamIP, captureDNSPort)
+	if reply != nil {
+		p.capturePacket(c, reply, time.Now(), upstreamIP, captureDNSPort, nil, captureProxyPort)
+	}
+}
+
+// capturePacket writes the message to the capture file and stops the session
+// if the packets limit is reached
+func (p *Proxy) capturePacket(c *capture, m *dns.Msg, t time.Time, srcIP net.IP, srcPort int, dstIP net.IP, dstPort int) {
+	b, err := m.Pack()
+	if err != nil {
+		log.Debug("capture: cannot pack message: %s", err)
+		return
+	}
+
+	done, err := c.writePacket(t, ipUDPPacket(srcIP, srcPort, dstIP, dstPort, b))
+	if err != nil {
+		log.Error("capture: cannot write packet: %s", err)
+		done = true
+	}
+
+	if done {
+		err = p.stopCapture(c)
+		if err != nil {
+			log.Error("capture: %s", err)
+		}
+	}
+}
+
+// matches returns true if the request must be captured
+func (c *capture) matches(d *DNSContext) bool {
+	if c.conf.Client != nil {
+		ip, _ := addrIPPort(d.Addr)
+		if !c.conf.Client.Equal(ip) {
+			return false
+		}
+	}
+
+	if c.conf.QName != "" {
+		if len(d.Req.Question) == 0 || strings.ToLower(d.Req.Question[0].Name) != c.conf.QName {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeHeader writes the pcap file header
+func (c *capture) writeHeader() error {
+	h := make([]byte, 24)
+	binary.LittleEndian.PutUint32(h[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(h[4:], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(h[6:], pcapVersionMinor)
+	binary.LittleEndian.PutUint32(h[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(h[20:], pcapLinkTypeRaw)
+
+	_, err := c.w.Write(h)
+	return err
+}
+
+// writePacket writes a pcap record.  Returns true if the packets limit is
+// reached.
+func (c *capture) writePacket(t time.Time, packet []byte) (bool, error) {
+	if len(packet) > pcapSnapLen {
+		// Such a message doesn't fit into an IP packet anyway
+		return false, nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return false, nil
+	}
+
+	h := make([]byte, 16)
+	binary.LittleEndian.PutUint32(h[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(h[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(h[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(h[12:], uint32(len(packet)))
+
+	_, err := c.w.Write(h)
+	if err == nil {
+		_, err = c.w.Write(packet)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	c.packets++
+	return c.conf.MaxPackets > 0 && c.packets >= c.conf.MaxPackets, nil
+}
+
+// close flushes and closes the capture file
+func (c *capture) close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	log.Info("Stopped capturing DNS messages into %s, %d packets captured", c.f.Name(), c.packets)
+
+	err := c.w.Flush()
+	if err != nil {
+		_ = c.f.Close()
+		return errorx.Decorate(err, "cannot write capture file")
+	}
+
+	return c.f.Close()
+}
+
+// ipUDPPacket wraps the payload into IP and UDP headers.  The address family
+// is chosen by the first non-nil IP, the IPs of the other family are replaced
+// with the unspecified ones.  The UDP checksum is left empty.
+func ipUDPPacket(srcIP net.IP, srcPort int, dstIP net.IP, dstPort int, payload []byte) []byte {
+	v4 := true
+	if srcIP != nil {
+		v4 = srcIP.To4() != nil
+	} else if dstIP != nil {
+		v4 = dstIP.To4() != nil
+	}
+
+	ipHeaderSize := ipv6HeaderSize
+	if v4 {
+		ipHeaderSize = ipv4HeaderSize
+	}
+
+	b := make([]byte, ipHeaderSize+udpHeaderSize+len(payload))
+	if v4 {
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		b[0] = 0x45 // version 4, 5 words header
+		b[8] = 64   // TTL
+		b[9] = 17   // UDP
+		copy(b[12:16], captureIP(srcIP, true))
+		copy(b[16:20], captureIP(dstIP, true))
+		binary.BigEndian.PutUint16(b[10:], ipv4Checksum(b[:ipv4HeaderSize]))
+	} else {
+		b[0] = 0x60 // version 6
+		binary.BigEndian.PutUint16(b[4:], uint16(udpHeaderSize+len(payload)))
+		b[6] = 17 // UDP
+		b[7] = 64 // hop limit
+		copy(b[8:24], captureIP(srcIP, false))
+		copy(b[24:40], captureIP(dstIP, false))
+	}
+
+	udp := b[ipHeaderSize:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpHeaderSize+len(payload)))
+	copy(udp[udpHeaderSize:], payload)
+
+	return b
+}
+
+// captureIP returns the IP in the 4- or 16-byte form or the unspecified IP
+// if it's of the other family
+func captureIP(ip net.IP, v4 bool) net.IP {
+	if v4 {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+		return net.IPv4zero.To4()
+	}
+
+	if ip != nil && ip.To4() == nil {
+		return ip.To16()
+	}
+	return net.IPv6unspecified
+}
+
+// ipv4Checksum calculates the IPv4 header checksum
+func ipv4Checksum(h []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(h); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(h[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+
+	return ^uint16(sum)
+}
+
+// addrIPPort extracts the IP address and the port from net.Addr
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP, addr.Port
+	case *net.TCPAddr:
+		return addr.IP, addr.Port
+	}
+
+	return nil, 0
+}
+
+// upstreamAddrIP returns the IP address of the upstream address if it's
+// specified as an IP and nil otherwise
+func upstreamAddrIP(addr string) net.IP {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		addr = addr[i+3:]
+	}
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		addr = addr[:i]
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// String implements the fmt.Stringer interface for CaptureConfig
+func (conf CaptureConfig) String() string {
+	return fmt.Sprintf("name=%s qname=%q client=%v duration=%s packets=%d",
+		conf.Name, conf.QName, conf.Client, conf.Duration, conf.MaxPackets)
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// readTestCapture returns the DNS messages from the pcap file
+func readTestCapture(t *testing.T, path string) []*dns.Msg {
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	if !assert.True(t, len(b) >= 24) {
+		return nil
+	}
+	assert.Equal(t, uint32(pcapMagic), binary.LittleEndian.Uint32(b))
+	assert.Equal(t, uint32(pcapLinkTypeRaw), binary.LittleEndian.Uint32(b[20:]))
+
+	var msgs []*dns.Msg
+	for b = b[24:]; len(b) >= 16; {
+		n := int(binary.LittleEndian.Uint32(b[8:]))
+		packet := b[16 : 16+n]
+		b = b[16+n:]
+
+		assert.Equal(t, byte(0x45), packet[0])
+		assert.Equal(t, uint16(0), ipv4Checksum(packet[:ipv4HeaderSize]))
+
+		m := &dns.Msg{}
+		err = m.Unpack(packet[ipv4HeaderSize+udpHeaderSize:])
+		assert.Nil(t, err)
+		msgs = append(msgs, m)
+	}
+	assert.Empty(t, b)
+
+	return msgs
+}
+
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dns.pcap")
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TCPListenAddr = nil
+	dnsProxy.CaptureDir = dir
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&testUpstream{
+		aResp: &dns.A{
+			Hdr: dns.RR_Header{Rrtype: dns.TypeA, Name: "host.example.org.", Class: dns.ClassINET, Ttl: 100},
+			A:   net.IP{1, 2, 3, 4},
+		},
+	}}
+	err = dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	assert.NotNil(t, dnsProxy.StartCapture(CaptureConfig{Name: "dns.pcap"}))
+	for _, name := range []string{"", ".", "..", "../dns.pcap", "sub/dns.pcap", `sub\dns.pcap`, path} {
+		assert.NotNil(t, dnsProxy.StartCapture(CaptureConfig{Name: name, MaxPackets: 1}), name)
+	}
+	err = dnsProxy.StartCapture(CaptureConfig{
+		Name:       "dns.pcap",
+		QName:      "HOST.example.org",
+		MaxPackets: 4,
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, dnsProxy.StartCapture(CaptureConfig{Name: "dns.pcap", MaxPackets: 1}))
+
+	client := &dns.Client{Net: "udp"}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+	for _, host := range []string{"other.example.org", "host.example.org", "host.example.org"} {
+		_, _, err = client.Exchange(createHostTestMessage(host), addr)
+		assert.Nil(t, err)
+	}
+
+	// The session is stopped after 4 packets
+	assert.Nil(t, dnsProxy.activeCapture())
+
+	msgs := readTestCapture(t, path)
+	if assert.Len(t, msgs, 4) {
+		// client -> proxy -> upstream -> proxy -> client
+		for i, resp := range []bool{false, false, true, true} {
+			assert.Equal(t, resp, msgs[i].Response)
+			assert.Equal(t, "host.example.org.", msgs[i].Question[0].Name)
+		}
+	}
+}
+
+func TestAdminCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	dnsProxy := createTestProxy(t, nil)
+	h := dnsProxy.adminHandler()
+
+	// The capture is disabled without the directory
+	r := newAdminJSONRequest(http.MethodPost, adminPathCaptureStart, `{"name": "dns.pcap", "packets": 1}`)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	dnsProxy.CaptureDir = dir
+	r = newAdminJSONRequest(http.MethodPost, adminPathCaptureStart, `{"name": "dns.pcap", "client": "bad"}`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	r = newAdminJSONRequest(http.MethodPost, adminPathCaptureStart, `{"name": "dns.pcap"}`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	r = newAdminJSONRequest(http.MethodPost, adminPathCaptureStart, `{"name": "../dns.pcap", "packets": 1}`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// The form posts aren't accepted
+	r = httptest.NewRequest(http.MethodPost, adminPathCaptureStart, strings.NewReader(`{"name": "dns.pcap", "packets": 1}`))
+	r.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	r = newAdminJSONRequest(http.MethodPost, adminPathCaptureStart, `{"name": "dns.pcap", "packets": 1}`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, err = os.Stat(filepath.Join(dir, "dns.pcap"))
+	assert.Nil(t, err)
+
+	r = httptest.NewRequest(http.MethodPost, adminPathCaptureStop, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestUpstreamAddrIP(t *testing.T) {
+	testCases := map[string]string{
+		"8.8.8.8:53":                        "8.8.8.8",
+		"tcp://8.8.8.8:53":                  "8.8.8.8",
+		"tls://[2001:db8::1]:853":           "2001:db8::1",
+		"https://1.1.1.1/dns-query":         "1.1.1.1",
+		"https://dns.adguard.com/dns-query": "<nil>",
+	}
+
+	for addr, ip := range testCases {
+		assert.Equal(t, ip, upstreamAddrIP(addr).String(), addr)
+	}
+}
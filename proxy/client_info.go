@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// EDNSClientInfoCode is the code of the EDNS option that carries the original
+// client's address and protocol between the chained dnsproxy instances, like
+// X-Forwarded-For does for HTTP.  It's from the range reserved for the local
+// and experimental use (RFC 6891).
+//
+// The option data is the protocol code (1 byte), the port (2 bytes), and the
+// IPv4 (4 bytes) or IPv6 (16 bytes) address.
+const EDNSClientInfoCode = 65050
+
+// clientInfoProtos are the protocols in the client info option, the code of
+// a protocol is its index plus 1
+var clientInfoProtos = []string{ProtoUDP, ProtoTCP, ProtoTLS, ProtoHTTPS, ProtoQUIC, ProtoDNSCrypt}
+
+// packClientInfo returns the client info option for the client's address and
+// protocol or nil if the address has no IP
+func packClientInfo(proto string, addr net.Addr) *dns.EDNS0_LOCAL {
+	ip, port := addrIPPort(addr)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	code := byte(0)
+	for i, p := range clientInfoProtos {
+		if p == proto {
+			code = byte(i + 1)
+			break
+		}
+	}
+
+	data := make([]byte, 3, 3+len(ip))
+	data[0] = code
+	binary.BigEndian.PutUint16(data[1:], uint16(port))
+	data = append(data, ip...)
+
+	return &dns.EDNS0_LOCAL{Code: EDNSClientInfoCode, Data: data}
+}
+
+// unpackClientInfo returns the client's address and protocol from the data of
+// the client info option
+func unpackClientInfo(data []byte) (net.Addr, string, error) {
+	if len(data) != 3+net.IPv4len && len(data) != 3+net.IPv6len {
+		return nil, "", fmt.Errorf("bad client info length %d", len(data))
+	}
+
+	code := int(data[0])
+	if code == 0 || code > len(clientInfoProtos) {
+		return nil, "", fmt.Errorf("bad client info protocol %d", code)
+	}
+	proto := clientInfoProtos[code-1]
+
+	port := int(binary.BigEndian.Uint16(data[1:]))
+	ip := net.IP(append([]byte{}, data[3:]...))
+	if proto == ProtoUDP {
+		return &net.UDPAddr{IP: ip, Port: port}, proto, nil
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, proto, nil
+}
+
+// removeClientInfo removes the client info options from the message and
+// returns the last of them or nil if there are none
+func removeClientInfo(m *dns.Msg) *dns.EDNS0_LOCAL {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	var info *dns.EDNS0_LOCAL
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == EDNSClientInfoCode {
+			info = l
+			continue
+		}
+		options = append(options, o)
+	}
+	opt.Option = options
+
+	return info
+}
+
+// isTrustedProxy returns true if the request came from one of
+// Config.TrustedProxies
+func (p *Proxy) isTrustedProxy(d *DNSContext) bool {
+	ip, _ := addrIPPort(d.Addr)
+	return ip != nil && subnetsContain(p.TrustedProxies, ip)
+}
+
+// processClientInfo removes the client info option from the request and, if
+// the request came from a trusted proxy, uses it as the original client of
+// the request.  The option of the untrusted clients is ignored, so that they
+// can't spoof their address.
+func (p *Proxy) processClientInfo(d *DNSContext) {
+	info := removeClientInfo(d.Req)
+	if info == nil {
+		return
+	}
+
+	if !p.isTrustedProxy(d) {
+		log.Debug("Ignoring client info from untrusted %s", d.Addr)
+		return
+	}
+
+	addr, proto, err := unpackClientInfo(info.Data)
+	if err != nil {
+		log.Debug("Ignoring client info from %s: %s", d.Addr, err)
+		return
+	}
+
+	d.ForwardedAddr = addr
+	d.ForwardedProto = proto
+	log.Tracef("Request from %s is forwarded for %s %s", d.Addr, proto, addr)
+}
+
+// withClientInfo returns the request to send to the upstreams.  If
+// Config.ForwardClientInfo is enabled, it's the copy of d.Req with the client
+// info option, so that the EDNS of the client's request is unchanged.
+func (p *Proxy) withClientInfo(d *DNSContext) *dns.Msg {
+	if !p.ForwardClientInfo {
+		return d.Req
+	}
+
+	info := packClientInfo(d.ClientProto(), d.ClientAddr())
+	if info == nil {
+		return d.Req
+	}
+
+	req := d.Req.Copy()
+
+	// Note that servers may return FORMERR if they meet 2 OPT records
+	if opt := req.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, info)
+		return req
+	}
+
+	o := &dns.OPT{}
+	o.SetUDPSize(dns.DefaultMsgSize)
+	o.Hdr.Name = "."
+	o.Hdr.Rrtype = dns.TypeOPT
+	o.Option = append(o.Option, info)
+	req.Extra = append(req.Extra, o)
+
+	return req
+}
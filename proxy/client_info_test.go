@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientInfo(t *testing.T) {
+	for _, addr := range []net.Addr{
+		&net.UDPAddr{IP: net.IP{203, 0, 113, 5}, Port: 53000},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 853},
+	} {
+		proto := ProtoUDP
+		if _, ok := addr.(*net.TCPAddr); ok {
+			proto = ProtoTLS
+		}
+
+		info := packClientInfo(proto, addr)
+		assert.Equal(t, uint16(EDNSClientInfoCode), info.Code)
+		a, p, err := unpackClientInfo(info.Data)
+		assert.Nil(t, err)
+		assert.Equal(t, addr.String(), a.String())
+		assert.IsType(t, addr, a)
+		assert.Equal(t, proto, p)
+	}
+
+	assert.Nil(t, packClientInfo(ProtoHTTPS, nil))
+
+	for _, data := range [][]byte{nil, {1, 0, 53, 1, 2, 3}, {7, 0, 53, 1, 2, 3, 4}, {0, 0, 53, 1, 2, 3, 4}} {
+		_, _, err := unpackClientInfo(data)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestProcessClientInfo(t *testing.T) {
+	p := &Proxy{}
+	p.TrustedProxies, _ = ParseSubnets([]string{"192.168.1.1"})
+
+	newCtx := func(ip net.IP) *DNSContext {
+		req := createHostTestMessage("example.org")
+		req.SetEdns0(4096, false)
+		info := packClientInfo(ProtoUDP, &net.UDPAddr{IP: net.IP{203, 0, 113, 5}, Port: 53000})
+		req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE}, info)
+		return &DNSContext{Proto: ProtoTCP, Req: req, Addr: &net.TCPAddr{IP: ip}}
+	}
+
+	d := newCtx(net.IP{192, 168, 1, 1})
+	p.processClientInfo(d)
+	assert.Equal(t, "203.0.113.5:53000", d.ClientAddr().String())
+	assert.Equal(t, ProtoUDP, d.ClientProto())
+	assert.Len(t, d.Req.IsEdns0().Option, 1)
+
+	// The option of the untrusted clients is removed and ignored
+	d = newCtx(net.IP{192, 168, 1, 2})
+	p.processClientInfo(d)
+	assert.Nil(t, d.ForwardedAddr)
+	assert.Equal(t, "192.168.1.2:0", d.ClientAddr().String())
+	assert.Equal(t, ProtoTCP, d.ClientProto())
+	assert.Len(t, d.Req.IsEdns0().Option, 1)
+}
+
+func TestClientInfoChaining(t *testing.T) {
+	// The upstream instance trusts the downstream one and records the
+	// clients
+	var lock sync.Mutex
+	var clients []string
+	upstreamProxy := createTestProxy(t, nil)
+	upstreamProxy.TrustedProxies, _ = ParseSubnets([]string{listenIP})
+	upstreamProxy.ACL, _ = ParseACL(nil, []string{"198.51.100.0/24"})
+	upstreamProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		lock.Lock()
+		clients = append(clients, d.ClientProto()+" "+d.ClientAddr().String())
+		lock.Unlock()
+
+		assert.Nil(t, removeClientInfo(d.Req))
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+	getClients := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, clients...)
+	}
+	assert.Nil(t, upstreamProxy.Start())
+	defer func() {
+		assert.Nil(t, upstreamProxy.Stop())
+	}()
+
+	u, err := upstream.AddressToUpstream(upstreamProxy.Addr(ProtoUDP).String(), upstream.Options{Timeout: defaultTimeout})
+	assert.Nil(t, err)
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.ForwardClientInfo = true
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	assert.Nil(t, dnsProxy.Init())
+
+	d := &DNSContext{
+		Proto: ProtoTLS,
+		Req:   createHostTestMessage("example.org"),
+		Addr:  &net.TCPAddr{IP: net.IP{203, 0, 113, 5}, Port: 40000},
+	}
+	assert.Nil(t, dnsProxy.Resolve(d))
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, []string{"tls 203.0.113.5:40000"}, getClients())
+
+	// The option is only added to the copy sent upstream, the client's
+	// request stays without EDNS
+	assert.Nil(t, d.Req.IsEdns0())
+
+	// The upstream instance applies its ACL to the original client
+	d = &DNSContext{
+		Proto: ProtoUDP,
+		Req:   createHostTestMessage("example.org"),
+		Addr:  &net.UDPAddr{IP: net.IP{198, 51, 100, 1}, Port: 40000},
+	}
+	assert.Nil(t, dnsProxy.Resolve(d))
+	assert.Equal(t, dns.RcodeRefused, d.Res.Rcode)
+	assert.Len(t, getClients(), 1)
+
+	dnsProxy.PrivacyMode = true
+	assert.NotNil(t, dnsProxy.validateConfig())
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// clientTTLRange returns the range of the TTLs of the responses to the client
+// of the request.  0 means no limit.
+func (p *Proxy) clientTTLRange(d *DNSContext) (min, max uint32) {
+	min, max = p.ClientMinTTL, p.ClientMaxTTL
+	if d.listener != nil {
+		if d.listener.ClientMinTTL != 0 {
+			min = d.listener.ClientMinTTL
+		}
+		if d.listener.ClientMaxTTL != 0 {
+			max = d.listener.ClientMaxTTL
+		}
+	}
+
+	return min, max
+}
+
+// setClientTTL overrides the TTLs of the response to the client according to
+// Config.ClientMinTTL and Config.ClientMaxTTL.  Unlike the cache TTL
+// overrides, it doesn't affect the cached response, so the clients may be
+// told to re-query sooner than the upstreams are queried.
+func (p *Proxy) setClientTTL(d *DNSContext) {
+	min, max := p.clientTTLRange(d)
+	if min == 0 && max == 0 {
+		return
+	}
+
+	if !hasTTLOutside(d.Res, min, max) {
+		return
+	}
+
+	res := d.writableRes()
+	for _, section := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			ttl := respectTTLOverrides(rr.Header().Ttl, min, max)
+			if ttl != rr.Header().Ttl {
+				log.Debug("Override client TTL from %d to %d", rr.Header().Ttl, ttl)
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+}
+
+// hasTTLOutside returns true if any of the records of m has a TTL outside of
+// the range
+func hasTTLOutside(m *dns.Msg, min, max uint32) bool {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT &&
+				respectTTLOverrides(rr.Header().Ttl, min, max) != rr.Header().Ttl {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetClientTTL(t *testing.T) {
+	p := &Proxy{Config: Config{ClientMinTTL: 10, ClientMaxTTL: 60}}
+
+	req := createHostTestMessage("host.example.org")
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Answer = []dns.RR{
+		newRR("host.example.org. 5 IN A 1.2.3.4"),
+		newRR("host.example.org. 30 IN A 1.2.3.5"),
+		newRR("host.example.org. 3600 IN A 1.2.3.6"),
+	}
+	res.Ns = []dns.RR{newRR("example.org. 86400 IN NS ns.example.org.")}
+	res.SetEdns0(4096, false)
+
+	d := &DNSContext{Req: req, Res: res}
+	p.setClientTTL(d)
+	ttls := []uint32{}
+	for _, rr := range append(d.Res.Answer, d.Res.Ns...) {
+		ttls = append(ttls, rr.Header().Ttl)
+	}
+	assert.Equal(t, []uint32{10, 30, 60, 60}, ttls)
+	assert.Equal(t, uint32(0), d.Res.IsEdns0().Hdr.Ttl)
+
+	// The original response isn't changed
+	assert.Equal(t, uint32(5), res.Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(3600), res.Answer[2].Header().Ttl)
+
+	// The listener's settings are preferred
+	d = &DNSContext{Req: req, Res: res, listener: &ListenerConfig{ClientMaxTTL: 20}}
+	p.setClientTTL(d)
+	assert.Equal(t, uint32(10), d.Res.Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(20), d.Res.Answer[1].Header().Ttl)
+
+	// Nothing is copied if nothing is changed
+	d = &DNSContext{Req: req, Res: res, listener: &ListenerConfig{ClientMinTTL: 1, ClientMaxTTL: 86400}}
+	p.setClientTTL(d)
+	assert.True(t, d.Res == res)
+}
+
+func TestClientTTLCache(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.ClientMaxTTL = 60
+	u := &testUpstream{aResp: newRR("host.example.org. 3600 IN A 1.2.3.4").(*dns.A)}
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	conn, err := dns.Dial("udp", dnsProxy.Addr(ProtoUDP).String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, conn.SetDeadline(time.Now().Add(time.Second)))
+		assert.Nil(t, conn.WriteMsg(createHostTestMessage("host.example.org")))
+		res, err := conn.ReadMsg()
+		if assert.Nil(t, err) && assert.Len(t, res.Answer, 1) {
+			assert.Equal(t, uint32(60), res.Answer[0].Header().Ttl)
+			assert.True(t, res.Answer[0].(*dns.A).A.Equal(net.IP{1, 2, 3, 4}))
+		}
+	}
+
+	// The cache honors the upstream's TTL
+	val, ok := dnsProxy.cache.Get(createHostTestMessage("host.example.org"))
+	assert.True(t, ok)
+	assert.True(t, val.Answer[0].Header().Ttl > 60)
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// CNAMEModeType - how to handle CNAME chains in the upstream responses
+type CNAMEModeType int
+
+const (
+	// CNAMEModeNone - pass the responses as is
+	CNAMEModeNone CNAMEModeType = iota
+	// CNAMEModeChase - if the CNAME chain in the response for an A or AAAA
+	// question doesn't end with an address, resolve the rest of it
+	CNAMEModeChase
+	// CNAMEModeFlatten - chase the CNAME chain and return only the final
+	// A or AAAA records renamed to the question name
+	CNAMEModeFlatten
+)
+
+// maxCNAMEChaseDepth is the maximum number of additional queries sent to
+// resolve a single CNAME chain
+const maxCNAMEChaseDepth = 8
+
+// processCNAME chases and flattens the CNAME chain in the reply according to
+// the CNAMEMode.  upstreamsFor returns the upstreams for the name the chain
+// is chased to.  It never fails, if something goes wrong, the reply is
+// returned as is.
+func (p *Proxy) processCNAME(req, reply *dns.Msg, upstreamsFor func(name string) []upstream.Upstream) *dns.Msg {
+	if p.CNAMEMode == CNAMEModeNone || reply == nil || reply.Rcode != dns.RcodeSuccess {
+		return reply
+	}
+
+	q := req.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return reply
+	}
+
+	terminated := p.chaseCNAME(q, reply, upstreamsFor)
+	if p.CNAMEMode == CNAMEModeFlatten && terminated {
+		flattenCNAME(q, reply)
+	}
+
+	return reply
+}
+
+// chaseCNAME resolves the rest of the CNAME chain if it's unterminated and
+// appends the answers to the reply.  The targets are resolved with the
+// upstreams returned by upstreamsFor, so that the domain-specific upstreams
+// are used for them.  Returns true if the chain is terminated now.
+func (p *Proxy) chaseCNAME(q dns.Question, reply *dns.Msg, upstreamsFor func(name string) []upstream.Upstream) bool {
+	for i := 0; i < maxCNAMEChaseDepth; i++ {
+		target, terminated := cnameChainEnd(reply, q)
+		if terminated || target == "" {
+			return terminated
+		}
+
+		log.Tracef("Chasing CNAME %s for %s", target, q.Name)
+		req := &dns.Msg{}
+		req.Id = p.newMsgID()
+		req.RecursionDesired = true
+		req.Question = []dns.Question{{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}}
+
+		resp, _, err := p.exchange(req, upstreamsFor(target))
+		if err != nil {
+			log.Tracef("Failed to chase CNAME %s: %s", target, err)
+			return false
+		}
+
+		reply.Answer = append(reply.Answer, resp.Answer...)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+			// The end of the chain doesn't exist or has no records of the
+			// type (NODATA), so asking again won't help
+			reply.Rcode = resp.Rcode
+			reply.Ns = resp.Ns
+			return false
+		}
+	}
+
+	_, terminated := cnameChainEnd(reply, q)
+	return terminated
+}
+
+// cnameChainEnd follows the CNAME chain for the question in the reply.  If
+// the chain is terminated with the records of the question type, it returns
+// true.  Otherwise, it returns the last target of the chain or an empty
+// string if there are no CNAMEs for the question name at all.
+func cnameChainEnd(reply *dns.Msg, q dns.Question) (target string, terminated bool) {
+	name := q.Name
+	// Every iteration either ends the loop or follows one of the records, so
+	// this limit protects from CNAME loops
+	for i := 0; i <= len(reply.Answer); i++ {
+		next := ""
+		for _, rr := range reply.Answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+
+			if rr.Header().Rrtype == q.Qtype {
+				return "", true
+			}
+
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		name = next
+	}
+
+	if name == q.Name {
+		return "", false
+	}
+
+	return name, false
+}
+
+// flattenCNAME replaces the answer with the records of the question type
+// renamed to the question name.  Their TTL is the minimum TTL of the chain.
+// The signatures are removed, since they aren't valid for the new records.
+func flattenCNAME(q dns.Question, reply *dns.Msg) {
+	ttl := ^uint32(0)
+	hasCNAME := false
+	var answer []dns.RR
+	for _, rr := range reply.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeCNAME:
+			hasCNAME = true
+		case q.Qtype:
+			answer = append(answer, rr)
+		default:
+			continue
+		}
+
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+
+	if !hasCNAME {
+		return
+	}
+
+	for _, rr := range answer {
+		rr.Header().Name = q.Name
+		rr.Header().Ttl = ttl
+	}
+	reply.Answer = answer
+}
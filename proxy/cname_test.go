@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// cnameTestUpstream answers with the records for the question name
+type cnameTestUpstream struct {
+	answers map[string][]dns.RR
+	queries int
+}
+
+func (u *cnameTestUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	u.queries++
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+
+	answers, ok := u.answers[m.Question[0].Name]
+	if !ok {
+		resp.Rcode = dns.RcodeNameError
+	}
+	resp.Answer = append(resp.Answer, answers...)
+
+	return resp, nil
+}
+
+func (u *cnameTestUpstream) Address() string {
+	return "cname"
+}
+
+// staticUpstreams returns the upstreamsFor function that returns the same
+// upstreams for any name
+func staticUpstreams(upstreams []upstream.Upstream) func(name string) []upstream.Upstream {
+	return func(_ string) []upstream.Upstream {
+		return upstreams
+	}
+}
+
+func newCNAMETestUpstream() *cnameTestUpstream {
+	return &cnameTestUpstream{
+		answers: map[string][]dns.RR{
+			// Unterminated chain
+			"host.example.org.": {
+				newRR("host.example.org. 300 IN CNAME cdn.example.net."),
+			},
+			"cdn.example.net.": {
+				newRR("cdn.example.net. 60 IN CNAME edge.example.com."),
+				newRR("edge.example.com. 600 IN A 1.2.3.4"),
+			},
+			// Terminated chain
+			"full.example.org.": {
+				newRR("full.example.org. 300 IN CNAME edge.example.com."),
+				newRR("edge.example.com. 600 IN A 1.2.3.4"),
+			},
+			// Loop
+			"loop1.example.org.": {
+				newRR("loop1.example.org. 300 IN CNAME loop2.example.org."),
+				newRR("loop2.example.org. 300 IN CNAME loop1.example.org."),
+			},
+			// Dangling
+			"dangling.example.org.": {
+				newRR("dangling.example.org. 300 IN CNAME nowhere.example.org."),
+			},
+			// No records of the type at the end
+			"nodata.example.org.": {
+				newRR("nodata.example.org. 300 IN CNAME empty.example.org."),
+			},
+			"empty.example.org.": nil,
+		},
+	}
+}
+
+func TestCNAMEChase(t *testing.T) {
+	p := &Proxy{}
+	p.CNAMEMode = CNAMEModeChase
+	upstreams := []upstream.Upstream{newCNAMETestUpstream()}
+
+	req := createHostTestMessage("host.example.org")
+	reply, _, err := p.exchange(req, upstreams)
+	assert.Nil(t, err)
+	reply = p.processCNAME(req, reply, staticUpstreams(upstreams))
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 3)
+	assert.Equal(t, "1.2.3.4", getIPFromResponse(reply).String())
+
+	// The loop is left as is
+	req = createHostTestMessage("loop1.example.org")
+	reply, _, err = p.exchange(req, upstreams)
+	assert.Nil(t, err)
+	reply = p.processCNAME(req, reply, staticUpstreams(upstreams))
+	assert.Len(t, reply.Answer, 2)
+
+	// The chain to a nonexistent name results in NXDOMAIN
+	req = createHostTestMessage("dangling.example.org")
+	reply, _, err = p.exchange(req, upstreams)
+	assert.Nil(t, err)
+	reply = p.processCNAME(req, reply, staticUpstreams(upstreams))
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.Len(t, reply.Answer, 1)
+
+	// NODATA and NXDOMAIN end the chase at once
+	for _, host := range []string{"nodata.example.org", "dangling.example.org"} {
+		u := newCNAMETestUpstream()
+		req = createHostTestMessage(host)
+		reply, _, err = p.exchange(req, []upstream.Upstream{u})
+		assert.Nil(t, err)
+		reply = p.processCNAME(req, reply, staticUpstreams([]upstream.Upstream{u}))
+		assert.Len(t, reply.Answer, 1)
+		assert.Equal(t, 2, u.queries, host)
+	}
+}
+
+func TestCNAMEFlatten(t *testing.T) {
+	p := &Proxy{}
+	p.CNAMEMode = CNAMEModeFlatten
+	upstreams := []upstream.Upstream{newCNAMETestUpstream()}
+
+	for _, host := range []string{"host.example.org", "full.example.org"} {
+		req := createHostTestMessage(host)
+		reply, _, err := p.exchange(req, upstreams)
+		assert.Nil(t, err)
+		reply = p.processCNAME(req, reply, staticUpstreams(upstreams))
+
+		assert.Len(t, reply.Answer, 1)
+		a, ok := reply.Answer[0].(*dns.A)
+		if assert.True(t, ok) {
+			assert.Equal(t, host+".", a.Hdr.Name)
+			assert.Equal(t, "1.2.3.4", a.A.String())
+		}
+	}
+
+	// The minimal TTL of the chain is used
+	req := createHostTestMessage("host.example.org")
+	reply, _, _ := p.exchange(req, upstreams)
+	reply = p.processCNAME(req, reply, staticUpstreams(upstreams))
+	assert.Equal(t, uint32(60), reply.Answer[0].Header().Ttl)
+
+	// The unterminated chain isn't flattened
+	req = createHostTestMessage("loop1.example.org")
+	reply, _, _ = p.exchange(req, upstreams)
+	reply = p.processCNAME(req, reply, staticUpstreams(upstreams))
+	assert.Len(t, reply.Answer, 2)
+}
+
+func TestCNAMEChaseDomainUpstreams(t *testing.T) {
+	// The internal server only knows the internal names and the public one
+	// only knows the public ones
+	internal := &cnameTestUpstream{answers: map[string][]dns.RR{
+		"www.internal.example.": {
+			newRR("www.internal.example. 300 IN CNAME cdn.example.net."),
+		},
+	}}
+	public := &cnameTestUpstream{answers: map[string][]dns.RR{
+		"cdn.example.net.": {
+			newRR("cdn.example.net. 300 IN A 1.2.3.4"),
+		},
+	}}
+
+	p := &Proxy{}
+	p.CNAMEMode = CNAMEModeChase
+	p.UpstreamConfig = &UpstreamConfig{
+		Upstreams: []upstream.Upstream{public},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"internal.example.": {internal},
+		},
+	}
+
+	d := &DNSContext{Req: createHostTestMessage("www.internal.example")}
+	assert.Nil(t, p.Resolve(d))
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Len(t, d.Res.Answer, 2)
+	assert.Equal(t, "1.2.3.4", getIPFromResponse(d.Res).String())
+	assert.Equal(t, 1, internal.queries)
+	assert.Equal(t, 1, public.queries)
+
+	// The custom upstream config is used for the target too
+	custom := &cnameTestUpstream{answers: map[string][]dns.RR{
+		"cdn.example.net.": {
+			newRR("cdn.example.net. 300 IN A 5.6.7.8"),
+		},
+	}}
+	d = &DNSContext{
+		Req: createHostTestMessage("www.internal.example"),
+		CustomUpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{custom},
+			DomainReservedUpstreams: map[string][]upstream.Upstream{
+				"internal.example.": {internal},
+			},
+		},
+	}
+	assert.Nil(t, p.Resolve(d))
+	assert.Equal(t, "5.6.7.8", getIPFromResponse(d.Res).String())
+	assert.Equal(t, 2, internal.queries)
+	assert.Equal(t, 1, custom.queries)
+	assert.Equal(t, 1, public.queries)
+}
@@ -4,10 +4,15 @@ import (
 	"crypto/tls"
 	"errors"
 	"net"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/fastip"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
 )
 
 // UpstreamModeType - upstream mode
@@ -36,6 +41,21 @@ type RequestHandler func(p *Proxy, d *DNSContext) error
 // err -- error (if any)
 type ResponseHandler func(d *DNSContext, err error)
 
+// CachePolicy is an optional callback that decides if the upstream response
+// res to d.Req is cached, d.Upstream is the upstream that has returned it.
+// It's only called for the responses that are cacheable otherwise.  If cache
+// is false, the response isn't cached, else if ttl isn't 0, it's cached for
+// ttl seconds instead of the TTL of its records.
+type CachePolicy func(d *DNSContext, res *dns.Msg) (cache bool, ttl uint32)
+
+// ListenPacketFunc creates a packet-oriented listener for the specified
+// protocol (ProtoUDP or ProtoQUIC) and address
+type ListenPacketFunc func(proto string, addr *net.UDPAddr) (net.PacketConn, error)
+
+// ListenStreamFunc creates a stream-oriented listener for the specified
+// protocol (ProtoTCP, ProtoTLS, or ProtoHTTPS) and address
+type ListenStreamFunc func(proto string, addr *net.TCPAddr) (net.Listener, error)
+
 // Config contains all the fields necessary for proxy configuration
 type Config struct {
 	// Listeners
@@ -49,13 +69,116 @@ type Config struct {
 	DNSCryptUDPListenAddr []*net.UDPAddr // if nil, then it does not listen for DNSCrypt
 	DNSCryptTCPListenAddr []*net.TCPAddr // if nil, then it does not listen for DNSCrypt
 
+	// UnixListenAddr and UnixgramListenAddr are the paths of the UNIX
+	// domain sockets, SOCK_STREAM and SOCK_DGRAM respectively, the plain
+	// DNS is served on for the local clients.  A socket file left by a
+	// previous run is replaced.  Their clients are always allowed by the
+	// ACL and never ratelimited, the access is controlled by the mode of
+	// the socket file.
+	UnixListenAddr     []*net.UnixAddr
+	UnixgramListenAddr []*net.UnixAddr
+	// UnixSocketMode, if set, is the mode of the UNIX socket files,
+	// otherwise it depends on the umask
+	UnixSocketMode os.FileMode
+
+	// ListenPacket, if set, is used instead of net.ListenUDP to create the
+	// UDP and QUIC listeners.  Together with ListenStream it allows
+	// terminating DNS inside a userspace network stack (e.g. gVisor's
+	// netstack) without OS sockets.  DNSCrypt listeners always use OS
+	// sockets.
+	ListenPacket ListenPacketFunc
+
+	// ListenStream, if set, is used instead of net.ListenTCP to create the
+	// TCP, TLS, and HTTPS listeners.
+	ListenStream ListenStreamFunc
+
+	// Pre-created listeners that are served in addition to the ones created
+	// from the addresses above.  This is useful for tests, socket activation,
+	// and custom transports.  The proxy takes ownership of them and closes
+	// them on Stop.  TLS and HTTPS listeners must not be wrapped in TLS, the
+	// proxy does it using TLSConfig.
+	UDPListeners   []net.PacketConn
+	TCPListeners   []net.Listener
+	TLSListeners   []net.Listener
+	HTTPSListeners []net.Listener
+	QUICListeners  []net.PacketConn
+
+	// Listeners are the groups of UDP, TCP, TLS, and HTTPS listeners with
+	// their own settings, e.g. handler, upstreams, and ratelimit.  The
+	// listeners above use the settings from this Config.
+	Listeners []*ListenerConfig
+
+	// AdminListenAddr is the address of the runtime control HTTP API.  If
+	// nil, the API is disabled.  The API has no authentication, so it must
+	// never be exposed to untrusted networks.
+	AdminListenAddr *net.TCPAddr
+
+	// CaptureDir is the directory the packet capture files are written to,
+	// see StartCapture.  If empty, the capture is disabled.
+	CaptureDir string
+
 	// Encryption configuration
 	// --
 
-	TLSConfig            *tls.Config    // necessary for TLS, HTTPS, QUIC
+	// TLSConfig is necessary for TLS, HTTPS, QUIC.  To require client
+	// certificates (mTLS) on these listeners, set its ClientAuth to
+	// tls.RequireAndVerifyClientCert and ClientCAs to the trusted CAs.
+	TLSConfig            *tls.Config
 	DNSCryptProviderName string         // DNSCrypt provider name
 	DNSCryptResolverCert *dnscrypt.Cert // DNSCrypt resolver certificate
 
+	// OCSPStapling, if true, makes the proxy fetch the OCSP responses for
+	// the certificates of TLSConfig from the responders listed in them and
+	// staple them in the TLS, HTTPS, and QUIC handshakes.  The responses are
+	// refreshed in the background half-way through their validity.  The
+	// certificate chains must include the issuers.
+	OCSPStapling bool
+
+	// TLSCertPath and TLSKeyPath, if set, are the files with the PEM-encoded
+	// certificate chain and private key of TLSConfig.  They're checked for
+	// changes every TLSReloadInterval, 1 minute by default, and the
+	// certificate is replaced without a restart, see also
+	// Proxy.ReloadTLSCertificate.  The certificates of TLSConfig itself are
+	// ignored then.  If TLSReloadInterval is negative, the files are only
+	// reloaded with Proxy.ReloadTLSCertificate.
+	TLSCertPath       string
+	TLSKeyPath        string
+	TLSReloadInterval time.Duration
+
+	// ACMEHosts, if set, are the domain names the certificate of TLSConfig
+	// is obtained and renewed for via ACME, e.g. from Let's Encrypt.  The
+	// HTTP-01 challenges are answered on ACMEHTTPListenAddr, the CA
+	// connects to it on port 80.  The certificates and the account key are
+	// kept in ACMECacheDir.  The certificates of TLSConfig itself are
+	// ignored then, the clients that don't send SNI get the certificate of
+	// the first host.
+	ACMEHosts          []string
+	ACMEHTTPListenAddr *net.TCPAddr
+	ACMECacheDir       string
+	ACMEEmail          string // contact email of the ACME account, optional
+	ACMEDirectoryURL   string // ACME directory, Let's Encrypt if empty
+
+	// HTTPSAuthTokens is the list of static tokens for DNS-over-HTTPS client
+	// authentication.  If not empty, a client must pass one of them either
+	// as a bearer token in the Authorization header or as the last element
+	// of the URL path (i.e. https://example.org/dns-query/<token>).
+	HTTPSAuthTokens []string
+
+	// HTTPSTrustedProxies are the subnets of the CDNs or the reverse proxies
+	// in front of the DNS-over-HTTPS listeners.  The client's IP address is
+	// only taken from the HTTP headers of the requests coming from them, so
+	// that the other clients can't spoof it.  If nil, the headers are
+	// ignored.
+	HTTPSTrustedProxies []*net.IPNet
+
+	// HTTPSClientIPHeaders are the names of the HTTP headers the client's IP
+	// address is taken from, in the order of preference, e.g.
+	// CF-Connecting-IP for Cloudflare or Fastly-Client-IP for Fastly.  The
+	// address is used instead of the DNS-over-HTTPS peer's one for the ACL,
+	// the ratelimit, ECS, and the logs.  If nil, the headers set by
+	// Cloudflare and Fastly, X-Real-IP, and X-Forwarded-For are used.
+	HTTPSClientIPHeaders []string
+
 	// Rate-limiting and anti-DNS amplification measures
 	// --
 
@@ -63,16 +186,118 @@ type Config struct {
 	RatelimitWhitelist []string // a list of whitelisted client IP addresses
 	RefuseAny          bool     // if true, refuse ANY requests
 
+	// QTypePolicy is the way the requests of the specific query types, e.g.
+	// ANY, AXFR, and IXFR, are handled instead of being sent to the
+	// upstreams.  The ANY requests that aren't in it are refused if
+	// RefuseAny is set.
+	QTypePolicy QTypePolicy
+
+	// ACL is the access control list of the clients.  If nil, all clients
+	// are allowed.
+	ACL *ACL
+
+	// AutoTuneUDPSize, if true, raises the UDP size advertised to the EDNS
+	// clients that keep retrying the truncated responses over TCP, up to
+	// 1232 bytes.  The responses never exceed the size the client advertises
+	// itself.  The truncation statistics are collected anyway.
+	AutoTuneUDPSize bool
+
 	// Upstream DNS servers and their settings
 	// --
 
 	UpstreamConfig *UpstreamConfig     // Upstream DNS servers configuration
-	Fallbacks      []upstream.Upstream // list of fallback resolvers (which will be used if regular upstream failed to answer)
+	Fallbacks      []upstream.Upstream // list of fallback resolvers (which will be used if regular upstream failed to answer), UpstreamConfig.Fallbacks replace them
 	UpstreamMode   UpstreamModeType    // How to request the upstream servers
+	CNAMEMode      CNAMEModeType       // How to handle CNAME chains in the upstream responses
+
+	// FastestAddr is the configuration of the fastest-addr module used in
+	// UModeFastestAddr: how the IP addresses are probed and how long the
+	// results are cached.  If the UpstreamLayer is shared, the proxy that
+	// uses the module first configures it.
+	FastestAddr fastip.Config
+
+	// UpstreamPolicy is the default timeout and retry policy of the
+	// upstreams, the fallbacks, and the last resort upstreams.
+	// UpstreamPolicies overrides it for the upstreams by their addresses.
+	UpstreamPolicy   UpstreamPolicy
+	UpstreamPolicies map[string]UpstreamPolicy
+	// ParallelTimeout, if set, limits the timeout of an exchange attempt in
+	// the parallel mode and with the fallbacks.  It's usually shorter than
+	// the regular one so that a slow upstream doesn't hold the race.  It
+	// never makes the timeouts of the UpstreamPolicies longer.
+	ParallelTimeout time.Duration
+	// UpstreamProbeRate is the share of the requests in UModeLoadBalance
+	// that are sent to a random upstream other than the best one first, so
+	// that the statistics of the others don't go stale.  If 0, 2% of the
+	// requests are, and if negative, none.
+	UpstreamProbeRate float64
+
+	// UpstreamLayer, if set, is the upstreams runtime state shared with the
+	// other proxies.  Otherwise, the proxy has its own one.
+	UpstreamLayer *UpstreamLayer
+
+	// LastResortUpstreams are used only when the regular upstreams and the
+	// fallbacks have been failing for LastResortThreshold.  This allows
+	// having e.g. a plain DNS emergency upstream in an encrypted-only
+	// configuration.
+	LastResortUpstreams []upstream.Upstream
+	// LastResortThreshold is the time the upstreams must have been failing
+	// for before the last resort upstreams are used.  If 0, one minute is
+	// used.
+	LastResortThreshold time.Duration
+
+	// Deterministic, if true, makes the behavior of the proxy reproducible
+	// for the integration tests: the upstreams are selected in the
+	// configured order instead of by their RTT or by the race in the
+	// parallel mode, the records of every RRset in the responses are
+	// sorted, and the IDs of the requests the proxy sends on its own are
+	// generated with RandomSeed.  The fastest-addr mode isn't affected.
+	Deterministic bool
+	RandomSeed    int64
+
+	// RequestDeduplication - if true, identical concurrent requests are
+	// coalesced into a single upstream exchange.  The requests with a custom
+	// upstream configuration are never coalesced.
+	RequestDeduplication bool
+
+	// HealthCheckInterval is the interval between the upstreams health
+	// checks.  If an upstream fails to answer the probe query several times
+	// in a row, it's excluded from selection until it answers again.  Down
+	// upstreams are probed with an exponential backoff.  0 disables the
+	// health checks.
+	HealthCheckInterval time.Duration
+	// HealthCheckDomain is the domain the probe NS queries are sent for.
+	// The root domain is used if it's empty.
+	HealthCheckDomain string
+
+	// Priming, if true, sends the NS queries for the root zone to the
+	// default upstreams and for the domains of
+	// UpstreamConfig.DomainReservedUpstreams to their upstreams in the
+	// background on start, so that the connections are established, and
+	// the NS records and glue of the zones are cached before the first
+	// client's request.
+	Priming bool
 
 	// BogusNXDomain - transforms responses that contain at least one of the given IP addresses into NXDOMAIN
 	// Similar to dnsmasq's "bogus-nxdomain"
 	BogusNXDomain []net.IP
+	// BogusNXDomainNets are the subnets that are handled like BogusNXDomain,
+	// e.g. the whole network of the ISP's search-redirect servers
+	BogusNXDomainNets []*net.IPNet
+
+	// Blocklist, if set, answers the requests for the blocked domains
+	// without sending them to the upstreams
+	Blocklist *Blocklist
+
+	// LocalHosts, if set, answers the A, AAAA, and PTR requests for the
+	// hosts registered at runtime, e.g. the DHCP clients.  They're answered
+	// before the blocklist is checked.
+	LocalHosts *LocalHosts
+
+	// Rewrites, if set, answers the requests for the names matching its
+	// rules with the static records.  They're checked after LocalHosts and
+	// before the blocklist.
+	Rewrites *Rewrites
 
 	// Enable EDNS Client Subnet option
 	// DNS requests to the upstream server will contain an OPT record with Client Subnet option.
@@ -96,6 +321,50 @@ type Config struct {
 	EnableEDNSClientSubnet bool
 	EDNSAddr               net.IP // ECS IP used in request
 
+	// ECSOverrides replace the ECS data for the specific domains, e.g. to
+	// send a fixed prefix for the CDN domains and strip ECS for the others.
+	// The most specific domain wins.  They require EnableEDNSClientSubnet.
+	ECSOverrides []ECSOverride
+
+	// PrivacyMode, if true, guarantees that no data identifying the clients
+	// is sent to the upstreams: the requests get a new ID and the lowercased
+	// question, their EDNS options, including ECS and cookies, are removed,
+	// and the client's UDP size is replaced.  It can't be used with
+	// EnableEDNSClientSubnet.
+	PrivacyMode bool
+
+	// TrustedProxies are the subnets of the downstream dnsproxy instances
+	// the client info EDNS option is accepted from, see EDNSClientInfoCode.
+	// The client reported by it is used instead of the one that sent the
+	// request for the ACL, the ratelimit, and ECS.  The option is removed
+	// from all the requests, so the untrusted clients can't spoof it.
+	TrustedProxies []*net.IPNet
+	// ProxyProtocol, if true, makes the TCP and TLS connections from the
+	// TrustedProxies start with the PROXY protocol header, v1 or v2, e.g.
+	// the ones from HAProxy in front of the DNS-over-TLS listener.  The
+	// client's address from it is used as the connection's remote address.
+	ProxyProtocol bool
+	// ForwardClientInfo, if true, adds the client info EDNS option to the
+	// requests sent to the upstreams.  It should only be enabled if they
+	// are the trusted dnsproxy instances, since it reveals the clients'
+	// addresses.  It can't be used with PrivacyMode.
+	ForwardClientInfo bool
+
+	// Cookies enables DNS cookies (RFC 7873).  The clients that send a
+	// client cookie get a server cookie, which is validated in their next
+	// requests, see DNSContext.CookieValid.  The plain DNS upstreams get the
+	// client cookie of the proxy and their own last server cookie back.
+	Cookies bool
+	// CookieSecret is the secret the server cookies are generated with.  The
+	// instances behind the same anycast address should share it.  It must
+	// be at least 16 bytes long.  If empty, a random one is generated.
+	CookieSecret []byte
+	// CookiesRequired, if true, makes the proxy answer the UDP requests that
+	// carry a client cookie but no valid server cookie with BADCOOKIE and a
+	// new server cookie, so that the client retries with it.  The requests
+	// without cookies are processed as usual.
+	CookiesRequired bool
+
 	// Cache settings
 	// --
 
@@ -104,16 +373,101 @@ type Config struct {
 	CacheMinTTL    uint32 // Minimum TTL for DNS entries (in seconds).
 	CacheMaxTTL    uint32 // Maximum TTL for DNS entries (in seconds).
 
+	// CacheShards is the number of the independent parts of the cache, each
+	// with its own lock and LRU list, the responses are spread over by the
+	// hash of the request.  It's reduced so that each part is at least 64
+	// KiB, so the small caches aren't sharded.  0 means 16.
+	CacheShards int
+
+	// CacheKeepHot is the number of the most requested entries that are
+	// kept when the cache is cleared, so that clearing it doesn't send all
+	// the clients to the upstreams at once.  The kept entries are
+	// re-resolved in the background, and so they are when the upstreams
+	// are replaced with SetUpstreamConfig.  Only the general cache entries
+	// are kept, the subnet cache is always cleared entirely.
+	CacheKeepHot int
+
+	// CachePrefetch is the number of the hits after which a cache entry is
+	// re-resolved in the background when 10% of its TTL is left, so that
+	// the popular names are always served from the cache, but never stale.
+	// The hits are counted anew for every cached response.  Only the
+	// general cache entries are prefetched.  0 disables prefetching.
+	CachePrefetch int
+
+	// CachePrewarm is the list of the names the A and AAAA records of which
+	// are resolved into the cache in the background on start
+	CachePrewarm []string
+
+	// CacheServeStale is how long the expired responses are kept in the
+	// cache to be served with the TTL of 30 seconds and the Stale Answer
+	// Extended DNS Error if the upstreams fail, see RFC 8767.  Only the
+	// general cache entries are served stale.  0 disables it.
+	CacheServeStale time.Duration
+
+	// CacheRoundRobin, if true, rotates the order of the A and AAAA records
+	// in the cached answers by one position for every response, so that
+	// the clients that always use the first address don't all go to the
+	// same one.  GeoIPRules sort the rotated answers.  The answers aren't
+	// rotated in the Deterministic mode.
+	CacheRoundRobin bool
+
+	// ClientMinTTL and ClientMaxTTL override the TTLs of the responses sent
+	// to the clients, in seconds.  Unlike CacheMinTTL and CacheMaxTTL, they
+	// don't affect the cached responses, so e.g. the roaming clients may be
+	// told to re-query sooner while the cache still honors the upstreams'
+	// TTLs.  0 means no limit.
+	ClientMinTTL uint32
+	ClientMaxTTL uint32
+
+	// SplitHorizon are the rules replacing the public addresses of the
+	// services behind the NAT in the responses to the internal clients with
+	// the internal ones.  Like ClientMinTTL and ClientMaxTTL, they don't
+	// affect the cached responses.
+	SplitHorizon []SplitHorizonRule
+
+	// GeoIP is the database with the locations of the IP addresses used by
+	// GeoIPRules
+	GeoIP *GeoIP
+
+	// GeoIPRules sort the A and AAAA answers for the domains by the
+	// distance between the addresses and the client, so that e.g. the CDNs
+	// returning a lot of addresses don't give the clients the far away ones
+	// first.  Like SplitHorizon, they don't affect the cached responses.
+	GeoIPRules []GeoIPRule
+
+	// UpdateForward is the settings of forwarding the UPDATE and NOTIFY
+	// messages to an authoritative server.  If nil, they're handled as
+	// ordinary queries.  ListenerConfig.UpdateForward allows forwarding them
+	// from the designated listeners only.  The messages are signed with the
+	// proxy's key for any client, so signing them requires ACL.
+	UpdateForward *UpdateForward
+
+	// UpstreamTSIG are the TSIG keys the queries for the zones to the plain
+	// DNS upstreams are signed with
+	UpstreamTSIG []UpstreamTSIG
+
 	// Handlers (for the case when dnsproxy is used as a library)
 	// --
 
 	BeforeRequestHandler BeforeRequestHandler // callback that is called before each request
 	RequestHandler       RequestHandler       // callback that can handle incoming DNS requests
 	ResponseHandler      ResponseHandler      // response callback
+	CachePolicy          CachePolicy          // callback that decides if the upstream responses are cached
 
 	// Other settings
 	// --
 
+	// MaxMessageSize is the max size of a request in bytes.  The larger
+	// DNS requests are answered with FORMERR and the DoH ones with 413.  0
+	// means no limit.
+	MaxMessageSize int
+
+	// ClientMessageSizeLimits are the max sizes of the requests from the
+	// clients within the subnets.  They're used instead of the ones of the
+	// listeners and MaxMessageSize, the first matching subnet wins.  A
+	// limit of 0 lifts the other limits for the subnet.
+	ClientMessageSizeLimits []ClientMessageSizeLimit
+
 	// MaxGoroutines is the maximum number of goroutines processing DNS
 	// requests.  Important for mobile users.
 	//
@@ -122,9 +476,179 @@ type Config struct {
 	// actually limit all goroutines.
 	MaxGoroutines int
 
+	// Backpressure makes the proxy refuse the TCP, TLS, and HTTPS requests
+	// instead of queueing them when all of MaxGoroutines are busy.  The DNS
+	// clients get REFUSED with the "Not Ready" Extended DNS Error and the DoH
+	// ones get 503 with Retry-After, so that they fail over to another server
+	// quickly.  Requires MaxGoroutines.
+	Backpressure bool
+
+	// UDPMaxGoroutines is the maximum number of goroutines processing the
+	// UDP requests.  If it's not set, they're limited by MaxGoroutines
+	// together with the other requests.
+	UDPMaxGoroutines int
+
+	// UDPBackpressure is the way the UDP requests are handled when all the
+	// request goroutines are busy.  By default the read loop waits for a
+	// goroutine.  The other policies require MaxGoroutines or
+	// UDPMaxGoroutines.
+	UDPBackpressure UDPBackpressure
+
+	// UDPQueueSize is the max number of the UDP requests waiting for a
+	// goroutine with UDPBackpressureQueue, the default is 1000
+	UDPQueueSize int
+
 	// The size of the read buffer on the underlying socket. Larger read buffers can handle
 	// larger bursts of requests before packets get dropped.
 	UDPBufferSize int
+
+	// UDPWorkers is the max number of the long-lived goroutines processing
+	// the requests of each UDP listener.  If all of them are busy, a new
+	// goroutine is spawned for the request.  0 means 256.
+	UDPWorkers int
+
+	// UDPSocketsPerAddr is the number of the UDP sockets opened for each UDP
+	// listen address with SO_REUSEPORT, so that the kernel distributes the
+	// packets between their independent read loops.  Only supported on
+	// Linux.  0 and 1 mean a single socket without SO_REUSEPORT.
+	UDPSocketsPerAddr int
+}
+
+// ConfigErrors are all the problems of the configuration found by
+// Config.Validate
+type ConfigErrors []error
+
+// Error implements the error interface for ConfigErrors
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+
+	return "invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks the configuration and returns ConfigErrors with all the
+// problems found or nil if it's valid
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+
+	errs = append(errs, c.validateListenAddrs()...)
+
+	if c.UpstreamConfig == nil {
+		errs = append(errs, errors.New("no default upstreams specified"))
+	} else if len(c.UpstreamConfig.Upstreams) == 0 {
+		if len(c.UpstreamConfig.DomainReservedUpstreams) == 0 {
+			errs = append(errs, errors.New("no upstreams specified"))
+		} else {
+			errs = append(errs, errors.New("no default upstreams specified"))
+		}
+	}
+
+	if c.PrivacyMode && c.EnableEDNSClientSubnet {
+		errs = append(errs, errors.New("privacy mode can't be used with EDNS Client Subnet"))
+	}
+
+	if c.PrivacyMode && c.ForwardClientInfo {
+		errs = append(errs, errors.New("privacy mode can't be used with forwarding the client info"))
+	}
+
+	if c.CookiesRequired && !c.Cookies {
+		errs = append(errs, errors.New("cookies can't be required if they're disabled"))
+	}
+
+	if c.MaxMessageSize < 0 {
+		errs = append(errs, errors.New("max message size can't be negative"))
+	}
+
+	if c.Backpressure && c.MaxGoroutines <= 0 {
+		errs = append(errs, errors.New("backpressure requires the max number of goroutines"))
+	}
+
+	if c.UDPBackpressure != UDPBackpressureBlock && c.MaxGoroutines <= 0 && c.UDPMaxGoroutines <= 0 {
+		errs = append(errs, errors.New("UDP backpressure requires the max number of goroutines"))
+	}
+
+	if c.UDPQueueSize < 0 {
+		errs = append(errs, errors.New("UDP queue size can't be negative"))
+	}
+
+	if c.ProxyProtocol && len(c.TrustedProxies) == 0 {
+		errs = append(errs, errors.New("PROXY protocol requires the trusted proxies"))
+	}
+
+	for _, r := range c.SplitHorizon {
+		if r.Public == nil || r.Internal == nil || (r.Public.To4() == nil) != (r.Internal.To4() == nil) {
+			errs = append(errs, errors.New("split horizon rule requires the public and the internal addresses of the same family"))
+		}
+	}
+
+	if len(c.GeoIPRules) > 0 && c.GeoIP == nil {
+		errs = append(errs, errors.New("GeoIP rules require the GeoIP database"))
+	}
+
+	if c.UpdateForward != nil {
+		if err := c.UpdateForward.validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if c.UpdateForward.TSIG != nil && c.ACL == nil {
+			errs = append(errs, errors.New("signing the forwarded updates requires ACL"))
+		}
+	}
+
+	for i := range c.UpstreamTSIG {
+		if err := c.UpstreamTSIG[i].validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, lc := range c.Listeners {
+		if lc.UpdateForward != nil {
+			if err := lc.UpdateForward.validate(); err != nil {
+				errs = append(errs, err)
+			}
+			if lc.UpdateForward.TSIG != nil && lc.ACL == nil && c.ACL == nil {
+				errs = append(errs, errors.New("signing the forwarded updates requires ACL"))
+			}
+		}
+	}
+
+	if c.UpstreamProbeRate > 1 {
+		errs = append(errs, errors.New("upstream probe rate can't be greater than 1"))
+	}
+
+	if c.UDPSocketsPerAddr > 1 && c.ListenPacket != nil {
+		errs = append(errs, errors.New("multiple UDP sockets per address can't be used with ListenPacket"))
+	}
+
+	if (c.TLSCertPath == "") != (c.TLSKeyPath == "") {
+		errs = append(errs, errors.New("TLS certificate reload requires both the certificate and the key files"))
+	} else if c.TLSCertPath != "" {
+		if c.TLSConfig == nil {
+			errs = append(errs, errors.New("TLS certificate reload requires TLS config"))
+		} else if c.TLSConfig.GetConfigForClient != nil {
+			errs = append(errs, errors.New("TLS certificate reload can't be used with GetConfigForClient in TLS config"))
+		}
+	}
+
+	if len(c.ACMEHosts) != 0 {
+		errs = append(errs, c.validateACME()...)
+	}
+
+	// The certificates loaded from the files are stapled by the reloader
+	if c.OCSPStapling && c.TLSCertPath == "" {
+		if c.TLSConfig == nil || len(c.TLSConfig.Certificates) == 0 {
+			errs = append(errs, errors.New("OCSP stapling requires the certificates in TLS config"))
+		} else if c.TLSConfig.GetConfigForClient != nil {
+			errs = append(errs, errors.New("OCSP stapling can't be used with GetConfigForClient in TLS config"))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
 }
 
 // validateConfig verifies that the supplied configuration is valid and returns an error if it's not
@@ -133,26 +657,31 @@ func (p *Proxy) validateConfig() error {
 		return errors.New("server has been already started")
 	}
 
-	err := p.validateListenAddrs()
+	err := p.Config.Validate()
 	if err != nil {
 		return err
 	}
 
-	if p.UpstreamConfig == nil {
-		return errors.New("no default upstreams specified")
-	}
-
-	if len(p.UpstreamConfig.Upstreams) == 0 {
-		if len(p.UpstreamConfig.DomainReservedUpstreams) == 0 {
-			return errors.New("no upstreams specified")
+	if p.PrivacyMode {
+		err = p.privacySelfTest()
+		if err != nil {
+			return err
 		}
-		return errors.New("no default upstreams specified")
+		log.Info("Privacy mode is enabled")
 	}
 
 	if p.CacheMinTTL > 0 || p.CacheMaxTTL > 0 {
 		log.Info("Cache TTL override is enabled. Min=%d, Max=%d", p.CacheMinTTL, p.CacheMaxTTL)
 	}
 
+	if p.ClientMinTTL > 0 || p.ClientMaxTTL > 0 {
+		log.Info("Client TTL override is enabled. Min=%d, Max=%d", p.ClientMinTTL, p.ClientMaxTTL)
+	}
+
+	for _, r := range p.SplitHorizon {
+		log.Info("Split horizon: %s is replaced with %s for the internal clients", r.Public, r.Internal)
+	}
+
 	if p.Ratelimit > 0 {
 		log.Info("Ratelimit is enabled and set to %d rps", p.Ratelimit)
 	}
@@ -161,48 +690,77 @@ func (p *Proxy) validateConfig() error {
 		log.Info("The server is configured to refuse ANY requests")
 	}
 
-	if len(p.BogusNXDomain) > 0 {
-		log.Info("%d bogus-nxdomain IP specified", len(p.BogusNXDomain))
+	if len(p.QTypePolicy) > 0 {
+		log.Info("Query type policy is set for %d query types", len(p.QTypePolicy))
+	}
+
+	if p.UpdateForward != nil {
+		log.Info("UPDATE and NOTIFY messages are forwarded to %s", p.UpdateForward.Server)
+	}
+
+	if len(p.BogusNXDomain) > 0 || len(p.BogusNXDomainNets) > 0 {
+		log.Info("%d bogus-nxdomain IP and %d subnets specified", len(p.BogusNXDomain), len(p.BogusNXDomainNets))
 	}
 
 	return nil
 }
 
-// validateListenAddrs -- checks if listen addrs are properly configured
-func (p *Proxy) validateListenAddrs() error {
-	if !p.hasListenAddrs() {
-		return errors.New("no listen address specified")
+// validateListenAddrs -- checks if listen addrs are properly configured and
+// returns all the problems found
+func (c *Config) validateListenAddrs() (errs []error) {
+	if !c.hasListenAddrs() {
+		errs = append(errs, errors.New("no listen address specified"))
 	}
 
-	if p.TLSListenAddr != nil && p.TLSConfig == nil {
-		return errors.New("cannot create a TLS listener without TLS config")
+	hasTLS := c.TLSListenAddr != nil || c.TLSListeners != nil
+	hasHTTPS := c.HTTPSListenAddr != nil || c.HTTPSListeners != nil
+	for _, lc := range c.Listeners {
+		hasTLS = hasTLS || lc.TLSListenAddr != nil
+		hasHTTPS = hasHTTPS || lc.HTTPSListenAddr != nil
 	}
 
-	if p.HTTPSListenAddr != nil && p.TLSConfig == nil {
-		return errors.New("cannot create an HTTPS listener without TLS config")
+	if hasTLS && c.TLSConfig == nil {
+		errs = append(errs, errors.New("cannot create a TLS listener without TLS config"))
 	}
 
-	if p.QUICListenAddr != nil && p.TLSConfig == nil {
-		return errors.New("cannot create a QUIC listener without TLS config")
+	if hasHTTPS && c.TLSConfig == nil {
+		errs = append(errs, errors.New("cannot create an HTTPS listener without TLS config"))
 	}
 
-	if (p.DNSCryptTCPListenAddr != nil || p.DNSCryptUDPListenAddr != nil) &&
-		(p.DNSCryptResolverCert == nil || p.DNSCryptProviderName == "") {
-		return errors.New("cannot create a DNSCrypt listener without DNSCrypt config")
+	if (c.QUICListenAddr != nil || c.QUICListeners != nil) && c.TLSConfig == nil {
+		errs = append(errs, errors.New("cannot create a QUIC listener without TLS config"))
 	}
 
-	return nil
+	if (c.DNSCryptTCPListenAddr != nil || c.DNSCryptUDPListenAddr != nil) &&
+		(c.DNSCryptResolverCert == nil || c.DNSCryptProviderName == "") {
+		errs = append(errs, errors.New("cannot create a DNSCrypt listener without DNSCrypt config"))
+	}
+
+	return errs
 }
 
 // hasListenAddrs - is there any addresses to listen to?
-func (p *Proxy) hasListenAddrs() bool {
-	if p.UDPListenAddr == nil &&
-		p.TCPListenAddr == nil &&
-		p.TLSListenAddr == nil &&
-		p.HTTPSListenAddr == nil &&
-		p.QUICListenAddr == nil &&
-		p.DNSCryptUDPListenAddr == nil &&
-		p.DNSCryptTCPListenAddr == nil {
+func (c *Config) hasListenAddrs() bool {
+	if c.UDPListenAddr == nil &&
+		c.TCPListenAddr == nil &&
+		c.TLSListenAddr == nil &&
+		c.HTTPSListenAddr == nil &&
+		c.QUICListenAddr == nil &&
+		c.DNSCryptUDPListenAddr == nil &&
+		c.DNSCryptTCPListenAddr == nil &&
+		c.UnixListenAddr == nil &&
+		c.UnixgramListenAddr == nil &&
+		c.UDPListeners == nil &&
+		c.TCPListeners == nil &&
+		c.TLSListeners == nil &&
+		c.HTTPSListeners == nil &&
+		c.QUICListeners == nil {
+		for _, lc := range c.Listeners {
+			if lc.hasListenAddrs() {
+				return true
+			}
+		}
+
 		return false
 	}
 
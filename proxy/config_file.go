@@ -0,0 +1,326 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/joomcode/errorx"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultFileTimeout is the upstream timeout if FileConfig.Timeout isn't set
+const defaultFileTimeout = 10 * time.Second
+
+// FileConfig is the YAML configuration file of the proxy, see LoadConfig.  It
+// covers the most common settings, the rest of Config can be set on the
+// result.  For example:
+//
+//	upstreams:
+//	  - https://dns.adguard.com/dns-query
+//	  - "[/internal.example.com/]10.0.0.2"
+//	bootstrap: [8.8.8.8]
+//	timeout: 5s
+//	listen:
+//	  udp: ["0.0.0.0:53"]
+//	  tcp: ["0.0.0.0:53"]
+//	cache:
+//	  enabled: true
+//	  min_ttl: 60
+//	acl:
+//	  allow: [192.168.0.0/16]
+type FileConfig struct {
+	// Upstreams are the upstreams in the ParseUpstreamsConfig syntax
+	Upstreams []string `yaml:"upstreams"`
+	// Fallbacks are the fallback upstreams
+	Fallbacks []string `yaml:"fallbacks"`
+	// Bootstrap are the resolvers of the upstreams' hostnames
+	Bootstrap []string `yaml:"bootstrap"`
+	// Timeout is the upstream timeout, 10s by default
+	Timeout time.Duration `yaml:"timeout"`
+	// UpstreamMode is one of "load_balance", the default, "parallel", and
+	// "fastest_addr"
+	UpstreamMode string `yaml:"upstream_mode"`
+
+	// Listen are the listen addresses of the Config
+	Listen FileListenAddrs `yaml:"listen"`
+	// TLS is the certificate of the TLS, HTTPS, and QUIC listeners
+	TLS FileTLS `yaml:"tls"`
+	// Listeners are the groups of the listeners with their own settings,
+	// see ListenerConfig
+	Listeners []FileListener `yaml:"listeners"`
+
+	Cache FileCache `yaml:"cache"`
+
+	ClientMinTTL uint32 `yaml:"client_min_ttl"`
+	ClientMaxTTL uint32 `yaml:"client_max_ttl"`
+
+	Ratelimit int     `yaml:"ratelimit"`
+	RefuseAny bool    `yaml:"refuse_any"`
+	ACL       FileACL `yaml:"acl"`
+}
+
+// FileListenAddrs are the listen addresses in the host:port form
+type FileListenAddrs struct {
+	UDP   []string `yaml:"udp"`
+	TCP   []string `yaml:"tcp"`
+	TLS   []string `yaml:"tls"`
+	HTTPS []string `yaml:"https"`
+	QUIC  []string `yaml:"quic"`
+}
+
+// FileTLS is the paths of the PEM-encoded certificate chain and private key,
+// they're reloaded when changed, see Config.TLSCertPath
+type FileTLS struct {
+	Certificate string `yaml:"certificate"`
+	PrivateKey  string `yaml:"private_key"`
+}
+
+// FileListener is a group of the listeners with its own settings, the ones
+// that aren't set are taken from FileConfig
+type FileListener struct {
+	Listen       FileListenAddrs `yaml:"listen"`
+	Upstreams    []string        `yaml:"upstreams"`
+	Ratelimit    int             `yaml:"ratelimit"`
+	ACL          FileACL         `yaml:"acl"`
+	ClientMinTTL uint32          `yaml:"client_min_ttl"`
+	ClientMaxTTL uint32          `yaml:"client_max_ttl"`
+}
+
+// FileCache is the cache settings
+type FileCache struct {
+	Enabled    bool   `yaml:"enabled"`
+	Size       int    `yaml:"size"`
+	MinTTL     uint32 `yaml:"min_ttl"`
+	MaxTTL     uint32 `yaml:"max_ttl"`
+	RoundRobin bool   `yaml:"round_robin"`
+}
+
+// FileACL is the allowed and the denied client subnets, see ParseACL
+type FileACL struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// upstreamModes are the names of the upstream modes in FileConfig
+var upstreamModes = map[string]UpstreamModeType{
+	"":             UModeLoadBalance,
+	"load_balance": UModeLoadBalance,
+	"parallel":     UModeParallel,
+	"fastest_addr": UModeFastestAddr,
+}
+
+// LoadConfig reads the YAML configuration file, see FileConfig, and returns
+// the validated Config.  All the problems found are returned at once as
+// ConfigErrors.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't read config file")
+	}
+
+	return ParseConfig(data)
+}
+
+// ParseConfig parses the YAML configuration, see LoadConfig
+func ParseConfig(data []byte) (*Config, error) {
+	fc := &FileConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(fc)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't parse config file")
+	}
+
+	return fc.Config()
+}
+
+// Config returns the validated Config with the settings from the file
+func (fc *FileConfig) Config() (*Config, error) {
+	var errs ConfigErrors
+	c := &Config{
+		ClientMinTTL:    fc.ClientMinTTL,
+		ClientMaxTTL:    fc.ClientMaxTTL,
+		CacheEnabled:    fc.Cache.Enabled,
+		CacheSizeBytes:  fc.Cache.Size,
+		CacheMinTTL:     fc.Cache.MinTTL,
+		CacheMaxTTL:     fc.Cache.MaxTTL,
+		CacheRoundRobin: fc.Cache.RoundRobin,
+		Ratelimit:       fc.Ratelimit,
+		RefuseAny:       fc.RefuseAny,
+	}
+
+	timeout := fc.Timeout
+	if timeout == 0 {
+		timeout = defaultFileTimeout
+	}
+	opts := upstream.Options{Bootstrap: fc.Bootstrap, Timeout: timeout}
+
+	if len(fc.Upstreams) > 0 {
+		uc, err := ParseUpstreamsConfigWithOptions(fc.Upstreams, opts, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("upstreams: %w", err))
+		} else {
+			c.UpstreamConfig = &uc
+		}
+	}
+
+	for _, addr := range fc.Fallbacks {
+		u, err := upstream.AddressToUpstream(addr, opts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("fallback %s: %w", addr, err))
+			continue
+		}
+		c.Fallbacks = append(c.Fallbacks, u)
+	}
+
+	mode, ok := upstreamModes[fc.UpstreamMode]
+	if !ok {
+		errs = append(errs, fmt.Errorf("unknown upstream mode %q", fc.UpstreamMode))
+	}
+	c.UpstreamMode = mode
+
+	errs = fc.Listen.apply(&c.UDPListenAddr, &c.TCPListenAddr, &c.TLSListenAddr, &c.HTTPSListenAddr, errs)
+	errs = fileListenAddrs("quic", fc.Listen.QUIC, &c.QUICListenAddr, errs)
+
+	if fc.TLS.Certificate != "" || fc.TLS.PrivateKey != "" {
+		cert, err := tls.LoadX509KeyPair(fc.TLS.Certificate, fc.TLS.PrivateKey)
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't load TLS certificate"))
+		} else {
+			c.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			c.TLSCertPath, c.TLSKeyPath = fc.TLS.Certificate, fc.TLS.PrivateKey
+		}
+	}
+
+	c.ACL, errs = fc.ACL.parse(errs)
+
+	for i, fl := range fc.Listeners {
+		lc, lerrs := fl.config(opts)
+		for _, err := range lerrs {
+			errs = append(errs, fmt.Errorf("listener group %d: %w", i, err))
+		}
+		c.Listeners = append(c.Listeners, lc)
+	}
+
+	if err, ok := c.Validate().(ConfigErrors); ok {
+		errs = append(errs, err...)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return c, nil
+}
+
+// config returns the listener group, errs are the problems found
+func (fl *FileListener) config(opts upstream.Options) (lc *ListenerConfig, errs []error) {
+	lc = &ListenerConfig{
+		Ratelimit:    fl.Ratelimit,
+		ClientMinTTL: fl.ClientMinTTL,
+		ClientMaxTTL: fl.ClientMaxTTL,
+	}
+
+	errs = fl.Listen.apply(&lc.UDPListenAddr, &lc.TCPListenAddr, &lc.TLSListenAddr, &lc.HTTPSListenAddr, errs)
+	if len(fl.Listen.QUIC) > 0 {
+		errs = append(errs, errors.New("QUIC listeners can't be in a group"))
+	}
+	if !lc.hasListenAddrs() {
+		errs = append(errs, errors.New("no listen address specified"))
+	}
+
+	if len(fl.Upstreams) > 0 {
+		uc, err := ParseUpstreamsConfigWithOptions(fl.Upstreams, opts, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("upstreams: %w", err))
+		} else {
+			lc.UpstreamConfig = &uc
+		}
+	}
+
+	lc.ACL, errs = fl.ACL.parse(errs)
+
+	return lc, errs
+}
+
+// apply parses the UDP, TCP, TLS, and HTTPS listen addresses
+func (a *FileListenAddrs) apply(udp *[]*net.UDPAddr, tcp, tlsAddrs, https *[]*net.TCPAddr, errs []error) []error {
+	errs = fileListenAddrs("udp", a.UDP, udp, errs)
+	errs = fileTCPListenAddrs("tcp", a.TCP, tcp, errs)
+	errs = fileTCPListenAddrs("tls", a.TLS, tlsAddrs, errs)
+	errs = fileTCPListenAddrs("https", a.HTTPS, https, errs)
+
+	return errs
+}
+
+// parse returns the ACL or nil if there are no subnets
+func (a *FileACL) parse(errs []error) (*ACL, []error) {
+	if len(a.Allow) == 0 && len(a.Deny) == 0 {
+		return nil, errs
+	}
+
+	acl, err := ParseACL(a.Allow, a.Deny)
+	if err != nil {
+		return nil, append(errs, fmt.Errorf("acl: %w", err))
+	}
+
+	return acl, errs
+}
+
+// fileListenAddrs parses the UDP listen addresses
+func fileListenAddrs(proto string, addrs []string, res *[]*net.UDPAddr, errs []error) []error {
+	for _, s := range addrs {
+		ip, port, err := parseListenAddr(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s listen address: %w", proto, err))
+			continue
+		}
+		*res = append(*res, &net.UDPAddr{IP: ip, Port: port})
+	}
+
+	return errs
+}
+
+// fileTCPListenAddrs parses the TCP listen addresses
+func fileTCPListenAddrs(proto string, addrs []string, res *[]*net.TCPAddr, errs []error) []error {
+	for _, s := range addrs {
+		ip, port, err := parseListenAddr(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s listen address: %w", proto, err))
+			continue
+		}
+		*res = append(*res, &net.TCPAddr{IP: ip, Port: port})
+	}
+
+	return errs
+}
+
+// parseListenAddr parses the ip:port listen address, the IP address may be
+// omitted to listen on all the interfaces
+func parseListenAddr(s string) (ip net.IP, port int, err error) {
+	host, p, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if host != "" {
+		ip = net.ParseIP(host)
+		if ip == nil {
+			return nil, 0, fmt.Errorf("invalid IP address in %q", s)
+		}
+	}
+
+	port, err = strconv.Atoi(p)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, 0, fmt.Errorf("invalid port in %q", s)
+	}
+
+	return ip, port, nil
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig([]byte(`
+upstreams:
+  - 8.8.8.8
+  - "[/internal.example.com/]10.0.0.2"
+fallbacks: [1.1.1.1]
+timeout: 5s
+upstream_mode: parallel
+listen:
+  udp: ["127.0.0.1:5353"]
+  tcp: [":5353"]
+cache:
+  enabled: true
+  size: 4096
+  min_ttl: 60
+  round_robin: true
+client_max_ttl: 3600
+ratelimit: 20
+acl:
+  allow: [192.168.0.0/16]
+listeners:
+  - listen:
+      udp: ["[::1]:5353"]
+    ratelimit: -1
+    upstreams: [192.168.1.1]
+    acl:
+      deny: [192.168.1.0/24]
+`))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Len(t, c.UpstreamConfig.Upstreams, 1)
+	assert.Len(t, c.UpstreamConfig.DomainReservedUpstreams, 1)
+	assert.Equal(t, "1.1.1.1:53", c.Fallbacks[0].Address())
+	assert.Equal(t, UModeParallel, c.UpstreamMode)
+	if assert.Len(t, c.UDPListenAddr, 1) && assert.Len(t, c.TCPListenAddr, 1) {
+		assert.Equal(t, "127.0.0.1:5353", c.UDPListenAddr[0].String())
+		assert.Equal(t, ":5353", c.TCPListenAddr[0].String())
+	}
+	assert.True(t, c.CacheEnabled)
+	assert.Equal(t, 4096, c.CacheSizeBytes)
+	assert.Equal(t, uint32(60), c.CacheMinTTL)
+	assert.True(t, c.CacheRoundRobin)
+	assert.Equal(t, uint32(3600), c.ClientMaxTTL)
+	assert.Equal(t, 20, c.Ratelimit)
+	assert.False(t, c.ACL.IsAllowed(net.IP{10, 0, 0, 1}))
+
+	if assert.Len(t, c.Listeners, 1) {
+		lc := c.Listeners[0]
+		assert.Equal(t, "[::1]:5353", lc.UDPListenAddr[0].String())
+		assert.Equal(t, -1, lc.Ratelimit)
+		assert.Equal(t, "192.168.1.1:53", lc.UpstreamConfig.Upstreams[0].Address())
+		assert.False(t, lc.ACL.IsAllowed(net.IP{192, 168, 1, 1}))
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	// All the problems are reported at once
+	_, err := ParseConfig([]byte(`
+upstreams: ["[/example.com/]8.8.8.8"]
+upstream_mode: random
+listen:
+  udp: ["localhost:53", ":port"]
+  tls: ["127.0.0.1:853"]
+acl:
+  allow: [invalid]
+listeners:
+  - ratelimit: 1
+`))
+	errs, ok := err.(ConfigErrors)
+	if assert.True(t, ok, err) {
+		// The mode, the two addresses, the ACL, the listener group without
+		// addresses, the TLS listener without a certificate, and no default
+		// upstreams
+		assert.Len(t, errs, 7, err)
+	}
+
+	// The typos aren't ignored
+	_, err = ParseConfig([]byte("upstream: [8.8.8.8]\n"))
+	assert.NotNil(t, err)
+
+	_, err = ParseConfig([]byte("timeout: 5 seconds\n"))
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = LoadConfig(filepath.Join(dir, "none.yaml"))
+	assert.NotNil(t, err)
+
+	path := filepath.Join(dir, "dnsproxy.yaml")
+	data := "upstreams: [8.8.8.8]\ntimeout: 2s\nlisten:\n  udp: [\"127.0.0.1:0\"]\n"
+	assert.Nil(t, ioutil.WriteFile(path, []byte(data), 0o644))
+
+	c, err := LoadConfig(path)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "8.8.8.8:53", c.UpstreamConfig.Upstreams[0].Address())
+	}
+
+	// The loaded configuration is enough to start the proxy
+	p := &Proxy{Config: *c}
+	assert.Nil(t, p.Start())
+	assert.Nil(t, p.Stop())
+}
+
+func TestConfigValidate(t *testing.T) {
+	c := &Config{
+		MaxMessageSize:    -1,
+		UpstreamProbeRate: 2,
+		CookiesRequired:   true,
+	}
+	errs, ok := c.Validate().(ConfigErrors)
+	if assert.True(t, ok) {
+		assert.Len(t, errs, 5)
+		assert.Contains(t, errs.Error(), "no listen address specified")
+	}
+
+	u, err := upstream.AddressToUpstream("8.8.8.8", upstream.Options{})
+	assert.Nil(t, err)
+
+	// All the problems of the listeners are reported
+	c = &Config{
+		TLSListenAddr:         []*net.TCPAddr{{}},
+		QUICListenAddr:        []*net.UDPAddr{{}},
+		DNSCryptUDPListenAddr: []*net.UDPAddr{{}},
+		Listeners:             []*ListenerConfig{{TLSListenAddr: []*net.TCPAddr{{}}}},
+		UpstreamConfig:        &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+	}
+	errs, ok = c.Validate().(ConfigErrors)
+	if assert.True(t, ok) {
+		assert.Len(t, errs, 3)
+	}
+
+	c = &Config{
+		UDPListenAddr:  []*net.UDPAddr{{}},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+	}
+	assert.Nil(t, c.Validate())
+}
@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// DNS cookies (RFC 7873).  The server cookies have the layout described in
+// RFC 9018, but their hash is the truncated HMAC-SHA256 instead of
+// SipHash-2-4, so they're only interoperable between the dnsproxy instances
+// sharing the secret.
+const (
+	clientCookieLen     = 8
+	serverCookieLen     = 16
+	minServerCookieLen  = 8
+	maxServerCookieLen  = 32
+	serverCookieVersion = 1
+
+	// cookieLifetime is the time a server cookie is valid for
+	cookieLifetime = time.Hour
+	// cookieMaxSkew is the max time a server cookie may be from the future,
+	// e.g. if it has been generated by another instance with a different
+	// clock
+	cookieMaxSkew = 5 * time.Minute
+	// minCookieSecretLen is the min length of Config.CookieSecret
+	minCookieSecretLen = 16
+)
+
+// cookies generates and validates the server cookies of the proxy and keeps
+// the server cookies of the upstreams
+type cookies struct {
+	secret []byte
+	now    func() time.Time
+
+	// upstreamCookies are the last server cookies of the upstreams by their
+	// addresses
+	upstreamCookies     map[string][]byte
+	upstreamCookiesLock sync.Mutex
+}
+
+// newCookies creates a new cookies instance.  If secret is empty, a random
+// one is generated.
+func newCookies(secret []byte) (*cookies, error) {
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return nil, fmt.Errorf("generating cookie secret: %w", err)
+		}
+	} else if len(secret) < minCookieSecretLen {
+		return nil, fmt.Errorf("cookie secret must be at least %d bytes", minCookieSecretLen)
+	}
+
+	return &cookies{
+		secret:          secret,
+		now:             time.Now,
+		upstreamCookies: map[string][]byte{},
+	}, nil
+}
+
+// hash returns the truncated HMAC of the data
+func (c *cookies) hash(data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	for _, d := range data {
+		_, _ = mac.Write(d)
+	}
+
+	return mac.Sum(nil)[:8]
+}
+
+// serverCookie returns the server cookie for the client cookie and the IP
+// address of the client generated at the time ts
+func (c *cookies) serverCookie(client []byte, ip net.IP, ts uint32) []byte {
+	cookie := make([]byte, serverCookieLen)
+	cookie[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(cookie[4:], ts)
+	copy(cookie[8:], c.hash(client, cookie[:8], ip))
+
+	return cookie
+}
+
+// newServerCookie returns the server cookie for the client cookie and the IP
+// address of the client generated now
+func (c *cookies) newServerCookie(client []byte, ip net.IP) []byte {
+	return c.serverCookie(client, ip, uint32(c.now().Unix()))
+}
+
+// isValid returns true if the server cookie has been generated by the proxy
+// for the client cookie and the IP address of the client and hasn't expired
+func (c *cookies) isValid(client, server []byte, ip net.IP) bool {
+	if len(server) != serverCookieLen || server[0] != serverCookieVersion {
+		return false
+	}
+
+	// The serial number arithmetic, as the timestamp wraps around
+	ts := binary.BigEndian.Uint32(server[4:])
+	age := time.Duration(int32(uint32(c.now().Unix())-ts)) * time.Second
+	if age > cookieLifetime || age < -cookieMaxSkew {
+		return false
+	}
+
+	return hmac.Equal(server, c.serverCookie(client, ip, ts))
+}
+
+// clientCookie returns the client cookie the proxy sends to the upstream
+func (c *cookies) clientCookie(addr string) []byte {
+	return c.hash([]byte("client"), []byte(addr))
+}
+
+// withUpstreamCookie returns the copy of the request with the client cookie
+// of the proxy and the last server cookie of the upstream
+func (c *cookies) withUpstreamCookie(addr string, req *dns.Msg) *dns.Msg {
+	cookie := c.clientCookie(addr)
+	c.upstreamCookiesLock.Lock()
+	cookie = append(cookie, c.upstreamCookies[addr]...)
+	c.upstreamCookiesLock.Unlock()
+
+	req = req.Copy()
+	removeCookie(req)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(cookie),
+	})
+
+	return req
+}
+
+// errCookieMismatch is returned when the upstream's response carries a client
+// cookie other than the proxy's one, i.e. it's probably spoofed
+var errCookieMismatch = errors.New("client cookie mismatch")
+
+// processUpstreamCookie removes the cookie from the upstream's reply and
+// remembers its server cookie
+func (c *cookies) processUpstreamCookie(addr string, reply *dns.Msg) error {
+	cookie, ok := removeCookie(reply)
+	if !ok {
+		return nil
+	}
+
+	client, server, ok := parseCookie(cookie)
+	if !ok || !hmac.Equal(client, c.clientCookie(addr)) {
+		return fmt.Errorf("%s: %w", addr, errCookieMismatch)
+	}
+
+	if server != nil {
+		c.upstreamCookiesLock.Lock()
+		c.upstreamCookies[addr] = server
+		c.upstreamCookiesLock.Unlock()
+	}
+
+	return nil
+}
+
+// parseCookie splits the cookie into the client and the server ones.  server
+// is nil if there is only a client cookie.  ok is false if the cookie is
+// malformed.
+func parseCookie(cookie []byte) (client, server []byte, ok bool) {
+	switch n := len(cookie); {
+	case n == clientCookieLen:
+		return cookie, nil, true
+	case n >= clientCookieLen+minServerCookieLen && n <= clientCookieLen+maxServerCookieLen:
+		return cookie[:clientCookieLen], cookie[clientCookieLen:], true
+	default:
+		return nil, nil, false
+	}
+}
+
+// removeCookie removes the cookie options from the message and returns the
+// data of the last of them.  found is false if there are none.  A cookie
+// that isn't valid hex is returned empty, so that it's malformed.
+func removeCookie(m *dns.Msg) (cookie []byte, found bool) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil, false
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			cookie, _ = hex.DecodeString(c.Cookie)
+			found = true
+			continue
+		}
+		options = append(options, o)
+	}
+	opt.Option = options
+
+	return cookie, found
+}
+
+// isPlainUpstream returns true if the upstream is a plain DNS one, the only
+// kind the cookies make sense for
+func isPlainUpstream(u upstream.Upstream) bool {
+	addr := u.Address()
+	return !strings.Contains(addr, "://") || strings.HasPrefix(addr, "tcp://")
+}
+
+// processCookie removes the cookie from the request, validates its server
+// cookie, and remembers its client cookie, so that the response gets a new
+// server cookie.  It returns false if the request has been answered with
+// FORMERR because the cookie is malformed or with BADCOOKIE because
+// Config.CookiesRequired is set and the server cookie isn't valid.
+func (p *Proxy) processCookie(d *DNSContext) bool {
+	if p.cookies == nil {
+		return true
+	}
+
+	cookie, found := removeCookie(d.Req)
+	if !found {
+		return true
+	}
+
+	client, server, ok := parseCookie(cookie)
+	if !ok {
+		log.Debug("Malformed cookie from %s", d.Addr)
+		d.Res = &dns.Msg{}
+		d.Res.SetRcode(d.Req, dns.RcodeFormatError)
+		d.ResponseClass = ResponseClassError
+		p.respond(d)
+		return false
+	}
+
+	d.clientCookie = client
+	ip, _ := addrIPPort(d.Addr)
+	d.CookieValid = server != nil && p.cookies.isValid(client, server, ip)
+	if d.CookieValid || !p.CookiesRequired || d.Proto != ProtoUDP {
+		return true
+	}
+
+	log.Debug("Answering BADCOOKIE to %s", d.Addr)
+	d.Res = &dns.Msg{}
+	d.Res.SetRcode(d.Req, dns.RcodeBadCookie)
+	d.ResponseClass = ResponseClassBlocked
+	p.respond(d)
+	return false
+}
+
+// setCookie adds a new server cookie to the response if the request has
+// carried a client cookie
+func (p *Proxy) setCookie(d *DNSContext) {
+	if d.clientCookie == nil {
+		return
+	}
+
+	ip, _ := addrIPPort(d.Addr)
+	cookie := append(append([]byte{}, d.clientCookie...), p.cookies.newServerCookie(d.clientCookie, ip)...)
+
+	res := d.writableRes()
+	removeCookie(res)
+	opt := res.IsEdns0()
+	if opt == nil {
+		size, do := uint16(dns.MinMsgSize), false
+		if reqOpt := d.Req.IsEdns0(); reqOpt != nil {
+			size, do = reqOpt.UDPSize(), reqOpt.Do()
+		}
+		res.SetEdns0(size, do)
+		opt = res.IsEdns0()
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(cookie),
+	})
+}
+
+// exchangeWithCookie is exchangeWithTimeout that, if the cookies are enabled,
+// sends the client cookie of the proxy and the last server cookie of the
+// upstream with the request and retries it once if the upstream answers with
+// BADCOOKIE.  The request is signed if there is Config.UpstreamTSIG for it.
+func (p *Proxy) exchangeWithCookie(u upstream.Upstream, req *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	u = p.withUpstreamTSIG(u, req)
+	if p.cookies == nil || p.PrivacyMode || req.IsEdns0() == nil || !isPlainUpstream(u) {
+		return p.exchangeWithTimeout(u, req, timeout)
+	}
+
+	addr := u.Address()
+	for attempt := 0; ; attempt++ {
+		reply, err := p.exchangeWithTimeout(u, p.cookies.withUpstreamCookie(addr, req), timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.cookies.processUpstreamCookie(addr, reply)
+		if err != nil {
+			return nil, err
+		}
+
+		if reply.Rcode != dns.RcodeBadCookie {
+			return reply, nil
+		} else if attempt > 0 {
+			return nil, fmt.Errorf("%s: bad cookie", addr)
+		}
+
+		log.Debug("Retrying the request to %s with its new server cookie", addr)
+	}
+}
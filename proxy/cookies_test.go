@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerCookie(t *testing.T) {
+	_, err := newCookies([]byte("short"))
+	assert.NotNil(t, err)
+
+	c, err := newCookies([]byte("0123456789abcdef"))
+	assert.Nil(t, err)
+	now := time.Unix(1600000000, 0)
+	c.now = func() time.Time { return now }
+
+	client := []byte("client01")
+	ip := net.IP{192, 0, 2, 1}
+	server := c.newServerCookie(client, ip)
+	assert.Len(t, server, serverCookieLen)
+	assert.True(t, c.isValid(client, server, ip))
+
+	assert.False(t, c.isValid([]byte("client02"), server, ip))
+	assert.False(t, c.isValid(client, server, net.IP{192, 0, 2, 2}))
+	tampered := append([]byte{}, server...)
+	tampered[15] ^= 1
+	assert.False(t, c.isValid(client, tampered, ip))
+	assert.False(t, c.isValid(client, server[:8], ip))
+
+	// The other instances with the same secret accept it
+	other, err := newCookies([]byte("0123456789abcdef"))
+	assert.Nil(t, err)
+	other.now = c.now
+	assert.True(t, other.isValid(client, server, ip))
+
+	now = now.Add(cookieLifetime + time.Second)
+	assert.False(t, c.isValid(client, server, ip))
+
+	now = now.Add(-cookieLifetime - cookieMaxSkew - time.Minute)
+	assert.False(t, c.isValid(client, server, ip))
+}
+
+func TestParseCookie(t *testing.T) {
+	testCases := []struct {
+		n  int
+		ok bool
+	}{
+		{n: 0, ok: false},
+		{n: 7, ok: false},
+		{n: 8, ok: true},
+		{n: 15, ok: false},
+		{n: 16, ok: true},
+		{n: 24, ok: true},
+		{n: 40, ok: true},
+		{n: 41, ok: false},
+	}
+
+	for _, tc := range testCases {
+		client, server, ok := parseCookie(make([]byte, tc.n))
+		assert.Equal(t, tc.ok, ok, tc.n)
+		if ok {
+			assert.Len(t, client, clientCookieLen)
+			assert.Len(t, server, tc.n-clientCookieLen)
+		}
+	}
+}
+
+// newCookieRequest returns a request with the cookie
+func newCookieRequest(cookie []byte) *dns.Msg {
+	req := createTestMessage()
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	if cookie != nil {
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: hex.EncodeToString(cookie),
+		})
+	}
+
+	return req
+}
+
+// responseCookie returns the cookie of the response or nil if there is none
+func responseCookie(t *testing.T, res *dns.Msg) []byte {
+	cookie, found := removeCookie(res.Copy())
+	if !found {
+		return nil
+	}
+	assert.NotEmpty(t, cookie)
+
+	return cookie
+}
+
+func TestCookiesServer(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Cookies = true
+	dnsProxy.CookiesRequired = true
+
+	var mu sync.Mutex
+	var valid []bool
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		mu.Lock()
+		valid = append(valid, d.CookieValid)
+		mu.Unlock()
+
+		// The cookie isn't passed further
+		_, found := removeCookie(d.Req)
+		assert.False(t, found)
+
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	udp := &dns.Client{Net: "udp", Timeout: time.Second}
+	tcp := &dns.Client{Net: "tcp", Timeout: time.Second}
+	udpAddr := dnsProxy.Addr(ProtoUDP).String()
+	tcpAddr := dnsProxy.Addr(ProtoTCP).String()
+	client := []byte("client01")
+
+	// A client cookie only is answered with BADCOOKIE over UDP
+	res, _, err := udp.Exchange(newCookieRequest(client), udpAddr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeBadCookie, res.Rcode)
+	cookie := responseCookie(t, res)
+	assert.Len(t, cookie, clientCookieLen+serverCookieLen)
+	assert.Equal(t, client, cookie[:clientCookieLen])
+
+	// But is processed over TCP
+	res, _, err = tcp.Exchange(newCookieRequest(client), tcpAddr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Len(t, responseCookie(t, res), clientCookieLen+serverCookieLen)
+
+	// The retry with the server cookie is processed
+	res, _, err = udp.Exchange(newCookieRequest(cookie), udpAddr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Len(t, responseCookie(t, res), clientCookieLen+serverCookieLen)
+
+	// The request without cookies is processed and gets none
+	res, _, err = udp.Exchange(newCookieRequest(nil), udpAddr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Nil(t, responseCookie(t, res))
+
+	// The malformed cookie is answered with FORMERR
+	res, _, err = udp.Exchange(newCookieRequest([]byte("short")), udpAddr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeFormatError, res.Rcode)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []bool{false, true, false}, valid)
+}
+
+func TestCookiesQTypePolicy(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Cookies = true
+	dnsProxy.QTypePolicy = QTypePolicy{dns.TypeA: QTypeActionTCPOnly}
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	udp := &dns.Client{Net: "udp", Timeout: time.Second}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	res, _, err := udp.Exchange(newCookieRequest([]byte("client01")), addr)
+	assert.Nil(t, err)
+	assert.True(t, res.Truncated)
+
+	// The client with a valid cookie isn't forced to use TCP
+	res, _, err = udp.Exchange(newCookieRequest(responseCookie(t, res)), addr)
+	assert.Nil(t, err)
+	assert.False(t, res.Truncated)
+}
+
+// cookieUpstream is a plain DNS upstream that supports cookies
+type cookieUpstream struct {
+	server  []byte
+	spoofed bool
+
+	mu      sync.Mutex
+	cookies [][]byte // cookies of the requests
+}
+
+// Exchange implements the upstream.Upstream interface for *cookieUpstream
+func (u *cookieUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	cookie, _ := removeCookie(m.Copy())
+	u.mu.Lock()
+	u.cookies = append(u.cookies, cookie)
+	u.mu.Unlock()
+
+	client, server, _ := parseCookie(cookie)
+	res := genEmptyNoError(m)
+	res.SetEdns0(dns.DefaultMsgSize, false)
+	if server == nil {
+		res.Rcode = dns.RcodeBadCookie
+	}
+
+	if u.spoofed {
+		client = []byte("spoofed!")
+	}
+	res.IsEdns0().Option = append(res.IsEdns0().Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(append(append([]byte{}, client...), u.server...)),
+	})
+
+	return res, nil
+}
+
+// Address implements the upstream.Upstream interface for *cookieUpstream
+func (u *cookieUpstream) Address() string {
+	return "192.0.2.53:53"
+}
+
+func TestCookiesUpstream(t *testing.T) {
+	p := &Proxy{}
+	var err error
+	p.cookies, err = newCookies(nil)
+	assert.Nil(t, err)
+
+	u := &cookieUpstream{server: []byte("server01")}
+	req := newCookieRequest([]byte("client01"))
+	reply, err := p.exchangeWithCookie(u, req, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+
+	// The upstream's cookie isn't passed to the client
+	assert.Nil(t, responseCookie(t, reply))
+	// Nor is the client's one to the upstream
+	assert.Equal(t, []byte("client01"), responseCookie(t, req)[:clientCookieLen])
+
+	// The request has been retried with the server cookie after BADCOOKIE
+	client := p.cookies.clientCookie(u.Address())
+	assert.Equal(t, [][]byte{client, append(append([]byte{}, client...), u.server...)}, u.cookies)
+
+	// The server cookie is remembered
+	_, err = p.exchangeWithCookie(u, newCookieRequest(nil), 0)
+	assert.Nil(t, err)
+	assert.Len(t, u.cookies, 3)
+	assert.Equal(t, u.cookies[1], u.cookies[2])
+
+	// The responses with a wrong client cookie are discarded
+	u.spoofed = true
+	_, err = p.exchangeWithCookie(u, newCookieRequest(nil), 0)
+	assert.NotNil(t, err)
+
+	// The requests without EDNS get no cookies
+	u.spoofed = false
+	_, err = p.exchangeWithCookie(u, createTestMessage(), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, u.cookies[len(u.cookies)-1])
+}
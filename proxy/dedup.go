@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// inflightRequest is an upstream exchange that identical concurrent requests
+// wait for instead of sending their own
+type inflightRequest struct {
+	wg    sync.WaitGroup // done when the exchange is finished
+	reply *dns.Msg       // must not be modified, every request gets a copy
+	u     upstream.Upstream
+	err   error
+}
+
+// exchangeDeduplicated is like exchangeUpstreams, but if RequestDeduplication
+// is enabled and an identical request is already being exchanged, it waits
+// for that exchange and uses its result.  req is the request of d to send to
+// the upstreams.
+func (p *Proxy) exchangeDeduplicated(d *DNSContext, req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	if !p.RequestDeduplication || d.CustomUpstreamConfig != nil {
+		// The requests with custom upstreams may get different responses
+		return p.exchangeUpstreams(req, upstreams, d.CustomUpstreamConfig)
+	}
+
+	k := dedupKey(d)
+	if p.ForwardClientInfo {
+		// The upstream applies its policy to the forwarded client, so the
+		// requests of the different clients may get different responses
+		if info := packClientInfo(d.ClientProto(), d.ClientAddr()); info != nil {
+			k += string(info.Data)
+		}
+	}
+
+	p.inflightLock.Lock()
+	r, ok := p.inflight[k]
+	if ok {
+		p.inflightLock.Unlock()
+
+		log.Tracef("Waiting for the identical request to %s", d.Req.Question[0].Name)
+		r.wg.Wait()
+		return dedupReply(r.reply, d.Req), r.u, r.err
+	}
+
+	r = &inflightRequest{}
+	r.wg.Add(1)
+	if p.inflight == nil {
+		p.inflight = map[string]*inflightRequest{}
+	}
+	p.inflight[k] = r
+	p.inflightLock.Unlock()
+
+	r.reply, r.u, r.err = p.exchangeUpstreams(req, upstreams, d.CustomUpstreamConfig)
+
+	p.inflightLock.Lock()
+	delete(p.inflight, k)
+	p.inflightLock.Unlock()
+	r.wg.Done()
+
+	return dedupReply(r.reply, d.Req), r.u, r.err
+}
+
+// dedupKey returns the key of the request which is the same for the requests
+// that get the same response
+func dedupKey(d *DNSContext) string {
+	var k []byte
+	if d.ecsReqMask != 0 {
+		k = keyWithSubnet(d.Req, d.ecsReqIP, d.ecsReqMask)
+	} else {
+		k = key(d.Req)
+	}
+
+	if d.Req.CheckingDisabled {
+		k = append(k, 1)
+	} else {
+		k = append(k, 0)
+	}
+
+	return string(k)
+}
+
+// dedupReply returns a copy of the shared reply adjusted for the request
+func dedupReply(reply, req *dns.Msg) *dns.Msg {
+	if reply == nil {
+		return nil
+	}
+
+	res := reply.Copy()
+	res.Id = req.Id
+	// The name case may differ, e.g. because of the 0x20 encoding
+	res.Question = []dns.Question{req.Question[0]}
+
+	return res
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingUpstream answers the requests only after release is closed
+type blockingUpstream struct {
+	release  chan struct{}
+	requests int32
+}
+
+func (u *blockingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.requests, 1)
+	<-u.release
+
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, newRR(m.Question[0].Name+" 300 IN A 1.2.3.4"))
+	return resp, nil
+}
+
+func (u *blockingUpstream) Address() string {
+	return "blocking"
+}
+
+func TestRequestDeduplication(t *testing.T) {
+	testCases := []struct {
+		name     string
+		dedup    bool
+		requests int32
+	}{
+		{"enabled", true, 1},
+		{"disabled", false, 10},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &blockingUpstream{release: make(chan struct{})}
+			p := &Proxy{}
+			p.RequestDeduplication = tc.dedup
+			p.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{u}}
+
+			wg := sync.WaitGroup{}
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					d := &DNSContext{Req: createHostTestMessage("host")}
+					err := p.Resolve(d)
+					assert.Nil(t, err)
+					if assert.NotNil(t, d.Res) {
+						assert.Equal(t, d.Req.Id, d.Res.Id)
+						assert.Len(t, d.Res.Answer, 1)
+					}
+				}()
+			}
+
+			// Give all the requests the time to start
+			time.Sleep(100 * time.Millisecond)
+			close(u.release)
+			wg.Wait()
+
+			assert.Equal(t, tc.requests, atomic.LoadInt32(&u.requests))
+			assert.Empty(t, p.inflight)
+		})
+	}
+}
+
+func TestRequestDeduplicationClientInfo(t *testing.T) {
+	u := &blockingUpstream{release: make(chan struct{})}
+	p := &Proxy{}
+	p.RequestDeduplication = true
+	p.ForwardClientInfo = true
+	p.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{u}}
+
+	wg := sync.WaitGroup{}
+	for _, ip := range []net.IP{{203, 0, 113, 1}, {203, 0, 113, 2}} {
+		wg.Add(1)
+		go func(ip net.IP) {
+			defer wg.Done()
+
+			d := &DNSContext{
+				Proto: ProtoUDP,
+				Req:   createHostTestMessage("host"),
+				Addr:  &net.UDPAddr{IP: ip, Port: 40000},
+			}
+			assert.Nil(t, p.Resolve(d))
+		}(ip)
+	}
+
+	// Give all the requests the time to start
+	time.Sleep(100 * time.Millisecond)
+	close(u.release)
+	wg.Wait()
+
+	// Each client's request is sent with its own client info
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.requests))
+	assert.Empty(t, p.inflight)
+}
+
+func TestDedupKey(t *testing.T) {
+	d1 := &DNSContext{Req: createHostTestMessage("host")}
+	d2 := &DNSContext{Req: createHostTestMessage("HOST")}
+	assert.Equal(t, dedupKey(d1), dedupKey(d2))
+
+	d2.Req.CheckingDisabled = true
+	assert.NotEqual(t, dedupKey(d1), dedupKey(d2))
+
+	d2 = &DNSContext{Req: createHostTestMessage("host")}
+	d2.Req.SetEdns0(4096, true)
+	assert.NotEqual(t, dedupKey(d1), dedupKey(d2))
+}
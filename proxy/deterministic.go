@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// deterministicRand is the seeded source of the message IDs in the
+// deterministic mode
+type deterministicRand struct {
+	rand *rand.Rand
+	lock sync.Mutex // rand.Rand isn't safe for concurrent use
+}
+
+// newDeterministicRand creates a new deterministicRand instance
+func newDeterministicRand(seed int64) *deterministicRand {
+	return &deterministicRand{rand: rand.New(rand.NewSource(seed))}
+}
+
+// newMsgID returns the ID for a request the proxy sends on its own, e.g. to
+// chase a CNAME.  In the deterministic mode, the IDs are generated with the
+// seeded random source.
+func (p *Proxy) newMsgID() uint16 {
+	r := p.deterministicRand
+	if r == nil {
+		return dns.Id()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return uint16(r.rand.Uint32())
+}
+
+// exchangeDeterministic sends the request to all the upstreams and returns
+// the reply of the first one in the configured order that has answered, so
+// that the result doesn't depend on which of them is faster
+func (p *Proxy) exchangeDeterministic(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	wrapped := make([]upstream.Upstream, len(upstreams))
+	for i, u := range upstreams {
+		wrapped[i] = p.withPolicy(u, p.ParallelTimeout)
+	}
+
+	results, err := upstream.ExchangeAll(wrapped, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, u := range wrapped {
+		for _, r := range results {
+			if r.Upstream == u {
+				return r.Resp, upstreams[i], nil
+			}
+		}
+	}
+
+	return nil, nil, err
+}
+
+// sortRRsets sorts the records of every RRset in the message sections by
+// the text representation of their data so that the order doesn't depend on the
+// upstream.  The order of the RRsets themselves is kept as the CNAME chains
+// depend on it.
+func sortRRsets(m *dns.Msg) {
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for start := 0; start < len(rrs); {
+			end := start + 1
+			for end < len(rrs) && sameRRset(rrs[start], rrs[end]) {
+				end++
+			}
+
+			set := rrs[start:end]
+			sort.SliceStable(set, func(i, j int) bool {
+				return rdataString(set[i]) < rdataString(set[j])
+			})
+			start = end
+		}
+	}
+}
+
+// rdataString returns the text representation of the record data
+func rdataString(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// sameRRset returns true if the records belong to the same RRset
+func sameRRset(a, b dns.RR) bool {
+	ha, hb := a.Header(), b.Header()
+
+	return ha.Rrtype == hb.Rrtype && ha.Class == hb.Class && ha.Rrtype != dns.TypeOPT &&
+		strings.EqualFold(ha.Name, hb.Name)
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeterministicExchange(t *testing.T) {
+	slow := &policyTestUpstream{addr: "slow", delay: 50 * time.Millisecond}
+	fast := &policyTestUpstream{addr: "fast"}
+	upstreams := []upstream.Upstream{slow, fast}
+
+	p := &Proxy{}
+	p.Deterministic = true
+	p.UpstreamMode = UModeParallel
+	_, u, err := p.exchange(createTestMessage(), upstreams)
+	assert.Nil(t, err)
+	assert.True(t, u == slow)
+
+	// The RTT doesn't change the order
+	p.UpstreamMode = UModeLoadBalance
+	p.upstreamLayer().recordExchange("slow", time.Second, nil)
+	p.upstreamLayer().recordExchange("fast", time.Millisecond, nil)
+	_, u, err = p.exchange(createTestMessage(), upstreams)
+	assert.Nil(t, err)
+	assert.True(t, u == slow)
+
+	// The next upstream is used if the first one fails
+	failing := &policyTestUpstream{addr: "failing", fails: 1}
+	p.UpstreamMode = UModeParallel
+	_, u, err = p.exchange(createTestMessage(), []upstream.Upstream{failing, fast})
+	assert.Nil(t, err)
+	assert.True(t, u == fast)
+}
+
+func TestDeterministicMsgID(t *testing.T) {
+	ids := func(seed int64) []uint16 {
+		p := &Proxy{deterministicRand: newDeterministicRand(seed)}
+		return []uint16{p.newMsgID(), p.newMsgID(), p.newMsgID()}
+	}
+
+	assert.Equal(t, ids(1), ids(1))
+	assert.NotEqual(t, ids(1), ids(2))
+}
+
+func TestSortRRsets(t *testing.T) {
+	m := &dns.Msg{}
+	for _, s := range []string{
+		"www.example.org. 60 IN CNAME example.org.",
+		"example.org. 60 IN A 192.0.2.3",
+		"example.org. 60 IN A 192.0.2.1",
+		"EXAMPLE.org. 60 IN A 192.0.2.2",
+		"example.org. 60 IN AAAA 2001:db8::1",
+	} {
+		rr, err := dns.NewRR(s)
+		assert.Nil(t, err)
+		m.Answer = append(m.Answer, rr)
+	}
+
+	sortRRsets(m)
+
+	var answer []string
+	for _, rr := range m.Answer {
+		answer = append(answer, rr.String())
+	}
+	assert.Equal(t, []string{
+		"www.example.org.\t60\tIN\tCNAME\texample.org.",
+		"example.org.\t60\tIN\tA\t192.0.2.1",
+		"EXAMPLE.org.\t60\tIN\tA\t192.0.2.2",
+		"example.org.\t60\tIN\tA\t192.0.2.3",
+		"example.org.\t60\tIN\tAAAA\t2001:db8::1",
+	}, answer)
+}
@@ -106,6 +106,7 @@ func (p *Proxy) checkDNS64(oldAAAAReq, oldAAAAResp *dns.Msg, upstreams []upstrea
 		log.Tracef("Failed to create DNS64 mapped request %s", err)
 		return nil, nil, err
 	}
+	modifiedAReq.Id = p.newMsgID()
 
 	// Exchange new A request with selected upstreams
 	newAResp, u, err := p.exchange(modifiedAReq, upstreams)
@@ -12,7 +12,15 @@ import (
 	"github.com/miekg/dns"
 )
 
-// DNSContext represents a DNS request message context
+// DNSContext represents a DNS request message context.
+//
+// A DNSContext is created by the listener for each request and is only used
+// by the goroutine processing it, so it isn't safe for concurrent use.  It's
+// passed to BeforeRequestHandler, RequestHandler, and ResponseHandler and is
+// owned by the proxy once the response is written: the handlers
+// must not keep it or its metadata (see SetMeta) nor use it from other
+// goroutines after they return, as the proxy may reuse it for another
+// request.  Copy the values that must outlive the request.
 type DNSContext struct {
 	Proto     string            // "udp", "tcp", "tls", "https", "quic"
 	Req       *dns.Msg          // DNS request
@@ -21,17 +29,42 @@ type DNSContext struct {
 	StartTime time.Time         // processing start time
 	Upstream  upstream.Upstream // upstream that resolved DNS request
 
+	// ForwardedAddr and ForwardedProto are the address and the protocol of
+	// the original client reported by a trusted downstream dnsproxy, see
+	// Config.TrustedProxies.  They're empty if the request came from the
+	// client directly.  Use ClientAddr and ClientProto to get either.
+	ForwardedAddr  net.Addr
+	ForwardedProto string
+
+	// CookieValid is true if the request carries a valid server cookie of
+	// the proxy (see Config.Cookies), i.e. the client's address isn't
+	// spoofed
+	CookieValid bool
+
+	// ResponseClass describes how the response was produced.  A custom
+	// RequestHandler may set it, e.g. to ResponseClassBlocked for filtered
+	// requests.  Otherwise, it's set by the proxy.
+	ResponseClass ResponseClass
+
 	// CustomUpstreamConfig -- custom upstream servers configuration
 	// to use for this request only.
 	// If set, Resolve() uses it instead of default servers
 	CustomUpstreamConfig *UpstreamConfig
 
-	// Conn - underlying client connection. Can be null in the case of DOH.
+	// Conn - underlying client connection. Can be null in the case of DOH
+	// or of a custom UDP listener that doesn't implement net.Conn.
 	Conn net.Conn
 
+	// packetConn - underlying packet connection (for UDP only)
+	packetConn net.PacketConn
+
 	// localIP - local IP address (for UDP socket to call udpMakeOOBWithSrc)
 	localIP net.IP
 
+	// udpWriter writes the UDP response in a batch with the others, it's
+	// written directly if it's nil
+	udpWriter *udpWriter
+
 	// HTTPRequest - HTTP request (for DOH only)
 	HTTPRequest *http.Request
 	// HTTPResponseWriter - HTTP response writer (for DOH only)
@@ -45,6 +78,56 @@ type DNSContext struct {
 
 	ecsReqIP   net.IP // ECS IP used in request
 	ecsReqMask uint8  // ECS mask used in request
+
+	// clientCookie is the client cookie of the request, the response gets a
+	// server cookie for it
+	clientCookie []byte
+
+	// udpSize is the UDP size tuned for the client, see truncationTracker.
+	// If set, it's advertised to the client and the UDP responses are
+	// truncated to it unless the client has advertised a smaller one.
+	udpSize int
+
+	// resCopy is the copy of Res this context owns, see writableRes
+	resCopy *dns.Msg
+
+	listener *ListenerConfig // settings of the listener, nil if Config is used
+
+	// metadata are the values the middleware passes to each other, see
+	// SetMeta
+	metadata []metadataEntry
+}
+
+// ClientAddr returns the address of the original client of the request, which
+// is Addr unless the request is forwarded by a trusted proxy
+func (ctx *DNSContext) ClientAddr() net.Addr {
+	if ctx.ForwardedAddr != nil {
+		return ctx.ForwardedAddr
+	}
+
+	return ctx.Addr
+}
+
+// ClientProto returns the protocol of the original client of the request,
+// which is Proto unless the request is forwarded by a trusted proxy
+func (ctx *DNSContext) ClientProto() string {
+	if ctx.ForwardedProto != "" {
+		return ctx.ForwardedProto
+	}
+
+	return ctx.Proto
+}
+
+// writableRes returns Res that can be changed.  The response may be shared
+// with the cache or the other requests, so it's copied the first time, and
+// the copy is returned until Res is replaced.
+func (ctx *DNSContext) writableRes() *dns.Msg {
+	if ctx.Res != ctx.resCopy {
+		ctx.Res = ctx.Res.Copy()
+		ctx.resCopy = ctx.Res
+	}
+
+	return ctx.Res
 }
 
 // scrub - prepares the d.Res to be written (truncates if necessary)
@@ -53,6 +136,35 @@ func (ctx *DNSContext) scrub() {
 		return
 	}
 
-	ctx.Res.Truncate(proxyutil.DNSSize(ctx.Proto, ctx.Req))
+	size := proxyutil.DNSSize(ctx.Proto, ctx.Req)
+	if ctx.Proto == ProtoUDP && ctx.udpSize > 0 {
+		if ctx.udpSize < size {
+			size = ctx.udpSize
+		}
+
+		if opt := ctx.Res.IsEdns0(); opt != nil {
+			opt.SetUDPSize(uint16(ctx.udpSize))
+		}
+	}
+	ctx.Res.Truncate(size)
 	ctx.Res.Compress = true // some devices require DNS message compression
 }
+
+// pad - pads the d.Res on the encrypted transports if the client has padded
+// its query (RFC 7830).  The responses never carry the padding of the
+// upstreams.
+func (ctx *DNSContext) pad() {
+	if ctx.Res == nil || ctx.Req == nil {
+		return
+	}
+
+	switch ctx.Proto {
+	case ProtoTLS, ProtoHTTPS, ProtoQUIC:
+		if proxyutil.HasPadding(ctx.Req) {
+			proxyutil.AddPadding(ctx.Res, proxyutil.ResponsePaddingBlockSize)
+			return
+		}
+	}
+
+	proxyutil.RemovePadding(ctx.Res)
+}
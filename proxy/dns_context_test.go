@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritableRes(t *testing.T) {
+	shared := genEmptyNoError(createTestMessage())
+	d := &DNSContext{Res: shared}
+
+	res := d.writableRes()
+	assert.False(t, res == shared)
+	assert.True(t, d.Res == res)
+	res.Rcode = 1
+
+	// The copy is changed further
+	assert.True(t, d.writableRes() == res)
+	assert.Equal(t, 0, shared.Rcode)
+
+	// The replaced response is copied again
+	d.Res = shared
+	assert.False(t, d.writableRes() == res)
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// ECSOverride - EDNS Client Subnet settings for a domain and its subdomains
+type ECSOverride struct {
+	// Domain is the domain the override applies to along with its
+	// subdomains.  "." applies to all domains.
+	Domain string
+
+	// Subnet is sent to the upstreams instead of the client's subnet.  If
+	// nil, ECS is stripped from the requests.
+	Subnet *net.IPNet
+}
+
+// findECSOverride returns the override for the most specific domain that
+// matches host or nil if there is none
+func (p *Proxy) findECSOverride(host string) *ECSOverride {
+	host = strings.ToLower(dns.Fqdn(host))
+
+	var res *ECSOverride
+	resLen := -1
+	for i := range p.ECSOverrides {
+		o := &p.ECSOverrides[i]
+		domain := strings.ToLower(dns.Fqdn(o.Domain))
+		if domain != "." && host != domain && !strings.HasSuffix(host, "."+domain) {
+			continue
+		}
+
+		if len(domain) > resLen {
+			res = o
+			resLen = len(domain)
+		}
+	}
+
+	return res
+}
+
+// applyECSOverride replaces the ECS data in the request with the one from
+// the override
+func applyECSOverride(d *DNSContext, o *ECSOverride) {
+	removeECS(d.Req)
+
+	if o.Subnet == nil {
+		log.Debug("Stripped ECS data for %s", d.Req.Question[0].Name)
+		return
+	}
+
+	d.ecsReqIP, d.ecsReqMask = setECSSubnet(d.Req, o.Subnet)
+	log.Debug("Set ECS data override: %s/%d", d.ecsReqIP, d.ecsReqMask)
+}
+
+// removeECS removes the EDNS Client Subnet option from the request
+func removeECS(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, e := range opt.Option {
+		if _, ok := e.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, e)
+		}
+	}
+	opt.Option = options
+}
+
+// setECSSubnet sets the EDNS Client Subnet option with the specified subnet
+// in the request which must not contain one yet.  Returns the IP and the mask.
+func setECSSubnet(m *dns.Msg, subnet *net.IPNet) (net.IP, uint8) {
+	ones, _ := subnet.Mask.Size()
+
+	e := new(dns.EDNS0_SUBNET)
+	e.Code = dns.EDNS0SUBNET
+	e.SourceNetmask = uint8(ones)
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		e.Family = 1
+		e.Address = ip4.Mask(subnet.Mask)
+	} else {
+		e.Family = 2
+		e.Address = subnet.IP.Mask(subnet.Mask)
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(4096, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, e)
+
+	return e.Address, e.SourceNetmask
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindECSOverride(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("203.0.113.0/24")
+	p := &Proxy{}
+	p.ECSOverrides = []ECSOverride{
+		{Domain: "."},
+		{Domain: "example.org", Subnet: subnet},
+		{Domain: "Internal.Example.org."},
+	}
+
+	testCases := []struct {
+		host string
+		want *ECSOverride
+	}{
+		{"example.org.", &p.ECSOverrides[1]},
+		{"cdn.EXAMPLE.org.", &p.ECSOverrides[1]},
+		{"internal.example.org.", &p.ECSOverrides[2]},
+		{"a.internal.example.org.", &p.ECSOverrides[2]},
+		{"notexample.org.", &p.ECSOverrides[0]},
+		{"example.com.", &p.ECSOverrides[0]},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, p.findECSOverride(tc.host), tc.host)
+	}
+
+	p.ECSOverrides = p.ECSOverrides[1:]
+	assert.Nil(t, p.findECSOverride("example.com."))
+}
+
+func TestECSOverrideProxy(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("203.0.113.0/24")
+	u := &testUpstream{aResp: newRR("host. 300 IN A 1.2.3.4").(*dns.A)}
+
+	p := &Proxy{}
+	p.EnableEDNSClientSubnet = true
+	p.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{u}}
+	p.ECSOverrides = []ECSOverride{
+		{Domain: "."},
+		{Domain: "cdn.example.org", Subnet: subnet},
+	}
+	clientAddr := &net.UDPAddr{IP: net.IP{4, 3, 2, 1}, Port: 1234}
+
+	// The override subnet is sent instead of the client's one
+	d := &DNSContext{Req: createHostTestMessage("a.cdn.example.org"), Addr: clientAddr}
+	err := p.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.0", u.ecsReqIP.String())
+	assert.Equal(t, uint8(24), u.ecsReqMask)
+
+	// The client's ECS is replaced too
+	req := createHostTestMessage("a.cdn.example.org")
+	setECS(req, net.IP{4, 3, 2, 1}, 0)
+	d = &DNSContext{Req: req, Addr: clientAddr}
+	err = p.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.0", u.ecsReqIP.String())
+	ip, _, _ := parseECS(req)
+	assert.Equal(t, "203.0.113.0", ip.String())
+
+	// ECS is stripped for the other domains
+	req = createHostTestMessage("example.com")
+	setECS(req, net.IP{4, 3, 2, 1}, 0)
+	d = &DNSContext{Req: req, Addr: clientAddr}
+	err = p.Resolve(d)
+	assert.Nil(t, err)
+	assert.Nil(t, u.ecsReqIP)
+	assert.Equal(t, uint8(0), u.ecsReqMask)
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+)
+
+// Extended DNS Errors (RFC 8914).  miekg/dns doesn't support them yet, so the
+// option is built as a local one.
+const (
+	// ednsEDECode is the code of the EDNS0 option
+	ednsEDECode = 15
+
+	// edeStaleAnswer is the info code of the expired cached response served
+	// because the upstreams have failed
+	edeStaleAnswer uint16 = 3
+
+	// edeNotReady is the info code of the server that can't answer now
+	edeNotReady uint16 = 14
+
+	// edeBlocked is the info code of the domain blocked by the operator
+	edeBlocked uint16 = 15
+
+	// edeCensored is the info code of the domain blocked because of an
+	// external requirement
+	edeCensored uint16 = 16
+
+	// edeProhibited is the info code of the client not allowed to query
+	edeProhibited uint16 = 18
+
+	// edeNetworkError is the info code of the failure to reach the upstreams
+	edeNetworkError uint16 = 23
+)
+
+// newEDE returns the Extended DNS Error option with the info code and the
+// extra text, which may be empty
+func newEDE(code uint16, text string) *dns.EDNS0_LOCAL {
+	data := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+
+	return &dns.EDNS0_LOCAL{
+		Code: ednsEDECode,
+		Data: append(data, text...),
+	}
+}
+
+// EDECodes returns the info codes of the Extended DNS Errors (RFC 8914) of
+// the message, e.g. to decide if it's cached in CachePolicy
+func EDECodes(m *dns.Msg) (codes []uint16) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if ok && local.Code == ednsEDECode && len(local.Data) >= 2 {
+			codes = append(codes, binary.BigEndian.Uint16(local.Data))
+		}
+	}
+
+	return codes
+}
+
+// setEDE adds the Extended DNS Error to the response to req if req supports
+// EDNS
+func setEDE(res, req *dns.Msg, code uint16, text string) {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+
+	opt := res.IsEdns0()
+	if opt == nil {
+		res.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = res.IsEdns0()
+	}
+
+	opt.Option = append(opt.Option, newEDE(code, text))
+}
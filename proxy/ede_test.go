@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// assertEDE checks that the response has the single Extended DNS Error with
+// the info code
+func assertEDE(t *testing.T, res *dns.Msg, code uint16) {
+	opt := res.IsEdns0()
+	if !assert.NotNil(t, opt) || !assert.Len(t, opt.Option, 1) {
+		return
+	}
+
+	ede, ok := opt.Option[0].(*dns.EDNS0_LOCAL)
+	if assert.True(t, ok) && assert.True(t, len(ede.Data) >= 2) {
+		assert.Equal(t, uint16(ednsEDECode), ede.Code)
+		assert.Equal(t, code, binary.BigEndian.Uint16(ede.Data))
+	}
+}
+
+func TestSetEDE(t *testing.T) {
+	req := createTestMessage()
+	res := genEmptyNoError(req)
+	setEDE(res, req, edeBlocked, "blocked")
+	assert.Nil(t, res.IsEdns0())
+
+	req.SetEdns0(1232, true)
+	setEDE(res, req, edeBlocked, "blocked")
+	assertEDE(t, res, edeBlocked)
+	assert.Equal(t, []uint16{edeBlocked}, EDECodes(res))
+	assert.Nil(t, EDECodes(req))
+	assert.Equal(t, uint16(1232), res.IsEdns0().UDPSize())
+	assert.True(t, res.IsEdns0().Do())
+	assert.Equal(t, "blocked", string(res.IsEdns0().Option[0].(*dns.EDNS0_LOCAL).Data[2:]))
+}
+
+func TestEDEUpstreamFailure(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheServeStale = time.Hour
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&healthTestUpstream{fail: true}}
+	assert.Nil(t, dnsProxy.Init())
+
+	resolve := func(host string) *DNSContext {
+		req := createHostTestMessage(host)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		d := &DNSContext{Req: req, Addr: &net.UDPAddr{IP: net.IP{192, 168, 1, 1}}}
+		_ = dnsProxy.Resolve(d)
+		return d
+	}
+
+	d := resolve("failed.example.org")
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+	assert.Equal(t, ResponseClassError, d.ResponseClass)
+	assertEDE(t, d.Res, edeNetworkError)
+
+	// The response has expired 10 seconds ago
+	cached := &dns.Msg{}
+	cached.SetQuestion("stale.example.org.", dns.TypeA)
+	cached.Response = true
+	cached.Answer = []dns.RR{newRR("stale.example.org. 60 IN A 192.0.2.1")}
+	dnsProxy.cache.Set(cached)
+	data := packResponse(cached)
+	binary.BigEndian.PutUint32(data, uint32(time.Now().Unix()-10))
+	_ = dnsProxy.cache.items.Set(key(cached), data)
+
+	d = resolve("stale.example.org")
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, ResponseClassCached, d.ResponseClass)
+	if assert.Len(t, d.Res.Answer, 1) {
+		assert.Equal(t, uint32(staleAnswerTTL), d.Res.Answer[0].Header().Ttl)
+	}
+	assertEDE(t, d.Res, edeStaleAnswer)
+
+	// The stale responses are only served if the upstreams fail
+	_, ok := dnsProxy.cache.Get(cached)
+	assert.False(t, ok)
+
+	// And only for CacheServeStale
+	binary.BigEndian.PutUint32(data, uint32(time.Now().Add(-2*time.Hour).Unix()))
+	_ = dnsProxy.cache.items.Set(key(cached), data)
+	d = resolve("stale.example.org")
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+}
+
+func TestEDEBlocklistCensored(t *testing.T) {
+	b := &Blocklist{}
+	assert.Equal(t, edeBlocked, b.edeCode())
+
+	b.Censored = true
+	assert.Equal(t, edeCensored, b.edeCode())
+}
@@ -1,7 +1,7 @@
 package proxy
 
 import (
-	"sort"
+	"math/rand"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
@@ -10,16 +10,26 @@ import (
 	"github.com/miekg/dns"
 )
 
+// defaultUpstreamProbeRate is the share of the requests that probe the other
+// upstreams in UModeLoadBalance if Config.UpstreamProbeRate isn't set
+const defaultUpstreamProbeRate = 0.02
+
 // exchange -- sends DNS query to the upstream DNS server and returns the response
 func (p *Proxy) exchange(req *dns.Msg, upstreams []upstream.Upstream) (reply *dns.Msg, u upstream.Upstream, err error) {
+	upstreams = p.healthyUpstreams(upstreams)
+
 	qtype := req.Question[0].Qtype
 	if p.UpstreamMode == UModeFastestAddr && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
-		reply, u, err = p.fastestAddr.ExchangeFastest(req, upstreams)
+		reply, u, err = p.exchangeFastest(req, upstreams)
 		return
 	}
 
 	if p.UpstreamMode == UModeParallel {
-		reply, u, err = upstream.ExchangeParallel(upstreams, req)
+		if p.Deterministic {
+			reply, u, err = p.exchangeDeterministic(req, upstreams)
+		} else {
+			reply, u, err = p.exchangeParallel(upstreams, req)
+		}
 		return
 	}
 
@@ -27,41 +37,47 @@ func (p *Proxy) exchange(req *dns.Msg, upstreams []upstream.Upstream) (reply *dn
 
 	if len(upstreams) == 1 {
 		u = upstreams[0]
-		reply, _, err = exchangeWithUpstream(u, req)
+		reply, _, err = exchangeWithUpstream(p.withPolicy(u, 0), req)
 		return
 	}
 
-	// sort upstreams by rtt from fast to slow
-	sortedUpstreams := p.getSortedUpstreams(upstreams)
+	// sort upstreams by their expected rtt from fast to slow, the
+	// deterministic mode keeps the configured order
+	sortedUpstreams := upstreams
+	if !p.Deterministic {
+		sortedUpstreams = p.loadBalanceOrder(upstreams)
+	}
 
 	errs := []error{}
 	for _, dnsUpstream := range sortedUpstreams {
-		reply, elapsed, err := exchangeWithUpstream(dnsUpstream, req)
+		reply, _, err := exchangeWithUpstream(p.withPolicy(dnsUpstream, 0), req)
 		if err == nil {
-			p.updateRtt(dnsUpstream.Address(), elapsed)
 			return reply, dnsUpstream, err
 		}
 		errs = append(errs, err)
-		p.updateRtt(dnsUpstream.Address(), int(defaultTimeout/time.Millisecond))
 	}
 	return nil, nil, errorx.DecorateMany("all upstreams failed to exchange request", errs...)
 }
 
-func (p *Proxy) getSortedUpstreams(u []upstream.Upstream) []upstream.Upstream {
-	// clone upstreams list to avoid race conditions
-	p.rttLock.Lock()
-	clone := make([]upstream.Upstream, len(u))
-	copy(clone, u)
+// loadBalanceOrder returns the copy of upstreams in the order they're tried
+// in UModeLoadBalance: from the best expected rtt to the worst, except that
+// a share of the requests first probes a random one of the others, so that
+// their statistics follow their recovery
+func (p *Proxy) loadBalanceOrder(upstreams []upstream.Upstream) []upstream.Upstream {
+	sorted := p.upstreamLayer().sortByStats(upstreams)
 
-	sort.Slice(clone, func(i, j int) bool {
-		if p.upstreamRttStats[clone[i].Address()] < p.upstreamRttStats[clone[j].Address()] {
-			return true
-		}
-		return false
-	})
-	p.rttLock.Unlock()
+	rate := p.UpstreamProbeRate
+	if rate == 0 {
+		rate = defaultUpstreamProbeRate
+	}
+	if len(sorted) > 1 && rand.Float64() < rate {
+		i := 1 + rand.Intn(len(sorted)-1)
+		probe := sorted[i]
+		copy(sorted[1:i+1], sorted[:i])
+		sorted[0] = probe
+	}
 
-	return clone
+	return sorted
 }
 
 // exchangeWithUpstream returns result of Exchange with elapsed time
@@ -76,13 +92,3 @@ func exchangeWithUpstream(u upstream.Upstream, req *dns.Msg) (*dns.Msg, int, err
 	}
 	return reply, elapsed, err
 }
-
-// updateRtt updates rtt in upstreamRttStats for given address
-func (p *Proxy) updateRtt(address string, rtt int) {
-	p.rttLock.Lock()
-	if p.upstreamRttStats == nil {
-		p.upstreamRttStats = map[string]int{}
-	}
-	p.upstreamRttStats[address] = (p.upstreamRttStats[address] + rtt) / 2
-	p.rttLock.Unlock()
-}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// fallbacks returns the fallback upstreams and the time budget of the
+// exchange with them: the ones of the current UpstreamConfig or, if it has
+// none, Config.Fallbacks without a budget
+func (p *Proxy) fallbacks() ([]upstream.Upstream, time.Duration) {
+	if uc := p.getUpstreamConfig(); uc != nil && len(uc.Fallbacks) != 0 {
+		return uc.Fallbacks, uc.FallbackTimeout
+	}
+
+	return p.Fallbacks, 0
+}
+
+// exchangeFallbacks sends the request to all the fallbacks in parallel.  If
+// the fallbacks have a time budget, it limits the whole exchange, including
+// the retries, otherwise Config.ParallelTimeout limits each attempt.
+func (p *Proxy) exchangeFallbacks(req *dns.Msg) (*dns.Msg, upstream.Upstream, error) {
+	fallbacks, budget := p.fallbacks()
+	if len(fallbacks) == 0 {
+		return nil, nil, errors.New("no fallbacks")
+	}
+	if budget <= 0 {
+		return p.exchangeParallel(fallbacks, req)
+	}
+
+	type result struct {
+		reply *dns.Msg
+		u     upstream.Upstream
+		err   error
+	}
+
+	// The request is copied as it may be still used by the abandoned
+	// exchanges
+	req = req.Copy()
+	ch := make(chan result, 1)
+	go func() {
+		reply, u, err := p.exchangeParallelWithTimeout(fallbacks, req, budget)
+		ch <- result{reply: reply, u: u, err: err}
+	}()
+
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+
+	select {
+	case r := <-ch:
+		return r.reply, r.u, r.err
+	case <-timer.C:
+		return nil, nil, fmt.Errorf("fallbacks: %w after %s", errExchangeTimeout, budget)
+	}
+}
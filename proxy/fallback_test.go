@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamConfigFallbacks(t *testing.T) {
+	bad := &healthTestUpstream{addr: "bad", fail: true}
+	good := &healthTestUpstream{addr: "good"}
+	fallback := &healthTestUpstream{addr: "fallback"}
+	oldFallback := &healthTestUpstream{addr: "old"}
+
+	p := &Proxy{}
+	p.Fallbacks = []upstream.Upstream{oldFallback}
+	p.UpstreamConfig = &UpstreamConfig{
+		Upstreams: []upstream.Upstream{good},
+		Fallbacks: []upstream.Upstream{fallback},
+	}
+
+	// The fallbacks aren't used while the upstreams answer
+	d := &DNSContext{Req: createTestMessage()}
+	assert.Nil(t, p.Resolve(d))
+	assert.Equal(t, good, d.Upstream)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&fallback.requests))
+
+	// The ones of UpstreamConfig replace Config.Fallbacks
+	p.UpstreamConfig.Upstreams = []upstream.Upstream{bad}
+	d = &DNSContext{Req: createTestMessage()}
+	assert.Nil(t, p.Resolve(d))
+	assert.Equal(t, fallback, d.Upstream)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&oldFallback.requests))
+	assert.Contains(t, p.allUpstreams(), upstream.Upstream(fallback))
+
+	p.UpstreamConfig.Fallbacks = nil
+	d = &DNSContext{Req: createTestMessage()}
+	assert.Nil(t, p.Resolve(d))
+	assert.Equal(t, oldFallback, d.Upstream)
+}
+
+func TestFallbackTimeout(t *testing.T) {
+	slow := &blockingUpstream{release: make(chan struct{})}
+	defer close(slow.release)
+
+	p := &Proxy{}
+	p.UpstreamConfig = &UpstreamConfig{
+		Upstreams:       []upstream.Upstream{&healthTestUpstream{addr: "bad", fail: true}},
+		Fallbacks:       []upstream.Upstream{slow},
+		FallbackTimeout: 100 * time.Millisecond,
+	}
+
+	start := time.Now()
+	d := &DNSContext{Req: createTestMessage()}
+	err := p.Resolve(d)
+	assert.True(t, errors.Is(err, errExchangeTimeout))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slow.requests))
+}
+
+func TestAdminUpstreamsFallbacks(t *testing.T) {
+	fallback := &healthTestUpstream{addr: "fallback"}
+	p := &Proxy{}
+	p.UpstreamConfig = &UpstreamConfig{
+		Upstreams:       []upstream.Upstream{&healthTestUpstream{addr: "good"}},
+		Fallbacks:       []upstream.Upstream{fallback},
+		FallbackTimeout: time.Second,
+	}
+
+	reload := func(body string) int {
+		r := newAdminJSONRequest(http.MethodPost, adminPathUpstreams, body)
+		w := httptest.NewRecorder()
+		p.handleAdminUpstreams(w, r)
+
+		return w.Code
+	}
+
+	// The fallbacks are kept
+	assert.Equal(t, http.StatusOK, reload(`{"upstreams": ["1.1.1.1"]}`))
+	uc := p.getUpstreamConfig()
+	assert.Equal(t, []upstream.Upstream{fallback}, uc.Fallbacks)
+	assert.Equal(t, time.Second, uc.FallbackTimeout)
+
+	// And replaced
+	assert.Equal(t, http.StatusOK, reload(`{"upstreams": ["1.1.1.1"], "fallbacks": ["192.168.1.1"], "fallback_timeout": "2s"}`))
+	uc = p.getUpstreamConfig()
+	if assert.Len(t, uc.Fallbacks, 1) {
+		assert.Equal(t, "192.168.1.1:53", uc.Fallbacks[0].Address())
+	}
+	assert.Equal(t, 2*time.Second, uc.FallbackTimeout)
+
+	assert.Equal(t, http.StatusBadRequest, reload(`{"upstreams": ["1.1.1.1"], "fallbacks": ["bad://"]}`))
+	assert.Equal(t, http.StatusBadRequest, reload(`{"upstreams": ["1.1.1.1"], "fallbacks": ["192.168.1.1"], "fallback_timeout": "x"}`))
+}
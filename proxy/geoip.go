@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// earthRadius is the mean radius of the Earth in kilometers
+const earthRadius = 6371
+
+// GeoIP is a MaxMind DB with the locations of the IP addresses, e.g. GeoLite2
+// City.  It's safe for concurrent use.
+type GeoIP struct {
+	reader *mmdbReader
+}
+
+// LoadGeoIP loads the MaxMind DB file with the locations of the IP
+// addresses, e.g. GeoLite2-City.mmdb.  The file is read into memory.
+func LoadGeoIP(path string) (*GeoIP, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't read GeoIP database")
+	}
+
+	r, err := newMMDBReader(buf)
+	if err != nil {
+		return nil, fmt.Errorf("loading GeoIP database %s: %w", path, err)
+	}
+
+	return &GeoIP{reader: r}, nil
+}
+
+// geoLocation is the coordinates of an IP address in degrees
+type geoLocation struct {
+	lat, lon float64
+}
+
+// locate returns the location of the IP address, ok is false if it's
+// unknown
+func (g *GeoIP) locate(ip net.IP) (loc geoLocation, ok bool) {
+	v, err := g.reader.lookup(ip)
+	if err != nil {
+		log.Debug("looking up %s in GeoIP database: %s", ip, err)
+		return loc, false
+	}
+
+	record, _ := v.(map[string]interface{})
+	location, _ := record["location"].(map[string]interface{})
+	lat, latOK := location["latitude"].(float64)
+	lon, lonOK := location["longitude"].(float64)
+
+	return geoLocation{lat: lat, lon: lon}, latOK && lonOK
+}
+
+// distance returns the great-circle distance between the locations in
+// kilometers
+func (l geoLocation) distance(other geoLocation) float64 {
+	lat1, lat2 := l.lat*math.Pi/180, other.lat*math.Pi/180
+	dLat, dLon := lat2-lat1, (other.lon-l.lon)*math.Pi/180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// GeoIPRule - GeoIP answer ordering settings for a domain and its subdomains
+type GeoIPRule struct {
+	// Domain is the domain the rule applies to along with its subdomains.
+	// "." applies to all domains.
+	Domain string
+
+	// Nearest is the number of the nearest addresses kept in the answers,
+	// the other ones are removed.  If 0, the addresses are only sorted.
+	Nearest int
+}
+
+// ParseGeoIPRule parses the rule in the "domain=sort" or the
+// "domain=nearest:N" form
+func ParseGeoIPRule(s string) (r GeoIPRule, err error) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return r, fmt.Errorf("invalid GeoIP rule %q, expected domain=action", s)
+	}
+
+	r.Domain = s[:i]
+	action := s[i+1:]
+	if action == "sort" {
+		return r, nil
+	}
+
+	if !strings.HasPrefix(action, "nearest:") {
+		return r, fmt.Errorf("invalid action in GeoIP rule %q", s)
+	}
+
+	r.Nearest, err = strconv.Atoi(strings.TrimPrefix(action, "nearest:"))
+	if err != nil || r.Nearest <= 0 {
+		return r, fmt.Errorf("invalid number of the nearest addresses in GeoIP rule %q", s)
+	}
+
+	return r, nil
+}
+
+// findGeoIPRule returns the rule for the most specific domain that matches
+// host or nil if there is none
+func (p *Proxy) findGeoIPRule(host string) *GeoIPRule {
+	host = strings.ToLower(dns.Fqdn(host))
+
+	var res *GeoIPRule
+	resLen := -1
+	for i := range p.GeoIPRules {
+		r := &p.GeoIPRules[i]
+		domain := strings.ToLower(dns.Fqdn(r.Domain))
+		if domain != "." && host != domain && !strings.HasSuffix(host, "."+domain) {
+			continue
+		}
+
+		if len(domain) > resLen {
+			res = r
+			resLen = len(domain)
+		}
+	}
+
+	return res
+}
+
+// applyGeoIP sorts the A and AAAA answers to the client by the distance from
+// the client according to Config.GeoIPRules.  The ECS address sent to the
+// upstreams is used instead of the client's one if it's set.  The addresses
+// with unknown locations are put last.
+func (p *Proxy) applyGeoIP(d *DNSContext) {
+	if p.GeoIP == nil || len(p.GeoIPRules) == 0 || len(d.Res.Answer) < 2 || len(d.Req.Question) == 0 {
+		return
+	}
+
+	rule := p.findGeoIPRule(d.Req.Question[0].Name)
+	if rule == nil {
+		return
+	}
+
+	ip := d.ecsReqIP
+	if ip == nil {
+		ip, _ = addrIPPort(d.ClientAddr())
+	}
+	if ip == nil {
+		return
+	}
+
+	client, ok := p.GeoIP.locate(ip)
+	if !ok {
+		log.Debug("GeoIP: unknown location of client %s", ip)
+		return
+	}
+
+	res := d.writableRes()
+
+	type addrAnswer struct {
+		rr       dns.RR
+		distance float64
+	}
+	var addrs []addrAnswer
+	for _, rr := range res.Answer {
+		addr := answerIP(rr)
+		if addr == nil {
+			continue
+		}
+
+		a := addrAnswer{rr: rr, distance: math.Inf(1)}
+		if loc, ok := p.GeoIP.locate(addr); ok {
+			a.distance = client.distance(loc)
+		}
+		addrs = append(addrs, a)
+	}
+	if len(addrs) < 2 {
+		return
+	}
+
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return addrs[i].distance < addrs[j].distance
+	})
+	if rule.Nearest > 0 && len(addrs) > rule.Nearest {
+		addrs = addrs[:rule.Nearest]
+	}
+
+	// The other records keep their places and the addresses take the
+	// places of the original ones
+	answer := make([]dns.RR, 0, len(res.Answer))
+	for _, rr := range res.Answer {
+		if answerIP(rr) == nil {
+			answer = append(answer, rr)
+		} else if len(addrs) > 0 {
+			answer = append(answer, addrs[0].rr)
+			addrs = addrs[1:]
+		}
+	}
+	res.Answer = answer
+}
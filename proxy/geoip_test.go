@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testMMDBNetwork is a network with a location in the test MaxMind DB
+type testMMDBNetwork struct {
+	cidr     string
+	lat, lon float64
+}
+
+// testMMDBWriter builds the MaxMind DB files for the tests
+type testMMDBWriter struct {
+	nodes [][2]int // records, -1 is empty, < -1 is the data at -(r+2)
+	data  []byte
+}
+
+// appendUint appends the n bytes of v in the big-endian order to b
+func appendUint(b []byte, v uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*uint(i))))
+	}
+
+	return b
+}
+
+func (w *testMMDBWriter) ctrl(typ, size int) {
+	if typ > 7 {
+		w.data = append(w.data, byte(size), byte(typ-7))
+		return
+	}
+	w.data = append(w.data, byte(typ<<5|size))
+}
+
+func (w *testMMDBWriter) str(s string) {
+	w.ctrl(mmdbString, len(s))
+	w.data = append(w.data, s...)
+}
+
+func (w *testMMDBWriter) double(f float64) {
+	w.ctrl(mmdbDouble, 8)
+	w.data = appendUint(w.data, uint64(math.Float64bits(f)), 8)
+}
+
+func (w *testMMDBWriter) uint16(v uint16) {
+	w.ctrl(mmdbUint16, 2)
+	w.data = appendUint(w.data, uint64(v), 2)
+}
+
+func (w *testMMDBWriter) uint32(v uint32) {
+	w.ctrl(mmdbUint32, 4)
+	w.data = appendUint(w.data, uint64(v), 4)
+}
+
+// insert adds the network with the data at off
+func (w *testMMDBWriter) insert(t *testing.T, cidr string, ipVersion int, off int) {
+	_, n, err := net.ParseCIDR(cidr)
+	assert.Nil(t, err)
+
+	ip := n.IP
+	ones, _ := n.Mask.Size()
+	if ip4 := ip.To4(); ip4 != nil && ipVersion == 6 {
+		// The IPv4 addresses are in ::/96
+		ip, ones = append(make(net.IP, 12), ip4...), ones+96
+	}
+
+	node := 0
+	for i := 0; i < ones; i++ {
+		bit := int(ip[i/8] >> (7 - uint(i%8)) & 1)
+		if i == ones-1 {
+			w.nodes[node][bit] = -(off + 2)
+			return
+		}
+
+		if w.nodes[node][bit] < 0 {
+			w.nodes = append(w.nodes, [2]int{-1, -1})
+			w.nodes[node][bit] = len(w.nodes) - 1
+		}
+		node = w.nodes[node][bit]
+	}
+}
+
+// writeTestMMDB writes the MaxMind DB file with the networks to dir
+func writeTestMMDB(t *testing.T, dir string, ipVersion, recordSize int, networks []testMMDBNetwork) string {
+	w := &testMMDBWriter{nodes: [][2]int{{-1, -1}}}
+	for i, n := range networks {
+		off := len(w.data)
+		w.ctrl(mmdbMap, 1)
+		if i == 0 {
+			w.str("location")
+		} else {
+			// The key is a pointer to the first one
+			w.data = append(w.data, mmdbPointer<<5, 1)
+		}
+		w.ctrl(mmdbMap, 2)
+		w.str("latitude")
+		w.double(n.lat)
+		w.str("longitude")
+		w.double(n.lon)
+
+		w.insert(t, n.cidr, ipVersion, off)
+	}
+
+	nodeCount := len(w.nodes)
+	record := func(r int) uint32 {
+		switch {
+		case r == -1:
+			return uint32(nodeCount)
+		case r < -1:
+			return uint32(nodeCount + mmdbDataSectionSeparator - r - 2)
+		default:
+			return uint32(r)
+		}
+	}
+
+	var buf []byte
+	for _, n := range w.nodes {
+		l, r := record(n[0]), record(n[1])
+		switch recordSize {
+		case 24:
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(l>>24<<4|r>>24), byte(r>>16), byte(r>>8), byte(r))
+		default:
+			buf = appendUint(appendUint(buf, uint64(l), 4), uint64(r), 4)
+		}
+	}
+	buf = append(buf, make([]byte, mmdbDataSectionSeparator)...)
+	buf = append(buf, w.data...)
+	buf = append(buf, mmdbMetadataMarker...)
+
+	w.data = nil
+	w.ctrl(mmdbMap, 4)
+	w.str("node_count")
+	w.uint32(uint32(nodeCount))
+	w.str("record_size")
+	w.uint16(uint16(recordSize))
+	w.str("ip_version")
+	w.uint16(uint16(ipVersion))
+	w.str("build_epoch")
+	w.ctrl(mmdbUint64, 1)
+	w.data = append(w.data, 1)
+	buf = append(buf, w.data...)
+
+	path := filepath.Join(dir, "test.mmdb")
+	assert.Nil(t, ioutil.WriteFile(path, buf, 0o644))
+
+	return path
+}
+
+var testGeoIPNetworks = []testMMDBNetwork{
+	{cidr: "198.51.100.0/24", lat: 40.71, lon: -74.01},  // New York
+	{cidr: "203.0.113.0/25", lat: 48.86, lon: 2.35},     // Paris
+	{cidr: "203.0.113.128/25", lat: 35.68, lon: 139.69}, // Tokyo
+	{cidr: "2001:db8::/32", lat: 51.51, lon: -0.13},     // London
+}
+
+func loadTestGeoIP(t *testing.T, ipVersion, recordSize int) *GeoIP {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	networks := testGeoIPNetworks
+	if ipVersion == 4 {
+		networks = networks[:3]
+	}
+
+	g, err := LoadGeoIP(writeTestMMDB(t, dir, ipVersion, recordSize, networks))
+	assert.Nil(t, err)
+
+	return g
+}
+
+func TestGeoIPLocate(t *testing.T) {
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			g := loadTestGeoIP(t, ipVersion, recordSize)
+			if g == nil {
+				continue
+			}
+
+			loc, ok := g.locate(net.IP{198, 51, 100, 7})
+			assert.True(t, ok)
+			assert.Equal(t, geoLocation{lat: 40.71, lon: -74.01}, loc)
+
+			loc, ok = g.locate(net.IP{203, 0, 113, 200})
+			assert.True(t, ok)
+			assert.Equal(t, geoLocation{lat: 35.68, lon: 139.69}, loc)
+
+			_, ok = g.locate(net.IP{192, 0, 2, 1})
+			assert.False(t, ok)
+
+			loc, ok = g.locate(net.ParseIP("2001:db8::1"))
+			assert.Equal(t, ipVersion == 6, ok)
+			if ok {
+				assert.Equal(t, geoLocation{lat: 51.51, lon: -0.13}, loc)
+			}
+		}
+	}
+
+	// New York to Paris
+	d := geoLocation{lat: 40.71, lon: -74.01}.distance(geoLocation{lat: 48.86, lon: 2.35})
+	assert.InDelta(t, 5837, d, 10)
+}
+
+func TestLoadGeoIPInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = LoadGeoIP(filepath.Join(dir, "none.mmdb"))
+	assert.NotNil(t, err)
+
+	path := filepath.Join(dir, "invalid.mmdb")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("not a database"), 0o644))
+	_, err = LoadGeoIP(path)
+	assert.NotNil(t, err)
+
+	// The tree is larger than the file
+	data := append(append([]byte{}, mmdbMetadataMarker...), mmdbMap<<5|3)
+	for _, f := range []struct {
+		key string
+		val byte
+	}{{"node_count", 100}, {"record_size", 24}, {"ip_version", 4}} {
+		data = append(data, byte(mmdbString<<5|len(f.key)))
+		data = append(data, f.key...)
+		data = append(data, mmdbUint16<<5|1, f.val)
+	}
+	assert.Nil(t, ioutil.WriteFile(path, data, 0o644))
+	_, err = LoadGeoIP(path)
+	assert.NotNil(t, err)
+}
+
+func TestParseGeoIPRule(t *testing.T) {
+	r, err := ParseGeoIPRule("cdn.example.com=sort")
+	assert.Nil(t, err)
+	assert.Equal(t, GeoIPRule{Domain: "cdn.example.com"}, r)
+
+	r, err = ParseGeoIPRule("example.net=nearest:2")
+	assert.Nil(t, err)
+	assert.Equal(t, GeoIPRule{Domain: "example.net", Nearest: 2}, r)
+
+	for _, s := range []string{"example.com", "=sort", "example.com=filter", "example.com=nearest:0", "example.com=nearest:x"} {
+		_, err = ParseGeoIPRule(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestApplyGeoIP(t *testing.T) {
+	p := &Proxy{}
+	p.GeoIP = loadTestGeoIP(t, 6, 24)
+	p.GeoIPRules = []GeoIPRule{
+		{Domain: "example.com"},
+		{Domain: "cdn.example.com", Nearest: 1},
+	}
+
+	res := &dns.Msg{}
+	res.Answer = []dns.RR{
+		newRR("www.example.com. 300 IN CNAME edge.example.net."),
+		newRR("edge.example.net. 300 IN A 192.0.2.1"),
+		newRR("edge.example.net. 300 IN A 203.0.113.200"),
+		newRR("edge.example.net. 300 IN A 203.0.113.5"),
+	}
+	ips := func(m *dns.Msg) (ips []string) {
+		for _, rr := range m.Answer {
+			if ip := answerIP(rr); ip != nil {
+				ips = append(ips, ip.String())
+			}
+		}
+		return ips
+	}
+
+	// The client in New York gets Paris, Tokyo, and the unknown one
+	d := &DNSContext{
+		Req:  createHostTestMessage("www.example.com"),
+		Res:  res,
+		Addr: &net.UDPAddr{IP: net.IP{198, 51, 100, 1}, Port: 53},
+	}
+	p.applyGeoIP(d)
+	assert.Equal(t, []string{"203.0.113.5", "203.0.113.200", "192.0.2.1"}, ips(d.Res))
+	assert.IsType(t, &dns.CNAME{}, d.Res.Answer[0])
+
+	// The shared response isn't changed
+	assert.Equal(t, []string{"192.0.2.1", "203.0.113.200", "203.0.113.5"}, ips(res))
+
+	// The ECS address is used and only the nearest address is kept
+	d = &DNSContext{
+		Req:      createHostTestMessage("img.cdn.example.com"),
+		Res:      res,
+		Addr:     &net.UDPAddr{IP: net.IP{192, 168, 1, 2}, Port: 53},
+		ecsReqIP: net.IP{203, 0, 113, 130},
+	}
+	p.applyGeoIP(d)
+	assert.Equal(t, []string{"203.0.113.200"}, ips(d.Res))
+	assert.Len(t, d.Res.Answer, 2)
+
+	// The clients with unknown locations and the other domains are skipped
+	for _, d = range []*DNSContext{{
+		Req:  createHostTestMessage("www.example.com"),
+		Res:  res,
+		Addr: &net.UDPAddr{IP: net.IP{192, 168, 1, 2}, Port: 53},
+	}, {
+		Req:  createHostTestMessage("www.example.org"),
+		Res:  res,
+		Addr: &net.UDPAddr{IP: net.IP{198, 51, 100, 1}, Port: 53},
+	}} {
+		p.applyGeoIP(d)
+		assert.Equal(t, res, d.Res)
+	}
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultHealthCheckDomain is the domain the probe NS queries are sent
+	// for if Config.HealthCheckDomain isn't set
+	defaultHealthCheckDomain = "."
+
+	// healthCheckMaxFailures is the number of consecutive failed probes
+	// after which an upstream is considered down
+	healthCheckMaxFailures = 2
+
+	// healthCheckMaxBackoff is the maximum interval between the probes of an
+	// upstream that is down
+	healthCheckMaxBackoff = 5 * time.Minute
+)
+
+// upstreamHealth is the health state of a single upstream
+type upstreamHealth struct {
+	failures  int           // number of consecutive failed probes
+	down      bool          // if true, the upstream is excluded from selection
+	backoff   time.Duration // current interval between the probes of a down upstream
+	nextProbe time.Time     // time of the next probe of a down upstream
+}
+
+// startHealthCheck starts the health check loop if it's enabled
+func (p *Proxy) startHealthCheck() {
+	if p.HealthCheckInterval <= 0 {
+		return
+	}
+
+	log.Info("Checking upstreams health every %s", p.HealthCheckInterval)
+	p.healthStop = make(chan struct{})
+	go p.healthCheckLoop(p.healthStop)
+}
+
+// stopHealthCheck stops the health check loop if it's running
+func (p *Proxy) stopHealthCheck() {
+	if p.healthStop != nil {
+		close(p.healthStop)
+		p.healthStop = nil
+	}
+}
+
+// healthCheckLoop probes the upstreams until stop is closed
+func (p *Proxy) healthCheckLoop(stop chan struct{}) {
+	t := time.NewTicker(p.HealthCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			p.checkUpstreamsHealth(time.Now())
+		}
+	}
+}
+
+// checkUpstreamsHealth probes all the upstreams that are due to be probed in
+// parallel and waits for the results
+func (p *Proxy) checkUpstreamsHealth(now time.Time) {
+	defer p.acquireUpstreams()()
+
+	wg := sync.WaitGroup{}
+	for _, u := range p.allUpstreams() {
+		if !p.isProbeDue(u.Address(), now) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(u upstream.Upstream) {
+			defer wg.Done()
+			p.probeUpstream(u)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// allUpstreams returns all the configured upstreams, including the
+// domain-specific ones and the fallbacks, without duplicates
+func (p *Proxy) allUpstreams() []upstream.Upstream {
+	seen := map[string]bool{}
+	var res []upstream.Upstream
+	add := func(upstreams []upstream.Upstream) {
+		for _, u := range upstreams {
+			if !seen[u.Address()] {
+				seen[u.Address()] = true
+				res = append(res, u)
+			}
+		}
+	}
+
+	uc := p.getUpstreamConfig()
+	if uc != nil {
+		add(uc.Upstreams)
+		for _, upstreams := range uc.DomainReservedUpstreams {
+			add(upstreams)
+		}
+	}
+	fallbacks, _ := p.fallbacks()
+	add(fallbacks)
+
+	return res
+}
+
+// probeUpstream sends a test query to the upstream and updates its health
+// state.  Any response, even a negative one, means that the upstream is up.
+func (p *Proxy) probeUpstream(u upstream.Upstream) {
+	domain := p.HealthCheckDomain
+	if domain == "" {
+		domain = defaultHealthCheckDomain
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(domain), dns.TypeNS)
+
+	_, _, err := exchangeWithUpstream(u, req)
+	p.updateUpstreamHealth(u.Address(), err, time.Now())
+}
+
+// updateUpstreamHealth updates the health state of the upstream with the
+// result of a probe
+func (p *Proxy) updateUpstreamHealth(address string, err error, now time.Time) {
+	l := p.upstreamLayer()
+	l.healthLock.Lock()
+	defer l.healthLock.Unlock()
+
+	if l.health == nil {
+		l.health = map[string]*upstreamHealth{}
+	}
+	h := l.health[address]
+	if h == nil {
+		h = &upstreamHealth{}
+		l.health[address] = h
+	}
+
+	if err == nil {
+		if h.down {
+			log.Info("upstream %s is up again", address)
+		}
+		*h = upstreamHealth{}
+		return
+	}
+
+	h.failures++
+	if h.down {
+		h.backoff *= 2
+	} else {
+		if h.failures < healthCheckMaxFailures {
+			return
+		}
+
+		log.Info("upstream %s is down: %s", address, err)
+		h.down = true
+		h.backoff = p.HealthCheckInterval
+	}
+
+	if h.backoff > healthCheckMaxBackoff {
+		h.backoff = healthCheckMaxBackoff
+	}
+	h.nextProbe = now.Add(h.backoff)
+}
+
+// isProbeDue checks if it's time to probe the upstream
+func (p *Proxy) isProbeDue(address string, now time.Time) bool {
+	l := p.upstreamLayer()
+	l.healthLock.RLock()
+	defer l.healthLock.RUnlock()
+
+	h := l.health[address]
+	return h == nil || !h.down || !now.Before(h.nextProbe)
+}
+
+// healthyUpstreams returns the upstreams that aren't down.  If all of them
+// are down, it returns upstreams as is since there is nothing better to try.
+func (p *Proxy) healthyUpstreams(upstreams []upstream.Upstream) []upstream.Upstream {
+	l := p.upstreamLayer()
+	l.healthLock.RLock()
+	defer l.healthLock.RUnlock()
+
+	if len(l.health) == 0 {
+		return upstreams
+	}
+
+	var res []upstream.Upstream
+	for _, u := range upstreams {
+		h := l.health[u.Address()]
+		if h == nil || !h.down {
+			res = append(res, u)
+		}
+	}
+
+	if len(res) == 0 {
+		return upstreams
+	}
+
+	return res
+}
+
+// downUpstreams returns the sorted addresses of the upstreams that are down
+func (p *Proxy) downUpstreams() []string {
+	l := p.upstreamLayer()
+	l.healthLock.RLock()
+	defer l.healthLock.RUnlock()
+
+	var res []string
+	for address, h := range l.health {
+		if h.down {
+			res = append(res, address)
+		}
+	}
+	sort.Strings(res)
+
+	return res
+}
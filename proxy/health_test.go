@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// healthTestUpstream is an upstream that either always fails or always
+// answers with an empty response
+type healthTestUpstream struct {
+	addr     string
+	fail     bool
+	requests int32
+}
+
+func (u *healthTestUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.requests, 1)
+	if u.fail {
+		return nil, errors.New("test upstream failure")
+	}
+
+	return genEmptyNoError(m), nil
+}
+
+func (u *healthTestUpstream) Address() string {
+	return u.addr
+}
+
+func TestUpdateUpstreamHealth(t *testing.T) {
+	p := &Proxy{}
+	p.HealthCheckInterval = time.Minute
+	now := time.Now()
+	testErr := errors.New("test")
+
+	// A single failure isn't enough
+	p.updateUpstreamHealth("1.1.1.1:53", testErr, now)
+	assert.Empty(t, p.downUpstreams())
+	assert.True(t, p.isProbeDue("1.1.1.1:53", now))
+
+	p.updateUpstreamHealth("1.1.1.1:53", testErr, now)
+	assert.Equal(t, []string{"1.1.1.1:53"}, p.downUpstreams())
+	assert.False(t, p.isProbeDue("1.1.1.1:53", now))
+	assert.True(t, p.isProbeDue("1.1.1.1:53", now.Add(time.Minute)))
+
+	// The backoff grows up to the maximum
+	for i := 0; i < 10; i++ {
+		p.updateUpstreamHealth("1.1.1.1:53", testErr, now)
+	}
+	assert.Equal(t, healthCheckMaxBackoff, p.upstreamLayer().health["1.1.1.1:53"].backoff)
+	assert.False(t, p.isProbeDue("1.1.1.1:53", now.Add(healthCheckMaxBackoff-time.Second)))
+
+	// A successful probe reinstates the upstream
+	p.updateUpstreamHealth("1.1.1.1:53", nil, now)
+	assert.Empty(t, p.downUpstreams())
+	assert.True(t, p.isProbeDue("1.1.1.1:53", now))
+}
+
+func TestHealthyUpstreams(t *testing.T) {
+	p := &Proxy{}
+	p.HealthCheckInterval = time.Minute
+	good := &healthTestUpstream{addr: "good"}
+	bad := &healthTestUpstream{addr: "bad", fail: true}
+	upstreams := []upstream.Upstream{bad, good}
+	p.UpstreamConfig = &UpstreamConfig{Upstreams: upstreams}
+
+	assert.Equal(t, upstreams, p.healthyUpstreams(upstreams))
+
+	for i := 0; i < healthCheckMaxFailures; i++ {
+		p.checkUpstreamsHealth(time.Now())
+	}
+	assert.Equal(t, []string{"bad"}, p.downUpstreams())
+	assert.Equal(t, []upstream.Upstream{good}, p.healthyUpstreams(upstreams))
+
+	// The down upstream isn't probed until the backoff is over
+	requests := atomic.LoadInt32(&bad.requests)
+	p.checkUpstreamsHealth(time.Now())
+	assert.Equal(t, requests, atomic.LoadInt32(&bad.requests))
+
+	// The down upstream isn't used for the exchange
+	_, u, err := p.exchange(createTestMessage(), upstreams)
+	assert.Nil(t, err)
+	assert.Equal(t, good, u)
+	assert.Equal(t, requests, atomic.LoadInt32(&bad.requests))
+
+	// If all the upstreams are down, use them anyway
+	onlyBad := []upstream.Upstream{bad}
+	assert.Equal(t, onlyBad, p.healthyUpstreams(onlyBad))
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// defaultLastResortThreshold is the time the upstreams and the fallbacks
+// must have been failing for before the last resort upstreams are used if
+// Config.LastResortThreshold isn't set
+const defaultLastResortThreshold = time.Minute
+
+// updateOutage records the result of an exchange with the regular upstreams
+// and the fallbacks and returns how long they have been failing
+func (p *Proxy) updateOutage(err error, now time.Time) time.Duration {
+	p.outageLock.Lock()
+	defer p.outageLock.Unlock()
+
+	if err == nil {
+		if !p.outageStart.IsZero() {
+			log.Info("upstreams have recovered after %s", now.Sub(p.outageStart))
+			p.outageStart = time.Time{}
+		}
+		return 0
+	}
+
+	if p.outageStart.IsZero() {
+		p.outageStart = now
+	}
+
+	return now.Sub(p.outageStart)
+}
+
+// isLastResortOutage checks if the regular upstreams and the fallbacks have
+// been failing for long enough to use the last resort upstreams
+func (p *Proxy) isLastResortOutage(outage time.Duration) bool {
+	threshold := p.LastResortThreshold
+	if threshold <= 0 {
+		threshold = defaultLastResortThreshold
+	}
+
+	return outage >= threshold
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateOutage(t *testing.T) {
+	p := &Proxy{}
+	now := time.Now()
+
+	assert.Equal(t, time.Duration(0), p.updateOutage(nil, now))
+	assert.Equal(t, time.Duration(0), p.updateOutage(assert.AnError, now))
+	assert.Equal(t, time.Minute, p.updateOutage(assert.AnError, now.Add(time.Minute)))
+
+	// A single success ends the outage
+	assert.Equal(t, time.Duration(0), p.updateOutage(nil, now.Add(2*time.Minute)))
+	assert.Equal(t, time.Duration(0), p.updateOutage(assert.AnError, now.Add(3*time.Minute)))
+}
+
+func TestLastResortUpstreams(t *testing.T) {
+	bad := &healthTestUpstream{addr: "bad", fail: true}
+	lastResort := &healthTestUpstream{addr: "last"}
+
+	p := &Proxy{}
+	p.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{bad}}
+	p.Fallbacks = []upstream.Upstream{bad}
+	p.LastResortUpstreams = []upstream.Upstream{lastResort}
+	p.LastResortThreshold = time.Hour
+
+	// The outage is too short
+	d := &DNSContext{Req: createTestMessage()}
+	err := p.Resolve(d)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&lastResort.requests))
+
+	// Pretend that the outage has lasted long enough
+	p.outageStart = time.Now().Add(-time.Hour)
+	d = &DNSContext{Req: createTestMessage()}
+	err = p.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lastResort.requests))
+	assert.Equal(t, lastResort, d.Upstream)
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+)
+
+// ListenerConfig is a group of listeners with their own settings.  The
+// settings that aren't set are taken from Config.  This allows a single proxy
+// instance to serve e.g. an unrestricted internal listener and a restricted
+// public one.
+type ListenerConfig struct {
+	UDPListenAddr   []*net.UDPAddr // if nil, then the group does not listen for UDP
+	TCPListenAddr   []*net.TCPAddr // if nil, then the group does not listen for TCP
+	TLSListenAddr   []*net.TCPAddr // if nil, then the group does not listen for TLS (DoT)
+	HTTPSListenAddr []*net.TCPAddr // if nil, then the group does not listen for HTTPS (DoH)
+
+	// RequestHandler is used instead of Config.RequestHandler if it's set
+	RequestHandler RequestHandler
+
+	// UpstreamConfig is used instead of Config.UpstreamConfig if it's set.
+	// It works the same way as DNSContext.CustomUpstreamConfig, so the
+	// responses from these upstreams aren't cached.
+	UpstreamConfig *UpstreamConfig
+
+	// Ratelimit is the max number of requests per second from a given IP.
+	// If 0, Config.Ratelimit is used, if negative, ratelimiting is disabled.
+	Ratelimit int
+
+	// ACL is used instead of Config.ACL if it's set
+	ACL *ACL
+
+	// QTypePolicy is used instead of Config.QTypePolicy if it's set
+	QTypePolicy QTypePolicy
+
+	// ClientMinTTL and ClientMaxTTL are used instead of Config.ClientMinTTL
+	// and Config.ClientMaxTTL if they're set
+	ClientMinTTL uint32
+	ClientMaxTTL uint32
+
+	// MaxMessageSize is used instead of Config.MaxMessageSize if it's set
+	MaxMessageSize int
+
+	// UpdateForward is used instead of Config.UpdateForward if it's set
+	UpdateForward *UpdateForward
+}
+
+// hasListenAddrs returns true if the group has any addresses to listen to
+func (lc *ListenerConfig) hasListenAddrs() bool {
+	return lc.UDPListenAddr != nil ||
+		lc.TCPListenAddr != nil ||
+		lc.TLSListenAddr != nil ||
+		lc.HTTPSListenAddr != nil
+}
+
+// setListenerConfig remembers the settings group of the listener l.  l must be
+// either a net.PacketConn or a net.Listener.
+func (p *Proxy) setListenerConfig(l interface{}, lc *ListenerConfig) {
+	if p.listenerConfigs == nil {
+		p.listenerConfigs = map[interface{}]*ListenerConfig{}
+	}
+	p.listenerConfigs[l] = lc
+}
+
+// requestHandler returns the request handler for the request or nil if the
+// request must be resolved with Resolve
+func (p *Proxy) requestHandler(d *DNSContext) RequestHandler {
+	if d.listener != nil && d.listener.RequestHandler != nil {
+		return d.listener.RequestHandler
+	}
+
+	return p.RequestHandler
+}
+
+// ratelimit returns the ratelimit for the request
+func (p *Proxy) ratelimit(d *DNSContext) int {
+	if d.listener != nil && d.listener.Ratelimit != 0 {
+		return d.listener.Ratelimit
+	}
+
+	return p.Ratelimit
+}
+
+// httpsHandler handles DoH requests on the listeners with their own settings
+type httpsHandler struct {
+	proxy    *Proxy
+	listener *ListenerConfig
+}
+
+// compile-time type check
+var _ http.Handler = &httpsHandler{}
+
+// ServeHTTP implements the http.Handler interface for *httpsHandler
+func (h *httpsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.proxy.serveHTTP(w, r, h.listener)
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenerConfig(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TCPListenAddr = nil
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	// The restricted listeners resolve the requests with their own upstream
+	u := &testUpstream{
+		aResp: &dns.A{
+			Hdr: dns.RR_Header{Rrtype: dns.TypeA, Name: "google-public-dns-a.google.com.", Class: dns.ClassINET, Ttl: 100},
+			A:   net.IP{1, 2, 3, 4},
+		},
+	}
+	lc := &ListenerConfig{
+		UDPListenAddr:  []*net.UDPAddr{{IP: net.ParseIP(listenIP)}},
+		TCPListenAddr:  []*net.TCPAddr{{IP: net.ParseIP(listenIP)}},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		RequestHandler: func(p *Proxy, d *DNSContext) error {
+			return p.Resolve(d)
+		},
+		Ratelimit:      1,
+		MaxMessageSize: 64,
+	}
+	dnsProxy.Listeners = []*ListenerConfig{lc}
+
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	udpAddrs := dnsProxy.Addrs(ProtoUDP)
+	assert.Len(t, udpAddrs, 2)
+	tcpAddrs := dnsProxy.Addrs(ProtoTCP)
+	assert.Len(t, tcpAddrs, 1)
+
+	// The global listener uses the global settings
+	client := &dns.Client{Net: "udp"}
+	for i := 0; i < 2; i++ {
+		res, _, err := client.Exchange(createTestMessage(), udpAddrs[0].String())
+		assert.Nil(t, err)
+		assert.Empty(t, res.Answer)
+	}
+
+	// The restricted one uses its own upstream and ratelimit
+	client.Timeout = defaultTimeout / 10
+	res, _, err := client.Exchange(createTestMessage(), udpAddrs[1].String())
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3.4", getIPFromResponse(res).String())
+	_, _, err = client.Exchange(createTestMessage(), udpAddrs[1].String())
+	assert.NotNil(t, err)
+
+	// And rejects too large requests
+	tcpClient := &dns.Client{Net: "tcp", Timeout: defaultTimeout / 10}
+	res, _, err = tcpClient.Exchange(createTestMessage(), tcpAddrs[0].String())
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3.4", getIPFromResponse(res).String())
+
+	req := createTestMessage()
+	req.SetEdns0(4096, true)
+	req.Extra = append(req.Extra, &dns.TXT{
+		Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{"too large to be accepted by the listener"},
+	})
+	res, _, err = tcpClient.Exchange(req, tcpAddrs[0].String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeFormatError, res.Rcode)
+	assert.Equal(t, req.Id, res.Id)
+}
+
+func TestListenerConfigValidation(t *testing.T) {
+	p := &Proxy{}
+	p.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{&testUpstream{}}}
+	p.Listeners = []*ListenerConfig{{}}
+	assert.NotNil(t, p.validateListenAddrs())
+
+	p.Listeners = []*ListenerConfig{{
+		TLSListenAddr: []*net.TCPAddr{{IP: net.ParseIP(listenIP)}},
+	}}
+	assert.NotNil(t, p.validateListenAddrs())
+
+	p.Listeners = []*ListenerConfig{{
+		UDPListenAddr: []*net.UDPAddr{{IP: net.ParseIP(listenIP)}},
+	}}
+	assert.Nil(t, p.validateListenAddrs())
+}
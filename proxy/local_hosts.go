@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// defaultLocalHostsTTL is the TTL of the local hosts responses if
+// LocalHosts.TTL isn't set
+const defaultLocalHostsTTL = 60
+
+// LocalHosts answers the A, AAAA, and PTR requests for the hosts registered
+// at runtime, e.g. from the DHCP leases, without sending them to the
+// upstreams.  It's safe for concurrent use.
+type LocalHosts struct {
+	// Domain is the local domain, e.g. "lan".  If set, the single-label
+	// hosts are also resolved within it, the PTR responses use the names
+	// within it, and the requests for the unknown names within it are
+	// answered with NXDOMAIN.
+	Domain string
+	// ReverseNets are the networks the PTR requests for the unknown
+	// addresses within are answered with NXDOMAIN, so that the private
+	// addresses don't leak to the upstreams.
+	ReverseNets []*net.IPNet
+	// TTL is the TTL of the responses, defaultLocalHostsTTL is used if 0.
+	TTL uint32
+
+	hosts map[string][]net.IP // host -> its addresses
+	ptrs  map[string]string   // reverse name of an address -> host
+	lock  sync.RWMutex
+}
+
+// Set replaces the addresses of the host.  If ips is empty, the host is
+// removed.  If an address is registered for several hosts, its PTR response
+// points to the last one.
+func (h *LocalHosts) Set(host string, ips ...net.IP) error {
+	host, err := normalizeLocalHost(host)
+	if err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.remove(host)
+	h.add(host, ips)
+
+	return nil
+}
+
+// Remove removes the host
+func (h *LocalHosts) Remove(host string) {
+	host, err := normalizeLocalHost(host)
+	if err != nil {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.remove(host)
+}
+
+// Replace replaces all the hosts at once, e.g. after a lease file is
+// reloaded.  Nothing is replaced if a host name is invalid.
+func (h *LocalHosts) Replace(hosts map[string][]net.IP) error {
+	normalized := make(map[string][]net.IP, len(hosts))
+	for host, ips := range hosts {
+		n, err := normalizeLocalHost(host)
+		if err != nil {
+			return err
+		}
+		normalized[n] = append(normalized[n], ips...)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.hosts = nil
+	h.ptrs = nil
+	for host, ips := range normalized {
+		h.add(host, ips)
+	}
+
+	return nil
+}
+
+// Lookup returns the addresses of the host
+func (h *LocalHosts) Lookup(host string) []net.IP {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return h.lookup(host)
+}
+
+// add adds the addresses of the host.  h.lock is expected to be locked.
+func (h *LocalHosts) add(host string, ips []net.IP) {
+	if len(ips) == 0 {
+		return
+	}
+
+	if h.hosts == nil {
+		h.hosts = map[string][]net.IP{}
+		h.ptrs = map[string]string{}
+	}
+
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		h.hosts[host] = append(h.hosts[host], ip)
+
+		ptr, err := dns.ReverseAddr(ip.String())
+		if err == nil {
+			h.ptrs[ptr] = host
+		}
+	}
+}
+
+// remove removes the host and its PTR records.  h.lock is expected to be
+// locked.
+func (h *LocalHosts) remove(host string) {
+	for _, ip := range h.hosts[host] {
+		ptr, err := dns.ReverseAddr(ip.String())
+		if err == nil && h.ptrs[ptr] == host {
+			delete(h.ptrs, ptr)
+		}
+	}
+	delete(h.hosts, host)
+}
+
+// lookup returns the addresses of the host taking the local domain into
+// account.  h.lock is expected to be locked.
+func (h *LocalHosts) lookup(host string) []net.IP {
+	if ips, ok := h.hosts[host]; ok {
+		return ips
+	}
+
+	if h.Domain != "" {
+		if name := strings.TrimSuffix(host, "."+h.Domain); name != host && !strings.Contains(name, ".") {
+			return h.hosts[name]
+		}
+	}
+
+	return nil
+}
+
+// inDomain returns true if the host is within the local domain
+func (h *LocalHosts) inDomain(host string) bool {
+	return h.Domain != "" && (host == h.Domain || strings.HasSuffix(host, "."+h.Domain))
+}
+
+// inReverseNets returns true if the reverse name is within ReverseNets
+func (h *LocalHosts) inReverseNets(name string) bool {
+	ip := reverseNameToIP(name)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range h.ReverseNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// response returns the response to the request or nil if the request isn't
+// for a local host.  h may be nil, nothing is answered then.
+func (h *LocalHosts) response(req *dns.Msg) *dns.Msg {
+	if h == nil {
+		return nil
+	}
+
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+
+	ttl := h.TTL
+	if ttl == 0 {
+		ttl = defaultLocalHostsTTL
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	var answer []dns.RR
+	if ptrHost, ok := h.ptrs[host+"."]; ok {
+		if q.Qtype == dns.TypePTR {
+			answer = append(answer, &dns.PTR{Hdr: hdr, Ptr: dns.Fqdn(h.fqdn(ptrHost))})
+		}
+	} else if ips := h.lookup(host); ips != nil {
+		for _, ip := range ips {
+			if ip4 := ip.To4(); q.Qtype == dns.TypeA && ip4 != nil {
+				answer = append(answer, &dns.A{Hdr: hdr, A: ip4})
+			} else if q.Qtype == dns.TypeAAAA && ip.To4() == nil {
+				answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	} else if h.inDomain(host) || h.inReverseNets(host) {
+		return GenEmptyMessage(req, dns.RcodeNameError, ttl)
+	} else {
+		return nil
+	}
+
+	if len(answer) == 0 {
+		return GenEmptyMessage(req, dns.RcodeSuccess, ttl)
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	resp.Answer = answer
+	return resp
+}
+
+// fqdn returns the name of the host within the local domain
+func (h *LocalHosts) fqdn(host string) string {
+	if h.Domain != "" && !strings.Contains(host, ".") {
+		return host + "." + h.Domain
+	}
+
+	return host
+}
+
+// normalizeLocalHost validates the host name and converts it to lower case
+// without the trailing dot.  Only the letters, the digits, "-", and "_" are
+// allowed in the labels.
+func normalizeLocalHost(host string) (string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if _, ok := dns.IsDomainName(host); !ok || host == "" || net.ParseIP(host) != nil {
+		return "", fmt.Errorf("invalid host name %q", host)
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" {
+			return "", fmt.Errorf("invalid host name %q", host)
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", fmt.Errorf("invalid host name %q", host)
+			}
+		}
+	}
+
+	return host, nil
+}
+
+// reverseNameToIP parses the in-addr.arpa or ip6.arpa name of an address
+// without the trailing dot.  It returns nil if the name isn't a reverse
+// name of a whole address.
+func reverseNameToIP(name string) net.IP {
+	if labels := strings.TrimSuffix(name, ".in-addr.arpa"); labels != name {
+		parts := strings.Split(labels, ".")
+		if len(parts) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+		return net.ParseIP(strings.Join(parts, ".")).To4()
+	}
+
+	if labels := strings.TrimSuffix(name, ".ip6.arpa"); labels != name {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+
+		var b strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil
+			}
+			b.WriteString(nibbles[i])
+			if i%4 == 0 && i != 0 {
+				b.WriteByte(':')
+			}
+		}
+		return net.ParseIP(b.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func newLocalHostsReq(name string, qtype uint16) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	return req
+}
+
+func TestLocalHosts(t *testing.T) {
+	_, reverseNet, err := net.ParseCIDR("192.168.1.0/24")
+	assert.Nil(t, err)
+	h := &LocalHosts{Domain: "lan", ReverseNets: []*net.IPNet{reverseNet}}
+
+	assert.Nil(t, h.Set("Laptop", net.ParseIP("192.168.1.23"), net.ParseIP("fd00::23")))
+	assert.Nil(t, h.Set("printer.lan.", net.ParseIP("192.168.1.30")))
+	assert.NotNil(t, h.Set("bad host"))
+	assert.NotNil(t, h.Set("192.168.1.1"))
+
+	resp := h.response(newLocalHostsReq("laptop.", dns.TypeA))
+	assert.Equal(t, "192.168.1.23", getIPFromResponse(resp).String())
+	assert.True(t, resp.Authoritative)
+	resp = h.response(newLocalHostsReq("LAPTOP.lan.", dns.TypeAAAA))
+	assert.Equal(t, "fd00::23", resp.Answer[0].(*dns.AAAA).AAAA.String())
+	assert.Equal(t, "LAPTOP.lan.", resp.Answer[0].Header().Name)
+	resp = h.response(newLocalHostsReq("printer.lan.", dns.TypeAAAA))
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+
+	// PTR
+	resp = h.response(newLocalHostsReq("23.1.168.192.in-addr.arpa.", dns.TypePTR))
+	assert.Equal(t, "laptop.lan.", resp.Answer[0].(*dns.PTR).Ptr)
+	ptr, err := dns.ReverseAddr("fd00::23")
+	assert.Nil(t, err)
+	resp = h.response(newLocalHostsReq(ptr, dns.TypePTR))
+	assert.Equal(t, "laptop.lan.", resp.Answer[0].(*dns.PTR).Ptr)
+	resp = h.response(newLocalHostsReq("30.1.168.192.in-addr.arpa.", dns.TypePTR))
+	assert.Equal(t, "printer.lan.", resp.Answer[0].(*dns.PTR).Ptr)
+
+	// The unknown names within the local domain and the reverse networks
+	resp = h.response(newLocalHostsReq("unknown.lan.", dns.TypeA))
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	resp = h.response(newLocalHostsReq("99.1.168.192.in-addr.arpa.", dns.TypePTR))
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Nil(t, h.response(newLocalHostsReq("99.2.168.192.in-addr.arpa.", dns.TypePTR)))
+	assert.Nil(t, h.response(newLocalHostsReq("example.org.", dns.TypeA)))
+
+	// The moved address points to the new host
+	assert.Nil(t, h.Set("desktop", net.ParseIP("192.168.1.23")))
+	resp = h.response(newLocalHostsReq("23.1.168.192.in-addr.arpa.", dns.TypePTR))
+	assert.Equal(t, "desktop.lan.", resp.Answer[0].(*dns.PTR).Ptr)
+	h.Remove("laptop")
+	resp = h.response(newLocalHostsReq("23.1.168.192.in-addr.arpa.", dns.TypePTR))
+	assert.Equal(t, "desktop.lan.", resp.Answer[0].(*dns.PTR).Ptr)
+	resp = h.response(newLocalHostsReq(ptr, dns.TypePTR))
+	assert.Nil(t, resp)
+
+	assert.Nil(t, h.Replace(map[string][]net.IP{"nas": {net.ParseIP("192.168.1.10")}}))
+	assert.Nil(t, h.Lookup("desktop"))
+	assert.Equal(t, []net.IP{net.ParseIP("192.168.1.10").To4()}, h.Lookup("nas.lan."))
+	assert.NotNil(t, h.Replace(map[string][]net.IP{"bad host": nil}))
+	assert.NotNil(t, h.Lookup("nas"))
+
+	var nilHosts *LocalHosts
+	assert.Nil(t, nilHosts.response(newLocalHostsReq("nas.", dns.TypeA)))
+}
+
+func TestReverseNameToIP(t *testing.T) {
+	testCases := map[string]string{
+		"1.2.168.192.in-addr.arpa": "192.168.2.1",
+		"2.168.192.in-addr.arpa":   "<nil>",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa": "fd00::1",
+		"0.0.d.f.ip6.arpa": "<nil>",
+		"example.org":      "<nil>",
+	}
+
+	for name, ip := range testCases {
+		assert.Equal(t, ip, reverseNameToIP(name).String(), name)
+	}
+}
+
+func TestLocalHostsProxy(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TCPListenAddr = nil
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+	dnsProxy.LocalHosts = &LocalHosts{Domain: "lan"}
+	assert.Nil(t, dnsProxy.LocalHosts.Set("nas", net.ParseIP("192.168.1.10")))
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "filter.txt")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("||lan^\n"), 0o644))
+	dnsProxy.Blocklist = &Blocklist{Sources: []string{path}}
+
+	err = dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	client := &dns.Client{Net: "udp"}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	// The local hosts aren't blocked
+	res, _, err := client.Exchange(newLocalHostsReq("nas.lan.", dns.TypeA), addr)
+	assert.Nil(t, err)
+	assert.Equal(t, "192.168.1.10", getIPFromResponse(res).String())
+
+	res, _, err = client.Exchange(createTestMessage(), addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+
+	stats := dnsProxy.Stats()
+	assert.Equal(t, uint64(2), stats.Responses[ResponseClassLocal.String()])
+}
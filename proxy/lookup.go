@@ -17,7 +17,7 @@ type lookupResult struct {
 
 func (p *Proxy) lookupIPAddr(host string, qtype uint16, ch chan *lookupResult) {
 	req := dns.Msg{}
-	req.Id = dns.Id()
+	req.Id = p.newMsgID()
 	req.RecursionDesired = true
 	req.Question = []dns.Question{
 		{
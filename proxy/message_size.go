@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// ClientMessageSizeLimit is the max size of the requests from the clients
+// within a subnet
+type ClientMessageSizeLimit struct {
+	Net     *net.IPNet
+	MaxSize int
+}
+
+// dnsHeaderLen is the length of the DNS message header
+const dnsHeaderLen = 12
+
+// maxMessageSize returns the max size of the request from the client with the
+// address addr received on the listener with the settings lc, which may be
+// nil.  The limit of the client's subnet takes precedence over the one of the
+// listener, which takes precedence over Config.MaxMessageSize.  0 means no
+// limit.
+func (p *Proxy) maxMessageSize(lc *ListenerConfig, addr net.Addr) int {
+	if len(p.ClientMessageSizeLimits) > 0 {
+		ip, _ := addrIPPort(addr)
+		for _, l := range p.ClientMessageSizeLimits {
+			if ip != nil && l.Net.Contains(ip) {
+				return l.MaxSize
+			}
+		}
+	}
+
+	if lc != nil && lc.MaxMessageSize > 0 {
+		return lc.MaxMessageSize
+	}
+
+	return p.MaxMessageSize
+}
+
+// udpBufSize returns the size of the buffers the UDP requests are read into.
+// It fits the requests of the largest of the max sizes, see maxMessageSize,
+// and one more byte, so that the larger requests are answered with FORMERR.
+// The requests that don't fit are dropped.
+func (p *Proxy) udpBufSize() int {
+	limits := []int{p.MaxMessageSize}
+	for _, lc := range p.Listeners {
+		if lc.MaxMessageSize > 0 {
+			limits = append(limits, lc.MaxMessageSize)
+		}
+	}
+	for _, l := range p.ClientMessageSizeLimits {
+		limits = append(limits, l.MaxSize)
+	}
+
+	size := 0
+	for _, l := range limits {
+		if l <= 0 || l >= dns.MaxMsgSize {
+			return dns.MaxMsgSize
+		}
+
+		if l+1 > size {
+			size = l + 1
+		}
+	}
+
+	return size
+}
+
+// isTooLarge returns true if the request of size n from the client with the
+// address addr exceeds its max size, see maxMessageSize
+func (p *Proxy) isTooLarge(lc *ListenerConfig, addr net.Addr, n int) bool {
+	max := p.maxMessageSize(lc, addr)
+	return max > 0 && n > max
+}
+
+// rejectTooLarge answers the too large request packet with FORMERR.  Only the
+// header of the packet is parsed, so the response has no question section.
+// d must have the connection fields set, the packets that aren't requests and
+// the ones of the clients denied by the ACL or ratelimited are dropped.
+func (p *Proxy) rejectTooLarge(d *DNSContext, packet []byte) {
+	if len(packet) < dnsHeaderLen {
+		return
+	}
+
+	flags := binary.BigEndian.Uint16(packet[2:])
+	if flags&(1<<15) != 0 {
+		// Never answer the responses
+		return
+	}
+
+	if !p.isAllowedEarly(d) {
+		log.Tracef("Dropping too large request from %s", d.Addr)
+		return
+	}
+
+	p.stats.incRequests()
+
+	d.StartTime = time.Now()
+	d.Req = &dns.Msg{}
+	d.Req.Id = binary.BigEndian.Uint16(packet)
+	d.Req.Opcode = int(flags>>11) & 0xF
+	d.Req.RecursionDesired = flags&(1<<8) != 0
+
+	d.Res = &dns.Msg{}
+	d.Res.SetRcode(d.Req, dns.RcodeFormatError)
+	d.ResponseClass = ResponseClassBlocked
+	p.respond(d)
+
+	p.stats.incResponse(d)
+}
+
+// ParseClientMessageSizeLimit parses the max message size of the clients in
+// the "subnet=size" form, e.g. "192.168.0.0/16=4096".  A single IP address is
+// a subnet as well.
+func ParseClientMessageSizeLimit(s string) (l ClientMessageSizeLimit, err error) {
+	i := strings.LastIndexByte(s, '=')
+	if i <= 0 {
+		return l, fmt.Errorf("invalid client message size limit %q: expected subnet=size", s)
+	}
+
+	nets, err := ParseSubnets([]string{s[:i]})
+	if err != nil {
+		return l, fmt.Errorf("invalid client message size limit %q: %w", s, err)
+	}
+
+	size, err := strconv.Atoi(s[i+1:])
+	if err != nil || size < 0 {
+		return l, fmt.Errorf("invalid client message size limit %q: bad size", s)
+	}
+
+	return ClientMessageSizeLimit{Net: nets[0], MaxSize: size}, nil
+}
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxMessageSize(t *testing.T) {
+	p := &Proxy{}
+	lc := &ListenerConfig{MaxMessageSize: 1024}
+	local, err := ParseClientMessageSizeLimit("192.168.0.0/16=4096")
+	assert.Nil(t, err)
+	trusted, err := ParseClientMessageSizeLimit("10.0.0.1=0")
+	assert.Nil(t, err)
+
+	public := &net.UDPAddr{IP: net.IP{198, 51, 100, 1}}
+	assert.Equal(t, 0, p.maxMessageSize(nil, public))
+
+	p.MaxMessageSize = 512
+	p.ClientMessageSizeLimits = []ClientMessageSizeLimit{local, trusted}
+	assert.Equal(t, 512, p.maxMessageSize(nil, public))
+	assert.Equal(t, 1024, p.maxMessageSize(lc, public))
+	assert.Equal(t, 4096, p.maxMessageSize(lc, &net.TCPAddr{IP: net.IP{192, 168, 1, 1}}))
+	assert.Equal(t, 0, p.maxMessageSize(lc, &net.TCPAddr{IP: net.IP{10, 0, 0, 1}}))
+
+	assert.True(t, p.isTooLarge(nil, public, 513))
+	assert.False(t, p.isTooLarge(nil, public, 512))
+	assert.False(t, p.isTooLarge(nil, &net.TCPAddr{IP: net.IP{10, 0, 0, 1}}, dns.MaxMsgSize))
+}
+
+func TestUDPBufSize(t *testing.T) {
+	local, err := ParseClientMessageSizeLimit("192.168.0.0/16=4096")
+	assert.Nil(t, err)
+	trusted, err := ParseClientMessageSizeLimit("10.0.0.1=0")
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		name    string
+		conf    Config
+		bufSize int
+	}{{
+		name:    "no_limit",
+		conf:    Config{},
+		bufSize: dns.MaxMsgSize,
+	}, {
+		name:    "limit",
+		conf:    Config{MaxMessageSize: 512},
+		bufSize: 513,
+	}, {
+		name: "listener_limit",
+		conf: Config{
+			MaxMessageSize: 512,
+			Listeners:      []*ListenerConfig{{MaxMessageSize: 1024}, {}},
+		},
+		bufSize: 1025,
+	}, {
+		name: "client_limit",
+		conf: Config{
+			MaxMessageSize:          512,
+			ClientMessageSizeLimits: []ClientMessageSizeLimit{local},
+		},
+		bufSize: 4097,
+	}, {
+		name: "client_no_limit",
+		conf: Config{
+			MaxMessageSize:          512,
+			ClientMessageSizeLimits: []ClientMessageSizeLimit{local, trusted},
+		},
+		bufSize: dns.MaxMsgSize,
+	}}
+
+	for _, tc := range testCases {
+		p := &Proxy{Config: tc.conf}
+		assert.Equal(t, tc.bufSize, p.udpBufSize(), tc.name)
+	}
+}
+
+func TestLargeRequestUDP(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	// The request larger than dns.DefaultMsgSize
+	req := createTestMessage()
+	for i := 0; i < 20; i++ {
+		req.Extra = append(req.Extra, &dns.TXT{
+			Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{string(bytes.Repeat([]byte{'a'}, 255))},
+		})
+	}
+	packed, err := req.Pack()
+	assert.Nil(t, err)
+	assert.Greater(t, len(packed), dns.DefaultMsgSize)
+
+	client := &dns.Client{Net: "udp", Timeout: time.Second, UDPSize: dns.MaxMsgSize}
+	res, _, err := client.Exchange(req, dnsProxy.Addr(ProtoUDP).String())
+	assert.Nil(t, err)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	}
+}
+
+func TestParseClientMessageSizeLimit(t *testing.T) {
+	l, err := ParseClientMessageSizeLimit("2001:db8::/32=1232")
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::/32", l.Net.String())
+	assert.Equal(t, 1232, l.MaxSize)
+
+	for _, s := range []string{"", "192.168.0.0/16", "=512", "192.168.0.0/16=x", "192.168.0.0/16=-1", "host=512"} {
+		_, err = ParseClientMessageSizeLimit(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+// newLargeRequest returns a request that is larger than 512 bytes
+func newLargeRequest() *dns.Msg {
+	req := createTestMessage()
+	req.Extra = append(req.Extra, &dns.TXT{
+		Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{string(bytes.Repeat([]byte{'a'}, 255)), string(bytes.Repeat([]byte{'b'}, 255))},
+	})
+
+	return req
+}
+
+func TestMaxMessageSizeUDP(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.MaxMessageSize = 512
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	client := &dns.Client{Net: "udp", Timeout: time.Second, UDPSize: dns.MaxMsgSize}
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	res, _, err := client.Exchange(createTestMessage(), addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+
+	req := newLargeRequest()
+	res, _, err = client.Exchange(req, addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeFormatError, res.Rcode)
+	assert.Equal(t, req.Id, res.Id)
+	assert.Empty(t, res.Question)
+
+	assert.Equal(t, uint64(1), dnsProxy.Stats().Responses[ResponseClassBlocked.String()])
+}
+
+func TestMaxMessageSizeACL(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.MaxMessageSize = 512
+	dnsProxy.Ratelimit = 1
+
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	// The too large UDP requests are ratelimited
+	client := &dns.Client{Net: "udp", Timeout: 500 * time.Millisecond, UDPSize: dns.MaxMsgSize}
+	res, _, err := client.Exchange(newLargeRequest(), dnsProxy.Addr(ProtoUDP).String())
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeFormatError, res.Rcode)
+	}
+	_, _, err = client.Exchange(newLargeRequest(), dnsProxy.Addr(ProtoUDP).String())
+	assert.NotNil(t, err)
+
+	// The clients denied by the ACL get no response
+	aclProxy := createTestProxy(t, nil)
+	aclProxy.MaxMessageSize = 512
+	aclProxy.ACL, err = ParseACL(nil, []string{listenIP})
+	assert.Nil(t, err)
+	assert.Nil(t, aclProxy.Start())
+	defer func() {
+		assert.Nil(t, aclProxy.Stop())
+	}()
+
+	client.Net = "tcp"
+	_, _, err = client.Exchange(newLargeRequest(), aclProxy.Addr(ProtoTCP).String())
+	assert.NotNil(t, err)
+}
+
+func TestMaxMessageSizeHTTPS(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.MaxMessageSize = 512
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+	assert.Nil(t, dnsProxy.Init())
+
+	serve := func(m *dns.Msg) int {
+		packed, err := m.Pack()
+		assert.Nil(t, err)
+
+		r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packed))
+		r.Header.Set("Content-Type", "application/dns-message")
+		w := httptest.NewRecorder()
+		dnsProxy.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(createTestMessage()))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve(newLargeRequest()))
+
+	// The bodies larger than any DNS message aren't read completely
+	dnsProxy.MaxMessageSize = 0
+	r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(make([]byte, 2*dns.MaxMsgSize)))
+	r.Header.Set("Content-Type", "application/dns-message")
+	w := httptest.NewRecorder()
+	dnsProxy.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
@@ -0,0 +1,83 @@
+package proxy
+
+// MetadataKey is the key of a DNSContext metadata value.  The keys are
+// compared by identity, so that the independent middleware can't overwrite
+// the values of each other even if they use the same names.  Create the keys
+// once, e.g. as package variables:
+//
+//	var geoCountryKey = proxy.NewMetadataKey("geo.country")
+type MetadataKey struct {
+	name string
+}
+
+// NewMetadataKey returns a new unique metadata key.  name is only used for
+// debugging.
+func NewMetadataKey(name string) *MetadataKey {
+	return &MetadataKey{name: name}
+}
+
+// String implements the fmt.Stringer interface for *MetadataKey
+func (k *MetadataKey) String() string {
+	return k.name
+}
+
+// metadataEntry is a key-value pair of the DNSContext metadata
+type metadataEntry struct {
+	key   *MetadataKey
+	value interface{}
+}
+
+// initialMetadataCap is the initial capacity of the DNSContext metadata.
+// There are only a few values per request, so a slice is cheaper than a map.
+const initialMetadataCap = 4
+
+// SetMeta sets the metadata value of the request for the key, replacing the
+// previous one
+func (ctx *DNSContext) SetMeta(key *MetadataKey, value interface{}) {
+	for i := range ctx.metadata {
+		if ctx.metadata[i].key == key {
+			ctx.metadata[i].value = value
+			return
+		}
+	}
+
+	if ctx.metadata == nil {
+		ctx.metadata = make([]metadataEntry, 0, initialMetadataCap)
+	}
+	ctx.metadata = append(ctx.metadata, metadataEntry{key: key, value: value})
+}
+
+// Meta returns the metadata value of the request for the key.  ok is false if
+// there is none.
+func (ctx *DNSContext) Meta(key *MetadataKey) (value interface{}, ok bool) {
+	for _, e := range ctx.metadata {
+		if e.key == key {
+			return e.value, true
+		}
+	}
+
+	return nil, false
+}
+
+// DeleteMeta removes the metadata value of the request for the key
+func (ctx *DNSContext) DeleteMeta(key *MetadataKey) {
+	for i, e := range ctx.metadata {
+		if e.key == key {
+			last := len(ctx.metadata) - 1
+			ctx.metadata[i] = ctx.metadata[last]
+			ctx.metadata[last] = metadataEntry{}
+			ctx.metadata = ctx.metadata[:last]
+			return
+		}
+	}
+}
+
+// RangeMeta calls f for each metadata value of the request in no particular
+// order until f returns false.  f must not change the metadata.
+func (ctx *DNSContext) RangeMeta(f func(key *MetadataKey, value interface{}) (cont bool)) {
+	for _, e := range ctx.metadata {
+		if !f(e.key, e.value) {
+			return
+		}
+	}
+}
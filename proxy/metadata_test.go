@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSContextMeta(t *testing.T) {
+	country := NewMetadataKey("geo.country")
+	user := NewMetadataKey("auth.user")
+	// The keys with the same name are still different
+	otherCountry := NewMetadataKey("geo.country")
+	assert.Equal(t, "geo.country", otherCountry.String())
+
+	d := &DNSContext{}
+	_, ok := d.Meta(country)
+	assert.False(t, ok)
+
+	d.SetMeta(country, "NL")
+	d.SetMeta(user, 42)
+	v, ok := d.Meta(country)
+	assert.True(t, ok)
+	assert.Equal(t, "NL", v)
+	_, ok = d.Meta(otherCountry)
+	assert.False(t, ok)
+
+	d.SetMeta(country, "DE")
+	v, _ = d.Meta(country)
+	assert.Equal(t, "DE", v)
+
+	var n int
+	d.RangeMeta(func(key *MetadataKey, value interface{}) bool {
+		n++
+		return false
+	})
+	assert.Equal(t, 1, n)
+
+	d.DeleteMeta(country)
+	_, ok = d.Meta(country)
+	assert.False(t, ok)
+	v, ok = d.Meta(user)
+	assert.True(t, ok)
+	assert.Equal(t, 42, v)
+
+	// Deleting the missing key is a no-op
+	d.DeleteMeta(otherCountry)
+	assert.Len(t, d.metadata, 1)
+}
+
+func TestDNSContextMetaHandlers(t *testing.T) {
+	geo := NewMetadataKey("geo.country")
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.BeforeRequestHandler = func(p *Proxy, d *DNSContext) (bool, error) {
+		d.SetMeta(geo, "NL")
+		return true, nil
+	}
+
+	got := make(chan interface{}, 1)
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		v, _ := d.Meta(geo)
+		got <- v
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	client := &dns.Client{Net: "udp"}
+	_, _, err := client.Exchange(createTestMessage(), dnsProxy.Addr(ProtoUDP).String())
+	assert.Nil(t, err)
+	assert.Equal(t, "NL", <-got)
+}
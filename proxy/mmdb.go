@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// mmdbMetadataMarker separates the metadata of a MaxMind DB file from the
+// data section
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const (
+	// mmdbDataSectionSeparator is the number of the zero bytes between the
+	// search tree and the data section
+	mmdbDataSectionSeparator = 16
+
+	// mmdbMaxDepth is the max nesting of the decoded values, it protects
+	// from the pointer loops in the corrupted files
+	mmdbMaxDepth = 32
+)
+
+// The MaxMind DB data field types
+const (
+	mmdbExtended  = 0
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+// errMMDBInvalid is returned when the MaxMind DB file is corrupted
+var errMMDBInvalid = errors.New("invalid MaxMind DB data")
+
+// mmdbReader looks up the IP addresses in a MaxMind DB file, e.g. GeoLite2
+// City, see https://maxmind.github.io/MaxMind-DB/
+type mmdbReader struct {
+	tree       []byte      // binary search tree
+	data       mmdbDecoder // data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // node of the IPv4 addresses in an IPv6 tree
+}
+
+// newMMDBReader parses the contents of a MaxMind DB file
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+
+	v, _, err := mmdbDecoder(buf[i+len(mmdbMetadataMarker):]).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("decoding metadata: %w", err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errMMDBInvalid
+	}
+
+	r := &mmdbReader{
+		nodeCount:  mmdbMetaUint(meta, "node_count"),
+		recordSize: mmdbMetaUint(meta, "record_size"),
+		ipVersion:  mmdbMetaUint(meta, "ip_version"),
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", r.ipVersion)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+mmdbDataSectionSeparator > uint(i) {
+		return nil, errMMDBInvalid
+	}
+	r.tree = buf[:treeSize]
+	r.data = mmdbDecoder(buf[treeSize+mmdbDataSectionSeparator : i])
+
+	if r.ipVersion == 6 {
+		for n := 0; n < 96 && r.ipv4Start < r.nodeCount; n++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+
+	return r, nil
+}
+
+// record returns the left (bit 0) or the right (bit 1) record of the node
+func (r *mmdbReader) record(node, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+bit*4:]))
+	}
+}
+
+// lookup returns the data of the network ip belongs to or nil if there is
+// none
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(ip[i/8]>>(7-uint(i%8))&1))
+	}
+
+	if node == r.nodeCount {
+		return nil, nil
+	} else if node < r.nodeCount {
+		return nil, errMMDBInvalid
+	}
+
+	v, _, err := r.data.decode(node-r.nodeCount-mmdbDataSectionSeparator, 0)
+	return v, err
+}
+
+// mmdbDecoder decodes the values of the MaxMind DB data section.  The maps
+// are decoded to map[string]interface{}, the arrays to []interface{}, the
+// unsigned integers to uint64, and the floating point numbers to float64.
+type mmdbDecoder []byte
+
+// decode decodes the value at off and returns it with the offset of the next
+// one
+func (d mmdbDecoder) decode(off uint, depth int) (v interface{}, next uint, err error) {
+	if depth > mmdbMaxDepth || off >= uint(len(d)) {
+		return nil, 0, errMMDBInvalid
+	}
+
+	ctrl := d[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == mmdbPointer {
+		var ptr uint
+		ptr, off, err = d.pointer(ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err = d.decode(ptr, depth+1)
+		return v, off, err
+	}
+
+	if typ == mmdbExtended {
+		if off >= uint(len(d)) {
+			return nil, 0, errMMDBInvalid
+		}
+		typ = 7 + uint(d[off])
+		off++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(d)) {
+			return nil, 0, errMMDBInvalid
+		}
+		size = []uint{29, 285, 65821}[n-1] + mmdbUint(d[off:off+n])
+		off += n
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key interface{}
+			key, off, err = d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBInvalid
+			}
+
+			m[k], off, err = d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case mmdbArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			a[i], off, err = d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, off, nil
+	case mmdbBool:
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(d)) {
+		return nil, 0, errMMDBInvalid
+	}
+	b := []byte(d[off : off+size])
+	off += size
+
+	switch typ {
+	case mmdbString:
+		return string(b), off, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBInvalid
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBInvalid
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		return uint64(mmdbUint(b)), off, nil
+	case mmdbInt32:
+		return int32(mmdbUint(b)), off, nil
+	case mmdbBytes, mmdbUint128:
+		return append([]byte(nil), b...), off, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported MaxMind DB data type %d", typ)
+	}
+}
+
+// pointer decodes the pointer with the control byte ctrl which data starts
+// at off and returns its offset in the data section and the offset of the
+// next value
+func (d mmdbDecoder) pointer(ctrl byte, off uint) (ptr, next uint, err error) {
+	ss := uint(ctrl>>3) & 0x3
+	vvv := uint(ctrl & 0x7)
+	n := ss + 1
+	if off+n > uint(len(d)) {
+		return 0, 0, errMMDBInvalid
+	}
+
+	ptr = mmdbUint(d[off : off+n])
+	switch ss {
+	case 0:
+		ptr |= vvv << 8
+	case 1:
+		ptr = ptr | vvv<<16 + 2048
+	case 2:
+		ptr = ptr | vvv<<24 + 526336
+	}
+
+	return ptr, off + n, nil
+}
+
+// mmdbUint returns the big-endian unsigned integer in b
+func mmdbUint(b []byte) uint {
+	var n uint
+	for _, c := range b {
+		n = n<<8 | uint(c)
+	}
+
+	return n
+}
+
+// mmdbMetaUint returns the unsigned integer metadata field or 0 if there is
+// none
+func mmdbMetaUint(meta map[string]interface{}, key string) uint {
+	n, _ := meta[key].(uint64)
+
+	return uint(n)
+}
@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspFetchTimeout is the timeout of a request to an OCSP responder
+	ocspFetchTimeout = 10 * time.Second
+	// ocspMaxResponseSize is the maximum size of an OCSP response
+	ocspMaxResponseSize = 64 * 1024
+	// ocspRetryInterval is the interval between the attempts to fetch an
+	// OCSP response after a failure
+	ocspRetryInterval = 5 * time.Minute
+	// ocspMinRefreshInterval is the minimum interval between the refreshes
+	// of an OCSP response
+	ocspMinRefreshInterval = time.Minute
+	// ocspMaxRefreshInterval is the refresh interval of the OCSP responses
+	// without the next update time
+	ocspMaxRefreshInterval = 24 * time.Hour
+)
+
+// stapledCert is a certificate with its OCSP response
+type stapledCert struct {
+	leaf   *x509.Certificate // parsed leaf certificate
+	issuer *x509.Certificate // parsed issuer of the leaf certificate
+
+	staple     []byte    // DER-encoded OCSP response, nil if there is none
+	nextUpdate time.Time // time the staple expires, zero if never
+	refreshAt  time.Time // time the staple must be refreshed
+}
+
+// ocspStapler keeps the OCSP responses for the certificates of a TLS config
+// and staples them using GetConfigForClient
+type ocspStapler struct {
+	base   *tls.Config // copy of the original TLS config
+	certs  []*stapledCert
+	client *http.Client
+
+	config *tls.Config // base with the stapled certificates
+	lock   sync.RWMutex
+
+	stop chan struct{} // closed to stop the refresh loop, nil if it's not running
+}
+
+// newOCSPStapler returns a new OCSP stapler for the certificates of conf.
+// The certificates without the OCSP responders or the issuers are served
+// without the staples.
+func newOCSPStapler(conf *tls.Config) *ocspStapler {
+	s := &ocspStapler{
+		base:   conf.Clone(),
+		client: &http.Client{Timeout: ocspFetchTimeout},
+	}
+	s.config = s.base
+
+	for _, cert := range conf.Certificates {
+		sc, err := newStapledCert(cert)
+		if err != nil {
+			log.Info("OCSP stapling is disabled for a certificate: %s", err)
+			continue
+		}
+		s.certs = append(s.certs, sc)
+	}
+
+	return s
+}
+
+// newStapledCert parses the leaf certificate and its issuer
+func newStapledCert(cert tls.Certificate) (*stapledCert, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, fmt.Errorf("the chain has no issuer")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't parse the certificate")
+	}
+
+	if len(leaf.OCSPServer) == 0 {
+		return nil, fmt.Errorf("%s has no OCSP responder", leaf.Subject)
+	}
+
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't parse the issuer of %s", leaf.Subject)
+	}
+
+	// The staple set by the user is served until a new one is fetched
+	return &stapledCert{leaf: leaf, issuer: issuer, staple: cert.OCSPStaple}, nil
+}
+
+// refresh fetches the OCSP responses that must be refreshed by now and
+// returns the time of the next refresh
+func (s *ocspStapler) refresh(now time.Time) time.Time {
+	next := now.Add(ocspMaxRefreshInterval)
+	changed := false
+	for _, sc := range s.certs {
+		if !sc.refreshAt.After(now) {
+			changed = true
+			err := s.fetch(sc, now)
+			if err != nil {
+				log.Error("couldn't refresh the OCSP response for %s: %s", sc.leaf.Subject, err)
+				sc.refreshAt = now.Add(ocspRetryInterval)
+			}
+		}
+
+		// The expired responses must not be stapled
+		if sc.staple != nil && !sc.nextUpdate.IsZero() && !now.Before(sc.nextUpdate) {
+			changed = true
+			sc.staple = nil
+		}
+
+		if sc.refreshAt.Before(next) {
+			next = sc.refreshAt
+		}
+	}
+
+	if changed {
+		s.update()
+	}
+
+	return next
+}
+
+// fetch requests the OCSP response for sc from its responders.  The staple
+// of sc is only replaced with a valid response.
+func (s *ocspStapler) fetch(sc *stapledCert, now time.Time) error {
+	req, err := ocsp.CreateRequest(sc.leaf, sc.issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return errorx.Decorate(err, "couldn't create OCSP request")
+	}
+
+	var errs []error
+	for _, server := range sc.leaf.OCSPServer {
+		der, resp, err := s.exchange(server, req, sc)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if resp.Status == ocsp.Revoked {
+			// A revoked certificate is served without a staple so that
+			// the clients can't be given a stale "good" response
+			sc.staple = nil
+			sc.refreshAt = now.Add(ocspRetryInterval)
+			return fmt.Errorf("the certificate is revoked at %s", resp.RevokedAt)
+		}
+
+		sc.staple = der
+		sc.nextUpdate = resp.NextUpdate
+		sc.refreshAt = ocspRefreshTime(resp, now)
+		log.Debug("Refreshed the OCSP response for %s, next update at %s", sc.leaf.Subject, sc.refreshAt)
+		return nil
+	}
+
+	return errorx.DecorateMany("all OCSP responders failed", errs...)
+}
+
+// exchange sends the OCSP request to the server and validates the response
+func (s *ocspStapler) exchange(server string, req []byte, sc *stapledCert) ([]byte, *ocsp.Response, error) {
+	httpResp, err := s.client.Post(server, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, errorx.Decorate(err, "couldn't request %s", server)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("couldn't request %s: status %d", server, httpResp.StatusCode)
+	}
+
+	der, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, nil, errorx.Decorate(err, "couldn't read the response of %s", server)
+	}
+
+	resp, err := ocsp.ParseResponseForCert(der, sc.leaf, sc.issuer)
+	if err != nil {
+		return nil, nil, errorx.Decorate(err, "invalid response of %s", server)
+	}
+
+	if resp.Status != ocsp.Good && resp.Status != ocsp.Revoked {
+		return nil, nil, fmt.Errorf("%s returned status %d", server, resp.Status)
+	}
+
+	return der, resp, nil
+}
+
+// ocspRefreshTime returns the time half-way through the validity of the
+// response
+func ocspRefreshTime(resp *ocsp.Response, now time.Time) time.Time {
+	if resp.NextUpdate.IsZero() {
+		return now.Add(ocspMaxRefreshInterval)
+	}
+
+	refreshAt := resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	if min := now.Add(ocspMinRefreshInterval); refreshAt.Before(min) {
+		refreshAt = min
+	}
+
+	return refreshAt
+}
+
+// update rebuilds the TLS config with the current staples
+func (s *ocspStapler) update() {
+	conf := s.base.Clone()
+	conf.Certificates = make([]tls.Certificate, len(s.base.Certificates))
+	copy(conf.Certificates, s.base.Certificates)
+
+	for i := range conf.Certificates {
+		for _, sc := range s.certs {
+			if bytes.Equal(conf.Certificates[i].Certificate[0], sc.leaf.Raw) {
+				conf.Certificates[i].OCSPStaple = sc.staple
+			}
+		}
+	}
+
+	s.lock.Lock()
+	s.config = conf
+	s.lock.Unlock()
+}
+
+// getConfigForClient returns the TLS config with the stapled certificates.
+// It's used as tls.Config.GetConfigForClient.
+func (s *ocspStapler) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.config, nil
+}
+
+// staples returns the number of the certificates with the OCSP responses
+func (s *ocspStapler) staples() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	n := 0
+	for _, cert := range s.config.Certificates {
+		if cert.OCSPStaple != nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+// startOCSPStapling fetches the OCSP responses and starts the refresh loop.
+// The listeners are served without the staples until they're fetched.  The
+// certificates reloaded from the files are stapled by the TLS reloader.
+func (p *Proxy) startOCSPStapling() {
+	if !p.OCSPStapling || p.tlsReloader != nil {
+		return
+	}
+
+	s := startOCSPStapler(p.TLSConfig)
+	p.ocspStapler = s
+	p.TLSConfig.GetConfigForClient = s.getConfigForClient
+}
+
+// stopOCSPStapling stops the OCSP refresh loop and restores the TLS config
+func (p *Proxy) stopOCSPStapling() {
+	if p.ocspStapler != nil {
+		p.ocspStapler.stopRefresh()
+		p.TLSConfig.GetConfigForClient = nil
+		p.ocspStapler = nil
+	}
+}
+
+// startOCSPStapler returns the stapler of the certificates of conf with the
+// fetched OCSP responses and starts its refresh loop
+func startOCSPStapler(conf *tls.Config) *ocspStapler {
+	s := newOCSPStapler(conf)
+	next := s.refresh(time.Now())
+	log.Info("OCSP stapling is enabled for %d of %d certificates", s.staples(), len(conf.Certificates))
+
+	if len(s.certs) > 0 {
+		s.stop = make(chan struct{})
+		go s.refreshLoop(next, s.stop)
+	}
+
+	return s
+}
+
+// stopRefresh stops the refresh loop if it's running
+func (s *ocspStapler) stopRefresh() {
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// refreshLoop refreshes the OCSP responses until stop is closed
+func (s *ocspStapler) refreshLoop(next time.Time, stop chan struct{}) {
+	t := time.NewTimer(time.Until(next))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			next = s.refresh(time.Now())
+			t.Reset(time.Until(next))
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testOCSPResponder is a CA with an OCSP responder
+type testOCSPResponder struct {
+	srv      *httptest.Server
+	caCert   *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+	status   int32 // ocsp status of the certificates
+	requests int32
+}
+
+func newTestOCSPResponder(t *testing.T) *testOCSPResponder {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	caCert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	r := &testOCSPResponder{caCert: caCert, caKey: caKey, status: ocsp.Good}
+	r.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&r.requests, 1)
+		body, _ := ioutil.ReadAll(req.Body)
+		ocspReq, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		resp, err := ocsp.CreateResponse(r.caCert, r.caCert, ocsp.Response{
+			Status:       int(atomic.LoadInt32(&r.status)),
+			SerialNumber: ocspReq.SerialNumber,
+			ThisUpdate:   now.Add(-time.Minute),
+			NextUpdate:   now.Add(time.Hour),
+			RevokedAt:    now.Add(-time.Minute),
+		}, r.caKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(resp)
+	}))
+
+	return r
+}
+
+// issue returns a certificate issued by the CA
+func (r *testOCSPResponder) issue(t *testing.T, ocspServers []string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: tlsServerName},
+		DNSNames:     []string{tlsServerName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   ocspServers,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, r.caCert, &key.PublicKey, r.caKey)
+	assert.Nil(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der, r.caCert.Raw}, PrivateKey: key}
+}
+
+func TestOCSPStapler(t *testing.T) {
+	r := newTestOCSPResponder(t)
+	defer r.srv.Close()
+
+	noOCSP := r.issue(t, nil)
+	cert := r.issue(t, []string{"http://127.0.0.1:1/unavailable", r.srv.URL})
+	s := newOCSPStapler(&tls.Config{Certificates: []tls.Certificate{noOCSP, cert}})
+	assert.Len(t, s.certs, 1)
+
+	now := time.Now()
+	next := s.refresh(now)
+	assert.Equal(t, 1, s.staples())
+	assert.True(t, next.After(now.Add(20*time.Minute)))
+	assert.True(t, next.Before(now.Add(40*time.Minute)))
+
+	conf, err := s.getConfigForClient(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, conf.Certificates[0].OCSPStaple)
+	resp, err := ocsp.ParseResponse(conf.Certificates[1].OCSPStaple, r.caCert)
+	assert.Nil(t, err)
+	assert.Equal(t, ocsp.Good, resp.Status)
+
+	// Nothing is fetched before the refresh time
+	requests := atomic.LoadInt32(&r.requests)
+	s.refresh(now.Add(time.Minute))
+	assert.Equal(t, requests, atomic.LoadInt32(&r.requests))
+
+	// The staple is removed once the certificate is revoked
+	atomic.StoreInt32(&r.status, ocsp.Revoked)
+	next = s.refresh(next)
+	assert.Equal(t, 0, s.staples())
+	assert.True(t, next.After(now))
+
+	// The expired staples are removed if the responder is unavailable
+	atomic.StoreInt32(&r.status, ocsp.Good)
+	s.refresh(next)
+	assert.Equal(t, 1, s.staples())
+	r.srv.Close()
+	s.refresh(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, 0, s.staples())
+}
+
+func TestOCSPStaplingProxy(t *testing.T) {
+	r := newTestOCSPResponder(t)
+	defer r.srv.Close()
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{r.issue(t, []string{r.srv.URL})}}
+	dnsProxy := createTestProxy(t, tlsConfig)
+	dnsProxy.OCSPStapling = true
+
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+		assert.Nil(t, tlsConfig.GetConfigForClient)
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(r.caCert)
+	conn, err := tls.Dial("tcp", dnsProxy.Addr(ProtoTLS).String(), &tls.Config{
+		ServerName: tlsServerName,
+		RootCAs:    roots,
+	})
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	staple := conn.ConnectionState().OCSPResponse
+	assert.NotNil(t, staple)
+	resp, err := ocsp.ParseResponse(staple, r.caCert)
+	assert.Nil(t, err)
+	assert.Equal(t, ocsp.Good, resp.Status)
+
+	// The configs without the certificates are rejected
+	invalidProxy := createTestProxy(t, &tls.Config{})
+	invalidProxy.OCSPStapling = true
+	assert.NotNil(t, invalidProxy.validateConfig())
+}
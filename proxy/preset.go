@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Preset is a named bundle of tuning values for a common deployment
+// profile.  Presets are meant to be applied to a Config before any explicit
+// settings so that the explicit ones take precedence.
+type Preset struct {
+	Name        string // preset name
+	Description string // human-readable description
+
+	CacheEnabled   bool   // cache status
+	CacheSizeBytes int    // cache size (in bytes)
+	CacheMinTTL    uint32 // minimum TTL for DNS entries (in seconds)
+
+	Ratelimit int  // max number of requests per second from a given IP
+	RefuseAny bool // if true, refuse ANY requests
+
+	MaxGoroutines int // maximum number of goroutines processing DNS requests
+	UDPBufferSize int // size of the read buffer on the UDP sockets
+
+	// Timeout is the recommended timeout for upstream exchanges.  It isn't
+	// a part of Config since it's passed to ParseUpstreamsConfig.
+	Timeout time.Duration
+}
+
+// Names of the built-in presets
+const (
+	PresetHomeRouter          = "home-router"
+	PresetPublicResolver      = "public-resolver"
+	PresetMobileClient        = "mobile-client"
+	PresetKubernetesNodeCache = "kubernetes-node-cache"
+)
+
+// presets contains all built-in presets indexed by their names
+var presets = map[string]*Preset{ // nolint:gochecknoglobals
+	PresetHomeRouter: {
+		Name:           PresetHomeRouter,
+		Description:    "Small LAN with a handful of trusted clients and constrained hardware",
+		CacheEnabled:   true,
+		CacheSizeBytes: 4 * 1024 * 1024,
+		CacheMinTTL:    60,
+		MaxGoroutines:  300,
+		Timeout:        5 * time.Second,
+	},
+	PresetPublicResolver: {
+		Name:           PresetPublicResolver,
+		Description:    "Resolver exposed to the Internet that must resist abuse",
+		CacheEnabled:   true,
+		CacheSizeBytes: 64 * 1024 * 1024,
+		Ratelimit:      20,
+		RefuseAny:      true,
+		UDPBufferSize:  4 * 1024 * 1024,
+		Timeout:        10 * time.Second,
+	},
+	PresetMobileClient: {
+		Name:           PresetMobileClient,
+		Description:    "Local proxy on a mobile device with a tight memory budget",
+		CacheEnabled:   true,
+		CacheSizeBytes: 256 * 1024,
+		MaxGoroutines:  50,
+		Timeout:        3 * time.Second,
+	},
+	PresetKubernetesNodeCache: {
+		Name:           PresetKubernetesNodeCache,
+		Description:    "Per-node cache in front of the cluster DNS with bursty load",
+		CacheEnabled:   true,
+		CacheSizeBytes: 16 * 1024 * 1024,
+		MaxGoroutines:  1000,
+		UDPBufferSize:  4 * 1024 * 1024,
+		Timeout:        2 * time.Second,
+	},
+}
+
+// GetPreset returns a copy of the built-in preset with the specified name.
+// It returns an error if there is no such preset.
+func GetPreset(name string) (Preset, error) {
+	ps, ok := presets[name]
+	if !ok {
+		return Preset{}, fmt.Errorf("unknown preset %q, supported presets: %v", name, PresetNames())
+	}
+
+	return *ps, nil
+}
+
+// PresetNames returns the sorted list of the built-in presets names
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Apply sets the preset values in the specified configuration.  Any value
+// previously set in c is overwritten, so explicit settings must be applied
+// after calling Apply.
+func (ps Preset) Apply(c *Config) {
+	c.CacheEnabled = ps.CacheEnabled
+	c.CacheSizeBytes = ps.CacheSizeBytes
+	c.CacheMinTTL = ps.CacheMinTTL
+	c.Ratelimit = ps.Ratelimit
+	c.RefuseAny = ps.RefuseAny
+	c.MaxGoroutines = ps.MaxGoroutines
+	c.UDPBufferSize = ps.UDPBufferSize
+}
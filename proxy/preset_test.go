@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPreset(t *testing.T) {
+	for _, name := range PresetNames() {
+		ps, err := GetPreset(name)
+		assert.Nil(t, err)
+		assert.Equal(t, name, ps.Name)
+		assert.True(t, ps.Timeout > 0)
+	}
+
+	_, err := GetPreset("unknown")
+	assert.NotNil(t, err)
+}
+
+func TestPresetApply(t *testing.T) {
+	ps, err := GetPreset(PresetPublicResolver)
+	assert.Nil(t, err)
+
+	c := Config{Ratelimit: 5}
+	ps.Apply(&c)
+	assert.True(t, c.CacheEnabled)
+	assert.True(t, c.RefuseAny)
+	assert.Equal(t, ps.Ratelimit, c.Ratelimit)
+	assert.Equal(t, ps.CacheSizeBytes, c.CacheSizeBytes)
+
+	// Modifying the copy must not affect the built-in preset
+	ps.Ratelimit = 1000
+	ps2, _ := GetPreset(PresetPublicResolver)
+	assert.NotEqual(t, ps.Ratelimit, ps2.Ratelimit)
+}
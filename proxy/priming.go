@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"sort"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// primingUpstreams returns the zones the priming queries are sent for and the
+// upstreams they're sent to: the root zone is primed with the default
+// upstreams and the domains with the reserved ones or, if they're excluded
+// with "#", with the default ones as well
+func primingUpstreams(uc *UpstreamConfig) map[string][]upstream.Upstream {
+	zones := map[string][]upstream.Upstream{}
+	if len(uc.Upstreams) != 0 {
+		zones["."] = uc.Upstreams
+	}
+
+	for domain, upstreams := range uc.DomainReservedUpstreams {
+		if domain == UnqualifiedNames {
+			continue
+		}
+
+		if upstreams == nil {
+			upstreams = uc.Upstreams
+		}
+		if len(upstreams) != 0 {
+			zones[domain] = upstreams
+		}
+	}
+
+	return zones
+}
+
+// prime sends the NS queries for the root zone and the domains with the
+// reserved upstreams, so that the connections to the upstreams are
+// established and the NS records and glue of the zones are cached before the
+// first client's request.  It returns the number of the primed zones.
+func (p *Proxy) prime() int {
+	zones := primingUpstreams(p.getUpstreamConfig())
+
+	names := make([]string, 0, len(zones))
+	for zone := range zones {
+		names = append(names, zone)
+	}
+	sort.Strings(names)
+
+	reqs := make([]*dns.Msg, len(names))
+	for i, zone := range names {
+		req := &dns.Msg{}
+		req.SetQuestion(zone, dns.TypeNS)
+		reqs[i] = req
+	}
+
+	errs := p.resolveIntoCache(reqs, func(name string) []upstream.Upstream {
+		return zones[name]
+	})
+	for _, err := range errs {
+		log.Debug("Priming: %s", err)
+	}
+
+	return len(reqs) - len(errs)
+}
+
+// startPriming primes the zones in the background if Config.Priming is
+// enabled
+func (p *Proxy) startPriming() {
+	if !p.Priming {
+		return
+	}
+
+	go func() {
+		n := p.prime()
+		log.Info("Primed %d zones", n)
+	}()
+}
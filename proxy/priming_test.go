@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrimingUpstreams(t *testing.T) {
+	u := &switchableUpstream{}
+	u.ip.Store(net.IP{1, 2, 3, 4})
+	reservedU := &switchableUpstream{}
+	reservedU.ip.Store(net.IP{5, 6, 7, 8})
+	uc := &UpstreamConfig{
+		Upstreams: []upstream.Upstream{u},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			UnqualifiedNames: {reservedU},
+			"host.com.":      {reservedU},
+			"maps.host.com.": nil,
+		},
+	}
+	assert.Equal(t, map[string][]upstream.Upstream{
+		".":              {u},
+		"host.com.":      {reservedU},
+		"maps.host.com.": {u},
+	}, primingUpstreams(uc))
+
+	uc.Upstreams = nil
+	assert.Equal(t, map[string][]upstream.Upstream{
+		"host.com.": {reservedU},
+	}, primingUpstreams(uc))
+}
+
+func TestPriming(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.Priming = true
+	u := &switchableUpstream{}
+	u.ip.Store(net.IP{1, 2, 3, 4})
+	reservedU := &switchableUpstream{}
+	reservedU.ip.Store(net.IP{5, 6, 7, 8})
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	dnsProxy.UpstreamConfig.DomainReservedUpstreams = map[string][]upstream.Upstream{
+		"corp.example.org.": {reservedU},
+	}
+
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&u.reqs) == 1 && atomic.LoadInt32(&reservedU.reqs) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// The responses are cached
+	for _, zone := range []string{".", "corp.example.org."} {
+		req := &dns.Msg{}
+		req.SetQuestion(zone, dns.TypeNS)
+		assert.Eventually(t, func() bool {
+			return dnsProxy.replyFromCache(&DNSContext{Req: req})
+		}, time.Second, 10*time.Millisecond, zone)
+	}
+}
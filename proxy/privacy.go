@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// privacyUDPSize is the UDP payload size advertised to the upstreams in the
+// privacy mode instead of the one of the client
+const privacyUDPSize = 4096
+
+// privateRequest returns the copy of the client's request that carries
+// nothing identifying the client: a new ID, the lowercased question, no EDNS
+// options, and no records except for the OPT one with the DO bit.  The
+// header flags the answer depends on are kept.
+func (p *Proxy) privateRequest(req *dns.Msg) *dns.Msg {
+	r := &dns.Msg{}
+	r.Id = p.newMsgID()
+	r.Opcode = req.Opcode
+	r.RecursionDesired = req.RecursionDesired
+	r.CheckingDisabled = req.CheckingDisabled
+	r.AuthenticatedData = req.AuthenticatedData
+
+	r.Question = make([]dns.Question, len(req.Question))
+	for i, q := range req.Question {
+		q.Name = strings.ToLower(q.Name)
+		r.Question[i] = q
+	}
+
+	if opt := req.IsEdns0(); opt != nil {
+		r.SetEdns0(privacyUDPSize, opt.Do())
+	}
+
+	return r
+}
+
+// restorePrivateReply makes the reply to the private request match the
+// client's original one
+func restorePrivateReply(reply, req *dns.Msg) {
+	if reply == nil {
+		return
+	}
+
+	reply.Id = req.Id
+	for i := range reply.Question {
+		if i < len(req.Question) && strings.EqualFold(reply.Question[i].Name, req.Question[i].Name) {
+			reply.Question[i].Name = req.Question[i].Name
+		}
+	}
+}
+
+// checkPrivateRequest returns an error if the private request carries any
+// data of the client's request that may identify the client
+func checkPrivateRequest(private, req *dns.Msg) error {
+	if private.Id == req.Id {
+		return fmt.Errorf("the client's ID %d is passed", req.Id)
+	}
+
+	for _, q := range private.Question {
+		if q.Name != strings.ToLower(q.Name) {
+			return fmt.Errorf("the client's casing of %q is passed", q.Name)
+		}
+	}
+
+	if len(private.Answer) != 0 || len(private.Ns) != 0 {
+		return fmt.Errorf("the client's records are passed")
+	}
+
+	for _, rr := range private.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			return fmt.Errorf("the client's %s record is passed", dns.TypeToString[rr.Header().Rrtype])
+		}
+		if len(opt.Option) != 0 {
+			return fmt.Errorf("the client's EDNS option %d is passed", opt.Option[0].Option())
+		}
+		if opt.UDPSize() != privacyUDPSize {
+			return fmt.Errorf("the client's UDP size %d is passed", opt.UDPSize())
+		}
+	}
+
+	return nil
+}
+
+// privateUpdate returns the copy of the client's UPDATE or NOTIFY request
+// with a new ID and, unless the client has signed it, the lowercased zone, no
+// EDNS options, and the fixed UDP size.  The records are the contents of the
+// message, so they're kept.  The TSIG signature covers the original ID but
+// not the new one, so the signed request only gets the new ID unless resigned
+// is true, i.e. its TSIG record is replaced anyway.
+func (p *Proxy) privateUpdate(req *dns.Msg, resigned bool) *dns.Msg {
+	r := req.Copy()
+	r.Id = p.newMsgID()
+	if req.IsTsig() != nil && !resigned {
+		return r
+	}
+
+	for i := range r.Question {
+		r.Question[i].Name = strings.ToLower(r.Question[i].Name)
+	}
+
+	if opt := r.IsEdns0(); opt != nil {
+		opt.Option = nil
+		opt.SetUDPSize(privacyUDPSize)
+	}
+
+	return r
+}
+
+// privacySelfTestUpstream records the request the proxy sends in the privacy
+// self-test
+type privacySelfTestUpstream struct {
+	req *dns.Msg
+}
+
+// Exchange implements the upstream.Upstream interface for
+// *privacySelfTestUpstream
+func (u *privacySelfTestUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	u.req = m.Copy()
+
+	res := &dns.Msg{}
+	res.SetReply(m)
+
+	return res, nil
+}
+
+// Address implements the upstream.Upstream interface for
+// *privacySelfTestUpstream.  It's the address of a plain DNS upstream, so
+// that the request gets everything the plain ones do, e.g. the cookies.
+func (u *privacySelfTestUpstream) Address() string {
+	return "192.0.2.53:53"
+}
+
+// privacySelfTest checks that a request full of the client's identifiers
+// reaches the upstream without any of them.  The request is sent the way the
+// proxy resolves the client's requests, with the configuration of the proxy
+// and the upstream that records it, so that a change of the exchange that
+// breaks the guarantee never goes unnoticed.  It runs every time the proxy is
+// started.
+func (p *Proxy) privacySelfTest() error {
+	req := &dns.Msg{}
+	req.SetQuestion("PrIvAcY-SeLf-TeSt.ExAmPlE.", dns.TypeA)
+	req.Id = 0x2020
+	req.SetEdns0(1232, true)
+	setECS(req, net.IP{203, 0, 113, 1}, 0)
+
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"},
+		&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+		&dns.EDNS0_PADDING{Padding: make([]byte, 16)},
+	)
+	req.Ns = append(req.Ns, &dns.TXT{
+		Hdr: dns.RR_Header{Name: "client.", Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{"client"},
+	})
+	req.Extra = append(req.Extra, &dns.TXT{
+		Hdr: dns.RR_Header{Name: "client.", Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{"client"},
+	})
+
+	// The proxy with the same configuration, but with the recording upstream
+	// only and its own statistics
+	u := &privacySelfTestUpstream{}
+	t := &Proxy{Config: p.Config}
+	t.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{u}}
+	t.UpstreamMode = UModeLoadBalance
+	t.UpstreamLayer = nil
+	t.UpstreamPolicy = UpstreamPolicy{}
+	t.UpstreamPolicies = nil
+	t.UpstreamTSIG = nil
+	t.Fallbacks = nil
+	t.LastResortUpstreams = nil
+	t.RequestDeduplication = false
+	t.deterministicRand = p.deterministicRand
+	if t.Cookies {
+		var err error
+		t.cookies, err = newCookies(t.CookieSecret)
+		if err != nil {
+			return fmt.Errorf("privacy mode self-test failed: %w", err)
+		}
+	}
+
+	d := &DNSContext{
+		Proto: ProtoUDP,
+		Req:   req,
+		Addr:  &net.UDPAddr{IP: net.IP{203, 0, 113, 1}, Port: 53535},
+	}
+
+	// The random ID may match by chance, the next one won't
+	var err error
+	for i := 0; i < 2; i++ {
+		var reply *dns.Msg
+		reply, _, err = t.exchangeDeduplicated(d, t.withClientInfo(d), t.UpstreamConfig.Upstreams)
+		if err == nil {
+			if u.req == nil {
+				err = errors.New("the request isn't sent")
+			} else if err = checkPrivateRequest(u.req, req); err == nil && reply.Id != req.Id {
+				err = fmt.Errorf("the client's ID %d isn't restored", req.Id)
+			}
+		}
+
+		if err == nil || u.req == nil || u.req.Id != req.Id {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("privacy mode self-test failed: %w", err)
+	}
+
+	return nil
+}
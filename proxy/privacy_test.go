@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingUpstream records the requests it gets
+type recordingUpstream struct {
+	testUpstream
+	reqs []*dns.Msg
+}
+
+func (u *recordingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	u.reqs = append(u.reqs, m.Copy())
+	return u.testUpstream.Exchange(m)
+}
+
+func createClientIdentifyingMessage() *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion("GoOgLe-DnS.cOm.", dns.TypeA)
+	req.SetEdns0(1400, true)
+	setECS(req, net.IP{203, 0, 113, 1}, 0)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"})
+
+	return req
+}
+
+func TestPrivateRequest(t *testing.T) {
+	p := &Proxy{}
+	req := createClientIdentifyingMessage()
+	req.CheckingDisabled = true
+
+	private := p.privateRequest(req)
+	assert.Nil(t, checkPrivateRequest(private, req))
+	assert.Equal(t, "google-dns.com.", private.Question[0].Name)
+	assert.True(t, private.RecursionDesired)
+	assert.True(t, private.CheckingDisabled)
+	assert.True(t, private.IsEdns0().Do())
+
+	// The original request isn't modified
+	assert.Equal(t, "GoOgLe-DnS.cOm.", req.Question[0].Name)
+	assert.Len(t, req.IsEdns0().Option, 2)
+
+	// No OPT record is added for the clients without EDNS
+	private = p.privateRequest(createTestMessage())
+	assert.Nil(t, private.IsEdns0())
+
+	// The leaks are detected
+	req = createClientIdentifyingMessage()
+	assert.NotNil(t, checkPrivateRequest(req, req))
+	leak := private.Copy()
+	leak.Question[0].Name = "GoOgLe-DnS.cOm."
+	assert.NotNil(t, checkPrivateRequest(leak, req))
+	leak = p.privateRequest(req)
+	setECS(leak, net.IP{203, 0, 113, 1}, 0)
+	assert.NotNil(t, checkPrivateRequest(leak, req))
+}
+
+func TestPrivacySelfTest(t *testing.T) {
+	p := &Proxy{}
+	p.PrivacyMode = true
+	assert.Nil(t, p.privacySelfTest())
+
+	// The cookies of the proxy aren't sent either
+	p.Cookies = true
+	p.UpstreamMode = UModeParallel
+	assert.Nil(t, p.privacySelfTest())
+
+	// The statistics of the proxy aren't affected
+	assert.Empty(t, p.upstreamLayer().stats)
+}
+
+func TestPrivateUpdate(t *testing.T) {
+	p := &Proxy{}
+	req := createUpdateTestMessage()
+	req.Question[0].Name = "ExAmPlE.oRg."
+	req.SetEdns0(1232, false)
+	setECS(req, net.IP{203, 0, 113, 1}, 0)
+
+	private := p.privateUpdate(req, false)
+	assert.NotEqual(t, req.Id, private.Id)
+	assert.Equal(t, "example.org.", private.Question[0].Name)
+	assert.Equal(t, req.Ns, private.Ns)
+	if opt := private.IsEdns0(); assert.NotNil(t, opt) {
+		assert.Empty(t, opt.Option)
+		assert.Equal(t, uint16(privacyUDPSize), opt.UDPSize())
+	}
+
+	// The original request isn't modified
+	assert.Len(t, req.IsEdns0().Option, 1)
+
+	// The request signed by the client only gets a new ID unless it's
+	// resigned
+	key := &TSIGKey{Name: "dhcp-update", Secret: "c2VjcmV0c2VjcmV0"}
+	key.sign(req)
+	private = p.privateUpdate(req, false)
+	assert.NotEqual(t, req.Id, private.Id)
+	private.Id = req.Id
+	assert.Equal(t, req.String(), private.String())
+
+	private = p.privateUpdate(req, true)
+	assert.Empty(t, private.IsEdns0().Option)
+}
+
+func TestPrivacyMode(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.PrivacyMode = true
+	u := &recordingUpstream{testUpstream: testUpstream{
+		aResp: &dns.A{
+			Hdr: dns.RR_Header{Name: "google-dns.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100},
+			A:   net.IP{8, 8, 8, 8},
+		},
+	}}
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	assert.Nil(t, dnsProxy.validateConfig())
+	assert.Nil(t, dnsProxy.Init())
+
+	req := createClientIdentifyingMessage()
+	d := &DNSContext{Req: req, Addr: &net.UDPAddr{IP: net.IP{192, 168, 1, 1}, Port: 53}}
+	err := dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+
+	assert.Len(t, u.reqs, 1)
+	assert.Nil(t, checkPrivateRequest(u.reqs[0], req))
+
+	// The client gets its ID and casing back
+	assert.Equal(t, req.Id, d.Res.Id)
+	assert.Equal(t, "GoOgLe-DnS.cOm.", d.Res.Question[0].Name)
+	assert.Equal(t, "8.8.8.8", getIPFromResponse(d.Res).String())
+
+	// ECS can't be used with the privacy mode
+	dnsProxy.EnableEDNSClientSubnet = true
+	assert.NotNil(t, dnsProxy.validateConfig())
+}
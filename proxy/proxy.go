@@ -10,7 +10,6 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/fastip"
-	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/ameshkov/dnscrypt/v2"
@@ -18,6 +17,7 @@ import (
 	"github.com/lucas-clemente/quic-go"
 	"github.com/miekg/dns"
 	gocache "github.com/patrickmn/go-cache"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/http2"
 )
 
@@ -53,21 +53,37 @@ type Proxy struct {
 	// Listeners
 	// --
 
-	udpListen         []*net.UDPConn   // UDP listen connections
+	udpListen         []net.PacketConn // UDP listen connections
 	tcpListen         []net.Listener   // TCP listeners
 	tlsListen         []net.Listener   // TLS listeners
+	tlsRawListen      []net.Listener   // TCP listeners the TLS listeners are created on
 	quicListen        []quic.Listener  // QUIC listeners
+	quicPacketConns   []net.PacketConn // custom packet connections QUIC listeners are created on
 	httpsListen       []net.Listener   // HTTPS listeners
 	httpsServer       []*http.Server   // HTTPS server instance
 	dnsCryptUDPListen []*net.UDPConn   // UDP listen connections for DNSCrypt
 	dnsCryptTCPListen []net.Listener   // TCP listeners for DNSCrypt
 	dnsCryptServer    *dnscrypt.Server // DNSCrypt server instance
+	unixListen        []net.Listener   // UNIX stream socket listeners
+	unixgramListen    []net.PacketConn // UNIX datagram socket connections
+	adminListen       net.Listener     // admin API listener
+	adminServer       *http.Server     // admin API server instance
+	acmeHTTPListen    net.Listener     // ACME HTTP-01 challenges listener
+	acmeHTTPServer    *http.Server     // ACME HTTP-01 challenges server instance
+
+	listenerConfigs map[interface{}]*ListenerConfig // settings of the listeners from Config.Listeners
 
 	// Upstream
 	// --
 
-	upstreamRttStats map[string]int // Map of upstream addresses and their rtt. Used to sort upstreams "from fast to slow"
-	rttLock          sync.Mutex     // Synchronizes access to the upstreamRttStats map
+	ownUpstreamLayer UpstreamLayer // upstreams runtime state used if Config.UpstreamLayer isn't set
+	healthStop       chan struct{} // Closed to stop the health check loop
+
+	inflight     map[string]*inflightRequest // Map of the requests being exchanged with the upstreams
+	inflightLock sync.Mutex                  // Synchronizes access to the inflight map
+
+	outageStart time.Time  // Time when the upstreams started failing, zero if they don't
+	outageLock  sync.Mutex // Synchronizes access to outageStart
 
 	// DNS64 (in case dnsproxy works in a NAT64/DNS64 network)
 	// --
@@ -86,17 +102,51 @@ type Proxy struct {
 
 	cache       *cache       // cache instance (nil if cache is disabled)
 	cacheSubnet *cacheSubnet // cache instance (nil if cache is disabled)
+	cacheHot    *hotEntries  // most requested cache entries (nil if they aren't kept)
+	prefetcher  *prefetcher  // popular cache entries re-resolved before expiry (nil if prefetching is disabled)
+
+	roundRobinCounter uint32 // rotation of the cached A and AAAA answers, see Config.CacheRoundRobin
+
+	// Blocklist
+	// --
+
+	blocklistStop chan struct{} // Closed to stop the blocklist refresh loop
+	rewritesStop  chan struct{} // Closed to stop the rewrites reload loop
+
+	// TLS certificates
+	// --
+
+	ocspStapler *ocspStapler // OCSP responses of the TLSConfig certificates (nil if stapling is disabled)
+	tlsReloader *tlsReloader // reloads the certificate of the TLSConfig from the files (nil if it's not configured)
+	acme        *autocert.Manager // obtains the certificates of the TLSConfig via ACME (nil if it's not configured)
 
 	// FastestAddr module
 	// --
 
 	fastestAddr *fastip.FastestAddr // fastest-addr module
 
+	// Runtime statistics and diagnostics
+	// --
+
+	stats          *statsCounters     // runtime statistics counters
+	truncation     *truncationTracker // truncated responses statistics
+	verboseClients map[string]bool    // client IPs for which all messages are logged
+	verboseLock    sync.RWMutex       // protects verboseClients
+	capture        *capture           // running packet capture session (nil if there is none)
+	captureLock    sync.Mutex         // protects capture
+
+	// deterministicRand generates the message IDs in the deterministic mode
+	deterministicRand *deterministicRand
+
+	// cookies are the DNS cookies of the proxy and the upstreams (nil if
+	// they're disabled)
+	cookies *cookies
+
 	// Other
 	// --
 
 	bytesPool    *sync.Pool // bytes pool to avoid unnecessary allocations when reading DNS packets
-	udpOOBSize   int        // size for received OOB data
+	udpBufPool   *sync.Pool // buffers the UDP requests are read into
 	sync.RWMutex            // protects parallel access to proxy structures
 
 	// requestGoroutinesSema limits the number of simultaneous requests.
@@ -109,6 +159,21 @@ type Proxy struct {
 	// See also: https://github.com/AdguardTeam/AdGuardHome/issues/2242.
 	requestGoroutinesSema semaphore
 
+	// udpGoroutinesSema limits the number of simultaneous UDP requests.
+	// It's requestGoroutinesSema unless Config.UDPMaxGoroutines is set.
+	udpGoroutinesSema semaphore
+
+	// busyRefusersSema limits the number of the goroutines refusing the TCP
+	// connections while requestGoroutinesSema is exhausted
+	busyRefusersSema semaphore
+
+	// abandoned counts the timed out exchanges with the upstreams
+	abandoned abandonedExchanges
+
+	// upstreamsInUse counts the requests using the current
+	// Config.UpstreamConfig, it's replaced along with it
+	upstreamsInUse *sync.WaitGroup
+
 	Config // proxy configuration
 }
 
@@ -119,13 +184,24 @@ func (p *Proxy) Init() (err error) {
 
 		p.cache = &cache{
 			cacheSize: p.CacheSizeBytes,
+			shards:    p.CacheShards,
+			staleTime: p.CacheServeStale,
 		}
 
 		if p.Config.EnableEDNSClientSubnet {
 			p.cacheSubnet = &cacheSubnet{
 				cacheSize: p.CacheSizeBytes,
+				shards:    p.CacheShards,
 			}
 		}
+
+		if p.CacheKeepHot > 0 {
+			p.cacheHot = newHotEntries(p.CacheKeepHot)
+		}
+
+		if p.CachePrefetch > 0 {
+			p.prefetcher = newPrefetcher(p.CachePrefetch)
+		}
 	}
 
 	if p.TLSConfig != nil && len(p.TLSConfig.NextProtos) == 0 {
@@ -148,6 +224,26 @@ func (p *Proxy) Init() (err error) {
 		p.requestGoroutinesSema = newNoopSemaphore()
 	}
 
+	p.upstreamsInUse = &sync.WaitGroup{}
+
+	p.busyRefusersSema = newNoopSemaphore()
+	if p.Backpressure {
+		p.busyRefusersSema, err = newChanSemaphore(busyMaxRefusers)
+		if err != nil {
+			return fmt.Errorf("can't init refusers semaphore: %w", err)
+		}
+	}
+
+	p.udpGoroutinesSema = p.requestGoroutinesSema
+	if p.UDPMaxGoroutines > 0 {
+		log.Info("UDPMaxGoroutines is set to %d", p.UDPMaxGoroutines)
+
+		p.udpGoroutinesSema, err = newChanSemaphore(p.UDPMaxGoroutines)
+		if err != nil {
+			return fmt.Errorf("can't init UDP semaphore: %w", err)
+		}
+	}
+
 	if p.DNSCryptResolverCert != nil && p.DNSCryptProviderName != "" {
 		log.Info("Initializing DNSCrypt: %s", p.DNSCryptProviderName)
 		p.dnsCryptServer = &dnscrypt.Server{
@@ -161,17 +257,35 @@ func (p *Proxy) Init() (err error) {
 		}
 	}
 
-	p.udpOOBSize = proxyutil.UDPGetOOBSize()
+	p.stats = newStatsCounters()
+	p.truncation = newTruncationTracker(p.AutoTuneUDPSize)
+	if p.Deterministic {
+		p.deterministicRand = newDeterministicRand(p.RandomSeed)
+	}
+
+	if p.Cookies {
+		p.cookies, err = newCookies(p.CookieSecret)
+		if err != nil {
+			return fmt.Errorf("can't init cookies: %w", err)
+		}
+	}
+
 	p.bytesPool = &sync.Pool{
 		New: func() interface{} {
 			// 2 bytes may be used to store packet length (see TCP/TLS)
 			return make([]byte, 2+dns.MaxMsgSize)
 		},
 	}
+	udpBufSize := p.udpBufSize()
+	p.udpBufPool = &sync.Pool{
+		New: func() interface{} {
+			return make([]byte, udpBufSize)
+		},
+	}
 
 	if p.UpstreamMode == UModeFastestAddr {
 		log.Printf("Fastest IP is enabled")
-		p.fastestAddr = fastip.NewFastestAddr()
+		p.fastestAddr = p.upstreamLayer().getFastestAddr(p.FastestAddr)
 	}
 
 	return nil
@@ -193,11 +307,33 @@ func (p *Proxy) Start() (err error) {
 		return err
 	}
 
+	// The blocklist is loaded before the requests are accepted
+	p.startBlocklist()
+	p.startRewrites()
+
+	err = p.startTLSReload()
+	if err != nil {
+		p.stopBlocklist()
+		p.stopRewrites()
+		return err
+	}
+	p.startOCSPStapling()
+	p.startACME()
+
 	err = p.startListeners()
 	if err != nil {
+		p.stopBlocklist()
+		p.stopRewrites()
+		p.stopTLSReload()
+		p.stopOCSPStapling()
+		p.stopACME()
 		return err
 	}
 
+	p.startHealthCheck()
+	p.startPriming()
+	p.startCachePrewarm()
+
 	p.started = true
 	return nil
 }
@@ -215,6 +351,18 @@ func (p *Proxy) Stop() error {
 
 	errs := []error{}
 
+	p.stopHealthCheck()
+	p.stopBlocklist()
+	p.stopRewrites()
+	p.stopTLSReload()
+	p.stopOCSPStapling()
+	p.stopACME()
+
+	err := p.StopCapture()
+	if err != nil {
+		errs = append(errs, errorx.Decorate(err, "couldn't stop packet capture"))
+	}
+
 	for _, l := range p.tcpListen {
 		err := l.Close()
 		if err != nil {
@@ -238,6 +386,7 @@ func (p *Proxy) Stop() error {
 		}
 	}
 	p.tlsListen = nil
+	p.tlsRawListen = nil
 
 	for _, srv := range p.httpsServer {
 		err := srv.Close()
@@ -256,6 +405,14 @@ func (p *Proxy) Stop() error {
 	}
 	p.quicListen = nil
 
+	for _, c := range p.quicPacketConns {
+		err := c.Close()
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't close QUIC packet connection"))
+		}
+	}
+	p.quicPacketConns = nil
+
 	for _, l := range p.dnsCryptUDPListen {
 		err := l.Close()
 		if err != nil {
@@ -272,6 +429,28 @@ func (p *Proxy) Stop() error {
 	}
 	p.dnsCryptTCPListen = nil
 
+	errs = append(errs, p.closeUnixListeners()...)
+
+	if p.adminServer != nil {
+		err := p.adminServer.Close()
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't close admin API server"))
+		}
+	}
+	p.adminListen = nil
+	p.adminServer = nil
+
+	if p.acmeHTTPServer != nil {
+		err := p.acmeHTTPServer.Close()
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't close ACME HTTP server"))
+		}
+	}
+	p.acmeHTTPListen = nil
+	p.acmeHTTPServer = nil
+
+	p.listenerConfigs = nil
+
 	p.started = false
 	log.Println("Stopped the DNS proxy server")
 	if len(errs) != 0 {
@@ -386,42 +565,23 @@ func (p *Proxy) Resolve(d *DNSContext) error {
 		return nil
 	}
 
-	host := d.Req.Question[0].Name
-	var upstreams []upstream.Upstream
-
-	// Get custom upstreams first -- note that they might be empty
-	if d.CustomUpstreamConfig != nil {
-		upstreams = d.CustomUpstreamConfig.getUpstreamsForDomain(host)
-	}
-
-	// If nothing found in the custom upstreams, start using the default ones
-	if upstreams == nil {
-		upstreams = p.UpstreamConfig.getUpstreamsForDomain(host)
-	}
+	upstreams := p.upstreamsForDomain(d.CustomUpstreamConfig, d.Req.Question[0].Name)
 
 	// execute the DNS request
 	startTime := time.Now()
-	reply, u, err := p.exchange(d.Req, upstreams)
-	if p.isEmptyAAAAResponse(reply, d.Req) {
-		log.Tracef("Received empty AAAA response, checking DNS64")
-		reply, u, err = p.checkDNS64(d.Req, reply, upstreams)
-	} else if p.isBogusNXDomain(reply) {
-		log.Tracef("Received IP from the bogus-nxdomain list, replacing response")
-		reply = p.genNXDomain(reply)
-	}
-
-	rtt := int(time.Since(startTime) / time.Millisecond)
-	log.Tracef("RTT: %d ms", rtt)
-
-	if err != nil && p.Fallbacks != nil {
-		log.Tracef("Using the fallback upstream due to %s", err)
-		reply, u, err = upstream.ExchangeParallel(p.Fallbacks, d.Req)
+	reply, u, err := p.exchangeDeduplicated(d, p.withClientInfo(d), upstreams)
+	if u != nil {
+		p.captureUpstreamExchange(d, u.Address(), startTime, reply)
 	}
 
 	// set Upstream that resolved DNS request to DNSContext
 	if reply != nil {
 		d.Upstream = u
+		d.ResponseClass = ResponseClassUpstream
 
+		if p.Deterministic {
+			sortRRsets(reply)
+		}
 		p.setMinMaxTTL(reply)
 
 		// Saving cached response
@@ -429,7 +589,14 @@ func (p *Proxy) Resolve(d *DNSContext) error {
 	}
 
 	if reply == nil {
-		d.Res = p.genServerFailure(d.Req)
+		if p.replyFromStaleCache(d) {
+			log.Debug("Upstreams failed: %s", err)
+			err = nil
+		} else {
+			d.Res = p.genServerFailure(d.Req)
+			setEDE(d.Res, d.Req, edeNetworkError, "")
+			d.ResponseClass = ResponseClassError
+		}
 	} else {
 		d.Res = reply
 	}
@@ -444,11 +611,75 @@ func (p *Proxy) Resolve(d *DNSContext) error {
 	return err
 }
 
+// upstreamsForDomain returns the upstreams for the host from the custom
+// upstream config, which may be nil, or from the default one if the custom
+// config has nothing for it
+func (p *Proxy) upstreamsForDomain(custom *UpstreamConfig, host string) []upstream.Upstream {
+	// Note that the custom upstreams might be empty
+	if custom != nil {
+		if upstreams := custom.getUpstreamsForDomain(host); upstreams != nil {
+			return upstreams
+		}
+	}
+
+	return p.getUpstreamConfig().getUpstreamsForDomain(host)
+}
+
+// exchangeUpstreams sends the request to the upstreams and post-processes the
+// reply.  If the upstreams fail, it uses the fallbacks.  In the privacy mode,
+// the upstreams only get the private copy of the request.  custom is the
+// custom upstream config the upstreams are taken from, it may be nil.
+func (p *Proxy) exchangeUpstreams(req *dns.Msg, upstreams []upstream.Upstream, custom *UpstreamConfig) (reply *dns.Msg, u upstream.Upstream, err error) {
+	if p.PrivacyMode {
+		origReq := req
+		req = p.privateRequest(req)
+		defer func() { restorePrivateReply(reply, origReq) }()
+	}
+
+	startTime := time.Now()
+	reply, u, err = p.exchange(req, upstreams)
+	if err == nil {
+		reply = p.processCNAME(req, reply, func(name string) []upstream.Upstream {
+			return p.upstreamsForDomain(custom, name)
+		})
+	}
+	if p.isEmptyAAAAResponse(reply, req) {
+		log.Tracef("Received empty AAAA response, checking DNS64")
+		reply, u, err = p.checkDNS64(req, reply, upstreams)
+	} else if p.isBogusNXDomain(reply) {
+		log.Tracef("Received IP from the bogus-nxdomain list, replacing response")
+		reply = p.genNXDomain(reply)
+	}
+
+	rtt := int(time.Since(startTime) / time.Millisecond)
+	log.Tracef("RTT: %d ms", rtt)
+
+	if fallbacks, _ := p.fallbacks(); err != nil && len(fallbacks) != 0 {
+		log.Tracef("Using the fallback upstream due to %s", err)
+		reply, u, err = p.exchangeFallbacks(req)
+	}
+
+	if len(p.LastResortUpstreams) != 0 {
+		outage := p.updateOutage(err, time.Now())
+		if err != nil && p.isLastResortOutage(outage) {
+			log.Error("all upstreams have been failing for %s, using the last resort upstreams for %s: %s", outage, req.Question[0].Name, err)
+			reply, u, err = p.exchangeParallel(p.LastResortUpstreams, req)
+		}
+	}
+
+	return reply, u, err
+}
+
 // Set EDNS Client-Subnet data in DNS request
 func (p *Proxy) processECS(d *DNSContext) {
 	d.ecsReqIP = nil
 	d.ecsReqMask = uint8(0)
 
+	if o := p.findECSOverride(d.Req.Question[0].Name); o != nil {
+		applyECSOverride(d, o)
+		return
+	}
+
 	ip, mask, _ := parseECS(d.Req)
 	if mask == 0 {
 		// Set EDNS Client-Subnet data
@@ -456,7 +687,7 @@ func (p *Proxy) processECS(d *DNSContext) {
 		if p.Config.EDNSAddr != nil {
 			clientIP = p.Config.EDNSAddr
 		} else {
-			switch addr := d.Addr.(type) {
+			switch addr := d.ClientAddr().(type) {
 			case *net.UDPAddr:
 				clientIP = addr.IP
 			case *net.TCPAddr:
@@ -16,10 +16,15 @@ func (p *Proxy) replyFromCache(d *DNSContext) bool {
 	}
 
 	if !p.Config.EnableEDNSClientSubnet {
-		val, ok := p.cache.Get(d.Req)
+		p.cacheHot.hit(d.Req)
+		val, ttl, ok := p.cache.getWithTTL(d.Req)
 		if ok && val != nil {
 			d.Res = val
+			d.ResponseClass = ResponseClassCached
 			log.Debug("Serving cached response")
+			if p.prefetcher.hit(d.Req, findLowestTTL(val), ttl) {
+				p.prefetch(d.Req)
+			}
 			return true
 		}
 		return false
@@ -29,14 +34,20 @@ func (p *Proxy) replyFromCache(d *DNSContext) bool {
 		val, ok := p.cacheSubnet.GetWithSubnet(d.Req, d.ecsReqIP, d.ecsReqMask)
 		if ok && val != nil {
 			d.Res = val
+			d.ResponseClass = ResponseClassCached
 			log.Debug("Serving response from subnet cache")
 			return true
 		}
 	} else if d.ecsReqMask == 0 && p.cache != nil {
-		val, ok := p.cache.Get(d.Req)
+		p.cacheHot.hit(d.Req)
+		val, ttl, ok := p.cache.getWithTTL(d.Req)
 		if ok && val != nil {
 			d.Res = val
+			d.ResponseClass = ResponseClassCached
 			log.Debug("Serving response from general cache")
+			if p.prefetcher.hit(d.Req, findLowestTTL(val), ttl) {
+				p.prefetch(d.Req)
+			}
 			return true
 		}
 	}
@@ -44,6 +55,27 @@ func (p *Proxy) replyFromCache(d *DNSContext) bool {
 	return false
 }
 
+// replyFromStaleCache sets the response to the expired cached one if it has
+// expired less than Config.CacheServeStale ago, so that the clients get the
+// answer when the upstreams fail.  Only the general cache is used.  It
+// returns true if the response is found.
+func (p *Proxy) replyFromStaleCache(d *DNSContext) bool {
+	if p.cache == nil || d.CustomUpstreamConfig != nil || d.ecsReqMask != 0 {
+		return false
+	}
+
+	res := p.cache.getStale(d.Req)
+	if res == nil {
+		return false
+	}
+
+	setEDE(res, d.Req, edeStaleAnswer, "")
+	d.Res = res
+	d.ResponseClass = ResponseClassCached
+	log.Debug("Serving stale response from cache")
+	return true
+}
+
 // Store response in general or subnet cache
 func (p *Proxy) setInCache(d *DNSContext, resp *dns.Msg) {
 	if p.cache == nil || d.CustomUpstreamConfig != nil {
@@ -53,6 +85,11 @@ func (p *Proxy) setInCache(d *DNSContext, resp *dns.Msg) {
 		return
 	}
 
+	resp, ok := p.applyCachePolicy(d, resp)
+	if !ok {
+		return
+	}
+
 	if !p.Config.EnableEDNSClientSubnet {
 		p.cache.Set(resp)
 		return
@@ -74,3 +111,31 @@ func (p *Proxy) setInCache(d *DNSContext, resp *dns.Msg) {
 		p.cache.Set(resp) // use general cache
 	}
 }
+
+// applyCachePolicy returns the response to cache and true if Config.CachePolicy
+// allows caching it.  If the policy sets the TTL, the returned response is a
+// copy with the TTL of all its records set to it.
+func (p *Proxy) applyCachePolicy(d *DNSContext, resp *dns.Msg) (*dns.Msg, bool) {
+	if p.CachePolicy == nil || resp == nil || !isCacheable(resp) {
+		return resp, true
+	}
+
+	ok, ttl := p.CachePolicy(d, resp)
+	if !ok {
+		log.Debug("%s: not caching the response by the cache policy", resp.Question[0].Name)
+		return nil, false
+	}
+
+	if ttl > 0 {
+		resp = resp.Copy()
+		for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+			for _, rr := range rrs {
+				if rr.Header().Rrtype != dns.TypeOPT {
+					rr.Header().Ttl = ttl
+				}
+			}
+		}
+	}
+
+	return resp, true
+}
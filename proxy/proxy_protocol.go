@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+)
+
+// proxyProtoV2Sig is the signature of the PROXY protocol v2 header
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoV1MaxLen is the max length of the PROXY protocol v1 header line
+const proxyProtoV1MaxLen = 107
+
+// proxyProtoListener returns the listener reading the PROXY protocol header
+// of the connections from Config.TrustedProxies if Config.ProxyProtocol is
+// enabled or l itself
+func (p *Proxy) proxyProtoListener(l net.Listener) net.Listener {
+	if !p.ProxyProtocol {
+		return l
+	}
+
+	return &proxyProtoListener{Listener: l, trusted: p.TrustedProxies}
+}
+
+// proxyProtoListener is a net.Listener the connections of which from the
+// trusted proxies start with the PROXY protocol header, v1 or v2, e.g. the
+// ones from HAProxy with send-proxy-v2.  Their RemoteAddr is the client's
+// address from the header.  The other connections are served as usual.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// Accept implements the net.Listener interface for *proxyProtoListener
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	ip, _ := addrIPPort(conn.RemoteAddr())
+	if ip == nil || !subnetsContain(l.trusted, ip) {
+		return conn, nil
+	}
+
+	return &proxyProtoConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtoConn is a connection from a trusted proxy.  The header is read
+// on the first Read, so that Accept isn't blocked by the slow proxies, and
+// the caller's read deadline applies to it.
+type proxyProtoConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once sync.Once
+	err  error // error reading the header
+
+	remote     net.Addr // client's address from the header, if any
+	remoteLock sync.RWMutex
+}
+
+// Read implements the net.Conn interface for *proxyProtoConn
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.r.Read(b)
+}
+
+// RemoteAddr implements the net.Conn interface for *proxyProtoConn.  It's the
+// proxy's address until the header is read.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.remoteLock.RLock()
+	defer c.remoteLock.RUnlock()
+
+	if c.remote != nil {
+		return c.remote
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads the PROXY protocol header of the connection
+func (c *proxyProtoConn) readHeader() {
+	addr, err := readProxyProtoHeader(c.r)
+	if err != nil {
+		c.err = errorx.Decorate(err, "reading PROXY protocol header from %s", c.Conn.RemoteAddr())
+		log.Debug("%s", c.err)
+		return
+	}
+
+	if addr != nil {
+		log.Tracef("Connection from %s is proxied for %s", c.Conn.RemoteAddr(), addr)
+		c.remoteLock.Lock()
+		c.remote = addr
+		c.remoteLock.Unlock()
+	}
+}
+
+// readProxyProtoHeader reads the PROXY protocol header, v1 or v2, and returns
+// the client's address from it.  The address is nil if the proxy tells that
+// the connection is its own, e.g. a health check, or has no IP address.
+func readProxyProtoHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtoV2Sig))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(sig, proxyProtoV2Sig):
+		return readProxyProtoV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readProxyProtoV1(r)
+	default:
+		return nil, errors.New("no PROXY protocol header")
+	}
+}
+
+// readProxyProtoV2 reads the binary header of the PROXY protocol v2
+func readProxyProtoV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, len(proxyProtoV2Sig)+4)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	verCmd, fam := hdr[12], hdr[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("bad version %d", verCmd>>4)
+	}
+
+	// The address block may be followed by the TLVs, which are skipped
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// The LOCAL command is for the proxy's own connections
+	if verCmd&0xf == 0 {
+		return nil, nil
+	}
+
+	var ipLen int
+	switch fam >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC or AF_UNIX
+		return nil, nil
+	}
+
+	if len(data) < 2*ipLen+4 {
+		return nil, fmt.Errorf("bad address block length %d", len(data))
+	}
+
+	ip := net.IP(append([]byte{}, data[:ipLen]...))
+	port := binary.BigEndian.Uint16(data[2*ipLen:])
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtoV1 reads the text header line of the PROXY protocol v1, e.g.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 853\r\n"
+func readProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtoV1MaxLen {
+			return nil, errors.New("too long v1 header")
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("bad v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("bad v1 header %q", line)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// proxyProtoV2Header returns the PROXY protocol v2 header of the TCP
+// connection from src to dst with a TLV after the address block
+func proxyProtoV2Header(src, dst *net.TCPAddr) []byte {
+	srcIP, dstIP, fam := src.IP.To4(), dst.IP.To4(), byte(0x11)
+	if srcIP == nil {
+		srcIP, dstIP, fam = src.IP.To16(), dst.IP.To16(), 0x21
+	}
+
+	data := append(append([]byte{}, srcIP...), dstIP...)
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(data[2*len(srcIP):], uint16(src.Port))
+	binary.BigEndian.PutUint16(data[2*len(srcIP)+2:], uint16(dst.Port))
+	// PP2_TYPE_AUTHORITY
+	data = append(data, 0x02, 0, 3, 'f', 'o', 'o')
+
+	hdr := append(append([]byte{}, proxyProtoV2Sig...), 0x21, fam, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(data)))
+
+	return append(hdr, data...)
+}
+
+func TestReadProxyProtoHeader(t *testing.T) {
+	client4 := &net.TCPAddr{IP: net.IP{203, 0, 113, 5}, Port: 56324}
+	client6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::5"), Port: 56324}
+	server4 := &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 853}
+	server6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 853}
+
+	local := proxyProtoV2Header(client4, server4)
+	local[12] = 0x20
+	badVersion := proxyProtoV2Header(client4, server4)
+	badVersion[12] = 0x11
+
+	testCases := []struct {
+		name   string
+		header []byte
+		want   string
+		err    bool
+	}{
+		{"v1_tcp4", []byte("PROXY TCP4 203.0.113.5 192.0.2.1 56324 853\r\n"), "203.0.113.5:56324", false},
+		{"v1_tcp6", []byte("PROXY TCP6 2001:db8::5 2001:db8::1 56324 853\r\n"), "[2001:db8::5]:56324", false},
+		{"v1_unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1_bad", []byte("PROXY TCP4 203.0.113.5 192.0.2.1 56324\r\n"), "", true},
+		{"v1_too_long", append([]byte("PROXY "), bytes.Repeat([]byte{'x'}, 200)...), "", true},
+		{"v2_tcp4", proxyProtoV2Header(client4, server4), "203.0.113.5:56324", false},
+		{"v2_tcp6", proxyProtoV2Header(client6, server6), "[2001:db8::5]:56324", false},
+		{"v2_local", local, "", false},
+		{"v2_bad_version", badVersion, "", true},
+		{"no_header", []byte("\x00\x1c\x12\x34\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00"), "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The data after the header must be left in the reader
+			r := bufio.NewReader(bytes.NewReader(append(tc.header, "rest"...)))
+			addr, err := readProxyProtoHeader(r)
+			if tc.err {
+				assert.NotNil(t, err)
+				return
+			}
+
+			if !assert.Nil(t, err) {
+				return
+			}
+			if tc.want == "" {
+				assert.Nil(t, addr)
+			} else if assert.NotNil(t, addr) {
+				assert.Equal(t, tc.want, addr.String())
+			}
+
+			rest := make([]byte, 4)
+			_, err = r.Read(rest)
+			assert.Nil(t, err)
+			assert.Equal(t, "rest", string(rest))
+		})
+	}
+}
+
+func TestProxyProtocolTCP(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.ProxyProtocol = true
+	dnsProxy.TrustedProxies = []*net.IPNet{{IP: net.IP{127, 0, 0, 0}, Mask: net.CIDRMask(8, 32)}}
+
+	var addrs []string
+	var addrsLock sync.Mutex
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		addrsLock.Lock()
+		addrs = append(addrs, d.Addr.String())
+		addrsLock.Unlock()
+
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	addr := dnsProxy.Addr(ProtoTCP).(*net.TCPAddr)
+	client := &net.TCPAddr{IP: net.IP{203, 0, 113, 5}, Port: 56324}
+
+	exchange := func(header []byte) error {
+		c, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		_ = c.SetDeadline(time.Now().Add(time.Second))
+		_, err = c.Write(header)
+		if err != nil {
+			return err
+		}
+
+		conn := &dns.Conn{Conn: c}
+		err = conn.WriteMsg(createTestMessage())
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.ReadMsg()
+		return err
+	}
+
+	assert.Nil(t, exchange(proxyProtoV2Header(client, addr)))
+	assert.Nil(t, exchange([]byte("PROXY TCP4 203.0.113.6 127.0.0.1 56325 53\r\n")))
+
+	// The trusted proxies must send the header
+	assert.NotNil(t, exchange(nil))
+
+	addrsLock.Lock()
+	defer addrsLock.Unlock()
+	assert.Equal(t, []string{"203.0.113.5:56324", "203.0.113.6:56325"}, addrs)
+}
@@ -58,6 +58,50 @@ func TestProxyRace(t *testing.T) {
 	}
 }
 
+func TestProxyPreCreatedListeners(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(listenIP)})
+	assert.Nil(t, err)
+	tcpListen, err := net.Listen("tcp", listenIP+":0")
+	assert.Nil(t, err)
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UDPListenAddr = nil
+	dnsProxy.TCPListenAddr = nil
+	dnsProxy.UDPListeners = []net.PacketConn{udpConn}
+	dnsProxy.TCPListeners = []net.Listener{tcpListen}
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	err = dnsProxy.Start()
+	assert.Nil(t, err)
+	assert.Equal(t, udpConn.LocalAddr(), dnsProxy.Addr(ProtoUDP))
+	assert.Equal(t, tcpListen.Addr(), dnsProxy.Addr(ProtoTCP))
+
+	for _, proto := range []string{ProtoUDP, ProtoTCP} {
+		conn, err := dns.Dial(proto, dnsProxy.Addr(proto).String())
+		assert.Nil(t, err)
+
+		err = conn.WriteMsg(createTestMessage())
+		assert.Nil(t, err)
+		res, err := conn.ReadMsg()
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+		_ = conn.Close()
+	}
+
+	assert.Nil(t, dnsProxy.Stop())
+
+	// The proxy owns the listeners, so they must be closed now
+	_, err = tcpListen.Accept()
+	assert.NotNil(t, err)
+
+	// TLS listeners require TLS config
+	dnsProxy = &Proxy{Config: Config{TLSListeners: []net.Listener{tcpListen}}}
+	assert.NotNil(t, dnsProxy.validateListenAddrs())
+}
+
 func TestUpstreamsSort(t *testing.T) {
 	testProxy := createTestProxy(t, nil)
 	upstreams := []upstream.Upstream{}
@@ -72,14 +116,14 @@ func TestUpstreamsSort(t *testing.T) {
 		upstreams = append(upstreams, up)
 	}
 
-	// create upstreamRttStats for 3 upstreams
-	upstreamRttStats := map[string]int{}
-	upstreamRttStats["1.1.1.1:53"] = 10
-	upstreamRttStats["2.3.4.5:53"] = 20
-	upstreamRttStats["1.2.3.4:53"] = 30
-	testProxy.upstreamRttStats = upstreamRttStats
+	// record the rtt of 3 upstreams
+	l := testProxy.upstreamLayer()
+	l.recordExchange("1.1.1.1:53", 10*time.Millisecond, nil)
+	l.recordExchange("2.3.4.5:53", 20*time.Millisecond, nil)
+	l.recordExchange("1.2.3.4:53", 30*time.Millisecond, nil)
 
-	sortedUpstreams := testProxy.getSortedUpstreams(upstreams)
+	testProxy.UpstreamProbeRate = -1
+	sortedUpstreams := testProxy.loadBalanceOrder(upstreams)
 
 	// upstream without rtt stats means `zero rtt`; this upstream should be the first one after sorting
 	if sortedUpstreams[0].Address() != "8.8.8.8:53" {
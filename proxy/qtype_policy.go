@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// minimalAnyTTL is the TTL of the synthesized HINFO record of the minimal
+// ANY responses, RFC 8482 recommends a long one
+const minimalAnyTTL = 3600
+
+// QTypeAction is the way the requests of a query type are handled
+type QTypeAction int
+
+// QTypeAction values
+const (
+	QTypeActionPass    QTypeAction = iota // resolved as usual
+	QTypeActionRefuse                     // answered with REFUSED
+	QTypeActionNotImpl                    // answered with NOTIMP, the same as Config.RefuseAny does
+	QTypeActionDrop                       // dropped without a response
+	QTypeActionMinimal                    // answered with a synthesized HINFO record for ANY (RFC 8482) and an empty NOERROR for the others
+	QTypeActionTCPOnly                    // answered with a truncated response over UDP, so that the client retries over TCP, resolved as usual over the other protocols and with a valid cookie
+)
+
+// qtypeActionNames are the names of the QTypeAction values
+var qtypeActionNames = map[string]QTypeAction{
+	"pass":     QTypeActionPass,
+	"refuse":   QTypeActionRefuse,
+	"notimp":   QTypeActionNotImpl,
+	"drop":     QTypeActionDrop,
+	"minimal":  QTypeActionMinimal,
+	"tcp_only": QTypeActionTCPOnly,
+}
+
+// String implements the fmt.Stringer interface for QTypeAction
+func (a QTypeAction) String() string {
+	for name, action := range qtypeActionNames {
+		if action == a {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("QTypeAction(%d)", int(a))
+}
+
+// QTypePolicy is the actions for the query types.  The requests of the
+// query types that aren't in it are resolved as usual.
+type QTypePolicy map[uint16]QTypeAction
+
+// ParseQTypePolicy parses the policy from the TYPE=action strings, e.g.
+// "ANY=minimal" or "AXFR=refuse".  The actions are pass, refuse, notimp,
+// drop, minimal, and tcp_only.
+func ParseQTypePolicy(rules []string) (QTypePolicy, error) {
+	policy := QTypePolicy{}
+	for _, rule := range rules {
+		i := strings.IndexByte(rule, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid query type rule %q, expected TYPE=action", rule)
+		}
+
+		qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(rule[:i]))]
+		if !ok {
+			return nil, fmt.Errorf("invalid query type in %q", rule)
+		}
+
+		action, ok := qtypeActionNames[strings.TrimSpace(rule[i+1:])]
+		if !ok {
+			return nil, fmt.Errorf("invalid action in %q", rule)
+		}
+
+		policy[qtype] = action
+	}
+
+	return policy, nil
+}
+
+// qtypeAction returns the action for the request.  ListenerConfig.QTypePolicy
+// is used instead of Config.QTypePolicy if it's set.  The ANY requests that
+// aren't in the policy are refused if Config.RefuseAny is set.
+func (p *Proxy) qtypeAction(d *DNSContext) QTypeAction {
+	policy := p.QTypePolicy
+	if d.listener != nil && d.listener.QTypePolicy != nil {
+		policy = d.listener.QTypePolicy
+	}
+
+	qtype := d.Req.Question[0].Qtype
+	if action, ok := policy[qtype]; ok {
+		return action
+	}
+
+	if p.RefuseAny && qtype == dns.TypeANY {
+		return QTypeActionNotImpl
+	}
+
+	return QTypeActionPass
+}
+
+// applyQTypePolicy handles the request according to the query type policy.
+// It returns false if the request must be dropped.
+func (p *Proxy) applyQTypePolicy(d *DNSContext) bool {
+	action := p.qtypeAction(d)
+	switch action {
+	case QTypeActionPass:
+		return true
+	case QTypeActionRefuse:
+		d.Res = p.genRefused(d.Req)
+		setEDE(d.Res, d.Req, edeProhibited, "query type is refused")
+	case QTypeActionNotImpl:
+		d.Res = p.genNotImpl(d.Req)
+	case QTypeActionDrop:
+		d.ResponseClass = ResponseClassDropped
+		return false
+	case QTypeActionMinimal:
+		d.Res = genMinimalResponse(d.Req)
+	case QTypeActionTCPOnly:
+		// A valid cookie proves the client's address as well as TCP
+		if d.Proto != ProtoUDP || d.CookieValid {
+			return true
+		}
+		d.Res = &dns.Msg{}
+		d.Res.SetReply(d.Req)
+		d.Res.RecursionAvailable = true
+		d.Res.Truncated = true
+	}
+
+	log.Tracef("Applying query type action %s to %s", action, d.Req.Question[0].String())
+	d.ResponseClass = ResponseClassBlocked
+	return true
+}
+
+// genMinimalResponse returns the minimal response to the request: the
+// synthesized HINFO record for ANY as described in RFC 8482 and an empty
+// NOERROR for the other types
+func genMinimalResponse(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if q.Qtype != dns.TypeANY {
+		return GenEmptyMessage(req, dns.RcodeSuccess, retryNoError)
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	resp.Answer = []dns.RR{&dns.HINFO{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: q.Qclass, Ttl: minimalAnyTTL},
+		Cpu: "RFC8482",
+	}}
+	return resp
+}
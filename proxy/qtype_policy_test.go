@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQTypePolicy(t *testing.T) {
+	policy, err := ParseQTypePolicy([]string{"ANY=minimal", "axfr=refuse", "TXT = tcp_only"})
+	assert.Nil(t, err)
+	assert.Equal(t, QTypePolicy{
+		dns.TypeANY:  QTypeActionMinimal,
+		dns.TypeAXFR: QTypeActionRefuse,
+		dns.TypeTXT:  QTypeActionTCPOnly,
+	}, policy)
+	assert.Equal(t, "tcp_only", QTypeActionTCPOnly.String())
+
+	for _, rule := range []string{"ANY", "BAD=refuse", "ANY=bad"} {
+		_, err = ParseQTypePolicy([]string{rule})
+		assert.NotNil(t, err, rule)
+	}
+}
+
+func TestApplyQTypePolicy(t *testing.T) {
+	p := &Proxy{}
+	p.QTypePolicy = QTypePolicy{
+		dns.TypeANY:  QTypeActionMinimal,
+		dns.TypeAXFR: QTypeActionRefuse,
+		dns.TypeIXFR: QTypeActionDrop,
+		dns.TypeTXT:  QTypeActionTCPOnly,
+	}
+	newCtx := func(proto string, qtype uint16) *DNSContext {
+		req := &dns.Msg{}
+		req.SetQuestion("example.org.", qtype)
+		return &DNSContext{Proto: proto, Req: req}
+	}
+
+	d := newCtx(ProtoUDP, dns.TypeANY)
+	assert.True(t, p.applyQTypePolicy(d))
+	assert.Equal(t, ResponseClassBlocked, d.ResponseClass)
+	assert.Equal(t, "RFC8482", d.Res.Answer[0].(*dns.HINFO).Cpu)
+
+	d = newCtx(ProtoTCP, dns.TypeAXFR)
+	assert.True(t, p.applyQTypePolicy(d))
+	assert.Equal(t, dns.RcodeRefused, d.Res.Rcode)
+
+	d = newCtx(ProtoUDP, dns.TypeIXFR)
+	assert.False(t, p.applyQTypePolicy(d))
+	assert.Nil(t, d.Res)
+	assert.Equal(t, ResponseClassDropped, d.ResponseClass)
+
+	// tcp_only only truncates the UDP responses
+	d = newCtx(ProtoUDP, dns.TypeTXT)
+	assert.True(t, p.applyQTypePolicy(d))
+	assert.True(t, d.Res.Truncated)
+	d = newCtx(ProtoTCP, dns.TypeTXT)
+	assert.True(t, p.applyQTypePolicy(d))
+	assert.Nil(t, d.Res)
+
+	d = newCtx(ProtoUDP, dns.TypeA)
+	assert.True(t, p.applyQTypePolicy(d))
+	assert.Nil(t, d.Res)
+
+	// The listener policy replaces the global one, RefuseAny is applied to
+	// ANY if neither has it
+	p.RefuseAny = true
+	d = newCtx(ProtoUDP, dns.TypeANY)
+	d.listener = &ListenerConfig{QTypePolicy: QTypePolicy{dns.TypeA: QTypeActionMinimal}}
+	assert.True(t, p.applyQTypePolicy(d))
+	assert.Equal(t, dns.RcodeNotImplemented, d.Res.Rcode)
+	d = newCtx(ProtoUDP, dns.TypeA)
+	d.listener = &ListenerConfig{QTypePolicy: QTypePolicy{dns.TypeA: QTypeActionMinimal}}
+	assert.True(t, p.applyQTypePolicy(d))
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Empty(t, d.Res.Answer)
+}
+
+func TestQTypePolicyListener(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TCPListenAddr = nil
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+	dnsProxy.Listeners = []*ListenerConfig{{
+		UDPListenAddr: []*net.UDPAddr{{IP: net.ParseIP(listenIP)}},
+		QTypePolicy:   QTypePolicy{dns.TypeANY: QTypeActionRefuse},
+	}}
+
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeANY)
+	client := &dns.Client{Net: "udp"}
+	addrs := dnsProxy.Addrs(ProtoUDP)
+
+	res, _, err := client.Exchange(req, addrs[0].String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+
+	res, _, err = client.Exchange(req, addrs[1].String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeRefused, res.Rcode)
+}
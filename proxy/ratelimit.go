@@ -3,6 +3,7 @@ package proxy
 import (
 	"net"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -10,7 +11,9 @@ import (
 	gocache "github.com/patrickmn/go-cache"
 )
 
-func (p *Proxy) limiterForIP(ip string) interface{} {
+// limiterForIP returns the ratelimiter for the IP with the specified limit.
+// The listeners with different limits don't share the ratelimiters.
+func (p *Proxy) limiterForIP(ip string, limit int) interface{} {
 	p.ratelimitLock.Lock()
 	defer p.ratelimitLock.Unlock()
 	if p.ratelimitBuckets == nil {
@@ -18,10 +21,15 @@ func (p *Proxy) limiterForIP(ip string) interface{} {
 	}
 
 	// check if ratelimiter for that IP already exists, if not, create
-	value, found := p.ratelimitBuckets.Get(ip)
+	k := ip
+	if limit != p.Ratelimit {
+		k = strconv.Itoa(limit) + "/" + ip
+	}
+
+	value, found := p.ratelimitBuckets.Get(k)
 	if !found {
-		value = rate.New(p.Ratelimit, time.Second)
-		p.ratelimitBuckets.Set(ip, value, time.Hour)
+		value = rate.New(limit, time.Second)
+		p.ratelimitBuckets.Set(k, value, time.Hour)
 	}
 
 	return value
@@ -29,7 +37,13 @@ func (p *Proxy) limiterForIP(ip string) interface{} {
 
 // isRatelimited checks if the specified IP is ratelimited
 func (p *Proxy) isRatelimited(addr net.Addr) bool {
-	if p.Ratelimit <= 0 { // 0 -- disabled
+	return p.isRatelimitedWith(addr, p.Ratelimit)
+}
+
+// isRatelimitedWith checks if the specified IP is ratelimited with the
+// specified max number of requests per second
+func (p *Proxy) isRatelimitedWith(addr net.Addr, limit int) bool {
+	if limit <= 0 || isUnixAddr(addr) { // 0 -- disabled
 		return false
 	}
 
@@ -48,7 +62,7 @@ func (p *Proxy) isRatelimited(addr net.Addr) bool {
 		}
 	}
 
-	value := p.limiterForIP(ip)
+	value := p.limiterForIP(ip, limit)
 	rl, ok := value.(*rate.RateLimiter)
 	if !ok {
 		log.Println("SHOULD NOT HAPPEN: non-bool entry found in safebrowsing lookup cache")
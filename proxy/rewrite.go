@@ -0,0 +1,454 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// defaultRewriteTTL is the TTL of the rewritten responses if Rewrites.TTL
+// isn't set
+const defaultRewriteTTL = 60
+
+// RewriteRule answers the requests for the names matching the pattern with a
+// static record.  The pattern is either a domain name, e.g. "nas.lan", a
+// wildcard matching the subdomains of a domain, e.g. "*.dev.example.com", or
+// a regular expression between slashes matched against the name without the
+// trailing dot, e.g. "/^web[0-9]+\.example\.com$/".
+type RewriteRule struct {
+	Pattern string `json:"pattern"`
+	// Type is A, AAAA, CNAME, or TXT
+	Type string `json:"type"`
+	// Value is the address, the target name, or the text
+	Value string `json:"value"`
+}
+
+// String returns the rule in the "pattern type value" form of the rewrites
+// files
+func (r RewriteRule) String() string {
+	return r.Pattern + " " + r.Type + " " + r.Value
+}
+
+// ParseRewriteRule parses a rule in the "pattern type value" form, e.g.
+// "*.dev.example.com A 10.0.0.5".  The value of a TXT rule is the rest of the
+// line.
+func ParseRewriteRule(s string) (RewriteRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 3 {
+		return RewriteRule{}, fmt.Errorf("invalid rewrite rule %q, expected pattern type value", s)
+	}
+
+	r := RewriteRule{Pattern: fields[0], Type: strings.ToUpper(fields[1]), Value: fields[2]}
+	if r.Type == "TXT" {
+		// The text may have spaces, so it's the rest of the line after the
+		// pattern and the type, which may also occur in the pattern
+		rest := strings.TrimSpace(s)
+		for _, f := range fields[:2] {
+			rest = strings.TrimLeftFunc(rest[len(f):], unicode.IsSpace)
+		}
+		r.Value = rest
+	}
+
+	_, err := compileRewriteRule(r)
+	if err != nil {
+		return RewriteRule{}, err
+	}
+
+	return r, nil
+}
+
+// rewriteRule is the compiled RewriteRule
+type rewriteRule struct {
+	RewriteRule
+
+	// name is the domain of an exact or a wildcard pattern
+	name     string
+	wildcard bool
+	re       *regexp.Regexp
+	rrtype   uint16
+	ip       net.IP // address of an A or AAAA rule
+	target   string // FQDN of a CNAME rule
+}
+
+// compileRewriteRule validates the rule and prepares it for matching
+func compileRewriteRule(r RewriteRule) (*rewriteRule, error) {
+	c := &rewriteRule{RewriteRule: r}
+
+	switch p := r.Pattern; {
+	case len(p) > 2 && p[0] == '/' && p[len(p)-1] == '/':
+		re, err := regexp.Compile(p[1 : len(p)-1])
+		if err != nil {
+			return nil, errorx.Decorate(err, "invalid rewrite pattern %q", p)
+		}
+		c.re = re
+	default:
+		c.wildcard = strings.HasPrefix(p, "*.")
+		name, err := normalizeLocalHost(strings.TrimPrefix(p, "*."))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite pattern %q", p)
+		}
+		c.name = name
+	}
+
+	switch r.Type {
+	case "A", "AAAA":
+		c.ip = net.ParseIP(r.Value)
+		if c.ip == nil || (c.ip.To4() != nil) != (r.Type == "A") {
+			return nil, fmt.Errorf("invalid %s rewrite value %q", r.Type, r.Value)
+		}
+		if r.Type == "A" {
+			c.ip = c.ip.To4()
+		}
+	case "CNAME":
+		if _, ok := dns.IsDomainName(r.Value); !ok || r.Value == "" {
+			return nil, fmt.Errorf("invalid CNAME rewrite value %q", r.Value)
+		}
+		c.target = dns.Fqdn(strings.ToLower(r.Value))
+	case "TXT":
+		if r.Value == "" {
+			return nil, fmt.Errorf("empty TXT rewrite value")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported rewrite type %q", r.Type)
+	}
+	c.rrtype = dns.StringToType[r.Type]
+
+	return c, nil
+}
+
+// match returns the priority of the match of the host or 0 if the rule
+// doesn't match it.  An exact pattern has the highest priority, then the
+// wildcards with the more labels, and then the regular expressions.
+func (c *rewriteRule) match(host string) int {
+	switch {
+	case c.re != nil:
+		if c.re.MatchString(host) {
+			return 1
+		}
+	case c.wildcard:
+		if strings.HasSuffix(host, "."+c.name) {
+			return 2 + dns.CountLabel(c.name)
+		}
+	case host == c.name:
+		return 1 << 16
+	}
+
+	return 0
+}
+
+// rr returns the record of the rule for the name
+func (c *rewriteRule) rr(name string, ttl uint32) dns.RR {
+	hdr := dns.RR_Header{Name: name, Rrtype: c.rrtype, Class: dns.ClassINET, Ttl: ttl}
+	switch c.rrtype {
+	case dns.TypeA:
+		return &dns.A{Hdr: hdr, A: c.ip}
+	case dns.TypeAAAA:
+		return &dns.AAAA{Hdr: hdr, AAAA: c.ip}
+	case dns.TypeCNAME:
+		return &dns.CNAME{Hdr: hdr, Target: c.target}
+	default:
+		return &dns.TXT{Hdr: hdr, Txt: splitTXT(c.Value)}
+	}
+}
+
+// splitTXT splits the text into the strings of at most 255 bytes
+func splitTXT(s string) []string {
+	var txt []string
+	for len(s) > 255 {
+		txt = append(txt, s[:255])
+		s = s[255:]
+	}
+
+	return append(txt, s)
+}
+
+// Rewrites answers the requests for the names matching the rules with the
+// static records without sending them to the upstreams.  The rules are
+// loaded from a file and added at runtime, e.g. via the admin API.  If
+// several patterns match a name, the most specific one wins and all its
+// rules are used: the records of the question type are returned, a CNAME is
+// followed, and the other types are answered with an empty NOERROR.  It's
+// safe for concurrent use.
+type Rewrites struct {
+	// Path is the path of the rewrites file with a rule per line in the
+	// "pattern type value" form.  The empty lines and the lines starting
+	// with "#" are skipped.
+	Path string
+	// RefreshInterval is the interval between the reloads of the file.  If
+	// 0, it's only loaded on start and by Reload.
+	RefreshInterval time.Duration
+	// TTL is the TTL of the responses, defaultRewriteTTL is used if 0.
+	TTL uint32
+
+	fileRules []*rewriteRule // rules from the file
+	rules     []*rewriteRule // rules added at runtime
+	lock      sync.RWMutex
+}
+
+// Reload reloads the rules from the file.  The previous rules are kept if it
+// fails.
+func (rw *Rewrites) Reload() error {
+	if rw.Path == "" {
+		return nil
+	}
+
+	rules, err := loadRewrites(rw.Path)
+	if err != nil {
+		return err
+	}
+
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+
+	rw.fileRules = rules
+	return nil
+}
+
+// Add adds the rule, it isn't removed by the file reloads
+func (rw *Rewrites) Add(r RewriteRule) error {
+	r.Type = strings.ToUpper(r.Type)
+	c, err := compileRewriteRule(r)
+	if err != nil {
+		return err
+	}
+
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+
+	for _, old := range rw.rules {
+		if old.RewriteRule == r {
+			return nil
+		}
+	}
+	rw.rules = append(rw.rules, c)
+
+	return nil
+}
+
+// Remove removes the rule added with Add and returns true if it was there
+func (rw *Rewrites) Remove(r RewriteRule) bool {
+	r.Type = strings.ToUpper(r.Type)
+
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+
+	for i, old := range rw.rules {
+		if old.RewriteRule == r {
+			rw.rules = append(rw.rules[:i], rw.rules[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Rules returns the rules from the file followed by the ones added with Add
+func (rw *Rewrites) Rules() []RewriteRule {
+	rw.lock.RLock()
+	defer rw.lock.RUnlock()
+
+	rules := make([]RewriteRule, 0, len(rw.fileRules)+len(rw.rules))
+	for _, c := range rw.fileRules {
+		rules = append(rules, c.RewriteRule)
+	}
+	for _, c := range rw.rules {
+		rules = append(rules, c.RewriteRule)
+	}
+
+	return rules
+}
+
+// matchLocked returns the rules of the most specific pattern matching the
+// host.  rw.lock is expected to be locked.
+func (rw *Rewrites) matchLocked(host string) []*rewriteRule {
+	var matched []*rewriteRule
+	best, pattern := 0, ""
+	for _, rules := range [][]*rewriteRule{rw.fileRules, rw.rules} {
+		for _, c := range rules {
+			// Of the regular expressions with the same priority, the
+			// first matching one wins
+			prio := c.match(host)
+			if prio > best {
+				best, pattern, matched = prio, c.Pattern, []*rewriteRule{c}
+			} else if prio == best && prio != 0 && c.Pattern == pattern {
+				matched = append(matched, c)
+			}
+		}
+	}
+
+	return matched
+}
+
+// response returns the response to the request or nil if no rule matches the
+// question name.  rw may be nil, nothing is answered then.
+func (rw *Rewrites) response(req *dns.Msg) *dns.Msg {
+	if rw == nil {
+		return nil
+	}
+
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+
+	ttl := rw.TTL
+	if ttl == 0 {
+		ttl = defaultRewriteTTL
+	}
+
+	rw.lock.RLock()
+	defer rw.lock.RUnlock()
+
+	var answer []dns.RR
+	name := q.Name
+	// Every iteration either ends the loop or follows a rewritten CNAME, so
+	// this limit protects from the CNAME loops
+	for i := 0; i <= maxCNAMEChaseDepth; i++ {
+		rules := rw.matchLocked(strings.ToLower(strings.TrimSuffix(name, ".")))
+		if len(rules) == 0 {
+			if i == 0 {
+				return nil
+			}
+			break
+		}
+
+		var cname *rewriteRule
+		found := false
+		for _, c := range rules {
+			if c.rrtype == q.Qtype {
+				answer = append(answer, c.rr(name, ttl))
+				found = true
+			} else if c.rrtype == dns.TypeCNAME && cname == nil {
+				cname = c
+			}
+		}
+		if found || cname == nil {
+			break
+		}
+
+		answer = append(answer, cname.rr(name, ttl))
+		name = cname.target
+	}
+
+	if len(answer) == 0 {
+		return GenEmptyMessage(req, dns.RcodeSuccess, ttl)
+	}
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	resp.Answer = answer
+	return resp
+}
+
+// rewrite answers the request from the rewrites.  If the rewritten CNAME
+// chain for an A or AAAA question ends outside of them, the rest of it is
+// resolved with the upstreams.  It returns false if no rule matches.
+func (p *Proxy) rewrite(d *DNSContext) bool {
+	resp := p.Rewrites.response(d.Req)
+	if resp == nil {
+		return false
+	}
+
+	q := d.Req.Question[0]
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+		if target, terminated := cnameChainEnd(resp, q); !terminated && target != "" {
+			p.chaseCNAME(q, resp, func(name string) []upstream.Upstream {
+				return p.upstreamsForDomain(d.CustomUpstreamConfig, name)
+			})
+		}
+	}
+
+	d.Res = resp
+	return true
+}
+
+// loadRewrites loads the rules from the file
+func loadRewrites(path string) ([]*rewriteRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't open %s", path)
+	}
+	defer f.Close()
+
+	var rules []*rewriteRule
+	br := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if s := strings.TrimSpace(line); s != "" && s[0] != '#' {
+			r, perr := ParseRewriteRule(s)
+			if perr != nil {
+				return nil, errorx.Decorate(perr, "%s:%d", path, n)
+			}
+			c, _ := compileRewriteRule(r)
+			rules = append(rules, c)
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errorx.Decorate(err, "couldn't read %s", path)
+		}
+	}
+
+	return rules, nil
+}
+
+// startRewrites loads the rewrites file and starts the reload loop if needed
+func (p *Proxy) startRewrites() {
+	rw := p.Rewrites
+	if rw == nil || rw.Path == "" {
+		return
+	}
+
+	err := rw.Reload()
+	if err != nil {
+		log.Error("%s", err)
+	}
+	log.Info("Loaded %d rewrite rules", len(rw.Rules()))
+
+	if rw.RefreshInterval <= 0 {
+		return
+	}
+
+	p.rewritesStop = make(chan struct{})
+	go p.rewritesRefreshLoop(p.rewritesStop)
+}
+
+// stopRewrites stops the rewrites reload loop if it's running
+func (p *Proxy) stopRewrites() {
+	if p.rewritesStop != nil {
+		close(p.rewritesStop)
+		p.rewritesStop = nil
+	}
+}
+
+// rewritesRefreshLoop reloads the rewrites file until stop is closed
+func (p *Proxy) rewritesRefreshLoop(stop chan struct{}) {
+	t := time.NewTicker(p.Rewrites.RefreshInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			err := p.Rewrites.Reload()
+			if err != nil {
+				log.Error("%s", err)
+			}
+		}
+	}
+}
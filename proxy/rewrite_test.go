@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRewriteRule(t *testing.T) {
+	r, err := ParseRewriteRule("*.dev.example.com a 10.0.0.5")
+	assert.Nil(t, err)
+	assert.Equal(t, RewriteRule{Pattern: "*.dev.example.com", Type: "A", Value: "10.0.0.5"}, r)
+
+	r, err = ParseRewriteRule("example.com TXT v=spf1 -all")
+	assert.Nil(t, err)
+	assert.Equal(t, "v=spf1 -all", r.Value)
+
+	// The type also occurs in the pattern
+	r, err = ParseRewriteRule("txt.example.com txt hello")
+	assert.Nil(t, err)
+	assert.Equal(t, RewriteRule{Pattern: "txt.example.com", Type: "TXT", Value: "hello"}, r)
+
+	r, err = ParseRewriteRule("\ttxt.example.com \t TXT  hello  world ")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello  world", r.Value)
+
+	for _, s := range []string{
+		"example.com A",
+		"example.com A fd00::1",
+		"example.com AAAA 10.0.0.1",
+		"example.com MX mail.example.com",
+		"example.com CNAME bad..name",
+		"/[/ A 10.0.0.1",
+		"*.bad..example.com A 10.0.0.1",
+	} {
+		_, err = ParseRewriteRule(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func newRewrites(t *testing.T, rules ...string) *Rewrites {
+	rw := &Rewrites{TTL: 30}
+	for _, s := range rules {
+		r, err := ParseRewriteRule(s)
+		assert.Nil(t, err)
+		assert.Nil(t, rw.Add(r))
+	}
+
+	return rw
+}
+
+func TestRewritesResponse(t *testing.T) {
+	rw := newRewrites(t,
+		"/^web[0-9]+\\.example\\.com$/ A 10.0.0.10",
+		"*.example.com A 10.0.0.1",
+		"*.dev.example.com A 10.0.0.5",
+		"*.dev.example.com A 10.0.0.6",
+		"api.dev.example.com AAAA fd00::7",
+		"docs.example.com CNAME site.example.net",
+		"site.example.net CNAME host.example.org",
+		"host.example.org A 192.0.2.1",
+		"loop.example.net CNAME loop.example.net",
+		"txt.example.net TXT hello world",
+	)
+
+	answer := func(name string, qtype uint16) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, qtype)
+		return rw.response(req)
+	}
+	ips := func(resp *dns.Msg) (ips []string) {
+		for _, rr := range resp.Answer {
+			switch v := rr.(type) {
+			case *dns.A:
+				ips = append(ips, v.A.String())
+			case *dns.AAAA:
+				ips = append(ips, v.AAAA.String())
+			}
+		}
+		return ips
+	}
+
+	// The longer wildcard wins and all its rules are used
+	resp := answer("x.dev.example.com.", dns.TypeA)
+	assert.Equal(t, []string{"10.0.0.5", "10.0.0.6"}, ips(resp))
+	assert.Equal(t, uint32(30), resp.Answer[0].Header().Ttl)
+	assert.Equal(t, "x.dev.example.com.", resp.Answer[0].Header().Name)
+
+	// The exact name wins, the other types get an empty NOERROR
+	resp = answer("API.dev.example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+	assert.Equal(t, []string{"fd00::7"}, ips(answer("api.dev.example.com.", dns.TypeAAAA)))
+
+	// The wildcards win over the regular expressions and don't match the
+	// domain itself
+	assert.Equal(t, []string{"10.0.0.1"}, ips(answer("web1.example.com.", dns.TypeA)))
+	assert.Nil(t, answer("example.com.", dns.TypeA))
+	assert.Nil(t, answer("example.org.", dns.TypeA))
+
+	// The CNAMEs are followed through the rules
+	resp = answer("docs.example.com.", dns.TypeA)
+	if assert.Len(t, resp.Answer, 3) {
+		assert.Equal(t, "site.example.net.", resp.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, "host.example.org.", resp.Answer[1].(*dns.CNAME).Target)
+		assert.Equal(t, []string{"192.0.2.1"}, ips(resp))
+	}
+	resp = answer("docs.example.com.", dns.TypeCNAME)
+	assert.Len(t, resp.Answer, 1)
+	resp = answer("loop.example.net.", dns.TypeA)
+	assert.Len(t, resp.Answer, maxCNAMEChaseDepth+1)
+
+	resp = answer("txt.example.net.", dns.TypeTXT)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, []string{"hello world"}, resp.Answer[0].(*dns.TXT).Txt)
+	}
+
+	var nilRewrites *Rewrites
+	assert.Nil(t, nilRewrites.response(createTestMessage()))
+}
+
+func TestRewritesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rewrites.txt")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("# dev\n*.dev.example.com A 10.0.0.5\n\n"), 0o644))
+
+	rw := newRewrites(t, "nas.lan A 192.168.1.10")
+	rw.Path = path
+	assert.Nil(t, rw.Reload())
+	assert.Equal(t, []RewriteRule{
+		{Pattern: "*.dev.example.com", Type: "A", Value: "10.0.0.5"},
+		{Pattern: "nas.lan", Type: "A", Value: "192.168.1.10"},
+	}, rw.Rules())
+
+	// The invalid file is reported with the line and the rules are kept
+	assert.Nil(t, ioutil.WriteFile(path, []byte("*.dev.example.com A 10.0.0.5\nbad\n"), 0o644))
+	err = rw.Reload()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "rewrites.txt:2")
+	}
+	assert.Len(t, rw.Rules(), 2)
+
+	// The added rules survive the reloads
+	assert.Nil(t, ioutil.WriteFile(path, nil, 0o644))
+	assert.Nil(t, rw.Reload())
+	assert.Equal(t, []RewriteRule{{Pattern: "nas.lan", Type: "A", Value: "192.168.1.10"}}, rw.Rules())
+
+	assert.True(t, rw.Remove(RewriteRule{Pattern: "nas.lan", Type: "a", Value: "192.168.1.10"}))
+	assert.False(t, rw.Remove(RewriteRule{Pattern: "nas.lan", Type: "A", Value: "192.168.1.10"}))
+	assert.Empty(t, rw.Rules())
+}
+
+func TestRewritesProxy(t *testing.T) {
+	u := &testUpstream{aResp: newRR("example.org. 300 IN A 192.0.2.1").(*dns.A)}
+	p := &Proxy{}
+	p.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{u}}
+	p.Rewrites = newRewrites(t, "docs.example.com CNAME example.org")
+
+	// The end of the chain is resolved with the upstreams
+	d := &DNSContext{Req: createHostTestMessage("docs.example.com")}
+	assert.True(t, p.rewrite(d))
+	if assert.Len(t, d.Res.Answer, 2) {
+		assert.Equal(t, net.IP{192, 0, 2, 1}, d.Res.Answer[1].(*dns.A).A.To4())
+	}
+
+	d = &DNSContext{Req: createHostTestMessage("www.example.com")}
+	assert.False(t, p.rewrite(d))
+	assert.Nil(t, d.Res)
+}
+
+func TestAdminRewrites(t *testing.T) {
+	p := &Proxy{}
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		p.adminHandler().ServeHTTP(w, r)
+		return w
+	}
+
+	rule := `{"pattern": "*.dev.example.com", "type": "A", "value": "10.0.0.5"}`
+	assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, adminPathRewrites, rule).Code)
+
+	p.Rewrites = &Rewrites{}
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, adminPathRewrites, rule).Code)
+	assert.Equal(t, http.StatusBadRequest, call(http.MethodPost, adminPathRewrites, `{"pattern": "x", "type": "MX"}`).Code)
+
+	w := call(http.MethodGet, adminPathRewrites, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var rules []RewriteRule
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&rules))
+	assert.Equal(t, []RewriteRule{{Pattern: "*.dev.example.com", Type: "A", Value: "10.0.0.5"}}, rules)
+
+	assert.Equal(t, http.StatusOK, call(http.MethodDelete, adminPathRewrites, rule).Code)
+	assert.Equal(t, http.StatusNotFound, call(http.MethodDelete, adminPathRewrites, rule).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, call(http.MethodPut, adminPathRewrites, rule).Code)
+
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, adminPathRewritesReload, "").Code)
+	p.Rewrites.Path = "/nonexistent/rewrites.txt"
+	assert.Equal(t, http.StatusInternalServerError, call(http.MethodPost, adminPathRewritesReload, "").Code)
+}
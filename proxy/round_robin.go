@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// rotateCachedAnswers rotates the A and AAAA answers of the cached response
+// by one more position for every response if Config.CacheRoundRobin is set,
+// so that the naive clients taking the first address spread over all of
+// them.  The other records keep their places.  The answers keep their sorted
+// order in the Config.Deterministic mode.  The cached responses are unpacked
+// anew for every request, so the response is changed in place.
+func (p *Proxy) rotateCachedAnswers(d *DNSContext) {
+	if !p.CacheRoundRobin || p.Deterministic || d.ResponseClass != ResponseClassCached {
+		return
+	}
+
+	var addrs []dns.RR
+	for _, rr := range d.Res.Answer {
+		if answerIP(rr) != nil {
+			addrs = append(addrs, rr)
+		}
+	}
+	if len(addrs) < 2 {
+		return
+	}
+
+	n := int(atomic.AddUint32(&p.roundRobinCounter, 1) % uint32(len(addrs)))
+	addrs = append(addrs[n:], addrs[:n]...)
+
+	for i, rr := range d.Res.Answer {
+		if answerIP(rr) != nil {
+			d.Res.Answer[i] = addrs[0]
+			addrs = addrs[1:]
+		}
+	}
+}
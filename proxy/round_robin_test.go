@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotateCachedAnswers(t *testing.T) {
+	p := &Proxy{}
+	p.CacheRoundRobin = true
+
+	res := &dns.Msg{}
+	res.Answer = []dns.RR{
+		newRR("www.example.com. 300 IN CNAME edge.example.net."),
+		newRR("edge.example.net. 300 IN A 192.0.2.1"),
+		newRR("edge.example.net. 300 IN A 192.0.2.2"),
+		newRR("edge.example.net. 300 IN A 192.0.2.3"),
+	}
+
+	// Every address comes first in turn
+	first := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		d := &DNSContext{Res: res.Copy(), ResponseClass: ResponseClassCached}
+		p.rotateCachedAnswers(d)
+
+		assert.IsType(t, &dns.CNAME{}, d.Res.Answer[0])
+		assert.Len(t, d.Res.Answer, 4)
+		first[answerIP(d.Res.Answer[1]).String()] = true
+	}
+	assert.Len(t, first, 3)
+
+	// The responses from the upstreams aren't rotated
+	d := &DNSContext{Res: res.Copy(), ResponseClass: ResponseClassUpstream}
+	p.rotateCachedAnswers(d)
+	assert.Equal(t, res.Answer, d.Res.Answer)
+
+	// Neither are they in the deterministic mode
+	p.Deterministic = true
+	d = &DNSContext{Res: res.Copy(), ResponseClass: ResponseClassCached}
+	p.rotateCachedAnswers(d)
+	assert.Equal(t, res.Answer, d.Res.Answer)
+
+	// Nor if it's disabled
+	p.Deterministic = false
+	p.CacheRoundRobin = false
+	d = &DNSContext{Res: res.Copy(), ResponseClass: ResponseClassCached}
+	p.rotateCachedAnswers(d)
+	assert.Equal(t, res.Answer, d.Res.Answer)
+}
@@ -43,16 +43,31 @@ func (p *Proxy) startListeners() error {
 		return err
 	}
 
+	err = p.createUnixListeners()
+	if err != nil {
+		return err
+	}
+
+	err = p.createAdminListener()
+	if err != nil {
+		return err
+	}
+
+	err = p.createACMEHTTPListener()
+	if err != nil {
+		return err
+	}
+
 	for _, l := range p.udpListen {
-		go p.udpPacketLoop(l, p.requestGoroutinesSema)
+		go p.udpPacketLoop(l, p.listenerConfigs[l], p.udpGoroutinesSema)
 	}
 
 	for _, l := range p.tcpListen {
-		go p.tcpPacketLoop(l, ProtoTCP, p.requestGoroutinesSema)
+		go p.tcpPacketLoop(p.proxyProtoListener(l), ProtoTCP, p.listenerConfigs[l], p.requestGoroutinesSema)
 	}
 
 	for _, l := range p.tlsListen {
-		go p.tcpPacketLoop(l, ProtoTLS, p.requestGoroutinesSema)
+		go p.tcpPacketLoop(l, ProtoTLS, p.listenerConfigs[l], p.requestGoroutinesSema)
 	}
 
 	for i := range p.httpsServer {
@@ -71,65 +86,186 @@ func (p *Proxy) startListeners() error {
 		go func(l net.Listener) { _ = p.dnsCryptServer.ServeTCP(l) }(l)
 	}
 
+	for _, l := range p.unixListen {
+		go p.tcpPacketLoop(l, ProtoTCP, nil, p.requestGoroutinesSema)
+	}
+
+	for _, c := range p.unixgramListen {
+		go p.udpPacketLoop(c, nil, p.udpGoroutinesSema)
+	}
+
+	if p.adminServer != nil {
+		go p.listenAdmin(p.adminServer, p.adminListen)
+	}
+
+	if p.acmeHTTPServer != nil {
+		go p.listenACMEHTTP(p.acmeHTTPServer, p.acmeHTTPListen)
+	}
+
 	return nil
 }
 
+// listenPacket creates a packet-oriented listener for the specified protocol
+// using Config.ListenPacket if it's set
+func (p *Proxy) listenPacket(proto string, addr *net.UDPAddr) (net.PacketConn, error) {
+	if p.ListenPacket != nil {
+		return p.ListenPacket(proto, addr)
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// listenStream creates a stream-oriented listener for the specified protocol
+// using Config.ListenStream if it's set
+func (p *Proxy) listenStream(proto string, addr *net.TCPAddr) (net.Listener, error) {
+	if p.ListenStream != nil {
+		return p.ListenStream(proto, addr)
+	}
+
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
 // handleDNSRequest processes the incoming packet bytes and returns with an optional response packet.
 func (p *Proxy) handleDNSRequest(d *DNSContext) error {
 	d.StartTime = time.Now()
+	p.stats.incRequests()
+	defer p.acquireUpstreams()()
+	defer p.finishDNSRequest(d)
 	p.logDNSMessage(d.Req)
+	p.captureClientMessage(d, d.Req, d.StartTime)
+
+	if p.isClientVerbose(d.Addr) {
+		log.Info("%s %s: IN: %s", d.Proto, d.Addr, d.Req)
+	}
 
 	if d.Req.Response {
 		log.Debug("Dropping incoming Reply packet from %s", d.Addr.String())
+		d.ResponseClass = ResponseClassDropped
 		return nil
 	}
 
+	p.processClientInfo(d)
+
+	if !p.isAllowedClient(d) {
+		// The UDP refusals are ratelimited too, so that the proxy can't be
+		// used to reflect them to the spoofed addresses
+		if d.ClientProto() == ProtoUDP && p.isRatelimitedWith(d.ClientAddr(), p.ratelimit(d)) {
+			log.Tracef("Ratelimiting %v denied by the ACL", d.ClientAddr())
+			d.ResponseClass = ResponseClassDropped
+			return nil
+		}
+
+		log.Debug("Refusing request from %s denied by the ACL", d.Addr)
+		p.stats.incACLRefused()
+		d.Res = p.genRefused(d.Req)
+		setEDE(d.Res, d.Req, edeProhibited, "")
+		d.ResponseClass = ResponseClassBlocked
+		p.respond(d)
+		return nil
+	}
+
+	if !p.processCookie(d) {
+		return nil
+	}
+
+	if d.listener != nil && d.listener.UpstreamConfig != nil && d.CustomUpstreamConfig == nil {
+		d.CustomUpstreamConfig = d.listener.UpstreamConfig
+	}
+
 	if p.BeforeRequestHandler != nil {
 		ok, err := p.BeforeRequestHandler(p, d)
 		if err != nil {
 			log.Error("Error in the BeforeRequestHandler: %s", err)
 			d.Res = p.genServerFailure(d.Req)
+			d.ResponseClass = ResponseClassError
 			p.respond(d)
 			return nil
 		}
 		if !ok {
+			if d.ResponseClass == ResponseClassNone {
+				d.ResponseClass = ResponseClassDropped
+			}
 			return nil // do nothing, don't reply
 		}
 	}
 
 	// ratelimit based on IP only, protects CPU cycles and outbound connections
-	if d.Proto == ProtoUDP && p.isRatelimited(d.Addr) {
-		log.Tracef("Ratelimiting %v based on IP only", d.Addr)
+	if d.ClientProto() == ProtoUDP && p.isRatelimitedWith(d.ClientAddr(), p.ratelimit(d)) {
+		log.Tracef("Ratelimiting %v based on IP only", d.ClientAddr())
+		d.ResponseClass = ResponseClassDropped
 		return nil // do nothing, don't reply, we got ratelimited
 	}
 
+	if isUpdateOrNotify(d.Req) {
+		if f := p.updateForward(d); f != nil {
+			p.forwardUpdate(d, f)
+			p.logDNSMessage(d.Res)
+			p.respond(d)
+			return nil
+		}
+	}
+
+	p.truncation.onRequest(d)
+
 	if len(d.Req.Question) != 1 {
 		log.Debug("got invalid number of questions: %v", len(d.Req.Question))
 		d.Res = p.genServerFailure(d.Req)
+		d.ResponseClass = ResponseClassError
+	}
+
+	// refuse, drop, or minimally answer ANY and other abusive query types
+	// (anti-DDOS measure)
+	if d.Res == nil && !p.applyQTypePolicy(d) {
+		return nil
 	}
 
-	// refuse ANY requests (anti-DDOS measure)
-	if p.RefuseAny && len(d.Req.Question) > 0 && d.Req.Question[0].Qtype == dns.TypeANY {
-		log.Tracef("Refusing type=ANY request")
-		d.Res = p.genNotImpl(d.Req)
+	if d.Res == nil {
+		d.Res = p.LocalHosts.response(d.Req)
+		if d.Res != nil {
+			log.Tracef("Answering %s from the local hosts", d.Req.Question[0].Name)
+			d.ResponseClass = ResponseClassLocal
+		}
+	}
+
+	if d.Res == nil && p.rewrite(d) {
+		log.Tracef("Answering %s from the rewrites", d.Req.Question[0].Name)
+		d.ResponseClass = ResponseClassLocal
+	}
+
+	if d.Res == nil && p.Blocklist.Match(d.Req.Question[0].Name) {
+		log.Tracef("Blocking %s", d.Req.Question[0].Name)
+		d.Res = p.Blocklist.response(d.Req)
+		setEDE(d.Res, d.Req, p.Blocklist.edeCode(), "")
+		d.ResponseClass = ResponseClassBlocked
 	}
 
 	var err error
 
 	if d.Res == nil {
-		if len(p.UpstreamConfig.Upstreams) == 0 {
+		if len(p.getUpstreamConfig().Upstreams) == 0 {
 			panic("SHOULD NOT HAPPEN: no default upstreams specified")
 		}
 
 		// execute the DNS request
 		// if there is a custom middleware configured, use it
-		if p.RequestHandler != nil {
-			err = p.RequestHandler(p, d)
+		if handler := p.requestHandler(d); handler != nil {
+			err = handler(p, d)
 		} else {
 			err = p.Resolve(d)
 		}
 
 		if err != nil {
+			d.ResponseClass = ResponseClassError
 			err = errorx.Decorate(err, "talking to dnsUpstream failed")
 		}
 	}
@@ -139,15 +275,52 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) error {
 	return err
 }
 
+// finishDNSRequest classifies the processed request if it hasn't been
+// classified yet, counts it in the stats, and logs the result
+func (p *Proxy) finishDNSRequest(d *DNSContext) {
+	if d.ResponseClass == ResponseClassNone {
+		if d.Res == nil {
+			d.ResponseClass = ResponseClassDropped
+		} else {
+			// A custom RequestHandler has generated the response itself
+			d.ResponseClass = ResponseClassLocal
+		}
+	}
+
+	p.stats.incResponse(d)
+
+	rcode := "-"
+	if d.Res != nil {
+		rcode = dns.RcodeToString[d.Res.Rcode]
+	}
+	if p.isClientVerbose(d.Addr) {
+		log.Info("%s %s: OUT (%s, %s): %s", d.Proto, d.Addr, d.ResponseClass, rcode, d.Res)
+	} else if len(d.Req.Question) > 0 {
+		q := d.Req.Question[0]
+		log.Debug("%s %s: %s %s: %s, %s", d.Proto, d.Addr, dns.Type(q.Qtype), q.Name, d.ResponseClass, rcode)
+	}
+}
+
 // respond writes the specified response to the client (or does nothing if d.Res is empty)
 func (p *Proxy) respond(d *DNSContext) {
 	if d.Res == nil {
 		return
 	}
 
+	p.rotateCachedAnswers(d)
+	p.applyGeoIP(d)
+	p.applySplitHorizon(d)
+	p.setClientTTL(d)
+	p.setCookie(d)
+	d.pad()
+	p.captureClientMessage(d, d.Res, time.Now())
+	p.truncation.onResponse(d)
+
 	// d.Conn can be nil in the case of a DOH request
 	if d.Conn != nil {
 		d.Conn.SetWriteDeadline(time.Now().Add(defaultTimeout)) //nolint
+	} else if d.packetConn != nil {
+		d.packetConn.SetWriteDeadline(time.Now().Add(defaultTimeout)) //nolint
 	}
 
 	var err error
@@ -1,13 +1,20 @@
 package proxy
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
+	"path"
 	"strconv"
+	"strings"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
@@ -16,25 +23,52 @@ import (
 func (p *Proxy) createHTTPSListeners() error {
 	for _, a := range p.HTTPSListenAddr {
 		log.Info("Creating an HTTPS server")
-		tcpListen, err := net.ListenTCP("tcp", a)
+		tcpListen, err := p.listenStream(ProtoHTTPS, a)
 		if err != nil {
 			return errorx.Decorate(err, "could not start HTTPS listener")
 		}
-		p.httpsListen = append(p.httpsListen, tcpListen)
-		log.Info("Listening to https://%s", tcpListen.Addr())
-
-		srv := &http.Server{
-			TLSConfig:         p.TLSConfig.Clone(),
-			Handler:           p,
-			ReadHeaderTimeout: defaultTimeout,
-			WriteTimeout:      defaultTimeout,
+		p.addHTTPSListener(tcpListen, nil)
+	}
+
+	for _, l := range p.HTTPSListeners {
+		p.addHTTPSListener(l, nil)
+	}
+
+	for _, lc := range p.Listeners {
+		for _, a := range lc.HTTPSListenAddr {
+			log.Info("Creating an HTTPS server")
+			tcpListen, err := p.listenStream(ProtoHTTPS, a)
+			if err != nil {
+				return errorx.Decorate(err, "could not start HTTPS listener")
+			}
+			p.addHTTPSListener(tcpListen, lc)
+			p.setListenerConfig(tcpListen, lc)
 		}
-		p.httpsServer = append(p.httpsServer, srv)
 	}
 
 	return nil
 }
 
+// addHTTPSListener creates an HTTPS server for the listener.  lc is the
+// settings of the listener, it may be nil.
+func (p *Proxy) addHTTPSListener(l net.Listener, lc *ListenerConfig) {
+	p.httpsListen = append(p.httpsListen, l)
+	log.Info("Listening to https://%s", l.Addr())
+
+	var handler http.Handler = p
+	if lc != nil {
+		handler = &httpsHandler{proxy: p, listener: lc}
+	}
+
+	srv := &http.Server{
+		TLSConfig:         p.TLSConfig.Clone(),
+		Handler:           handler,
+		ReadHeaderTimeout: defaultTimeout,
+		WriteTimeout:      defaultTimeout,
+	}
+	p.httpsServer = append(p.httpsServer, srv)
+}
+
 // serveHttps starts the HTTPS server
 func (p *Proxy) listenHTTPS(srv *http.Server, l net.Listener) {
 	log.Info("Listening to DNS-over-HTTPS on %s", l.Addr())
@@ -48,61 +82,71 @@ func (p *Proxy) listenHTTPS(srv *http.Server, l net.Listener) {
 }
 
 // ServeHTTP is the http.RequestHandler implementation that handles DOH queries
+// (RFC 8484): the GET requests with the base64url-encoded message in the dns
+// parameter and the POST requests with the message in the body.
 // Here is what it returns:
-// http.StatusBadRequest - if there is no DNS request data
+// http.StatusBadRequest - if there is no DNS request data or it's malformed
 // http.StatusUnsupportedMediaType - if request content type is not application/dns-message
 // http.StatusMethodNotAllowed - if request method is not GET or POST
+// http.StatusUnauthorized - if HTTPSAuthTokens are set and the client didn't pass any of them
+// http.StatusRequestEntityTooLarge - if the request exceeds the max message size of the client
+// http.StatusServiceUnavailable - if Backpressure is set and all the request goroutines are busy
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Tracef("Incoming HTTPS request on %s", r.URL)
+	p.serveHTTP(w, r, nil)
+}
 
-	var buf []byte
-	var err error
+// serveHTTP handles the DOH query received on the listener with the settings
+// lc, which may be nil
+func (p *Proxy) serveHTTP(w http.ResponseWriter, r *http.Request, lc *ListenerConfig) {
+	log.Tracef("Incoming HTTPS request on %s", p.httpsLogPath(r))
 
-	switch r.Method {
-	case http.MethodGet:
-		dnsParam := r.URL.Query().Get("dns")
-		buf, err = base64.RawURLEncoding.DecodeString(dnsParam)
-		if len(buf) == 0 || err != nil {
-			log.Tracef("Cannot parse DNS request from %s", dnsParam)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
-		}
-	case http.MethodPost:
-		contentType := r.Header.Get("Content-Type")
-		if contentType != "application/dns-message" {
-			log.Tracef("Unsupported media type: %s", contentType)
-			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
-			return
-		}
+	if !p.isHTTPSAuthorized(r) {
+		log.Tracef("Unauthorized DNS-over-HTTPS request from %s", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
 
-		buf, err = ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.Tracef("Cannot read the request body: %s", err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
+	release, ok := p.acquireHTTP(w)
+	if !ok {
+		log.Tracef("Refusing DNS-over-HTTPS request from %s: too many requests", r.RemoteAddr)
+		return
+	}
+	defer release()
+
+	buf, code, err := readDoHMessage(r)
+	if err != nil {
+		log.Tracef("Bad DNS-over-HTTPS request from %s: %s", r.RemoteAddr, err)
+		if code == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", "GET, POST")
 		}
-		defer r.Body.Close()
-	default:
-		log.Tracef("Wrong HTTP method: %s", r.Method)
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	addr, _ := p.remoteAddr(r)
+
+	if len(buf) > dns.MaxMsgSize || p.isTooLarge(lc, addr, len(buf)) {
+		log.Tracef("Too large DNS request (%d bytes) from %s", len(buf), addr)
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	msg := new(dns.Msg)
-	if err = msg.Unpack(buf); err != nil {
+	msg, err := proxyutil.UnpackMsg(buf)
+	if err != nil {
 		log.Tracef("msg.Unpack: %s", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	addr, _ := p.remoteAddr(r)
-
 	d := &DNSContext{
 		Proto:              ProtoHTTPS,
 		Req:                msg,
 		Addr:               addr,
 		HTTPRequest:        r,
 		HTTPResponseWriter: w,
+
+		listener: lc,
 	}
 
 	err = p.handleDNSRequest(d)
@@ -111,25 +155,159 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Get a client IP address from HTTP headers that proxy servers may set
-func getIPFromHTTPRequest(r *http.Request) net.IP {
-	names := []string{
-		"CF-Connecting-IP", "True-Client-IP", // set by CloudFlare servers
-		"X-Real-IP",
+// dohMediaType is the media type of the DNS messages in DOH
+const dohMediaType = "application/dns-message"
+
+// readDoHMessage returns the DNS message of the DOH request.  If the request
+// is malformed, it returns the error and the HTTP status code to respond
+// with.
+func readDoHMessage(r *http.Request) (buf []byte, code int, err error) {
+	switch r.Method {
+	case http.MethodGet:
+		dnsParam := r.URL.Query().Get("dns")
+		if dnsParam == "" {
+			return nil, http.StatusBadRequest, errors.New("no dns parameter")
+		}
+
+		// The padding must be omitted, but some clients add it anyway
+		buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(dnsParam, "="))
+		if err != nil {
+			return nil, http.StatusBadRequest, errorx.Decorate(err, "decoding dns parameter")
+		}
+	case http.MethodPost:
+		contentType := r.Header.Get("Content-Type")
+		mediaType, _, mtErr := mime.ParseMediaType(contentType)
+		if mtErr != nil || mediaType != dohMediaType {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported media type: %q", contentType)
+		}
+
+		// A DNS message can't be larger, so the body isn't read further
+		buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if err != nil {
+			return nil, http.StatusBadRequest, errorx.Decorate(err, "reading request body")
+		}
+		defer r.Body.Close()
+	default:
+		return nil, http.StatusMethodNotAllowed, fmt.Errorf("wrong HTTP method: %s", r.Method)
+	}
+
+	if len(buf) == 0 {
+		return nil, http.StatusBadRequest, errors.New("empty DNS message")
 	}
+
+	return buf, http.StatusOK, nil
+}
+
+// isHTTPSAuthorized checks if the request contains one of HTTPSAuthTokens
+// either in the Authorization header or in the URL path
+func (p *Proxy) isHTTPSAuthorized(r *http.Request) bool {
+	if len(p.HTTPSAuthTokens) == 0 {
+		return true
+	}
+
+	var candidates []string
+	const bearerPrefix = "Bearer "
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, bearerPrefix) {
+		candidates = append(candidates, strings.TrimSpace(auth[len(bearerPrefix):]))
+	}
+	if r.URL != nil {
+		candidates = append(candidates, path.Base(r.URL.Path))
+	}
+
+	for _, c := range candidates {
+		for _, token := range p.HTTPSAuthTokens {
+			if subtle.ConstantTimeCompare([]byte(c), []byte(token)) == 1 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// httpsLogPath returns the URL path of the DoH request to log.  If
+// HTTPSAuthTokens are set, its last element, which may be the token, is
+// redacted.
+func (p *Proxy) httpsLogPath(r *http.Request) string {
+	if r.URL == nil {
+		return ""
+	} else if len(p.HTTPSAuthTokens) == 0 {
+		return r.URL.Path
+	}
+
+	dir, last := path.Split(r.URL.Path)
+	if last == "" {
+		return r.URL.Path
+	}
+
+	return dir + "REDACTED"
+}
+
+// defaultHTTPClientIPHeaders are the HTTP headers the client's IP address is
+// taken from if Config.HTTPSClientIPHeaders isn't set
+var defaultHTTPClientIPHeaders = []string{
+	"CF-Connecting-IP", "True-Client-IP", // set by CloudFlare servers
+	"Fastly-Client-IP", // set by Fastly servers
+	"X-Real-IP",
+	"X-Forwarded-For",
+}
+
+// httpClientIP returns the client's IP address from the HTTP headers that
+// the CDNs and the reverse proxies set or nil if there is none.  peer is the
+// address the request came from.  The headers are only used if peer is one
+// of Config.HTTPSTrustedProxies, since any client can set them.
+func (p *Proxy) httpClientIP(r *http.Request, peer net.IP) net.IP {
+	if peer == nil || !subnetsContain(p.HTTPSTrustedProxies, peer) {
+		return nil
+	}
+
+	names := p.HTTPSClientIPHeaders
+	if names == nil {
+		names = defaultHTTPClientIPHeaders
+	}
+
 	for _, name := range names {
 		s := r.Header.Get(name)
-		ip := net.ParseIP(s)
+		if s == "" {
+			continue
+		}
+
+		var ip net.IP
+		if http.CanonicalHeaderKey(name) == "X-Forwarded-For" {
+			ip = p.forwardedForIP(r.Header[http.CanonicalHeaderKey(name)])
+		} else {
+			ip = net.ParseIP(strings.TrimSpace(s))
+		}
+
 		if ip != nil {
 			return ip
 		}
 	}
 
-	s := r.Header.Get("X-Forwarded-For")
-	s = splitNext(&s, ',') // get left-most IP address
-	ip := net.ParseIP(s)
-	if ip != nil {
-		return ip
+	return nil
+}
+
+// forwardedForIP returns the client's IP address from the X-Forwarded-For
+// header values.  It's the right-most address that isn't one of
+// Config.HTTPSTrustedProxies, since the ones to the left of it may be spoofed
+// by the client.
+func (p *Proxy) forwardedForIP(values []string) net.IP {
+	var addrs []string
+	for _, v := range values {
+		for v != "" {
+			addrs = append(addrs, strings.TrimSpace(splitNext(&v, ',')))
+		}
+	}
+
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(addrs[i])
+		if ip == nil {
+			return nil
+		}
+
+		if !subnetsContain(p.HTTPSTrustedProxies, ip) {
+			return ip
+		}
 	}
 
 	return nil
@@ -147,11 +325,28 @@ func (p *Proxy) respondHTTPS(d *DNSContext) error {
 	}
 
 	w.Header().Set("Server", "AdGuard DNS")
-	w.Header().Set("Content-Type", "application/dns-message")
+	w.Header().Set("Content-Type", dohMediaType)
+	setDoHCacheHeaders(w.Header(), resp)
 	_, err = w.Write(bytes)
 	return err
 }
 
+// setDoHCacheHeaders sets the HTTP caching headers of the DOH response, so
+// that the HTTP caches don't keep it longer than the DNS caches would (RFC
+// 8484, section 5.1).  The freshness lifetime is the lowest TTL of the
+// records, the SOA one for the negative responses.  The TTLs of the cached
+// responses are already decreased by the time they've spent in the cache, so
+// the age is always 0.
+func setDoHCacheHeaders(h http.Header, resp *dns.Msg) {
+	var maxAge uint32
+	if !resp.Truncated && (resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError) {
+		maxAge = findLowestTTL(resp)
+	}
+
+	h.Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(maxAge), 10))
+	h.Set("Age", "0")
+}
+
 func (p *Proxy) remoteAddr(r *http.Request) (net.Addr, error) {
 	host, port, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
@@ -163,11 +358,12 @@ func (p *Proxy) remoteAddr(r *http.Request) (net.Addr, error) {
 		return nil, err
 	}
 
-	ip := getIPFromHTTPRequest(r)
+	peer := net.ParseIP(host)
+	ip := p.httpClientIP(r, peer)
 	if ip != nil {
 		log.Tracef("Using IP address from HTTP request: %s", ip)
 	} else {
-		ip = net.ParseIP(host)
+		ip = peer
 		if ip == nil {
 			return nil, fmt.Errorf("invalid IP: %s", host)
 		}
@@ -5,11 +5,14 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
@@ -57,7 +60,7 @@ func TestHttpsProxy(t *testing.T) {
 	req.Header.Set("Content-Type", "application/dns-message")
 	req.Header.Set("Accept", "application/dns-message")
 
-	// IP "1.2.3.4" will be used as a client address in DNSContext
+	// Ignored, since there are no trusted proxies
 	req.Header.Set("X-Forwarded-For", "1.2.3.4, 127.0.0.1")
 
 	client := http.Client{
@@ -78,3 +81,300 @@ func TestHttpsProxy(t *testing.T) {
 
 	assertResponse(t, reply)
 }
+
+func TestHttpsAuthTokens(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.HTTPSAuthTokens = []string{"secret"}
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	msg := createTestMessage()
+	buf, err := msg.Pack()
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		name   string
+		url    string
+		header string
+		code   int
+	}{
+		{"no_token", "https://test.com/dns-query", "", http.StatusUnauthorized},
+		{"bad_token", "https://test.com/dns-query", "Bearer wrong", http.StatusUnauthorized},
+		{"bearer", "https://test.com/dns-query", "Bearer secret", http.StatusOK},
+		{"path", "https://test.com/dns-query/secret", "", http.StatusOK},
+		{"bad_path", "https://test.com/dns-query/secret/x", "", http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.url, bytes.NewReader(buf))
+			req.Header.Set("Content-Type", "application/dns-message")
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+
+			w := httptest.NewRecorder()
+			dnsProxy.ServeHTTP(w, req)
+			assert.Equal(t, tc.code, w.Code)
+		})
+	}
+}
+
+func TestHttpsLogPath(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	req := httptest.NewRequest(http.MethodGet, "https://test.com/dns-query/secret?dns=AAAB", nil)
+	assert.Equal(t, "/dns-query/secret", dnsProxy.httpsLogPath(req))
+
+	dnsProxy.HTTPSAuthTokens = []string{"secret"}
+	assert.Equal(t, "/dns-query/REDACTED", dnsProxy.httpsLogPath(req))
+
+	req = httptest.NewRequest(http.MethodGet, "https://test.com/dns-query/", nil)
+	assert.Equal(t, "/dns-query/", dnsProxy.httpsLogPath(req))
+}
+
+func TestHttpsResponsePadding(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		d.Res.SetEdns0(dns.DefaultMsgSize, false)
+		// The upstream padding must not be passed through
+		proxyutil.AddPadding(d.Res, proxyutil.QueryPaddingBlockSize)
+		return nil
+	}
+
+	exchange := func(msg *dns.Msg) []byte {
+		buf, err := msg.Pack()
+		assert.Nil(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "https://test.com/dns-query", bytes.NewReader(buf))
+		req.Header.Set("Content-Type", "application/dns-message")
+		w := httptest.NewRecorder()
+		dnsProxy.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		return w.Body.Bytes()
+	}
+
+	// The padded query gets the padded response
+	msg := createTestMessage()
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	proxyutil.AddPadding(msg, proxyutil.QueryPaddingBlockSize)
+	body := exchange(msg)
+	assert.Zero(t, len(body)%proxyutil.ResponsePaddingBlockSize)
+
+	// The unpadded one doesn't
+	msg = createTestMessage()
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	body = exchange(msg)
+	reply := &dns.Msg{}
+	assert.Nil(t, reply.Unpack(body))
+	assert.False(t, proxyutil.HasPadding(reply))
+}
+
+func TestHttpsRemoteAddr(t *testing.T) {
+	_, cdn, _ := net.ParseCIDR("203.0.113.0/24")
+
+	testCases := []struct {
+		name    string
+		trusted []*net.IPNet
+		names   []string
+		peer    string
+		headers map[string][]string
+		want    string
+	}{{
+		name: "no_headers",
+		peer: "192.0.2.1:1234",
+		want: "192.0.2.1:1234",
+	}, {
+		name:    "no_trusted_proxies",
+		peer:    "192.0.2.1:1234",
+		headers: map[string][]string{"Fastly-Client-IP": {"198.51.100.1"}},
+		want:    "192.0.2.1:1234",
+	}, {
+		name:    "trusted_peer",
+		trusted: []*net.IPNet{cdn},
+		peer:    "203.0.113.1:1234",
+		headers: map[string][]string{"CF-Connecting-IP": {"198.51.100.1"}},
+		want:    "198.51.100.1:1234",
+	}, {
+		name:    "untrusted_peer",
+		trusted: []*net.IPNet{cdn},
+		peer:    "192.0.2.1:1234",
+		headers: map[string][]string{"CF-Connecting-IP": {"198.51.100.1"}},
+		want:    "192.0.2.1:1234",
+	}, {
+		name:    "custom_header",
+		trusted: []*net.IPNet{cdn},
+		names:   []string{"Fastly-Client-IP"},
+		peer:    "203.0.113.1:1234",
+		headers: map[string][]string{
+			"CF-Connecting-IP": {"198.51.100.1"},
+			"Fastly-Client-IP": {"198.51.100.2"},
+		},
+		want: "198.51.100.2:1234",
+	}, {
+		name:    "forwarded_for_no_trusted_proxies",
+		peer:    "192.0.2.1:1234",
+		headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1, 203.0.113.2"}},
+		want:    "192.0.2.1:1234",
+	}, {
+		name:    "forwarded_for_trusted",
+		trusted: []*net.IPNet{cdn},
+		peer:    "203.0.113.1:1234",
+		headers: map[string][]string{"X-Forwarded-For": {"10.0.0.1, 198.51.100.1", "203.0.113.2"}},
+		want:    "198.51.100.1:1234",
+	}, {
+		name:    "forwarded_for_only_trusted",
+		trusted: []*net.IPNet{cdn},
+		peer:    "203.0.113.1:1234",
+		headers: map[string][]string{"X-Forwarded-For": {"203.0.113.2"}},
+		want:    "203.0.113.1:1234",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: Config{
+				HTTPSTrustedProxies:  tc.trusted,
+				HTTPSClientIPHeaders: tc.names,
+			}}
+
+			r := httptest.NewRequest(http.MethodPost, "/dns-query", nil)
+			r.RemoteAddr = tc.peer
+			for name, values := range tc.headers {
+				for _, v := range values {
+					r.Header.Add(name, v)
+				}
+			}
+
+			addr, err := p.remoteAddr(r)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, addr.String())
+		})
+	}
+}
+
+func TestHttpsGet(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = &dns.Msg{}
+		d.Res.SetReply(d.Req)
+		d.Res.Answer = []dns.RR{
+			newRR("google-public-dns-a.google.com. 300 IN A 8.8.8.8"),
+			newRR("google-public-dns-a.google.com. 60 IN A 8.8.4.4"),
+		}
+		return nil
+	}
+
+	msg := createTestMessage()
+	msg.Id = 0
+	buf, err := msg.Pack()
+	assert.Nil(t, err)
+	param := base64.RawURLEncoding.EncodeToString(buf)
+
+	for _, dnsParam := range []string{param, base64.URLEncoding.EncodeToString(buf)} {
+		req := httptest.NewRequest(http.MethodGet, "https://test.com/dns-query?dns="+dnsParam, nil)
+		req.Header.Set("Accept", "application/dns-message")
+		w := httptest.NewRecorder()
+		dnsProxy.ServeHTTP(w, req)
+		if !assert.Equal(t, http.StatusOK, w.Code) {
+			continue
+		}
+
+		assert.Equal(t, "application/dns-message", w.Header().Get("Content-Type"))
+		assert.Equal(t, "max-age=60", w.Header().Get("Cache-Control"))
+		assert.Equal(t, "0", w.Header().Get("Age"))
+
+		reply := &dns.Msg{}
+		assert.Nil(t, reply.Unpack(w.Body.Bytes()))
+		assert.Len(t, reply.Answer, 2)
+	}
+}
+
+func TestHttpsBadRequests(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	buf, err := createTestMessage().Pack()
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		body        []byte
+		code        int
+	}{
+		{"get_no_param", http.MethodGet, "/dns-query", "", nil, http.StatusBadRequest},
+		{"get_bad_base64", http.MethodGet, "/dns-query?dns=!!!", "", nil, http.StatusBadRequest},
+		{"get_bad_message", http.MethodGet, "/dns-query?dns=AAAA", "", nil, http.StatusBadRequest},
+		{"post_empty", http.MethodPost, "/dns-query", "application/dns-message", nil, http.StatusBadRequest},
+		{"post_bad_type", http.MethodPost, "/dns-query", "text/plain", buf, http.StatusUnsupportedMediaType},
+		{"post_type_params", http.MethodPost, "/dns-query", "application/dns-message; charset=binary", buf, http.StatusOK},
+		{"put", http.MethodPut, "/dns-query", "application/dns-message", buf, http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "https://test.com"+tc.url, bytes.NewReader(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+
+			w := httptest.NewRecorder()
+			dnsProxy.ServeHTTP(w, req)
+			assert.Equal(t, tc.code, w.Code)
+			if tc.code == http.StatusMethodNotAllowed {
+				assert.Equal(t, "GET, POST", w.Header().Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestSetDoHCacheHeaders(t *testing.T) {
+	req := createHostTestMessage("host.example.org")
+
+	testCases := []struct {
+		name  string
+		rcode int
+		rrs   []dns.RR
+		ns    []dns.RR
+		want  string
+	}{{
+		name: "answer",
+		rrs:  []dns.RR{newRR("host.example.org. 300 IN A 1.2.3.4")},
+		want: "max-age=300",
+	}, {
+		name:  "nxdomain",
+		rcode: dns.RcodeNameError,
+		ns:    []dns.RR{newRR("example.org. 900 IN SOA ns.example.org. admin.example.org. 1 7200 3600 86400 900")},
+		want:  "max-age=900",
+	}, {
+		name: "nodata_no_soa",
+		want: "max-age=0",
+	}, {
+		name:  "servfail",
+		rcode: dns.RcodeServerFailure,
+		rrs:   []dns.RR{newRR("host.example.org. 300 IN A 1.2.3.4")},
+		want:  "max-age=0",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := &dns.Msg{}
+			res.SetRcode(req, tc.rcode)
+			res.Answer, res.Ns = tc.rrs, tc.ns
+			res.SetEdns0(4096, false)
+
+			h := http.Header{}
+			setDoHCacheHeaders(h, res)
+			assert.Equal(t, tc.want, h.Get("Cache-Control"))
+			assert.Equal(t, "0", h.Get("Age"))
+		})
+	}
+}
@@ -3,13 +3,14 @@ package proxy
 import (
 	"context"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 	"github.com/lucas-clemente/quic-go"
-	"github.com/miekg/dns"
 )
 
 // NextProtoDQ - During connection establishment, DNS/QUIC support is indicated
@@ -28,16 +29,42 @@ var compatProtoDQ = []string{"dq", "doq"}
 func (p *Proxy) createQUICListeners() error {
 	for _, a := range p.QUICListenAddr {
 		log.Info("Creating a QUIC listener")
-		quicListen, err := quic.ListenAddr(a.String(), p.TLSConfig, &quic.Config{MaxIdleTimeout: maxQuicIdleTimeout})
+		conn, err := p.listenPacket(ProtoQUIC, a)
 		if err != nil {
 			return errorx.Decorate(err, "could not start QUIC listener")
 		}
-		p.quicListen = append(p.quicListen, quicListen)
-		log.Info("Listening to quic://%s", quicListen.Addr())
+
+		err = p.addQUICListener(conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, conn := range p.QUICListeners {
+		err := p.addQUICListener(conn)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// addQUICListener creates a QUIC listener on top of the packet connection
+func (p *Proxy) addQUICListener(conn net.PacketConn) error {
+	// quic.Listen doesn't close the connection when the listener is closed,
+	// so remember it to close it on Stop
+	p.quicPacketConns = append(p.quicPacketConns, conn)
+
+	quicListen, err := quic.Listen(conn, p.TLSConfig, &quic.Config{MaxIdleTimeout: maxQuicIdleTimeout})
+	if err != nil {
+		return errorx.Decorate(err, "could not start QUIC listener")
+	}
+	p.quicListen = append(p.quicListen, quicListen)
+	log.Info("Listening to quic://%s", quicListen.Addr())
+
+	return nil
+}
+
 // quicPacketLoop listens for incoming QUIC packets.
 //
 // See also the comment on Proxy.requestGoroutinesSema.
@@ -131,15 +158,15 @@ func (p *Proxy) handleQUICStream(stream quic.Stream, session quic.Session) {
 		return
 	}
 
-	msg := dns.Msg{}
-	err = msg.Unpack(buf)
+	msg, err := proxyutil.UnpackMsg(buf[:n])
 	if err != nil {
 		log.Info("failed to unpack a DNS query: %v", err)
+		return
 	}
 
 	d := &DNSContext{
 		Proto:      ProtoQUIC,
-		Req:        &msg,
+		Req:        msg,
 		Addr:       session.RemoteAddr(),
 		QUICStream: stream,
 	}
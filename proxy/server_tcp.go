@@ -8,41 +8,82 @@ import (
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
-	"github.com/miekg/dns"
 )
 
 func (p *Proxy) createTCPListeners() error {
 	for _, a := range p.TCPListenAddr {
 		log.Printf("Creating a TCP server socket")
-		tcpListen, err := net.ListenTCP("tcp", a)
+		tcpListen, err := p.listenStream(ProtoTCP, a)
 		if err != nil {
 			return errorx.Decorate(err, "couldn't listen to TCP socket")
 		}
 		p.tcpListen = append(p.tcpListen, tcpListen)
 		log.Printf("Listening to tcp://%s", tcpListen.Addr())
 	}
+
+	for _, l := range p.TCPListeners {
+		p.tcpListen = append(p.tcpListen, l)
+		log.Printf("Listening to tcp://%s", l.Addr())
+	}
+
+	for _, lc := range p.Listeners {
+		for _, a := range lc.TCPListenAddr {
+			log.Printf("Creating a TCP server socket")
+			tcpListen, err := p.listenStream(ProtoTCP, a)
+			if err != nil {
+				return errorx.Decorate(err, "couldn't listen to TCP socket")
+			}
+			p.tcpListen = append(p.tcpListen, tcpListen)
+			p.setListenerConfig(tcpListen, lc)
+			log.Printf("Listening to tcp://%s", tcpListen.Addr())
+		}
+	}
 	return nil
 }
 
 func (p *Proxy) createTLSListeners() error {
 	for _, a := range p.TLSListenAddr {
 		log.Printf("Creating a TLS server socket")
-		tcpListen, err := net.ListenTCP("tcp", a)
+		tcpListen, err := p.listenStream(ProtoTLS, a)
 		if err != nil {
 			return errorx.Decorate(err, "could not start TLS listener")
 		}
-		l := tls.NewListener(tcpListen, p.TLSConfig)
+		l := tls.NewListener(p.proxyProtoListener(tcpListen), p.TLSConfig)
 		p.tlsListen = append(p.tlsListen, l)
+		p.tlsRawListen = append(p.tlsRawListen, tcpListen)
 		log.Printf("Listening to tls://%s", l.Addr())
 	}
+
+	for _, tcpListen := range p.TLSListeners {
+		l := tls.NewListener(p.proxyProtoListener(tcpListen), p.TLSConfig)
+		p.tlsListen = append(p.tlsListen, l)
+		p.tlsRawListen = append(p.tlsRawListen, tcpListen)
+		log.Printf("Listening to tls://%s", l.Addr())
+	}
+
+	for _, lc := range p.Listeners {
+		for _, a := range lc.TLSListenAddr {
+			log.Printf("Creating a TLS server socket")
+			tcpListen, err := p.listenStream(ProtoTLS, a)
+			if err != nil {
+				return errorx.Decorate(err, "could not start TLS listener")
+			}
+			l := tls.NewListener(p.proxyProtoListener(tcpListen), p.TLSConfig)
+			p.tlsListen = append(p.tlsListen, l)
+			p.tlsRawListen = append(p.tlsRawListen, tcpListen)
+			p.setListenerConfig(l, lc)
+			p.setListenerConfig(tcpListen, lc)
+			log.Printf("Listening to tls://%s", l.Addr())
+		}
+	}
 	return nil
 }
 
 // tcpPacketLoop listens for incoming TCP packets.  proto must be either "tcp"
-// or "tls".
+// or "tls".  lc is the settings of the listener, it may be nil.
 //
 // See also the comment on Proxy.requestGoroutinesSema.
-func (p *Proxy) tcpPacketLoop(l net.Listener, proto string, requestGoroutinesSema semaphore) {
+func (p *Proxy) tcpPacketLoop(l net.Listener, proto string, lc *ListenerConfig, requestGoroutinesSema semaphore) {
 	log.Printf("Entering the %s listener loop on %s", proto, l.Addr())
 	for {
 		clientConn, err := l.Accept()
@@ -54,19 +95,36 @@ func (p *Proxy) tcpPacketLoop(l net.Listener, proto string, requestGoroutinesSem
 				log.Info("got error when reading from TCP listen: %s", err)
 			}
 			break
-		} else {
+		}
+
+		if !p.Backpressure {
 			requestGoroutinesSema.acquire()
+		} else if !requestGoroutinesSema.tryAcquire() {
+			if !p.busyRefusersSema.tryAcquire() {
+				p.stats.incBusyRefused()
+				log.Debug("Closing %s connection %s: too many requests", proto, clientConn.RemoteAddr())
+				_ = clientConn.Close()
+				continue
+			}
+
 			go func() {
-				p.handleTCPConnection(clientConn, proto)
-				requestGoroutinesSema.release()
+				p.refuseTCPConnection(clientConn, proto, lc)
+				p.busyRefusersSema.release()
 			}()
+			continue
 		}
+
+		go func() {
+			p.handleTCPConnection(clientConn, proto, lc)
+			requestGoroutinesSema.release()
+		}()
 	}
 }
 
 // handleTCPConnection starts a loop that handles an incoming TCP connection
-// proto is either "tcp" or "tls"
-func (p *Proxy) handleTCPConnection(conn net.Conn, proto string) {
+// proto is either "tcp" or "tls", lc is the settings of the listener, it may
+// be nil
+func (p *Proxy) handleTCPConnection(conn net.Conn, proto string, lc *ListenerConfig) {
 	log.Tracef("Start handling the new %s connection %s", proto, conn.RemoteAddr())
 	defer conn.Close()
 
@@ -83,8 +141,19 @@ func (p *Proxy) handleTCPConnection(conn net.Conn, proto string) {
 			return
 		}
 
-		msg := &dns.Msg{}
-		err = msg.Unpack(packet)
+		if p.isTooLarge(lc, conn.RemoteAddr(), len(packet)) {
+			log.Debug("Closing %s connection %s: too large request (%d bytes)", proto, conn.RemoteAddr(), len(packet))
+			p.rejectTooLarge(&DNSContext{
+				Proto: proto,
+				Addr:  conn.RemoteAddr(),
+				Conn:  conn,
+
+				listener: lc,
+			}, packet)
+			return
+		}
+
+		msg, err := proxyutil.UnpackMsg(packet)
 		if err != nil {
 			log.Info("error handling TCP packet: %s", err)
 			return
@@ -95,6 +164,8 @@ func (p *Proxy) handleTCPConnection(conn net.Conn, proto string) {
 			Req:   msg,
 			Addr:  conn.RemoteAddr(),
 			Conn:  conn,
+
+			listener: lc,
 		}
 
 		err = p.handleDNSRequest(d)
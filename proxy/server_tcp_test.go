@@ -3,9 +3,11 @@ package proxy
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"net"
 	"testing"
 
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestTcpProxy(t *testing.T) {
@@ -34,6 +36,38 @@ func TestTcpProxy(t *testing.T) {
 	}
 }
 
+func TestTcpProxyListenStream(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UDPListenAddr = nil
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	protos := []string{}
+	dnsProxy.ListenStream = func(proto string, addr *net.TCPAddr) (net.Listener, error) {
+		protos = append(protos, proto)
+		return net.Listen("tcp", addr.String())
+	}
+
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+	assert.Equal(t, []string{ProtoTCP}, protos)
+
+	conn, err := dns.Dial("tcp", dnsProxy.Addr(ProtoTCP).String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	err = conn.WriteMsg(createTestMessage())
+	assert.Nil(t, err)
+	res, err := conn.ReadMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+}
+
 func TestTlsProxy(t *testing.T) {
 	// Prepare the proxy server
 	serverConfig, caPem := createServerTLSConfig(t)
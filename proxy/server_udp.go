@@ -17,63 +17,343 @@ func (p *Proxy) createUDPListeners() error {
 		if err != nil {
 			return err
 		}
-		p.udpListen = append(p.udpListen, udpListen)
+		p.udpListen = append(p.udpListen, udpListen...)
+	}
+
+	for _, conn := range p.UDPListeners {
+		err := p.udpSetOptions(conn)
+		if err != nil {
+			return err
+		}
+		p.udpListen = append(p.udpListen, conn)
+		log.Info("Listening to udp://%s", conn.LocalAddr())
+	}
+
+	for _, lc := range p.Listeners {
+		for _, a := range lc.UDPListenAddr {
+			udpListen, err := p.udpCreate(a)
+			if err != nil {
+				return err
+			}
+			for _, l := range udpListen {
+				p.udpListen = append(p.udpListen, l)
+				p.setListenerConfig(l, lc)
+			}
+		}
 	}
 
 	return nil
 }
 
-// udpCreate - create a UDP listening socket
-func (p *Proxy) udpCreate(udpAddr *net.UDPAddr) (*net.UDPConn, error) {
-	log.Info("Creating the UDP server socket")
-	udpListen, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return nil, errorx.Decorate(err, "couldn't listen to UDP socket")
+// udpCreate - create the UDP listening sockets for the address: a single one
+// or Config.UDPSocketsPerAddr ones with SO_REUSEPORT
+func (p *Proxy) udpCreate(udpAddr *net.UDPAddr) ([]net.PacketConn, error) {
+	if p.UDPSocketsPerAddr <= 1 {
+		log.Info("Creating the UDP server socket")
+		udpListen, err := p.listenPacket(ProtoUDP, udpAddr)
+		if err != nil {
+			return nil, errorx.Decorate(err, "couldn't listen to UDP socket")
+		}
+
+		err = p.udpSetOptions(udpListen)
+		if err != nil {
+			_ = udpListen.Close()
+			return nil, err
+		}
+
+		log.Info("Listening to udp://%s", udpListen.LocalAddr())
+		return []net.PacketConn{udpListen}, nil
+	}
+
+	log.Info("Creating %d UDP server sockets with SO_REUSEPORT", p.UDPSocketsPerAddr)
+	conns := make([]net.PacketConn, 0, p.UDPSocketsPerAddr)
+	closeAll := func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}
+
+	addr := udpAddr
+	for i := 0; i < p.UDPSocketsPerAddr; i++ {
+		udpListen, err := proxyutil.ListenUDPReusePort(addr)
+		if err != nil {
+			closeAll()
+			return nil, errorx.Decorate(err, "couldn't listen to UDP socket")
+		}
+		conns = append(conns, udpListen)
+
+		err = p.udpSetOptions(udpListen)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		// The other sockets are bound to the port chosen for the first one
+		addr = udpListen.LocalAddr().(*net.UDPAddr)
+	}
+
+	log.Info("Listening to udp://%s", addr)
+	return conns, nil
+}
+
+// udpSetOptions sets the buffer size and the socket options necessary to get
+// the local IP address of the incoming packets.  Socket options only make
+// sense for the OS sockets, so other connections are left as is.
+func (p *Proxy) udpSetOptions(c net.PacketConn) error {
+	conn, ok := c.(*net.UDPConn)
+	if !ok {
+		return nil
 	}
 
 	if p.Config.UDPBufferSize > 0 {
-		err = udpListen.SetReadBuffer(p.Config.UDPBufferSize)
+		err := conn.SetReadBuffer(p.Config.UDPBufferSize)
 		if err != nil {
-			_ = udpListen.Close()
-			return nil, errorx.Decorate(err, "setting UDP buffer size failed")
+			return errorx.Decorate(err, "setting UDP buffer size failed")
 		}
 	}
 
-	err = proxyutil.UDPSetOptions(udpListen)
+	err := proxyutil.UDPSetOptions(conn)
 	if err != nil {
-		_ = udpListen.Close()
-		return nil, errorx.Decorate(err, "udpSetOptions failed")
+		return errorx.Decorate(err, "udpSetOptions failed")
+	}
+
+	return nil
+}
+
+const (
+	// udpBatchSize is the max number of the UDP packets read or written at
+	// once
+	udpBatchSize = 64
+	// defaultUDPWorkers is the default max number of the long-lived
+	// goroutines processing the requests of a UDP listener
+	defaultUDPWorkers = 256
+	// udpWriteQueueSize is the max number of the UDP responses waiting to be
+	// written
+	udpWriteQueueSize = 1024
+)
+
+// udpRequest is a UDP request waiting to be processed
+type udpRequest struct {
+	buf        []byte // buffer from Proxy.udpBufPool the packet is read into
+	packet     []byte
+	localIP    net.IP
+	remoteAddr net.Addr
+}
+
+// udpWorkers processes the UDP requests with a pool of long-lived goroutines,
+// so that a goroutine isn't spawned for every request.  It starts up to max
+// of them as needed, and if all of them are busy, the request is processed in
+// a new goroutine.  It isn't safe for concurrent use.
+type udpWorkers struct {
+	handle  func(r udpRequest)
+	work    chan udpRequest // requests for the idle workers
+	started int
+	max     int
+}
+
+// newUDPWorkers returns a new pool of up to max workers
+func newUDPWorkers(max int, handle func(r udpRequest)) *udpWorkers {
+	return &udpWorkers{
+		handle: handle,
+		work:   make(chan udpRequest),
+		max:    max,
+	}
+}
+
+// dispatch passes the request to an idle worker
+func (w *udpWorkers) dispatch(r udpRequest) {
+	select {
+	case w.work <- r:
+		return
+	default:
 	}
 
-	log.Info("Listening to udp://%s", udpListen.LocalAddr())
-	return udpListen, nil
+	if w.started < w.max {
+		w.started++
+		go w.run(r)
+		return
+	}
+
+	go w.handle(r)
+}
+
+// run processes the request and then the other ones until the pool is
+// stopped
+func (w *udpWorkers) run(r udpRequest) {
+	w.handle(r)
+	for r = range w.work {
+		w.handle(r)
+	}
+}
+
+// stop stops the idle workers and the busy ones once they're done
+func (w *udpWorkers) stop() {
+	close(w.work)
 }
 
-// udpPacketLoop listens for incoming UDP packets.
+// udpWriter writes the UDP responses to a socket in batches
+type udpWriter struct {
+	conn  *net.UDPConn
+	batch *proxyutil.UDPBatch
+	queue chan proxyutil.UDPPacket
+	done  chan struct{} // closed to stop the writer
+}
+
+// newUDPWriter returns a new writer to conn and starts it
+func newUDPWriter(conn *net.UDPConn) *udpWriter {
+	w := &udpWriter{
+		conn:  conn,
+		batch: proxyutil.NewUDPBatch(conn, udpBatchSize),
+		queue: make(chan proxyutil.UDPPacket, udpWriteQueueSize),
+		done:  make(chan struct{}),
+	}
+	go w.loop()
+
+	return w
+}
+
+// write queues the packet to be written.  It's written right away if the
+// writer is stopped.
+func (w *udpWriter) write(pkt proxyutil.UDPPacket) error {
+	select {
+	case w.queue <- pkt:
+		return nil
+	case <-w.done:
+		_, err := proxyutil.UDPWrite(pkt.Data, w.conn, pkt.RemoteAddr, pkt.LocalIP)
+		return err
+	}
+}
+
+// loop writes the queued packets until the writer is stopped.  The packets
+// queued while the previous batch was being written are written together.
+func (w *udpWriter) loop() {
+	pkts := make([]proxyutil.UDPPacket, 0, udpBatchSize)
+	for {
+		select {
+		case pkt := <-w.queue:
+			pkts = append(pkts[:0], pkt)
+		case <-w.done:
+			return
+		}
+
+	fill:
+		for len(pkts) < udpBatchSize {
+			select {
+			case pkt := <-w.queue:
+				pkts = append(pkts, pkt)
+			default:
+				break fill
+			}
+		}
+
+		w.writeBatch(pkts)
+	}
+}
+
+// writeBatch writes the packets skipping the ones that fail to be written
+func (w *udpWriter) writeBatch(pkts []proxyutil.UDPPacket) {
+	for len(pkts) > 0 {
+		n, err := w.batch.Write(pkts)
+		if err == nil {
+			return
+		}
+
+		if proxyutil.IsConnClosed(err) {
+			return
+		}
+
+		log.Debug("Failed to write UDP response to %s: %s", pkts[n].RemoteAddr, err)
+		pkts = pkts[n+1:]
+	}
+}
+
+// stop stops the writer
+func (w *udpWriter) stop() {
+	close(w.done)
+}
+
+// udpWorkersNum returns the max number of the workers of a UDP listener
+func (p *Proxy) udpWorkersNum() int {
+	if p.UDPWorkers > 0 {
+		return p.UDPWorkers
+	}
+
+	return defaultUDPWorkers
+}
+
+// udpPacketLoop listens for incoming UDP packets.  It reads them in batches
+// and writes the responses in batches if conn is an OS socket.
 //
 // See also the comment on Proxy.requestGoroutinesSema.
-func (p *Proxy) udpPacketLoop(conn *net.UDPConn, requestGoroutinesSema semaphore) {
+func (p *Proxy) udpPacketLoop(conn net.PacketConn, lc *ListenerConfig, requestGoroutinesSema semaphore) {
 	log.Info("Entering the UDP listener loop on %s", conn.LocalAddr())
-	b := make([]byte, dns.MaxMsgSize)
+
+	var batch *proxyutil.UDPBatch
+	var w *udpWriter
+	if c, ok := conn.(*net.UDPConn); ok {
+		batch = proxyutil.NewUDPBatch(c, udpBatchSize)
+		w = newUDPWriter(c)
+		defer w.stop()
+	}
+
+	handle := func(r udpRequest) {
+		p.udpHandlePacket(r.packet, r.localIP, r.remoteAddr, conn, lc, w)
+		p.udpBufPool.Put(r.buf)
+		requestGoroutinesSema.release()
+	}
+	workers := newUDPWorkers(p.udpWorkersNum(), handle)
+	defer workers.stop()
+
+	var queue chan udpRequest
+	if p.UDPBackpressure == UDPBackpressureQueue {
+		queue = make(chan udpRequest, p.udpQueueSize())
+		go udpQueueLoop(queue, requestGoroutinesSema, handle)
+		defer close(queue)
+	}
+
+	reqs := make([]udpRequest, udpBatchSize)
+	pkts := make([]proxyutil.UDPPacket, udpBatchSize)
+	defer func() {
+		for _, r := range reqs {
+			if r.buf != nil {
+				p.udpBufPool.Put(r.buf)
+			}
+		}
+	}()
+
 	for {
 		p.RLock()
-		if !p.started {
+		started := p.started
+		p.RUnlock()
+		if !started {
 			return
 		}
-		p.RUnlock()
 
-		n, localIP, remoteAddr, err := proxyutil.UDPRead(conn, b, p.udpOOBSize)
+		for i := range reqs {
+			if reqs[i].buf == nil {
+				reqs[i].buf = p.udpBufPool.Get().([]byte)
+			}
+		}
+
+		n, err := p.udpRead(conn, batch, pkts, reqs)
 		// documentation says to handle the packet even if err occurs, so do that first
-		if n > 0 {
-			// make a copy of all bytes because ReadFrom() will overwrite contents of b on next call
-			// we need the contents to survive the call because we're handling them in goroutine
-			packet := make([]byte, n)
-			copy(packet, b)
-			requestGoroutinesSema.acquire()
-			go func() {
-				p.udpHandlePacket(packet, localIP, remoteAddr, conn)
-				requestGoroutinesSema.release()
-			}()
+		for i := 0; i < n; i++ {
+			r := reqs[i]
+			if r.packet == nil {
+				log.Debug("Dropping too large UDP packet from %s", r.remoteAddr)
+				continue
+			} else if r.remoteAddr == nil {
+				// E.g. a client of a UNIX datagram socket that isn't
+				// bound to a path can't be answered
+				log.Debug("Dropping UDP packet from an unnamed socket")
+				continue
+			}
+
+			// The buffer now belongs to the worker
+			reqs[i] = udpRequest{}
+			if requestGoroutinesSema.tryAcquire() || p.udpBusy(r, conn, lc, w, queue, requestGoroutinesSema) {
+				workers.dispatch(r)
+			}
 		}
 		if err != nil {
 			if proxyutil.IsConnClosed(err) {
@@ -86,23 +366,83 @@ func (p *Proxy) udpPacketLoop(conn *net.UDPConn, requestGoroutinesSema semaphore
 	}
 }
 
-// udpHandlePacket processes the incoming UDP packet and sends a DNS response
-func (p *Proxy) udpHandlePacket(packet []byte, localIP net.IP, remoteAddr *net.UDPAddr, conn *net.UDPConn) {
+// udpRead reads the packets from conn into the buffers of reqs and returns the
+// number of the read ones.  If conn is an OS socket, they're read in a batch
+// into pkts, and OOB data is used to get the local IP address.  The packets
+// that don't fit in the buffers are returned truncated, so that they're
+// rejected as too large, unless the buffers fit the largest DNS message, then
+// they're returned with the nil packet.
+func (p *Proxy) udpRead(conn net.PacketConn, batch *proxyutil.UDPBatch, pkts []proxyutil.UDPPacket, reqs []udpRequest) (int, error) {
+	if batch == nil {
+		n, remoteAddr, err := conn.ReadFrom(reqs[0].buf)
+		if n <= 0 {
+			return 0, err
+		}
+
+		reqs[0].packet = reqs[0].buf[:n]
+		reqs[0].localIP = nil
+		reqs[0].remoteAddr = remoteAddr
+
+		return 1, err
+	}
+
+	for i := range reqs {
+		pkts[i] = proxyutil.UDPPacket{Data: reqs[i].buf}
+	}
+
+	n, err := batch.Read(pkts)
+	for i := 0; i < n; i++ {
+		pkt := &pkts[i]
+		reqs[i].packet = pkt.Data
+		if pkt.Truncated && len(reqs[i].buf) >= dns.MaxMsgSize {
+			reqs[i].packet = nil
+		}
+		reqs[i].localIP = pkt.LocalIP
+		reqs[i].remoteAddr = pkt.RemoteAddr
+		pkt.Data = nil
+	}
+
+	return n, err
+}
+
+// udpHandlePacket processes the incoming UDP packet and sends a DNS response.
+// lc is the settings of the listener, it may be nil.  w writes the response
+// if it's not nil.
+func (p *Proxy) udpHandlePacket(packet []byte, localIP net.IP, remoteAddr net.Addr, conn net.PacketConn, lc *ListenerConfig, w *udpWriter) {
 	log.Tracef("Start handling new UDP packet from %s", remoteAddr)
 
-	msg := &dns.Msg{}
-	err := msg.Unpack(packet)
+	if p.isTooLarge(lc, remoteAddr, len(packet)) {
+		log.Debug("Rejecting too large UDP packet (%d bytes) from %s", len(packet), remoteAddr)
+		p.rejectTooLarge(&DNSContext{
+			Proto:      ProtoUDP,
+			Addr:       remoteAddr,
+			packetConn: conn,
+			localIP:    localIP,
+			udpWriter:  w,
+
+			listener: lc,
+		}, packet)
+		return
+	}
+
+	msg, err := proxyutil.UnpackMsg(packet)
 	if err != nil {
 		log.Printf("error handling UDP packet: %s", err)
 		return
 	}
 
 	d := &DNSContext{
-		Proto:   ProtoUDP,
-		Req:     msg,
-		Addr:    remoteAddr,
-		Conn:    conn,
-		localIP: localIP,
+		Proto:      ProtoUDP,
+		Req:        msg,
+		Addr:       remoteAddr,
+		packetConn: conn,
+		localIP:    localIP,
+		udpWriter:  w,
+		listener:   lc,
+	}
+	// Custom packet connections may not implement net.Conn
+	if c, ok := conn.(net.Conn); ok {
+		d.Conn = c
 	}
 
 	err = p.handleDNSRequest(d)
@@ -120,9 +460,17 @@ func (p *Proxy) respondUDP(d *DNSContext) error {
 		return errorx.Decorate(err, "couldn't convert message into wire format: %s", resp.String())
 	}
 
-	conn := d.Conn.(*net.UDPConn)
-	rAddr := d.Addr.(*net.UDPAddr)
-	n, err := proxyutil.UDPWrite(bytes, conn, rAddr, d.localIP)
+	var n int
+	conn, ok := d.packetConn.(*net.UDPConn)
+	rAddr, addrOK := d.Addr.(*net.UDPAddr)
+	if ok && addrOK {
+		if d.udpWriter != nil {
+			return d.udpWriter.write(proxyutil.UDPPacket{Data: bytes, RemoteAddr: rAddr, LocalIP: d.localIP})
+		}
+		n, err = proxyutil.UDPWrite(bytes, conn, rAddr, d.localIP)
+	} else {
+		n, err = d.packetConn.WriteTo(bytes, d.Addr)
+	}
 	if n == 0 && proxyutil.IsConnClosed(err) {
 		return err
 	}
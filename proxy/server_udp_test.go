@@ -1,9 +1,14 @@
 package proxy
 
 import (
+	"net"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestUdpProxy(t *testing.T) {
@@ -31,3 +36,184 @@ func TestUdpProxy(t *testing.T) {
 		t.Fatalf("cannot stop the DNS proxy: %s", err)
 	}
 }
+
+// testPacketConn hides the *net.UDPConn methods so that the proxy treats it as
+// a custom packet connection
+type testPacketConn struct {
+	net.PacketConn
+}
+
+func TestUdpProxyListenPacket(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TCPListenAddr = nil
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	protos := []string{}
+	dnsProxy.ListenPacket = func(proto string, addr *net.UDPAddr) (net.PacketConn, error) {
+		protos = append(protos, proto)
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return &testPacketConn{PacketConn: conn}, nil
+	}
+
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+	assert.Equal(t, []string{ProtoUDP}, protos)
+
+	conn, err := dns.Dial("udp", dnsProxy.Addr(ProtoUDP).String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	err = conn.WriteMsg(createTestMessage())
+	assert.Nil(t, err)
+	res, err := conn.ReadMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+}
+
+func TestUDPWorkers(t *testing.T) {
+	var mu sync.Mutex
+	handled := map[string]bool{}
+	release := make(chan struct{})
+	w := newUDPWorkers(2, func(r udpRequest) {
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		handled[string(r.packet)] = true
+	})
+
+	// The requests over the max number of the workers are processed anyway
+	for _, p := range []string{"1", "2", "3"} {
+		w.dispatch(udpRequest{packet: []byte(p)})
+	}
+	assert.Equal(t, 2, w.started)
+	close(release)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	// The idle workers are reused
+	w.dispatch(udpRequest{packet: []byte("4")})
+	assert.Equal(t, 2, w.started)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return handled["4"]
+	}, time.Second, 10*time.Millisecond)
+	w.stop()
+}
+
+func TestUdpProxyConcurrent(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TCPListenAddr = nil
+	dnsProxy.UDPWorkers = 2
+	dnsProxy.MaxGoroutines = 8
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		time.Sleep(time.Millisecond)
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+	addr := dnsProxy.Addr(ProtoUDP).String()
+
+	// Malformed requests are dropped
+	conn, err := net.Dial("udp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write(make([]byte, dns.DefaultMsgSize+1))
+	assert.Nil(t, err)
+
+	const clients, reqs = 20, 10
+	wg := &sync.WaitGroup{}
+	wg.Add(clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			defer wg.Done()
+
+			c, dialErr := dns.Dial("udp", addr)
+			if !assert.Nil(t, dialErr) {
+				return
+			}
+			defer c.Close()
+
+			for j := 0; j < reqs; j++ {
+				req := createTestMessage()
+				assert.Nil(t, c.SetDeadline(time.Now().Add(time.Second)))
+				assert.Nil(t, c.WriteMsg(req))
+				res, readErr := c.ReadMsg()
+				if assert.Nil(t, readErr) {
+					assert.Equal(t, req.Id, res.Id)
+					assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestUdpProxyReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on Linux")
+	}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.TCPListenAddr = nil
+	dnsProxy.UDPSocketsPerAddr = 4
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	assert.Len(t, dnsProxy.udpListen, 4)
+	addr := dnsProxy.Addr(ProtoUDP).String()
+	for _, l := range dnsProxy.udpListen {
+		assert.Equal(t, addr, l.LocalAddr().String())
+	}
+
+	// The requests from different clients are answered by any of the sockets
+	for i := 0; i < 10; i++ {
+		conn, err := dns.Dial("udp", addr)
+		assert.Nil(t, err)
+
+		req := createTestMessage()
+		assert.Nil(t, conn.SetDeadline(time.Now().Add(time.Second)))
+		assert.Nil(t, conn.WriteMsg(req))
+		res, err := conn.ReadMsg()
+		if assert.Nil(t, err) {
+			assert.Equal(t, req.Id, res.Id)
+		}
+		assert.Nil(t, conn.Close())
+	}
+}
+
+func TestUdpProxyReusePortListenPacket(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UDPSocketsPerAddr = 4
+	dnsProxy.ListenPacket = func(proto string, addr *net.UDPAddr) (net.PacketConn, error) {
+		return net.ListenUDP("udp", addr)
+	}
+	assert.NotNil(t, dnsProxy.Start())
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+)
+
+// createUnixListeners creates the listeners of the UNIX domain sockets.  The
+// stream ones are served like TCP and the datagram ones like UDP.
+func (p *Proxy) createUnixListeners() error {
+	for _, a := range p.UnixListenAddr {
+		log.Info("Creating a UNIX stream server socket")
+		err := removeStaleSocket(a.Name)
+		if err != nil {
+			return err
+		}
+
+		l, err := net.ListenUnix("unix", a)
+		if err != nil {
+			return errorx.Decorate(err, "couldn't listen to UNIX socket")
+		}
+		p.unixListen = append(p.unixListen, l)
+
+		err = p.chmodSocket(a.Name)
+		if err != nil {
+			return err
+		}
+		log.Info("Listening to unix://%s", a.Name)
+	}
+
+	for _, a := range p.UnixgramListenAddr {
+		log.Info("Creating a UNIX datagram server socket")
+		err := removeStaleSocket(a.Name)
+		if err != nil {
+			return err
+		}
+
+		conn, err := net.ListenUnixgram("unixgram", a)
+		if err != nil {
+			return errorx.Decorate(err, "couldn't listen to UNIX datagram socket")
+		}
+		p.unixgramListen = append(p.unixgramListen, conn)
+
+		err = p.chmodSocket(a.Name)
+		if err != nil {
+			return err
+		}
+		log.Info("Listening to unixgram://%s", a.Name)
+	}
+
+	return nil
+}
+
+// chmodSocket sets Config.UnixSocketMode on the socket file if it's set
+func (p *Proxy) chmodSocket(path string) error {
+	if p.UnixSocketMode == 0 {
+		return nil
+	}
+
+	err := os.Chmod(path, p.UnixSocketMode)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't set the mode of %s", path)
+	}
+
+	return nil
+}
+
+// closeUnixListeners closes the listeners of the UNIX domain sockets and
+// removes the files of the datagram ones, the stream ones remove theirs
+// themselves
+func (p *Proxy) closeUnixListeners() (errs []error) {
+	for _, l := range p.unixListen {
+		err := l.Close()
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't close UNIX listening socket"))
+		}
+	}
+	p.unixListen = nil
+
+	for _, c := range p.unixgramListen {
+		path := c.LocalAddr().String()
+		err := c.Close()
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't close UNIX datagram socket"))
+		}
+
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, errorx.Decorate(err, "couldn't remove %s", path))
+		}
+	}
+	p.unixgramListen = nil
+
+	return errs
+}
+
+// isUnixAddr returns true if addr is the address of a UNIX socket client
+func isUnixAddr(addr net.Addr) bool {
+	_, ok := addr.(*net.UnixAddr)
+	return ok
+}
+
+// removeStaleSocket removes the socket file left by a previous run, since
+// the socket can't be bound to the existing file.  The other files are never
+// removed.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errorx.Decorate(err, "couldn't check %s", path)
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't remove stale socket %s", path)
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnixListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	streamPath := filepath.Join(dir, "dns.sock")
+	dgramPath := filepath.Join(dir, "dns.dgram")
+
+	// The socket left by a previous run is replaced
+	stale, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: dgramPath, Net: "unixgram"})
+	assert.Nil(t, err)
+	assert.Nil(t, stale.Close())
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UnixListenAddr = []*net.UnixAddr{{Name: streamPath, Net: "unix"}}
+	dnsProxy.UnixgramListenAddr = []*net.UnixAddr{{Name: dgramPath, Net: "unixgram"}}
+	dnsProxy.UnixSocketMode = 0o600
+	dnsProxy.Ratelimit = 1
+	// The clients of the UNIX sockets aren't checked by the ACL
+	dnsProxy.ACL, err = ParseACL(nil, []string{"0.0.0.0/0", "::/0"})
+	assert.Nil(t, err)
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+
+	assert.Nil(t, dnsProxy.Start())
+	stopped := false
+	defer func() {
+		if !stopped {
+			assert.Nil(t, dnsProxy.Stop())
+		}
+	}()
+
+	for _, path := range []string{streamPath, dgramPath} {
+		fi, err := os.Stat(path)
+		if assert.Nil(t, err) {
+			assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+		}
+	}
+
+	c, err := net.Dial("unix", streamPath)
+	assert.Nil(t, err)
+	_ = c.SetDeadline(time.Now().Add(time.Second))
+	// *net.UnixConn is also a net.PacketConn, so it's hidden from dns.Conn
+	// to make it use the length prefixes
+	conn := &dns.Conn{Conn: struct{ net.Conn }{c}}
+	for i := 0; i < 3; i++ {
+		req := createTestMessage()
+		assert.Nil(t, conn.WriteMsg(req))
+		res, err := conn.ReadMsg()
+		if assert.Nil(t, err) {
+			assert.Equal(t, req.Id, res.Id)
+			assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+		}
+	}
+	assert.Nil(t, c.Close())
+
+	client, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "client.dgram"), Net: "unixgram"})
+	assert.Nil(t, err)
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(time.Second))
+
+	// And aren't ratelimited
+	for i := 0; i < 3; i++ {
+		req := createTestMessage()
+		packed, err := req.Pack()
+		assert.Nil(t, err)
+		_, err = client.WriteTo(packed, &net.UnixAddr{Name: dgramPath, Net: "unixgram"})
+		assert.Nil(t, err)
+
+		buf := make([]byte, dns.MaxMsgSize)
+		n, _, err := client.ReadFrom(buf)
+		if !assert.Nil(t, err) {
+			break
+		}
+		res := &dns.Msg{}
+		assert.Nil(t, res.Unpack(buf[:n]))
+		assert.Equal(t, req.Id, res.Id)
+		assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	}
+
+	// The socket files are removed on stop
+	stopped = true
+	assert.Nil(t, dnsProxy.Stop())
+	for _, path := range []string{streamPath, dgramPath} {
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, removeStaleSocket(filepath.Join(dir, "none")))
+
+	// The other files are never removed
+	path := filepath.Join(dir, "file")
+	assert.Nil(t, ioutil.WriteFile(path, nil, 0o644))
+	assert.NotNil(t, removeStaleSocket(path))
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+)
+
+// The environment variables of the systemd socket activation protocol, see
+// sd_listen_fds(3)
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+
+	// listenFDsStart is the first inherited file descriptor
+	listenFDsStart = 3
+)
+
+// InheritListeners takes over the listening sockets passed to the process
+// using the systemd socket activation protocol and adds them to the
+// pre-created listeners of the config.  The sockets are assigned to the
+// listeners by their names from LISTEN_FDNAMES: "udp", "tcp", "tls", "https",
+// or "quic".  The sockets with the other names are plain DNS listeners.
+// LISTEN_PID is checked only if it's set, so that a parent process that
+// doesn't know the PID of its child in advance can pass the sockets as well,
+// see ExportListeners.
+//
+// The environment variables are unset so that they aren't inherited further.
+// It returns the number of the inherited sockets.
+func InheritListeners(c *Config) (int, error) {
+	fdsStr := os.Getenv(envListenFDs)
+	if fdsStr == "" {
+		return 0, nil
+	}
+
+	pidStr := os.Getenv(envListenPID)
+	namesStr := os.Getenv(envListenFDNames)
+	_ = os.Unsetenv(envListenPID)
+	_ = os.Unsetenv(envListenFDs)
+	_ = os.Unsetenv(envListenFDNames)
+
+	if pidStr != "" && pidStr != strconv.Itoa(os.Getpid()) {
+		log.Debug("Ignoring the sockets passed to the process %s", pidStr)
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(fdsStr)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", envListenFDs, fdsStr)
+	}
+
+	var names []string
+	if namesStr != "" {
+		names = strings.Split(namesStr, ":")
+	}
+
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		err = inheritListener(c, f, name)
+		// The socket is duplicated, so the original descriptor isn't needed
+		_ = f.Close()
+		if err != nil {
+			return i, errorx.Decorate(err, "cannot inherit socket %d (%s)", listenFDsStart+i, name)
+		}
+	}
+
+	return n, nil
+}
+
+// inheritListener adds the listening socket f to the config as a listener of
+// the specified protocol
+func inheritListener(c *Config, f *os.File, proto string) error {
+	switch proto {
+	case ProtoUDP, ProtoQUIC:
+		conn, err := net.FilePacketConn(f)
+		if err != nil {
+			return err
+		}
+		if proto == ProtoUDP {
+			c.UDPListeners = append(c.UDPListeners, conn)
+		} else {
+			c.QUICListeners = append(c.QUICListeners, conn)
+		}
+	case ProtoTCP, ProtoTLS, ProtoHTTPS:
+		l, err := net.FileListener(f)
+		if err != nil {
+			return err
+		}
+		switch proto {
+		case ProtoTCP:
+			c.TCPListeners = append(c.TCPListeners, l)
+		case ProtoTLS:
+			c.TLSListeners = append(c.TLSListeners, l)
+		default:
+			c.HTTPSListeners = append(c.HTTPSListeners, l)
+		}
+	default:
+		// systemd names the sockets after the socket unit by default, so
+		// the other names are treated as plain DNS.  The socket type tells
+		// if it's a UDP or a TCP one.
+		if conn, err := net.FilePacketConn(f); err == nil {
+			c.UDPListeners = append(c.UDPListeners, conn)
+			return nil
+		}
+
+		l, err := net.FileListener(f)
+		if err != nil {
+			return err
+		}
+		c.TCPListeners = append(c.TCPListeners, l)
+	}
+
+	return nil
+}
+
+// fileConn is implemented by the OS sockets, e.g. *net.UDPConn and
+// *net.TCPListener
+type fileConn interface {
+	File() (*os.File, error)
+}
+
+// ExportListeners returns the duplicates of the listening sockets of the
+// running proxy and their names for InheritListeners.  This allows upgrading
+// the proxy without dropping a single packet: the new process gets the
+// sockets in exec.Cmd.ExtraFiles with the environment from ListenEnv, starts
+// serving, and then the old one is stopped.  Only the OS sockets are
+// exported, the listeners from Config.Listeners and the DNSCrypt and admin
+// API listeners aren't.  The caller must close the files.
+func (p *Proxy) ExportListeners() (files []*os.File, names []string, err error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	defer func() {
+		if err != nil {
+			for _, f := range files {
+				_ = f.Close()
+			}
+			files, names = nil, nil
+		}
+	}()
+
+	add := func(l interface{}, proto string) error {
+		if _, ok := p.listenerConfigs[l]; ok {
+			return nil
+		}
+
+		c, ok := l.(fileConn)
+		if !ok {
+			return nil
+		}
+
+		f, err := c.File()
+		if err != nil {
+			return errorx.Decorate(err, "cannot export %s listener", proto)
+		}
+		files = append(files, f)
+		names = append(names, proto)
+
+		return nil
+	}
+
+	for _, l := range p.udpListen {
+		if err = add(l, ProtoUDP); err != nil {
+			return
+		}
+	}
+	for _, l := range p.tcpListen {
+		if err = add(l, ProtoTCP); err != nil {
+			return
+		}
+	}
+	for _, l := range p.tlsRawListen {
+		if err = add(l, ProtoTLS); err != nil {
+			return
+		}
+	}
+	for _, l := range p.httpsListen {
+		if err = add(l, ProtoHTTPS); err != nil {
+			return
+		}
+	}
+	for _, l := range p.quicPacketConns {
+		if err = add(l, ProtoQUIC); err != nil {
+			return
+		}
+	}
+
+	return files, names, nil
+}
+
+// ListenEnv returns the environment variables that pass the sockets exported
+// with ExportListeners to a child process
+func ListenEnv(names []string) []string {
+	return []string{
+		envListenFDs + "=" + strconv.Itoa(len(names)),
+		envListenFDNames + "=" + strings.Join(names, ":"),
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportListeners(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+
+	files, names, err := dnsProxy.ExportListeners()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{ProtoUDP, ProtoTCP}, names)
+	assert.Equal(t, []string{"LISTEN_FDS=2", "LISTEN_FDNAMES=udp:tcp"}, ListenEnv(names))
+
+	// The new instance takes over the sockets
+	newProxy := &Proxy{}
+	newProxy.UpstreamConfig = dnsProxy.UpstreamConfig
+	newProxy.RequestHandler = dnsProxy.RequestHandler
+	for i, f := range files {
+		err = inheritListener(&newProxy.Config, f, names[i])
+		assert.Nil(t, err)
+		_ = f.Close()
+	}
+	assert.Len(t, newProxy.UDPListeners, 1)
+	assert.Len(t, newProxy.TCPListeners, 1)
+
+	udpAddr := dnsProxy.Addr(ProtoUDP).String()
+	tcpAddr := dnsProxy.Addr(ProtoTCP).String()
+	err = newProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, newProxy.Stop())
+	}()
+
+	// The old one is stopped, but the sockets are still served
+	assert.Nil(t, dnsProxy.Stop())
+	for _, c := range []*dns.Client{{Net: "udp"}, {Net: "tcp"}} {
+		addr := udpAddr
+		if c.Net == "tcp" {
+			addr = tcpAddr
+		}
+
+		res, _, err := c.Exchange(createTestMessage(), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	}
+}
+
+func TestInheritListeners(t *testing.T) {
+	// The sockets passed to another process are ignored
+	_ = os.Setenv(envListenPID, strconv.Itoa(os.Getpid()+1))
+	_ = os.Setenv(envListenFDs, "1")
+	c := &Config{}
+	n, err := InheritListeners(c)
+	assert.Nil(t, err)
+	assert.Zero(t, n)
+	assert.Empty(t, c.UDPListeners)
+	assert.Empty(t, os.Getenv(envListenFDs))
+
+	_ = os.Setenv(envListenFDs, "invalid")
+	_, err = InheritListeners(c)
+	assert.NotNil(t, err)
+
+	// Nothing is passed
+	n, err = InheritListeners(c)
+	assert.Nil(t, err)
+	assert.Zero(t, n)
+}
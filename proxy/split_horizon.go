@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// SplitHorizonRule rewrites the public address of a service behind the NAT
+// in the answers to the internal clients to its internal address, so that
+// they don't depend on the NAT reflection (hairpinning) of the router
+type SplitHorizonRule struct {
+	// Clients are the subnets of the internal clients.  If empty, the
+	// private networks are used, see DefaultSplitHorizonClients.
+	Clients []*net.IPNet
+	// Public is the public address in the A or AAAA answers
+	Public net.IP
+	// Internal is the address of the same family it's replaced with
+	Internal net.IP
+}
+
+// DefaultSplitHorizonClients are the private, the shared (CGNAT), and the
+// loopback networks
+var DefaultSplitHorizonClients = mustParseSubnets(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"fc00::/7",
+	"::1/128",
+)
+
+// mustParseSubnets is ParseSubnets that panics on error
+func mustParseSubnets(s ...string) []*net.IPNet {
+	nets, err := ParseSubnets(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return nets
+}
+
+// isClient returns true if the rule applies to the client with the ip
+func (r *SplitHorizonRule) isClient(ip net.IP) bool {
+	clients := r.Clients
+	if len(clients) == 0 {
+		clients = DefaultSplitHorizonClients
+	}
+
+	for _, n := range clients {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseSplitHorizonRule parses the rule in the "public=internal[@subnet[,subnet]]"
+// form, e.g. "203.0.113.5=192.168.1.10@192.168.1.0/24".  A single IP address
+// is a subnet as well.
+func ParseSplitHorizonRule(s string) (r SplitHorizonRule, err error) {
+	addrs, clients := s, ""
+	if i := strings.IndexByte(s, '@'); i >= 0 {
+		addrs, clients = s[:i], s[i+1:]
+	}
+
+	i := strings.IndexByte(addrs, '=')
+	if i < 0 {
+		return r, fmt.Errorf("invalid split horizon rule %q: expected public=internal", s)
+	}
+
+	r.Public, r.Internal = net.ParseIP(addrs[:i]), net.ParseIP(addrs[i+1:])
+	if r.Public == nil || r.Internal == nil {
+		return r, fmt.Errorf("invalid split horizon rule %q: bad address", s)
+	}
+	if (r.Public.To4() == nil) != (r.Internal.To4() == nil) {
+		return r, fmt.Errorf("invalid split horizon rule %q: address families differ", s)
+	}
+
+	if clients != "" {
+		r.Clients, err = ParseSubnets(strings.Split(clients, ","))
+		if err != nil {
+			return r, fmt.Errorf("invalid split horizon rule %q: %w", s, err)
+		}
+	}
+
+	return r, nil
+}
+
+// applySplitHorizon replaces the public addresses in the A and AAAA answers
+// to the client according to Config.SplitHorizon
+func (p *Proxy) applySplitHorizon(d *DNSContext) {
+	if len(p.SplitHorizon) == 0 || len(d.Res.Answer) == 0 {
+		return
+	}
+
+	ip, _ := addrIPPort(d.ClientAddr())
+	if ip == nil {
+		return
+	}
+
+	for i, rr := range d.Res.Answer {
+		addr := answerIP(rr)
+		if addr == nil {
+			continue
+		}
+
+		internal := p.splitHorizonAddr(ip, addr)
+		if internal == nil {
+			continue
+		}
+
+		log.Debug("Split horizon: replacing %s with %s for %s", addr, internal, ip)
+		switch rr := d.writableRes().Answer[i].(type) {
+		case *dns.A:
+			rr.A = internal.To4()
+		case *dns.AAAA:
+			rr.AAAA = internal.To16()
+		}
+	}
+}
+
+// splitHorizonAddr returns the internal address the public address addr is
+// replaced with for the client with the ip or nil
+func (p *Proxy) splitHorizonAddr(ip, addr net.IP) net.IP {
+	for i := range p.SplitHorizon {
+		r := &p.SplitHorizon[i]
+		if r.Public.Equal(addr) && (r.Internal.To4() == nil) == (addr.To4() == nil) && r.isClient(ip) {
+			return r.Internal
+		}
+	}
+
+	return nil
+}
+
+// answerIP returns the address of the A or AAAA record or nil
+func answerIP(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	default:
+		return nil
+	}
+}
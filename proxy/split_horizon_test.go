@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSplitHorizonRule(t *testing.T) {
+	r, err := ParseSplitHorizonRule("203.0.113.5=192.168.1.10")
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.5", r.Public.String())
+	assert.Equal(t, "192.168.1.10", r.Internal.String())
+	assert.Empty(t, r.Clients)
+	assert.True(t, r.isClient(net.IP{192, 168, 5, 5}))
+	assert.False(t, r.isClient(net.IP{8, 8, 8, 8}))
+
+	r, err = ParseSplitHorizonRule("2001:db8::1=fd00::1@fd00::/64,10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, "fd00::1", r.Internal.String())
+	if assert.Len(t, r.Clients, 2) {
+		assert.Equal(t, "fd00::/64", r.Clients[0].String())
+		assert.Equal(t, "10.0.0.1/32", r.Clients[1].String())
+	}
+	assert.False(t, r.isClient(net.IP{192, 168, 5, 5}))
+
+	for _, s := range []string{
+		"",
+		"203.0.113.5",
+		"203.0.113.5=",
+		"203.0.113.5=fd00::1",
+		"203.0.113.5=192.168.1.10@bad",
+	} {
+		_, err = ParseSplitHorizonRule(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestApplySplitHorizon(t *testing.T) {
+	r, err := ParseSplitHorizonRule("203.0.113.5=192.168.1.10")
+	assert.Nil(t, err)
+	p := &Proxy{Config: Config{SplitHorizon: []SplitHorizonRule{r}}}
+
+	req := createHostTestMessage("host.example.org")
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Answer = []dns.RR{
+		newRR("host.example.org. 60 IN A 203.0.113.5"),
+		newRR("host.example.org. 60 IN A 203.0.113.6"),
+	}
+
+	internal := &net.UDPAddr{IP: net.IP{192, 168, 1, 20}, Port: 53000}
+	d := &DNSContext{Req: req, Res: res, Addr: internal}
+	p.applySplitHorizon(d)
+	assert.Equal(t, "192.168.1.10", d.Res.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, "203.0.113.6", d.Res.Answer[1].(*dns.A).A.String())
+
+	// The original response isn't changed
+	assert.Equal(t, "203.0.113.5", res.Answer[0].(*dns.A).A.String())
+
+	// The external clients get the public address
+	external := &net.UDPAddr{IP: net.IP{198, 51, 100, 1}, Port: 53000}
+	d = &DNSContext{Req: req, Res: res, Addr: external}
+	p.applySplitHorizon(d)
+	assert.True(t, d.Res == res)
+
+	// The forwarded client address is used
+	d = &DNSContext{Req: req, Res: res, Addr: internal, ForwardedAddr: external}
+	p.applySplitHorizon(d)
+	assert.True(t, d.Res == res)
+}
+
+func TestSplitHorizonCache(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.SplitHorizon = []SplitHorizonRule{{
+		Clients:  mustParseSubnets("127.0.0.0/8"),
+		Public:   net.IP{1, 2, 3, 4},
+		Internal: net.IP{192, 168, 1, 10},
+	}}
+	u := &testUpstream{aResp: newRR("host.example.org. 3600 IN A 1.2.3.4").(*dns.A)}
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	conn, err := dns.Dial("udp", dnsProxy.Addr(ProtoUDP).String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, conn.SetDeadline(time.Now().Add(time.Second)))
+		assert.Nil(t, conn.WriteMsg(createHostTestMessage("host.example.org")))
+		res, err := conn.ReadMsg()
+		if assert.Nil(t, err) && assert.Len(t, res.Answer, 1) {
+			assert.Equal(t, "192.168.1.10", res.Answer[0].(*dns.A).A.String())
+		}
+	}
+
+	// The cache has the public address
+	val, ok := dnsProxy.cache.Get(createHostTestMessage("host.example.org"))
+	if assert.True(t, ok) {
+		assert.Equal(t, "1.2.3.4", val.Answer[0].(*dns.A).A.String())
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseClass describes how the response to a request was produced
+type ResponseClass int
+
+const (
+	// ResponseClassNone - the request hasn't been classified yet
+	ResponseClassNone ResponseClass = iota
+	// ResponseClassUpstream - the response was received from an upstream or
+	// a fallback
+	ResponseClassUpstream
+	// ResponseClassCached - the response was served from the cache
+	ResponseClassCached
+	// ResponseClassLocal - the response was generated by a custom
+	// RequestHandler, LocalHosts, or Rewrites without contacting the
+	// upstreams
+	ResponseClassLocal
+	// ResponseClassBlocked - the request was refused by a policy, e.g.
+	// RefuseAny or a custom filter
+	ResponseClassBlocked
+	// ResponseClassError - the request failed and the client got SERVFAIL
+	ResponseClassError
+	// ResponseClassDropped - the request was dropped without a response,
+	// e.g. because of the ratelimit
+	ResponseClassDropped
+
+	// responseClassCount is the number of the response classes
+	responseClassCount
+)
+
+// responseClassNames are the names of the response classes used in logs and
+// in Stats
+var responseClassNames = [responseClassCount]string{
+	ResponseClassNone:     "none",
+	ResponseClassUpstream: "upstream",
+	ResponseClassCached:   "cached",
+	ResponseClassLocal:    "local",
+	ResponseClassBlocked:  "blocked",
+	ResponseClassError:    "error",
+	ResponseClassDropped:  "dropped",
+}
+
+// String implements the fmt.Stringer interface for ResponseClass
+func (c ResponseClass) String() string {
+	if c < 0 || c >= responseClassCount {
+		return "unknown"
+	}
+
+	return responseClassNames[c]
+}
+
+// Stats contains the runtime statistics of the proxy
+type Stats struct {
+	StartTime time.Time         `json:"start_time"` // time when the proxy was started
+	Requests  uint64            `json:"requests"`   // number of processed requests
+	Responses map[string]uint64 `json:"responses"`  // number of requests per response class
+	Rcodes    map[string]uint64 `json:"rcodes"`     // number of responses per response code
+
+	ACLRefused  uint64 `json:"acl_refused"`  // number of requests refused by the ACL
+	BusyRefused uint64 `json:"busy_refused"` // number of TCP connections and DoH requests refused because of backpressure
+
+	UDPSaturated uint64 `json:"udp_saturated"` // number of UDP requests that came when all the request goroutines were busy
+	UDPDropped   uint64 `json:"udp_dropped"`   // number of UDP requests dropped because of Config.UDPBackpressure
+
+	UpstreamsDown []string        `json:"upstreams_down,omitempty"` // addresses of the upstreams excluded by the health checks
+	Upstreams     []UpstreamStats `json:"upstreams,omitempty"`      // statistics of the upstreams, see Proxy.UpstreamStats
+
+	// Truncation contains the statistics of the clients that got truncated
+	// UDP responses, the ones with the most truncated responses first.  A
+	// lot of TCP retries may indicate MTU or fragmentation issues.
+	Truncation []TruncationStats `json:"truncation,omitempty"`
+}
+
+// maxStatsRcode is the maximum response code that is counted
+const maxStatsRcode = dns.RcodeBadCookie
+
+// statsCounters contains the counters that are updated atomically.  It must
+// be allocated separately so that the 64-bit fields are properly aligned on
+// 32-bit platforms.
+type statsCounters struct {
+	requests     uint64
+	aclRefused   uint64
+	busyRefused  uint64
+	udpSaturated uint64
+	udpDropped   uint64
+	responses    [responseClassCount]uint64
+	rcodes       [maxStatsRcode + 1]uint64
+
+	startTime time.Time
+}
+
+// newStatsCounters creates a new statsCounters instance
+func newStatsCounters() *statsCounters {
+	return &statsCounters{startTime: time.Now()}
+}
+
+// incRequests increments the requests counter.  s may be nil.
+func (s *statsCounters) incRequests() {
+	if s != nil {
+		atomic.AddUint64(&s.requests, 1)
+	}
+}
+
+// incACLRefused increments the counter of the requests refused by the ACL.  s
+// may be nil.
+func (s *statsCounters) incACLRefused() {
+	if s != nil {
+		atomic.AddUint64(&s.aclRefused, 1)
+	}
+}
+
+// incBusyRefused increments the counter of the TCP connections and DoH
+// requests refused because of backpressure.  s may be nil.
+func (s *statsCounters) incBusyRefused() {
+	if s != nil {
+		atomic.AddUint64(&s.busyRefused, 1)
+	}
+}
+
+// incUDPSaturated increments the counter of the UDP requests that came when all
+// the request goroutines were busy.  s may be nil.
+func (s *statsCounters) incUDPSaturated() {
+	if s != nil {
+		atomic.AddUint64(&s.udpSaturated, 1)
+	}
+}
+
+// incUDPDropped increments the counter of the UDP requests dropped because of
+// backpressure.  s may be nil.
+func (s *statsCounters) incUDPDropped() {
+	if s != nil {
+		atomic.AddUint64(&s.udpDropped, 1)
+	}
+}
+
+// incResponse increments the counters of the response class and the response
+// code of the processed request.  s may be nil.
+func (s *statsCounters) incResponse(d *DNSContext) {
+	if s == nil {
+		return
+	}
+
+	if d.ResponseClass >= 0 && d.ResponseClass < responseClassCount {
+		atomic.AddUint64(&s.responses[d.ResponseClass], 1)
+	}
+
+	if d.Res != nil && d.Res.Rcode >= 0 && d.Res.Rcode <= maxStatsRcode {
+		atomic.AddUint64(&s.rcodes[d.Res.Rcode], 1)
+	}
+}
+
+// Stats returns a snapshot of the proxy runtime statistics
+func (p *Proxy) Stats() Stats {
+	p.RLock()
+	s := p.stats
+	t := p.truncation
+	p.RUnlock()
+
+	if s == nil {
+		return Stats{}
+	}
+
+	stats := Stats{
+		StartTime: s.startTime,
+		Requests:  atomic.LoadUint64(&s.requests),
+		Responses: map[string]uint64{},
+		Rcodes:    map[string]uint64{},
+
+		ACLRefused:  atomic.LoadUint64(&s.aclRefused),
+		BusyRefused: atomic.LoadUint64(&s.busyRefused),
+
+		UDPSaturated: atomic.LoadUint64(&s.udpSaturated),
+		UDPDropped:   atomic.LoadUint64(&s.udpDropped),
+
+		UpstreamsDown: p.downUpstreams(),
+		Upstreams:     p.UpstreamStats(),
+		Truncation:    t.stats(),
+	}
+
+	for c := ResponseClassUpstream; c < responseClassCount; c++ {
+		stats.Responses[c.String()] = atomic.LoadUint64(&s.responses[c])
+	}
+
+	for rcode := range s.rcodes {
+		n := atomic.LoadUint64(&s.rcodes[rcode])
+		if n != 0 {
+			stats.Rcodes[dns.RcodeToString[rcode]] = n
+		}
+	}
+
+	return stats
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseClassification(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.RefuseAny = true
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&testUpstream{
+		aResp: newRR("host. 300 IN A 1.2.3.4").(*dns.A),
+	}}
+	err := dnsProxy.Init()
+	assert.Nil(t, err)
+
+	handle := func(req *dns.Msg) *DNSContext {
+		d := &DNSContext{
+			Proto:              ProtoHTTPS,
+			Req:                req,
+			Addr:               &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1234},
+			HTTPResponseWriter: httptest.NewRecorder(),
+		}
+		_ = dnsProxy.handleDNSRequest(d)
+		return d
+	}
+
+	// The response is cached after the first request
+	d := handle(createHostTestMessage("host"))
+	assert.Equal(t, ResponseClassUpstream, d.ResponseClass)
+	d = handle(createHostTestMessage("host"))
+	assert.Equal(t, ResponseClassCached, d.ResponseClass)
+
+	req := createHostTestMessage("any")
+	req.Question[0].Qtype = dns.TypeANY
+	d = handle(req)
+	assert.Equal(t, ResponseClassBlocked, d.ResponseClass)
+
+	req = createHostTestMessage("response")
+	req.Response = true
+	d = handle(req)
+	assert.Equal(t, ResponseClassDropped, d.ResponseClass)
+
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		return nil
+	}
+	d = handle(createHostTestMessage("local"))
+	assert.Equal(t, ResponseClassLocal, d.ResponseClass)
+
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = p.genServerFailure(d.Req)
+		return errors.New("test")
+	}
+	d = handle(createHostTestMessage("error"))
+	assert.Equal(t, ResponseClassError, d.ResponseClass)
+
+	stats := dnsProxy.Stats()
+	assert.Equal(t, uint64(6), stats.Requests)
+	assert.Equal(t, map[string]uint64{
+		"upstream": 1,
+		"cached":   1,
+		"local":    1,
+		"blocked":  1,
+		"error":    1,
+		"dropped":  1,
+	}, stats.Responses)
+	assert.Equal(t, map[string]uint64{
+		"NOERROR":  3,
+		"NOTIMP":   1,
+		"SERVFAIL": 1,
+	}, stats.Rcodes)
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+)
+
+// defaultTLSReloadInterval is the interval between the checks of the
+// certificate files if Config.TLSReloadInterval isn't set
+const defaultTLSReloadInterval = time.Minute
+
+// tlsReloader serves the certificate of the TLS config from the files and
+// replaces it when they change.  The config is replaced as a whole using
+// GetConfigForClient, so the handshakes in progress aren't affected.
+type tlsReloader struct {
+	certPath string
+	keyPath  string
+	ocsp     bool // staple the OCSP responses, see Config.OCSPStapling
+
+	base    *tls.Config  // copy of the original TLS config
+	config  *tls.Config  // base with the current certificate
+	stapler *ocspStapler // stapler of the current certificate, nil if OCSP stapling is disabled
+	modTime time.Time    // latest modification time of the loaded files
+	lock    sync.RWMutex
+
+	reloadLock sync.Mutex // serializes the reloads
+	stop       chan struct{}
+}
+
+// getConfigForClient returns the TLS config with the current certificate.
+// It's used as tls.Config.GetConfigForClient.
+func (r *tlsReloader) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if r.stapler != nil {
+		return r.stapler.getConfigForClient(hello)
+	}
+
+	return r.config, nil
+}
+
+// filesModTime returns the latest modification time of the certificate files
+func (r *tlsReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certPath, r.keyPath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// reload loads the certificate from the files and replaces the current one.
+// The current certificate is kept if the files can't be loaded.
+func (r *tlsReloader) reload() error {
+	r.reloadLock.Lock()
+	defer r.reloadLock.Unlock()
+
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return errorx.Decorate(err, "couldn't reload TLS certificate")
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't reload TLS certificate")
+	}
+
+	conf := r.base.Clone()
+	conf.Certificates = []tls.Certificate{cert}
+
+	var stapler *ocspStapler
+	if r.ocsp {
+		stapler = startOCSPStapler(conf)
+	}
+
+	r.lock.Lock()
+	old := r.stapler
+	r.config, r.stapler, r.modTime = conf, stapler, modTime
+	r.lock.Unlock()
+
+	if old != nil {
+		old.stopRefresh()
+	}
+
+	log.Info("Loaded TLS certificate from %s", r.certPath)
+
+	return nil
+}
+
+// reloadIfChanged reloads the certificate if the files have changed since
+// it was loaded
+func (r *tlsReloader) reloadIfChanged() {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		log.Error("checking TLS certificate files: %s", err)
+		return
+	}
+
+	r.lock.RLock()
+	changed := modTime.After(r.modTime)
+	r.lock.RUnlock()
+
+	if changed {
+		err = r.reload()
+		if err != nil {
+			log.Error("%s", err)
+		}
+	}
+}
+
+// reloadLoop checks the files for changes every interval until stop is
+// closed
+func (r *tlsReloader) reloadLoop(interval time.Duration, stop chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			r.reloadIfChanged()
+		}
+	}
+}
+
+// startTLSReload loads the certificate of the TLS config from
+// Config.TLSCertPath and Config.TLSKeyPath and starts checking them for
+// changes
+func (p *Proxy) startTLSReload() error {
+	if p.TLSCertPath == "" {
+		return nil
+	}
+
+	r := &tlsReloader{
+		certPath: p.TLSCertPath,
+		keyPath:  p.TLSKeyPath,
+		ocsp:     p.OCSPStapling,
+		base:     p.TLSConfig.Clone(),
+	}
+	err := r.reload()
+	if err != nil {
+		return err
+	}
+
+	p.tlsReloader = r
+	p.TLSConfig.GetConfigForClient = r.getConfigForClient
+
+	interval := p.TLSReloadInterval
+	if interval == 0 {
+		interval = defaultTLSReloadInterval
+	}
+	if interval > 0 {
+		r.stop = make(chan struct{})
+		go r.reloadLoop(interval, r.stop)
+	}
+
+	return nil
+}
+
+// stopTLSReload stops checking the certificate files and restores the TLS
+// config
+func (p *Proxy) stopTLSReload() {
+	r := p.tlsReloader
+	if r == nil {
+		return
+	}
+
+	if r.stop != nil {
+		close(r.stop)
+	}
+
+	r.reloadLock.Lock()
+	defer r.reloadLock.Unlock()
+
+	r.lock.Lock()
+	if r.stapler != nil {
+		r.stapler.stopRefresh()
+		r.stapler = nil
+	}
+	r.lock.Unlock()
+
+	p.TLSConfig.GetConfigForClient = nil
+	p.tlsReloader = nil
+}
+
+// ReloadTLSCertificate reloads the certificate of the TLS, HTTPS, and QUIC
+// listeners from Config.TLSCertPath and Config.TLSKeyPath at once, e.g. on
+// SIGHUP.  The current certificate is kept if the files can't be loaded.
+func (p *Proxy) ReloadTLSCertificate() error {
+	p.RLock()
+	r := p.tlsReloader
+	p.RUnlock()
+
+	if r == nil {
+		return errors.New("TLS certificate files aren't configured")
+	}
+
+	return r.reload()
+}
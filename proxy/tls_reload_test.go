@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCertFiles writes the certificate and the key of conf to the files
+// and returns the certificate
+func writeTestCertFiles(t *testing.T, conf *tls.Config, certPath, keyPath string) []byte {
+	cert := conf.Certificates[0]
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(cert.PrivateKey.(*rsa.PrivateKey)),
+	})
+	assert.Nil(t, ioutil.WriteFile(certPath, certPem, 0o644))
+	assert.Nil(t, ioutil.WriteFile(keyPath, keyPem, 0o600))
+
+	return cert.Certificate[0]
+}
+
+func TestTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first, _ := createServerTLSConfig(t)
+	firstCert := writeTestCertFiles(t, first, certPath, keyPath)
+
+	// The certificates of the config are replaced by the ones from the files
+	serverConfig, _ := createServerTLSConfig(t)
+	dnsProxy := createTestProxy(t, serverConfig)
+	dnsProxy.TLSCertPath, dnsProxy.TLSKeyPath = certPath, keyPath
+	dnsProxy.TLSReloadInterval = 50 * time.Millisecond
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+		assert.Nil(t, serverConfig.GetConfigForClient)
+	}()
+
+	peerCert := func() []byte {
+		conn, err := tls.Dial("tcp", dnsProxy.Addr(ProtoTLS).String(), &tls.Config{InsecureSkipVerify: true})
+		if !assert.Nil(t, err) {
+			return nil
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+	assert.Equal(t, firstCert, peerCert())
+
+	// Reloaded at once
+	second, _ := createServerTLSConfig(t)
+	secondCert := writeTestCertFiles(t, second, certPath, keyPath)
+	assert.Nil(t, dnsProxy.ReloadTLSCertificate())
+	assert.Equal(t, secondCert, peerCert())
+
+	// The current certificate is kept if the files are invalid
+	assert.Nil(t, ioutil.WriteFile(keyPath, []byte("invalid"), 0o600))
+	assert.NotNil(t, dnsProxy.ReloadTLSCertificate())
+	assert.Equal(t, secondCert, peerCert())
+
+	// Reloaded when the files change
+	writeTestCertFiles(t, first, certPath, keyPath)
+	future := time.Now().Add(time.Hour)
+	assert.Nil(t, os.Chtimes(certPath, future, future))
+	assert.Eventually(t, func() bool {
+		dnsProxy.tlsReloader.lock.RLock()
+		defer dnsProxy.tlsReloader.lock.RUnlock()
+
+		return dnsProxy.tlsReloader.modTime.Equal(future)
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, firstCert, peerCert())
+}
+
+func TestTLSReloadNotConfigured(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	assert.Nil(t, dnsProxy.Start())
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	assert.NotNil(t, dnsProxy.ReloadTLSCertificate())
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+const (
+	// truncationExpiration is the time the truncation statistics of an
+	// inactive client are kept for
+	truncationExpiration = time.Hour
+	// tcpRetryWindow is the time after a truncated response within which
+	// the TCP request for the same question is considered a retry
+	tcpRetryWindow = 5 * time.Second
+	// tuneRetries is the number of the TCP retries after which the UDP
+	// response size of the client is raised
+	tuneRetries = 3
+	// maxTunedUDPSize is the maximum UDP response size the clients are
+	// tuned to.  It's the size recommended by the DNS Flag Day 2020 to avoid
+	// the IP fragmentation.
+	maxTunedUDPSize = 1232
+	// maxTruncationStats is the maximum number of the clients in Stats
+	maxTruncationStats = 100
+)
+
+// TruncationStats contains the truncation statistics of a client
+type TruncationStats struct {
+	Client     string `json:"client"`      // client IP address
+	Truncated  uint64 `json:"truncated"`   // number of truncated UDP responses
+	TCPRetries uint64 `json:"tcp_retries"` // number of the truncated requests retried over TCP
+	UDPSize    int    `json:"udp_size"`    // tuned UDP response size, 0 if not tuned
+}
+
+// clientTruncation contains the truncation state of a client
+type clientTruncation struct {
+	stats TruncationStats
+
+	// lastQuestion is the question of the last truncated response and
+	// lastTime is the time it was sent at
+	lastQuestion dns.Question
+	lastTime     time.Time
+
+	// retries is the number of the TCP retries since the last tuning
+	retries int
+
+	lock sync.Mutex
+}
+
+// truncationTracker tracks the truncated UDP responses and the TCP retries of
+// the clients and tunes their UDP response sizes
+type truncationTracker struct {
+	clients  *gocache.Cache // client IP -> *clientTruncation
+	autoTune bool
+}
+
+// newTruncationTracker creates a new truncationTracker instance
+func newTruncationTracker(autoTune bool) *truncationTracker {
+	return &truncationTracker{
+		clients:  gocache.New(truncationExpiration, truncationExpiration),
+		autoTune: autoTune,
+	}
+}
+
+// client returns the truncation state of the client.  If create is false, it
+// returns nil if there is no state yet.
+func (t *truncationTracker) client(ip string, create bool) *clientTruncation {
+	if v, ok := t.clients.Get(ip); ok {
+		return v.(*clientTruncation)
+	}
+	if !create {
+		return nil
+	}
+
+	c := &clientTruncation{stats: TruncationStats{Client: ip}}
+	if err := t.clients.Add(ip, c, gocache.DefaultExpiration); err != nil {
+		// Added concurrently
+		return t.client(ip, false)
+	}
+
+	return c
+}
+
+// onRequest counts the TCP retries of the truncated requests and sets the
+// tuned UDP response size of the UDP requests.  t may be nil.
+func (t *truncationTracker) onRequest(d *DNSContext) {
+	if t == nil || len(d.Req.Question) == 0 {
+		return
+	}
+
+	switch d.Proto {
+	case ProtoTCP:
+		t.onTCPRequest(d)
+	case ProtoUDP:
+		if !t.autoTune || d.Req.IsEdns0() == nil {
+			// The clients without EDNS don't accept the responses
+			// larger than 512 bytes
+			return
+		}
+
+		c := t.client(getIPString(d.Addr), false)
+		if c == nil {
+			return
+		}
+
+		c.lock.Lock()
+		d.udpSize = c.stats.UDPSize
+		c.lock.Unlock()
+	}
+}
+
+// onTCPRequest counts the TCP request if it's a retry of the last truncated
+// response and raises the UDP response size of the client if needed
+func (t *truncationTracker) onTCPRequest(d *DNSContext) {
+	ip := getIPString(d.Addr)
+	c := t.client(ip, false)
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	q := d.Req.Question[0]
+	if c.lastTime.IsZero() || time.Since(c.lastTime) > tcpRetryWindow ||
+		q.Qtype != c.lastQuestion.Qtype || !strings.EqualFold(q.Name, c.lastQuestion.Name) {
+		return
+	}
+	c.lastTime = time.Time{}
+	c.stats.TCPRetries++
+	c.retries++
+
+	if !t.autoTune || c.retries < tuneRetries || c.stats.UDPSize >= maxTunedUDPSize {
+		return
+	}
+	c.retries = 0
+
+	size := c.stats.UDPSize * 2
+	if size < dns.MinMsgSize*2 {
+		size = dns.MinMsgSize * 2
+	}
+	if size > maxTunedUDPSize {
+		size = maxTunedUDPSize
+	}
+	c.stats.UDPSize = size
+	log.Debug("Client %s keeps retrying truncated responses over TCP, raising its UDP response size to %d", ip, size)
+}
+
+// onResponse records the truncated UDP response.  t may be nil.
+func (t *truncationTracker) onResponse(d *DNSContext) {
+	if t == nil || d.Proto != ProtoUDP || d.Res == nil || !d.Res.Truncated || len(d.Req.Question) == 0 {
+		return
+	}
+
+	c := t.client(getIPString(d.Addr), true)
+	c.lock.Lock()
+	c.stats.Truncated++
+	c.lastQuestion = d.Req.Question[0]
+	c.lastTime = time.Now()
+	c.lock.Unlock()
+}
+
+// stats returns the statistics of the clients with the most truncated
+// responses
+func (t *truncationTracker) stats() []TruncationStats {
+	if t == nil {
+		return nil
+	}
+
+	var stats []TruncationStats
+	for _, item := range t.clients.Items() {
+		c := item.Object.(*clientTruncation)
+		c.lock.Lock()
+		stats = append(stats, c.stats)
+		c.lock.Unlock()
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Truncated != stats[j].Truncated {
+			return stats[i].Truncated > stats[j].Truncated
+		}
+		return stats[i].Client < stats[j].Client
+	})
+	if len(stats) > maxTruncationStats {
+		stats = stats[:maxTruncationStats]
+	}
+
+	return stats
+}
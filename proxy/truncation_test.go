@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncationTracker(t *testing.T) {
+	tracker := newTruncationTracker(true)
+	udpAddr := &net.UDPAddr{IP: net.IP{192, 168, 1, 2}, Port: 12345}
+	tcpAddr := &net.TCPAddr{IP: net.IP{192, 168, 1, 2}, Port: 12346}
+
+	req := createTestMessage()
+	req.SetEdns0(512, false)
+
+	// The truncated response and its TCP retry
+	retry := func() {
+		d := &DNSContext{Proto: ProtoUDP, Addr: udpAddr, Req: req, Res: genEmptyNoError(req)}
+		tracker.onRequest(d)
+		d.Res.Truncated = true
+		tracker.onResponse(d)
+
+		tracker.onRequest(&DNSContext{Proto: ProtoTCP, Addr: tcpAddr, Req: req})
+	}
+
+	for i := 0; i < tuneRetries-1; i++ {
+		retry()
+	}
+	d := &DNSContext{Proto: ProtoUDP, Addr: udpAddr, Req: req}
+	tracker.onRequest(d)
+	assert.Equal(t, 0, d.udpSize)
+
+	retry()
+	tracker.onRequest(d)
+	assert.Equal(t, 1024, d.udpSize)
+
+	for i := 0; i < tuneRetries*2; i++ {
+		retry()
+	}
+	tracker.onRequest(d)
+	assert.Equal(t, maxTunedUDPSize, d.udpSize)
+
+	// The clients without EDNS aren't tuned
+	d = &DNSContext{Proto: ProtoUDP, Addr: udpAddr, Req: createTestMessage()}
+	tracker.onRequest(d)
+	assert.Equal(t, 0, d.udpSize)
+
+	// The TCP requests for the other questions aren't retries
+	tracker.onRequest(&DNSContext{Proto: ProtoTCP, Addr: tcpAddr, Req: createHostTestMessage("example.org")})
+
+	stats := tracker.stats()
+	if assert.Len(t, stats, 1) {
+		assert.Equal(t, TruncationStats{
+			Client:     "192.168.1.2",
+			Truncated:  uint64(tuneRetries * 3),
+			TCPRetries: uint64(tuneRetries * 3),
+			UDPSize:    maxTunedUDPSize,
+		}, stats[0])
+	}
+}
+
+func TestScrubTunedSize(t *testing.T) {
+	// The response of about 1.6 KB
+	newRes := func(req *dns.Msg) *dns.Msg {
+		res := genEmptyNoError(req)
+		res.SetEdns0(4096, false)
+		for i := 0; i < 100; i++ {
+			res.Answer = append(res.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+				A:   net.IP{10, 0, 0, byte(i)},
+			})
+		}
+
+		return res
+	}
+
+	small := createTestMessage()
+	small.SetEdns0(512, false)
+	large := createTestMessage()
+	large.SetEdns0(4096, false)
+
+	testCases := []struct {
+		name      string
+		req       *dns.Msg
+		udpSize   int
+		truncated bool
+		advert    uint16
+	}{{
+		name:      "client_size",
+		req:       large,
+		truncated: false,
+		advert:    4096,
+	}, {
+		name:      "tuned_size",
+		req:       large,
+		udpSize:   maxTunedUDPSize,
+		truncated: true,
+		advert:    maxTunedUDPSize,
+	}, {
+		name:      "smaller_client_size",
+		req:       small,
+		udpSize:   maxTunedUDPSize,
+		truncated: true,
+		advert:    maxTunedUDPSize,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{Proto: ProtoUDP, Req: tc.req, Res: newRes(tc.req), udpSize: tc.udpSize}
+			d.scrub()
+			assert.Equal(t, tc.truncated, d.Res.Truncated)
+			assert.LessOrEqual(t, d.Res.Len(), int(tc.req.IsEdns0().UDPSize()))
+			if tc.udpSize != 0 {
+				assert.LessOrEqual(t, d.Res.Len(), tc.udpSize)
+			}
+			if assert.NotNil(t, d.Res.IsEdns0()) {
+				assert.Equal(t, tc.advert, d.Res.IsEdns0().UDPSize())
+			}
+		})
+	}
+}
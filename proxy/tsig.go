@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tsigFudge is the permitted difference in the clocks of the signer and the
+// verifier in seconds, RFC 8945 recommends 300
+const tsigFudge = 300
+
+// tsigAlgorithms are the supported TSIG algorithms
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// TSIGKey is a TSIG (RFC 8945) key the messages are signed and verified with
+type TSIGKey struct {
+	// Name is the name of the key, e.g. "dhcp-update."
+	Name string
+	// Algorithm is the HMAC algorithm, e.g. dns.HmacSHA256, which is the
+	// default
+	Algorithm string
+	// Secret is the base64-encoded secret
+	Secret string
+}
+
+// ParseTSIGKey parses the key in the "[algorithm:]name:secret" form like the
+// -y option of dig, e.g. "hmac-sha256:dhcp-update:c2VjcmV0".  The default
+// algorithm is hmac-sha256.
+func ParseTSIGKey(s string) (*TSIGKey, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		parts = append([]string{"hmac-sha256"}, parts...)
+	}
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid TSIG key %q, expected [algorithm:]name:secret", s)
+	}
+
+	algorithm, ok := tsigAlgorithms[strings.ToLower(strings.TrimSuffix(parts[0], "."))]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm in %q", s)
+	}
+
+	k := &TSIGKey{Name: parts[1], Algorithm: algorithm, Secret: parts[2]}
+	err := k.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// validate returns an error if the key can't be used
+func (k *TSIGKey) validate() error {
+	if _, ok := dns.IsDomainName(k.Name); !ok || k.Name == "" {
+		return fmt.Errorf("invalid TSIG key name %q", k.Name)
+	}
+
+	if k.Algorithm != "" && !isTSIGAlgorithm(k.Algorithm) {
+		return fmt.Errorf("unsupported TSIG algorithm %q of key %s", k.Algorithm, k.Name)
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil || k.Secret == "" {
+		return fmt.Errorf("invalid TSIG secret of key %s", k.Name)
+	}
+
+	return nil
+}
+
+// isTSIGAlgorithm returns true if the algorithm is supported
+func isTSIGAlgorithm(algorithm string) bool {
+	for _, a := range tsigAlgorithms {
+		if strings.EqualFold(dns.Fqdn(algorithm), a) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fqdn returns the name of the key in the canonical form used by dns.Conn
+func (k *TSIGKey) fqdn() string {
+	return strings.ToLower(dns.Fqdn(k.Name))
+}
+
+// sign adds the TSIG record that is computed when m is written to the
+// connection with secrets
+func (k *TSIGKey) sign(m *dns.Msg) {
+	algorithm := dns.HmacSHA256
+	if k.Algorithm != "" {
+		algorithm = strings.ToLower(dns.Fqdn(k.Algorithm))
+	}
+
+	removeTSIG(m)
+	m.SetTsig(k.fqdn(), algorithm, tsigFudge, time.Now().Unix())
+}
+
+// secrets returns the secrets map of dns.Conn with the key
+func (k *TSIGKey) secrets() map[string]string {
+	return map[string]string{k.fqdn(): k.Secret}
+}
+
+// exchange sends the copy of req signed with the key to the plain DNS server
+// over UDP, or TCP if tcp is true or the response is truncated.  It returns
+// the verified response without the TSIG record.  The only unsigned response
+// accepted is the NOTAUTH one with the BADKEY or BADSIG error.
+func (k *TSIGKey) exchange(req *dns.Msg, server string, timeout time.Duration, tcp bool) (*dns.Msg, error) {
+	m := req.Copy()
+	k.sign(m)
+
+	c := &dns.Client{Timeout: timeout, UDPSize: dns.MaxMsgSize, TsigSecret: k.secrets()}
+	if tcp {
+		c.Net = "tcp"
+	}
+
+	res, _, err := c.Exchange(m, server)
+	if err == nil && res.Truncated && !tcp {
+		c.Net = "tcp"
+		res, _, err = c.Exchange(m, server)
+	}
+	if err != nil {
+		// The errors like BADKEY are sent unsigned, so dns.Client fails to
+		// verify them
+		if res != nil && isTSIGError(res) {
+			removeTSIG(res)
+			return res, nil
+		}
+
+		return nil, err
+	}
+
+	// The signature of the response is verified by dns.Client if there is
+	// one
+	if res.IsTsig() == nil {
+		return nil, errors.New("the response isn't signed")
+	}
+	removeTSIG(res)
+
+	return res, nil
+}
+
+// isTSIGError returns true if res is the unsigned response to the request
+// with the unknown key or the invalid signature
+func isTSIGError(res *dns.Msg) bool {
+	t := res.IsTsig()
+
+	return res.Rcode == dns.RcodeNotAuth && t != nil && t.MAC == "" &&
+		(t.Error == dns.RcodeBadKey || t.Error == dns.RcodeBadSig)
+}
+
+// removeTSIG removes the TSIG record from the message
+func removeTSIG(m *dns.Msg) {
+	if m.IsTsig() != nil {
+		m.Extra = m.Extra[:len(m.Extra)-1]
+	}
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTSIGKey(t *testing.T) {
+	k, err := ParseTSIGKey("dhcp-update:c2VjcmV0")
+	assert.Nil(t, err)
+	assert.Equal(t, &TSIGKey{Name: "dhcp-update", Algorithm: dns.HmacSHA256, Secret: "c2VjcmV0"}, k)
+	assert.Equal(t, "dhcp-update.", k.fqdn())
+
+	k, err = ParseTSIGKey("HMAC-SHA512:Key.Example.:c2VjcmV0")
+	assert.Nil(t, err)
+	assert.Equal(t, dns.HmacSHA512, k.Algorithm)
+	assert.Equal(t, "key.example.", k.fqdn())
+
+	for _, s := range []string{"", "key", "hmac-md4:key:c2VjcmV0", "key:not base64", "key:", "a:b:c:d"} {
+		_, err = ParseTSIGKey(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestTSIGKeyExchange(t *testing.T) {
+	key, err := ParseTSIGKey("key:c2VjcmV0c2VjcmV0")
+	assert.Nil(t, err)
+
+	// The server sends the responses returned by respond as is
+	var lock sync.Mutex
+	var respond func(r *dns.Msg) *dns.Msg
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	started := make(chan struct{})
+	s := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc:     func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			buf, _ := respond(r).Pack()
+			_, _ = w.Write(buf)
+		}),
+	}
+	go func() { _ = s.ActivateAndServe() }()
+	<-started
+	defer func() { _ = s.Shutdown() }()
+
+	reply := func(r *dns.Msg, rcode int, tsigErr uint16) *dns.Msg {
+		res := &dns.Msg{}
+		res.SetRcode(r, rcode)
+		if tsigErr != dns.RcodeSuccess {
+			res.SetTsig(key.fqdn(), dns.HmacSHA256, tsigFudge, time.Now().Unix())
+			res.IsTsig().Error = tsigErr
+		}
+
+		return res
+	}
+
+	testCases := []struct {
+		name    string
+		rcode   int
+		tsigErr uint16
+		wantErr bool
+	}{{
+		name:    "unsigned_success",
+		rcode:   dns.RcodeSuccess,
+		wantErr: true,
+	}, {
+		name:    "unsigned_servfail",
+		rcode:   dns.RcodeServerFailure,
+		wantErr: true,
+	}, {
+		name:    "unsigned_notauth_without_tsig",
+		rcode:   dns.RcodeNotAuth,
+		wantErr: true,
+	}, {
+		name:    "badtime",
+		rcode:   dns.RcodeNotAuth,
+		tsigErr: dns.RcodeBadTime,
+		wantErr: true,
+	}, {
+		name:    "badkey",
+		rcode:   dns.RcodeNotAuth,
+		tsigErr: dns.RcodeBadKey,
+	}, {
+		name:    "badsig",
+		rcode:   dns.RcodeNotAuth,
+		tsigErr: dns.RcodeBadSig,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rcode, tsigErr := tc.rcode, tc.tsigErr
+			lock.Lock()
+			respond = func(r *dns.Msg) *dns.Msg { return reply(r, rcode, tsigErr) }
+			lock.Unlock()
+
+			res, err := key.exchange(createUpdateTestMessage(), pc.LocalAddr().String(), time.Second, false)
+			if tc.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			if assert.Nil(t, err) {
+				assert.Equal(t, dns.RcodeNotAuth, res.Rcode)
+				assert.Nil(t, res.IsTsig())
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// UpdateForward - settings of forwarding the DNS UPDATE (RFC 2136) and NOTIFY
+// (RFC 1996) messages to an authoritative server, e.g. the messages from a
+// DHCP server to the internal primary server.  The access to the forwarding
+// listeners should be restricted with ACL.
+type UpdateForward struct {
+	// Server is the address of the authoritative server, host:port
+	Server string
+
+	// TSIG is the key the forwarded messages are signed with.  The TSIG
+	// record of the client's message is replaced, the responses must be
+	// signed with the same key.  Any client allowed by the listener's ACL can
+	// change the zones then, so the ACL must be set.  If nil, the messages
+	// are forwarded as is.
+	TSIG *TSIGKey
+
+	// Timeout is the timeout of the exchange with the server, if 0,
+	// defaultTimeout is used
+	Timeout time.Duration
+}
+
+// validate returns an error if the settings are invalid
+func (f *UpdateForward) validate() error {
+	if _, _, err := net.SplitHostPort(f.Server); err != nil {
+		return fmt.Errorf("invalid update forwarding server %q: %w", f.Server, err)
+	}
+
+	if f.TSIG != nil {
+		return f.TSIG.validate()
+	}
+
+	return nil
+}
+
+// updateForward returns the forwarding settings of the UPDATE and NOTIFY
+// requests or nil if they're handled as ordinary queries
+func (p *Proxy) updateForward(d *DNSContext) *UpdateForward {
+	if d.listener != nil && d.listener.UpdateForward != nil {
+		return d.listener.UpdateForward
+	}
+
+	return p.UpdateForward
+}
+
+// isUpdateOrNotify returns true if m is an UPDATE or a NOTIFY message
+func isUpdateOrNotify(m *dns.Msg) bool {
+	return m.Opcode == dns.OpcodeUpdate || m.Opcode == dns.OpcodeNotify
+}
+
+// forwardUpdate forwards the UPDATE or NOTIFY request to the authoritative
+// server and sets the response.  SERVFAIL is the response if the server
+// can't be reached.  In the privacy mode, the server only gets the private
+// copy of the request, see privateUpdate.
+func (p *Proxy) forwardUpdate(d *DNSContext, f *UpdateForward) {
+	req := d.Req
+	if p.PrivacyMode {
+		req = p.privateUpdate(req, f.TSIG != nil)
+	}
+
+	res, err := f.exchange(req)
+	if err != nil {
+		log.Error("forwarding %s to %s: %s", dns.OpcodeToString[d.Req.Opcode], f.Server, err)
+		d.Res = p.genServerFailure(d.Req)
+		d.ResponseClass = ResponseClassError
+		return
+	}
+
+	if p.PrivacyMode {
+		restorePrivateReply(res, d.Req)
+	}
+
+	d.Res = res
+	d.ResponseClass = ResponseClassUpstream
+}
+
+// exchange sends the request to the server over UDP, or TCP if the response
+// is truncated, and returns the response
+func (f *UpdateForward) exchange(req *dns.Msg) (*dns.Msg, error) {
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	var res *dns.Msg
+	var err error
+	if f.TSIG != nil {
+		res, err = f.TSIG.exchange(req, f.Server, timeout, false)
+	} else {
+		c := &dns.Client{Timeout: timeout}
+		res, err = exchangeUpdate(c, req, f.Server)
+		if err == nil && res.Truncated {
+			c.Net = "tcp"
+			res, err = exchangeUpdate(c, req, f.Server)
+		}
+	}
+	if err != nil {
+		return nil, errorx.Decorate(err, "exchanging with %s", f.Server)
+	}
+
+	return res, nil
+}
+
+// exchangeUpdate exchanges m with the server.  The messages signed by the
+// clients are forwarded as is, dns.Client can't send them without the secret.
+func exchangeUpdate(c *dns.Client, m *dns.Msg, server string) (*dns.Msg, error) {
+	if m.IsTsig() == nil {
+		res, _, err := c.Exchange(m, server)
+		return res, err
+	}
+
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.Dial(server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(c.Timeout))
+	if _, err = conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	buf, err = conn.ReadMsgHeader(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &dns.Msg{}
+	if err = res.Unpack(buf); err != nil {
+		return nil, err
+	}
+	if res.Id != m.Id {
+		return nil, dns.ErrId
+	}
+
+	return res, nil
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestPrimary starts the authoritative server that accepts the UPDATE
+// and NOTIFY messages signed with secrets, or the unsigned ones if secrets
+// is nil
+func startTestPrimary(t *testing.T, secrets map[string]string) (addr string, stop func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	started := make(chan struct{})
+	s := &dns.Server{
+		PacketConn:        pc,
+		TsigSecret:        secrets,
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc:     func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			res := &dns.Msg{}
+			res.SetReply(r)
+			if secrets != nil {
+				t := r.IsTsig()
+				switch {
+				case t == nil:
+					res.Rcode = dns.RcodeNotAuth
+				case w.TsigStatus() != nil:
+					// The error is sent with the unsigned TSIG record
+					res.Rcode = dns.RcodeNotAuth
+					res.SetTsig(t.Hdr.Name, t.Algorithm, tsigFudge, time.Now().Unix())
+					res.IsTsig().Error = dns.RcodeBadSig
+					if w.TsigStatus() == dns.ErrSecret {
+						res.IsTsig().Error = dns.RcodeBadKey
+					}
+					buf, _ := res.Pack()
+					_, _ = w.Write(buf)
+					return
+				default:
+					res.SetTsig(t.Hdr.Name, t.Algorithm, tsigFudge, time.Now().Unix())
+				}
+			}
+			_ = w.WriteMsg(res)
+		}),
+	}
+	go func() { _ = s.ActivateAndServe() }()
+	<-started
+
+	return pc.LocalAddr().String(), func() { _ = s.Shutdown() }
+}
+
+func createUpdateTestMessage() *dns.Msg {
+	m := &dns.Msg{}
+	m.SetUpdate("example.org.")
+	m.Insert([]dns.RR{newRR("host.example.org. 300 IN A 192.168.1.10")})
+
+	return m
+}
+
+func TestUpdateForward(t *testing.T) {
+	key, err := ParseTSIGKey("dhcp-update:c2VjcmV0c2VjcmV0")
+	assert.Nil(t, err)
+
+	addr, stop := startTestPrimary(t, key.secrets())
+	defer stop()
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpdateForward = &UpdateForward{Server: addr, TSIG: key, Timeout: time.Second}
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		d.Res.Rcode = dns.RcodeNameError
+		return nil
+	}
+
+	// Signing requires ACL
+	assert.NotNil(t, dnsProxy.Start())
+	dnsProxy.ACL, err = ParseACL([]string{"127.0.0.0/8"}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, dnsProxy.Start())
+	defer func() { assert.Nil(t, dnsProxy.Stop()) }()
+
+	c := &dns.Client{Timeout: time.Second}
+	proxyAddr := dnsProxy.Addr(ProtoUDP).String()
+
+	// The UPDATE and NOTIFY messages are signed and forwarded, the TSIG
+	// record of the response is removed
+	notify := &dns.Msg{}
+	notify.SetNotify("example.org.")
+	for _, req := range []*dns.Msg{createUpdateTestMessage(), notify} {
+		res, _, err := c.Exchange(req, proxyAddr)
+		if assert.Nil(t, err) {
+			assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+			assert.Equal(t, req.Opcode, res.Opcode)
+			assert.Nil(t, res.IsTsig())
+		}
+	}
+
+	// The queries are still handled
+	res, _, err := c.Exchange(createTestMessage(), proxyAddr)
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeNameError, res.Rcode)
+	}
+
+	// The unsigned errors like BADSIG are passed to the clients
+	f := &UpdateForward{Server: addr, TSIG: &TSIGKey{Name: key.Name, Secret: "b3RoZXJzZWNyZXQ="}, Timeout: time.Second}
+	res, err = f.exchange(createUpdateTestMessage())
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeNotAuth, res.Rcode)
+	}
+}
+
+func TestUpdateForwardListener(t *testing.T) {
+	addr, stop := startTestPrimary(t, nil)
+	defer stop()
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.Listeners = []*ListenerConfig{{
+		UDPListenAddr: []*net.UDPAddr{{IP: net.ParseIP(listenIP)}},
+		UpdateForward: &UpdateForward{Server: addr, Timeout: time.Second},
+	}}
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = genEmptyNoError(d.Req)
+		d.Res.Rcode = dns.RcodeNotImplemented
+		return nil
+	}
+	assert.Nil(t, dnsProxy.Start())
+	defer func() { assert.Nil(t, dnsProxy.Stop()) }()
+
+	addrs := dnsProxy.Addrs(ProtoUDP)
+	assert.Len(t, addrs, 2)
+
+	c := &dns.Client{Timeout: time.Second}
+
+	// Only the designated listener forwards the messages
+	res, _, err := c.Exchange(createUpdateTestMessage(), addrs[0].String())
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeNotImplemented, res.Rcode)
+	}
+
+	req := createUpdateTestMessage()
+	res, _, err = c.Exchange(req, addrs[1].String())
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+		assert.Equal(t, req.Id, res.Id)
+	}
+
+	// The messages signed by the clients are forwarded as is
+	key := &TSIGKey{Name: "dhcp-update", Secret: "c2VjcmV0c2VjcmV0"}
+	signed := &dns.Client{Timeout: time.Second, TsigSecret: key.secrets()}
+	key.sign(req)
+	res, _, err = signed.Exchange(req, addrs[1].String())
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	}
+
+	// The unsigned successful responses aren't accepted if the messages are
+	// signed
+	req = createUpdateTestMessage()
+	_, err = (&UpdateForward{Server: addr, TSIG: key, Timeout: time.Second}).exchange(req)
+	assert.NotNil(t, err)
+}
+
+func TestUpdateForwardPrivacy(t *testing.T) {
+	addr, stop := startTestPrimary(t, nil)
+	defer stop()
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.PrivacyMode = true
+	dnsProxy.UpdateForward = &UpdateForward{Server: addr, Timeout: time.Second}
+	assert.Nil(t, dnsProxy.Start())
+	defer func() { assert.Nil(t, dnsProxy.Stop()) }()
+
+	req := createUpdateTestMessage()
+	req.SetEdns0(1232, false)
+	setECS(req, net.IP{203, 0, 113, 1}, 0)
+
+	// The response gets the client's ID back
+	c := &dns.Client{Timeout: time.Second}
+	res, _, err := c.Exchange(req, dnsProxy.Addr(ProtoUDP).String())
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+		assert.Equal(t, req.Id, res.Id)
+	}
+}
+
+func TestUpdateForwardValidate(t *testing.T) {
+	assert.Nil(t, (&UpdateForward{Server: "10.0.0.2:53"}).validate())
+	assert.NotNil(t, (&UpdateForward{Server: "10.0.0.2"}).validate())
+	assert.NotNil(t, (&UpdateForward{
+		Server: "10.0.0.2:53",
+		TSIG:   &TSIGKey{Name: "key", Secret: "not base64"},
+	}).validate())
+
+	// The listener that signs the updates requires its own ACL or the
+	// global one
+	key := &TSIGKey{Name: "key", Secret: "c2VjcmV0c2VjcmV0"}
+	lc := &ListenerConfig{
+		UDPListenAddr: []*net.UDPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		UpdateForward: &UpdateForward{Server: "10.0.0.2:53", TSIG: key},
+	}
+	c := &Config{
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{&testUpstream{}}},
+		Listeners:      []*ListenerConfig{lc},
+	}
+	assert.NotNil(t, c.Validate())
+	acl, err := ParseACL([]string{"10.0.0.0/24"}, nil)
+	assert.Nil(t, err)
+	lc.ACL = acl
+	assert.Nil(t, c.Validate())
+	lc.ACL, c.ACL = nil, acl
+	assert.Nil(t, c.Validate())
+}
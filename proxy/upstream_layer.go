@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/fastip"
+)
+
+// UpstreamLayer is the runtime state of the upstreams: their round-trip time
+// and error rate statistics, their health, and the fastest-addr module with its
+// cache.
+// Several Proxy instances may share it via Config.UpstreamLayer, e.g. an
+// embedder running one proxy per tenant.  The connection pools and the
+// bootstrap caches belong to the upstreams themselves, so to share them as
+// well the proxies must use the same upstream.Upstream instances.
+//
+// The zero value is ready to use.
+type UpstreamLayer struct {
+	stats     map[string]*upstreamStats // Map of upstream addresses and their statistics, see Proxy.UpstreamStats
+	statsLock sync.Mutex                // Synchronizes access to stats
+
+	health     map[string]*upstreamHealth // Map of upstream addresses and their health state
+	healthLock sync.RWMutex               // Synchronizes access to health
+
+	fastestAddr     *fastip.FastestAddr // fastest-addr module, created on demand
+	fastestAddrLock sync.Mutex          // Synchronizes access to fastestAddr
+}
+
+// upstreamLayer returns the shared upstream layer if it's configured and the
+// proxy's own one otherwise
+func (p *Proxy) upstreamLayer() *UpstreamLayer {
+	if p.UpstreamLayer != nil {
+		return p.UpstreamLayer
+	}
+
+	return &p.ownUpstreamLayer
+}
+
+// getFastestAddr returns the fastest-addr module creating it with the
+// configuration c if necessary
+func (l *UpstreamLayer) getFastestAddr(c fastip.Config) *fastip.FastestAddr {
+	l.fastestAddrLock.Lock()
+	defer l.fastestAddrLock.Unlock()
+
+	if l.fastestAddr == nil {
+		l.fastestAddr = fastip.NewFastestAddrWithConfig(c)
+	}
+
+	return l.fastestAddr
+}
+
+// FastestAddrResults returns the cached results of probing the IP addresses
+// in UModeFastestAddr, see fastip.FastestAddr.Results.  It returns nil in the
+// other modes.
+func (p *Proxy) FastestAddrResults() []fastip.Result {
+	if p.fastestAddr == nil {
+		return nil
+	}
+
+	return p.fastestAddr.Results()
+}
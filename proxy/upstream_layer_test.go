@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedUpstreamLayer(t *testing.T) {
+	layer := &UpstreamLayer{}
+
+	p1 := createTestProxy(t, nil)
+	p1.UpstreamLayer = layer
+	p1.UpstreamMode = UModeFastestAddr
+	p2 := createTestProxy(t, nil)
+	p2.UpstreamLayer = layer
+	p2.UpstreamMode = UModeFastestAddr
+	p3 := createTestProxy(t, nil)
+	p3.UpstreamMode = UModeFastestAddr
+
+	for _, p := range []*Proxy{p1, p2, p3} {
+		assert.Nil(t, p.Init())
+	}
+
+	// The fastest-addr module is shared
+	assert.NotNil(t, p1.fastestAddr)
+	assert.True(t, p1.fastestAddr == p2.fastestAddr)
+	assert.False(t, p1.fastestAddr == p3.fastestAddr)
+
+	// So are the rtt stats
+	upstreams := []upstream.Upstream{
+		&healthTestUpstream{addr: "1.1.1.1:53"},
+		&healthTestUpstream{addr: "8.8.8.8:53"},
+	}
+	p1.upstreamLayer().recordExchange("1.1.1.1:53", 100*time.Millisecond, nil)
+	assert.Equal(t, "8.8.8.8:53", p2.upstreamLayer().sortByStats(upstreams)[0].Address())
+	assert.Equal(t, "1.1.1.1:53", p3.upstreamLayer().sortByStats(upstreams)[0].Address())
+
+	// And the health state
+	now := time.Now()
+	testErr := errors.New("test")
+	p1.HealthCheckInterval = time.Minute
+	for i := 0; i < healthCheckMaxFailures; i++ {
+		p1.updateUpstreamHealth("1.1.1.1:53", testErr, now)
+	}
+	assert.Equal(t, []string{"1.1.1.1:53"}, p2.downUpstreams())
+	assert.Len(t, p2.healthyUpstreams(upstreams), 1)
+	assert.Empty(t, p3.downUpstreams())
+}
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// UpstreamPolicy is the timeout and the retry policy of the exchanges with an
+// upstream
+type UpstreamPolicy struct {
+	// Timeout is the maximum duration of a single exchange attempt.  If 0,
+	// only the timeout of the upstream itself is used.  The shortest of the
+	// upstream's own timeout, this one, and Config.ParallelTimeout applies.
+	Timeout time.Duration
+	// Retries is the number of the additional attempts after a failed one
+	Retries int
+	// Backoff is the delay before the first retry, it's doubled for every
+	// next one
+	Backoff time.Duration
+}
+
+// errExchangeTimeout is returned when an exchange attempt exceeds the timeout
+// of the policy
+var errExchangeTimeout = errors.New("upstream exchange timed out")
+
+// maxAbandonedExchanges is the max number of the timed out exchanges with an
+// upstream still waiting for the upstream's own timeout.  The next attempts
+// fail at once until some of them finish.
+const maxAbandonedExchanges = 64
+
+// abandonedExchanges counts the timed out exchanges with the upstreams that
+// are still in progress
+type abandonedExchanges struct {
+	lock  sync.Mutex
+	count map[string]int // upstream address -> number of exchanges
+}
+
+// add adds delta to the number of the abandoned exchanges with the upstream
+// and returns the new one
+func (a *abandonedExchanges) add(addr string, delta int) int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.count == nil {
+		a.count = map[string]int{}
+	}
+
+	n := a.count[addr] + delta
+	if n <= 0 {
+		delete(a.count, addr)
+		return 0
+	}
+	a.count[addr] = n
+
+	return n
+}
+
+// upstreamPolicy returns the policy for the upstream, either its own one or
+// the default one
+func (p *Proxy) upstreamPolicy(u upstream.Upstream) UpstreamPolicy {
+	if policy, ok := p.UpstreamPolicies[u.Address()]; ok {
+		return policy
+	}
+
+	return p.UpstreamPolicy
+}
+
+// exchangeWithPolicy sends the request to the upstream with the timeout and
+// the retries of its policy.  If maxTimeout isn't 0, it limits the timeout of
+// the policy.
+func (p *Proxy) exchangeWithPolicy(u upstream.Upstream, req *dns.Msg, maxTimeout time.Duration) (reply *dns.Msg, err error) {
+	policy := p.upstreamPolicy(u)
+	timeout := policy.Timeout
+	if maxTimeout > 0 && (timeout == 0 || maxTimeout < timeout) {
+		timeout = maxTimeout
+	}
+
+	backoff := policy.Backoff
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		reply, err = p.exchangeWithCookie(u, req, timeout)
+		p.upstreamLayer().recordExchange(u.Address(), time.Since(start), err)
+		if err == nil || attempt >= policy.Retries {
+			return reply, err
+		}
+
+		if backoff > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// exchangeWithTimeout sends the request to the upstream and waits for the
+// response for at most timeout.  0 means the timeout of the upstream itself,
+// which timeout can only shorten.  The abandoned exchange finishes in
+// background when the upstream's timeout expires, so their number is limited
+// by maxAbandonedExchanges.
+func (p *Proxy) exchangeWithTimeout(u upstream.Upstream, req *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	if timeout <= 0 {
+		return u.Exchange(req)
+	}
+
+	addr := u.Address()
+	if p.abandoned.add(addr, 0) >= maxAbandonedExchanges {
+		return nil, fmt.Errorf("%s: %w, too many previous exchanges are still in progress", addr, errExchangeTimeout)
+	}
+
+	type result struct {
+		reply *dns.Msg
+		err   error
+	}
+
+	// The request is copied as it may be still used by the abandoned
+	// exchange when it's retried
+	req = req.Copy()
+	ch := make(chan result, 1)
+
+	// state is set to exchangeDone by the exchange or to exchangeAbandoned on
+	// timeout, whichever is the first
+	var state int32
+	go func() {
+		reply, err := u.Exchange(req)
+		ch <- result{reply: reply, err: err}
+		if !atomic.CompareAndSwapInt32(&state, exchangeRunning, exchangeDone) {
+			p.abandoned.add(addr, -1)
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-ch:
+		return r.reply, r.err
+	case <-timer.C:
+		if atomic.CompareAndSwapInt32(&state, exchangeRunning, exchangeAbandoned) {
+			p.abandoned.add(addr, 1)
+			return nil, fmt.Errorf("%s: %w after %s", addr, errExchangeTimeout, timeout)
+		}
+
+		r := <-ch
+		return r.reply, r.err
+	}
+}
+
+// The states of an exchange with timeout
+const (
+	exchangeRunning int32 = iota
+	exchangeDone
+	exchangeAbandoned
+)
+
+// policyUpstream applies the policy to the exchanges of the upstream passed
+// to the functions of the upstream package
+type policyUpstream struct {
+	upstream.Upstream
+
+	proxy   *Proxy
+	timeout time.Duration
+}
+
+// Exchange implements the upstream.Upstream interface for *policyUpstream
+func (u *policyUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return u.proxy.exchangeWithPolicy(u.Upstream, m, u.timeout)
+}
+
+// withPolicy returns the upstream that applies the policy of u to its
+// exchanges and records their statistics.  If timeout isn't 0, it limits the
+// timeout of the policy.
+func (p *Proxy) withPolicy(u upstream.Upstream, timeout time.Duration) upstream.Upstream {
+	return &policyUpstream{Upstream: u, proxy: p, timeout: timeout}
+}
+
+// exchangeParallel is upstream.ExchangeParallel with the policies of the
+// upstreams applied.  Config.ParallelTimeout, if set, limits their timeouts.
+func (p *Proxy) exchangeParallel(upstreams []upstream.Upstream, req *dns.Msg) (*dns.Msg, upstream.Upstream, error) {
+	return p.exchangeParallelWithTimeout(upstreams, req, p.ParallelTimeout)
+}
+
+// exchangeParallelWithTimeout is exchangeParallel with the timeout of the
+// attempts limited by timeout, if it isn't 0
+func (p *Proxy) exchangeParallelWithTimeout(upstreams []upstream.Upstream, req *dns.Msg, timeout time.Duration) (*dns.Msg, upstream.Upstream, error) {
+	wrapped := make([]upstream.Upstream, len(upstreams))
+	for i, u := range upstreams {
+		wrapped[i] = p.withPolicy(u, timeout)
+	}
+
+	reply, u, err := upstream.ExchangeParallel(wrapped, req)
+	if pu, ok := u.(*policyUpstream); ok {
+		u = pu.Upstream
+	}
+
+	return reply, u, err
+}
+
+// exchangeFastest is FastestAddr.ExchangeFastest with the policies of the
+// upstreams applied.  The upstreams with the better statistics are preferred
+// when several of them return the fastest address or none of the addresses
+// responds.
+func (p *Proxy) exchangeFastest(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	sorted := p.upstreamLayer().sortByStats(upstreams)
+	wrapped := make([]upstream.Upstream, len(sorted))
+	for i, u := range sorted {
+		wrapped[i] = p.withPolicy(u, 0)
+	}
+
+	reply, u, err := p.fastestAddr.ExchangeFastest(req, wrapped)
+	if pu, ok := u.(*policyUpstream); ok {
+		u = pu.Upstream
+	}
+
+	return reply, u, err
+}
+
+// ParseUpstreamPolicy parses the policy of an upstream in the
+// "address=timeout[,retries[,backoff]]" form, e.g.
+// "tls://dns.example.org=2s,1,100ms".  The empty fields are left 0.
+func ParseUpstreamPolicy(s string) (addr string, policy UpstreamPolicy, err error) {
+	i := strings.LastIndexByte(s, '=')
+	if i <= 0 {
+		return "", policy, fmt.Errorf("invalid upstream policy %q: no address", s)
+	}
+	addr = s[:i]
+
+	fields := strings.Split(s[i+1:], ",")
+	if len(fields) > 3 {
+		return "", policy, fmt.Errorf("invalid upstream policy %q: too many fields", s)
+	}
+
+	for j, f := range fields {
+		if f == "" {
+			continue
+		}
+
+		switch j {
+		case 0:
+			policy.Timeout, err = time.ParseDuration(f)
+		case 1:
+			policy.Retries, err = strconv.Atoi(f)
+		case 2:
+			policy.Backoff, err = time.ParseDuration(f)
+		}
+		if err != nil {
+			return "", policy, fmt.Errorf("invalid upstream policy %q: %w", s, err)
+		}
+	}
+
+	if policy.Timeout < 0 || policy.Retries < 0 || policy.Backoff < 0 {
+		return "", policy, fmt.Errorf("invalid upstream policy %q: negative value", s)
+	}
+
+	return addr, policy, nil
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// policyTestUpstream fails the first exchanges and answers after a delay
+type policyTestUpstream struct {
+	addr     string
+	fails    int32
+	delay    time.Duration
+	attempts int32
+}
+
+func (u *policyTestUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	n := atomic.AddInt32(&u.attempts, 1)
+	if n <= u.fails {
+		return nil, errors.New("test failure")
+	}
+	time.Sleep(u.delay)
+
+	return genEmptyNoError(m), nil
+}
+
+func (u *policyTestUpstream) Address() string {
+	return u.addr
+}
+
+func TestUpstreamPolicyRetries(t *testing.T) {
+	p := &Proxy{}
+	u := &policyTestUpstream{addr: "flaky", fails: 2}
+
+	// No retries by default
+	_, err := p.exchangeWithPolicy(u, createTestMessage(), 0)
+	assert.NotNil(t, err)
+
+	u.attempts = 0
+	p.UpstreamPolicy = UpstreamPolicy{Retries: 2, Backoff: 10 * time.Millisecond}
+	start := time.Now()
+	_, err = p.exchangeWithPolicy(u, createTestMessage(), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), u.attempts)
+	assert.True(t, time.Since(start) >= 30*time.Millisecond)
+
+	// The upstream's own policy overrides the default one
+	u.attempts = 0
+	p.UpstreamPolicies = map[string]UpstreamPolicy{"flaky": {Retries: 1}}
+	_, err = p.exchangeWithPolicy(u, createTestMessage(), 0)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(2), u.attempts)
+}
+
+func TestUpstreamPolicyTimeout(t *testing.T) {
+	p := &Proxy{}
+	p.UpstreamPolicies = map[string]UpstreamPolicy{"slow": {Timeout: 500 * time.Millisecond}}
+	slow := &policyTestUpstream{addr: "slow", delay: 100 * time.Millisecond}
+
+	_, err := p.exchangeWithPolicy(slow, createTestMessage(), 0)
+	assert.Nil(t, err)
+
+	_, err = p.exchangeWithPolicy(slow, createTestMessage(), 10*time.Millisecond)
+	assert.True(t, errors.Is(err, errExchangeTimeout))
+
+	// The longer timeout doesn't override the shorter one of the policy
+	p.UpstreamPolicies["slow"] = UpstreamPolicy{Timeout: 10 * time.Millisecond}
+	_, err = p.exchangeWithPolicy(slow, createTestMessage(), time.Second)
+	assert.True(t, errors.Is(err, errExchangeTimeout))
+	p.UpstreamPolicies["slow"] = UpstreamPolicy{Timeout: 500 * time.Millisecond}
+
+	// The parallel timeout doesn't let the slow upstream answer
+	p.ParallelTimeout = 10 * time.Millisecond
+	_, _, err = p.exchangeParallel([]upstream.Upstream{slow, &policyTestUpstream{addr: "failing", fails: 1}}, createTestMessage())
+	assert.NotNil(t, err)
+
+	fast := &policyTestUpstream{addr: "fast"}
+	_, u, err := p.exchangeParallel([]upstream.Upstream{slow, fast}, createTestMessage())
+	assert.Nil(t, err)
+	assert.True(t, u == fast)
+}
+
+// blockingTestUpstream answers when release is closed
+type blockingTestUpstream struct {
+	release  chan struct{}
+	attempts int32
+}
+
+func (u *blockingTestUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.attempts, 1)
+	<-u.release
+
+	return genEmptyNoError(m), nil
+}
+
+func (u *blockingTestUpstream) Address() string {
+	return "slow"
+}
+
+func TestUpstreamPolicyAbandoned(t *testing.T) {
+	p := &Proxy{}
+	slow := &blockingTestUpstream{release: make(chan struct{})}
+
+	for i := 0; i < maxAbandonedExchanges; i++ {
+		_, err := p.exchangeWithTimeout(slow, createTestMessage(), time.Millisecond)
+		assert.True(t, errors.Is(err, errExchangeTimeout))
+	}
+
+	// The upstream isn't asked while too many exchanges are in progress
+	_, err := p.exchangeWithTimeout(slow, createTestMessage(), time.Second)
+	assert.True(t, errors.Is(err, errExchangeTimeout))
+	assert.Equal(t, int32(maxAbandonedExchanges), atomic.LoadInt32(&slow.attempts))
+
+	close(slow.release)
+	assert.Eventually(t, func() bool {
+		return p.abandoned.add("slow", 0) == 0
+	}, time.Second, 10*time.Millisecond)
+	_, err = p.exchangeWithTimeout(slow, createTestMessage(), time.Second)
+	assert.Nil(t, err)
+}
+
+func TestParseUpstreamPolicy(t *testing.T) {
+	addr, policy, err := ParseUpstreamPolicy("https://dns.example.org/dns-query=2s,1,100ms")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://dns.example.org/dns-query", addr)
+	assert.Equal(t, UpstreamPolicy{Timeout: 2 * time.Second, Retries: 1, Backoff: 100 * time.Millisecond}, policy)
+
+	addr, policy, err = ParseUpstreamPolicy("8.8.8.8:53=,3")
+	assert.Nil(t, err)
+	assert.Equal(t, "8.8.8.8:53", addr)
+	assert.Equal(t, UpstreamPolicy{Retries: 3}, policy)
+
+	for _, s := range []string{"8.8.8.8:53", "=1s", "8.8.8.8:53=1s,1,1s,1", "8.8.8.8:53=x", "8.8.8.8:53=1s,-1"} {
+		_, _, err = ParseUpstreamPolicy(s)
+		assert.NotNil(t, err, s)
+	}
+}
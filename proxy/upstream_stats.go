@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/joomcode/errorx"
+)
+
+const (
+	// upstreamRTTSamples is the number of the last round-trip times of an
+	// upstream the percentiles are calculated from
+	upstreamRTTSamples = 1000
+
+	// upstreamEWMAWeight is the weight of the newest exchange in the
+	// moving averages of the round-trip time and the failure rate of an
+	// upstream
+	upstreamEWMAWeight = 0.2
+)
+
+// upstreamStats are the runtime statistics of a single upstream
+type upstreamStats struct {
+	queries  uint64
+	errors   uint64
+	timeouts uint64
+
+	rttSum  time.Duration   // sum of the round-trip times of successful exchanges
+	rtts    []time.Duration // ring buffer of the last round-trip times
+	rttNext int             // index of the next sample in rtts
+
+	// ewmaRTT and ewmaErrors are the exponentially weighted moving
+	// averages of the round-trip time of the successful exchanges and of
+	// the failure rate, they follow the recent state of the upstream
+	ewmaRTT    time.Duration
+	ewmaErrors float64
+
+	lastFailure time.Time
+	lastError   string
+}
+
+// UpstreamStats contains the runtime statistics of an upstream.  The
+// durations are encoded in JSON as nanoseconds.
+type UpstreamStats struct {
+	Address  string `json:"address"`
+	Queries  uint64 `json:"queries"`  // number of exchanges including retries
+	Errors   uint64 `json:"errors"`   // number of failed exchanges including the timed out ones
+	Timeouts uint64 `json:"timeouts"` // number of timed out exchanges
+
+	// AvgRTT is the average round-trip time of the successful exchanges.
+	// The percentiles are calculated from the last 1000 of them.
+	AvgRTT time.Duration `json:"avg_rtt"`
+	P50RTT time.Duration `json:"p50_rtt"`
+	P90RTT time.Duration `json:"p90_rtt"`
+	P99RTT time.Duration `json:"p99_rtt"`
+
+	// EWMARTT and ErrorRate are the moving averages of the round-trip time
+	// and the failure rate the upstreams are ranked by
+	EWMARTT   time.Duration `json:"ewma_rtt"`
+	ErrorRate float64       `json:"error_rate"`
+
+	LastFailure time.Time `json:"last_failure"`         // time of the last failed exchange, zero if none
+	LastError   string    `json:"last_error,omitempty"` // error of the last failed exchange
+}
+
+// recordExchange updates the statistics of the upstream with the result of
+// an exchange that took rtt
+func (l *UpstreamLayer) recordExchange(address string, rtt time.Duration, err error) {
+	l.statsLock.Lock()
+	defer l.statsLock.Unlock()
+
+	if l.stats == nil {
+		l.stats = map[string]*upstreamStats{}
+	}
+	s := l.stats[address]
+	if s == nil {
+		s = &upstreamStats{}
+		l.stats[address] = s
+	}
+
+	s.queries++
+	failed := 0.0
+	if err != nil {
+		failed = 1
+	}
+	if s.queries == 1 {
+		s.ewmaErrors = failed
+	} else {
+		s.ewmaErrors += upstreamEWMAWeight * (failed - s.ewmaErrors)
+	}
+
+	if err != nil {
+		s.errors++
+		if isTimeout(err) {
+			s.timeouts++
+		}
+		s.lastFailure = time.Now()
+		s.lastError = err.Error()
+		return
+	}
+
+	s.rttSum += rtt
+	if s.ewmaRTT == 0 {
+		s.ewmaRTT = rtt
+	} else {
+		s.ewmaRTT += time.Duration(upstreamEWMAWeight * float64(rtt-s.ewmaRTT))
+	}
+
+	if len(s.rtts) < upstreamRTTSamples {
+		s.rtts = append(s.rtts, rtt)
+	} else {
+		s.rtts[s.rttNext] = rtt
+		s.rttNext = (s.rttNext + 1) % upstreamRTTSamples
+	}
+}
+
+// snapshot returns the statistics of the upstream with the address
+func (s *upstreamStats) snapshot(address string) UpstreamStats {
+	res := UpstreamStats{
+		Address:     address,
+		Queries:     s.queries,
+		Errors:      s.errors,
+		Timeouts:    s.timeouts,
+		EWMARTT:     s.ewmaRTT,
+		ErrorRate:   s.ewmaErrors,
+		LastFailure: s.lastFailure,
+		LastError:   s.lastError,
+	}
+
+	if n := s.queries - s.errors; n > 0 {
+		res.AvgRTT = s.rttSum / time.Duration(n)
+	}
+
+	if len(s.rtts) > 0 {
+		rtts := make([]time.Duration, len(s.rtts))
+		copy(rtts, s.rtts)
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		res.P50RTT = percentile(rtts, 50)
+		res.P90RTT = percentile(rtts, 90)
+		res.P99RTT = percentile(rtts, 99)
+	}
+
+	return res
+}
+
+// percentile returns the p-th percentile of the sorted durations using the
+// nearest-rank method
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return sorted[i]
+}
+
+// expectedRTT returns the expected time of an exchange with the upstream
+// from the moving averages, counting a failed one as defaultTimeout.  It's 0
+// for the upstreams that haven't been used yet, so that they're tried first.
+func (s *upstreamStats) expectedRTT() time.Duration {
+	if s == nil || s.queries == 0 {
+		return 0
+	}
+
+	return time.Duration((1-s.ewmaErrors)*float64(s.ewmaRTT) + s.ewmaErrors*float64(defaultTimeout))
+}
+
+// sortByStats returns the copy of upstreams sorted by their expected
+// round-trip time from fast to slow
+func (l *UpstreamLayer) sortByStats(upstreams []upstream.Upstream) []upstream.Upstream {
+	rtts := make(map[string]time.Duration, len(upstreams))
+	l.statsLock.Lock()
+	for _, u := range upstreams {
+		rtts[u.Address()] = l.stats[u.Address()].expectedRTT()
+	}
+	l.statsLock.Unlock()
+
+	sorted := make([]upstream.Upstream, len(upstreams))
+	copy(sorted, upstreams)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rtts[sorted[i].Address()] < rtts[sorted[j].Address()]
+	})
+
+	return sorted
+}
+
+// UpstreamStats returns a snapshot of the runtime statistics of the
+// upstreams that have been used, sorted by their addresses.  The health
+// probes aren't counted.
+func (p *Proxy) UpstreamStats() []UpstreamStats {
+	l := p.upstreamLayer()
+	l.statsLock.Lock()
+	defer l.statsLock.Unlock()
+
+	res := make([]UpstreamStats, 0, len(l.stats))
+	for address, s := range l.stats {
+		res = append(res, s.snapshot(address))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Address < res[j].Address })
+
+	return res
+}
+
+// isTimeout returns true if the error is caused by an exchange timeout
+func isTimeout(err error) bool {
+	for err != nil {
+		if errors.Is(err, errExchangeTimeout) {
+			return true
+		}
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return true
+		}
+
+		// errorx doesn't support errors.Unwrap
+		xerr, ok := err.(*errorx.Error)
+		if !ok {
+			return false
+		}
+		err = xerr.Cause()
+	}
+
+	return false
+}
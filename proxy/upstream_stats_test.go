@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamStats(t *testing.T) {
+	p := &Proxy{}
+	p.UpstreamPolicy = UpstreamPolicy{Retries: 1}
+
+	flaky := &policyTestUpstream{addr: "flaky", fails: 1}
+	_, err := p.exchangeWithPolicy(flaky, createTestMessage(), 0)
+	assert.Nil(t, err)
+
+	slow := &policyTestUpstream{addr: "slow", delay: 100 * time.Millisecond}
+	_, err = p.exchangeWithPolicy(slow, createTestMessage(), 10*time.Millisecond)
+	assert.NotNil(t, err)
+
+	stats := p.UpstreamStats()
+	if !assert.Len(t, stats, 2) {
+		return
+	}
+
+	assert.Equal(t, "flaky", stats[0].Address)
+	assert.Equal(t, uint64(2), stats[0].Queries)
+	assert.Equal(t, uint64(1), stats[0].Errors)
+	assert.Equal(t, uint64(0), stats[0].Timeouts)
+	assert.Equal(t, "test failure", stats[0].LastError)
+	assert.False(t, stats[0].LastFailure.IsZero())
+
+	assert.Equal(t, "slow", stats[1].Address)
+	assert.Equal(t, uint64(2), stats[1].Queries)
+	assert.Equal(t, uint64(2), stats[1].Timeouts)
+	assert.Equal(t, time.Duration(0), stats[1].AvgRTT)
+
+	p.stats = newStatsCounters()
+	assert.Equal(t, stats, p.Stats().Upstreams)
+}
+
+func TestUpstreamStatsRTT(t *testing.T) {
+	l := &UpstreamLayer{}
+	for i := 1; i <= upstreamRTTSamples+100; i++ {
+		l.recordExchange("u", time.Duration(i)*time.Millisecond, nil)
+	}
+
+	s := l.stats["u"].snapshot("u")
+	assert.Equal(t, uint64(upstreamRTTSamples+100), s.Queries)
+	assert.Equal(t, 550500*time.Microsecond, s.AvgRTT)
+	// Only the last samples are used for the percentiles
+	assert.Equal(t, 600*time.Millisecond, s.P50RTT)
+	assert.Equal(t, 1000*time.Millisecond, s.P90RTT)
+	assert.Equal(t, 1090*time.Millisecond, s.P99RTT)
+}
+
+func TestUpstreamSortByStats(t *testing.T) {
+	l := &UpstreamLayer{}
+	fast := &policyTestUpstream{addr: "fast"}
+	slow := &policyTestUpstream{addr: "slow"}
+	failing := &policyTestUpstream{addr: "failing"}
+	unused := &policyTestUpstream{addr: "unused"}
+
+	l.recordExchange("fast", 10*time.Millisecond, nil)
+	l.recordExchange("slow", 500*time.Millisecond, nil)
+	l.recordExchange("failing", time.Millisecond, nil)
+	l.recordExchange("failing", time.Millisecond, errors.New("test failure"))
+
+	sorted := l.sortByStats([]upstream.Upstream{failing, slow, fast, unused})
+	assert.Equal(t, []upstream.Upstream{unused, fast, slow, failing}, sorted)
+}
+
+func TestUpstreamStatsEWMA(t *testing.T) {
+	l := &UpstreamLayer{}
+	l.recordExchange("u", 100*time.Millisecond, nil)
+	l.recordExchange("u", 200*time.Millisecond, nil)
+
+	s := l.stats["u"]
+	assert.Equal(t, 120*time.Millisecond, s.ewmaRTT)
+	assert.Equal(t, 120*time.Millisecond, s.expectedRTT())
+
+	// A failure costs defaultTimeout
+	l.recordExchange("u", time.Millisecond, errors.New("test failure"))
+	assert.Equal(t, 120*time.Millisecond, s.ewmaRTT)
+	assert.InDelta(t, 0.2, s.ewmaErrors, 1e-9)
+	assert.Equal(t, 96*time.Millisecond+defaultTimeout/5, s.expectedRTT())
+
+	// But the recovered upstream is ranked by its latency again, unlike with
+	// the lifetime averages
+	l.recordExchange("slow", 500*time.Millisecond, nil)
+	for i := 0; i < 20; i++ {
+		l.recordExchange("u", 120*time.Millisecond, nil)
+	}
+	u := &policyTestUpstream{addr: "u"}
+	slow := &policyTestUpstream{addr: "slow"}
+	assert.Equal(t, []upstream.Upstream{u, slow}, l.sortByStats([]upstream.Upstream{slow, u}))
+
+	snap := s.snapshot("u")
+	assert.Equal(t, 120*time.Millisecond, snap.EWMARTT)
+	assert.True(t, snap.ErrorRate > 0 && snap.ErrorRate < 0.01)
+}
+
+func TestLoadBalanceOrder(t *testing.T) {
+	fast := &policyTestUpstream{addr: "fast"}
+	medium := &policyTestUpstream{addr: "medium", delay: 10 * time.Millisecond}
+	slow := &policyTestUpstream{addr: "slow", delay: 20 * time.Millisecond}
+	upstreams := []upstream.Upstream{slow, medium, fast}
+
+	p := &Proxy{}
+	l := p.upstreamLayer()
+	l.recordExchange("fast", time.Millisecond, nil)
+	l.recordExchange("medium", 10*time.Millisecond, nil)
+	l.recordExchange("slow", 20*time.Millisecond, nil)
+
+	p.UpstreamProbeRate = -1
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, []upstream.Upstream{fast, medium, slow}, p.loadBalanceOrder(upstreams))
+	}
+
+	// Every request probes one of the others, the rest keep their order
+	p.UpstreamProbeRate = 1
+	probed := map[upstream.Upstream]bool{}
+	for i := 0; i < 100; i++ {
+		order := p.loadBalanceOrder(upstreams)
+		assert.NotEqual(t, fast, order[0])
+		assert.Equal(t, fast, order[1])
+		probed[order[0]] = true
+	}
+	assert.Len(t, probed, 2)
+
+	// Most of the traffic goes to the best upstream only
+	p.UpstreamProbeRate = 0.1
+	for i := 0; i < 100; i++ {
+		_, _, err := p.exchange(createTestMessage(), upstreams)
+		assert.Nil(t, err)
+	}
+	assert.True(t, fast.attempts > 70)
+	assert.Equal(t, int32(100), fast.attempts+medium.attempts+slow.attempts)
+}
+
+func TestIsTimeout(t *testing.T) {
+	assert.True(t, isTimeout(fmt.Errorf("u: %w", errExchangeTimeout)))
+	assert.True(t, isTimeout(errorx.Decorate(&timeoutError{}, "exchange")))
+	assert.False(t, isTimeout(errorx.Decorate(errors.New("refused"), "exchange")))
+	assert.False(t, isTimeout(nil))
+}
+
+// timeoutError is a net.Error that has timed out
+type timeoutError struct{}
+
+func (*timeoutError) Error() string   { return "i/o timeout" }
+func (*timeoutError) Timeout() bool   { return true }
+func (*timeoutError) Temporary() bool { return true }
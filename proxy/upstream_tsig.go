@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// UpstreamTSIG - TSIG key the queries for a zone and its subdomains to the
+// plain DNS upstreams are signed with, e.g. to forward the queries for an
+// internal zone to the server that only answers the signed ones.  The
+// responses must be signed with the same key.
+type UpstreamTSIG struct {
+	// Zone is the zone the key applies to along with its subdomains.  "."
+	// applies to all domains.
+	Zone string
+
+	// Upstream is the address of the upstream as it's returned by
+	// Upstream.Address, e.g. "10.0.0.2:53" or "tcp://10.0.0.2:53".  If empty,
+	// the queries to all the plain DNS upstreams are signed.
+	Upstream string
+
+	// Key is the TSIG key
+	Key *TSIGKey
+}
+
+// ParseUpstreamTSIG parses the key in the "zone[@upstream]=key" form, where
+// key is in the form of ParseTSIGKey, e.g.
+// "internal.example.com@10.0.0.2:53=hmac-sha256:internal:c2VjcmV0"
+func ParseUpstreamTSIG(s string) (t UpstreamTSIG, err error) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return t, fmt.Errorf("invalid upstream TSIG %q, expected zone[@upstream]=key", s)
+	}
+
+	t.Zone = s[:i]
+	if j := strings.IndexByte(t.Zone, '@'); j >= 0 {
+		t.Zone, t.Upstream = t.Zone[:j], t.Zone[j+1:]
+	}
+
+	t.Key, err = ParseTSIGKey(s[i+1:])
+	if err != nil {
+		return t, err
+	}
+
+	return t, t.validate()
+}
+
+// validate returns an error if the key can't be used
+func (t *UpstreamTSIG) validate() error {
+	if _, ok := dns.IsDomainName(t.Zone); !ok || t.Zone == "" {
+		return fmt.Errorf("invalid upstream TSIG zone %q", t.Zone)
+	}
+
+	if strings.Contains(t.Upstream, "://") && !strings.HasPrefix(t.Upstream, "tcp://") {
+		return fmt.Errorf("TSIG isn't supported for upstream %s, only plain DNS is", t.Upstream)
+	}
+
+	if t.Key == nil {
+		return fmt.Errorf("no TSIG key for zone %s", t.Zone)
+	}
+
+	return t.Key.validate()
+}
+
+// findUpstreamTSIG returns the key for the most specific zone that matches
+// host and the upstream or nil if there is none
+func (p *Proxy) findUpstreamTSIG(host string, u upstream.Upstream) *UpstreamTSIG {
+	if len(p.UpstreamTSIG) == 0 || !isPlainUpstream(u) {
+		return nil
+	}
+
+	host = strings.ToLower(dns.Fqdn(host))
+	addr := u.Address()
+
+	var res *UpstreamTSIG
+	resLen := -1
+	for i := range p.UpstreamTSIG {
+		t := &p.UpstreamTSIG[i]
+		if t.Upstream != "" && t.Upstream != addr {
+			continue
+		}
+
+		zone := strings.ToLower(dns.Fqdn(t.Zone))
+		if zone != "." && host != zone && !strings.HasSuffix(host, "."+zone) {
+			continue
+		}
+
+		if len(zone) > resLen {
+			res = t
+			resLen = len(zone)
+		}
+	}
+
+	return res
+}
+
+// timeoutUpstream is the upstream that has its own timeout, e.g. the plain
+// DNS one
+type timeoutUpstream interface {
+	Timeout() time.Duration
+}
+
+// tsigUpstream signs the queries to the plain DNS upstream and verifies the
+// responses
+type tsigUpstream struct {
+	upstream.Upstream
+
+	key *TSIGKey
+}
+
+// Exchange implements the upstream.Upstream interface for *tsigUpstream
+func (u *tsigUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	addr := u.Address()
+	tcp := strings.HasPrefix(addr, "tcp://")
+
+	timeout := defaultTimeout
+	if t, ok := u.Upstream.(timeoutUpstream); ok {
+		timeout = t.Timeout()
+	}
+
+	res, err := u.key.exchange(m, strings.TrimPrefix(addr, "tcp://"), timeout, tcp)
+	if err != nil {
+		return nil, errorx.Decorate(err, "TSIG exchange with %s failed", addr)
+	}
+
+	return res, nil
+}
+
+// withUpstreamTSIG returns the upstream that signs the request to u if there
+// is a key for them and u otherwise
+func (p *Proxy) withUpstreamTSIG(u upstream.Upstream, req *dns.Msg) upstream.Upstream {
+	if len(req.Question) == 0 {
+		return u
+	}
+
+	t := p.findUpstreamTSIG(req.Question[0].Name, u)
+	if t == nil {
+		return u
+	}
+
+	return &tsigUpstream{Upstream: u, key: t.Key}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUpstreamTSIG(t *testing.T) {
+	u, err := ParseUpstreamTSIG("internal.example.com@10.0.0.2:53=hmac-sha512:internal:c2VjcmV0")
+	assert.Nil(t, err)
+	assert.Equal(t, "internal.example.com", u.Zone)
+	assert.Equal(t, "10.0.0.2:53", u.Upstream)
+	assert.Equal(t, &TSIGKey{Name: "internal", Algorithm: dns.HmacSHA512, Secret: "c2VjcmV0"}, u.Key)
+
+	u, err = ParseUpstreamTSIG(".=internal:c2VjcmV0")
+	assert.Nil(t, err)
+	assert.Equal(t, ".", u.Zone)
+	assert.Empty(t, u.Upstream)
+
+	for _, s := range []string{
+		"internal.example.com",
+		"=internal:c2VjcmV0",
+		"internal.example.com=internal",
+		"internal.example.com@tls://10.0.0.2=internal:c2VjcmV0",
+	} {
+		_, err = ParseUpstreamTSIG(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestFindUpstreamTSIG(t *testing.T) {
+	key := &TSIGKey{Name: "key", Secret: "c2VjcmV0"}
+	p := &Proxy{}
+	p.UpstreamTSIG = []UpstreamTSIG{
+		{Zone: "example.com", Key: key},
+		{Zone: "internal.example.com", Upstream: "10.0.0.2:53", Key: key},
+	}
+
+	plain, err := upstream.AddressToUpstream("10.0.0.2", upstream.Options{})
+	assert.Nil(t, err)
+	other, err := upstream.AddressToUpstream("tcp://10.0.0.3", upstream.Options{})
+	assert.Nil(t, err)
+	encrypted, err := upstream.AddressToUpstream("tls://10.0.0.2", upstream.Options{})
+	assert.Nil(t, err)
+
+	assert.Equal(t, &p.UpstreamTSIG[1], p.findUpstreamTSIG("host.internal.example.com", plain))
+	assert.Equal(t, &p.UpstreamTSIG[0], p.findUpstreamTSIG("host.internal.example.com", other))
+	assert.Equal(t, &p.UpstreamTSIG[0], p.findUpstreamTSIG("EXAMPLE.com.", plain))
+	assert.Nil(t, p.findUpstreamTSIG("example.org", plain))
+	assert.Nil(t, p.findUpstreamTSIG("example.com", encrypted))
+}
+
+func TestUpstreamTSIG(t *testing.T) {
+	key, err := ParseTSIGKey("internal:c2VjcmV0c2VjcmV0")
+	assert.Nil(t, err)
+
+	addr, stop := startTestPrimary(t, key.secrets())
+	defer stop()
+
+	dnsProxy := createTestProxy(t, nil)
+	config, err := ParseUpstreamsConfig([]string{upstreamAddr, "[/internal.example.com/]" + addr}, nil, time.Second)
+	assert.Nil(t, err)
+	dnsProxy.UpstreamConfig = &config
+	dnsProxy.UpstreamTSIG = []UpstreamTSIG{{Zone: "internal.example.com", Upstream: addr, Key: key}}
+	assert.Nil(t, dnsProxy.Start())
+	defer func() { assert.Nil(t, dnsProxy.Stop()) }()
+
+	c := &dns.Client{Timeout: time.Second}
+	proxyAddr := dnsProxy.Addr(ProtoUDP).String()
+
+	res, _, err := c.Exchange(createHostTestMessage("host.internal.example.com"), proxyAddr)
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+		assert.Nil(t, res.IsTsig())
+	}
+
+	// The unsigned queries are refused by the server
+	u, err := upstream.AddressToUpstream(addr, upstream.Options{Timeout: time.Second})
+	assert.Nil(t, err)
+	res, err = u.Exchange(createHostTestMessage("host.internal.example.com"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeNotAuth, res.Rcode)
+	}
+}
@@ -15,6 +15,30 @@ import (
 type UpstreamConfig struct {
 	Upstreams               []upstream.Upstream            // list of default upstreams
 	DomainReservedUpstreams map[string][]upstream.Upstream // map of reserved domains and lists of corresponding upstreams
+
+	// Fallbacks are queried in parallel only after all the upstreams for the
+	// request have failed or timed out, e.g. a plain DNS resolver on the LAN
+	// behind the encrypted upstreams.  If set, they replace
+	// Config.Fallbacks.
+	Fallbacks []upstream.Upstream
+	// FallbackTimeout, if set, is the time budget of the whole exchange with
+	// the fallbacks, including the retries.  Otherwise, the attempts are
+	// limited by Config.ParallelTimeout.
+	FallbackTimeout time.Duration
+}
+
+// all returns the default, the domain-specific, and the fallback upstreams
+func (uc *UpstreamConfig) all() []upstream.Upstream {
+	if uc == nil {
+		return nil
+	}
+
+	res := append([]upstream.Upstream{}, uc.Upstreams...)
+	for _, upstreams := range uc.DomainReservedUpstreams {
+		res = append(res, upstreams...)
+	}
+
+	return append(res, uc.Fallbacks...)
 }
 
 // ParseUpstreamsConfig returns UpstreamConfig and error if upstreams configuration is invalid
@@ -26,6 +50,18 @@ type UpstreamConfig struct {
 // will send queries for *.host.com to 1.2.3.4, except for *.www.host.com, which will go to 2.3.4.5 and *.maps.host.com,
 // which will go to default server 3.4.5.6 with all other domains
 func ParseUpstreamsConfig(upstreamConfig, bootstrapDNS []string, timeout time.Duration) (UpstreamConfig, error) {
+	return ParseUpstreamsConfigWithOptions(upstreamConfig, upstream.Options{Bootstrap: bootstrapDNS, Timeout: timeout}, nil)
+}
+
+// UpstreamOptionsFunc adjusts the options of the upstream with the address
+// as it's written in the configuration
+type UpstreamOptionsFunc func(addr string, opts *upstream.Options)
+
+// ParseUpstreamsConfigWithOptions is like ParseUpstreamsConfig, but creates
+// the upstreams with opts.  If optsFunc isn't nil, it adjusts the copy of opts
+// for every upstream.
+func ParseUpstreamsConfigWithOptions(upstreamConfig []string, opts upstream.Options, optsFunc UpstreamOptionsFunc) (UpstreamConfig, error) {
+	bootstrapDNS := opts.Bootstrap
 	var upstreams []upstream.Upstream
 	domainReservedUpstreams := map[string][]upstream.Upstream{}
 
@@ -51,7 +87,11 @@ func ParseUpstreamsConfig(upstreamConfig, bootstrapDNS []string, timeout time.Du
 			dnsUpstream, ok := upstreamsIndex[u]
 			if !ok {
 				// create an upstream
-				dnsUpstream, err = upstream.AddressToUpstream(u, upstream.Options{Bootstrap: bootstrapDNS, Timeout: timeout})
+				uOpts := opts
+				if optsFunc != nil {
+					optsFunc(u, &uOpts)
+				}
+				dnsUpstream, err = upstream.AddressToUpstream(u, uOpts)
 				if err != nil {
 					return UpstreamConfig{}, fmt.Errorf("cannot prepare the upstream %s (%s): %s", l, bootstrapDNS, err)
 				}
@@ -1,9 +1,12 @@
 package proxy
 
 import (
+	"net/url"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -36,6 +39,37 @@ func TestGetUpstreamsForDomainWithoutDuplicates(t *testing.T) {
 	assert.True(t, u1 == u2)
 }
 
+// customUpstream is an upstream of a custom scheme
+type customUpstream struct {
+	address string
+}
+
+// Exchange implements the upstream.Upstream interface for *customUpstream
+func (u *customUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	res := &dns.Msg{}
+	res.SetRcode(m, dns.RcodeRefused)
+	return res, nil
+}
+
+// Address implements the upstream.Upstream interface for *customUpstream
+func (u *customUpstream) Address() string {
+	return u.address
+}
+
+func TestCustomUpstreamsForDomain(t *testing.T) {
+	err := upstream.Register("custom", func(u *url.URL, _ upstream.Options) (upstream.Upstream, error) {
+		return &customUpstream{address: u.String()}, nil
+	})
+	assert.Nil(t, err)
+
+	upstreams := []string{"1.1.1.1", "[/service.example/]custom://backend"}
+	config, err := ParseUpstreamsConfig(upstreams, []string{}, 1*time.Second)
+	assert.Nil(t, err)
+
+	assertUpstreamsForDomain(t, config, 1, "www.service.example.", []string{"custom://backend"})
+	assertUpstreamsForDomain(t, config, 1, "example.org.", []string{"1.1.1.1:53"})
+}
+
 // assertUpstreamsForDomain checks count and addresses of the specified domain upstreams
 func assertUpstreamsForDomain(t *testing.T, config UpstreamConfig, count int, domain string, address []string) {
 	u := config.getUpstreamsForDomain(domain)
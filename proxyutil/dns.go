@@ -12,8 +12,137 @@ import (
 var (
 	// ErrTooLarge - DNS message is larger than 64kb
 	ErrTooLarge = errors.New("DNS message is too large")
+	// ErrBadCounts - DNS message header declares more records than it may
+	// contain
+	ErrBadCounts = errors.New("DNS message records count exceeds its size")
+	// ErrBadName - DNS message contains a name with a bad label or a
+	// compression pointer that may cause a loop
+	ErrBadName = errors.New("bad name in DNS message")
 )
 
+const (
+	// dnsHeaderSize is the size of the DNS message header
+	dnsHeaderSize = 12
+	// minQuestionSize is the size of a question with the root name
+	minQuestionSize = 1 + 4
+	// minRRSize is the size of a resource record with the root name and
+	// empty rdata
+	minRRSize = 1 + 10
+	// maxNamePointers is the maximum number of compression pointers followed
+	// in a single name.  Compressors point straight to the earlier name, so
+	// real messages never need more than a few.
+	maxNamePointers = 16
+)
+
+// UnpackMsg checks the names in the wire format message using CheckMsgNames
+// and unpacks it.  It must be used instead of dns.Msg.Unpack for the
+// messages received from the clients and the upstreams.
+func UnpackMsg(b []byte) (*dns.Msg, error) {
+	err := CheckMsgNames(b)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &dns.Msg{}
+	err = msg.Unpack(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// CheckMsgNames walks through the question names and the records owner names
+// of the wire format message and checks that the records counts fit the
+// message size and that every compression pointer points strictly before the
+// previous one, so that following them always terminates quickly.  The names
+// in rdata are checked by dns.Msg.Unpack.
+func CheckMsgNames(b []byte) error {
+	if len(b) < dnsHeaderSize {
+		return dns.ErrShortRead
+	}
+
+	qdCount := int(binary.BigEndian.Uint16(b[4:]))
+	rrCount := int(binary.BigEndian.Uint16(b[6:])) +
+		int(binary.BigEndian.Uint16(b[8:])) +
+		int(binary.BigEndian.Uint16(b[10:]))
+	if qdCount*minQuestionSize+rrCount*minRRSize > len(b)-dnsHeaderSize {
+		return ErrBadCounts
+	}
+
+	off := dnsHeaderSize
+	var err error
+	for i := 0; i < qdCount; i++ {
+		off, err = skipName(b, off)
+		if err != nil {
+			return err
+		}
+		// qtype and qclass
+		off += 4
+	}
+
+	for i := 0; i < rrCount; i++ {
+		off, err = skipName(b, off)
+		if err != nil {
+			return err
+		}
+		// type, class, TTL, and rdlength
+		if off+10 > len(b) {
+			return dns.ErrShortRead
+		}
+		off += 10 + int(binary.BigEndian.Uint16(b[off+8:]))
+	}
+
+	if off > len(b) {
+		return dns.ErrShortRead
+	}
+
+	return nil
+}
+
+// skipName checks the name that starts at off and returns the offset right
+// after it
+func skipName(b []byte, off int) (int, error) {
+	end := -1
+	ptrs := 0
+	lowest := off
+	for {
+		if off >= len(b) {
+			return 0, dns.ErrShortRead
+		}
+
+		c := int(b[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				if end < 0 {
+					end = off + 1
+				}
+				return end, nil
+			}
+			off += c + 1
+		case 0xC0:
+			if off+1 >= len(b) {
+				return 0, dns.ErrShortRead
+			}
+			if end < 0 {
+				end = off + 2
+			}
+
+			ptrs++
+			ptr := (c&0x3F)<<8 | int(b[off+1])
+			if ptrs > maxNamePointers || ptr >= lowest {
+				return 0, ErrBadName
+			}
+			lowest = ptr
+			off = ptr
+		default:
+			// Extended label types are obsolete
+			return 0, ErrBadName
+		}
+	}
+}
+
 // DNSSize returns if buffer size *advertised* in the requests OPT record.
 // Or when the request was over TCP, we return the maximum allowed size of 64K.
 func DNSSize(proto string, r *dns.Msg) int {
@@ -0,0 +1,119 @@
+package proxyutil
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestHeader returns a DNS message header with the specified counts
+func newTestHeader(qdCount, anCount uint16) []byte {
+	b := make([]byte, dnsHeaderSize)
+	binary.BigEndian.PutUint16(b[0:], 0x1234)
+	binary.BigEndian.PutUint16(b[4:], qdCount)
+	binary.BigEndian.PutUint16(b[6:], anCount)
+	return b
+}
+
+func TestUnpackMsg(t *testing.T) {
+	m := &dns.Msg{}
+	m.SetQuestion("www.example.org.", dns.TypeA)
+	m.Response = true
+	for _, rr := range []string{
+		"www.example.org. 300 IN CNAME cdn.example.org.",
+		"cdn.example.org. 300 IN CNAME edge.cdn.example.org.",
+		"edge.cdn.example.org. 300 IN A 1.2.3.4",
+	} {
+		r, err := dns.NewRR(rr)
+		assert.Nil(t, err)
+		m.Answer = append(m.Answer, r)
+	}
+	m.Compress = true
+	b, err := m.Pack()
+	assert.Nil(t, err)
+
+	msg, err := UnpackMsg(b)
+	assert.Nil(t, err)
+	assert.Len(t, msg.Answer, len(m.Answer))
+	for i := range m.Answer {
+		assert.Equal(t, m.Answer[i].String(), msg.Answer[i].String())
+	}
+}
+
+func TestUnpackMsgBombs(t *testing.T) {
+	// A single RR with a compressed owner name and empty rdata
+	rr := func(ptr int) []byte {
+		return []byte{0xC0 | byte(ptr>>8), byte(ptr), 0, 1, 0, 1, 0, 0, 0, 0, 0, 0}
+	}
+
+	// Every owner name points to the previous one, so the last one
+	// requires following all the pointers
+	chain := newTestHeader(1, maxNamePointers+1)
+	chain = append(chain, 1, 'a', 0, 0, 1, 0, 1)
+	prev := dnsHeaderSize
+	for i := 0; i < maxNamePointers+1; i++ {
+		off := len(chain)
+		chain = append(chain, rr(prev)...)
+		prev = off
+	}
+
+	// An upstream reply to the "a" question whose answer's owner name points
+	// to itself
+	reply := append(newTestHeader(1, 1), 1, 'a', 0, 0, 1, 0, 1)
+	reply[2] |= 0x80
+	reply = append(reply, rr(len(reply))...)
+
+	testCases := []struct {
+		name string
+		msg  []byte
+		err  error
+	}{{
+		name: "self_pointer",
+		msg:  append(newTestHeader(1, 0), 0xC0, dnsHeaderSize, 0, 1, 0, 1),
+		err:  ErrBadName,
+	}, {
+		name: "loop",
+		msg:  append(newTestHeader(1, 0), 1, 'a', 0xC0, dnsHeaderSize, 0, 1, 0, 1),
+		err:  ErrBadName,
+	}, {
+		name: "forward_pointer",
+		msg:  append(newTestHeader(1, 0), 0xC0, dnsHeaderSize+2, 1, 'a', 0, 0, 1, 0, 1),
+		err:  ErrBadName,
+	}, {
+		name: "pointers_chain",
+		msg:  chain,
+		err:  ErrBadName,
+	}, {
+		name: "reply_self_pointer",
+		msg:  reply,
+		err:  ErrBadName,
+	}, {
+		name: "extended_label",
+		msg:  append(newTestHeader(1, 0), 0x40, 0, 0, 1, 0, 1),
+		err:  ErrBadName,
+	}, {
+		name: "counts",
+		msg:  append(newTestHeader(1, 0xFFFF), 0, 0, 1, 0, 1),
+		err:  ErrBadCounts,
+	}, {
+		name: "short",
+		msg:  append(newTestHeader(1, 0), 10, 'a', 'b', 'c', 'd', 'e'),
+		err:  dns.ErrShortRead,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := UnpackMsg(tc.msg)
+			assert.Nil(t, msg)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+
+	// The chain one pointer shorter is fine
+	binary.BigEndian.PutUint16(chain[6:], maxNamePointers)
+	chain = chain[:len(chain)-12]
+	_, err := UnpackMsg(chain)
+	assert.Nil(t, err)
+}
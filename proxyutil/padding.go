@@ -0,0 +1,69 @@
+package proxyutil
+
+import (
+	"github.com/miekg/dns"
+)
+
+const (
+	// QueryPaddingBlockSize is the block size the queries are padded to as
+	// recommended by RFC 8467
+	QueryPaddingBlockSize = 128
+	// ResponsePaddingBlockSize is the block size the responses are padded
+	// to as recommended by RFC 8467
+	ResponsePaddingBlockSize = 468
+
+	// paddingOptionHeaderSize is the size of the option code and length
+	paddingOptionHeaderSize = 4
+)
+
+// HasPadding returns true if the message contains the EDNS(0) padding option
+func HasPadding(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RemovePadding removes the EDNS(0) padding option from the message
+func RemovePadding(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// AddPadding pads the message with the EDNS(0) padding option so that its
+// wire format size is a multiple of blockSize.  The existing padding is
+// replaced.  The message must contain an OPT record, otherwise nothing is
+// done.
+func AddPadding(m *dns.Msg, blockSize int) {
+	RemovePadding(m)
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	n := m.Len() + paddingOptionHeaderSize
+	padding := (blockSize - n%blockSize) % blockSize
+	if n+padding > dns.MaxMsgSize {
+		return
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padding)})
+}
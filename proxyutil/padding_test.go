@@ -0,0 +1,44 @@
+package proxyutil
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddPadding(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		for _, blockSize := range []int{QueryPaddingBlockSize, ResponsePaddingBlockSize} {
+			m := &dns.Msg{}
+			m.SetQuestion("www.example.org.", dns.TypeA)
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			m.Compress = compress
+
+			AddPadding(m, blockSize)
+			assert.True(t, HasPadding(m))
+			b, err := m.Pack()
+			assert.Nil(t, err)
+			assert.Zero(t, len(b)%blockSize)
+
+			// The existing padding is replaced
+			m.SetQuestion("a.much.longer.name.example.org.", dns.TypeA)
+			AddPadding(m, blockSize)
+			assert.Len(t, m.IsEdns0().Option, 1)
+			b, err = m.Pack()
+			assert.Nil(t, err)
+			assert.Zero(t, len(b)%blockSize)
+
+			RemovePadding(m)
+			assert.False(t, HasPadding(m))
+			assert.NotNil(t, m.IsEdns0())
+		}
+	}
+
+	// Nothing is done without an OPT record
+	m := &dns.Msg{}
+	m.SetQuestion("www.example.org.", dns.TypeA)
+	AddPadding(m, QueryPaddingBlockSize)
+	assert.False(t, HasPadding(m))
+	assert.Nil(t, m.IsEdns0())
+}
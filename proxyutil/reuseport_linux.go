@@ -0,0 +1,35 @@
+package proxyutil
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ListenUDPReusePort creates a UDP socket with SO_REUSEPORT, so that several
+// sockets may be bound to the same address and the kernel distributes the
+// incoming packets between them
+func ListenUDPReusePort(addr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if cerr != nil {
+				return cerr
+			}
+
+			return err
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
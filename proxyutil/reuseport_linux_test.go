@@ -0,0 +1,27 @@
+package proxyutil
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenUDPReusePort(t *testing.T) {
+	conn, err := ListenUDPReusePort(&net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	assert.NotZero(t, addr.Port)
+
+	// Another socket may be bound to the same address
+	conn2, err := ListenUDPReusePort(addr)
+	assert.Nil(t, err)
+	defer conn2.Close()
+	assert.Equal(t, addr.String(), conn2.LocalAddr().String())
+
+	// But not without SO_REUSEPORT
+	_, err = net.ListenUDP("udp", addr)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package proxyutil
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// ListenUDPReusePort isn't supported on this platform, as SO_REUSEPORT
+// either doesn't exist or doesn't distribute the packets between the sockets
+func ListenUDPReusePort(_ *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, fmt.Errorf("SO_REUSEPORT isn't supported on %s", runtime.GOOS)
+}
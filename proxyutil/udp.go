@@ -0,0 +1,17 @@
+package proxyutil
+
+import "net"
+
+// UDPPacket is a packet read or written with UDPBatch
+type UDPPacket struct {
+	// Data is the contents of the packet.  Before a read, it's the buffer
+	// the packet is read into, after it, it's the read prefix of the buffer.
+	Data []byte
+	// RemoteAddr is the address the packet is received from or sent to
+	RemoteAddr *net.UDPAddr
+	// LocalIP is the local IP address the packet is received on or sent
+	// from.  It may be nil.
+	LocalIP net.IP
+	// Truncated is true if the read packet didn't fit in the buffer
+	Truncated bool
+}
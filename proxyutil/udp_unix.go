@@ -4,7 +4,10 @@ package proxyutil
 
 import (
 	"fmt"
+	"io"
 	"net"
+	"runtime"
+	"syscall"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
@@ -54,6 +57,121 @@ func UDPWrite(bytes []byte, conn *net.UDPConn, remoteAddr *net.UDPAddr, localIP
 	return n, err
 }
 
+// UDPBatch reads and writes the UDP packets in batches: with a single recvmmsg
+// or sendmmsg call on Linux and one by one on the other platforms.  It isn't
+// safe for concurrent use.
+type UDPBatch struct {
+	conn    *net.UDPConn
+	batched *ipv4.PacketConn
+	msgs    []ipv4.Message
+	oob     [][]byte // OOB buffers of msgs for reading
+}
+
+// NewUDPBatch returns a new UDPBatch that reads and writes up to size packets
+// at once
+func NewUDPBatch(c *net.UDPConn, size int) *UDPBatch {
+	b := &UDPBatch{
+		conn:    c,
+		batched: ipv4.NewPacketConn(c),
+		msgs:    make([]ipv4.Message, size),
+		oob:     make([][]byte, size),
+	}
+
+	oobSize := UDPGetOOBSize()
+	for i := range b.msgs {
+		b.msgs[i].Buffers = make([][]byte, 1)
+		b.oob[i] = make([]byte, oobSize)
+	}
+
+	return b
+}
+
+// Read reads up to the batch size packets into the buffers of pkts and returns
+// the number of the read packets
+func (b *UDPBatch) Read(pkts []UDPPacket) (int, error) {
+	if len(pkts) > len(b.msgs) {
+		pkts = pkts[:len(b.msgs)]
+	}
+
+	msgs := b.msgs[:len(pkts)]
+	for i := range msgs {
+		msgs[i].Buffers[0] = pkts[i].Data
+		msgs[i].OOB = b.oob[i]
+	}
+
+	n, err := b.batched.ReadBatch(msgs, 0)
+	if n < 0 {
+		n = 0
+	}
+
+	for i := 0; i < n; i++ {
+		m := &msgs[i]
+		pkt := &pkts[i]
+		pkt.Data = pkt.Data[:m.N]
+		pkt.RemoteAddr, _ = m.Addr.(*net.UDPAddr)
+		pkt.LocalIP = udpGetDstFromOOB(m.OOB[:m.NN])
+		pkt.Truncated = m.Flags&syscall.MSG_TRUNC != 0
+	}
+
+	// Don't keep the buffers that now belong to the caller
+	for i := range msgs {
+		msgs[i].Buffers[0] = nil
+		msgs[i].Addr = nil
+	}
+
+	return n, err
+}
+
+// Write writes the packets and returns the number of the written ones.  If
+// it fails to write a packet, it returns the error and the number of the
+// packets written before it.
+func (b *UDPBatch) Write(pkts []UDPPacket) (int, error) {
+	// The packets to the IPv4-mapped addresses are passed to the kernel
+	// with the IPv4 addresses, which only Linux accepts for IPv6 sockets
+	if runtime.GOOS != "linux" {
+		for i, pkt := range pkts {
+			_, err := UDPWrite(pkt.Data, b.conn, pkt.RemoteAddr, pkt.LocalIP)
+			if err != nil {
+				return i, err
+			}
+		}
+
+		return len(pkts), nil
+	}
+
+	written := 0
+	for written < len(pkts) {
+		msgs := b.msgs
+		if len(pkts)-written < len(msgs) {
+			msgs = msgs[:len(pkts)-written]
+		}
+
+		for i := range msgs {
+			pkt := &pkts[written+i]
+			msgs[i].Buffers[0] = pkt.Data
+			msgs[i].OOB = udpMakeOOBWithSrc(pkt.LocalIP)
+			msgs[i].Addr = pkt.RemoteAddr
+		}
+
+		n, err := b.batched.WriteBatch(msgs, 0)
+		for i := range msgs {
+			msgs[i].Buffers[0] = nil
+			msgs[i].Addr = nil
+		}
+
+		if n > 0 {
+			written += n
+		}
+		if err != nil {
+			return written, err
+		} else if n <= 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+
+	return written, nil
+}
+
 // udpGetDstFromOOB - get destination IP from OOB data
 func udpGetDstFromOOB(oob []byte) net.IP {
 	cm6 := &ipv6.ControlMessage{}
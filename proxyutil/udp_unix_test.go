@@ -0,0 +1,74 @@
+// +build aix darwin dragonfly linux netbsd openbsd solaris freebsd
+
+package proxyutil
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPBatch(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Nil(t, UDPSetOptions(conn))
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	assert.Nil(t, err)
+	defer client.Close()
+
+	sent := [][]byte{[]byte("first"), make([]byte, 1024), []byte("third")}
+	for _, data := range sent {
+		_, err = client.Write(data)
+		assert.Nil(t, err)
+	}
+
+	b := NewUDPBatch(conn, 2)
+	var read []UDPPacket
+	assert.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	for len(read) < len(sent) {
+		pkts := make([]UDPPacket, 4)
+		for i := range pkts {
+			pkts[i].Data = make([]byte, 512)
+		}
+
+		var n int
+		n, err = b.Read(pkts)
+		if !assert.Nil(t, err) {
+			return
+		}
+		// No more than the batch size is read at once
+		assert.True(t, n > 0 && n <= 2)
+		read = append(read, pkts[:n]...)
+	}
+
+	for i, pkt := range read {
+		assert.Equal(t, client.LocalAddr().String(), pkt.RemoteAddr.String())
+		assert.True(t, pkt.LocalIP.Equal(net.IP{127, 0, 0, 1}), pkt.LocalIP)
+		if i == 1 {
+			assert.True(t, pkt.Truncated)
+			assert.Len(t, pkt.Data, 512)
+		} else {
+			assert.False(t, pkt.Truncated)
+			assert.Equal(t, sent[i], pkt.Data)
+		}
+	}
+
+	for i := range read {
+		read[i].Data = []byte{byte(i)}
+	}
+	n, err := b.Write(read)
+	assert.Nil(t, err)
+	assert.Equal(t, len(read), n)
+
+	assert.Nil(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 16)
+	for i := range read {
+		n, err = client.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte{byte(i)}, buf[:n])
+	}
+}
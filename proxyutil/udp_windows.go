@@ -1,6 +1,10 @@
 package proxyutil
 
-import "net"
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
 
 // UDPGetOOBSize - get max. size of received OOB data
 // Does nothing on Windows
@@ -28,3 +32,51 @@ func UDPRead(c *net.UDPConn, buf []byte, _ int) (int, net.IP, *net.UDPAddr, erro
 func UDPWrite(bytes []byte, conn *net.UDPConn, remoteAddr *net.UDPAddr, _ net.IP) (int, error) {
 	return conn.WriteTo(bytes, remoteAddr)
 }
+
+// UDPBatch reads and writes the UDP packets one by one on Windows.  It isn't
+// safe for concurrent use.
+type UDPBatch struct {
+	conn *net.UDPConn
+	buf  []byte // buffer large enough for any packet
+}
+
+// NewUDPBatch returns a new UDPBatch
+func NewUDPBatch(c *net.UDPConn, _ int) *UDPBatch {
+	return &UDPBatch{conn: c}
+}
+
+// Read reads a packet into the buffer of pkts[0] and returns 1 if it's read.
+// The packet is read into a larger buffer first, since Windows fails to read
+// the packets that don't fit in it.
+func (b *UDPBatch) Read(pkts []UDPPacket) (int, error) {
+	if b.buf == nil {
+		b.buf = make([]byte, dns.MaxMsgSize)
+	}
+
+	n, addr, err := b.conn.ReadFromUDP(b.buf)
+	if n <= 0 {
+		return 0, err
+	}
+
+	pkt := &pkts[0]
+	pkt.Truncated = n > len(pkt.Data)
+	pkt.Data = pkt.Data[:copy(pkt.Data, b.buf[:n])]
+	pkt.RemoteAddr = addr
+	pkt.LocalIP = nil
+
+	return 1, err
+}
+
+// Write writes the packets one by one and returns the number of the written
+// ones.  If it fails to write a packet, it returns the error and the number
+// of the packets written before it.
+func (b *UDPBatch) Write(pkts []UDPPacket) (int, error) {
+	for i, pkt := range pkts {
+		_, err := b.conn.WriteTo(pkt.Data, pkt.RemoteAddr)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(pkts), nil
+}
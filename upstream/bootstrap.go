@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -30,6 +31,22 @@ var RootCAs *x509.CertPool
 // nolint
 var CipherSuites []uint16
 
+// sessionCacheSize is the number of the TLS session tickets kept per upstream.
+// The tickets are cached by the server name, but the servers may issue
+// several tickets per connection.
+const sessionCacheSize = 16
+
+const (
+	// minBootstrapTTL is the min time the resolved addresses of an upstream
+	// hostname are cached, it's also the interval between the failed
+	// re-resolutions
+	minBootstrapTTL = 10 * time.Second
+
+	// defaultBootstrapTTL is the time the resolved addresses are cached if
+	// the bootstrap resolver doesn't return the TTL, e.g. the system one
+	defaultBootstrapTTL = 5 * time.Minute
+)
+
 type bootstrapper struct {
 	address            string        // in form of "tls://one.one.one.one:853"
 	resolvers          []*Resolver   // list of Resolvers to use to resolve hostname, if necessary
@@ -38,6 +55,24 @@ type bootstrapper struct {
 
 	dialContext    dialHandler // specifies the dial function for creating unencrypted TCP connections.
 	resolvedConfig *tls.Config
+
+	// resolvedAt and expire are the times the addresses of the hostname
+	// were resolved and expire.  They're zero if the upstream address is an
+	// IP address, it's never re-resolved then.
+	resolvedAt time.Time
+	expire     time.Time
+
+	// refreshing is 1 while the hostname is re-resolved in the background
+	refreshing int32
+
+	// sessionCache keeps the TLS session tickets of the upstream so that
+	// the new connections resume the previous sessions instead of making
+	// full handshakes.  It survives the re-creation of resolvedConfig.
+	sessionCache tls.ClientSessionCache
+
+	// verifyConnection, if not nil, additionally verifies the TLS
+	// connections to the upstream, see TLSChecks
+	verifyConnection func(tls.ConnectionState) error
 	sync.RWMutex
 }
 
@@ -62,6 +97,7 @@ func newBootstrapperResolved(address string, serverIPAddrs []net.IP, timeout tim
 		address:            address,
 		timeout:            timeout,
 		insecureSkipVerify: insecureSkipVerify,
+		sessionCache:       tls.NewLRUClientSessionCache(sessionCacheSize),
 	}
 	b.dialContext = b.createDialContext(resolverAddresses, timeout)
 	b.resolvedConfig = b.createTLSConfig(host)
@@ -96,19 +132,34 @@ func newBootstrapper(address string, bootstrapAddr []string, timeout time.Durati
 		resolvers:          resolvers,
 		timeout:            timeout,
 		insecureSkipVerify: insecureSkipVerify,
+		sessionCache:       tls.NewLRUClientSessionCache(sessionCacheSize),
 	}, nil
 }
 
+// setVerifyConnection sets the function additionally verifying the TLS
+// connections to the upstream
+func (n *bootstrapper) setVerifyConnection(f func(tls.ConnectionState) error) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.verifyConnection = f
+	if n.resolvedConfig != nil {
+		n.resolvedConfig.VerifyConnection = f
+	}
+}
+
 // dialHandler specifies the dial function for creating unencrypted TCP connections.
 type dialHandler func(ctx context.Context, network, addr string) (net.Conn, error)
 
-// will get usable IP address from Address field, and caches the result
+// will get usable IP address from Address field, and caches the result.  The
+// returned dialHandler always dials the current addresses, so it may be kept,
+// see dial.
 func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 	n.RLock()
 	if n.dialContext != nil && n.resolvedConfig != nil { // fast path
-		tlsConfig, dialContext := n.resolvedConfig, n.dialContext
+		tlsConfig := n.resolvedConfig
 		n.RUnlock()
-		return tlsConfig.Clone(), dialContext, nil
+		return tlsConfig.Clone(), n.dial, nil
 	}
 
 	//
@@ -135,7 +186,7 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 
 		n.dialContext = n.createDialContext([]string{resolverAddress}, n.timeout)
 		n.resolvedConfig = n.createTLSConfig(host)
-		return n.resolvedConfig, n.dialContext, nil
+		return n.resolvedConfig, n.dial, nil
 	}
 
 	// Don't lock anymore (we can launch multiple lookup requests at a time)
@@ -147,6 +198,20 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 	// if it's a hostname
 	//
 
+	err = n.resolve(host, port)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n.RLock()
+	defer n.RUnlock()
+
+	return n.resolvedConfig, n.dial, nil
+}
+
+// resolve resolves the hostname of the upstream with the bootstrap resolvers
+// and caches the addresses for their TTL
+func (n *bootstrapper) resolve(host, port string) error {
 	var ctx context.Context
 	if n.timeout > 0 {
 		ctxWithTimeout, cancel := context.WithTimeout(context.TODO(), n.timeout)
@@ -156,9 +221,9 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 		ctx = context.Background()
 	}
 
-	addrs, err := LookupParallel(ctx, n.resolvers, host)
+	addrs, ttl, err := lookupParallelTTL(ctx, n.resolvers, host)
 	if err != nil {
-		return nil, nil, errorx.Decorate(err, "failed to lookup %s", host)
+		return errorx.Decorate(err, "failed to lookup %s", host)
 	}
 
 	resolved := []string{}
@@ -172,15 +237,78 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 
 	if len(resolved) == 0 {
 		// couldn't find any suitable IP address
-		return nil, nil, fmt.Errorf("couldn't find any suitable IP address for host %s", host)
+		return fmt.Errorf("couldn't find any suitable IP address for host %s", host)
 	}
 
 	n.Lock()
 	defer n.Unlock()
 
+	cacheTTL := defaultBootstrapTTL
+	if ttl > 0 {
+		cacheTTL = time.Duration(ttl) * time.Second
+	}
+	if cacheTTL < minBootstrapTTL {
+		cacheTTL = minBootstrapTTL
+	}
+	log.Debug("Resolved %s to %s for %s", host, resolved, cacheTTL)
+
 	n.dialContext = n.createDialContext(resolved, n.timeout)
-	n.resolvedConfig = n.createTLSConfig(host)
-	return n.resolvedConfig, n.dialContext, nil
+	if n.resolvedConfig == nil {
+		n.resolvedConfig = n.createTLSConfig(host)
+	}
+	n.resolvedAt = time.Now()
+	n.expire = n.resolvedAt.Add(cacheTTL)
+
+	return nil
+}
+
+// dial dials the resolved addresses of the upstream.  The expired addresses
+// are still dialed while the hostname is re-resolved in the background.  If
+// none of them can be connected to, they expire, but not sooner than
+// minBootstrapTTL after they were resolved.
+func (n *bootstrapper) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	n.RLock()
+	dialContext, expire := n.dialContext, n.expire
+	n.RUnlock()
+
+	if !expire.IsZero() && time.Now().After(expire) {
+		n.refresh()
+	}
+
+	conn, err := dialContext(ctx, network, addr)
+	if err != nil && !expire.IsZero() {
+		n.Lock()
+		if t := n.resolvedAt.Add(minBootstrapTTL); t.Before(n.expire) {
+			n.expire = t
+		}
+		n.Unlock()
+	}
+
+	return conn, err
+}
+
+// refresh re-resolves the hostname of the upstream in the background unless
+// it's already being done.  If it fails, the old addresses are kept and it's
+// retried after minBootstrapTTL.
+func (n *bootstrapper) refresh() {
+	if !atomic.CompareAndSwapInt32(&n.refreshing, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&n.refreshing, 0)
+
+		// The address has been parsed by get already
+		host, port, _ := getAddressHostPort(n.address)
+		err := n.resolve(host, port)
+		if err != nil {
+			log.Debug("re-resolving %s: %s", n.address, err)
+
+			n.Lock()
+			n.expire = time.Now().Add(minBootstrapTTL)
+			n.Unlock()
+		}
+	}()
 }
 
 // createTLSConfig creates a client TLS config
@@ -191,6 +319,8 @@ func (n *bootstrapper) createTLSConfig(host string) *tls.Config {
 		CipherSuites:       CipherSuites,
 		MinVersion:         tls.VersionTLS12,
 		InsecureSkipVerify: n.insecureSkipVerify,
+		ClientSessionCache: n.sessionCache,
+		VerifyConnection:   n.verifyConnection,
 	}
 
 	tlsConfig.NextProtos = []string{
@@ -200,37 +330,164 @@ func (n *bootstrapper) createTLSConfig(host string) *tls.Config {
 	return tlsConfig
 }
 
-// createDialContext returns dialContext function that tries to establish connection with all given addresses one by one
+// happyEyeballsDelay is the delay after which the addresses of the other
+// family are dialed if the preferred family hasn't connected yet.  This is the
+// recommended "Connection Attempt Delay" from RFC 8305.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// createDialContext returns dialContext function that tries to establish
+// connection with all given addresses one by one.  If there are addresses of
+// both IP families, they are dialed in parallel with a short stagger (see RFC
+// 8305), and the family that connects first is preferred next time.
 func (n *bootstrapper) createDialContext(addresses []string, timeout time.Duration) (dialContext dialHandler) {
 	dialer := &net.Dialer{
 		Timeout: timeout,
 	}
 
-	dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		errs := []error{}
+	ipv4, ipv6 := splitAddressesByFamily(addresses)
+	if len(ipv4) == 0 || len(ipv6) == 0 {
+		return func(ctx context.Context, network, _ string) (net.Conn, error) {
+			// Note that we're using bootstrapped resolverAddress instead of what's passed to the function
+			return dialSequential(ctx, dialer.DialContext, network, addresses)
+		}
+	}
 
-		// Return first connection without error
-		// Note that we're using bootstrapped resolverAddress instead of what's passed to the function
-		for _, resolverAddress := range addresses {
-			log.Tracef("Dialing to %s", resolverAddress)
-			start := time.Now()
-			con, err := dialer.DialContext(ctx, network, resolverAddress)
-			elapsed := time.Since(start) / time.Millisecond
+	// preferIPv6 is 1 if the IPv6 addresses should be dialed first.  At
+	// first, follow the order of the resolved addresses.
+	preferIPv6 := int32(0)
+	if ipv6[0] == addresses[0] {
+		preferIPv6 = 1
+	}
+
+	return func(ctx context.Context, network, _ string) (net.Conn, error) {
+		primary, fallback := ipv4, ipv6
+		primaryIPv6 := atomic.LoadInt32(&preferIPv6) == 1
+		if primaryIPv6 {
+			primary, fallback = ipv6, ipv4
+		}
 
-			if err == nil {
-				log.Tracef("dialer has successfully initialized connection to %s in %d milliseconds", resolverAddress, elapsed)
-				return con, err
+		conn, fallbackWon, err := dialHappyEyeballs(ctx, dialer.DialContext, network, primary, fallback)
+		if err == nil && fallbackWon {
+			log.Tracef("Preferring IPv6 is now %t for %s", !primaryIPv6, n.address)
+			if primaryIPv6 {
+				atomic.StoreInt32(&preferIPv6, 0)
+			} else {
+				atomic.StoreInt32(&preferIPv6, 1)
 			}
-			errs = append(errs, err)
-			log.Tracef("dialer failed to initialize connection to %s, in %d milliseconds, cause: %s", resolverAddress, elapsed, err)
 		}
 
-		if len(errs) == 0 {
-			return nil, fmt.Errorf("all dialers failed to initialize connection")
+		return conn, err
+	}
+}
+
+// splitAddressesByFamily splits the "ip:port" addresses into IPv4 and IPv6
+// ones keeping the order
+func splitAddressesByFamily(addresses []string) (ipv4, ipv6 []string) {
+	for _, addr := range addresses {
+		host, _, err := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		if err == nil && ip != nil && ip.To4() == nil {
+			ipv6 = append(ipv6, addr)
+		} else {
+			ipv4 = append(ipv4, addr)
 		}
-		return nil, errorx.DecorateMany("all dialers failed to initialize connection: ", errs...)
 	}
-	return
+
+	return ipv4, ipv6
+}
+
+// dialResult is the result of dialing a list of addresses
+type dialResult struct {
+	conn     net.Conn
+	err      error
+	fallback bool // true if these are the fallback addresses
+}
+
+// dialHappyEyeballs dials the primary addresses and, after happyEyeballsDelay
+// or as soon as they fail, the fallback ones in parallel.  It returns the
+// first established connection and closes the others.  fallbackWon is true if
+// the connection is to one of the fallback addresses.
+func dialHappyEyeballs(ctx context.Context, dial dialHandler, network string, primary, fallback []string) (conn net.Conn, fallbackWon bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, 2)
+	dialAll := func(addresses []string, isFallback bool) {
+		c, dialErr := dialSequential(ctx, dial, network, addresses)
+		results <- dialResult{conn: c, err: dialErr, fallback: isFallback}
+	}
+
+	go dialAll(primary, false)
+	running := 1
+
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	fallbackStarted := false
+	startFallback := func() {
+		if !fallbackStarted {
+			fallbackStarted = true
+			running++
+			go dialAll(fallback, true)
+		}
+	}
+
+	errs := []error{}
+	for {
+		select {
+		case <-timer.C:
+			log.Tracef("Dialing the other IP family after %s", happyEyeballsDelay)
+			startFallback()
+		case r := <-results:
+			running--
+			if r.err == nil {
+				// Close the connection that may still be established
+				go closeDialResults(results, running)
+				return r.conn, r.fallback, nil
+			}
+
+			errs = append(errs, r.err)
+			if !fallbackStarted {
+				startFallback()
+			} else if running == 0 {
+				return nil, false, errorx.DecorateMany("all dialers failed to initialize connection: ", errs...)
+			}
+		}
+	}
+}
+
+// closeDialResults waits for n more results and closes their connections
+func closeDialResults(results chan dialResult, n int) {
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.conn != nil {
+			_ = r.conn.Close()
+		}
+	}
+}
+
+// dialSequential tries to establish connection with the given addresses one
+// by one and returns the first one without error
+func dialSequential(ctx context.Context, dial dialHandler, network string, addresses []string) (net.Conn, error) {
+	errs := []error{}
+
+	for _, resolverAddress := range addresses {
+		log.Tracef("Dialing to %s", resolverAddress)
+		start := time.Now()
+		con, err := dial(ctx, network, resolverAddress)
+		elapsed := time.Since(start) / time.Millisecond
+
+		if err == nil {
+			log.Tracef("dialer has successfully initialized connection to %s in %d milliseconds", resolverAddress, elapsed)
+			return con, err
+		}
+		errs = append(errs, err)
+		log.Tracef("dialer failed to initialize connection to %s, in %d milliseconds, cause: %s", resolverAddress, elapsed, err)
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("all dialers failed to initialize connection")
+	}
+	return nil, errorx.DecorateMany("all dialers failed to initialize connection: ", errs...)
 }
 
 // getAddressHostPort splits resolver address into host and port
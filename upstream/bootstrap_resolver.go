@@ -133,17 +133,24 @@ func (r *Resolver) resolve(host string, qtype uint16, ch chan *resultError) {
 
 // LookupIPAddr returns result of LookupIPAddr method of Resolver's net.Resolver
 func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := r.lookupIPAddrTTL(ctx, host)
+	return addrs, err
+}
+
+// lookupIPAddrTTL is LookupIPAddr that also returns the min TTL of the
+// answers in seconds, it's 0 if it's unknown, e.g. for the system resolver
+func (r *Resolver) lookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, uint32, error) {
 	if r.resolver != nil {
 		// use system resolver
 		addrs, err := r.resolver.LookupIPAddr(ctx, host)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		return proxyutil.SortIPAddrs(addrs), nil
+		return proxyutil.SortIPAddrs(addrs), 0, nil
 	}
 
 	if r.upstream == nil || len(host) == 0 {
-		return []net.IPAddr{}, nil
+		return []net.IPAddr{}, 0, nil
 	}
 
 	if host[:1] != "." {
@@ -156,6 +163,8 @@ func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr,
 
 	var ipAddrs []net.IPAddr
 	var errs []error
+	var ttl uint32
+	ttlSeen := false
 	n := 0
 wait:
 	for {
@@ -166,6 +175,11 @@ wait:
 				errs = append(errs, re.err)
 			} else {
 				proxyutil.AppendIPAddrs(&ipAddrs, re.resp.Answer)
+				for _, rr := range re.resp.Answer {
+					if h := rr.Header(); !ttlSeen || h.Ttl < ttl {
+						ttl, ttlSeen = h.Ttl, true
+					}
+				}
 			}
 			n++
 			if n == 2 {
@@ -175,8 +189,8 @@ wait:
 	}
 
 	if len(ipAddrs) == 0 && len(errs) != 0 {
-		return []net.IPAddr{}, errs[0]
+		return []net.IPAddr{}, 0, errs[0]
 	}
 
-	return proxyutil.SortIPAddrs(ipAddrs), nil
+	return proxyutil.SortIPAddrs(ipAddrs), ttl, nil
 }
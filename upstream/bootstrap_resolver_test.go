@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -82,3 +83,59 @@ func TestNewResolverIsValid(t *testing.T) {
 	r, err = NewResolver("dns.adguard.com", 0)
 	assert.NotNil(t, err)
 }
+
+// ttlTestUpstream answers with the records of the requested type
+type ttlTestUpstream struct {
+	answers map[uint16][]dns.RR
+}
+
+func (u *ttlTestUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = u.answers[req.Question[0].Qtype]
+
+	return resp, nil
+}
+
+func (u *ttlTestUpstream) Address() string {
+	return ""
+}
+
+func TestLookupIPAddrTTL(t *testing.T) {
+	newRR := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		assert.Nil(t, err)
+
+		return rr
+	}
+
+	testCases := []struct {
+		name    string
+		answers map[uint16][]dns.RR
+		ttl     uint32
+	}{{
+		name: "min",
+		answers: map[uint16][]dns.RR{
+			dns.TypeA:    {newRR("example.org. 300 IN A 192.0.2.1"), newRR("example.org. 60 IN A 192.0.2.2")},
+			dns.TypeAAAA: {newRR("example.org. 120 IN AAAA 2001:db8::1")},
+		},
+		ttl: 60,
+	}, {
+		name: "zero",
+		answers: map[uint16][]dns.RR{
+			dns.TypeA:    {newRR("example.org. 0 IN A 192.0.2.1"), newRR("example.org. 300 IN A 192.0.2.2")},
+			dns.TypeAAAA: {newRR("example.org. 120 IN AAAA 2001:db8::1")},
+		},
+		ttl: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &Resolver{upstream: &ttlTestUpstream{answers: tc.answers}}
+			addrs, ttl, err := r.lookupIPAddrTTL(context.TODO(), "example.org")
+			assert.Nil(t, err)
+			assert.Len(t, addrs, 3)
+			assert.Equal(t, tc.ttl, ttl)
+		})
+	}
+}
@@ -2,8 +2,19 @@ package upstream
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 // See the details here: https://github.com/AdguardTeam/dnsproxy/issues/18
@@ -34,3 +45,224 @@ func TestDialContext(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitAddressesByFamily(t *testing.T) {
+	ipv4, ipv6 := splitAddressesByFamily([]string{"[2001:db8::1]:853", "1.2.3.4:853", "[2001:db8::2]:853", "5.6.7.8:853"})
+	assert.Equal(t, []string{"1.2.3.4:853", "5.6.7.8:853"}, ipv4)
+	assert.Equal(t, []string{"[2001:db8::1]:853", "[2001:db8::2]:853"}, ipv6)
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	const (
+		hangAddr = "hang"
+		failAddr = "fail"
+		okAddr   = "ok"
+	)
+
+	// dial returns a pipe for okAddr, an error for failAddr, and blocks
+	// until the context is canceled for hangAddr
+	var dials int32
+	dial := func(ctx context.Context, _, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		switch addr {
+		case okAddr:
+			c, _ := net.Pipe()
+			return c, nil
+		case hangAddr:
+			<-ctx.Done()
+			return nil, ctx.Err()
+		default:
+			return nil, errors.New("test dial failure")
+		}
+	}
+
+	testCases := []struct {
+		name        string
+		primary     string
+		fallback    string
+		fallbackWon bool
+		dials       int32
+		minElapsed  time.Duration
+		maxElapsed  time.Duration
+		wantErr     bool
+	}{{
+		name:     "primary_ok",
+		primary:  okAddr,
+		fallback: okAddr,
+		dials:    1,
+	}, {
+		name:        "primary_hangs",
+		primary:     hangAddr,
+		fallback:    okAddr,
+		fallbackWon: true,
+		dials:       2,
+		minElapsed:  happyEyeballsDelay,
+	}, {
+		name:        "primary_fails",
+		primary:     failAddr,
+		fallback:    okAddr,
+		fallbackWon: true,
+		dials:       2,
+		maxElapsed:  happyEyeballsDelay,
+	}, {
+		name:     "all_fail",
+		primary:  failAddr,
+		fallback: failAddr,
+		dials:    2,
+		wantErr:  true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&dials, 0)
+			start := time.Now()
+			conn, fallbackWon, err := dialHappyEyeballs(context.Background(), dial, "tcp", []string{tc.primary}, []string{tc.fallback})
+			elapsed := time.Since(start)
+
+			if tc.wantErr {
+				assert.NotNil(t, err)
+				assert.Nil(t, conn)
+			} else {
+				assert.Nil(t, err)
+				assert.NotNil(t, conn)
+				assert.Equal(t, tc.fallbackWon, fallbackWon)
+			}
+			assert.Equal(t, tc.dials, atomic.LoadInt32(&dials))
+			assert.True(t, elapsed >= tc.minElapsed)
+			if tc.maxElapsed > 0 {
+				assert.True(t, elapsed < tc.maxElapsed)
+			}
+		})
+	}
+}
+
+func TestDialContextDualStack(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	// The IPv6 address is unreachable, so the IPv4 one must be used
+	b := bootstrapper{}
+	dialContext := b.createDialContext([]string{"[::1]:1", l.Addr().String()}, time.Second)
+	for i := 0; i < 2; i++ {
+		conn, err := dialContext(context.TODO(), "tcp", "")
+		if assert.Nil(t, err) {
+			assert.Equal(t, l.Addr().String(), conn.RemoteAddr().String())
+			_ = conn.Close()
+		}
+	}
+}
+
+// createTestServerTLSConfig returns the TLS config with a self-signed
+// certificate for the test servers
+func createTestServerTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"example.org"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func TestBootstrapperSessionResumption(t *testing.T) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", createTestServerTLSConfig(t))
+	assert.Nil(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// The session ticket of TLS 1.3 is sent after the handshake
+			// and the client handles it when it reads the data
+			_, _ = conn.Write([]byte{0})
+			_ = conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	b, err := newBootstrapperResolved("tls://example.org:"+port, []net.IP{net.IPv4(127, 0, 0, 1)}, time.Second, true)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		// Every connection gets its own copy of the config
+		tlsConfig, dialContext, err := b.get()
+		assert.Nil(t, err)
+		assert.NotNil(t, tlsConfig.ClientSessionCache)
+
+		conn, err := tlsDial(dialContext, "tcp", tlsConfig)
+		if !assert.Nil(t, err) {
+			return
+		}
+		_, err = conn.Read(make([]byte, 1))
+		assert.Nil(t, err)
+
+		// Only the first connection makes the full handshake
+		assert.Equal(t, i > 0, conn.ConnectionState().DidResume)
+		_ = conn.Close()
+	}
+}
+
+func TestBootstrapperReresolve(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// The upstream has moved from 127.0.0.2 where nothing listens
+	s, addr := startTestDiscoveryServer(t)
+	s.setRecords("dot.example.", "dot.example. 300 IN A 127.0.0.2")
+	b, err := newBootstrapper("tls://dot.example:"+port, []string{addr}, time.Second, false)
+	assert.Nil(t, err)
+
+	start := time.Now()
+	_, dialContext, err := b.get()
+	assert.Nil(t, err)
+	b.RLock()
+	assert.InDelta(t, 300, b.expire.Sub(start).Seconds(), 1)
+	b.RUnlock()
+
+	s.setRecords("dot.example.", "dot.example. 1 IN A 127.0.0.1")
+	_, err = dialContext(context.TODO(), "tcp", "")
+	assert.NotNil(t, err)
+
+	// The failed addresses expire minBootstrapTTL after they were resolved
+	b.Lock()
+	assert.Equal(t, b.resolvedAt.Add(minBootstrapTTL), b.expire)
+	b.resolvedAt = b.resolvedAt.Add(-minBootstrapTTL)
+	b.expire = b.resolvedAt.Add(minBootstrapTTL)
+	b.Unlock()
+
+	// The same dialContext dials the new address after it's re-resolved in
+	// the background.  The TTL is at least minBootstrapTTL.
+	assert.Eventually(t, func() bool {
+		conn, err := dialContext(context.TODO(), "tcp", "")
+		if err != nil {
+			return false
+		}
+		_ = conn.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	b.RLock()
+	assert.InDelta(t, minBootstrapTTL.Seconds(), b.expire.Sub(b.resolvedAt).Seconds(), 0.001)
+	b.RUnlock()
+
+	// The IP addresses aren't re-resolved
+	b, err = newBootstrapper("tls://127.0.0.1:"+port, nil, time.Second, false)
+	assert.Nil(t, err)
+	_, _, err = b.get()
+	assert.Nil(t, err)
+	assert.True(t, b.expire.IsZero())
+}
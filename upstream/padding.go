@@ -0,0 +1,44 @@
+package upstream
+
+import (
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+// padQuery returns a copy of the query padded with the EDNS(0) padding option
+// to hide its size from the observers of the encrypted traffic (RFC 8467).  If
+// the query has no OPT record, it's added, and addedOPT is true.
+func padQuery(m *dns.Msg) (req *dns.Msg, addedOPT bool) {
+	req = m.Copy()
+	if req.IsEdns0() == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		addedOPT = true
+	}
+	proxyutil.AddPadding(req, proxyutil.QueryPaddingBlockSize)
+
+	return req, addedOPT
+}
+
+// unpadReply removes the padding from the reply to a query padded with
+// padQuery.  If the OPT record was added to the query, it's removed from the
+// reply as well, since the client doesn't support EDNS.
+func unpadReply(reply *dns.Msg, addedOPT bool) *dns.Msg {
+	if reply == nil {
+		return nil
+	}
+
+	if !addedOPT {
+		proxyutil.RemovePadding(reply)
+		return reply
+	}
+
+	extra := reply.Extra[:0]
+	for _, rr := range reply.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	reply.Extra = extra
+
+	return reply
+}
@@ -0,0 +1,45 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPadQuery(t *testing.T) {
+	m := &dns.Msg{}
+	m.SetQuestion("www.example.org.", dns.TypeA)
+
+	req, addedOPT := padQuery(m)
+	assert.True(t, addedOPT)
+	assert.True(t, proxyutil.HasPadding(req))
+	assert.Equal(t, m.Id, req.Id)
+	// The original query isn't modified
+	assert.Nil(t, m.IsEdns0())
+
+	reply := &dns.Msg{}
+	reply.SetReply(req)
+	reply.SetEdns0(dns.DefaultMsgSize, false)
+	proxyutil.AddPadding(reply, proxyutil.ResponsePaddingBlockSize)
+	reply = unpadReply(reply, addedOPT)
+	assert.Nil(t, reply.IsEdns0())
+
+	// The client's OPT record is kept
+	m.SetEdns0(1232, true)
+	req, addedOPT = padQuery(m)
+	assert.False(t, addedOPT)
+	assert.True(t, proxyutil.HasPadding(req))
+	assert.False(t, proxyutil.HasPadding(m))
+
+	reply = &dns.Msg{}
+	reply.SetReply(req)
+	reply.SetEdns0(dns.DefaultMsgSize, true)
+	proxyutil.AddPadding(reply, proxyutil.ResponsePaddingBlockSize)
+	reply = unpadReply(reply, addedOPT)
+	assert.NotNil(t, reply.IsEdns0())
+	assert.False(t, proxyutil.HasPadding(reply))
+
+	assert.Nil(t, unpadReply(nil, true))
+}
@@ -138,6 +138,7 @@ func exchange(u Upstream, req *dns.Msg) (*dns.Msg, error) {
 // lookupResult is a structure that represents result of lookup
 type lookupResult struct {
 	address []net.IPAddr // List of IP addresses
+	ttl     uint32       // Min TTL of the addresses, 0 if it's unknown
 	err     error        // Error
 }
 
@@ -145,14 +146,20 @@ type lookupResult struct {
 // First answer without error will be returned
 // Return nil and error if count of errors equals count of resolvers
 func LookupParallel(ctx context.Context, resolvers []*Resolver, host string) ([]net.IPAddr, error) {
+	addrs, _, err := lookupParallelTTL(ctx, resolvers, host)
+	return addrs, err
+}
+
+// lookupParallelTTL is LookupParallel that also returns the min TTL of the
+// addresses in seconds, it's 0 if it's unknown
+func lookupParallelTTL(ctx context.Context, resolvers []*Resolver, host string) ([]net.IPAddr, uint32, error) {
 	size := len(resolvers)
 
 	if size == 0 {
-		return nil, errors.New("no resolvers specified")
+		return nil, 0, errors.New("no resolvers specified")
 	}
 	if size == 1 {
-		address, err := lookup(ctx, resolvers[0], host)
-		return address, err
+		return lookup(ctx, resolvers[0], host)
 	}
 
 	// Size of channel must accommodate results of lookups from all resolvers
@@ -175,32 +182,33 @@ func LookupParallel(ctx context.Context, resolvers []*Resolver, host string) ([]
 				break
 			}
 
-			return result.address, nil
+			return result.address, result.ttl, nil
 		}
 
 		if n == size {
-			return nil, errorx.DecorateMany("all resolvers failed to lookup", errs...)
+			return nil, 0, errorx.DecorateMany("all resolvers failed to lookup", errs...)
 		}
 	}
 }
 
 // lookupAsync tries to lookup for host ip with one Resolver and sends lookupResult to res channel
 func lookupAsync(ctx context.Context, r *Resolver, host string, res chan *lookupResult) {
-	address, err := lookup(ctx, r, host)
+	address, ttl, err := lookup(ctx, r, host)
 	res <- &lookupResult{
 		err:     err,
 		address: address,
+		ttl:     ttl,
 	}
 }
 
-func lookup(ctx context.Context, r *Resolver, host string) ([]net.IPAddr, error) {
+func lookup(ctx context.Context, r *Resolver, host string) ([]net.IPAddr, uint32, error) {
 	start := time.Now()
-	address, err := r.LookupIPAddr(ctx, host)
+	address, ttl, err := r.lookupIPAddrTTL(ctx, host)
 	elapsed := time.Since(start) / time.Millisecond
 	if err != nil {
 		log.Tracef("failed to lookup for %s in %d milliseconds using %s: %s", host, elapsed, r.resolverAddress, err)
 	} else {
 		log.Tracef("successfully finished lookup for %s in %d milliseconds using %s. Result : %s", host, elapsed, r.resolverAddress, address)
 	}
-	return address, err
+	return address, ttl, err
 }
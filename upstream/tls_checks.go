@@ -0,0 +1,476 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"golang.org/x/crypto/cryptobyte"
+	cryptobyte_asn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"golang.org/x/crypto/ocsp"
+)
+
+// defaultMinSCTs is the number of the SCTs required by the "sct" check
+// without an explicit number.  It's the minimum required by the CT policies
+// of the browsers.
+const defaultMinSCTs = 2
+
+// TLSChecks are the additional checks of the certificates of the encrypted
+// upstreams for the high-assurance deployments
+type TLSChecks struct {
+	// RequireOCSPStapling, if true, requires the server to staple a valid
+	// OCSP response with the good status of its certificate
+	RequireOCSPStapling bool
+	// MinSCTs, if positive, is the number of the distinct logs of
+	// Options.CTLogs the certificate must have the valid signed certificate
+	// timestamps from, either embedded into it or sent in the handshake
+	MinSCTs int
+	// SPKIPins, if not empty, are the SHA-256 hashes of the
+	// SubjectPublicKeyInfo one of which the certificate chain must have, in
+	// addition to the usual verification.  If the verification is disabled,
+	// only the server certificate is checked.
+	SPKIPins [][sha256.Size]byte
+}
+
+// ParseTLSChecks parses the checks of an upstream in the
+// "address=check[,check]" form, where check is "ocsp", "sct[:number]", or
+// "pin:base64", e.g. "tls://dns.example.org=ocsp,sct:3".  The pin is the
+// base64-encoded SHA-256 hash of the SubjectPublicKeyInfo of a certificate of
+// the chain, like the one of kdig's +tls-pin.
+func ParseTLSChecks(s string) (addr string, checks TLSChecks, err error) {
+	i := checksIndex(s)
+	if i <= 0 {
+		return "", checks, fmt.Errorf("invalid TLS checks %q: no address", s)
+	}
+	addr = s[:i]
+
+	for _, c := range strings.Split(s[i+1:], ",") {
+		switch {
+		case strings.HasPrefix(c, "pin:"):
+			pin, err := base64.StdEncoding.DecodeString(c[len("pin:"):])
+			if err != nil || len(pin) != sha256.Size {
+				return "", checks, fmt.Errorf("invalid TLS checks %q: bad pin %q", s, c)
+			}
+			var p [sha256.Size]byte
+			copy(p[:], pin)
+			checks.SPKIPins = append(checks.SPKIPins, p)
+		case c == "ocsp":
+			checks.RequireOCSPStapling = true
+		case c == "sct":
+			checks.MinSCTs = defaultMinSCTs
+		case strings.HasPrefix(c, "sct:"):
+			checks.MinSCTs, err = strconv.Atoi(c[len("sct:"):])
+			if err != nil || checks.MinSCTs <= 0 {
+				return "", checks, fmt.Errorf("invalid TLS checks %q: bad number of SCTs", s)
+			}
+		default:
+			return "", checks, fmt.Errorf("invalid TLS checks %q: unknown check %q", s, c)
+		}
+	}
+
+	return addr, checks, nil
+}
+
+// checksIndex returns the index of the "=" separating the address and the
+// checks in s.  The pins end with "=" themselves, so it's the last one
+// followed by a check if there is one.
+func checksIndex(s string) int {
+	for i := strings.LastIndexByte(s, '='); i > 0; i = strings.LastIndexByte(s[:i], '=') {
+		c := s[i+1:]
+		if strings.HasPrefix(c, "ocsp") || strings.HasPrefix(c, "sct") || strings.HasPrefix(c, "pin:") {
+			return i
+		}
+	}
+
+	return strings.LastIndexByte(s, '=')
+}
+
+// CTLog is a certificate transparency log
+type CTLog struct {
+	ID  [sha256.Size]byte // SHA-256 hash of the log's public key
+	Key crypto.PublicKey  // log's public key
+}
+
+// NewCTLog creates a CTLog from the DER-encoded public key of the log
+func NewCTLog(der []byte) (*CTLog, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid CT log key")
+	}
+
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		return &CTLog{ID: sha256.Sum256(der), Key: key}, nil
+	default:
+		return nil, fmt.Errorf("unsupported CT log key type %T", key)
+	}
+}
+
+// LoadCTLogList loads the logs from the JSON log list in the format of
+// https://www.gstatic.com/ct/log_list/v3/log_list.json.  The logs of the
+// older format without the operators are loaded as well.
+func LoadCTLogList(path string) ([]*CTLog, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	type jsonLog struct {
+		Key []byte `json:"key"`
+	}
+	list := struct {
+		Operators []struct {
+			Logs []jsonLog `json:"logs"`
+		} `json:"operators"`
+		Logs []jsonLog `json:"logs"`
+	}{}
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid CT log list %s", path)
+	}
+
+	jsonLogs := list.Logs
+	for _, op := range list.Operators {
+		jsonLogs = append(jsonLogs, op.Logs...)
+	}
+
+	var logs []*CTLog
+	for _, l := range jsonLogs {
+		ctLog, err := NewCTLog(l.Key)
+		if err != nil {
+			return nil, errorx.Decorate(err, "invalid CT log list %s", path)
+		}
+		logs = append(logs, ctLog)
+	}
+
+	return logs, nil
+}
+
+// newConnectionVerifier returns the function verifying the TLS connections
+// to the upstream with the checks, or nil if there are no checks
+func newConnectionVerifier(checks TLSChecks, logs []*CTLog) (func(tls.ConnectionState) error, error) {
+	if !checks.RequireOCSPStapling && checks.MinSCTs <= 0 && len(checks.SPKIPins) == 0 {
+		return nil, nil
+	}
+	if checks.MinSCTs > len(logs) {
+		return nil, fmt.Errorf("%d SCTs are required, but only %d CT logs are known", checks.MinSCTs, len(logs))
+	}
+
+	return func(cs tls.ConnectionState) error {
+		return verifyConnection(cs, checks, logs, time.Now())
+	}, nil
+}
+
+// verifyConnection checks the certificate of the TLS connection
+func verifyConnection(cs tls.ConnectionState, checks TLSChecks, logs []*CTLog, now time.Time) error {
+	if len(checks.SPKIPins) != 0 && !hasPinnedKey(cs, checks.SPKIPins) {
+		return fmt.Errorf("pin check of %s failed: no pinned public key in the certificate chain", cs.ServerName)
+	}
+
+	if !checks.RequireOCSPStapling && checks.MinSCTs <= 0 {
+		return nil
+	}
+
+	// Prefer the verified chain, the issuer in the peer certificates may be
+	// just sent by the server
+	chain := cs.PeerCertificates
+	if len(cs.VerifiedChains) != 0 {
+		chain = cs.VerifiedChains[0]
+	}
+	if len(chain) < 2 {
+		return errors.New("no issuer of the server certificate")
+	}
+	cert, issuer := chain[0], chain[1]
+
+	if checks.RequireOCSPStapling {
+		err := verifyOCSPStaple(cs.OCSPResponse, cert, issuer, now)
+		if err != nil {
+			return errorx.Decorate(err, "OCSP check of %s failed", cs.ServerName)
+		}
+	}
+
+	if checks.MinSCTs > 0 {
+		n := countValidSCTs(cs.SignedCertificateTimestamps, cert, issuer, logs, now)
+		if n < checks.MinSCTs {
+			return fmt.Errorf("CT check of %s failed: %d valid SCTs, %d required", cs.ServerName, n, checks.MinSCTs)
+		}
+	}
+
+	return nil
+}
+
+// hasPinnedKey returns true if a certificate of the verified chains of the
+// connection has one of the pinned public keys.  If the chains aren't
+// verified, only the key of the server certificate is trusted, as the server
+// has proven it has the private one.
+func hasPinnedKey(cs tls.ConnectionState, pins [][sha256.Size]byte) bool {
+	chains := cs.VerifiedChains
+	if len(chains) == 0 && len(cs.PeerCertificates) != 0 {
+		chains = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+	}
+
+	for _, chain := range chains {
+		for _, cert := range chain {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if hash == pin {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// verifyOCSPStaple checks that the stapled OCSP response is valid and says
+// that the certificate is good
+func verifyOCSPStaple(staple []byte, cert, issuer *x509.Certificate, now time.Time) error {
+	if len(staple) == 0 {
+		return errors.New("no stapled OCSP response")
+	}
+
+	resp, err := ocsp.ParseResponseForCert(staple, cert, issuer)
+	if err != nil {
+		return err
+	}
+
+	if resp.Status != ocsp.Good {
+		return fmt.Errorf("certificate status is %d, not good", resp.Status)
+	}
+	if now.Before(resp.ThisUpdate) || !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate) {
+		return fmt.Errorf("OCSP response is valid from %s to %s", resp.ThisUpdate, resp.NextUpdate)
+	}
+
+	return nil
+}
+
+// Signed certificate timestamps, see RFC 6962
+const (
+	sctVersion1       = 0
+	sctEntryX509      = 0
+	sctEntryPrecert   = 1
+	sctHashSHA256     = 4
+	sctSignatureRSA   = 1
+	sctSignatureECDSA = 3
+)
+
+// oidSCTList is the OID of the certificate extension with the embedded SCTs
+var oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// sct is a parsed signed certificate timestamp
+type sct struct {
+	logID      []byte
+	timestamp  uint64
+	extensions []byte
+	hashAlg    uint8
+	sigAlg     uint8
+	signature  []byte
+}
+
+// parseSCT parses the TLS-encoded SCT
+func parseSCT(data []byte) (*sct, error) {
+	s := cryptobyte.String(data)
+	t := &sct{}
+
+	var version uint8
+	var timestamp []byte
+	var ext, sig cryptobyte.String
+	if !s.ReadUint8(&version) || version != sctVersion1 ||
+		!s.ReadBytes(&t.logID, sha256.Size) ||
+		!s.ReadBytes(&timestamp, 8) ||
+		!s.ReadUint16LengthPrefixed(&ext) ||
+		!s.ReadUint8(&t.hashAlg) ||
+		!s.ReadUint8(&t.sigAlg) ||
+		!s.ReadUint16LengthPrefixed(&sig) ||
+		!s.Empty() {
+		return nil, errors.New("invalid SCT")
+	}
+	t.timestamp = binary.BigEndian.Uint64(timestamp)
+	t.extensions, t.signature = ext, sig
+
+	return t, nil
+}
+
+// embeddedSCTs returns the SCTs embedded into the certificate
+func embeddedSCTs(cert *x509.Certificate) [][]byte {
+	var scts [][]byte
+	for _, e := range cert.Extensions {
+		if !e.Id.Equal(oidSCTList) {
+			continue
+		}
+
+		var list []byte
+		if _, err := asn1.Unmarshal(e.Value, &list); err != nil {
+			return nil
+		}
+
+		s := cryptobyte.String(list)
+		var items cryptobyte.String
+		if !s.ReadUint16LengthPrefixed(&items) {
+			return nil
+		}
+		for !items.Empty() {
+			var item cryptobyte.String
+			if !items.ReadUint16LengthPrefixed(&item) {
+				return scts
+			}
+			scts = append(scts, item)
+		}
+	}
+
+	return scts
+}
+
+// countValidSCTs returns the number of the distinct logs with the valid SCTs
+// for the certificate, either sent in the handshake or embedded into it
+func countValidSCTs(tlsSCTs [][]byte, cert, issuer *x509.Certificate, logs []*CTLog, now time.Time) int {
+	valid := map[[sha256.Size]byte]bool{}
+	check := func(data []byte, entryType uint16) {
+		t, err := parseSCT(data)
+		if err != nil || t.timestamp > uint64(now.UnixNano()/int64(time.Millisecond)) {
+			return
+		}
+
+		for _, l := range logs {
+			if bytes.Equal(l.ID[:], t.logID) && verifySCT(t, l, entryType, cert, issuer) == nil {
+				valid[l.ID] = true
+			}
+		}
+	}
+
+	for _, data := range tlsSCTs {
+		check(data, sctEntryX509)
+	}
+	for _, data := range embeddedSCTs(cert) {
+		check(data, sctEntryPrecert)
+	}
+
+	return len(valid)
+}
+
+// verifySCT verifies the signature of the SCT by the log
+func verifySCT(t *sct, l *CTLog, entryType uint16, cert, issuer *x509.Certificate) error {
+	if t.hashAlg != sctHashSHA256 {
+		return errors.New("unsupported SCT hash algorithm")
+	}
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(sctVersion1)
+	b.AddUint8(0) // certificate_timestamp
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], t.timestamp)
+	b.AddBytes(timestamp[:])
+	b.AddUint16(entryType)
+	if entryType == sctEntryPrecert {
+		tbs, err := precertTBS(cert)
+		if err != nil {
+			return err
+		}
+		keyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+		b.AddBytes(keyHash[:])
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(tbs) })
+	} else {
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(cert.Raw) })
+	}
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(t.extensions) })
+
+	signed, err := b.Bytes()
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(signed)
+
+	switch key := l.Key.(type) {
+	case *ecdsa.PublicKey:
+		if t.sigAlg == sctSignatureECDSA && ecdsa.VerifyASN1(key, digest[:], t.signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if t.sigAlg == sctSignatureRSA && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], t.signature) == nil {
+			return nil
+		}
+	}
+
+	return errors.New("invalid SCT signature")
+}
+
+// precertTBS returns the TBSCertificate of the precertificate the embedded
+// SCTs were issued for, i.e. the one of cert without the SCT list extension
+func precertTBS(cert *x509.Certificate) ([]byte, error) {
+	input := cryptobyte.String(cert.RawTBSCertificate)
+	var tbs cryptobyte.String
+	if !input.ReadASN1(&tbs, cryptobyte_asn1.SEQUENCE) {
+		return nil, errors.New("invalid TBSCertificate")
+	}
+
+	extensionsTag := cryptobyte_asn1.Tag(3).Constructed().ContextSpecific()
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddASN1(cryptobyte_asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		for !tbs.Empty() {
+			var elem cryptobyte.String
+			var tag cryptobyte_asn1.Tag
+			if !tbs.ReadAnyASN1Element(&elem, &tag) {
+				b.SetError(errors.New("invalid TBSCertificate"))
+				return
+			}
+			if tag != extensionsTag {
+				b.AddBytes(elem)
+				continue
+			}
+
+			var extsField, exts cryptobyte.String
+			if !elem.ReadASN1(&extsField, extensionsTag) || !extsField.ReadASN1(&exts, cryptobyte_asn1.SEQUENCE) {
+				b.SetError(errors.New("invalid certificate extensions"))
+				return
+			}
+			b.AddASN1(extensionsTag, func(b *cryptobyte.Builder) {
+				b.AddASN1(cryptobyte_asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					addExtensionsWithoutSCTs(b, exts)
+				})
+			})
+		}
+	})
+
+	return b.Bytes()
+}
+
+// addExtensionsWithoutSCTs adds the certificate extensions except for the SCT
+// list one
+func addExtensionsWithoutSCTs(b *cryptobyte.Builder, exts cryptobyte.String) {
+	for !exts.Empty() {
+		var ext, fields cryptobyte.String
+		if !exts.ReadASN1Element(&ext, cryptobyte_asn1.SEQUENCE) {
+			b.SetError(errors.New("invalid certificate extension"))
+			return
+		}
+
+		// ext is kept intact to be added as is
+		var oid asn1.ObjectIdentifier
+		elem := ext
+		if !elem.ReadASN1(&fields, cryptobyte_asn1.SEQUENCE) || !fields.ReadASN1ObjectIdentifier(&oid) {
+			b.SetError(errors.New("invalid certificate extension"))
+			return
+		}
+
+		if !oid.Equal(oidSCTList) {
+			b.AddBytes(ext)
+		}
+	}
+}
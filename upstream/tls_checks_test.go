@@ -0,0 +1,392 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCA issues the certificates, the OCSP responses and the SCTs for the
+// tests
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	logKey *ecdsa.PrivateKey
+	log    *CTLog
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	logKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	logDER, err := x509.MarshalPKIXPublicKey(&logKey.PublicKey)
+	assert.Nil(t, err)
+	ctLog, err := NewCTLog(logDER)
+	assert.Nil(t, err)
+
+	return &testCA{cert: cert, key: key, logKey: logKey, log: ctLog}
+}
+
+// issue issues the server certificate, with the embedded SCT if embedSCT
+// is true
+func (ca *testCA) issue(t *testing.T, embedSCT bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"example.org"},
+	}
+	create := func() *x509.Certificate {
+		der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+		assert.Nil(t, err)
+		cert, err := x509.ParseCertificate(der)
+		assert.Nil(t, err)
+		return cert
+	}
+
+	if !embedSCT {
+		return create(), key
+	}
+
+	// The SCT is issued for the TBSCertificate without the SCT list, so the
+	// certificate with an empty list is issued first
+	template.ExtraExtensions = []pkix.Extension{ca.sctListExtension(t, nil)}
+	tbs, err := precertTBS(create())
+	assert.Nil(t, err)
+
+	b := cryptobyte.NewBuilder(nil)
+	keyHash := sha256.Sum256(ca.cert.RawSubjectPublicKeyInfo)
+	b.AddBytes(keyHash[:])
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(tbs) })
+	entry, err := b.Bytes()
+	assert.Nil(t, err)
+
+	template.ExtraExtensions = []pkix.Extension{ca.sctListExtension(t, ca.sct(t, sctEntryPrecert, entry))}
+	return create(), key
+}
+
+// sct returns the SCT of the log for the entry
+func (ca *testCA) sct(t *testing.T, entryType uint16, entry []byte) []byte {
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(time.Now().Add(-time.Minute).UnixNano()/int64(time.Millisecond)))
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(sctVersion1)
+	b.AddUint8(0)
+	b.AddBytes(timestamp[:])
+	b.AddUint16(entryType)
+	b.AddBytes(entry)
+	b.AddUint16(0)
+	signed, err := b.Bytes()
+	assert.Nil(t, err)
+
+	digest := sha256.Sum256(signed)
+	sig, err := ecdsa.SignASN1(rand.Reader, ca.logKey, digest[:])
+	assert.Nil(t, err)
+
+	b = cryptobyte.NewBuilder(nil)
+	b.AddUint8(sctVersion1)
+	b.AddBytes(ca.log.ID[:])
+	b.AddBytes(timestamp[:])
+	b.AddUint16(0)
+	b.AddUint8(sctHashSHA256)
+	b.AddUint8(sctSignatureECDSA)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(sig) })
+	data, err := b.Bytes()
+	assert.Nil(t, err)
+
+	return data
+}
+
+// sctListExtension returns the certificate extension with the SCTs
+func (ca *testCA) sctListExtension(t *testing.T, scts ...[]byte) pkix.Extension {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, s := range scts {
+			if s != nil {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(s) })
+			}
+		}
+	})
+	list, err := b.Bytes()
+	assert.Nil(t, err)
+
+	value, err := asn1.Marshal(list)
+	assert.Nil(t, err)
+
+	return pkix.Extension{Id: oidSCTList, Value: value}
+}
+
+// ocspResponse returns the OCSP response for the certificate
+func (ca *testCA) ocspResponse(t *testing.T, cert *x509.Certificate, status int, nextUpdate time.Time) []byte {
+	resp, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+		Status:       status,
+		SerialNumber: cert.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour),
+		NextUpdate:   nextUpdate,
+		RevokedAt:    time.Now().Add(-time.Hour),
+	}, ca.key)
+	assert.Nil(t, err)
+
+	return resp
+}
+
+func TestParseTLSChecks(t *testing.T) {
+	addr, checks, err := ParseTLSChecks("tls://dns.example.org=ocsp,sct")
+	assert.Nil(t, err)
+	assert.Equal(t, "tls://dns.example.org", addr)
+	assert.Equal(t, TLSChecks{RequireOCSPStapling: true, MinSCTs: 2}, checks)
+
+	addr, checks, err = ParseTLSChecks("https://dns.example.org/dns-query=sct:3")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://dns.example.org/dns-query", addr)
+	assert.Equal(t, TLSChecks{MinSCTs: 3}, checks)
+
+	// The pins end with "="
+	pin := sha256.Sum256([]byte("key"))
+	pinStr := base64.StdEncoding.EncodeToString(pin[:])
+	addr, checks, err = ParseTLSChecks("tls://dns.example.org=ocsp,pin:" + pinStr)
+	assert.Nil(t, err)
+	assert.Equal(t, "tls://dns.example.org", addr)
+	assert.Equal(t, TLSChecks{RequireOCSPStapling: true, SPKIPins: [][sha256.Size]byte{pin}}, checks)
+
+	for _, s := range []string{
+		"tls://dns.example.org",
+		"=ocsp",
+		"tls://dns.example.org=crl",
+		"tls://dns.example.org=sct:0",
+		"tls://dns.example.org=pin:AAAA",
+		"tls://dns.example.org=pin:" + pinStr[1:],
+	} {
+		_, _, err = ParseTLSChecks(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestVerifyConnectionOCSP(t *testing.T) {
+	ca := newTestCA(t)
+	cert, _ := ca.issue(t, false)
+	checks := TLSChecks{RequireOCSPStapling: true}
+	now := time.Now()
+
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert, ca.cert}}
+	assert.NotNil(t, verifyConnection(cs, checks, nil, now))
+
+	cs.OCSPResponse = ca.ocspResponse(t, cert, ocsp.Good, now.Add(time.Hour))
+	assert.Nil(t, verifyConnection(cs, checks, nil, now))
+
+	cs.OCSPResponse = ca.ocspResponse(t, cert, ocsp.Revoked, now.Add(time.Hour))
+	assert.NotNil(t, verifyConnection(cs, checks, nil, now))
+
+	cs.OCSPResponse = ca.ocspResponse(t, cert, ocsp.Good, now.Add(-time.Minute))
+	assert.NotNil(t, verifyConnection(cs, checks, nil, now))
+
+	// The response must be signed by the issuer
+	other := newTestCA(t)
+	cs.OCSPResponse = other.ocspResponse(t, cert, ocsp.Good, now.Add(time.Hour))
+	assert.NotNil(t, verifyConnection(cs, checks, nil, now))
+
+	// The issuer is required
+	cs = tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	assert.NotNil(t, verifyConnection(cs, checks, nil, now))
+}
+
+func TestVerifyConnectionSCT(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCA(t)
+	logs := []*CTLog{ca.log, other.log}
+	now := time.Now()
+
+	// The SCT sent in the handshake is issued for the certificate itself
+	cert, _ := ca.issue(t, false)
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(cert.Raw) })
+	entry, err := b.Bytes()
+	assert.Nil(t, err)
+	tlsSCT := ca.sct(t, sctEntryX509, entry)
+
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert, ca.cert}}
+	assert.Equal(t, 0, countValidSCTs(cs.SignedCertificateTimestamps, cert, ca.cert, logs, now))
+	cs.SignedCertificateTimestamps = [][]byte{tlsSCT, tlsSCT}
+	assert.Equal(t, 1, countValidSCTs(cs.SignedCertificateTimestamps, cert, ca.cert, logs, now))
+	assert.Nil(t, verifyConnection(cs, TLSChecks{MinSCTs: 1}, logs, now))
+	assert.NotNil(t, verifyConnection(cs, TLSChecks{MinSCTs: 2}, logs, now))
+
+	// The unknown logs aren't counted
+	assert.Equal(t, 0, countValidSCTs(cs.SignedCertificateTimestamps, cert, ca.cert, []*CTLog{other.log}, now))
+
+	// The SCT of another certificate is invalid
+	cert2, _ := ca.issue(t, false)
+	assert.Equal(t, 0, countValidSCTs(cs.SignedCertificateTimestamps, cert2, ca.cert, logs, now))
+
+	// The SCTs from the future are invalid
+	assert.Equal(t, 0, countValidSCTs(cs.SignedCertificateTimestamps, cert, ca.cert, logs, now.Add(-time.Hour)))
+
+	// The embedded SCT is issued for the precertificate
+	cert, _ = ca.issue(t, true)
+	assert.Len(t, embeddedSCTs(cert), 1)
+	assert.Equal(t, 1, countValidSCTs(nil, cert, ca.cert, logs, now))
+	assert.Equal(t, 0, countValidSCTs(nil, cert, other.cert, logs, now))
+
+	_, err = newConnectionVerifier(TLSChecks{MinSCTs: 3}, logs)
+	assert.NotNil(t, err)
+	verify, err := newConnectionVerifier(TLSChecks{}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, verify)
+}
+
+func TestVerifyConnectionPin(t *testing.T) {
+	ca := newTestCA(t)
+	cert, _ := ca.issue(t, false)
+	certPin := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	caPin := sha256.Sum256(ca.cert.RawSubjectPublicKeyInfo)
+	otherPin := sha256.Sum256([]byte("key"))
+	now := time.Now()
+
+	verified := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert, ca.cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert, ca.cert}},
+	}
+	assert.Nil(t, verifyConnection(verified, TLSChecks{SPKIPins: [][sha256.Size]byte{certPin}}, nil, now))
+	assert.Nil(t, verifyConnection(verified, TLSChecks{SPKIPins: [][sha256.Size]byte{otherPin, caPin}}, nil, now))
+	assert.NotNil(t, verifyConnection(verified, TLSChecks{SPKIPins: [][sha256.Size]byte{otherPin}}, nil, now))
+
+	// Only the server certificate is trusted without the verification
+	unverified := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert, ca.cert}}
+	assert.Nil(t, verifyConnection(unverified, TLSChecks{SPKIPins: [][sha256.Size]byte{certPin}}, nil, now))
+	assert.NotNil(t, verifyConnection(unverified, TLSChecks{SPKIPins: [][sha256.Size]byte{caPin}}, nil, now))
+
+	// The issuer isn't required
+	unverified.PeerCertificates = unverified.PeerCertificates[:1]
+	assert.Nil(t, verifyConnection(unverified, TLSChecks{SPKIPins: [][sha256.Size]byte{certPin}}, nil, now))
+}
+
+func TestLoadCTLogList(t *testing.T) {
+	ca := newTestCA(t)
+	der, err := x509.MarshalPKIXPublicKey(ca.log.Key)
+	assert.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "dnsproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log_list.json")
+	list := fmt.Sprintf(`{"operators": [{"name": "Test", "logs": [{"key": "%s"}]}]}`, base64.StdEncoding.EncodeToString(der))
+	assert.Nil(t, ioutil.WriteFile(path, []byte(list), 0o644))
+
+	logs, err := LoadCTLogList(path)
+	assert.Nil(t, err)
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, ca.log.ID, logs[0].ID)
+	}
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"logs": [{"key": "AAAA"}]}`), 0o644))
+	_, err = LoadCTLogList(path)
+	assert.NotNil(t, err)
+}
+
+func TestTLSChecksHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, false)
+
+	serverCert := tls.Certificate{
+		Certificate: [][]byte{cert.Raw, ca.cert.Raw},
+		PrivateKey:  key,
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &serverCert, nil
+		},
+	})
+	assert.Nil(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte{0})
+			_ = conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	opts := Options{
+		ServerIPAddrs:      []net.IP{net.IPv4(127, 0, 0, 1)},
+		Timeout:            time.Second,
+		InsecureSkipVerify: true,
+		TLSChecks:          TLSChecks{RequireOCSPStapling: true},
+	}
+	handshake := func() error {
+		b, err := urlToBoot("tls://example.org:"+port, opts)
+		assert.Nil(t, err)
+
+		tlsConfig, dialContext, err := b.get()
+		assert.Nil(t, err)
+
+		conn, err := tlsDial(dialContext, "tcp", tlsConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+
+	// The OCSP response isn't stapled
+	assert.NotNil(t, handshake())
+
+	serverCert.OCSPStaple = ca.ocspResponse(t, cert, ocsp.Good, time.Now().Add(time.Hour))
+	assert.Nil(t, handshake())
+
+	opts.TLSChecks = TLSChecks{SPKIPins: [][sha256.Size]byte{sha256.Sum256(cert.RawSubjectPublicKeyInfo)}}
+	assert.Nil(t, handshake())
+
+	opts.TLSChecks = TLSChecks{SPKIPins: [][sha256.Size]byte{sha256.Sum256(ca.cert.RawSubjectPublicKeyInfo)}}
+	assert.NotNil(t, handshake())
+
+	// The SCTs require the logs
+	opts.TLSChecks = TLSChecks{MinSCTs: 1}
+	_, err = urlToBoot("tls://example.org:"+port, opts)
+	assert.NotNil(t, err)
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/ameshkov/dnsstamps"
 	"github.com/joomcode/errorx"
@@ -37,6 +38,14 @@ type Options struct {
 
 	// InsecureSkipVerify - if true, do not verify the server certificate
 	InsecureSkipVerify bool
+
+	// TLSChecks are the additional checks of the server certificate of an
+	// encrypted upstream
+	TLSChecks TLSChecks
+
+	// CTLogs are the certificate transparency logs the SCTs are checked
+	// against if TLSChecks.MinSCTs is set
+	CTLogs []*CTLog
 }
 
 // Parse "host:port" string and validate port number
@@ -61,6 +70,11 @@ func parseHostAndPort(addr string) (string, string, error) {
 // * tls://1.1.1.1 -- DNS-over-TLS
 // * https://dns.adguard.com/dns-query -- DNS-over-HTTPS
 // * sdns://... -- DNS stamp (see https://dnscrypt.info/stamps-specifications)
+// * svcb://_dns.example.net -- endpoints discovered by the SVCB records
+// * srv://_domain-s._tcp.example.net -- DoT endpoints discovered by the SRV records
+// * mdns:// -- Multicast DNS on the LAN, mdns://192.168.1.1 -- a single mDNS responder
+// * recursive:// -- recursive resolution from the root servers with the QNAME minimisation
+// * scheme://... -- custom upstream, see Register
 func AddressToUpstream(address string, opts Options) (Upstream, error) {
 	if strings.Contains(address, "://") {
 		upstreamURL, err := url.Parse(address)
@@ -83,12 +97,26 @@ func AddressToUpstream(address string, opts Options) (Upstream, error) {
 }
 
 // urlToBoot creates an instance of the bootstrapper with the specified options
-func urlToBoot(resolverURL string, opts Options) (*bootstrapper, error) {
+func urlToBoot(resolverURL string, opts Options) (b *bootstrapper, err error) {
+	verify, err := newConnectionVerifier(opts.TLSChecks, opts.CTLogs)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid TLS checks of %s", resolverURL)
+	}
+
 	if len(opts.ServerIPAddrs) == 0 {
-		return newBootstrapper(resolverURL, opts.Bootstrap, opts.Timeout, opts.InsecureSkipVerify)
+		b, err = newBootstrapper(resolverURL, opts.Bootstrap, opts.Timeout, opts.InsecureSkipVerify)
+	} else {
+		b, err = newBootstrapperResolved(resolverURL, opts.ServerIPAddrs, opts.Timeout, opts.InsecureSkipVerify)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if verify != nil {
+		b.setVerifyConnection(verify)
 	}
 
-	return newBootstrapperResolved(resolverURL, opts.ServerIPAddrs, opts.Timeout, opts.InsecureSkipVerify)
+	return b, nil
 }
 
 // urlToUpstream converts a URL to an Upstream
@@ -127,6 +155,18 @@ func urlToUpstream(upstreamURL *url.URL, opts Options) (Upstream, error) {
 
 		return &dnsOverTLS{boot: b}, nil
 
+	case "mdns":
+		return newMDNS(upstreamURL.Host, opts.Timeout)
+
+	case "recursive":
+		return newRecursive(upstreamURL, opts.Timeout)
+
+	case "svcb":
+		return newDNSDiscovery(upstreamURL.Host, dns.TypeSVCB, opts)
+
+	case "srv":
+		return newDNSDiscovery(upstreamURL.Host, dns.TypeSRV, opts)
+
 	case "https":
 		if upstreamURL.Port() == "" {
 			upstreamURL.Host += ":443"
@@ -141,6 +181,10 @@ func urlToUpstream(upstreamURL *url.URL, opts Options) (Upstream, error) {
 		return &dnsOverHTTPS{boot: b}, nil
 
 	default:
+		if f := factory(upstreamURL.Scheme); f != nil {
+			return f(upstreamURL, opts)
+		}
+
 		return nil, fmt.Errorf("unsupported URL scheme: %s", upstreamURL.Scheme)
 	}
 }
@@ -213,3 +257,53 @@ func logFinish(upstreamAddress string, err error) {
 	log.Debug("%s: response: %s",
 		upstreamAddress, status)
 }
+
+// readReply reads the reply from c and unpacks it with proxyutil.UnpackMsg, so
+// that the crafted names in it can't slow down the proxy rewriting the reply
+func readReply(c *dns.Conn) (*dns.Msg, error) {
+	b, err := c.ReadMsgHeader(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return proxyutil.UnpackMsg(b)
+}
+
+// exchangeClient is like c.Exchange, but the reply is read with readReply.
+// c.Timeout must be set.
+func exchangeClient(c *dns.Client, m *dns.Msg, address string) (*dns.Msg, error) {
+	co, err := c.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	defer co.Close()
+
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		co.UDPSize = opt.UDPSize()
+	} else if opt == nil && c.UDPSize >= dns.MinMsgSize {
+		co.UDPSize = c.UDPSize
+	}
+
+	_ = co.SetWriteDeadline(time.Now().Add(c.Timeout))
+	err = co.WriteMsg(m)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = co.SetReadDeadline(time.Now().Add(c.Timeout))
+	_, isUDP := co.Conn.(net.PacketConn)
+	for {
+		reply, err := readReply(co)
+		if err != nil {
+			return nil, err
+		}
+
+		if reply.Id == m.Id {
+			return reply, nil
+		} else if !isUDP {
+			return nil, dns.ErrId
+		}
+
+		// Ignore the replies to the earlier requests that timed out
+	}
+}
@@ -0,0 +1,412 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+const (
+	// minDiscoveryTTL is the minimum time the discovered endpoints are used
+	// for before the records are requested again
+	minDiscoveryTTL = 10 * time.Second
+	// discoveryRetryInterval is the interval between the attempts to refresh
+	// the endpoints when the records can't be requested
+	discoveryRetryInterval = 10 * time.Second
+
+	// svcbKeyDOHPath is the "dohpath" SvcParamKey, it's not known to
+	// miekg/dns yet
+	svcbKeyDOHPath dns.SVCBKey = 7
+	// defaultDOHPath is the path of the DoH endpoints without "dohpath"
+	defaultDOHPath = "/dns-query"
+)
+
+// dnsDiscovery is an upstream with the endpoints discovered by the SVCB or the
+// SRV records of a DNS name.  The endpoints are built from the records and
+// refreshed when the records' TTL expires.
+//
+// The ALPN, the port, and the IP hints of the SVCB records define DoT ("dot"),
+// DoH ("h2", "h3"), and DoQ ("doq") endpoints, see draft-ietf-add-svcb-dns.
+// The SRV records define DoT endpoints.
+type dnsDiscovery struct {
+	name  string // the name of the records, fully-qualified
+	qtype uint16 // dns.TypeSVCB or dns.TypeSRV
+	opts  Options
+
+	// resolvers are used to request the records
+	resolvers []Upstream
+
+	endpoints  []*discoveredEndpoint // sorted by priority
+	expire     time.Time             // when the endpoints must be refreshed
+	sync.Mutex                       // protects endpoints and expire
+}
+
+// discoveredEndpoint is an upstream built from a single record
+type discoveredEndpoint struct {
+	addr     string   // the upstream URL
+	hints    []net.IP // the IP addresses of the server if advertised
+	priority uint16
+	upstream Upstream
+}
+
+// key identifies the endpoint among the refreshed ones
+func (e *discoveredEndpoint) key() string {
+	key := e.addr
+	for _, ip := range e.hints {
+		key += " " + ip.String()
+	}
+
+	return key
+}
+
+// compile-time type check
+var _ Upstream = &dnsDiscovery{}
+
+// newDNSDiscovery creates an upstream discovering its endpoints by the
+// records of the specified type.  The records are requested from the
+// bootstrap DNS servers or from the system ones if there are none.
+func newDNSDiscovery(name string, qtype uint16, opts Options) (*dnsDiscovery, error) {
+	if name == "" {
+		return nil, errors.New("discovery name is not specified")
+	}
+
+	resolverAddrs := opts.Bootstrap
+	if len(resolverAddrs) == 0 {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, errorx.Decorate(err, "no bootstrap DNS servers to discover %s", name)
+		}
+		for _, s := range conf.Servers {
+			resolverAddrs = append(resolverAddrs, net.JoinHostPort(s, conf.Port))
+		}
+	}
+
+	p := &dnsDiscovery{
+		name:  dns.Fqdn(name),
+		qtype: qtype,
+		opts:  opts,
+	}
+	for _, addr := range resolverAddrs {
+		r, err := NewResolver(addr, opts.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		p.resolvers = append(p.resolvers, r.upstream)
+	}
+	if len(p.resolvers) == 0 {
+		return nil, fmt.Errorf("no bootstrap DNS servers to discover %s", name)
+	}
+
+	return p, nil
+}
+
+// Address returns the original address of the upstream
+func (p *dnsDiscovery) Address() string {
+	return strings.ToLower(dns.TypeToString[p.qtype]) + "://" + strings.TrimSuffix(p.name, ".")
+}
+
+// Exchange sends the request to the discovered endpoints in the order of
+// their priority until one of them responds
+func (p *dnsDiscovery) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	endpoints, err := p.getEndpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range endpoints {
+		var reply *dns.Msg
+		reply, err = e.upstream.Exchange(m)
+		if err == nil {
+			return reply, nil
+		}
+		log.Debug("%s: endpoint %s failed: %s", p.Address(), e.upstream.Address(), err)
+	}
+
+	return nil, errorx.Decorate(err, "all endpoints of %s failed", p.Address())
+}
+
+// Close implements the io.Closer interface for *dnsDiscovery.  It closes the
+// connections of the discovered endpoints.
+func (p *dnsDiscovery) Close() error {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, e := range p.endpoints {
+		if c, ok := e.upstream.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+
+	return nil
+}
+
+// getEndpoints returns the discovered endpoints refreshing them if needed.
+// The stale endpoints are used if the records can't be requested.
+func (p *dnsDiscovery) getEndpoints() ([]*discoveredEndpoint, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	if now.Before(p.expire) {
+		return p.endpoints, nil
+	}
+
+	endpoints, ttl, err := p.discover()
+	if err != nil {
+		if len(p.endpoints) == 0 {
+			return nil, errorx.Decorate(err, "cannot discover %s", p.Address())
+		}
+		log.Error("Cannot refresh %s, using the previous endpoints: %s", p.Address(), err)
+		p.expire = now.Add(discoveryRetryInterval)
+		return p.endpoints, nil
+	}
+
+	if ttl < minDiscoveryTTL {
+		ttl = minDiscoveryTTL
+	}
+	p.endpoints = endpoints
+	p.expire = now.Add(ttl)
+
+	return p.endpoints, nil
+}
+
+// discover requests the records and builds the endpoints from them.  The
+// endpoints that haven't changed are kept so that their connections are
+// reused.  It returns the endpoints and the minimum TTL of the records.
+func (p *dnsDiscovery) discover() ([]*discoveredEndpoint, time.Duration, error) {
+	resp, err := p.lookup(p.name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ttl := ^uint32(0)
+	var endpoints []*discoveredEndpoint
+	for _, rr := range resp.Answer {
+		var eps []*discoveredEndpoint
+		var rrErr error
+		switch rr := rr.(type) {
+		case *dns.SVCB:
+			eps, rrErr = p.svcbEndpoints(rr)
+		case *dns.SRV:
+			eps = srvEndpoints(rr)
+		default:
+			// CNAMEs are followed by the resolver
+			continue
+		}
+		if rrErr != nil {
+			log.Debug("%s: skipping record %s: %s", p.Address(), rr, rrErr)
+			continue
+		}
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		endpoints = append(endpoints, eps...)
+	}
+	if len(endpoints) == 0 {
+		return nil, 0, fmt.Errorf("no usable %s records for %s", dns.TypeToString[p.qtype], p.name)
+	}
+
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].priority < endpoints[j].priority
+	})
+
+	err = p.createUpstreams(endpoints)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return endpoints, time.Duration(ttl) * time.Second, nil
+}
+
+// createUpstreams creates the upstreams of the new endpoints reusing the ones
+// of the current endpoints with the same key
+func (p *dnsDiscovery) createUpstreams(endpoints []*discoveredEndpoint) error {
+	current := map[string]Upstream{}
+	for _, e := range p.endpoints {
+		current[e.key()] = e.upstream
+	}
+
+	for _, e := range endpoints {
+		if u, ok := current[e.key()]; ok {
+			e.upstream = u
+			continue
+		}
+
+		opts := p.opts
+		if len(e.hints) != 0 {
+			opts.ServerIPAddrs = e.hints
+		}
+		u, err := AddressToUpstream(e.addr, opts)
+		if err != nil {
+			return errorx.Decorate(err, "cannot create endpoint %s", e.addr)
+		}
+		e.upstream = u
+	}
+
+	return nil
+}
+
+// lookup requests the records of the name from the resolvers
+func (p *dnsDiscovery) lookup(name string) (*dns.Msg, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(name, p.qtype)
+	req.RecursionDesired = true
+
+	var err error
+	for _, r := range p.resolvers {
+		var resp *dns.Msg
+		resp, err = r.Exchange(req)
+		if err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("%s returned %s", r.Address(), dns.RcodeToString[resp.Rcode])
+			continue
+		}
+
+		return resp, nil
+	}
+
+	return nil, err
+}
+
+// svcbEndpoints builds the endpoints from an SVCB record.  The AliasMode
+// records are followed once.
+func (p *dnsDiscovery) svcbEndpoints(rr *dns.SVCB) ([]*discoveredEndpoint, error) {
+	if rr.Priority != 0 {
+		return svcbServiceEndpoints(rr)
+	}
+
+	if rr.Target == "." || strings.EqualFold(rr.Target, rr.Hdr.Name) {
+		return nil, errors.New("alias to itself")
+	}
+
+	resp, err := p.lookup(rr.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []*discoveredEndpoint
+	for _, a := range resp.Answer {
+		if svcb, ok := a.(*dns.SVCB); ok && svcb.Priority != 0 {
+			eps, err := svcbServiceEndpoints(svcb)
+			if err == nil {
+				endpoints = append(endpoints, eps...)
+			}
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no usable records for alias %s", rr.Target)
+	}
+
+	return endpoints, nil
+}
+
+// svcbServiceEndpoints builds the endpoints from a ServiceMode SVCB record, one
+// for every supported ALPN
+func svcbServiceEndpoints(rr *dns.SVCB) ([]*discoveredEndpoint, error) {
+	host := strings.TrimSuffix(rr.Target, ".")
+	if host == "" {
+		// "." is the owner name, the "_dns" label is not a part of the
+		// server's hostname
+		host = strings.TrimPrefix(strings.TrimSuffix(rr.Hdr.Name, "."), "_dns.")
+	}
+
+	var alpns []string
+	var port string
+	var hints []net.IP
+	dohPath := defaultDOHPath
+	for _, kv := range rr.Value {
+		switch kv := kv.(type) {
+		case *dns.SVCBAlpn:
+			alpns = kv.Alpn
+		case *dns.SVCBPort:
+			port = strconv.Itoa(int(kv.Port))
+		case *dns.SVCBIPv4Hint:
+			hints = append(hints, kv.Hint...)
+		case *dns.SVCBIPv6Hint:
+			hints = append(hints, kv.Hint...)
+		case *dns.SVCBLocal:
+			if kv.KeyCode == svcbKeyDOHPath {
+				// The template variables aren't supported, the GET
+				// requests aren't used anyway
+				dohPath = strings.SplitN(string(kv.Data), "{", 2)[0]
+			}
+		case *dns.SVCBMandatory:
+			for _, k := range kv.Code {
+				if !isSupportedSVCBKey(k) {
+					return nil, fmt.Errorf("unsupported mandatory key %s", k)
+				}
+			}
+		}
+	}
+
+	hostPort := host
+	if port != "" {
+		hostPort = net.JoinHostPort(host, port)
+	}
+
+	var endpoints []*discoveredEndpoint
+	seen := map[string]bool{}
+	for _, alpn := range alpns {
+		var addr string
+		switch alpn {
+		case "dot":
+			addr = "tls://" + hostPort
+		case "h2", "h3":
+			addr = "https://" + hostPort + dohPath
+		case "doq", NextProtoDQ:
+			addr = "quic://" + hostPort
+		default:
+			continue
+		}
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		endpoints = append(endpoints, &discoveredEndpoint{
+			addr:     addr,
+			hints:    hints,
+			priority: rr.Priority,
+		})
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no supported protocols in %v", alpns)
+	}
+
+	return endpoints, nil
+}
+
+// isSupportedSVCBKey returns true if the key is taken into account when the
+// endpoints are built
+func isSupportedSVCBKey(k dns.SVCBKey) bool {
+	switch k {
+	case dns.SVCB_ALPN, dns.SVCB_PORT, dns.SVCB_IPV4HINT, dns.SVCB_IPV6HINT, svcbKeyDOHPath:
+		return true
+	}
+
+	return false
+}
+
+// srvEndpoints builds a DoT endpoint from an SRV record
+func srvEndpoints(rr *dns.SRV) []*discoveredEndpoint {
+	host := strings.TrimSuffix(rr.Target, ".")
+	if host == "" {
+		// "." means that the service isn't available
+		return nil
+	}
+
+	addr := "tls://" + net.JoinHostPort(host, strconv.Itoa(int(rr.Port)))
+	return []*discoveredEndpoint{{addr: addr, priority: rr.Priority}}
+}
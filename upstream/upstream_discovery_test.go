@@ -0,0 +1,150 @@
+package upstream
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDiscoveryServer is a DNS server answering with the configured records
+type testDiscoveryServer struct {
+	records map[string][]dns.RR
+	lock    sync.Mutex
+}
+
+func (s *testDiscoveryServer) setRecords(name string, zone ...string) {
+	var rrs []dns.RR
+	for _, z := range zone {
+		rr, err := dns.NewRR(z)
+		if err != nil {
+			panic(err)
+		}
+		rrs = append(rrs, rr)
+	}
+
+	s.lock.Lock()
+	s.records[name] = rrs
+	s.lock.Unlock()
+}
+
+func (s *testDiscoveryServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	rrs, ok := s.records[req.Question[0].Name]
+	if !ok {
+		resp.Rcode = dns.RcodeNameError
+	}
+	resp.Answer = rrs
+	_ = w.WriteMsg(resp)
+}
+
+// startTestDiscoveryServer starts the server and returns it and its address
+func startTestDiscoveryServer(t *testing.T) (*testDiscoveryServer, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	s := &testDiscoveryServer{records: map[string][]dns.RR{}}
+	srv := &dns.Server{PacketConn: conn, Handler: s}
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = srv.Shutdown()
+	})
+
+	return s, conn.LocalAddr().String()
+}
+
+func endpointAddrs(endpoints []*discoveredEndpoint) []string {
+	var addrs []string
+	for _, e := range endpoints {
+		addrs = append(addrs, e.key())
+	}
+
+	return addrs
+}
+
+func TestDiscoverySVCB(t *testing.T) {
+	s, addr := startTestDiscoveryServer(t)
+	s.setRecords("_dns.example.net.",
+		`_dns.example.net. 300 IN SVCB 2 dns.example.net. alpn=dot,h2,h3 port=8853 ipv4hint=127.0.0.1 key7="/q{?dns}"`,
+		`_dns.example.net. 60 IN SVCB 1 . alpn=doq`,
+		`_dns.example.net. 60 IN SVCB 3 . alpn=unknown`,
+	)
+	s.setRecords("alias.example.net.", `alias.example.net. 300 IN SVCB 0 _dns.example.net.`)
+
+	u, err := AddressToUpstream("svcb://_dns.example.net", Options{Bootstrap: []string{addr}, Timeout: time.Second})
+	assert.Nil(t, err)
+	p := u.(*dnsDiscovery)
+	assert.Equal(t, "svcb://_dns.example.net", p.Address())
+
+	endpoints, err := p.getEndpoints()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"quic://example.net",
+		"tls://dns.example.net:8853 127.0.0.1",
+		"https://dns.example.net:8853/q 127.0.0.1",
+	}, endpointAddrs(endpoints))
+	assert.True(t, p.expire.After(time.Now().Add(50*time.Second)))
+	assert.True(t, p.expire.Before(time.Now().Add(61*time.Second)))
+	tls := endpoints[1].upstream
+
+	// The endpoints are refreshed when expired, the unchanged ones are kept
+	s.setRecords("_dns.example.net.",
+		`_dns.example.net. 0 IN SVCB 1 dns.example.net. alpn=dot port=8853 ipv4hint=127.0.0.1`,
+	)
+	endpoints, err = p.getEndpoints()
+	assert.Nil(t, err)
+	assert.Len(t, endpoints, 3)
+
+	p.expire = time.Time{}
+	endpoints, err = p.getEndpoints()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"tls://dns.example.net:8853 127.0.0.1"}, endpointAddrs(endpoints))
+	assert.True(t, tls == endpoints[0].upstream)
+	assert.True(t, p.expire.After(time.Now().Add(minDiscoveryTTL/2)))
+
+	// The previous endpoints are used if the records are gone
+	s.setRecords("_dns.example.net.")
+	p.expire = time.Time{}
+	endpoints, err = p.getEndpoints()
+	assert.Nil(t, err)
+	assert.Len(t, endpoints, 1)
+
+	// The aliases are followed
+	u, err = AddressToUpstream("svcb://alias.example.net", Options{Bootstrap: []string{addr}, Timeout: time.Second})
+	assert.Nil(t, err)
+	s.setRecords("_dns.example.net.", `_dns.example.net. 60 IN SVCB 1 . alpn=dot`)
+	endpoints, err = u.(*dnsDiscovery).getEndpoints()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"tls://example.net"}, endpointAddrs(endpoints))
+}
+
+func TestDiscoverySRV(t *testing.T) {
+	s, addr := startTestDiscoveryServer(t)
+	s.setRecords("_domain-s._tcp.example.net.",
+		"_domain-s._tcp.example.net. 60 IN SRV 20 0 853 dns2.example.net.",
+		"_domain-s._tcp.example.net. 60 IN SRV 10 0 8853 dns1.example.net.",
+	)
+
+	u, err := AddressToUpstream("srv://_domain-s._tcp.example.net", Options{Bootstrap: []string{addr}, Timeout: time.Second})
+	assert.Nil(t, err)
+	assert.Equal(t, "srv://_domain-s._tcp.example.net", u.Address())
+
+	endpoints, err := u.(*dnsDiscovery).getEndpoints()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"tls://dns1.example.net:8853", "tls://dns2.example.net:853"}, endpointAddrs(endpoints))
+
+	// Nothing to exchange with if there are no records
+	u, err = AddressToUpstream("srv://_domain-s._tcp.example.org", Options{Bootstrap: []string{addr}, Timeout: time.Second})
+	assert.Nil(t, err)
+	_, err = u.Exchange(createTestMessage())
+	assert.NotNil(t, err)
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 	"golang.org/x/net/http2"
@@ -34,17 +35,31 @@ type dnsOverHTTPS struct {
 
 func (p *dnsOverHTTPS) Address() string { return p.boot.address }
 
+// Close implements the io.Closer interface for *dnsOverHTTPS.  It closes the
+// idle connections of the HTTP client.
+func (p *dnsOverHTTPS) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client != nil {
+		p.client.CloseIdleConnections()
+	}
+
+	return nil
+}
+
 func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (*dns.Msg, error) {
 	client, err := p.getClient()
 	if err != nil {
 		return nil, errorx.Decorate(err, "couldn't initialize HTTP client or transport")
 	}
 
-	logBegin(p.Address(), m)
-	r, err := p.exchangeHTTPSClient(m, client)
+	req, addedOPT := padQuery(m)
+	logBegin(p.Address(), req)
+	r, err := p.exchangeHTTPSClient(req, client)
 	logFinish(p.Address(), err)
 
-	return r, err
+	return unpadReply(r, addedOPT), err
 }
 
 // exchangeHTTPSClient sends the DNS query to a DOH resolver using the specified
@@ -79,15 +94,14 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(m *dns.Msg, client *http.Client) (*dn
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("got an unexpected HTTP status code %d from '%s'", resp.StatusCode, p.boot.address)
 	}
-	response := dns.Msg{}
-	err = response.Unpack(body)
+	response, err := proxyutil.UnpackMsg(body)
 	if err != nil {
 		return nil, errorx.Decorate(err, "couldn't unpack DNS response from '%s': body is %s", p.boot.address, string(body))
 	}
 	if err == nil && response.Id != m.Id {
 		err = dns.ErrId
 	}
-	return &response, err
+	return response, err
 }
 
 // getClient gets or lazily initializes an HTTP client (and transport) that will
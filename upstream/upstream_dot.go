@@ -21,7 +21,27 @@ type dnsOverTLS struct {
 
 func (p *dnsOverTLS) Address() string { return p.boot.address }
 
+// Close implements the io.Closer interface for *dnsOverTLS.  It closes the
+// pooled connections.
+func (p *dnsOverTLS) Close() error {
+	p.RLock()
+	defer p.RUnlock()
+
+	if p.pool == nil {
+		return nil
+	}
+
+	return p.pool.Close()
+}
+
 func (p *dnsOverTLS) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	req, addedOPT := padQuery(m)
+	reply, err := p.exchange(req)
+	return unpadReply(reply, addedOPT), err
+}
+
+// exchange sends the padded query using a pooled connection
+func (p *dnsOverTLS) exchange(m *dns.Msg) (*dns.Msg, error) {
 	var pool *TLSPool
 	p.RLock()
 	pool = p.pool
@@ -79,7 +99,7 @@ func (p *dnsOverTLS) exchangeConn(poolConn net.Conn, m *dns.Msg) (*dns.Msg, erro
 		return nil, errorx.Decorate(err, "Failed to send a request to %s", p.Address())
 	}
 
-	reply, err := c.ReadMsg()
+	reply, err := readReply(&c)
 	if err != nil {
 		poolConn.Close()
 		return nil, errorx.Decorate(err, "Failed to read a request from %s", p.Address())
@@ -0,0 +1,157 @@
+package upstream
+
+import (
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+const (
+	// mdnsPort is the port of the Multicast DNS responders
+	mdnsPort = "5353"
+
+	// mdnsTimeout is the max time the responses to a Multicast DNS query are
+	// waited for.  There are no negative answers in Multicast DNS, so the
+	// query for a name nobody has takes all of it.
+	mdnsTimeout = time.Second
+
+	// mdnsCacheFlush is the cache-flush bit of the record class
+	mdnsCacheFlush = 1 << 15
+)
+
+// mdnsGroup is the IPv4 Multicast DNS group address
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdns sends one-shot Multicast DNS queries (RFC 6762, section 5.1) to the
+// multicast group or to a single responder, e.g. the one of the LAN's router.
+// The responders answer such queries directly with unicast.
+type mdns struct {
+	address string // address of the responder, empty for the multicast group
+	timeout time.Duration
+}
+
+// newMDNS returns the Multicast DNS upstream for the mdns:// URL host, which
+// may be empty
+func newMDNS(host string, timeout time.Duration) (*mdns, error) {
+	if host == "" {
+		return &mdns{timeout: timeout}, nil
+	}
+
+	host, port, err := parseHostAndPort(host)
+	if err != nil {
+		return nil, err
+	}
+	if port == "" {
+		port = mdnsPort
+	}
+
+	return &mdns{address: net.JoinHostPort(host, port), timeout: timeout}, nil
+}
+
+// Address implements the Upstream interface for *mdns
+func (u *mdns) Address() string {
+	return "mdns://" + u.address
+}
+
+// Exchange implements the Upstream interface for *mdns.  The first response
+// to the query is returned.  If nobody answers, the response is empty, as the
+// name may have the records of the other types.
+func (u *mdns) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	logBegin(u.Address(), m)
+	reply, err := u.exchange(m)
+	logFinish(u.Address(), err)
+
+	return reply, err
+}
+
+// exchange sends the query and waits for the response
+func (u *mdns) exchange(m *dns.Msg) (*dns.Msg, error) {
+	dst, network := mdnsGroup, "udp4"
+	if u.address != "" {
+		addr, err := net.ResolveUDPAddr("udp", u.address)
+		if err != nil {
+			return nil, errorx.Decorate(err, "resolving %s", u.address)
+		}
+		dst, network = addr, "udp"
+	}
+
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, errorx.Decorate(err, "packing mdns query")
+	}
+
+	// The source port must not be 5353, so that the responders answer with
+	// unicast and repeat the ID and the question
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, errorx.Decorate(err, "opening mdns socket")
+	}
+	defer conn.Close()
+
+	timeout := mdnsTimeout
+	if u.timeout > 0 && u.timeout < timeout {
+		timeout = u.timeout
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	_, err = conn.WriteTo(packed, dst)
+	if err != nil {
+		return nil, errorx.Decorate(err, "sending mdns query to %s", dst)
+	}
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				reply := &dns.Msg{}
+				reply.SetReply(m)
+				return reply, nil
+			}
+
+			return nil, errorx.Decorate(err, "reading mdns response")
+		}
+
+		reply, err := proxyutil.UnpackMsg(buf[:n])
+		if err != nil || !isMDNSReply(m, reply) {
+			continue
+		}
+
+		return toUnicastReply(m, reply), nil
+	}
+}
+
+// isMDNSReply returns true if reply is the response to the query m.  The
+// legacy responders may not repeat the question.
+func isMDNSReply(m, reply *dns.Msg) bool {
+	if !reply.Response || reply.Id != m.Id {
+		return false
+	}
+
+	if len(reply.Question) == 0 {
+		return true
+	}
+
+	q, rq := m.Question[0], reply.Question[0]
+	return q.Qtype == rq.Qtype && dns.CanonicalName(q.Name) == dns.CanonicalName(rq.Name)
+}
+
+// toUnicastReply makes the Multicast DNS response to m a unicast DNS one: it
+// has the question of m and no cache-flush bits
+func toUnicastReply(m, reply *dns.Msg) *dns.Msg {
+	reply.Question = append([]dns.Question(nil), m.Question...)
+	reply.RecursionDesired = m.RecursionDesired
+
+	for _, rrs := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Class &^= mdnsCacheFlush
+			}
+		}
+	}
+
+	return reply
+}
@@ -0,0 +1,103 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMDNS(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	// A legacy responder that doesn't repeat the question and sets the
+	// cache-flush bits
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			req := &dns.Msg{}
+			if req.Unpack(buf[:n]) != nil {
+				continue
+			}
+
+			res := &dns.Msg{}
+			res.Id = req.Id
+			res.Response = true
+			res.Authoritative = true
+			res.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeA, Class: dns.ClassINET | mdnsCacheFlush, Ttl: 120},
+				A:   net.IP{192, 168, 1, 10},
+			}}
+			packed, _ := res.Pack()
+			_, _ = conn.WriteTo(packed, addr)
+		}
+	}()
+
+	u, err := AddressToUpstream("mdns://"+conn.LocalAddr().String(), Options{Timeout: time.Second})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "mdns://"+conn.LocalAddr().String(), u.Address())
+
+	req := &dns.Msg{}
+	req.SetQuestion("printer.local.", dns.TypeA)
+	req.RecursionDesired = true
+
+	res, err := u.Exchange(req)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, req.Id, res.Id)
+	assert.Equal(t, req.Question, res.Question)
+	assert.True(t, res.RecursionDesired)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, uint16(dns.ClassINET), res.Answer[0].Header().Class)
+		assert.Equal(t, "192.168.1.10", res.Answer[0].(*dns.A).A.String())
+	}
+}
+
+func TestMDNSNoAnswer(t *testing.T) {
+	// Nobody answers there
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	u, err := newMDNS(conn.LocalAddr().String(), 100*time.Millisecond)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("nobody.local.", dns.TypeA)
+
+	res, err := u.Exchange(req)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Equal(t, req.Id, res.Id)
+	assert.Empty(t, res.Answer)
+}
+
+func TestNewMDNS(t *testing.T) {
+	u, err := newMDNS("", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "mdns://", u.Address())
+
+	u, err = newMDNS("192.168.1.1", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "mdns://192.168.1.1:5353", u.Address())
+}
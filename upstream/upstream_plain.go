@@ -24,11 +24,16 @@ func (p *plainDNS) Address() string {
 	return p.address
 }
 
+// Timeout returns the timeout of the exchanges
+func (p *plainDNS) Timeout() time.Duration {
+	return p.timeout
+}
+
 func (p *plainDNS) Exchange(m *dns.Msg) (*dns.Msg, error) {
 	if p.preferTCP {
 		tcpClient := dns.Client{Net: "tcp", Timeout: p.timeout}
 		logBegin(p.Address(), m)
-		reply, _, tcpErr := tcpClient.Exchange(m, p.address)
+		reply, tcpErr := exchangeClient(&tcpClient, m, p.address)
 		logFinish(p.Address(), tcpErr)
 		return reply, tcpErr
 	}
@@ -36,14 +41,14 @@ func (p *plainDNS) Exchange(m *dns.Msg) (*dns.Msg, error) {
 	client := dns.Client{Timeout: p.timeout, UDPSize: dns.MaxMsgSize}
 
 	logBegin(p.Address(), m)
-	reply, _, err := client.Exchange(m, p.address)
+	reply, err := exchangeClient(&client, m, p.address)
 	logFinish(p.Address(), err)
 
 	if reply != nil && reply.Truncated {
 		log.Tracef("Truncated message was received, retrying over TCP, question: %s", m.Question[0].String())
 		tcpClient := dns.Client{Net: "tcp", Timeout: p.timeout}
 		logBegin(p.Address(), m)
-		reply, _, err = tcpClient.Exchange(m, p.address)
+		reply, err = exchangeClient(&tcpClient, m, p.address)
 		logFinish(p.Address(), err)
 	}
 
@@ -1,9 +1,14 @@
 package upstream
 
 import (
+	"encoding/binary"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestDNSTruncated(t *testing.T) {
@@ -30,3 +35,52 @@ func TestDNSTruncated(t *testing.T) {
 		t.Fatalf("response must NOT be truncated")
 	}
 }
+
+func TestPlainDNSCraftedReply(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	// The server first answers with a stale ID and then with the reply
+	// whose answer's owner name points to itself
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			req := &dns.Msg{}
+			if req.Unpack(buf[:n]) != nil {
+				continue
+			}
+
+			stale := &dns.Msg{}
+			stale.SetReply(req)
+			stale.Id = req.Id + 1
+			b, _ := stale.Pack()
+			_, _ = conn.WriteTo(b, addr)
+
+			res := &dns.Msg{}
+			res.SetReply(req)
+			b, _ = res.Pack()
+			binary.BigEndian.PutUint16(b[6:], 1)
+			ptr := len(b)
+			b = append(b, 0xC0|byte(ptr>>8), byte(ptr), 0, 1, 0, 1, 0, 0, 0, 0, 0, 0)
+			_, _ = conn.WriteTo(b, addr)
+		}
+	}()
+
+	u, err := AddressToUpstream(conn.LocalAddr().String(), Options{Timeout: time.Second})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	_, err = u.Exchange(req)
+	assert.Equal(t, proxyutil.ErrBadName, err)
+}
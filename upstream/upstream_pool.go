@@ -89,6 +89,21 @@ func (n *TLSPool) Put(c net.Conn) {
 	n.connsMutex.Unlock()
 }
 
+// Close closes the pooled connections.  The pool can still be used, the new
+// connections are created then.
+func (n *TLSPool) Close() error {
+	n.connsMutex.Lock()
+	conns := n.conns
+	n.conns = nil
+	n.connsMutex.Unlock()
+
+	for _, c := range conns {
+		_ = c.Close()
+	}
+
+	return nil
+}
+
 // tlsDial is basically the same as tls.DialWithDialer, but we will call our own dialContext function to get connection
 func tlsDial(dialContext dialHandler, network string, config *tls.Config) (*tls.Conn, error) {
 	// we're using bootstrapped address instead of what's passed to the function
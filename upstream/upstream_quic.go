@@ -7,6 +7,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/joomcode/errorx"
 
 	"github.com/miekg/dns"
@@ -29,18 +30,45 @@ type dnsOverQUIC struct {
 
 func (p *dnsOverQUIC) Address() string { return p.boot.address }
 
+// Close implements the io.Closer interface for *dnsOverQUIC.  It closes the
+// session, the next exchange opens a new one.
+func (p *dnsOverQUIC) Close() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.session == nil {
+		return nil
+	}
+
+	err := p.session.CloseWithError(0, "")
+	p.session = nil
+
+	return err
+}
+
 func (p *dnsOverQUIC) Exchange(m *dns.Msg) (*dns.Msg, error) {
 	session, err := p.getSession(true)
 	if err != nil {
 		return nil, err
 	}
 
+	if m.Opcode != dns.OpcodeQuery {
+		// Only the queries are safe to be sent in 0-RTT data as they're
+		// idempotent and the replay doesn't harm.  The other messages,
+		// e.g. dynamic updates, wait for the handshake.
+		err = waitHandshake(session)
+		if err != nil {
+			return nil, errorx.Decorate(err, "failed to complete handshake with %s", p.Address())
+		}
+	}
+
 	stream, err := p.openStream(session)
 	if err != nil {
 		return nil, errorx.Decorate(err, "failed to open new stream to %s", p.Address())
 	}
 
-	buf, err := m.Pack()
+	req, addedOPT := padQuery(m)
+	buf, err := req.Pack()
 	if err != nil {
 		return nil, err
 	}
@@ -70,13 +98,12 @@ func (p *dnsOverQUIC) Exchange(m *dns.Msg) (*dns.Msg, error) {
 		return nil, errorx.Decorate(err, "failed to read response from %s due to %v", p.Address(), err)
 	}
 
-	reply := new(dns.Msg)
-	err = reply.Unpack(respBuf)
+	reply, err := proxyutil.UnpackMsg(respBuf[:n])
 	if err != nil {
 		return nil, errorx.Decorate(err, "failed to unpack response from %s", p.Address())
 	}
 
-	return reply, nil
+	return unpadReply(reply, addedOPT), nil
 }
 
 func (p *dnsOverQUIC) getBytesPool() *sync.Pool {
@@ -178,10 +205,40 @@ func (p *dnsOverQUIC) openSession() (quic.Session, error) {
 	quicConfig := &quic.Config{
 		HandshakeTimeout: handshakeTimeout,
 	}
-	session, err := quic.DialAddrContext(context.Background(), addr, tlsConfig, quicConfig)
+	// The early session sends the queries in 0-RTT data if the TLS session
+	// of the upstream can be resumed
+	session, err := quic.DialAddrEarlyContext(context.Background(), addr, tlsConfig, quicConfig)
 	if err != nil {
 		return nil, errorx.Decorate(err, "failed to open QUIC session to %s", p.Address())
 	}
 
+	// quic-go ignores VerifyConnection, so the session is verified before
+	// any query is sent, giving up 0-RTT
+	if tlsConfig.VerifyConnection != nil {
+		err = waitHandshake(session)
+		if err == nil {
+			err = tlsConfig.VerifyConnection(session.ConnectionState().ConnectionState)
+		}
+		if err != nil {
+			_ = session.CloseWithError(0, "")
+			return nil, errorx.Decorate(err, "failed to verify QUIC session to %s", p.Address())
+		}
+	}
+
 	return session, nil
 }
+
+// waitHandshake blocks until the handshake of the early session is completed
+func waitHandshake(session quic.Session) error {
+	es, ok := session.(quic.EarlySession)
+	if !ok {
+		return nil
+	}
+
+	select {
+	case <-es.HandshakeComplete().Done():
+		return nil
+	case <-es.Context().Done():
+		return es.Context().Err()
+	}
+}
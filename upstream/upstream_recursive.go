@@ -0,0 +1,557 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// rootHints are the IPv4 addresses of the root servers, a to m, see
+// https://www.iana.org/domains/root/servers
+var rootHints = []string{
+	"198.41.0.4",
+	"199.9.14.201",
+	"192.33.4.12",
+	"199.7.91.13",
+	"192.203.230.10",
+	"192.5.5.241",
+	"192.112.36.4",
+	"198.97.190.53",
+	"192.36.148.17",
+	"192.58.128.30",
+	"193.0.14.129",
+	"199.7.83.42",
+	"202.12.27.33",
+}
+
+const (
+	// recursiveMaxReferrals is the max number of the referrals followed
+	// resolving a name, not counting the ones for the name servers' addresses
+	recursiveMaxReferrals = 32
+
+	// recursiveMaxMinimise is the max number of the minimised queries a name
+	// is resolved with, MAX_MINIMISE_COUNT of RFC 9156.  The full name is
+	// asked then.
+	recursiveMaxMinimise = 10
+
+	// recursiveMinimiseOneLabel is the number of the first minimised queries
+	// that reveal one more label each, MINIMISE_ONE_LAB of RFC 9156.  The
+	// next ones reveal the rest of the labels evenly.
+	recursiveMinimiseOneLabel = 4
+
+	// recursiveMaxDepth is the max length of the CNAME chains plus the
+	// nesting of the name servers' address lookups
+	recursiveMaxDepth = 8
+
+	// recursiveMaxServers is the max number of the name servers of a zone
+	// a query is sent to before giving up
+	recursiveMaxServers = 3
+
+	// recursiveTimeout is the timeout of a single query if none is set
+	recursiveTimeout = 2 * time.Second
+
+	// recursiveMaxTime is the max time of resolving a request if the
+	// upstream's timeout isn't set
+	recursiveMaxTime = 10 * time.Second
+
+	// recursiveMaxDelegations is the max number of the cached delegations
+	recursiveMaxDelegations = 10000
+
+	// recursiveUDPSize is the UDP payload size the name servers are asked to
+	// respect, the one recommended by the DNS flag day 2020
+	recursiveUDPSize = 1232
+)
+
+// recursive resolves the requests itself starting from the root servers
+// instead of forwarding them.  The names are minimised (RFC 7816, RFC 9156):
+// each name server only sees the labels of the name one below its zone.
+type recursive struct {
+	address string   // address of the root server, empty for the root hints
+	roots   []string // addresses of the root servers
+	port    string   // port of the name servers
+	timeout time.Duration
+	qmin    bool // if true, the names are minimised
+
+	// delegations are the cached name servers of the zones
+	delegations     map[string]*delegation
+	delegationsLock sync.Mutex
+}
+
+// delegation is the cached addresses of a zone's name servers
+type delegation struct {
+	servers []string
+	expire  time.Time
+}
+
+// newRecursive returns the recursive upstream for the recursive:// URL.  The
+// host of the URL replaces the root hints, the name servers are queried on
+// its port then.  "?qmin=0" disables the QNAME minimisation.
+func newRecursive(u *url.URL, timeout time.Duration) (*recursive, error) {
+	r := &recursive{
+		port:        "53",
+		timeout:     timeout,
+		qmin:        u.Query().Get("qmin") != "0",
+		delegations: map[string]*delegation{},
+	}
+
+	if u.Host == "" {
+		for _, ip := range rootHints {
+			r.roots = append(r.roots, net.JoinHostPort(ip, r.port))
+		}
+
+		return r, nil
+	}
+
+	host, port, err := parseHostAndPort(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("root server must be an IP address: %s", u.Host)
+	}
+	if port != "" {
+		r.port = port
+	}
+
+	r.address = net.JoinHostPort(host, r.port)
+	r.roots = []string{r.address}
+
+	return r, nil
+}
+
+// Address implements the Upstream interface for *recursive
+func (u *recursive) Address() string {
+	return "recursive://" + u.address
+}
+
+// Exchange implements the Upstream interface for *recursive
+func (u *recursive) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	logBegin(u.Address(), m)
+	reply, err := u.exchange(m)
+	logFinish(u.Address(), err)
+
+	return reply, err
+}
+
+// exchange resolves the question of m
+func (u *recursive) exchange(m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) != 1 {
+		return nil, errors.New("request must have exactly one question")
+	}
+
+	timeout := u.timeout
+	if timeout <= 0 {
+		timeout = recursiveMaxTime
+	}
+
+	res, err := u.resolve(m.Question[0], 0, time.Now().Add(timeout))
+	if err != nil {
+		return nil, errorx.Decorate(err, "resolving %s", m.Question[0].Name)
+	}
+
+	reply := &dns.Msg{}
+	reply.SetRcode(m, res.Rcode)
+	reply.RecursionAvailable = true
+	reply.Answer = res.Answer
+	reply.Ns = res.Ns
+
+	return reply, nil
+}
+
+// resolve resolves the question following the CNAME chain.  depth is the
+// nesting of the lookup, deadline is the one of the whole resolution.
+func (u *recursive) resolve(q dns.Question, depth int, deadline time.Time) (*dns.Msg, error) {
+	var cnames []dns.RR
+	for {
+		if depth > recursiveMaxDepth {
+			return nil, errors.New("too deep recursion")
+		}
+
+		res, err := u.iterate(q, depth, deadline)
+		if err != nil {
+			return nil, err
+		}
+
+		target := cnameTarget(res, q)
+		if target == "" {
+			res.Answer = append(cnames, res.Answer...)
+			return res, nil
+		}
+
+		cnames = append(cnames, res.Answer...)
+		q.Name = target
+		depth++
+	}
+}
+
+// cnameTarget returns the name the CNAME chain of the answer to q ends with
+// if there are no records for it in the answer or ""
+func cnameTarget(res *dns.Msg, q dns.Question) string {
+	if q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeANY || res.Rcode != dns.RcodeSuccess {
+		return ""
+	}
+
+	name := dns.CanonicalName(q.Name)
+	for i := 0; i <= len(res.Answer); i++ {
+		next := ""
+		for _, rr := range res.Answer {
+			if dns.CanonicalName(rr.Header().Name) != name {
+				continue
+			}
+
+			if rr.Header().Rrtype == q.Qtype {
+				return ""
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = dns.CanonicalName(cname.Target)
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		name = next
+	}
+
+	if name == dns.CanonicalName(q.Name) {
+		return ""
+	}
+
+	return name
+}
+
+// iterate follows the referrals from the closest known zone of the name down
+// to its authoritative name servers and returns their response
+func (u *recursive) iterate(q dns.Question, depth int, deadline time.Time) (*dns.Msg, error) {
+	name := dns.CanonicalName(q.Name)
+	zone, servers := u.closestDelegation(name)
+
+	labels := dns.CountLabel(name)
+	n := dns.CountLabel(zone) + 1
+	qmin := u.qmin
+	minimised, referrals := 0, 0
+	for {
+		// Only the next labels of the name are revealed to the zone's
+		// servers, with the A type, as many of them don't handle the NS one
+		// well
+		qname, qtype := name, q.Qtype
+		if qmin && n < labels && minimised < recursiveMaxMinimise {
+			qname, qtype = lastLabels(name, n), dns.TypeA
+			minimised++
+		}
+
+		res, err := u.query(servers, qname, qtype, q.Qclass, deadline)
+		if err != nil {
+			if qname == name {
+				return nil, err
+			}
+
+			// Some name servers fail for the empty non-terminals, so the
+			// full name is asked then
+			qmin = false
+			continue
+		}
+
+		child, ns := referral(res, zone, name)
+		if child != "" {
+			referrals++
+			if referrals > recursiveMaxReferrals {
+				return nil, errors.New("too many referrals")
+			}
+
+			servers, err = u.nsAddrs(res, zone, ns, depth, deadline)
+			if err != nil {
+				return nil, errorx.Decorate(err, "resolving name servers of %s", child)
+			}
+
+			u.cacheDelegation(child, servers, ns)
+			zone, n = child, dns.CountLabel(child)+1
+			continue
+		}
+
+		if qname == name {
+			removeOutOfZone(res, zone)
+			return res, nil
+		}
+
+		// The minimised name isn't a zone cut.  Some name servers answer
+		// NXDOMAIN for the empty non-terminals, so the full name is asked
+		// then.
+		if res.Rcode != dns.RcodeSuccess {
+			qmin = false
+		} else {
+			n = minimisedLabels(n, labels, minimised)
+		}
+	}
+}
+
+// minimisedLabels returns the number of the labels of the name revealed by
+// the next minimised query after the minimised ones, the last of which
+// revealed n labels
+func minimisedLabels(n, labels, minimised int) int {
+	if minimised < recursiveMinimiseOneLabel || minimised >= recursiveMaxMinimise {
+		return n + 1
+	}
+
+	step := (labels - n) / (recursiveMaxMinimise - minimised)
+	if step < 1 {
+		step = 1
+	}
+
+	return n + step
+}
+
+// removeOutOfZone removes the records outside of the zone the response came
+// from, since its name servers aren't authoritative for them
+func removeOutOfZone(res *dns.Msg, zone string) {
+	inZone := func(rrs []dns.RR) []dns.RR {
+		var filtered []dns.RR
+		for _, rr := range rrs {
+			if dns.IsSubDomain(zone, dns.CanonicalName(rr.Header().Name)) {
+				filtered = append(filtered, rr)
+			} else {
+				log.Debug("recursive: dropping %s from the response of %s", rr.Header().Name, zone)
+			}
+		}
+
+		return filtered
+	}
+
+	res.Answer = inZone(res.Answer)
+	res.Ns = inZone(res.Ns)
+}
+
+// lastLabels returns the last n labels of the canonical name
+func lastLabels(name string, n int) string {
+	idx := dns.Split(name)
+	if n >= len(idx) {
+		return name
+	}
+
+	return name[idx[len(idx)-n]:]
+}
+
+// referral returns the child zone of zone the response delegates name to
+// and its NS records or "" if the response isn't a referral
+func referral(res *dns.Msg, zone, name string) (child string, ns []*dns.NS) {
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 0 {
+		return "", nil
+	}
+
+	for _, rr := range res.Ns {
+		r, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		owner := dns.CanonicalName(r.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+
+		if child == "" {
+			child = owner
+		}
+		if owner == child {
+			ns = append(ns, r)
+		}
+	}
+
+	return child, ns
+}
+
+// nsAddrs returns the addresses of the name servers from the glue records of
+// the referral from zone or resolves them.  The glue records outside of zone
+// are ignored.
+func (u *recursive) nsAddrs(res *dns.Msg, zone string, ns []*dns.NS, depth int, deadline time.Time) ([]string, error) {
+	var v4, v6 []string
+	for _, n := range ns {
+		target := dns.CanonicalName(n.Ns)
+		if !dns.IsSubDomain(zone, target) {
+			continue
+		}
+
+		for _, rr := range res.Extra {
+			if dns.CanonicalName(rr.Header().Name) != target {
+				continue
+			}
+
+			switch rr := rr.(type) {
+			case *dns.A:
+				v4 = append(v4, net.JoinHostPort(rr.A.String(), u.port))
+			case *dns.AAAA:
+				v6 = append(v6, net.JoinHostPort(rr.AAAA.String(), u.port))
+			}
+		}
+	}
+
+	// IPv4 is preferred, as the host may not have the IPv6 connectivity
+	if addrs := append(v4, v6...); len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	var lastErr error
+	for _, n := range ns {
+		q := dns.Question{Name: n.Ns, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		r, err := u.resolve(q, depth+1, deadline)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var addrs []string
+		for _, rr := range r.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, net.JoinHostPort(a.A.String(), u.port))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+
+	return nil, errors.New("no addresses of name servers")
+}
+
+// query sends the non-recursive query to the servers in a random order until
+// one of them answers or the deadline is reached
+func (u *recursive) query(servers []string, name string, qtype, qclass uint16, deadline time.Time) (*dns.Msg, error) {
+	m := &dns.Msg{}
+	m.SetQuestion(name, qtype)
+	m.Question[0].Qclass = qclass
+	m.RecursionDesired = false
+	m.SetEdns0(recursiveUDPSize, false)
+
+	timeout := u.timeout
+	if timeout <= 0 || timeout > recursiveTimeout {
+		timeout = recursiveTimeout
+	}
+
+	var lastErr error
+	perm := rand.Perm(len(servers))
+	for i := 0; i < len(perm) && i < recursiveMaxServers; i++ {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, errors.New("resolution timed out")
+		}
+
+		addr := servers[perm[i]]
+		log.Tracef("recursive: asking %s about %s %s", addr, dns.Type(qtype), name)
+
+		t := timeout
+		if t > left {
+			t = left
+		}
+
+		client := &dns.Client{Net: "udp", Timeout: t, UDPSize: recursiveUDPSize}
+		res, err := exchangeClient(client, m, addr)
+		if err == nil && res.Truncated {
+			client.Net = "tcp"
+			res, err = exchangeClient(client, m, addr)
+		}
+
+		if err != nil {
+			lastErr = errorx.Decorate(err, "querying %s", addr)
+			continue
+		}
+		if res.Rcode == dns.RcodeServerFailure || res.Rcode == dns.RcodeRefused {
+			lastErr = fmt.Errorf("%s answered %s", addr, dns.RcodeToString[res.Rcode])
+			continue
+		}
+
+		return res, nil
+	}
+
+	return nil, lastErr
+}
+
+// closestDelegation returns the closest enclosing zone of the name the name
+// servers of which are known and their addresses
+func (u *recursive) closestDelegation(name string) (zone string, servers []string) {
+	u.delegationsLock.Lock()
+	defer u.delegationsLock.Unlock()
+
+	now := time.Now()
+	for zone = name; zone != "."; zone = parentZone(zone) {
+		d, ok := u.delegations[zone]
+		if !ok {
+			continue
+		}
+		if now.After(d.expire) {
+			delete(u.delegations, zone)
+			continue
+		}
+
+		return zone, d.servers
+	}
+
+	return ".", u.roots
+}
+
+// cacheDelegation caches the addresses of the zone's name servers for the
+// lowest TTL of the NS records
+func (u *recursive) cacheDelegation(zone string, servers []string, ns []*dns.NS) {
+	ttl := ns[0].Hdr.Ttl
+	for _, r := range ns {
+		if r.Hdr.Ttl < ttl {
+			ttl = r.Hdr.Ttl
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+
+	u.delegationsLock.Lock()
+	defer u.delegationsLock.Unlock()
+
+	now := time.Now()
+	if _, ok := u.delegations[zone]; !ok && len(u.delegations) >= recursiveMaxDelegations {
+		u.evictDelegations(now)
+	}
+
+	u.delegations[zone] = &delegation{
+		servers: servers,
+		expire:  now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// evictDelegations removes the expired delegations or, if there are none, a
+// random one.  u.delegationsLock must be held.
+func (u *recursive) evictDelegations(now time.Time) {
+	for zone, d := range u.delegations {
+		if now.After(d.expire) {
+			delete(u.delegations, zone)
+		}
+	}
+	if len(u.delegations) < recursiveMaxDelegations {
+		return
+	}
+
+	for zone := range u.delegations {
+		delete(u.delegations, zone)
+		return
+	}
+}
+
+// parentZone returns the parent of the canonical name
+func parentZone(name string) string {
+	i := strings.IndexByte(name, '.')
+	if i < 0 || i == len(name)-1 {
+		return "."
+	}
+
+	return name[i+1:]
+}
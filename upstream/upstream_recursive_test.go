@@ -0,0 +1,336 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testZone is an authoritative name server of a zone for the recursive
+// upstream tests
+type testZone struct {
+	name     string
+	children map[string]string // child zone -> address of its name server
+	records  []dns.RR
+
+	queries     []string
+	forged      []dns.RR // added to every answer, e.g. the out-of-zone ones
+	queriesLock sync.Mutex
+}
+
+// ServeDNS implements the dns.Handler interface for *testZone
+func (z *testZone) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	z.queriesLock.Lock()
+	z.queries = append(z.queries, q.Name)
+	forged := z.forged
+	z.queriesLock.Unlock()
+
+	res := &dns.Msg{}
+	res.SetReply(r)
+
+	for child, ip := range z.children {
+		if dns.IsSubDomain(child, q.Name) {
+			ns := "ns." + child
+			res.Ns = []dns.RR{&dns.NS{
+				Hdr: dns.RR_Header{Name: child, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
+				Ns:  ns,
+			}}
+			res.Extra = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: ns, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+				A:   net.ParseIP(ip),
+			}}
+			_ = w.WriteMsg(res)
+			return
+		}
+	}
+
+	res.Authoritative = true
+	exists := false
+	for _, rr := range z.records {
+		owner := rr.Header().Name
+		if dns.IsSubDomain(q.Name, owner) {
+			exists = true
+		}
+		if owner == q.Name && (rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME) {
+			res.Answer = append(res.Answer, rr)
+		}
+	}
+
+	if len(res.Answer) > 0 {
+		res.Answer = append(res.Answer, forged...)
+	} else {
+		if !exists {
+			res.Rcode = dns.RcodeNameError
+		}
+		res.Ns = []dns.RR{&dns.SOA{
+			Hdr:    dns.RR_Header{Name: z.name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:     "ns." + z.name,
+			Mbox:   "admin." + z.name,
+			Minttl: 300,
+		}}
+	}
+
+	_ = w.WriteMsg(res)
+}
+
+// takeQueries returns the names the zone's server has been asked about and
+// forgets them
+func (z *testZone) takeQueries() []string {
+	z.queriesLock.Lock()
+	defer z.queriesLock.Unlock()
+
+	q := z.queries
+	z.queries = nil
+
+	return q
+}
+
+// testLongName is the name with as many labels as the ip6.arpa ones
+var testLongName = strings.Repeat("a.", 32) + "example.org."
+
+// setForged sets the records added to every answer of the zone's server
+func (z *testZone) setForged(rrs ...dns.RR) {
+	z.queriesLock.Lock()
+	defer z.queriesLock.Unlock()
+
+	z.forged = rrs
+}
+
+// startTestZones starts the name servers of the root, org., and example.org.
+// zones on the same port of the different loopback addresses and returns
+// them and the port
+func startTestZones(t *testing.T) (root, org, example *testZone, port string) {
+	root = &testZone{name: ".", children: map[string]string{"org.": "127.0.0.2"}}
+	org = &testZone{name: "org.", children: map[string]string{"example.org.": "127.0.0.3"}}
+	example = &testZone{name: "example.org.", records: []dns.RR{
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "www.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IP{1, 2, 3, 4},
+		},
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "alias.a.b.example.org.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: "www.example.org.",
+		},
+		&dns.A{
+			Hdr: dns.RR_Header{Name: testLongName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IP{1, 2, 3, 5},
+		},
+	}}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	_, port, _ = net.SplitHostPort(conn.LocalAddr().String())
+
+	conns := []net.PacketConn{conn}
+	for _, ip := range []string{"127.0.0.2", "127.0.0.3"} {
+		c, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+		if err != nil {
+			for _, c := range conns {
+				_ = c.Close()
+			}
+			t.Skipf("cannot listen on %s: %s", ip, err)
+		}
+		conns = append(conns, c)
+	}
+
+	for i, z := range []*testZone{root, org, example} {
+		srv := &dns.Server{PacketConn: conns[i], Handler: z}
+		go func() {
+			_ = srv.ActivateAndServe()
+		}()
+		t.Cleanup(func() {
+			_ = srv.Shutdown()
+		})
+	}
+
+	return root, org, example, port
+}
+
+func TestRecursive(t *testing.T) {
+	root, org, example, port := startTestZones(t)
+
+	u, err := AddressToUpstream("recursive://127.0.0.1:"+port, Options{Timeout: time.Second})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "recursive://127.0.0.1:"+port, u.Address())
+
+	req := &dns.Msg{}
+	req.SetQuestion("alias.a.b.example.org.", dns.TypeA)
+	res, err := u.Exchange(req)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, req.Id, res.Id)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.True(t, res.RecursionAvailable)
+	if assert.Len(t, res.Answer, 2) {
+		assert.Equal(t, "www.example.org.", res.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, "1.2.3.4", res.Answer[1].(*dns.A).A.String())
+	}
+
+	// Each server only sees the next label, the empty non-terminals are
+	// walked through one by one
+	assert.Equal(t, []string{"org."}, root.takeQueries())
+	assert.Equal(t, []string{"example.org."}, org.takeQueries())
+	assert.Equal(t, []string{
+		"b.example.org.",
+		"a.b.example.org.",
+		"alias.a.b.example.org.",
+		"www.example.org.",
+	}, example.takeQueries())
+
+	// The delegations are cached
+	req.SetQuestion("nonexistent.example.org.", dns.TypeA)
+	res, err = u.Exchange(req)
+	if assert.Nil(t, err) {
+		assert.Equal(t, dns.RcodeNameError, res.Rcode)
+		assert.Len(t, res.Ns, 1)
+	}
+	assert.Empty(t, root.takeQueries())
+	assert.Empty(t, org.takeQueries())
+	assert.Equal(t, []string{"nonexistent.example.org."}, example.takeQueries())
+}
+
+func TestRecursiveNoQNameMinimisation(t *testing.T) {
+	root, org, _, port := startTestZones(t)
+
+	u, err := AddressToUpstream("recursive://127.0.0.1:"+port+"?qmin=0", Options{Timeout: time.Second})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	res, err := u.Exchange(req)
+	if assert.Nil(t, err) && assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "1.2.3.4", res.Answer[0].(*dns.A).A.String())
+	}
+	assert.Equal(t, []string{"www.example.org."}, root.takeQueries())
+	assert.Equal(t, []string{"www.example.org."}, org.takeQueries())
+}
+
+func TestNewRecursive(t *testing.T) {
+	r, err := newRecursive(&url.URL{Scheme: "recursive"}, 0)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "recursive://", r.Address())
+		assert.Len(t, r.roots, len(rootHints))
+		assert.True(t, r.qmin)
+	}
+
+	r, err = newRecursive(&url.URL{Scheme: "recursive", Host: "192.0.2.1"}, 0)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"192.0.2.1:53"}, r.roots)
+	}
+
+	_, err = newRecursive(&url.URL{Scheme: "recursive", Host: "root.example"}, 0)
+	assert.NotNil(t, err)
+}
+
+func TestLastLabels(t *testing.T) {
+	assert.Equal(t, "org.", lastLabels("www.example.org.", 1))
+	assert.Equal(t, "example.org.", lastLabels("www.example.org.", 2))
+	assert.Equal(t, "www.example.org.", lastLabels("www.example.org.", 3))
+	assert.Equal(t, "www.example.org.", lastLabels("www.example.org.", 5))
+	assert.Equal(t, "org.", parentZone("example.org."))
+	assert.Equal(t, ".", parentZone("org."))
+}
+
+func TestRecursiveLongName(t *testing.T) {
+	_, _, example, port := startTestZones(t)
+
+	u, err := AddressToUpstream("recursive://127.0.0.1:"+port, Options{Timeout: time.Second})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(testLongName, dns.TypeA)
+	res, err := u.Exchange(req)
+	if assert.Nil(t, err) && assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "1.2.3.5", res.Answer[0].(*dns.A).A.String())
+	}
+
+	// The minimised queries are limited, the full name is asked then
+	queries := example.takeQueries()
+	assert.LessOrEqual(t, len(queries), recursiveMaxMinimise)
+	assert.Equal(t, testLongName, queries[len(queries)-1])
+}
+
+func TestRecursiveOutOfZone(t *testing.T) {
+	_, _, example, port := startTestZones(t)
+	example.setForged(&dns.A{
+		Hdr: dns.RR_Header{Name: "www.example.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{6, 6, 6, 6},
+	})
+
+	u, err := AddressToUpstream("recursive://127.0.0.1:"+port, Options{Timeout: time.Second})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	res, err := u.Exchange(req)
+	if assert.Nil(t, err) && assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "www.example.org.", res.Answer[0].Header().Name)
+	}
+}
+
+func TestRecursiveDeadline(t *testing.T) {
+	// Nothing answers, the resolution fails when the deadline is reached
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	r, err := newRecursive(&url.URL{Scheme: "recursive", Host: conn.LocalAddr().String()}, 200*time.Millisecond)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	start := time.Now()
+	_, err = r.Exchange(req)
+	assert.NotNil(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	_, err = r.query(r.roots, "example.org.", dns.TypeA, dns.ClassINET, time.Now())
+	assert.NotNil(t, err)
+}
+
+func TestRecursiveDelegationsLimit(t *testing.T) {
+	r, err := newRecursive(&url.URL{Scheme: "recursive"}, 0)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	ns := []*dns.NS{{Hdr: dns.RR_Header{Ttl: 3600}}}
+	for i := 0; i < recursiveMaxDelegations+10; i++ {
+		r.cacheDelegation(fmt.Sprintf("zone%d.example.", i), []string{"192.0.2.1:53"}, ns)
+	}
+	assert.Len(t, r.delegations, recursiveMaxDelegations)
+}
+
+func TestMinimisedLabels(t *testing.T) {
+	// One label at a time first, then the rest evenly
+	n := 3
+	var got []int
+	for minimised := 1; minimised <= recursiveMaxMinimise; minimised++ {
+		n = minimisedLabels(n, 34, minimised)
+		got = append(got, n)
+	}
+	assert.Equal(t, []int{4, 5, 6, 10, 14, 19, 24, 29, 34, 35}, got)
+}
@@ -0,0 +1,64 @@
+package upstream
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Factory creates a custom Upstream for the address with the URL scheme it's
+// registered for, see Register.  opts are the options the address is parsed
+// with, the factory may ignore the ones it doesn't support.
+type Factory func(u *url.URL, opts Options) (Upstream, error)
+
+// builtinSchemes are the URL schemes handled by urlToUpstream
+var builtinSchemes = map[string]bool{
+	"sdns":      true,
+	"dns":       true,
+	"tcp":       true,
+	"quic":      true,
+	"tls":       true,
+	"mdns":      true,
+	"recursive": true,
+	"svcb":      true,
+	"srv":       true,
+	"https":     true,
+}
+
+var (
+	factories     = map[string]Factory{}
+	factoriesLock sync.RWMutex
+)
+
+// Register makes AddressToUpstream create the upstreams for the addresses with
+// the URL scheme using the factory, e.g. for "consul://service.example".  So
+// the custom upstreams can be used by the proxy like the built-in ones: as the
+// default upstreams, the upstreams for domains, and the fallbacks.  It's
+// usually called from the init function of the package implementing the
+// upstream.  The built-in schemes and the already registered ones can't be
+// registered.
+func Register(scheme string, f Factory) error {
+	scheme = strings.ToLower(scheme)
+	if scheme == "" || f == nil {
+		return fmt.Errorf("invalid upstream factory for scheme %q", scheme)
+	}
+
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+
+	if builtinSchemes[scheme] || factories[scheme] != nil {
+		return fmt.Errorf("upstream scheme %q is already registered", scheme)
+	}
+	factories[scheme] = f
+
+	return nil
+}
+
+// factory returns the factory registered for the URL scheme or nil
+func factory(scheme string) Factory {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	return factories[scheme]
+}
@@ -0,0 +1,57 @@
+package upstream
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// customUpstream is a custom upstream answering every query with REFUSED
+type customUpstream struct {
+	address string
+	timeout time.Duration
+}
+
+// Exchange implements the Upstream interface for *customUpstream
+func (u *customUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	res := &dns.Msg{}
+	res.SetRcode(m, dns.RcodeRefused)
+	return res, nil
+}
+
+// Address implements the Upstream interface for *customUpstream
+func (u *customUpstream) Address() string {
+	return u.address
+}
+
+func TestRegister(t *testing.T) {
+	f := func(u *url.URL, opts Options) (Upstream, error) {
+		return &customUpstream{address: u.String(), timeout: opts.Timeout}, nil
+	}
+	assert.Nil(t, Register("Test", f))
+
+	u, err := AddressToUpstream("test://backend.example/path", Options{Timeout: time.Second})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "test://backend.example/path", u.Address())
+	assert.Equal(t, time.Second, u.(*customUpstream).timeout)
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	res, err := u.Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeRefused, res.Rcode)
+
+	// The schemes can't be overridden
+	assert.NotNil(t, Register("test", f))
+	assert.NotNil(t, Register("tls", f))
+	assert.NotNil(t, Register("", f))
+	assert.NotNil(t, Register("other", nil))
+
+	_, err = AddressToUpstream("other://backend.example", Options{})
+	assert.NotNil(t, err)
+}